@@ -0,0 +1,386 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/idempotency"
+	"github.com/amammay/effectivecloudrun/internal/pubsubx"
+	"github.com/amammay/effectivecloudrun/internal/revisionx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/tracex"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *server) routes() {
+	// a banned client is turned away before it can take a slot of the shedder
+	if s.guard != nil {
+		s.router.Use(s.guard.Middleware("ip", s.guard.ClientIP))
+	}
+	// shed load before doing any other work, max_in_flight should match the cloud run concurrency. past it interactive
+	// callers wait briefly for a slot ahead of batch callers, who wait longer, and get every 5th slot while both wait
+	maxInFlight, _ := s.cfg.Int("max_in_flight")
+	s.shedder = httpx.NewShedder(httpx.WithMaxInFlight(maxInFlight), httpx.WithPriorities(s.priorityClass, 4,
+		httpx.PriorityClass{Name: "interactive", QueueSize: 20, MaxWait: 2 * time.Second},
+		httpx.PriorityClass{Name: "batch", QueueSize: 50, MaxWait: 10 * time.Second},
+	))
+	s.router.Use(s.shedder.Middleware)
+	s.brownout = httpx.NewBrownout(s.shedder.Pressure, s.logger)
+	s.registerBrownouts()
+	// a signed X-Debug-Trace header forces sampling, so it has to come before the span is started
+	s.router.Use(tracex.NewDebug([]byte(s.cfg.String("debug_trace_secret"))).Middleware)
+	s.router.Use(otelmux.Middleware(AppName))
+	s.router.Use(serverx.ColdStartMiddleware)
+	// validateConfig turned away anything that doesn't parse at startup
+	if every, _ := s.cfg.Int("access_log_sample_every"); every > 0 {
+		rate, _ := strconv.ParseFloat(s.cfg.String("access_log_rate"), 64)
+		s.router.Use(httpx.NewAccessLog(s.logger, httpx.WithAccessSampleEvery(every), httpx.WithAccessRate(rate)).Middleware)
+	}
+	s.router.Use(s.crash.Middleware)
+	if requestTimeout, err := s.cfg.Duration("request_timeout"); err == nil && requestTimeout > 0 {
+		s.router.Use(httpx.NewTimeout(s.logger, requestTimeout).Middleware)
+	}
+	s.router.Use(revisionx.Middleware(""))
+	disconnects := httpx.NewDisconnectWatcher(s.logger, httpx.WithDraining(func() bool {
+		return s.draining != nil && s.draining()
+	}))
+	s.router.Use(disconnects.Middleware)
+	if rate, err := strconv.ParseFloat(s.cfg.String("usage_sample_rate"), 64); err == nil && rate > 0 {
+		s.router.Use(httpx.NewUsageSampler(s.logger, httpx.WithUsageSampleRate(rate)).Middleware)
+	}
+	s.router.HandleFunc("/version", buildinfo.Handler()).Methods(http.MethodGet)
+	// several /api calls in one round trip, each item still passes the auth of /api on its own
+	s.router.Handle("/batch", httpx.NewBatch(s.router, httpx.WithBatchPrefix("/api/"))).Methods(http.MethodPost)
+
+	apiRouter := s.router.PathPrefix("/api").Subrouter()
+	if s.apiAuth != nil {
+		apiRouter.Use(s.apiAuth.Middleware)
+	}
+	if s.guard != nil {
+		// only verified identities are counted, a forged token can't get anyone else banned
+		apiRouter.Use(s.guard.Middleware("identity", func(request *http.Request) string {
+			if claims, ok := authx.ClaimsFromContext(request.Context()); ok {
+				return claims.Email
+			}
+			return ""
+		}))
+	}
+	// idempotent requests and pushed messages share one collection, their keys are kept apart by source
+	seen := dedupe.Firestore(s.firestore, s.cfg.String("dedupe_collection"))
+	// a client retrying a POST with the same Idempotency-Key gets the note it created the first time, not a second one
+	keyOpts := []idempotency.Option{idempotency.WithLogger(s.logger.Sugar())}
+	// a retry waits on the first request for as long as that one could still be running
+	if requestTimeout, err := s.cfg.Duration("request_timeout"); err == nil && requestTimeout > 0 {
+		keyOpts = append(keyOpts, idempotency.WithLockTTL(requestTimeout))
+	}
+	// every caller has keys of their own, without api auth, eg running locally, nobody can be told apart
+	scope := idempotency.Shared
+	if s.apiAuth != nil {
+		scope = idempotency.ByCaller
+	}
+	keys := idempotency.New(seen, scope, keyOpts...)
+	apiRouter.Use(keys.Middleware)
+	if s.quota != nil {
+		// after idempotency, a replayed response doesn't count against its caller again
+		apiRouter.Use(s.quota.Middleware(func(request *http.Request) string {
+			if claims, ok := authx.ClaimsFromContext(request.Context()); ok {
+				return claims.Email
+			}
+			return ""
+		}))
+	}
+	if s.meter != nil {
+		// after the quota, requests it rejected aren't billed
+		apiRouter.Use(s.meter.Middleware(func(request *http.Request) string {
+			if claims, ok := authx.ClaimsFromContext(request.Context()); ok {
+				return claims.Email
+			}
+			return ""
+		}))
+	}
+	apiRouter.HandleFunc("/notes", s.handleListNotes()).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/notes", s.handleCreateNote()).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/notes/{id}", s.handleGetNote()).Methods(http.MethodGet)
+	apiRouter.Handle("/notes:import", s.notesImport()).Methods(http.MethodPost)
+	// what our middleware put on the context of a request, only for requests signed with debug_trace_secret
+	apiRouter.HandleFunc("/debug/context", s.handleDebugContext()).Methods(http.MethodGet)
+	if s.uploads != nil {
+		apiRouter.HandleFunc("/uploads", s.handleUpload()).Methods(http.MethodPost)
+	}
+	if s.operations != nil {
+		s.operations.Register("notes.purge", s.purgeNotes)
+		apiRouter.HandleFunc("/notes:purge", s.handlePurgeNotes()).Methods(http.MethodPost)
+		apiRouter.PathPrefix("/operations/").Handler(s.operations.Handler()).Methods(http.MethodGet, http.MethodPost)
+		// cloud tasks delivers operations here until their work is done, a 503 has it retry with a backoff
+		s.router.Handle("/tasks/operations", s.tasksAuth.Middleware(s.operations.Worker())).Methods(http.MethodPost)
+	}
+
+	pushRouter := s.router.PathPrefix("/pubsub").Subrouter()
+	if s.pushAuth != nil {
+		pushRouter.Use(s.pushAuth.Middleware)
+	}
+	// a redelivery is acked without writing the event again, for as long as pub/sub retains messages by default
+	events := dedupe.New(seen, "pubsub", dedupe.WithTTL(7*24*time.Hour))
+	pushRouter.Handle("/events", pubsubx.Push(s.logger, s.handleEvent(), pubsubx.WithDedupe(events))).Methods(http.MethodPost)
+}
+
+// routeTemplate is the path template of the route matching request, eg /api/notes/{id}, or its path without one
+func routeTemplate(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return request.URL.Path
+}
+
+// priorityClass queues pushes and the callers in batch_callers as batch, everyone else as interactive. it runs ahead of
+// authentication so it reads unverified claims, a forged token only gets its request to a 403
+func (s *server) priorityClass(request *http.Request) string {
+	if strings.HasPrefix(request.URL.Path, "/pubsub/") || strings.HasPrefix(request.URL.Path, "/tasks/") {
+		return "batch"
+	}
+	if claims, ok := authx.PeekClaims(request); ok && claims.Email != "" {
+		for _, caller := range strings.Split(s.cfg.String("batch_callers"), ",") {
+			if strings.EqualFold(strings.TrimSpace(caller), claims.Email) {
+				return "batch"
+			}
+		}
+	}
+	return "interactive"
+}
+
+// registerBrownouts registers the features we degrade under pressure, again when brownout_pressure changes
+func (s *server) registerBrownouts() {
+	pressure, _ := strconv.ParseFloat(s.cfg.String("brownout_pressure"), 64)
+	s.brownout.Register("list_notes", pressure, "serve our last listing of notes instead of querying firestore")
+}
+
+// handleUpload streams the files of a multipart or raw upload into uploads_bucket and lists where they went
+func (s *server) handleUpload() http.HandlerFunc {
+	type uploadResponse struct {
+		Uploads []*httpx.Upload `json:"uploads"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		uploads, err := s.uploads.Receive(writer, request)
+		if err != nil {
+			// nobody learns where the files written before the failure went, they are left for a lifecycle rule
+			s.logger.WrapTraceContext(ctx).Warnw("upload failed", "written", len(uploads), "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		httpx.RespondJSON(writer, &uploadResponse{Uploads: uploads}, http.StatusCreated)
+	}
+}
+
+// uploadName names the object of an upload randomly, a client picked filename is only trusted for its extension
+func uploadName(upload *httpx.Upload) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	ext := strings.ToLower(path.Ext(upload.Filename))
+	if len(ext) > 8 || strings.ContainsAny(ext, "/\\") {
+		ext = ""
+	}
+	return "uploads/" + time.Now().UTC().Format("2006/01/02") + "/" + hex.EncodeToString(b) + ext
+}
+
+// maxNoteText keeps a note well below the 1MiB a firestore document can hold
+const maxNoteText = 16 << 10
+
+type note struct {
+	ID      string    `json:"id" firestore:"-"`
+	Text    string    `json:"text" firestore:"text"`
+	Author  string    `json:"author,omitempty" firestore:"author,omitempty"`
+	Created time.Time `json:"created" firestore:"created"`
+}
+
+// newestNotesKey is what notesCache keeps our listing of the newest notes under
+const newestNotesKey = "newest"
+
+// newestNotes is the query handleListNotes lists, notesWatch listens to the same one
+func (s *server) newestNotes() firestore.Query {
+	return s.firestore.Collection(s.cfg.String("notes_collection")).OrderBy("created", firestore.Desc).Limit(50)
+}
+
+// handleListNotes returns our 50 newest notes. while notesWatch is live they come from memory, a note created or
+// changed since invalidates them. during a brownout it serves the last listing this instance made, with its Age, and
+// only queries firestore when there is none yet
+func (s *server) handleListNotes() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if s.brownout.Degraded(ctx, "list_notes") {
+			s.listedMu.Lock()
+			listed, listedAt := s.listed, s.listedAt
+			s.listedMu.Unlock()
+			if listed != nil {
+				writer.Header().Set("Age", strconv.Itoa(int(time.Since(listedAt).Seconds())))
+				httpx.RespondJSON(writer, listed, http.StatusOK)
+				return
+			}
+		}
+		if s.notesWatch != nil && s.notesWatch.Live() {
+			if cached, ok := s.notesCache.Get(ctx, newestNotesKey); ok {
+				httpx.RespondJSON(writer, cached, http.StatusOK)
+				return
+			}
+		}
+		// a note changing while we query has its invalidation race our Set, see firestorex.Watcher.Generation
+		var generation uint64
+		if s.notesWatch != nil {
+			generation = s.notesWatch.Generation()
+		}
+		snapshots, err := s.newestNotes().Documents(ctx).GetAll()
+		if err != nil {
+			err = errs.Wrapf(err, errs.Unavailable, "notes.Documents()")
+			s.logger.WrapTraceContext(ctx).Errorw("notes.Documents()", "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		notes := make([]*note, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			n := &note{ID: snapshot.Ref.ID}
+			if err := snapshot.DataTo(n); err != nil {
+				httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "snapshot.DataTo(%s)", snapshot.Ref.Path))
+				return
+			}
+			notes = append(notes, n)
+		}
+		s.listedMu.Lock()
+		s.listed, s.listedAt = notes, time.Now()
+		s.listedMu.Unlock()
+		if s.notesWatch != nil && s.notesWatch.Generation() == generation {
+			s.notesCache.Set(ctx, newestNotesKey, notes)
+			// a snapshot that came in between our check and Set may have been invalidated before we cached
+			if s.notesWatch.Generation() != generation {
+				s.notesCache.Delete(ctx, newestNotesKey)
+			}
+		}
+		httpx.RespondJSON(writer, notes, http.StatusOK)
+	}
+}
+
+// createNoteRequest is the body of a note to create
+type createNoteRequest struct {
+	Text string `json:"text"`
+}
+
+func (r *createNoteRequest) Validate() []errs.FieldError {
+	switch {
+	case strings.TrimSpace(r.Text) == "":
+		return []errs.FieldError{{In: "body", Pointer: "/text", Constraint: "required", Message: "text is required"}}
+	case len(r.Text) > maxNoteText:
+		return []errs.FieldError{{In: "body", Pointer: "/text", Constraint: "maxLength",
+			Message: fmt.Sprintf("text is at most %d bytes", maxNoteText)}}
+	}
+	return nil
+}
+
+// handleCreateNote stores a note, authored by the caller when /api requires identity tokens
+func (s *server) handleCreateNote() http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var body createNoteRequest
+		if err := httpx.DecodeJSON(writer, r, &body, 64<<10); err != nil {
+			httpx.LogInvalid(ctx, s.logger, err)
+			httpx.RespondError(writer, r, err)
+			return
+		}
+
+		n := &note{Text: body.Text, Created: time.Now().UTC()}
+		if claims, ok := authx.ClaimsFromContext(ctx); ok {
+			n.Author = claims.Email
+		}
+		ref, _, err := s.firestore.Collection(s.cfg.String("notes_collection")).Add(ctx, n)
+		if err != nil {
+			httpx.RespondError(writer, r, errs.Wrapf(err, errs.Unavailable, "notes.Add()"))
+			return
+		}
+		n.ID = ref.ID
+		s.logger.WrapTraceContext(ctx).Infow("note created", "note_id", n.ID)
+		httpx.RespondJSON(writer, n, http.StatusCreated)
+	}
+}
+
+func (s *server) handleGetNote() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		id := mux.Vars(request)["id"]
+		snapshot, err := s.firestore.Collection(s.cfg.String("notes_collection")).Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			httpx.RespondError(writer, request, errs.New(errs.NotFound, "note not found"))
+			return
+		}
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "notes.Doc(%s).Get()", id))
+			return
+		}
+		n := &note{ID: snapshot.Ref.ID}
+		if err := snapshot.DataTo(n); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "snapshot.DataTo(%s)", snapshot.Ref.Path))
+			return
+		}
+		httpx.RespondJSON(writer, n, http.StatusOK)
+	}
+}
+
+// event is a pub/sub message as we keep it in firestore
+type event struct {
+	Subscription string            `firestore:"subscription"`
+	Attributes   map[string]string `firestore:"attributes,omitempty"`
+	Data         string            `firestore:"data"`
+	Published    time.Time         `firestore:"published"`
+	Received     time.Time         `firestore:"received"`
+}
+
+// handleEvent records every message pushed to us. redeliveries are mostly caught by pubsubx.WithDedupe, keying the
+// document by message id still has one that slips through, eg after its key was released, overwrite the same document
+// handleDebugContext dumps the context values of a request forced with tracex.Debug, to everyone else it isn't there
+func (s *server) handleDebugContext() http.HandlerFunc {
+	dump := ctxval.Handler()
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !tracex.Forced(request.Context()) {
+			httpx.RespondError(writer, request, errs.New(errs.NotFound, "not found"))
+			return
+		}
+		dump(writer, request)
+	}
+}
+
+func (s *server) handleEvent() pubsubx.HandlerFunc {
+	return func(ctx context.Context, push *pubsubx.PushRequest) error {
+		ctx, span := startSpan(ctx, "server.handleEvent()")
+		defer span.End()
+		span.SetAttributes(attribute.Int("event.bytes", len(push.Message.Data)))
+
+		e := &event{
+			Subscription: push.Subscription,
+			Attributes:   push.Message.Attributes,
+			Data:         string(push.Message.Data),
+			Published:    push.Message.PublishTime,
+			Received:     time.Now().UTC(),
+		}
+		if _, err := s.firestore.Collection(s.cfg.String("events_collection")).Doc(push.Message.ID).Set(ctx, e); err != nil {
+			return errs.Wrapf(err, errs.Unavailable, "events.Doc(%s).Set()", push.Message.ID)
+		}
+		s.logger.WrapTraceContext(ctx).Infow("event recorded", "subscription", push.Subscription)
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/firestorex"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/metering"
+	"strings"
+	"time"
+)
+
+// importNote is a line of a notes import, an id makes importing it again overwrite the note rather than duplicate it
+type importNote struct {
+	ID      string    `json:"id"`
+	Text    string    `json:"text"`
+	Created time.Time `json:"created"`
+}
+
+func (n *importNote) Validate() []errs.FieldError {
+	var fields []errs.FieldError
+	switch {
+	case strings.TrimSpace(n.Text) == "":
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/text", Constraint: "required", Message: "text is required"})
+	case len(n.Text) > maxNoteText:
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/text", Constraint: "maxLength",
+			Message: fmt.Sprintf("text is at most %d bytes", maxNoteText)})
+	}
+	// firestore document ids can't contain a slash, nor be . or ..
+	if strings.Contains(n.ID, "/") || n.ID == "." || n.ID == ".." || len(n.ID) > 1500 {
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/id", Constraint: "pattern",
+			Message: "id must be a valid firestore document id"})
+	}
+	return fields
+}
+
+// notesImport takes notes as ndjson, one note a line, written to firestore 500 at a time and acknowledged as they are
+func (s *server) notesImport() *httpx.Ingest {
+	write := firestorex.IngestSink(s.firestore, s.cfg.String("notes_collection"), func(record interface{}) string {
+		return record.(*note).ID
+	})
+	return httpx.NewIngest(func() interface{} { return &importNote{} }, func(ctx context.Context, records []interface{}) error {
+		var author string
+		if claims, ok := authx.ClaimsFromContext(ctx); ok {
+			author = claims.Email
+		}
+		now := time.Now().UTC()
+		notes := make([]interface{}, 0, len(records))
+		for _, record := range records {
+			imported := record.(*importNote)
+			n := &note{ID: imported.ID, Text: imported.Text, Author: author, Created: imported.Created}
+			if n.Created.IsZero() {
+				n.Created = now
+			}
+			notes = append(notes, n)
+		}
+		if err := write(ctx, notes); err != nil {
+			return err
+		}
+		// an import is metered by the notes it wrote rather than as a single request
+		metering.AddUnits(ctx, int64(len(notes)))
+		return nil
+	}, httpx.WithIngestMaxLineBytes(maxNoteText+4<<10))
+}
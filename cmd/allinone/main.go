@@ -0,0 +1,754 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/abuse"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/bqx"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/checks"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"github.com/amammay/effectivecloudrun/internal/crashx"
+	"github.com/amammay/effectivecloudrun/internal/firestorex"
+	"github.com/amammay/effectivecloudrun/internal/gcsx"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/lockx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/lro"
+	"github.com/amammay/effectivecloudrun/internal/memx"
+	"github.com/amammay/effectivecloudrun/internal/metadatax"
+	"github.com/amammay/effectivecloudrun/internal/metering"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"github.com/amammay/effectivecloudrun/internal/quota"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"github.com/amammay/effectivecloudrun/internal/revisionx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/tracex"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+	"google.golang.org/grpc"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AppName = "allinone"
+)
+
+type server struct {
+	router    *mux.Router
+	logger    *logx.AppLogger
+	cfg       *configx.Config
+	firestore *firestore.Client
+	// apiAuth and pushAuth guard /api and /pubsub, nil when their audience isn't configured
+	apiAuth  *authx.Verifier
+	pushAuth *authx.Verifier
+	// crash remembers our recent requests for post-mortems
+	crash *crashx.Recorder
+	// shedder is kept around so a config reload can change its limit
+	shedder *httpx.Shedder
+	// brownout degrades our expensive routes before the shedder has to reject requests
+	brownout *httpx.Brownout
+	// listed is our last listing of notes, served in its place during a brownout
+	listedMu sync.Mutex
+	listed   []*note
+	listedAt time.Time
+	// notesWatch keeps notesCache in step with firestore while it is live, both are nil unless notes_watch is set
+	notesWatch *firestorex.Watcher
+	notesCache *cachex.Cache
+	// uploads streams files posted to /api/uploads into uploads_bucket, nil when it isn't configured
+	uploads *httpx.Uploads
+	// operations runs work that outlives our requests through cloud tasks, nil when tasks_queue isn't configured
+	operations *lro.Manager
+	// tasksAuth guards /tasks, only cloud tasks calling as tasks_service_account gets in
+	tasksAuth *authx.Verifier
+	// quota counts the requests of every caller of /api, nil when api_quota isn't configured
+	quota *quota.Quota
+	// meter exports what callers of /api used, nil when neither metering_topic nor metering_table is configured
+	meter *metering.Meter
+	// guard bans clients and callers making bursts of requests, nil unless abuse_guard is set
+	guard *abuse.Guard
+	// draining is set to serverx.Server.Draining once our server exists
+	draining func() bool
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.router.ServeHTTP(writer, request)
+}
+
+// serverOption hands newServer one of the parts of our api that only exist when their config is set, a part left out
+// or given as nil turns its routes or middleware off
+type serverOption func(s *server)
+
+// withAuth guards /api with api and /pubsub with push
+func withAuth(api, push *authx.Verifier) serverOption {
+	return func(s *server) {
+		s.apiAuth, s.pushAuth = api, push
+	}
+}
+
+// withUploads serves /api/uploads
+func withUploads(uploads *httpx.Uploads) serverOption {
+	return func(s *server) {
+		s.uploads = uploads
+	}
+}
+
+// withOperations serves our operations, tasksAuth lets only cloud tasks run their work on /tasks/operations
+func withOperations(operations *lro.Manager, tasksAuth *authx.Verifier) serverOption {
+	return func(s *server) {
+		s.operations, s.tasksAuth = operations, tasksAuth
+	}
+}
+
+// withQuota counts the requests of every caller of /api against apiQuota
+func withQuota(apiQuota *quota.Quota) serverOption {
+	return func(s *server) {
+		s.quota = apiQuota
+	}
+}
+
+// withMeter records what every caller of /api used
+func withMeter(meter *metering.Meter) serverOption {
+	return func(s *server) {
+		s.meter = meter
+	}
+}
+
+// withGuard bans clients and callers making bursts of requests
+func withGuard(guard *abuse.Guard) serverOption {
+	return func(s *server) {
+		s.guard = guard
+	}
+}
+
+func newServer(logger *logx.AppLogger, cfg *configx.Config, firestoreClient *firestore.Client, crash *crashx.Recorder, opts ...serverOption) *server {
+	s := &server{router: mux.NewRouter(), logger: logger, cfg: cfg, firestore: firestoreClient, crash: crash}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.routes()
+	return s
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	// layer our config, defaults < ./config/<profile>.json < APP_* env < secrets mounted at /secrets
+	cfg, err := configx.Load(
+		configx.WithDefaults(map[string]string{
+			"admin_addr": "localhost:8081",
+			// when set the admin endpoints, /reload among them, live on our public port under /admin/ behind identity
+			// tokens for this audience instead of on admin_addr
+			"admin_audience":     "",
+			"trace_sample_ratio": "1",
+			// cloud monitoring accepts a point per time series at most every 5 seconds, a minute is plenty for dashboards
+			"metrics_interval": "60s",
+			"log_level":        "debug",
+			// send cpu, heap and goroutine profiles to cloud profiler, deploy with --no-cpu-throttling for it to be useful
+			"profiler": "false",
+			// the id of a pub/sub topic config changes are published on, see configx.Config.Subscribe
+			"config_topic": "",
+			// how much of firestore is ready before /readyz passes, none, dial or read, see firestorex.WarmupMode
+			"firestore_warmup": "read",
+			// how often we read the traffic split of our service to know if we are its stable or canary revision
+			"traffic_interval": "60s",
+			"max_in_flight":    "80",
+			// comma separated emails of callers queued behind interactive ones once max_in_flight is reached
+			"batch_callers": "",
+			// fraction of max_in_flight in use at which listing notes serves our last listing, see httpx.Brownout
+			"brownout_pressure": "0.8",
+			// has to match the --timeout of the service, requests get a deadline a little ahead of it
+			"request_timeout": "5m",
+			// gc percent once memx has set a soft memory limit, 0 keeps the go default
+			"gogc": "0",
+			// fraction of requests annotated with their cpu and memory usage, see httpx.UsageSampler
+			"usage_sample_rate": "0",
+			// our own access log, 0 leaves it to cloud run's request log, 1 logs every request, n logs 1 in n successes
+			"access_log_sample_every": "0",
+			// at most this many successful requests logged a second, 0 is unlimited
+			"access_log_rate": "0",
+			// signs X-Debug-Trace headers that force a trace and debug logs for one request, see tracex.Debug
+			"debug_trace_secret": "",
+			// put our trace id on 5xx responses for users to report, turn off where trace ids are considered sensitive
+			"error_trace_ids": "true",
+			// answer every public request with a 503 until it is turned off again, see serverx.Server.SetMaintenance
+			"maintenance":        "false",
+			"maintenance_reason": "",
+			// the url of this service, callers of /api need an identity token minted for it
+			"api_audience": "",
+			// the audience set on the push subscription, and the service account it pushes as
+			"push_audience":        "",
+			"push_service_account": "",
+			"notes_collection":     "notes",
+			"events_collection":    "events",
+			// keep a firestore listener on our newest notes and serve them from memory while it is live, only worth it
+			// deployed with --no-cpu-throttling and --min-instances, see firestorex.Watcher
+			"notes_watch": "false",
+			// publish every change to our notes on this pub/sub topic, from the one instance holding the notes_changes lock
+			"notes_changes_topic": "",
+			"locks_collection":    "locks",
+			// where watchers keep what they have handled, so the next instance picks up where the last one stopped
+			"watch_checkpoints_collection": "watch_checkpoints",
+			// what pushed messages and requests carrying an Idempotency-Key were processed, set a ttl policy on its
+			// expires field or run cmd/dedupesweep
+			"dedupe_collection": "dedupe",
+			// the bucket files posted to /api/uploads are streamed into, /api/uploads is only served when it is set
+			"uploads_bucket": "",
+			// the cloud tasks queue our long running operations are worked off, projects/<project>/locations/<region>/queues/<queue>,
+			// /api/operations and the routes starting operations are only served when it is set
+			"tasks_queue": "",
+			// the identity cloud tasks calls us with, it needs run.invoker on this service
+			"tasks_service_account": "",
+			// the full url of /tasks/operations on this service, also the audience of the tokens cloud tasks presents
+			"operations_url":        "",
+			"operations_collection": "operations",
+			// how long operations are kept once created, set a ttl policy on their expires field
+			"operations_ttl": "168h",
+			// how enqueueing operations is retried, eg attempts=5,max=10s, on top of retry.Default, see retry.Parse
+			"tasks_retry": "",
+			// requests per caller of /api, eg daily=1000,monthly=20000, none unless it is set, see quota.ParseLimits
+			"api_quota":           "",
+			"quota_collection":    "quotas",
+			"quota_sync_interval": "10s",
+			// where usage events of callers of /api are exported for billing, a pub/sub topic id or a bigquery
+			// dataset.table in our project, at most one of them
+			"metering_topic": "",
+			"metering_table": "",
+			// ban clients and callers that burst past their limit per minute for abuse_ban, see abuse.Guard
+			"abuse_guard":          "false",
+			"abuse_ip_limit":       "600",
+			"abuse_identity_limit": "300",
+			"abuse_ban":            "10m",
+			"abuse_collection":     "abuse_bans",
+			// proxies of ours in front of the service appending to X-Forwarded-For, 1 behind an external load balancer
+			"abuse_proxy_hops": "0",
+		}),
+		configx.WithProfileDir("config"),
+		configx.WithEnvPrefix("APP"),
+		configx.WithSecretsDir("/secrets"),
+		configx.WithSensitiveKeys("debug_trace_secret"),
+	)
+	if err != nil {
+		return fmt.Errorf("configx.Load(): %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		return fmt.Errorf("validateConfig(): %v", err)
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	sampleRatio, err := strconv.ParseFloat(cfg.String("trace_sample_ratio"), 64)
+	if err != nil {
+		return fmt.Errorf("strconv.ParseFloat(trace_sample_ratio): %v", err)
+	}
+	sampler, err := tracex.NewSampler(sampleRatio)
+	if err != nil {
+		return fmt.Errorf("tracex.NewSampler(): %v", err)
+	}
+	metricsInterval, err := cfg.Duration("metrics_interval")
+	if err != nil {
+		return fmt.Errorf("cfg.Duration(metrics_interval): %v", err)
+	}
+	profile, err := cfg.Bool("profiler")
+	if err != nil {
+		return fmt.Errorf("cfg.Bool(profiler): %v", err)
+	}
+	// logs, traces, metrics and profiles, torn down together once our server has shut down
+	telemetry, err := obs.Init(ctx, obs.Config{
+		ServiceName:     AppName,
+		Sampler:         tracex.ForceSampler(sampler),
+		MetricsInterval: metricsInterval,
+		Profile:         profile,
+	})
+	if err != nil {
+		return fmt.Errorf("obs.Init(): %v", err)
+	}
+	projectID, onGCE := telemetry.ProjectID, telemetry.OnGCE
+	loggerClient := telemetry.Logger
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	cfg.Log(logger)
+	cfg.Validate(validateConfig)
+	logLevel, _ := parseLevel(cfg.String("log_level"))
+	loggerClient.Level.SetLevel(logLevel)
+	errorTraceIDs, _ := cfg.Bool("error_trace_ids")
+	httpx.SetCorrelationIDs(errorTraceIDs)
+
+	// size the gc to our container, after metrics so its gc metrics get exported
+	gogc, err := cfg.Int("gogc")
+	if err != nil {
+		return fmt.Errorf("cfg.Int(gogc): %v", err)
+	}
+	tuning, err := memx.Tune(logger, memx.WithGOGC(gogc))
+	if err != nil {
+		return fmt.Errorf("memx.Tune(): %v", err)
+	}
+
+	// flush the requests we were serving if we panic or get close to being killed for running out of memory
+	crash := crashx.New(loggerClient, crashx.WithMemoryThreshold(uint64(tuning.ContainerLimit)/10*9))
+	defer crash.Recover()
+	go crash.Watch(ctx)
+
+	unaryInterceptor := grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor())
+	streamInterceptor := grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor())
+	firestoreWarmup, err := firestorex.ParseWarmupMode(cfg.String("firestore_warmup"))
+	if err != nil {
+		return fmt.Errorf("firestorex.ParseWarmupMode(firestore_warmup): %v", err)
+	}
+	warmClient, err := firestorex.NewClient(ctx, projectID, option.WithGRPCDialOption(unaryInterceptor), option.WithGRPCDialOption(streamInterceptor))
+	if err != nil {
+		return fmt.Errorf("firestorex.NewClient(): %v", err)
+	}
+	firestoreClient := warmClient.Client
+
+	var apiAuth, pushAuth *authx.Verifier
+	if audience := cfg.String("api_audience"); audience != "" {
+		apiAuth, err = authx.NewVerifier(ctx, audience)
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(api_audience): %v", err)
+		}
+	}
+	if audience := cfg.String("push_audience"); audience != "" {
+		var opts []authx.Option
+		if sa := cfg.String("push_service_account"); sa != "" {
+			opts = append(opts, authx.WithAllowedEmails(sa))
+		}
+		pushAuth, err = authx.NewVerifier(ctx, audience, opts...)
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(push_audience): %v", err)
+		}
+	}
+
+	var uploads *httpx.Uploads
+	if bucket := cfg.String("uploads_bucket"); bucket != "" {
+		storageService, err := storage.NewService(ctx)
+		if err != nil {
+			return fmt.Errorf("storage.NewService(): %v", err)
+		}
+		uploads = httpx.NewUploads(gcsx.Sink(storageService, bucket, uploadName),
+			httpx.WithUploadMaxBytes(100<<20),
+			httpx.WithUploadMaxFiles(5),
+			httpx.WithUploadContentTypes("image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf"),
+		)
+	}
+
+	var operations *lro.Manager
+	var tasksAuth *authx.Verifier
+	if queueName := cfg.String("tasks_queue"); queueName != "" {
+		target, serviceAccount := cfg.String("operations_url"), cfg.String("tasks_service_account")
+		if target == "" || serviceAccount == "" {
+			return fmt.Errorf("operations_url and tasks_service_account must be set along with tasks_queue")
+		}
+		operationsTTL, err := cfg.Duration("operations_ttl")
+		if err != nil {
+			return fmt.Errorf("cfg.Duration(operations_ttl): %v", err)
+		}
+		tasksRetry, err := retry.FromConfig(cfg, "tasks_retry", retry.Default())
+		if err != nil {
+			return fmt.Errorf("retry.FromConfig(): %v", err)
+		}
+		queue, err := lro.CloudTasks(ctx, queueName, target, serviceAccount, lro.WithEnqueueRetry(tasksRetry))
+		if err != nil {
+			return fmt.Errorf("lro.CloudTasks(): %v", err)
+		}
+		operations = lro.New(lro.Firestore(firestoreClient, cfg.String("operations_collection"), operationsTTL), queue, lro.WithLogger(logger))
+		if tasksAuth, err = authx.NewVerifier(ctx, target, authx.WithAllowedEmails(serviceAccount)); err != nil {
+			return fmt.Errorf("authx.NewVerifier(operations_url): %v", err)
+		}
+	}
+
+	firestoreCheck := checks.Firestore(firestoreClient, "warmup", "ping")
+	firestoreChecker := checks.New("firestore", firestoreCheck)
+
+	var instanceID string
+	if onGCE {
+		if instanceID, err = metadatax.InstanceID(ctx); err != nil {
+			return fmt.Errorf("metadatax.InstanceID(): %v", err)
+		}
+	}
+
+	// log what cloud run actually deployed, a forgotten --min-instances or --concurrency is easy to spot this way
+	var inspector *revisionx.Inspector
+	if onGCE && revisionx.Revision() != "" {
+		region, err := metadatax.Region(ctx)
+		if err != nil {
+			return fmt.Errorf("metadatax.Region(): %v", err)
+		}
+		if inspector, err = revisionx.NewInspector(ctx, projectID, region, revisionx.WithInspectLogger(logger)); err != nil {
+			return fmt.Errorf("revisionx.NewInspector(): %v", err)
+		}
+		inspectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		settings, err := inspector.Inspect(inspectCtx)
+		cancel()
+		if err != nil {
+			// not being allowed to read our own revision shouldn't keep us from serving
+			logger.Warnw("inspecting our revision, grant our service account roles/run.viewer", "err", err)
+		} else {
+			logger.Infow("deployed settings", settings.Fields()...)
+		}
+		// labels our metrics and logs with whether we are the stable or the canary revision as traffic moves
+		trafficInterval, err := cfg.Duration("traffic_interval")
+		if err != nil {
+			return fmt.Errorf("cfg.Duration(traffic_interval): %v", err)
+		}
+		go inspector.Watch(ctx, trafficInterval)
+	}
+
+	var apiQuota *quota.Quota
+	var backgroundOpts []serverx.Option
+	limits, err := quota.ParseLimits(cfg.String("api_quota"))
+	if err != nil {
+		return fmt.Errorf("quota.ParseLimits(api_quota): %v", err)
+	}
+	if len(limits) > 0 {
+		if apiAuth == nil {
+			return fmt.Errorf("api_audience must be set along with api_quota, callers are told apart by their identity")
+		}
+		syncInterval, err := cfg.Duration("quota_sync_interval")
+		if err != nil {
+			return fmt.Errorf("cfg.Duration(quota_sync_interval): %v", err)
+		}
+		// 10 shards take a busy caller's adds from every instance syncing every few seconds
+		apiQuota = quota.New(quota.Firestore(firestoreClient, cfg.String("quota_collection"), 10), "api", limits, quota.WithLogger(logger))
+		backgroundOpts = append(backgroundOpts, serverx.WithBackground("quota_sync", syncInterval, apiQuota.Reconcile))
+	}
+
+	meter, meteringClose, err := newMeter(ctx, cfg, projectID, logger)
+	if err != nil {
+		return fmt.Errorf("newMeter(): %v", err)
+	}
+	if meter != nil && apiAuth == nil {
+		return fmt.Errorf("api_audience must be set along with metering_topic or metering_table, usage is recorded by caller")
+	}
+
+	guard, err := newGuard(loggerClient, cfg, firestoreClient)
+	if err != nil {
+		return fmt.Errorf("newGuard(): %v", err)
+	}
+	if guard != nil {
+		// bans of the other instances are picked up within seconds, our own hold right away
+		backgroundOpts = append(backgroundOpts, serverx.WithBackground("abuse_sync", 10*time.Second, guard.Sync))
+	}
+
+	handler := newServer(loggerClient, cfg, firestoreClient, crash,
+		withAuth(apiAuth, pushAuth),
+		withUploads(uploads),
+		withOperations(operations, tasksAuth),
+		withQuota(apiQuota),
+		withMeter(meter),
+		withGuard(guard),
+	)
+	// srv is created once its options are, the throttling our watchers check is only asked for while we serve
+	var srv *serverx.Server
+	var daemons []serverx.Option
+	notesWatch, err := cfg.Bool("notes_watch")
+	if err != nil {
+		return fmt.Errorf("cfg.Bool(notes_watch): %v", err)
+	}
+	if notesWatch {
+		// handleListNotes never caches a listing that raced a change, the ttl only backs up a watcher that went quiet
+		if handler.notesCache, err = cachex.New(cachex.WithName("notes"), cachex.WithMemoryPercent(5), cachex.WithTTL(time.Minute)); err != nil {
+			return fmt.Errorf("cachex.New(): %v", err)
+		}
+		handler.notesWatch, err = firestorex.NewWatcher("notes", handler.newestNotes(),
+			firestorex.InvalidateCache(handler.notesCache, func(doc *firestore.DocumentSnapshot) []string {
+				return []string{newestNotesKey}
+			}),
+			firestorex.WithWatchLogger(logger),
+			firestorex.WithPausedWhen(func() bool { return srv.CPUThrottled() }),
+		)
+		if err != nil {
+			return fmt.Errorf("firestorex.NewWatcher(notes): %v", err)
+		}
+		daemons = append(daemons, serverx.WithDaemon("notes_watch", handler.notesWatch.Run))
+	}
+	var changesClient *pubsub.Client
+	var changesTopic *pubsub.Topic
+	if topicID := cfg.String("notes_changes_topic"); topicID != "" {
+		if changesClient, err = pubsub.NewClient(ctx, projectID); err != nil {
+			return fmt.Errorf("pubsub.NewClient(): %v", err)
+		}
+		changesTopic = changesClient.Topic(topicID)
+		changesTopic.EnableMessageOrdering = true
+		checkpoint := firestoreClient.Collection(cfg.String("watch_checkpoints_collection")).Doc("notes_changes")
+		publisher, err := firestorex.NewWatcher("notes_changes", firestoreClient.Collection(cfg.String("notes_collection")).Query,
+			firestorex.PublishChanges(changesTopic, checkpoint),
+			firestorex.WithWatchLogger(logger),
+		)
+		if err != nil {
+			return fmt.Errorf("firestorex.NewWatcher(notes_changes): %v", err)
+		}
+		// every instance listening would publish every change, only the one holding the lock does
+		locker := lockx.New(firestoreClient, cfg.String("locks_collection"), instanceID, lockx.WithLogger(logger))
+		daemons = append(daemons, serverx.WithDaemon("notes_changes", func(ctx context.Context) error {
+			return locker.Lead(ctx, "notes_changes", func(ctx context.Context, lease *lockx.Lease) error {
+				return publisher.Run(ctx)
+			})
+		}))
+	}
+
+	serverOpts := []serverx.Option{
+		serverx.WithInstanceID(instanceID),
+		serverx.WithLeakDetector(serverx.NewLeakDetector(logger)),
+		serverx.WithReadinessCheck(firestoreChecker.Name(), firestoreChecker.Ready),
+		serverx.WithConfig(cfg),
+		serverx.WithLogLevel(loggerClient.Level),
+		serverx.WithTraceSampling(sampler),
+	}
+	// /reload rewrites our config, when an audience is configured only callers with an identity token for it reach the
+	// admin endpoints under /admin/, otherwise they only listen on a local port that cloud run never routes traffic to
+	if audience := cfg.String("admin_audience"); audience != "" {
+		adminAuth, err := authx.NewVerifier(ctx, audience)
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(): %v", err)
+		}
+		serverOpts = append(serverOpts, serverx.WithAdminGuard(adminAuth.Middleware))
+	} else {
+		serverOpts = append(serverOpts, serverx.WithAdminAddr(cfg.String("admin_addr")))
+	}
+	// each step is timed on its own in the cold start log, a faster cold start or a faster first request
+	switch firestoreWarmup {
+	case firestorex.WarmupRead:
+		serverOpts = append(serverOpts,
+			serverx.WithWarmup("firestore.dial", warmClient.Connected),
+			serverx.WithWarmup("firestore.read", serverx.WarmupFunc(firestoreCheck)),
+		)
+	case firestorex.WarmupDial:
+		serverOpts = append(serverOpts, serverx.WithWarmup("firestore.dial", warmClient.Connected))
+	}
+	serverOpts = append(serverOpts, daemons...)
+	serverOpts = append(serverOpts, backgroundOpts...)
+	// telemetry is flushed after every hook so it includes them, with time of its own however long draining takes
+	serverOpts = append(serverOpts, telemetry.ServerOptions()...)
+	srv = serverx.New("", handler, logger, serverOpts...)
+	handler.draining = srv.Draining
+	if apiQuota != nil {
+		// what we admitted since the last sync counts against our callers once we are gone
+		srv.OnShutdownNamed("quota_sync", apiQuota.Reconcile)
+	}
+	if meter != nil {
+		// usage recorded by requests that drained is exported before we close its pub/sub client
+		srv.OnShutdownNamed("metering", func(ctx context.Context) error {
+			err := meter.Close(ctx)
+			meteringClose()
+			return err
+		})
+	}
+	setMaintenance := func(cfg *configx.Config) {
+		enabled, _ := cfg.Bool("maintenance")
+		srv.SetMaintenance(enabled, cfg.String("maintenance_reason"), 0)
+	}
+	setMaintenance(cfg)
+
+	// tunables that take effect without a redeploy, on a POST to the admin /reload or a message on config_topic
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		logger.Infow("config reloaded", "changed", changed, "values", cfg.Redacted(), "provenance", cfg.Provenance())
+	})
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		level, _ := parseLevel(cfg.String("log_level"))
+		loggerClient.Level.SetLevel(level)
+	}, "log_level")
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		// validateConfig already turned away a ratio SetRatio would reject
+		ratio, _ := strconv.ParseFloat(cfg.String("trace_sample_ratio"), 64)
+		sampler.SetRatio(ratio)
+	}, "trace_sample_ratio")
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		maxInFlight, _ := cfg.Int("max_in_flight")
+		handler.shedder.SetMaxInFlight(maxInFlight)
+	}, "max_in_flight")
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		handler.registerBrownouts()
+	}, "brownout_pressure")
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		enabled, _ := cfg.Bool("error_trace_ids")
+		httpx.SetCorrelationIDs(enabled)
+	}, "error_trace_ids")
+	cfg.OnChange(func(cfg *configx.Config, changed []string) {
+		setMaintenance(cfg)
+	}, "maintenance", "maintenance_reason")
+	if topicID := cfg.String("config_topic"); topicID != "" && onGCE {
+		pubsubClient, err := pubsub.NewClient(ctx, projectID)
+		if err != nil {
+			return fmt.Errorf("pubsub.NewClient(): %v", err)
+		}
+		subscribeCtx, stopSubscribe := context.WithCancel(ctx)
+		subscribed := make(chan struct{})
+		go func() {
+			defer close(subscribed)
+			if err := cfg.Subscribe(subscribeCtx, pubsubClient, topicID, AppName+"-config-"+instanceID, logger); err != nil {
+				logger.Errorw("cfg.Subscribe()", "err", err)
+			}
+		}()
+		// stop before the subscription's client goes away, so it gets to delete the subscription of this instance
+		srv.OnShutdownNamed("config_subscription", func(ctx context.Context) error {
+			stopSubscribe()
+			select {
+			case <-subscribed:
+			case <-ctx.Done():
+			}
+			if err := pubsubClient.Close(); err != nil {
+				return fmt.Errorf("pubsubClient.Close(): %v", err)
+			}
+			return nil
+		})
+	}
+	if inspector != nil {
+		srv.AdminHandle("/deployment", inspector)
+	}
+	srv.AdminHandle("/brownout", handler.brownout)
+
+	// hooks run in order once in flight requests have drained, and our daemons have returned
+	if changesClient != nil {
+		srv.OnShutdownNamed("notes_changes", func(ctx context.Context) error {
+			changesTopic.Stop()
+			if err := changesClient.Close(); err != nil {
+				return fmt.Errorf("changesClient.Close(): %v", err)
+			}
+			return nil
+		})
+	}
+	srv.OnShutdownNamed("firestore_checker", firestoreChecker.Close)
+	srv.OnShutdownNamed("firestore", func(ctx context.Context) error {
+		if err := firestoreClient.Close(); err != nil {
+			return fmt.Errorf("firestoreClient.Close(): %v", err)
+		}
+		return nil
+	})
+	return srv.ListenAndServe()
+}
+
+// validateConfig checks the tunables we change at runtime and those routes reads without checking, at startup and
+// before a reload swaps them in
+func validateConfig(cfg *configx.Config) error {
+	if _, err := parseLevel(cfg.String("log_level")); err != nil {
+		return fmt.Errorf("parseLevel(log_level): %v", err)
+	}
+	ratio, err := strconv.ParseFloat(cfg.String("trace_sample_ratio"), 64)
+	if err != nil {
+		return fmt.Errorf("strconv.ParseFloat(trace_sample_ratio): %v", err)
+	}
+	if !(ratio >= 0 && ratio <= 1) {
+		return fmt.Errorf("trace_sample_ratio %v is not between 0 and 1", ratio)
+	}
+	if maxInFlight, err := cfg.Int("max_in_flight"); err != nil || maxInFlight < 0 {
+		return fmt.Errorf("max_in_flight has to be a number of requests, 0 for no limit")
+	}
+	pressure, err := strconv.ParseFloat(cfg.String("brownout_pressure"), 64)
+	if err != nil || pressure <= 0 {
+		return fmt.Errorf("brownout_pressure has to be a fraction of max_in_flight above 0")
+	}
+	if _, err := cfg.Bool("error_trace_ids"); err != nil {
+		return fmt.Errorf("cfg.Bool(error_trace_ids): %v", err)
+	}
+	if _, err := cfg.Bool("maintenance"); err != nil {
+		return fmt.Errorf("cfg.Bool(maintenance): %v", err)
+	}
+	if every, err := cfg.Int("access_log_sample_every"); err != nil || every < 0 {
+		return fmt.Errorf("access_log_sample_every has to be a number of requests, 0 for no access log")
+	}
+	if rate, err := strconv.ParseFloat(cfg.String("access_log_rate"), 64); err != nil || !(rate >= 0) || math.IsInf(rate, 0) {
+		return fmt.Errorf("access_log_rate has to be a number of entries a second, 0 for no limit")
+	}
+	return nil
+}
+
+func parseLevel(text string) (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(text))
+	return level, err
+}
+
+// newMeter exports usage to metering_topic or metering_table, it returns a nil meter when neither is set. close
+// releases the client of the sink once the meter is closed
+func newMeter(ctx context.Context, cfg *configx.Config, projectID string, logger *zap.SugaredLogger) (*metering.Meter, func(), error) {
+	topicID, table := cfg.String("metering_topic"), cfg.String("metering_table")
+	switch {
+	case topicID != "" && table != "":
+		return nil, nil, fmt.Errorf("set metering_topic or metering_table, not both")
+	case topicID != "":
+		client, err := pubsub.NewClient(ctx, projectID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pubsub.NewClient(): %v", err)
+		}
+		meter, err := metering.New(metering.PubSub(client.Topic(topicID)), metering.WithName("pubsub"), metering.WithRoute(routeTemplate), metering.WithLogger(logger))
+		if err != nil {
+			client.Close()
+			return nil, nil, fmt.Errorf("metering.New(): %v", err)
+		}
+		return meter, func() { client.Close() }, nil
+	case table != "":
+		parts := strings.SplitN(table, ".", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("metering_table is dataset.table, got %q", table)
+		}
+		svc, err := bigquery.NewService(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bigquery.NewService(): %v", err)
+		}
+		sink := metering.BigQuery(svc, bqx.Table{Project: projectID, Dataset: parts[0], Table: parts[1]})
+		meter, err := metering.New(sink, metering.WithName("bigquery"), metering.WithRoute(routeTemplate), metering.WithLogger(logger))
+		if err != nil {
+			return nil, nil, fmt.Errorf("metering.New(): %v", err)
+		}
+		return meter, func() {}, nil
+	}
+	return nil, nil, nil
+}
+
+// newGuard bans bursts by ip and by caller once abuse_guard is set, it returns nil otherwise. pushes and cloud tasks
+// come from google's addresses in bursts of their own and are left alone
+func newGuard(logger *logx.AppLogger, cfg *configx.Config, firestoreClient *firestore.Client) (*abuse.Guard, error) {
+	enabled, err := cfg.Bool("abuse_guard")
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Bool(abuse_guard): %v", err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+	ipLimit, err := cfg.Int("abuse_ip_limit")
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Int(abuse_ip_limit): %v", err)
+	}
+	identityLimit, err := cfg.Int("abuse_identity_limit")
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Int(abuse_identity_limit): %v", err)
+	}
+	hops, err := cfg.Int("abuse_proxy_hops")
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Int(abuse_proxy_hops): %v", err)
+	}
+	banFor, err := cfg.Duration("abuse_ban")
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Duration(abuse_ban): %v", err)
+	}
+	return abuse.New(logger, abuse.Firestore(firestoreClient, cfg.String("abuse_collection")),
+		abuse.WithLimit("ip", ipLimit),
+		abuse.WithLimit("identity", identityLimit),
+		abuse.WithBanDuration(banFor),
+		abuse.WithProxyHops(hops),
+		abuse.WithExempt(func(request *http.Request) bool {
+			return strings.HasPrefix(request.URL.Path, "/pubsub/") || strings.HasPrefix(request.URL.Path, "/tasks/")
+		}),
+	), nil
+}
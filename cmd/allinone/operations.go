@@ -0,0 +1,108 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/lro"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"time"
+)
+
+// purgeNotesRequest asks for the notes created before Before to be deleted
+type purgeNotesRequest struct {
+	Before time.Time `json:"before"`
+}
+
+func (r *purgeNotesRequest) Validate() []errs.FieldError {
+	if r.Before.IsZero() {
+		return []errs.FieldError{{In: "body", Pointer: "/before", Constraint: "required", Message: "before is required"}}
+	}
+	return nil
+}
+
+type purgeNotesResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// handlePurgeNotes starts an operation deleting old notes, there can be far more of them than a request has time to
+// delete. it answers with a 202 and the operation to poll
+func (s *server) handlePurgeNotes() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		var body purgeNotesRequest
+		if err := httpx.DecodeJSON(writer, request, &body, 4<<10); err != nil {
+			httpx.LogInvalid(ctx, s.logger, err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		op, err := s.operations.Start(ctx, "notes.purge", &body)
+		if err != nil {
+			s.logger.WrapTraceContext(ctx).Errorw("s.operations.Start()", "err", err)
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.operations.Start()"))
+			return
+		}
+		s.logger.WrapTraceContext(ctx).Infow("purging notes", "operation", op.ID, "before", body.Before)
+		s.operations.RespondAccepted(writer, op, "/api/operations/"+op.ID)
+	}
+}
+
+// purgeNotes deletes the notes of a purge operation in batches, stopping between batches once it is cancelled. a
+// retry starts over on the notes that are left
+func (s *server) purgeNotes(ctx context.Context, run *lro.Run) (interface{}, error) {
+	var body purgeNotesRequest
+	if err := run.Decode(&body); err != nil {
+		return nil, err
+	}
+	query := s.firestore.Collection(s.cfg.String("notes_collection")).Where("created", "<", body.Before)
+	total, err := count(ctx, query)
+	if err != nil {
+		return nil, errs.Wrapf(err, errs.Unavailable, "count()")
+	}
+	result := &purgeNotesResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		snapshots, err := query.Select().Limit(500).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, errs.Wrapf(err, errs.Unavailable, "notes.Documents()")
+		}
+		if len(snapshots) == 0 {
+			return result, nil
+		}
+		batch := s.firestore.Batch()
+		for _, snapshot := range snapshots {
+			batch.Delete(snapshot.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return nil, errs.Wrapf(err, errs.Unavailable, "batch.Commit()")
+		}
+		result.Deleted += len(snapshots)
+		if total > 0 && result.Deleted < total {
+			if err := run.Progress(ctx, result.Deleted*100/total); err != nil {
+				s.logger.WrapTraceContext(ctx).Warnw("run.Progress()", "err", err)
+			}
+		}
+	}
+}
+
+// count counts the documents of query without reading their fields
+func count(ctx context.Context, query firestore.Query) (int, error) {
+	iter := query.Select().Documents(ctx)
+	defer iter.Stop()
+	n := 0
+	for {
+		_, err := iter.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("iter.Next(): %v", err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/amammay/effectivecloudrun/cmd/allinone"
+)
+
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// rates may be a minute old, refreshing every 20 seconds keeps them well within that while a run or two is slow
+	maxAge, interval := time.Minute, 20*time.Second
+	if v := os.Getenv("MAX_AGE"); v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("time.ParseDuration(MAX_AGE): %v", err)
+		}
+	}
+	if v := os.Getenv("REFRESH_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("time.ParseDuration(REFRESH_INTERVAL): %v", err)
+		}
+	}
+
+	cache, err := cachex.New(cachex.WithName("rates"), cachex.WithMemoryPercent(5))
+	if err != nil {
+		return fmt.Errorf("cachex.New(): %v", err)
+	}
+	rates := cachex.NewRefresher(cache, loadRates, maxAge)
+
+	var srv *serverx.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rates/", func(writer http.ResponseWriter, request *http.Request) {
+		base := strings.ToUpper(strings.TrimPrefix(request.URL.Path, "/rates/"))
+		if len(base) != 3 {
+			httpx.RespondError(writer, request, errs.Invalid(errs.FieldError{In: "path", Pointer: "/base", Constraint: "format", Message: "base is a 3 letter currency code"}))
+			return
+		}
+		value, err := rates.Get(request.Context(), base)
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "rates.Get()"))
+			return
+		}
+		httpx.RespondJSON(writer, value, http.StatusOK)
+	})
+	mux.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
+		httpx.RespondJSON(writer, map[string]interface{}{"cpu_throttled": srv.CPUThrottled(), "cached": cache.Len()}, http.StatusOK)
+	})
+
+	// with --no-cpu-throttling the refresh runs between requests and they are served from memory, throttled it pauses
+	// and requests reload whatever got older than maxAge themselves
+	srv = serverx.New("", otelhttp.NewHandler(mux, "cacherefresh"), logger,
+		serverx.WithBackground("refresh_rates", interval, rates.Refresh),
+	)
+	return srv.ListenAndServe()
+}
+
+// exchangeRates is what our slow upstream knows about a currency
+type exchangeRates struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+	AsOf  time.Time          `json:"as_of"`
+}
+
+// loadRates stands in for a slow dependency, a second and a half is a request we'd rather not have users wait on
+func loadRates(ctx context.Context, base string) (interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(1500 * time.Millisecond):
+	}
+	rates := &exchangeRates{Base: base, Rates: map[string]float64{}, AsOf: time.Now().UTC()}
+	for _, currency := range []string{"USD", "EUR", "GBP", "JPY", "CAD"} {
+		if currency != base {
+			rates.Rates[currency] = 0.5 + rand.Float64()
+		}
+	}
+	return rates, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/statex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxHistory is how many messages a conversation keeps, older ones fall off
+const maxHistory = 50
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type message struct {
+	From string    `json:"from" firestore:"from"`
+	Text string    `json:"text" firestore:"text"`
+	Sent time.Time `json:"sent" firestore:"sent"`
+}
+
+// conversation is the state of a session, kept in memory on the instance affinity sends the client to
+type conversation struct {
+	Messages []message `json:"messages" firestore:"messages"`
+}
+
+func newConversation() interface{} {
+	return &conversation{}
+}
+
+type server struct {
+	mux    *http.ServeMux
+	logger *logx.AppLogger
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.mux.ServeHTTP(writer, request)
+}
+
+func run() error {
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	fs, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+
+	collection := os.Getenv("SESSIONS_COLLECTION")
+	if collection == "" {
+		collection = "chat-sessions"
+	}
+	sessions := statex.New(statex.Firestore(fs, collection, newConversation), newConversation, statex.WithLogger(logger))
+	go sessions.Run(ctx)
+
+	// every instance has to sign tokens with the same secret, mount it from secret manager as CSRF_SECRET
+	secret := []byte(os.Getenv("CSRF_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("rand.Read(): %v", err)
+		}
+		logger.Warn("CSRF_SECRET isn't set, csrf tokens are only good on this instance")
+	}
+	csrf := statex.NewCSRF(secret)
+
+	s := &server{mux: http.NewServeMux(), logger: loggerClient}
+	s.mux.Handle("/chat", sessions.Middleware(csrf.Middleware(s.handleChat())))
+
+	srv := serverx.New("", s, logger)
+	// sessions are written once requests have drained, before the firestore client they are written with is closed
+	srv.OnShutdown(sessions.Flush)
+	srv.OnShutdown(func(ctx context.Context) error {
+		if err := fs.Close(); err != nil {
+			return fmt.Errorf("fs.Close(): %v", err)
+		}
+		return nil
+	})
+	return srv.ListenAndServe()
+}
+
+// handleChat returns the conversation of our session on GET, and adds a message and our reply to it on POST
+func (s *server) handleChat() http.HandlerFunc {
+	type chatRequest struct {
+		Text string `json:"text"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		session := statex.FromContext(request.Context())
+		switch request.Method {
+		case http.MethodGet:
+			var messages []message
+			session.View(func(value interface{}) {
+				messages = append([]message{}, value.(*conversation).Messages...)
+			})
+			httpx.RespondJSON(writer, &conversation{Messages: messages}, http.StatusOK)
+		case http.MethodPost:
+			var chat chatRequest
+			if err := json.NewDecoder(request.Body).Decode(&chat); err != nil || strings.TrimSpace(chat.Text) == "" {
+				httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "text is required"))
+				return
+			}
+			now := time.Now()
+			reply := message{From: "bot", Text: fmt.Sprintf("you said %q", chat.Text), Sent: now}
+			session.Update(func(value interface{}) error {
+				c := value.(*conversation)
+				c.Messages = append(c.Messages, message{From: "user", Text: chat.Text, Sent: now}, reply)
+				if len(c.Messages) > maxHistory {
+					c.Messages = c.Messages[len(c.Messages)-maxHistory:]
+				}
+				return nil
+			})
+			httpx.RespondJSON(writer, reply, http.StatusOK)
+		default:
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "method_not_allowed", Message: "method not allowed"}, http.StatusMethodNotAllowed)
+		}
+	}
+}
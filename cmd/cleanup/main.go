@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/firestore"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/jobx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// maxBatchSize is the most writes firestore accepts in a single commit
+const maxBatchSize = 500
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type config struct {
+	collection  string
+	field       string
+	olderThan   time.Duration
+	batchSize   int
+	rate        float64
+	max         int
+	dryRun      bool
+	checkpoints string
+}
+
+func run() error {
+	var cfg config
+	flag.StringVar(&cfg.collection, "collection", "beers", "collection to delete stale documents from, eg beers or tenants/acme/beer")
+	flag.StringVar(&cfg.field, "field", "created", "timestamp field that says how old a document is")
+	flag.DurationVar(&cfg.olderThan, "older-than", 30*24*time.Hour, "delete documents whose -field is older than this")
+	flag.IntVar(&cfg.batchSize, "batch", 200, "documents deleted per commit, at most 500")
+	flag.Float64Var(&cfg.rate, "rate", 500, "documents deleted per second at most, 0 for no limit")
+	flag.IntVar(&cfg.max, "max", 0, "stop after deleting this many documents, 0 for no limit")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "count what would be deleted without deleting it")
+	flag.StringVar(&cfg.checkpoints, "checkpoints", "job_checkpoints", "collection progress is saved in, so a retried task carries on")
+	flag.Parse()
+	if cfg.batchSize < 1 || cfg.batchSize > maxBatchSize {
+		return fmt.Errorf("-batch must be between 1 and %d", maxBatchSize)
+	}
+
+	// retrieves our project id from the gcp metadata server
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+	if projectID == "" {
+		return fmt.Errorf("GOOGLE_CLOUD_PROJECT must be set when running outside of gcp")
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// a job's task gets a SIGTERM when it is cancelled or runs past its --task-timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	defer client.Close()
+
+	task := jobx.FromEnv()
+	if task.Index != 0 {
+		// every task would query for the same documents, the others have nothing to do
+		logger.Infow("cleanup runs as the first task only", "task", task.String())
+		return nil
+	}
+	c := &cleaner{
+		cfg:         cfg,
+		client:      client,
+		task:        task,
+		checkpoints: jobx.NewCheckpoints(client, cfg.checkpoints),
+		pacer:       jobx.NewPacer(cfg.rate),
+		logger:      logger.With("task", task.String(), "collection", cfg.collection, "dry_run", cfg.dryRun),
+	}
+	started := time.Now()
+	p, err := c.run(ctx, started)
+	c.logger.Infow("cleanup finished",
+		"deleted", p.Deleted,
+		"cutoff", p.Cutoff.Format(time.RFC3339),
+		"done", p.Done,
+		"took", time.Since(started).String(),
+	)
+	if err != nil {
+		return fmt.Errorf("c.run(): %v", err)
+	}
+	return nil
+}
+
+// progress is what a task has deleted so far, saved after every commit
+type progress struct {
+	// Cutoff is fixed by the first attempt, a retry deletes the same documents rather than ones that went stale since
+	Cutoff  time.Time `firestore:"cutoff"`
+	Deleted int       `firestore:"deleted"`
+	// After and AfterID are the last document deleted, the next query starts after it instead of at the start of the
+	// collection, which is all tombstones of what we just deleted and slow to skip over
+	After   time.Time `firestore:"after"`
+	AfterID string    `firestore:"after_id"`
+	Done    bool      `firestore:"done"`
+	Updated time.Time `firestore:"updated"`
+}
+
+type cleaner struct {
+	cfg         config
+	client      *firestore.Client
+	task        jobx.Task
+	checkpoints *jobx.Checkpoints
+	pacer       *jobx.Pacer
+	logger      *zap.SugaredLogger
+}
+
+// run deletes the documents older than the cutoff a page at a time, oldest first
+func (c *cleaner) run(ctx context.Context, now time.Time) (progress, error) {
+	name := "cleanup-" + c.cfg.collection
+	p := progress{Cutoff: now.Add(-c.cfg.olderThan)}
+	if !c.cfg.dryRun {
+		resumed, err := c.checkpoints.Load(ctx, c.task, name, &p)
+		if err != nil {
+			return p, fmt.Errorf("checkpoints.Load(): %v", err)
+		}
+		if resumed {
+			c.logger.Infow("resuming cleanup", "deleted", p.Deleted, "cutoff", p.Cutoff.Format(time.RFC3339), "after_id", p.AfterID)
+		}
+		if p.Done {
+			return p, nil
+		}
+	}
+
+	for {
+		size := c.cfg.batchSize
+		if c.cfg.max > 0 {
+			if p.Deleted >= c.cfg.max {
+				c.logger.Infow("stopped at -max, the next run carries on", "max", c.cfg.max)
+				return p, nil
+			}
+			if left := c.cfg.max - p.Deleted; left < size {
+				size = left
+			}
+		}
+		if err := c.pacer.Wait(ctx, size); err != nil {
+			return p, err
+		}
+
+		page, err := c.page(ctx, p, size)
+		if err != nil {
+			return p, fmt.Errorf("c.page(): %v", err)
+		}
+		if len(page) == 0 {
+			p.Done = true
+			return p, c.save(ctx, name, p)
+		}
+		if !c.cfg.dryRun {
+			batch := c.client.Batch()
+			for _, snapshot := range page {
+				batch.Delete(snapshot.Ref)
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				return p, fmt.Errorf("batch.Commit(): %v", err)
+			}
+		}
+
+		last := page[len(page)-1]
+		p.Deleted += len(page)
+		p.AfterID = last.Ref.ID
+		if t, ok := last.Data()[c.cfg.field].(time.Time); ok {
+			p.After = t
+		}
+		if err := c.save(ctx, name, p); err != nil {
+			return p, err
+		}
+		msg := "deleted stale documents"
+		if c.cfg.dryRun {
+			msg = "found stale documents"
+		}
+		c.logger.Infow(msg, "batch", len(page), "deleted", p.Deleted, "after", p.After.Format(time.RFC3339))
+	}
+}
+
+// page is the next size documents past the cutoff, after the last one we deleted
+func (c *cleaner) page(ctx context.Context, p progress, size int) ([]*firestore.DocumentSnapshot, error) {
+	query := c.client.Collection(c.cfg.collection).
+		Where(c.cfg.field, "<", p.Cutoff).
+		OrderBy(c.cfg.field, firestore.Asc).
+		OrderBy(firestore.DocumentID, firestore.Asc)
+	if p.AfterID != "" {
+		query = query.StartAfter(p.After, p.AfterID)
+	}
+	iter := query.Limit(size).Documents(ctx)
+	defer iter.Stop()
+
+	var page []*firestore.DocumentSnapshot
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return page, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iter.Next(): %v", err)
+		}
+		page = append(page, snapshot)
+	}
+}
+
+// save checkpoints p once its deletes are committed, a dry run deleted nothing and has nothing to save
+func (c *cleaner) save(ctx context.Context, name string, p progress) error {
+	if c.cfg.dryRun {
+		return nil
+	}
+	p.Updated = time.Now()
+	if err := c.checkpoints.Save(ctx, c.task, name, p); err != nil {
+		return fmt.Errorf("checkpoints.Save(): %v", err)
+	}
+	return nil
+}
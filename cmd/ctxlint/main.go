@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// withoutContext are calls that do i/o but take no context, each with what to call instead
+var withoutContext = map[string]map[string]string{
+	"net/http": {
+		"Get":        "http.NewRequestWithContext and a client",
+		"Head":       "http.NewRequestWithContext and a client",
+		"Post":       "http.NewRequestWithContext and a client",
+		"PostForm":   "http.NewRequestWithContext and a client",
+		"NewRequest": "http.NewRequestWithContext",
+	},
+	"net": {
+		"Dial":        "net.Dialer.DialContext",
+		"DialTimeout": "net.Dialer.DialContext",
+	},
+	"os/exec": {
+		"Command": "exec.CommandContext",
+	},
+	"cloud.google.com/go/compute/metadata": {
+		"*": "metadatax",
+	},
+}
+
+// allowed are calls of a package matched by "*" that do no i/o
+var allowed = map[string]bool{
+	"cloud.google.com/go/compute/metadata.OnGCE": true,
+}
+
+type finding struct {
+	pos     token.Position
+	message string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: ctxlint [dir/...]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"./internal/..."}
+	}
+
+	fset := token.NewFileSet()
+	var findings []finding
+	for _, dir := range dirs {
+		files, err := goFiles(dir)
+		if err != nil {
+			log.Fatalf("goFiles(%s): %v", dir, err)
+		}
+		for _, path := range files {
+			file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+			if err != nil {
+				log.Fatalf("parser.ParseFile(%s): %v", path, err)
+			}
+			findings = append(findings, check(fset, file)...)
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].pos.Filename != findings[j].pos.Filename {
+			return findings[i].pos.Filename < findings[j].pos.Filename
+		}
+		return findings[i].pos.Line < findings[j].pos.Line
+	})
+	for _, f := range findings {
+		fmt.Printf("%s: %s\n", f.pos, f.message)
+	}
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// goFiles lists the non test go files of dir, and of every directory below it when dir ends in /...
+func goFiles(dir string) ([]string, error) {
+	recursive := strings.HasSuffix(dir, "/...")
+	root := strings.TrimSuffix(dir, "/...")
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && (!recursive || info.Name() == "testdata" || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".go") && !strings.HasSuffix(path, "_test.go") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// check reports what in file keeps a context from reaching i/o:
+//   - calls that have a context taking variant, or a package we have a context taking replacement for
+//   - context.Background and context.TODO without a comment next to them saying why the work is detached
+//   - exported functions taking a context anywhere but first
+//   - context.WithValue outside of ctxval, values stored that way are missing from ctxval.Dump
+//
+// a "ctxlint:ignore" comment on the line or the one above leaves a call alone, files importing testing are skipped
+func check(fset *token.FileSet, file *ast.File) []finding {
+	imports := map[string]string{}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	// helpers for tests, the test owns their lifetime
+	for _, path := range imports {
+		if path == "testing" {
+			return nil
+		}
+	}
+	// lines with a comment ending on them, and those where it says to leave the next line alone
+	commented, ignored := map[int]bool{}, map[int]bool{}
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			line := fset.Position(c.End()).Line
+			commented[line] = true
+			if strings.Contains(c.Text, "ctxlint:ignore") {
+				ignored[line] = true
+			}
+		}
+	}
+
+	var findings []finding
+	report := func(node ast.Node, format string, args ...interface{}) {
+		if line := fset.Position(node.Pos()).Line; ignored[line] || ignored[line-1] {
+			return
+		}
+		findings = append(findings, finding{pos: fset.Position(node.Pos()), message: fmt.Sprintf(format, args...)})
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.CallExpr:
+			sel, ok := node.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			pkg, ok := sel.X.(*ast.Ident)
+			if !ok || pkg.Obj != nil {
+				return true
+			}
+			path, ok := imports[pkg.Name]
+			if !ok {
+				return true
+			}
+			if path == "context" && (sel.Sel.Name == "Background" || sel.Sel.Name == "TODO") {
+				line := fset.Position(node.Pos()).Line
+				if !commented[line] && !commented[line-1] {
+					report(node, "context.%s() detaches from the caller, pass a context in or comment on why this work outlives it", sel.Sel.Name)
+				}
+				return true
+			}
+			if path == "context" && sel.Sel.Name == "WithValue" && file.Name.Name != "ctxval" {
+				report(node, "context.WithValue() hides the value from ctxval.Dump, store it under a key of ctxval.New")
+				return true
+			}
+			calls := withoutContext[path]
+			if instead, ok := calls[sel.Sel.Name]; ok {
+				report(node, "%s.%s() takes no context, use %s", pkg.Name, sel.Sel.Name, instead)
+			} else if instead, ok := calls["*"]; ok && !allowed[path+"."+sel.Sel.Name] {
+				report(node, "%s.%s() takes no context, use %s", pkg.Name, sel.Sel.Name, instead)
+			}
+		case *ast.FuncDecl:
+			if !node.Name.IsExported() || node.Type.Params == nil {
+				return true
+			}
+			// func(a, ctx context.Context) is one field with two names, position counts names
+			position := 0
+			for _, field := range node.Type.Params.List {
+				names := len(field.Names)
+				if names == 0 {
+					names = 1
+				}
+				if isContext(field.Type, imports) && position+names > 1 {
+					report(field, "%s takes a context after other parameters, a context goes first", node.Name.Name)
+				}
+				position += names
+			}
+		}
+		return true
+	})
+	return findings
+}
+
+func isContext(expr ast.Expr, imports map[string]string) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && imports[pkg.Name] == "context" && sel.Sel.Name == "Context"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		// want has a substring per finding, in order
+		want []string
+	}{
+		{
+			name: "http_without_context",
+			src: `package p
+import "net/http"
+func f() { http.Get("https://example.com") }`,
+			want: []string{"http.Get() takes no context, use http.NewRequestWithContext and a client"},
+		},
+		{
+			name: "renamed_import",
+			src: `package p
+import stdexec "os/exec"
+func f() { stdexec.Command("ls") }`,
+			want: []string{"stdexec.Command() takes no context, use exec.CommandContext"},
+		},
+		{
+			name: "whole_package_replaced",
+			src: `package p
+import "cloud.google.com/go/compute/metadata"
+func f() { metadata.ProjectID() }`,
+			want: []string{"metadata.ProjectID() takes no context, use metadatax"},
+		},
+		{
+			name: "allowed_call_of_replaced_package",
+			src: `package p
+import "cloud.google.com/go/compute/metadata"
+func f() bool { return metadata.OnGCE() }`,
+		},
+		{
+			name: "context_taking_variant",
+			src: `package p
+import "net/http"
+func f(ctx context.Context) { http.NewRequestWithContext(ctx, "GET", "/", nil) }`,
+		},
+		{
+			name: "local_variable_shadows_package",
+			src: `package p
+import "net/http"
+func f(c *http.Client) { http := c; http.Get("/") }`,
+		},
+		{
+			name: "background_without_comment",
+			src: `package p
+import "context"
+func f() { g(context.Background()); g(context.TODO()) }
+func g(ctx context.Context) {}`,
+			want: []string{"context.Background() detaches", "context.TODO() detaches"},
+		},
+		{
+			name: "background_with_comment_above",
+			src: `package p
+import "context"
+func f() {
+	// runs after the request that started it has returned
+	g(context.Background())
+}
+func g(ctx context.Context) {}`,
+		},
+		{
+			name: "background_with_comment_on_the_line",
+			src: `package p
+import "context"
+func f() {
+	g(context.Background()) // outlives the request
+}
+func g(ctx context.Context) {}`,
+		},
+		{
+			name: "context_not_first",
+			src: `package p
+import "context"
+func Exported(name string, ctx context.Context) {}
+func Grouped(a, ctx context.Context) {}
+func First(ctx context.Context, name string) {}
+func unexported(name string, ctx context.Context) {}`,
+			want: []string{"Exported takes a context after other parameters", "Grouped takes a context after other parameters"},
+		},
+		{
+			name: "with_value",
+			src: `package p
+import "context"
+func f(ctx context.Context) context.Context { return context.WithValue(ctx, "k", "v") }`,
+			want: []string{"context.WithValue() hides the value from ctxval.Dump"},
+		},
+		{
+			name: "with_value_in_ctxval",
+			src: `package ctxval
+import "context"
+func f(ctx context.Context) context.Context { return context.WithValue(ctx, "k", "v") }`,
+		},
+		{
+			name: "ignore_comment_above",
+			src: `package p
+import "net/http"
+func f() {
+	// ctxlint:ignore a one off call during startup
+	http.Get("https://example.com")
+}`,
+		},
+		{
+			name: "ignore_comment_on_the_line",
+			src: `package p
+import "os/exec"
+func f() {
+	exec.Command("ls") // ctxlint:ignore the process outlives us
+}`,
+		},
+		{
+			name: "ignore_covers_only_the_next_line",
+			src: `package p
+import "net/http"
+func f() {
+	// ctxlint:ignore
+	http.Get("https://example.com")
+	http.Head("https://example.com")
+}`,
+			want: []string{"http.Head() takes no context"},
+		},
+		{
+			name: "test_helpers_skipped",
+			src: `package p
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+func helper(t *testing.T) { http.Get("/"); _ = context.Background() }`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, tt.name+".go", tt.src, parser.ParseComments)
+			if err != nil {
+				t.Fatalf("parser.ParseFile(): %v", err)
+			}
+			findings := check(fset, file)
+			if len(findings) != len(tt.want) {
+				t.Fatalf("check() found %d problems, want %d: %v", len(findings), len(tt.want), findings)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(findings[i].message, want) {
+					t.Errorf("finding %d = %q, want it to contain %q", i, findings[i].message, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/firestore"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	collection := flag.String("collection", "dedupe", "firestore collection dedupe.Firestore keeps its entries in")
+	grace := flag.Duration("grace", time.Hour, "keep entries this long past their expiry, for clocks that disagree")
+	flag.Parse()
+
+	// retrieves our project id from the gcp metadata server
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+	if projectID == "" {
+		return fmt.Errorf("GOOGLE_CLOUD_PROJECT must be set when running outside of gcp")
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// a job's task gets a SIGTERM when it is cancelled or runs past its --task-timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	defer client.Close()
+
+	store, ok := dedupe.Firestore(client, *collection).(dedupe.Sweeper)
+	if !ok {
+		return fmt.Errorf("dedupe.Firestore() doesn't sweep")
+	}
+	started := time.Now()
+	swept, err := store.Sweep(ctx, started.Add(-*grace))
+	// what was swept before a failure stays swept, the next run picks up where this one stopped
+	logger.Infow("swept expired dedupe entries", "collection", *collection, "swept", swept, "took", time.Since(started).String())
+	if err != nil {
+		return fmt.Errorf("store.Sweep(): %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+)
+
+// maxEventBytes is the most data pub/sub takes in a single message
+const maxEventBytes = 10 << 20
+
+var publishedEvents = metric.Must(global.Meter("github.com/amammay/effectivecloudrun/cmd/eventbridge")).NewInt64Counter(
+	"eventbridge.events",
+	metric.WithDescription("events by outcome, published, failed or invalid"),
+)
+
+type bridge struct {
+	topic  *pubsub.Topic
+	logger *logx.AppLogger
+	// memory is the bytes of events we hold on to until pub/sub has them, across every stream. a stream waiting for
+	// memory stops reading, so http/2 flow control pushes back on its client rather than us buffering without bound
+	memory *semaphore.Weighted
+	budget int64
+	// window is how many events one stream can have waiting on pub/sub, so a single client can't take all of memory
+	window int64
+	// drain is closed once we are shutting down
+	drain chan struct{}
+}
+
+// publish publishes the events of a stream as they come in and acks each once pub/sub has it. the stream ends when
+// the client closes its side and everything it sent was acked, or when we start draining. then it ends with
+// Unavailable once the events we took are acked, the client sends the events it has no ack for on a new stream,
+// which cloud run routes to an instance that isn't shutting down
+func (b *bridge) publish(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	logger := b.logger.WrapTraceContext(ctx)
+
+	// receiving runs on its own so we can stop taking events the moment we start draining
+	events := make(chan *Event)
+	received := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			event := &Event{}
+			if err := stream.RecvMsg(event); err != nil {
+				received <- err
+				return
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var sendMu sync.Mutex
+	send := func(ack *Ack) {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		// a client that went away misses its acks, it sends whatever it has no ack for again
+		if err := stream.SendMsg(ack); err != nil {
+			logger.Debugw("stream.SendMsg()", "seq", ack.Seq, "err", err)
+		}
+	}
+	inFlight := semaphore.NewWeighted(b.window)
+	// pending are the events waiting on pub/sub, we only return once all of them are acked
+	var pending sync.WaitGroup
+	defer pending.Wait()
+
+	for {
+		select {
+		case event := <-events:
+			if err := b.accept(ctx, event, inFlight, &pending, send); err != nil {
+				return status.FromContextError(err).Err()
+			}
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-b.drain:
+			logger.Info("draining stream")
+			pending.Wait()
+			return status.Error(codes.Unavailable, "instance shutting down, send events without an ack on a new stream")
+		}
+	}
+}
+
+// accept publishes event once there is room for it, and acks it from its own goroutine once pub/sub has it. it only
+// returns an error once ctx is done
+func (b *bridge) accept(ctx context.Context, event *Event, inFlight *semaphore.Weighted, pending *sync.WaitGroup, send func(ack *Ack)) error {
+	size := int64(len(event.Data))
+	for key, value := range event.Attributes {
+		size += int64(len(key) + len(value))
+	}
+	if reason := b.invalid(event, size); reason != "" {
+		publishedEvents.Add(ctx, 1, attribute.String("outcome", "invalid"))
+		send(&Ack{Seq: event.Seq, Error: reason})
+		return nil
+	}
+
+	// waiting here keeps us from reading the next event, which is all the backpressure a client needs
+	if err := inFlight.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	if err := b.memory.Acquire(ctx, size); err != nil {
+		inFlight.Release(1)
+		return err
+	}
+	if event.Resume && event.OrderingKey != "" {
+		b.topic.ResumePublish(event.OrderingKey)
+	}
+	// the client library batches what we publish, by PublishSettings, and keeps each ordering key in order
+	result := b.topic.Publish(ctx, &pubsub.Message{Data: event.Data, Attributes: event.Attributes, OrderingKey: event.OrderingKey})
+
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		// not tied to the stream, pub/sub either has the event or gives up on it within PublishSettings.Timeout
+		id, err := result.Get(context.Background())
+		b.memory.Release(size)
+		inFlight.Release(1)
+
+		ack := &Ack{Seq: event.Seq, MessageID: id}
+		outcome := "published"
+		if err != nil {
+			outcome = "failed"
+			ack.Error = err.Error()
+			// pub/sub pauses the ordering key of a failed event, the events after it fail too until one resumes it
+			b.logger.WrapTraceContext(ctx).Warnw("publish failed", "seq", event.Seq, "ordering_key", event.OrderingKey, "err", err)
+		}
+		publishedEvents.Add(ctx, 1, attribute.String("outcome", outcome))
+		send(ack)
+	}()
+	return nil
+}
+
+// invalid says what is wrong with event, empty when nothing is
+func (b *bridge) invalid(event *Event, size int64) string {
+	switch {
+	case len(event.Data) == 0 && len(event.Attributes) == 0:
+		return "an event needs data or attributes"
+	case size > maxEventBytes:
+		return fmt.Sprintf("events are at most %d bytes", maxEventBytes)
+	case size > b.budget:
+		return fmt.Sprintf("events are at most %d bytes on this instance", b.budget)
+	}
+	return ""
+}
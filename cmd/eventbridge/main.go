@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	// cancelled when serving fails, which shuts us down like a signal would
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	topicID := os.Getenv("TOPIC")
+	if topicID == "" {
+		return fmt.Errorf("TOPIC must be set")
+	}
+	budget, err := envInt("MAX_OUTSTANDING_BYTES", 64<<20)
+	if err != nil {
+		return err
+	}
+	window, err := envInt("STREAM_WINDOW", 1000)
+	if err != nil {
+		return err
+	}
+	batchSize, err := envInt("BATCH_SIZE", 100)
+	if err != nil {
+		return err
+	}
+	batchDelay := 10 * time.Millisecond
+	if v := os.Getenv("BATCH_DELAY"); v != "" {
+		if batchDelay, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("BATCH_DELAY must be a duration, got %q", v)
+		}
+	}
+
+	// ordering is only guaranteed for messages published through the same region, a regional endpoint keeps every
+	// instance of ours publishing through the region it runs in
+	var clientOpts []option.ClientOption
+	if region := os.Getenv("PUBSUB_REGION"); region != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(region+"-pubsub.googleapis.com:443"))
+	}
+	pubsubClient, err := pubsub.NewClient(ctx, projectID, clientOpts...)
+	if err != nil {
+		return fmt.Errorf("pubsub.NewClient(): %v", err)
+	}
+	defer pubsubClient.Close()
+	topic := pubsubClient.Topic(topicID)
+	topic.EnableMessageOrdering = true
+	topic.PublishSettings.CountThreshold = int(batchSize)
+	topic.PublishSettings.DelayThreshold = batchDelay
+	// we never hold more than our budget, pub/sub mustn't refuse what we let in
+	if int64(topic.PublishSettings.BufferedByteLimit) < budget {
+		topic.PublishSettings.BufferedByteLimit = int(budget)
+	}
+
+	b := &bridge{
+		topic:  topic,
+		logger: loggerClient,
+		memory: semaphore.NewWeighted(budget),
+		budget: budget,
+		window: window,
+		drain:  make(chan struct{}),
+	}
+
+	grpcServer := grpc.NewServer(
+		// errors leave with the code of their errs kind and only their client safe message
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), errs.StreamServerInterceptor()),
+		// the cloud run frontend closes idle connections on its own, pinging keeps a stream that is waiting on its
+		// client from looking idle
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: 30 * time.Second}),
+	)
+	grpcServer.RegisterService(&eventsServiceDesc, b)
+	// cloud run startup and liveness probes speak the grpc health protocol
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("net.Listen(): %v", err)
+	}
+
+	// setup our shutdown signal
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(
+		shutdown,
+		os.Interrupt,    // Capture ctrl + c events (SIGINT)
+		syscall.SIGTERM, // Capture actual sig term event (kill command).
+	)
+	defer signal.Stop(shutdown)
+
+	// serverx is an http server, grpc brings its own, so this is the same dance for a grpc.Server
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		select {
+		case o := <-shutdown:
+			logger.Infof("sig: %s - starting shutting down sequence...", o)
+		case <-gctx.Done():
+			logger.Info("server stopped - starting shutting down sequence...")
+		}
+		// no new streams, and the ones we have ack what they took and tell their clients to go elsewhere
+		healthServer.Shutdown()
+		close(b.drain)
+
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			logger.Info("server has shutdown gracefully")
+		case <-time.After(9 * time.Second):
+			logger.Warn("streams still open after shutdown timeout, closing them")
+			grpcServer.Stop()
+		}
+		// sends whatever is still batched, every event we acked is in pub/sub already
+		topic.Stop()
+		return nil
+	})
+
+	logger.Infow("starting server", "addr", listener.Addr().String(), "topic", topicID, "budget_bytes", budget)
+	if err := grpcServer.Serve(listener); err != nil {
+		cancelFunc()
+		g.Wait()
+		return fmt.Errorf("grpcServer.Serve(): %v", err)
+	}
+	return g.Wait()
+}
+
+// envInt reads a positive number from the env variable key, fallback when it isn't set
+func envInt(key string, fallback int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", key, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// we have no protoc step, so our service is declared by hand and its messages travel as json. clients pick the
+// codec with grpc.CallContentSubtype("json"), the health service next to us keeps speaking protobuf
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// Event is one event a client sends over a Publish stream
+type Event struct {
+	// Seq is the client's number for the event, its ack carries it back
+	Seq         int64             `json:"seq"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	// Resume publishes OrderingKey again after an event of it failed, set it on the first of them sent again
+	Resume bool `json:"resume,omitempty"`
+}
+
+// Ack is sent for every event once pub/sub has it, or once it failed. acks come in the order events are published,
+// which isn't the order they were sent in across ordering keys
+type Ack struct {
+	Seq       int64  `json:"seq"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// eventsServiceDesc is what protoc would generate for
+//
+//	service Events {
+//	  rpc Publish(stream Event) returns (stream Ack);
+//	}
+var eventsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "eventbridge.v1.Events",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Publish",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*bridge).publish(stream)
+		},
+	}},
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
 	"golang.org/x/sync/errgroup"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,6 +25,14 @@ func main() {
 }
 
 func run() error {
+	loggerClient, err := logx.NewLogger("", false)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+
+	// unlike http.DefaultClient our client keeps enough idle connections around for cloud run concurrency, the leak
+	// check logs any response body we forget to close
+	client := clientx.New(clientx.WithLeakCheck(loggerClient))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/cancelablerequest", func(writer http.ResponseWriter, request *http.Request) {
@@ -30,12 +43,14 @@ func run() error {
 			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		_, err = http.DefaultClient.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("http.DefaultClient.Do: %v", err)
+			log.Printf("client.Do: %v", err)
 			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		// until the body is read and closed its connection can't be reused, or even freed
+		clientx.DrainAndClose(resp.Body)
 		fmt.Fprintf(writer, "<h1> hello world <h1/>")
 	})
 
@@ -47,15 +62,50 @@ func run() error {
 			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		_, err = http.DefaultClient.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("http.DefaultClient.Do: %v", err)
+			log.Printf("client.Do: %v", err)
 			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		// until the body is read and closed its connection can't be reused, or even freed
+		clientx.DrainAndClose(resp.Body)
 		fmt.Fprintf(writer, "<h1> hello world <h1/>")
 	})
 
+	mux.HandleFunc("/budgetedrequest", func(writer http.ResponseWriter, request *http.Request) {
+
+		log.Println("starting work")
+		// pretend our cloud run --timeout is 5 seconds, keeping half a second to write our response
+		budget := ctxutil.NewBudget(request.Context(), ctxutil.WithFallback(5*time.Second), ctxutil.WithReserve(500*time.Millisecond))
+
+		// we know delay/10 takes 10 seconds, so there is no point in even starting it
+		ctx, cancel, err := budget.Step(request.Context(), "delay/10", 10*time.Second)
+		if err != nil {
+			log.Printf("budget.Step: %v", err)
+			http.Error(writer, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://httpbin.org/delay/10", nil)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		resp, err := client.Do(req)
+		if err = budget.Wrap(ctx, "delay/10", err); err != nil {
+			log.Printf("client.Do: %v", err)
+			http.Error(writer, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		clientx.DrainAndClose(resp.Body)
+		fmt.Fprintf(writer, "<h1> hello world <h1/>")
+	})
+
+	// the watcher tells us when a request was cancelled mid flight, and if it was the client leaving or our shutdown
+	var draining int32
+	watcher := httpx.NewDisconnectWatcher(loggerClient, httpx.WithDraining(func() bool { return atomic.LoadInt32(&draining) == 1 }))
+
 	// create our base context to work with
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
@@ -66,7 +116,7 @@ func run() error {
 	}
 	httpServer := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: watcher.Middleware(mux),
 		// we register our base context generator, this will be the first piece of context added to all incoming calls
 		// if this context where to be cancelled, it would cancel all subsequent context driven functions therefore to
 		// allow for a clean and mostly graceful disconnect
@@ -90,6 +140,7 @@ func run() error {
 		// on an seperate go routine we will wait and listen for our shutdown events
 		o := <-shutdown
 		log.Printf("sig: %s - starting shutting down sequence...", o)
+		atomic.StoreInt32(&draining, 1)
 		// we need to use a fresh context.Background() because the parent ctx we have in our current scope will be cancelled during the Shutdown method call
 		graceFull, cancel := context.WithTimeout(context.Background(), 9*time.Second)
 		defer cancel()
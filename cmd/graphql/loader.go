@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"time"
+)
+
+// batchWait is how long a loader collects keys before fetching them, resolvers running in parallel all land well
+// within it
+const batchWait = 2 * time.Millisecond
+
+type loaderResult struct {
+	snapshot *firestore.DocumentSnapshot
+	err      error
+}
+
+// docLoader batches firestore reads of a single collection for the lifetime of one graphql request, so resolving the
+// brewery of 50 beers costs one GetAll instead of 50 round trips. results are cached for the rest of the request
+type docLoader struct {
+	fs         *firestore.Client
+	collection string
+
+	mu      sync.Mutex
+	cache   map[string]*loaderCall
+	pending []string
+	timer   *time.Timer
+	links   []trace.Link
+}
+
+type loaderCall struct {
+	done   chan struct{}
+	result loaderResult
+}
+
+func newDocLoader(fs *firestore.Client, collection string) *docLoader {
+	return &docLoader{fs: fs, collection: collection, cache: map[string]*loaderCall{}}
+}
+
+// Load returns the snapshot of id, a missing document is a NotFound error
+func (l *docLoader) Load(ctx context.Context, id string) (*firestore.DocumentSnapshot, error) {
+	l.mu.Lock()
+	call, ok := l.cache[id]
+	if !ok {
+		call = &loaderCall{done: make(chan struct{})}
+		l.cache[id] = call
+		l.pending = append(l.pending, id)
+		l.links = append(l.links, trace.LinkFromContext(ctx))
+		if l.timer == nil {
+			l.timer = time.AfterFunc(batchWait, l.dispatch)
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result.snapshot, call.result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *docLoader) dispatch() {
+	l.mu.Lock()
+	ids, links := l.pending, l.links
+	l.pending, l.links, l.timer = nil, nil, nil
+	calls := make([]*loaderCall, len(ids))
+	for i, id := range ids {
+		calls[i] = l.cache[id]
+	}
+	l.mu.Unlock()
+
+	// the batch serves many resolvers, so it gets its own span linked to each of them
+	ctx, span := otel.Tracer(instrumentationName).Start(context.Background(), "loader."+l.collection,
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("loader.keys", len(ids))),
+	)
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	refs := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		refs[i] = l.fs.Collection(l.collection).Doc(id)
+	}
+	snapshots, err := l.fs.GetAll(ctx, refs)
+	for i, call := range calls {
+		switch {
+		case err != nil:
+			call.result.err = errs.Wrapf(err, errs.Unknown, "fs.GetAll(%s)", l.collection)
+		case !snapshots[i].Exists():
+			call.result.err = errs.New(errs.NotFound, l.collection+" not found")
+		default:
+			call.result.snapshot = snapshots[i]
+		}
+		close(call.done)
+	}
+}
+
+var loadersKey = ctxval.New("graphql.loaders")
+
+type loaders struct {
+	breweries *docLoader
+}
+
+func withLoaders(ctx context.Context, fs *firestore.Client) context.Context {
+	return loadersKey.With(ctx, &loaders{breweries: newDocLoader(fs, "breweries")})
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	l, _ := loadersKey.Value(ctx)
+	return l.(*loaders)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	graphql "github.com/graph-gophers/graphql-go"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"log"
+	"net/http"
+	"os"
+)
+
+const AppName = "graphql"
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type server struct {
+	mux    *http.ServeMux
+	logger *logx.AppLogger
+	schema *graphql.Schema
+	fs     *firestore.Client
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.mux.ServeHTTP(writer, request)
+}
+
+func run() error {
+	ctx := context.Background()
+	// logs, traces and metrics, torn down together once our server has shut down
+	telemetry, err := obs.Init(ctx, obs.Config{ServiceName: AppName})
+	if err != nil {
+		return fmt.Errorf("obs.Init(): %v", err)
+	}
+	projectID := telemetry.ProjectID
+	loggerClient := telemetry.Logger
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	fs, err := firestore.NewClient(ctx, projectID,
+		option.WithGRPCDialOption(grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor())),
+		option.WithGRPCDialOption(grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor())),
+	)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+
+	s := &server{
+		mux:    http.NewServeMux(),
+		logger: loggerClient,
+		fs:     fs,
+		schema: graphql.MustParseSchema(schema, &rootResolver{fs: fs},
+			graphql.Tracer(newResolverTracer()),
+			graphql.MaxParallelism(20),
+		),
+	}
+
+	var handler http.Handler = s.handleGraphQL()
+	// with an audience configured only callers presenting a google identity token get through
+	if audience := os.Getenv("AUDIENCE"); audience != "" {
+		verifier, err := authx.NewVerifier(ctx, audience)
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(): %v", err)
+		}
+		handler = verifier.Middleware(handler)
+	}
+	s.mux.Handle("/graphql", otelhttp.NewHandler(handler, "graphql"))
+
+	// telemetry is flushed after every hook so it includes them
+	srv := serverx.New("", s, logger, telemetry.ServerOptions()...)
+	srv.OnShutdown(func(ctx context.Context) error {
+		return fs.Close()
+	})
+	return srv.ListenAndServe()
+}
+
+func (s *server) handleGraphQL() http.HandlerFunc {
+	type graphQLRequest struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "graphql requests must be POSTed"))
+			return
+		}
+		var params graphQLRequest
+		if err := json.NewDecoder(request.Body).Decode(&params); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "json.Decode()"))
+			return
+		}
+
+		// our loaders live exactly as long as this request
+		ctx := withLoaders(request.Context(), s.fs)
+		response := s.schema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+		for _, queryErr := range response.Errors {
+			// the client only sees the safe message, log what actually happened
+			s.logger.WrapTraceContext(ctx).Warnw("graphql error", "path", queryErr.Path, "message", queryErr.Message, "err", queryErr.ResolverError)
+		}
+		httpx.RespondJSON(writer, response, http.StatusOK)
+	}
+}
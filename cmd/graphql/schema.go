@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	graphql "github.com/graph-gophers/graphql-go"
+	"google.golang.org/api/iterator"
+	"time"
+)
+
+const schema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	beer(id: ID!): Beer
+	beers(first: Int = 20): [Beer!]!
+}
+
+type Mutation {
+	createBeer(name: String!, breweryId: ID!): Beer!
+}
+
+type Beer {
+	id: ID!
+	name: String!
+	created: Time
+	brewery: Brewery
+}
+
+type Brewery {
+	id: ID!
+	name: String!
+	city: String
+}
+`
+
+// gqlError only exposes the client safe message of err, the kind becomes extensions.code
+type gqlError struct {
+	err error
+}
+
+func (e gqlError) Error() string {
+	return errs.Message(e.err)
+}
+
+func (e gqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": errs.KindOf(e.err).String()}
+}
+
+func (e gqlError) Unwrap() error {
+	return e.err
+}
+
+func toGQL(err error) error {
+	if err == nil {
+		return nil
+	}
+	return gqlError{err: err}
+}
+
+type beerDoc struct {
+	Name      string    `firestore:"name"`
+	BreweryID string    `firestore:"brewery_id"`
+	Created   time.Time `firestore:"created,serverTimestamp"`
+}
+
+type breweryDoc struct {
+	Name string `firestore:"name"`
+	City string `firestore:"city"`
+}
+
+type rootResolver struct {
+	fs *firestore.Client
+}
+
+func (r *rootResolver) Beer(ctx context.Context, args struct{ ID graphql.ID }) (*beerResolver, error) {
+	snapshot, err := r.fs.Collection("beers").Doc(string(args.ID)).Get(ctx)
+	if err != nil {
+		if errs.Is(err, errs.NotFound) {
+			return nil, nil
+		}
+		return nil, toGQL(errs.Wrapf(err, errs.Unknown, "doc.Get()"))
+	}
+	return newBeerResolver(snapshot)
+}
+
+func (r *rootResolver) Beers(ctx context.Context, args struct{ First int32 }) ([]*beerResolver, error) {
+	if args.First < 1 || args.First > 100 {
+		return nil, toGQL(errs.New(errs.InvalidArgument, "first must be between 1 and 100"))
+	}
+	iter := r.fs.Collection("beers").OrderBy("created", firestore.Desc).Limit(int(args.First)).Documents(ctx)
+	defer iter.Stop()
+	var beers []*beerResolver
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return beers, nil
+		}
+		if err != nil {
+			return nil, toGQL(errs.Wrapf(err, errs.Unknown, "iter.Next()"))
+		}
+		beer, err := newBeerResolver(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		beers = append(beers, beer)
+	}
+}
+
+func (r *rootResolver) CreateBeer(ctx context.Context, args struct {
+	Name      string
+	BreweryID graphql.ID
+}) (*beerResolver, error) {
+	if args.Name == "" {
+		return nil, toGQL(errs.New(errs.InvalidArgument, "name is required"))
+	}
+	// make sure the brewery exists, through the loader so it is cached for resolving Beer.brewery
+	if _, err := loadersFrom(ctx).breweries.Load(ctx, string(args.BreweryID)); err != nil {
+		return nil, toGQL(err)
+	}
+	ref := r.fs.Collection("beers").NewDoc()
+	doc := beerDoc{Name: args.Name, BreweryID: string(args.BreweryID)}
+	if _, err := ref.Create(ctx, doc); err != nil {
+		return nil, toGQL(errs.Wrapf(err, errs.Unknown, "ref.Create()"))
+	}
+	doc.Created = time.Now()
+	return &beerResolver{id: ref.ID, doc: doc}, nil
+}
+
+type beerResolver struct {
+	id  string
+	doc beerDoc
+}
+
+func newBeerResolver(snapshot *firestore.DocumentSnapshot) (*beerResolver, error) {
+	b := &beerResolver{id: snapshot.Ref.ID}
+	if err := snapshot.DataTo(&b.doc); err != nil {
+		return nil, toGQL(errs.Wrapf(err, errs.Internal, "snapshot.DataTo()"))
+	}
+	return b, nil
+}
+
+func (b *beerResolver) ID() graphql.ID {
+	return graphql.ID(b.id)
+}
+
+func (b *beerResolver) Name() string {
+	return b.doc.Name
+}
+
+func (b *beerResolver) Created() *graphql.Time {
+	if b.doc.Created.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: b.doc.Created}
+}
+
+// Brewery is resolved through our request scoped loader, every beer in a list asks for its brewery at the same time
+// and the loader turns that into a single batched read
+func (b *beerResolver) Brewery(ctx context.Context) (*breweryResolver, error) {
+	if b.doc.BreweryID == "" {
+		return nil, nil
+	}
+	snapshot, err := loadersFrom(ctx).breweries.Load(ctx, b.doc.BreweryID)
+	if err != nil {
+		return nil, toGQL(err)
+	}
+	brewery := &breweryResolver{id: snapshot.Ref.ID}
+	if err := snapshot.DataTo(&brewery.doc); err != nil {
+		return nil, toGQL(errs.Wrapf(err, errs.Internal, "snapshot.DataTo()"))
+	}
+	return brewery, nil
+}
+
+type breweryResolver struct {
+	id  string
+	doc breweryDoc
+}
+
+func (b *breweryResolver) ID() graphql.ID {
+	return graphql.ID(b.id)
+}
+
+func (b *breweryResolver) Name() string {
+	return b.doc.Name
+}
+
+func (b *breweryResolver) City() *string {
+	if b.doc.City == "" {
+		return nil
+	}
+	return &b.doc.City
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/introspection"
+	gqltrace "github.com/graph-gophers/graphql-go/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/cmd/graphql"
+
+// resolverTracer gives every graphql query a span and every non trivial resolver a child span of it, trivial
+// resolvers are plain struct fields and would only add noise
+type resolverTracer struct {
+	tracer trace.Tracer
+}
+
+var _ gqltrace.Tracer = resolverTracer{}
+
+func newResolverTracer() resolverTracer {
+	return resolverTracer{tracer: otel.Tracer(instrumentationName)}
+}
+
+func (t resolverTracer) TraceQuery(ctx context.Context, queryString string, operationName string, variables map[string]interface{}, varTypes map[string]*introspection.Type) (context.Context, gqltrace.TraceQueryFinishFunc) {
+	name := "graphql.query"
+	if operationName != "" {
+		name += " " + operationName
+	}
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("graphql.operation", operationName),
+		attribute.String("graphql.query", queryString),
+	))
+	return ctx, func(queryErrors []*gqlerrors.QueryError) {
+		if len(queryErrors) > 0 {
+			span.SetStatus(codes.Error, queryErrors[0].Message)
+			span.SetAttributes(attribute.Int("graphql.errors", len(queryErrors)))
+		}
+		span.End()
+	}
+}
+
+func (t resolverTracer) TraceField(ctx context.Context, label, typeName, fieldName string, trivial bool, args map[string]interface{}) (context.Context, gqltrace.TraceFieldFinishFunc) {
+	if trivial {
+		return ctx, func(*gqlerrors.QueryError) {}
+	}
+	ctx, span := t.tracer.Start(ctx, typeName+"."+fieldName, trace.WithAttributes(
+		attribute.String("graphql.type", typeName),
+		attribute.String("graphql.field", fieldName),
+	))
+	return ctx, func(queryErr *gqlerrors.QueryError) {
+		if queryErr != nil {
+			if queryErr.ResolverError != nil {
+				span.RecordError(queryErr.ResolverError)
+			}
+			span.SetStatus(codes.Error, queryErr.Message)
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/memx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/storage/v1"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	ctx := context.Background()
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	outputBucket := os.Getenv("OUTPUT_BUCKET")
+	if outputBucket == "" {
+		return fmt.Errorf("OUTPUT_BUCKET must be set")
+	}
+	size := 256
+	if v := os.Getenv("THUMBNAIL_SIZE"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			return fmt.Errorf("THUMBNAIL_SIZE must be a positive number, got %q", v)
+		}
+	}
+
+	// decoded images are by far the most memory we use, they get half of our container. the other half is the runtime
+	// and headroom for the gc to catch up on images we are done with
+	tuning, err := memx.Tune(logger)
+	if err != nil {
+		return fmt.Errorf("memx.Tune(): %v", err)
+	}
+	limit := tuning.ContainerLimit
+	if limit <= 0 {
+		// running locally without a limit, pretend we have the memory of a default cloud run instance
+		limit = 512 << 20
+	}
+	budget := limit / 2
+
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewService(): %v", err)
+	}
+	w := &worker{
+		storage:      storageService,
+		logger:       loggerClient,
+		outputBucket: outputBucket,
+		size:         size,
+		maxBytes:     32 << 20,
+		budget:       budget,
+		memory:       semaphore.NewWeighted(budget),
+		wait:         5 * time.Second,
+	}
+	logger.Infow("image budget", "container_limit_bytes", limit, "budget_bytes", budget, "thumbnail_size", size)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", w.handleFinalized())
+	srv := serverx.New("", otelhttp.NewHandler(mux, "imageworker"), logger)
+	return srv.ListenAndServe()
+}
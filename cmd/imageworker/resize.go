@@ -0,0 +1,49 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// samples is how many source pixels along each axis are averaged into one thumbnail pixel, enough to avoid the
+// aliasing of nearest neighbour without touching every pixel of a large image
+const samples = 4
+
+// resize scales img down to fit within size by size, keeping its aspect ratio. images that already fit are returned
+// as they are
+func resize(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, b, a uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					// the centre of each sample cell within the source box of this pixel
+					px := bounds.Min.X + (x*samples+sx)*w/(tw*samples) + w/(tw*samples*2)
+					py := bounds.Min.Y + (y*samples+sy)*h/(th*samples) + h/(th*samples*2)
+					cr, cg, cb, ca := img.At(px, py).RGBA()
+					r, g, b, a = r+cr, g+cg, b+cb, a+ca
+				}
+			}
+			n := uint32(samples * samples)
+			thumb.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return thumb
+}
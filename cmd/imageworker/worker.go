@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/gcsx"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/storage/v1"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// finalizedType is the cloudevent type eventarc sends once an object is written to a bucket
+const finalizedType = "google.cloud.storage.object.v1.finalized"
+
+// thumbnailPrefix is where thumbnails go, never thumbnail a thumbnail when the output bucket is also the input bucket
+const thumbnailPrefix = "thumbnails/"
+
+// storageObject is the part of the event data of a finalized object we need, gcs sends its size as a string
+type storageObject struct {
+	Bucket      string `json:"bucket"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        string `json:"size"`
+}
+
+// errSkipped is what a retry won't change, the event is acknowledged so eventarc stops delivering it
+var errSkipped = errors.New("skipped")
+
+type worker struct {
+	storage      *storage.Service
+	logger       *logx.AppLogger
+	outputBucket string
+	size         int
+	// maxBytes bounds the objects we download at all
+	maxBytes int64
+	// budget is the memory images may take at once, memory is reserved from it for every image we decode
+	budget int64
+	memory *semaphore.Weighted
+	// wait is how long an image waits for memory before we push back on eventarc
+	wait time.Duration
+}
+
+// handleFinalized thumbnails the object of an eventarc event. eventarc retries any event that isn't acknowledged with
+// a 2xx, with a backoff, so the status is how we steer it
+//
+// - 200 for thumbnails written and for events a retry can't help, eg objects too large for any instance or not images
+// - 429 when the image has to wait too long for memory, eventarc backs off and cloud run scales out meanwhile
+// - 503 for failures reading or writing gcs, which a retry may well get past
+func (w *worker) handleFinalized() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		logger := w.logger.WrapTraceContext(ctx)
+		if eventType := request.Header.Get("Ce-Type"); eventType != finalizedType {
+			logger.Infow("ignoring event", "type", eventType)
+			httpx.RespondJSON(writer, map[string]string{"status": "ignored"}, http.StatusOK)
+			return
+		}
+		var object storageObject
+		if err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&object); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "json.Decode()"))
+			return
+		}
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.String("image.bucket", object.Bucket),
+			attribute.String("image.name", object.Name),
+			attribute.String("event.id", request.Header.Get("Ce-Id")),
+		)
+
+		started := time.Now()
+		err := w.thumbnail(ctx, &object)
+		var backpressure *backpressureError
+		switch {
+		case err == nil:
+			logger.Infow("thumbnail written", "object", object.Name, "took", time.Since(started).String())
+			httpx.RespondJSON(writer, map[string]string{"status": "done"}, http.StatusOK)
+		case errors.Is(err, errSkipped):
+			logger.Warnw("skipping object", "object", object.Name, "reason", err.Error())
+			httpx.RespondJSON(writer, map[string]string{"status": "skipped", "reason": err.Error()}, http.StatusOK)
+		case errors.As(err, &backpressure):
+			logger.Infow("no memory for image, pushing back", "object", object.Name, "needs_bytes", backpressure.needs)
+			writer.Header().Set("Retry-After", "10")
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "busy", Message: "no memory for this image right now"}, http.StatusTooManyRequests)
+		default:
+			logger.Errorw("thumbnailing failed, eventarc will retry", "object", object.Name, "err", err)
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "w.thumbnail()"))
+		}
+	}
+}
+
+// backpressureError is an image that didn't get its memory in time
+type backpressureError struct {
+	needs int64
+}
+
+func (e *backpressureError) Error() string {
+	return fmt.Sprintf("waited too long for %d bytes of memory", e.needs)
+}
+
+// thumbnail streams object in, decodes it once memory for it is reserved and streams its thumbnail out
+func (w *worker) thumbnail(ctx context.Context, object *storageObject) error {
+	if object.Bucket == w.outputBucket && strings.HasPrefix(object.Name, thumbnailPrefix) {
+		return fmt.Errorf("%w: already a thumbnail", errSkipped)
+	}
+	if size, err := strconv.ParseInt(object.Size, 10, 64); err == nil && size > w.maxBytes {
+		return fmt.Errorf("%w: %d bytes is more than the %d we take", errSkipped, size, w.maxBytes)
+	}
+
+	resp, err := w.storage.Objects.Get(object.Bucket, object.Name).Context(ctx).Download()
+	if err != nil {
+		return fmt.Errorf("Objects.Get(%s).Download(): %v", object.Name, err)
+	}
+	defer resp.Body.Close()
+	body := &readRecorder{r: io.LimitReader(resp.Body, w.maxBytes)}
+
+	// the header of an image tells its dimensions before anything is decoded, what we read of it is replayed after
+	var head bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(body, &head))
+	if err != nil {
+		if body.err != nil {
+			return fmt.Errorf("reading %s: %v", object.Name, body.err)
+		}
+		return fmt.Errorf("%w: not an image we can decode: %v", errSkipped, err)
+	}
+	needs := decodedBytes(config, w.size)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("image.format", format),
+		attribute.Int("image.width", config.Width),
+		attribute.Int("image.height", config.Height),
+		attribute.Int64("image.reserved_bytes", needs),
+	)
+	if needs > w.budget {
+		return fmt.Errorf("%w: %dx%d needs %d bytes, more than the %d of an instance", errSkipped, config.Width, config.Height, needs, w.budget)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, w.wait)
+	err = w.memory.Acquire(waitCtx, needs)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &backpressureError{needs: needs}
+	}
+	defer w.memory.Release(needs)
+
+	thumb, err := decodeThumbnail(io.MultiReader(&head, body), w.size)
+	if err != nil {
+		if body.err != nil {
+			return fmt.Errorf("reading %s: %v", object.Name, body.err)
+		}
+		return fmt.Errorf("%w: %v", errSkipped, err)
+	}
+
+	// cancelled before Close, a failed write leaves no half written thumbnail behind
+	writeCtx, cancelWrite := context.WithCancel(ctx)
+	defer cancelWrite()
+	contentType := "image/png"
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+	}
+	out := gcsx.NewWriter(writeCtx, w.storage, w.outputBucket, thumbnailPrefix+object.Name, contentType)
+	if format == "jpeg" {
+		err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(out, thumb)
+	}
+	if err != nil {
+		cancelWrite()
+		out.Close()
+		return fmt.Errorf("encoding %s: %v", format, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("out.Close(): %v", err)
+	}
+	return nil
+}
+
+// readRecorder keeps the first error reading r failed with. a decoder reports a connection gcs dropped halfway the
+// same way as a corrupt image, only a decode that read everything it wanted is one a retry won't change
+type readRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// decodeThumbnail decodes an image and scales it down, the full image is garbage as soon as this returns so the gc
+// may have it while we encode
+func decodeThumbnail(r io.Reader, size int) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("image.Decode(): %v", err)
+	}
+	return resize(img, size), nil
+}
+
+// decodedBytes estimates the memory decoding config takes, 4 bytes a pixel for the image and its thumbnail, plus the
+// chunk gcsx buffers for the upload
+func decodedBytes(config image.Config, size int) int64 {
+	return int64(config.Width)*int64(config.Height)*4 + int64(size)*int64(size)*4 + 2<<20
+}
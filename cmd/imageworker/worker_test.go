@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noisyPNG is large enough that its pixels come well after its header
+func noisyPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7919 >> 3)
+	}
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode(): %v", err)
+	}
+	return buf.Bytes()
+}
+
+// fakeGCS serves objects, an object with a drop after n bytes announces all of them but the connection goes away
+// once n are sent
+func fakeGCS(t *testing.T, objects map[string][]byte, drops map[string]int) *storage.Service {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		name := request.URL.Path[strings.LastIndex(request.URL.Path, "/")+1:]
+		data, ok := objects[name]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		n, dropped := drops[name]
+		if !dropped {
+			writer.Write(data)
+			return
+		}
+		writer.Write(data[:n])
+		writer.(http.Flusher).Flush()
+		conn, _, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack(): %v", err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	svc, err := storage.NewService(context.Background(), option.WithEndpoint(srv.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("storage.NewService(): %v", err)
+	}
+	return svc
+}
+
+func TestThumbnailReadErrors(t *testing.T) {
+	img := noisyPNG(t)
+	objects := map[string][]byte{
+		"garbage.png":   []byte("this is not an image at all"),
+		"truncated.png": img[:len(img)/2],
+		"header.png":    img,
+		"pixels.png":    img,
+	}
+	drops := map[string]int{
+		// gone before the header was read, and after it while the pixels were
+		"header.png": 10,
+		"pixels.png": len(img) / 2,
+	}
+	w := &worker{
+		storage:      fakeGCS(t, objects, drops),
+		outputBucket: "thumbnails",
+		size:         32,
+		maxBytes:     32 << 20,
+		budget:       1 << 30,
+		memory:       semaphore.NewWeighted(1 << 30),
+		wait:         time.Second,
+	}
+
+	tests := []struct {
+		name    string
+		skipped bool
+	}{
+		{name: "garbage.png", skipped: true},
+		// everything gcs has was read, the image itself is broken
+		{name: "truncated.png", skipped: true},
+		{name: "header.png", skipped: false},
+		{name: "pixels.png", skipped: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := w.thumbnail(context.Background(), &storageObject{Bucket: "uploads", Name: tt.name})
+			if err == nil {
+				t.Fatalf("w.thumbnail() succeeded, want an error")
+			}
+			if got := errors.Is(err, errSkipped); got != tt.skipped {
+				t.Errorf("w.thumbnail() = %v, skipped %t, want %t", err, got, tt.skipped)
+			}
+		})
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"cloud.google.com/go/compute/metadata"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
 	"log"
 	"net/http"
 	"os"
@@ -14,17 +19,56 @@ func main() {
 }
 
 func run() error {
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	info := buildinfo.Get()
+	logger.Infow("starting", "version", info.Version, "revision", info.Revision, "ko_data", os.Getenv("KO_DATA_PATH"))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		fmt.Fprintf(w, "<h1>hello world! </h1>")
 	})
+	mux.HandleFunc("/version", buildinfo.Handler())
+	mux.HandleFunc("/env", handleEnv())
+
+	// serverx answers /healthz and /readyz ahead of our mux and drains in flight requests on SIGTERM
+	srv := serverx.New("", mux, logger)
+	return srv.ListenAndServe()
+}
+
+// echoed are the only env vars /env reveals, the container contract of cloud run and what ko sets. a denylist of
+// secret looking names would miss the one secret named unlike the others, so anything else stays hidden
+var echoed = []string{"K_SERVICE", "K_REVISION", "K_CONFIGURATION", "PORT", "KO_DATA_PATH"}
 
-	// cloud run sets the PORT env variable for us to listen on
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// handleEnv echoes the env vars in echoed that are set, so a smoke test can check what cloud run actually gave the
+// revision
+func handleEnv() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		env := map[string]string{}
+		for _, name := range echoed {
+			if value, ok := os.LookupEnv(name); ok {
+				env[name] = value
+			}
+		}
+		httpx.RespondJSON(writer, env, http.StatusOK)
 	}
-	log.Printf("starting server on %q", port)
-	return http.ListenAndServe(":"+port, mux)
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type config struct {
+	target       string
+	mixFile      string
+	paths        string
+	token        string
+	auth         bool
+	concurrency  int
+	maxConc      int
+	stepDuration time.Duration
+	timeout      time.Duration
+	maxErrorRate float64
+}
+
+func run() error {
+	cfg := config{}
+	flag.StringVar(&cfg.target, "target", "", "url of the service, eg https://api-xyz.a.run.app")
+	flag.StringVar(&cfg.mixFile, "mix", "", "json file with the request mix, [{\"method\":\"GET\",\"path\":\"/api/http\",\"weight\":3}]")
+	flag.StringVar(&cfg.paths, "paths", "", "comma separated paths to GET evenly when no -mix is given")
+	flag.StringVar(&cfg.token, "token", "", "identity token to send, eg $(gcloud auth print-identity-token)")
+	flag.BoolVar(&cfg.auth, "auth", true, "mint identity tokens for -target from application default credentials when no -token is given")
+	flag.IntVar(&cfg.concurrency, "concurrency", 8, "concurrent requests, the starting point when ramping")
+	flag.IntVar(&cfg.maxConc, "max-concurrency", 0, "ramp concurrency by doubling up to this value to find the saturation point")
+	flag.DurationVar(&cfg.stepDuration, "duration", 30*time.Second, "how long to hold each concurrency level")
+	flag.DurationVar(&cfg.timeout, "timeout", 30*time.Second, "per request timeout")
+	flag.Float64Var(&cfg.maxErrorRate, "max-error-rate", 0.01, "error and shed rate at which a step counts as saturated")
+	flag.Parse()
+
+	if cfg.target == "" {
+		return fmt.Errorf("-target must be set")
+	}
+	target, err := url.Parse(strings.TrimSuffix(cfg.target, "/"))
+	if err != nil {
+		return fmt.Errorf("url.Parse(): %v", err)
+	}
+	requests, err := loadMix(cfg.mixFile, cfg.paths)
+	if err != nil {
+		return fmt.Errorf("loadMix(): %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := newClient(ctx, target, cfg)
+	if err != nil {
+		return fmt.Errorf("newClient(): %v", err)
+	}
+
+	var summaries []summary
+	saturatedAt := 0
+	for _, concurrency := range steps(cfg.concurrency, cfg.maxConc) {
+		log.Printf("running %d concurrent requests for %s", concurrency, cfg.stepDuration)
+		sum := runStep(ctx, client, target, requests, concurrency, cfg.stepDuration)
+		summaries = append(summaries, sum)
+		if ctx.Err() != nil {
+			break
+		}
+		if saturated, reason := saturation(summaries, cfg.maxErrorRate); saturated {
+			log.Printf("stopping the ramp, %s", reason)
+			if len(summaries) > 1 {
+				saturatedAt = summaries[len(summaries)-2].Concurrency
+			}
+			break
+		}
+	}
+
+	fmt.Println()
+	printSummaries(os.Stdout, summaries)
+	if len(summaries) > 1 {
+		fmt.Printf("\nbest throughput at concurrency %d\n", best(summaries, cfg.maxErrorRate).Concurrency)
+	}
+	if saturatedAt > 0 {
+		fmt.Printf("saturation point around concurrency %d, a good starting value for --concurrency and the limiter\n", saturatedAt)
+	}
+	return nil
+}
+
+// newClient authenticates every request with an identity token for target, the audience cloud run expects
+func newClient(ctx context.Context, target *url.URL, cfg config) (*http.Client, error) {
+	transport := clientx.NewTransport()
+	// one connection per worker, otherwise the ramp measures our dialing instead of the service
+	transport.MaxIdleConnsPerHost = cfg.concurrency
+	if cfg.maxConc > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = cfg.maxConc
+	}
+	client := &http.Client{Transport: transport, Timeout: cfg.timeout}
+
+	switch {
+	case cfg.token != "":
+		client.Transport = &oauth2.Transport{Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: cfg.token}), Base: transport}
+	case cfg.auth:
+		// user credentials from gcloud can't mint identity tokens for an arbitrary audience, pass -token for those
+		tokens, err := idtoken.NewTokenSource(ctx, target.Scheme+"://"+target.Host)
+		if err != nil {
+			return nil, fmt.Errorf("idtoken.NewTokenSource(): %v, pass -token or -auth=false", err)
+		}
+		client.Transport = &oauth2.Transport{Source: tokens, Base: transport}
+	}
+	return client, nil
+}
+
+// steps doubles from start up to max, a single step when we are not ramping
+func steps(start, max int) []int {
+	if start < 1 {
+		start = 1
+	}
+	levels := []int{start}
+	for c := start * 2; c < max; c *= 2 {
+		levels = append(levels, c)
+	}
+	if max > start {
+		levels = append(levels, max)
+	}
+	return levels
+}
+
+// runStep keeps concurrency requests in flight for d
+func runStep(ctx context.Context, client *http.Client, target *url.URL, requests *mix, concurrency int, d time.Duration) summary {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	st := newStats()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				entry := requests.pick(rnd)
+				began := time.Now()
+				status, err := send(ctx, client, target, entry)
+				if ctx.Err() != nil {
+					// the step ended mid request, that isn't the service failing
+					return
+				}
+				if err != nil {
+					log.Printf("%s %s: %v", entry.Method, entry.Path, err)
+				}
+				st.record(time.Since(began), status)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return st.summarize(concurrency, time.Since(start))
+}
+
+func send(ctx context.Context, client *http.Client, target *url.URL, entry mixEntry) (int, error) {
+	var body io.Reader
+	if len(entry.Body) > 0 {
+		body = bytes.NewReader(entry.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, entry.Method, target.String()+entry.Path, body)
+	if err != nil {
+		return 0, fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range entry.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "effectivecloudrun-loadgen")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("client.Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	// read the whole response so the latency includes the body and the connection goes back to the pool
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return 0, fmt.Errorf("io.Copy(): %v", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// saturation compares the latest step to the one before it. an instance is saturated once more concurrency stops
+// buying throughput and only adds latency, or once it starts failing or shedding requests
+func saturation(summaries []summary, maxErrorRate float64) (bool, string) {
+	last := summaries[len(summaries)-1]
+	if rate := last.ErrorRate + last.ShedRate; rate > maxErrorRate {
+		return true, fmt.Sprintf("%.2f%% of requests failed or were shed at concurrency %d", rate*100, last.Concurrency)
+	}
+	if len(summaries) < 2 {
+		return false, ""
+	}
+	prev := summaries[len(summaries)-2]
+	if prev.RPS == 0 || prev.P95 == 0 {
+		return false, ""
+	}
+	gained := last.RPS/prev.RPS - 1
+	slower := float64(last.P95)/float64(prev.P95) - 1
+	if gained < 0.10 && slower > 0.50 {
+		return true, fmt.Sprintf("going from %d to %d gained %.0f%% throughput but p95 grew %.0f%%", prev.Concurrency, last.Concurrency, gained*100, slower*100)
+	}
+	return false, ""
+}
+
+// best is the step with the highest throughput that stayed under the error budget
+func best(summaries []summary, maxErrorRate float64) summary {
+	top := summaries[0]
+	for _, s := range summaries[1:] {
+		if s.ErrorRate+s.ShedRate <= maxErrorRate && s.RPS > top.RPS {
+			top = s
+		}
+	}
+	return top
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// mixEntry is one kind of request in a request mix, weight is relative to the other entries
+type mixEntry struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+	Weight  int               `json:"weight"`
+}
+
+// mix picks requests in proportion to their weights
+type mix struct {
+	entries []mixEntry
+	total   int
+}
+
+// loadMix reads a json array of mix entries from path, or builds an even mix of GET requests from a comma separated
+// list of paths
+func loadMix(path, paths string) (*mix, error) {
+	var entries []mixEntry
+	switch {
+	case path != "":
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadFile(): %v", err)
+		}
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal(): %v", err)
+		}
+	case paths != "":
+		for _, p := range strings.Split(paths, ",") {
+			entries = append(entries, mixEntry{Path: strings.TrimSpace(p)})
+		}
+	default:
+		entries = []mixEntry{{Path: "/"}}
+	}
+
+	m := &mix{}
+	for _, e := range entries {
+		if e.Method == "" {
+			e.Method = http.MethodGet
+		}
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		if !strings.HasPrefix(e.Path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", e.Path)
+		}
+		m.entries = append(m.entries, e)
+		m.total += e.Weight
+	}
+	if len(m.entries) == 0 {
+		return nil, fmt.Errorf("request mix is empty")
+	}
+	return m, nil
+}
+
+// pick returns a random entry, rnd is owned by the calling worker since math/rand sources aren't safe to share
+func (m *mix) pick(rnd *rand.Rand) mixEntry {
+	n := rnd.Intn(m.total)
+	for _, e := range m.entries {
+		if n < e.Weight {
+			return e
+		}
+		n -= e.Weight
+	}
+	return m.entries[len(m.entries)-1]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stats collects the outcome of every request sent during one step
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+func newStats() *stats {
+	return &stats{statuses: map[int]int{}}
+}
+
+// record adds one request, status is 0 when the request failed before we got a response
+func (s *stats) record(latency time.Duration, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == 0 {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+	s.statuses[status]++
+}
+
+// summary is what we report for a step
+type summary struct {
+	Concurrency int
+	Requests    int
+	RPS         float64
+	P50         time.Duration
+	P95         time.Duration
+	P99         time.Duration
+	Max         time.Duration
+	// ErrorRate counts transport errors and 5xx responses other than shedding
+	ErrorRate float64
+	// ShedRate counts 429 and 503 responses, what our shedder answers with when an instance is full
+	ShedRate float64
+}
+
+func (s *stats) summarize(concurrency int, elapsed time.Duration) summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	total := len(sorted) + s.errors
+	failed, shed := s.errors, 0
+	for status, n := range s.statuses {
+		switch {
+		case status == 429 || status == 503:
+			shed += n
+		case status >= 500:
+			failed += n
+		}
+	}
+
+	sum := summary{Concurrency: concurrency, Requests: total}
+	if elapsed > 0 {
+		sum.RPS = float64(total) / elapsed.Seconds()
+	}
+	if total > 0 {
+		sum.ErrorRate = float64(failed) / float64(total)
+		sum.ShedRate = float64(shed) / float64(total)
+	}
+	if len(sorted) > 0 {
+		sum.P50 = percentile(sorted, 0.50)
+		sum.P95 = percentile(sorted, 0.95)
+		sum.P99 = percentile(sorted, 0.99)
+		sum.Max = sorted[len(sorted)-1]
+	}
+	return sum
+}
+
+// percentile uses the nearest rank of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func printSummaries(w io.Writer, summaries []summary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "concurrency\trequests\trps\tp50\tp95\tp99\tmax\terrors\tshed\t")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%.2f%%\t%.2f%%\t\n",
+			s.Concurrency, s.Requests, s.RPS,
+			round(s.P50), round(s.P95), round(s.P99), round(s.Max),
+			s.ErrorRate*100, s.ShedRate*100,
+		)
+	}
+	tw.Flush()
+}
+
+func round(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(100 * time.Microsecond)
+}
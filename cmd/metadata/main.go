@@ -2,8 +2,10 @@ package main
 
 import (
 	"cloud.google.com/go/compute/metadata"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
 	"log"
 	"net/http"
 	"os"
@@ -77,6 +79,25 @@ func run() error {
 		}
 		log.Printf("recieve identity token that is %d bytes", len(identityToken))
 
+		// or let clientx fetch, reuse and refresh access tokens for us, to call an api that has no go client library
+		// our credentials are only looked up once the first token is needed
+		ctx := context.Background()
+		resourceManager := clientx.New(
+			clientx.WithBaseURL("https://cloudresourcemanager.googleapis.com/v1/"),
+			clientx.WithGoogleAuth(clientx.DeferredGoogleTokenSource("https://www.googleapis.com/auth/cloud-platform.read-only")),
+		)
+		var project struct {
+			Name           string `json:"name"`
+			LifecycleState string `json:"lifecycleState"`
+		}
+		// our identity needs resourcemanager.projects.get, which the default compute service account has
+		if err := resourceManager.JSON(ctx, http.MethodGet, "projects/"+projectID, nil, &project); err != nil {
+			log.Printf("resourceManager.JSON(projects/%s): %v", projectID, err)
+		} else {
+			response.MetadataResults["projectName"] = project.Name
+			response.MetadataResults["projectState"] = project.LifecycleState
+			log.Printf("our project is named %q and is %s", project.Name, project.LifecycleState)
+		}
 	}
 
 	// serve out some of the instance metadata
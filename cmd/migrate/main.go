@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/jobx"
+	"github.com/amammay/effectivecloudrun/internal/lockx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/migrate"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	ledgerPath := flag.String("ledger", "migrations/ledger", "document that remembers which migrations were applied")
+	locks := flag.String("locks", "locks", "collection of the lock that keeps two runs from migrating at once")
+	dryRun := flag.Bool("dry-run", false, "count what every pending migration would update without writing anything")
+	list := flag.Bool("list", false, "list applied and pending migrations and exit")
+	batchSize := flag.Int("batch", 200, "updates per commit, at most 500")
+	rate := flag.Float64("rate", 500, "documents scanned per second at most, 0 for no limit")
+	flag.Parse()
+
+	// retrieves our project id from the gcp metadata server
+	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+	if projectID == "" {
+		return fmt.Errorf("GOOGLE_CLOUD_PROJECT must be set when running outside of gcp")
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// a job's task gets a SIGTERM when it is cancelled or runs past its --task-timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	defer client.Close()
+
+	task := jobx.FromEnv()
+	logger = logger.With("task", task.String())
+	runner, err := migrate.New(client, *ledgerPath, migrations,
+		migrate.WithBatchSize(*batchSize),
+		migrate.WithDryRun(*dryRun),
+		migrate.WithPacer(jobx.NewPacer(*rate)),
+		migrate.WithLogger(logger),
+	)
+	if err != nil {
+		return fmt.Errorf("migrate.New(): %v", err)
+	}
+	if *list {
+		return printMigrations(ctx, runner)
+	}
+	if task.Index != 0 {
+		// migrations run one after the other, the other tasks have nothing to do
+		logger.Info("migrations run as the first task only")
+		return nil
+	}
+
+	// a second execution started while this one runs fails rather than migrate the same documents along with us
+	locker := lockx.New(client, *locks, task.Execution, lockx.WithLogger(logger))
+	started := time.Now()
+	err = locker.Hold(ctx, "migrations", func(ctx context.Context, lease *lockx.Lease) error {
+		results, err := runner.Run(ctx)
+		for _, r := range results {
+			logger.Infow("migration result", "migration", r.ID, "scanned", r.Scanned, "updated", r.Updated, "resumed", r.Resumed,
+				"took", r.Took.String(), "dry_run", *dryRun)
+		}
+		logger.Infow("migrations finished", "ran", len(results), "took", time.Since(started).String(), "dry_run", *dryRun)
+		return err
+	})
+	if errors.Is(err, lockx.ErrHeld) {
+		return fmt.Errorf("another run is migrating, try again once it is done: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("locker.Hold(): %v", err)
+	}
+	return nil
+}
+
+func printMigrations(ctx context.Context, runner *migrate.Runner) error {
+	applied, err := runner.Applied(ctx)
+	if err != nil {
+		return fmt.Errorf("runner.Applied(): %v", err)
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if a, ok := applied[m.ID]; ok {
+			state = fmt.Sprintf("applied %s, %d of %d updated", a.At.Format(time.RFC3339), a.Updated, a.Scanned)
+		}
+		fmt.Printf("%-24s %s\n  %s\n", m.ID, state, m.Description)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"github.com/amammay/effectivecloudrun/internal/migrate"
+	"strings"
+)
+
+// migrations are every migration of the data our examples keep in firestore. append new ones with the next number,
+// never change or renumber one that ran somewhere
+var migrations = []migrate.Migration{
+	{
+		ID:          "0001_beers_name_lower",
+		Description: "store a lowercased copy of every beer name for case insensitive prefix queries",
+		Query: func(client *firestore.Client) firestore.Query {
+			return client.Collection("beers").Query
+		},
+		Update: func(doc *firestore.DocumentSnapshot) ([]firestore.Update, error) {
+			name, _ := doc.Data()["name"].(string)
+			lower := strings.ToLower(name)
+			if existing, ok := doc.Data()["name_lower"].(string); ok && existing == lower {
+				return nil, nil
+			}
+			return []firestore.Update{{Path: "name_lower", Value: lower}}, nil
+		},
+	},
+	{
+		// the expand half of renaming beer_name to name, readers move to name once this ran everywhere, and a later
+		// migration deletes beer_name once nothing reads it anymore
+		ID:          "0002_beer_name",
+		Description: "copy beer_name to name in the beer collection",
+		Query: func(client *firestore.Client) firestore.Query {
+			return client.Collection("beer").Query
+		},
+		Update: func(doc *firestore.DocumentSnapshot) ([]firestore.Update, error) {
+			data := doc.Data()
+			beerName, ok := data["beer_name"].(string)
+			if !ok {
+				return nil, nil
+			}
+			if name, ok := data["name"].(string); ok && name == beerName {
+				return nil, nil
+			}
+			return []firestore.Update{{Path: "name", Value: beerName}}, nil
+		},
+	},
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var templates embed.FS
+
+// cloud run service names are lowercase letters, digits and dashes
+var validName = regexp.MustCompile(`^[a-z]([a-z0-9-]{0,47}[a-z0-9])?$`)
+
+// service is what our templates are rendered with
+type service struct {
+	Name      string
+	Module    string
+	Dir       string
+	ProjectID string
+
+	Config  bool
+	Tracing bool
+	Auth    bool
+}
+
+// file maps a template to the file it generates, files with a feature that is turned off are skipped
+type file struct {
+	template string
+	name     string
+	enabled  func(s service) bool
+}
+
+var files = []file{
+	{template: "main.go.tmpl", name: "main.go"},
+	{template: "api.go.tmpl", name: "api.go"},
+	{template: "trace.go.tmpl", name: "trace.go", enabled: func(s service) bool { return s.Tracing }},
+	{template: "README.md.tmpl", name: "README.md"},
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	s := service{}
+	var force bool
+	flag.StringVar(&s.Name, "name", "", "name of the service, also its cloud run service name")
+	flag.StringVar(&s.Dir, "dir", "", "directory to generate into relative to the module root, defaults to cmd/<name>")
+	flag.StringVar(&s.ProjectID, "project", "mammay-labs", "project id used when running off of gcp")
+	flag.BoolVar(&s.Config, "config", true, "layered config through configx")
+	flag.BoolVar(&s.Tracing, "tracing", true, "cloud trace through otel and tracex")
+	flag.BoolVar(&s.Auth, "auth", false, "identity token auth on /api through authx")
+	flag.BoolVar(&force, "force", false, "overwrite files that already exist")
+	flag.Parse()
+
+	if !validName.MatchString(s.Name) {
+		return fmt.Errorf("-name %q must be lowercase letters, digits and dashes", s.Name)
+	}
+	if s.Dir == "" {
+		s.Dir = "cmd/" + s.Name
+	}
+	s.Dir = filepath.ToSlash(filepath.Clean(s.Dir))
+
+	// our internal packages can only be imported from inside this module, so we always generate relative to its root
+	root, module, err := findModule()
+	if err != nil {
+		return fmt.Errorf("findModule(): %v", err)
+	}
+	s.Module = module
+
+	out := filepath.Join(root, filepath.FromSlash(s.Dir))
+	rendered, err := render(s)
+	if err != nil {
+		return fmt.Errorf("render(): %v", err)
+	}
+	if !force {
+		for name := range rendered {
+			if _, err := os.Stat(filepath.Join(out, name)); err == nil {
+				return fmt.Errorf("%s already exists, pass -force to overwrite", filepath.Join(s.Dir, name))
+			}
+		}
+	}
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return fmt.Errorf("os.MkdirAll(): %v", err)
+	}
+	for name, content := range rendered {
+		if err := ioutil.WriteFile(filepath.Join(out, name), content, 0o644); err != nil {
+			return fmt.Errorf("ioutil.WriteFile(): %v", err)
+		}
+		fmt.Println(filepath.Join(s.Dir, name))
+	}
+	return nil
+}
+
+// render executes every enabled template, go files are gofmt'd so the templates don't have to be exact about blank
+// lines and import order
+func render(s service) (map[string][]byte, error) {
+	tmpl, err := template.ParseFS(templates, "templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("template.ParseFS(): %v", err)
+	}
+	rendered := map[string][]byte{}
+	for _, f := range files {
+		if f.enabled != nil && !f.enabled(s) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, f.template, s); err != nil {
+			return nil, fmt.Errorf("tmpl.ExecuteTemplate(%s): %v", f.template, err)
+		}
+		content := buf.Bytes()
+		if strings.HasSuffix(f.name, ".go") {
+			content, err = format.Source(content)
+			if err != nil {
+				return nil, fmt.Errorf("format.Source(%s): %v", f.name, err)
+			}
+		}
+		rendered[f.name] = content
+	}
+	return rendered, nil
+}
+
+// findModule walks up from the working directory to the go.mod and returns its directory and module path
+func findModule() (string, string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", "", fmt.Errorf("os.Getwd(): %v", err)
+	}
+	for {
+		f, err := os.Open(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "module ") {
+					return dir, strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "module ")), `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("no module directive in %s", filepath.Join(dir, "go.mod"))
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("no go.mod found, run from inside the module")
+		}
+		dir = parent
+	}
+}
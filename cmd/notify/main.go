@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/tracex"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	AppName             = "notify"
+	instrumentationName = "github.com/amammay/effectivecloudrun/cmd/notify"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type server struct {
+	mux    *http.ServeMux
+	logger *logx.AppLogger
+	queue  *tasksQueue
+	sender *sender
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.mux.ServeHTTP(writer, request)
+}
+
+func run() error {
+	ctx := context.Background()
+
+	// layer our config, defaults < ./config/<profile>.json < APP_* env < secrets mounted at /secrets
+	cfg, err := configx.Load(
+		configx.WithDefaults(map[string]string{
+			"trace_sample_ratio": "1",
+			// the queue notifications wait in, projects/<project>/locations/<region>/queues/<queue>
+			"tasks_queue": "",
+			// the identity cloud tasks calls us with, it needs run.invoker on this service
+			"tasks_service_account": "",
+			// the full url of /tasks/send on this service, also the audience of the tokens cloud tasks presents
+			"send_url": "",
+			// the messages endpoint of our email provider and who our emails are from
+			"provider_url": "",
+			"email_from":   "",
+			// the api key of our email provider, mount it from secret manager at /secrets/email_api_key
+			"email_api_key": "",
+			// what tasks were already sent, set a ttl policy on its expires field or run cmd/dedupesweep
+			"dedupe_collection": "dedupe",
+		}),
+		configx.WithProfileDir("config"),
+		configx.WithEnvPrefix("APP"),
+		configx.WithSecretsDir("/secrets"),
+		configx.WithSensitiveKeys("email_api_key"),
+	)
+	if err != nil {
+		return fmt.Errorf("configx.Load(): %v", err)
+	}
+
+	ratio, err := strconv.ParseFloat(cfg.String("trace_sample_ratio"), 64)
+	if err != nil {
+		return fmt.Errorf("strconv.ParseFloat(trace_sample_ratio): %v", err)
+	}
+	// logs, traces and metrics, torn down together once our server has shut down. the sampler is parent based, a
+	// notification sampled when it was asked for stays sampled while it is sent
+	sampler, err := tracex.NewSampler(ratio)
+	if err != nil {
+		return fmt.Errorf("tracex.NewSampler(): %v", err)
+	}
+	telemetry, err := obs.Init(ctx, obs.Config{ServiceName: AppName, Sampler: sampler})
+	if err != nil {
+		return fmt.Errorf("obs.Init(): %v", err)
+	}
+	projectID := telemetry.ProjectID
+	loggerClient := telemetry.Logger
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	cfg.Log(logger)
+	for _, key := range []string{"tasks_queue", "tasks_service_account", "send_url", "provider_url", "email_from", "email_api_key"} {
+		if cfg.String(key) == "" {
+			return fmt.Errorf("%s must be set", key)
+		}
+	}
+
+	queue, err := newTasksQueue(ctx, cfg.String("tasks_queue"), cfg.String("send_url"), cfg.String("tasks_service_account"))
+	if err != nil {
+		return fmt.Errorf("newTasksQueue(): %v", err)
+	}
+	firestoreClient, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	defer firestoreClient.Close()
+	// only cloud tasks, presenting an identity token for our send url as our tasks service account, may send
+	verifier, err := authx.NewVerifier(ctx, cfg.String("send_url"), authx.WithAllowedEmails(cfg.String("tasks_service_account")))
+	if err != nil {
+		return fmt.Errorf("authx.NewVerifier(): %v", err)
+	}
+
+	s := &server{
+		mux:    http.NewServeMux(),
+		logger: loggerClient,
+		queue:  queue,
+		sender: newSender(cfg.String("provider_url"), cfg.String("email_from"), cfg.String("email_api_key")),
+	}
+	// cloud tasks retries a task until it succeeds, a task we already sent is acknowledged without sending it again
+	sent := dedupe.New(dedupe.Firestore(firestoreClient, cfg.String("dedupe_collection")), "tasks")
+	s.mux.Handle("/notifications", s.handleNotify())
+	s.mux.Handle("/tasks/send", verifier.Middleware(sent.Middleware(dedupe.TaskName)(s.handleSend())))
+
+	// telemetry is flushed after every hook so it includes them
+	srv := serverx.New("", otelhttp.NewHandler(s, AppName), logger, telemetry.ServerOptions()...)
+	return srv.ListenAndServe()
+}
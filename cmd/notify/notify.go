@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/idempotency"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// notification is an email we were asked to send
+type notification struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+func (n *notification) Validate() []errs.FieldError {
+	var fields []errs.FieldError
+	if _, err := mail.ParseAddress(n.To); err != nil {
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/to", Constraint: "format", Message: "to is an email address"})
+	}
+	if strings.TrimSpace(n.Subject) == "" {
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/subject", Constraint: "required", Message: "subject is required"})
+	}
+	if len(n.Text) > 64<<10 {
+		fields = append(fields, errs.FieldError{In: "body", Pointer: "/text", Constraint: "maxLength", Message: "text is at most 65536 bytes"})
+	}
+	return fields
+}
+
+// task is the body of a task on our queue
+type task struct {
+	Notification notification `json:"notification"`
+	// Trace is the trace context of the request that asked for the notification. cloud run puts a trace of its own on
+	// the request cloud tasks makes, in the payload ours gets to /tasks/send untouched
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// handleNotify queues a notification and answers with a 202 and its id. a client retrying the same notification with
+// the same Idempotency-Key gets the same id and its notification is sent once
+func (s *server) handleNotify() http.HandlerFunc {
+	type notifyResponse struct {
+		ID string `json:"id"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if request.Method != http.MethodPost {
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "method_not_allowed", Message: "method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		var n notification
+		if err := httpx.DecodeJSON(writer, request, &n, 128<<10); err != nil {
+			httpx.LogInvalid(ctx, s.logger, err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		id, err := taskID(request, &n)
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "taskID()"))
+			return
+		}
+
+		t := &task{Notification: n, Trace: map[string]string{}}
+		otel.GetTextMapPropagator().Inject(ctx, traceCarrier(t.Trace))
+		body, err := json.Marshal(t)
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "json.Marshal()"))
+			return
+		}
+		if err := s.queue.enqueue(ctx, id, body); err != nil {
+			s.logger.WrapTraceContext(ctx).Errorw("s.queue.enqueue()", "id", id, "err", err)
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.queue.enqueue()"))
+			return
+		}
+		s.logger.WrapTraceContext(ctx).Infow("notification queued", "id", id)
+		httpx.RespondJSON(writer, &notifyResponse{ID: id}, http.StatusAccepted)
+	}
+}
+
+// taskID names the task of a request after its Idempotency-Key and the notification it carries, or randomly without a
+// key. a key reused for another notification names another task rather than silently dropping that notification as
+// a retry. our callers are our own services, cloud run iam lets nobody else in, so keys aren't scoped per caller
+func taskID(request *http.Request, n *notification) (string, error) {
+	if key := request.Header.Get(idempotency.Header); key != "" {
+		payload, err := json.Marshal(n)
+		if err != nil {
+			return "", fmt.Errorf("json.Marshal(): %v", err)
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "%d:%s", len(key), key)
+		h.Write(payload)
+		return "n-" + hex.EncodeToString(h.Sum(nil)[:16]), nil
+	}
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("io.ReadFull(): %v", err)
+	}
+	return "n-" + hex.EncodeToString(b), nil
+}
+
+// handleSend sends the notification of a task. the task name is the Idempotency-Key we give our provider, so a
+// retry after a send whose response we never got isn't sent twice either. failures cloud tasks should retry answer
+// with a 503, a notification the provider refuses for good is dropped with a 200
+func (s *server) handleSend() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		name := dedupe.TaskName(request)
+		var t task
+		if err := json.NewDecoder(io.LimitReader(request.Body, 1<<20)).Decode(&t); err != nil {
+			// a task we can't decode never will be, cloud tasks would retry it until it gives up
+			s.logger.WrapTraceContext(request.Context()).Errorw("dropping undecodable task", "task", name, "err", err)
+			httpx.RespondJSON(writer, map[string]string{"status": "dropped"}, http.StatusOK)
+			return
+		}
+
+		// continue the trace of the request that asked for the notification, linked to the request cloud tasks made
+		opts := []trace.SpanStartOption{
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(attribute.String("notify.task", name)),
+		}
+		ctx := request.Context()
+		if len(t.Trace) > 0 {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}))
+			ctx = otel.GetTextMapPropagator().Extract(ctx, traceCarrier(t.Trace))
+		}
+		if retries, err := strconv.Atoi(request.Header.Get("X-CloudTasks-TaskRetryCount")); err == nil {
+			opts = append(opts, trace.WithAttributes(attribute.Int("notify.retries", retries)))
+		}
+		ctx, span := otel.Tracer(instrumentationName).Start(ctx, "notify.send", opts...)
+		defer span.End()
+		logger := s.logger.WrapTraceContext(ctx)
+
+		err := s.sender.send(ctx, name, &t.Notification)
+		switch {
+		case err == nil:
+			logger.Infow("notification sent", "task", name)
+			httpx.RespondJSON(writer, map[string]string{"status": "sent"}, http.StatusOK)
+		case permanent(err):
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.Errorw("provider refused notification, dropping it", "task", name, "err", err)
+			httpx.RespondJSON(writer, map[string]string{"status": "dropped"}, http.StatusOK)
+		default:
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.Warnw("sending notification failed, cloud tasks will retry it", "task", name, "err", err)
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.sender.send()"))
+		}
+	}
+}
+
+// traceCarrier reads and writes the trace context of a task
+type traceCarrier map[string]string
+
+func (c traceCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c traceCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c traceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
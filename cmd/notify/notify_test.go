@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/amammay/effectivecloudrun/internal/idempotency"
+	"net/http"
+	"testing"
+)
+
+func TestTaskID(t *testing.T) {
+	newRequest := func(key string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/notify", nil)
+		if key != "" {
+			req.Header.Set(idempotency.Header, key)
+		}
+		return req
+	}
+	welcome := &notification{To: "ada@example.com", Subject: "welcome", Text: "hello"}
+	id := func(key string, n *notification) string {
+		t.Helper()
+		got, err := taskID(newRequest(key), n)
+		if err != nil {
+			t.Fatalf("taskID(): %v", err)
+		}
+		return got
+	}
+
+	first := id("key-1", welcome)
+	tests := []struct {
+		name string
+		key  string
+		n    *notification
+		same bool
+	}{
+		{name: "retry", key: "key-1", n: &notification{To: "ada@example.com", Subject: "welcome", Text: "hello"}, same: true},
+		{name: "other_notification", key: "key-1", n: &notification{To: "eve@example.com", Subject: "welcome", Text: "hello"}},
+		{name: "other_key", key: "key-2", n: welcome},
+		{name: "no_key", n: welcome},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := id(tt.key, tt.n); (got == first) != tt.same {
+				t.Errorf("taskID() = %q, same as the first %q: %t, want %t", got, first, got == first, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/googleapi"
+	"net/http"
+)
+
+// tasksQueue hands notifications to cloud tasks, which calls /tasks/send with them until sending succeeds
+type tasksQueue struct {
+	tasks          *cloudtasks.ProjectsLocationsQueuesTasksService
+	queue          string
+	target         string
+	serviceAccount string
+}
+
+func newTasksQueue(ctx context.Context, queue, target, serviceAccount string) (*tasksQueue, error) {
+	svc, err := cloudtasks.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cloudtasks.NewService(): %v", err)
+	}
+	return &tasksQueue{tasks: svc.Projects.Locations.Queues.Tasks, queue: queue, target: target, serviceAccount: serviceAccount}, nil
+}
+
+// enqueue creates the task name, a name cloud tasks has already seen is rejected with a 409 which we take as enqueued,
+// for about an hour after that task ran. it is how a client retrying the same request doesn't send twice
+func (q *tasksQueue) enqueue(ctx context.Context, name string, body []byte) error {
+	task := &cloudtasks.Task{
+		Name: q.queue + "/tasks/" + name,
+		HttpRequest: &cloudtasks.HttpRequest{
+			HttpMethod: http.MethodPost,
+			Url:        q.target,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       base64.StdEncoding.EncodeToString(body),
+			OidcToken:  &cloudtasks.OidcToken{ServiceAccountEmail: q.serviceAccount, Audience: q.target},
+		},
+	}
+	_, err := q.tasks.Create(q.queue, &cloudtasks.CreateTaskRequest{Task: task}).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tasks.Create(): %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/idempotency"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// sender sends emails through the messages api of our provider, any provider taking a bearer api key and an
+// Idempotency-Key works the same way
+type sender struct {
+	client *clientx.Client
+	url    string
+	from   string
+	apiKey string
+}
+
+func newSender(url, from, apiKey string) *sender {
+	return &sender{
+		// a few quick retries ride out a blip, cloud tasks retries anything longer with its own backoff. the
+		// Idempotency-Key we send makes retrying the POST safe
+		client: clientx.New(
+			clientx.WithTimeout(30*time.Second),
+			clientx.WithPerTryTimeout(10*time.Second),
+			clientx.WithRetryPolicy(clientx.DefaultRetryPolicy()),
+		),
+		url:    url,
+		from:   from,
+		apiKey: apiKey,
+	}
+}
+
+// send sends n once per key, the provider drops a second message with a key it has already seen
+func (s *sender) send(ctx context.Context, key string, n *notification) error {
+	body, err := json.Marshal(map[string]string{"from": s.from, "to": n.To, "subject": n.Subject, "text": n.Text})
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set(idempotency.Header, key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("s.client.Do(): %w", err)
+	}
+	defer clientx.DrainAndClose(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &clientx.StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(snippet)}
+	}
+	return nil
+}
+
+// permanent reports if the provider refused a message in a way retrying won't change, eg an invalid recipient. a
+// refused api key is ours to fix, its messages are retried until we have
+func permanent(err error) bool {
+	var statusErr *clientx.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch code := statusErr.StatusCode; code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return code >= 400 && code < 500
+	}
+}
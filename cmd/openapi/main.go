@@ -0,0 +1,195 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const AppName = "openapi"
+
+//go:embed openapi.yaml
+var specYAML []byte
+
+// locales has our error messages in every language besides english, see httpx.Catalog
+//
+//go:embed locales
+var locales embed.FS
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type beer struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Style   string    `json:"style"`
+	ABV     float64   `json:"abv,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type server struct {
+	router *mux.Router
+	logger *logx.AppLogger
+	spec   *openapi3.T
+
+	// now and newID are swapped out by tests that compare whole responses
+	now   func() time.Time
+	newID func() (string, error)
+
+	mu    sync.RWMutex
+	beers map[string]*beer
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.router.ServeHTTP(writer, request)
+}
+
+func run() error {
+	ctx := context.Background()
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	spec, err := loadSpec(ctx, specYAML)
+	if err != nil {
+		return fmt.Errorf("loadSpec(): %v", err)
+	}
+	specRouter, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		return fmt.Errorf("gorillamux.NewRouter(): %v", err)
+	}
+
+	// OPENAPI_DEBUG=true also validates our responses, it buffers every response so leave it off in production
+	debug, _ := strconv.ParseBool(os.Getenv("OPENAPI_DEBUG"))
+	s := &server{router: mux.NewRouter(), logger: loggerClient, spec: spec, now: time.Now, newID: randomID, beers: map[string]*beer{}}
+	catalog, err := httpx.LoadCatalog(locales, "locales")
+	if err != nil {
+		return fmt.Errorf("httpx.LoadCatalog(): %v", err)
+	}
+	s.routes(&validator{router: specRouter, logger: loggerClient, debug: debug}, catalog)
+
+	srv := serverx.New("", s, logger)
+	return srv.ListenAndServe()
+}
+
+func (s *server) routes(v *validator, catalog *httpx.Catalog) {
+	s.router.Use(otelmux.Middleware(AppName))
+	// errors answer in the language of Accept-Language, their codes stay the same
+	s.router.Use(catalog.Middleware)
+	s.router.HandleFunc("/openapi.json", s.handleSpec()).Methods(http.MethodGet)
+
+	// the validator wraps the api as a whole, so it also answers for paths and methods our spec doesn't know about
+	api := mux.NewRouter()
+	api.HandleFunc("/beers", s.handleListBeers()).Methods(http.MethodGet)
+	api.HandleFunc("/beers", s.handleCreateBeer()).Methods(http.MethodPost)
+	api.HandleFunc("/beers/{id}", s.handleGetBeer()).Methods(http.MethodGet)
+	s.router.PathPrefix("/").Handler(v.middleware(api))
+}
+
+func (s *server) handleSpec() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		httpx.RespondJSON(writer, s.spec, http.StatusOK)
+	}
+}
+
+// handleListBeers can trust limit, the validator already checked it is an integer between 1 and 100
+func (s *server) handleListBeers() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		limit := 20
+		if l := request.URL.Query().Get("limit"); l != "" {
+			limit, _ = strconv.Atoi(l)
+		}
+
+		s.mu.RLock()
+		beers := make([]*beer, 0, len(s.beers))
+		for _, b := range s.beers {
+			beers = append(beers, b)
+		}
+		s.mu.RUnlock()
+
+		sort.Slice(beers, func(i, j int) bool { return beers[i].Created.After(beers[j].Created) })
+		if len(beers) > limit {
+			beers = beers[:limit]
+		}
+		httpx.RespondJSON(writer, beers, http.StatusOK)
+	}
+}
+
+func (s *server) handleCreateBeer() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var b beer
+		if err := json.NewDecoder(request.Body).Decode(&b); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "json.Decode()"))
+			return
+		}
+		id, err := s.newID()
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "s.newID()"))
+			return
+		}
+		b.ID = id
+		b.Created = s.now().UTC()
+
+		s.mu.Lock()
+		s.beers[b.ID] = &b
+		s.mu.Unlock()
+		httpx.RespondJSON(writer, &b, http.StatusCreated)
+	}
+}
+
+func (s *server) handleGetBeer() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		s.mu.RLock()
+		b, ok := s.beers[mux.Vars(request)["id"]]
+		s.mu.RUnlock()
+		if !ok {
+			httpx.RespondError(writer, request, errs.New(errs.NotFound, "beer not found"))
+			return
+		}
+		httpx.RespondJSON(writer, b, http.StatusOK)
+	}
+}
+
+// randomID is 16 hex characters
+func randomID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("rand.Read(): %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
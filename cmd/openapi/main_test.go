@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx/logtest"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves our api the way run wires it, with a fixed clock and ids counting up so whole responses can
+// be compared
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	spec, err := loadSpec(context.Background(), specYAML)
+	if err != nil {
+		t.Fatalf("loadSpec(): %v", err)
+	}
+	specRouter, err := gorillamux.NewRouter(spec)
+	if err != nil {
+		t.Fatalf("gorillamux.NewRouter(): %v", err)
+	}
+	catalog, err := httpx.LoadCatalog(locales, "locales")
+	if err != nil {
+		t.Fatalf("httpx.LoadCatalog(): %v", err)
+	}
+	logger, _ := logtest.New(t, "test-project")
+
+	var ids int
+	s := &server{
+		router: mux.NewRouter(),
+		logger: logger,
+		spec:   spec,
+		now:    func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) },
+		newID: func() (string, error) {
+			ids++
+			return fmt.Sprintf("%016x", ids), nil
+		},
+		beers: map[string]*beer{},
+	}
+	// debug also validates every response we send against our spec
+	s.routes(&validator{router: specRouter, logger: logger, debug: true}, catalog)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBeers(t *testing.T) {
+	srv := newTestServer(t)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "create", method: http.MethodPost, path: "/beers", body: `{"name":"Zombie Dust","style":"ipa","abv":6.2}`,
+			wantStatus: http.StatusCreated, wantBody: `{"id":"0000000000000001","name":"Zombie Dust","style":"ipa","abv":6.2,"created":"2021-06-01T12:00:00Z"}`},
+		{name: "create_another", method: http.MethodPost, path: "/beers", body: `{"name":"Old Rasputin","style":"stout"}`,
+			wantStatus: http.StatusCreated, wantBody: `{"id":"0000000000000002","name":"Old Rasputin","style":"stout","created":"2021-06-01T12:00:00Z"}`},
+		{name: "get", method: http.MethodGet, path: "/beers/0000000000000001",
+			wantStatus: http.StatusOK, wantBody: `{"id":"0000000000000001","name":"Zombie Dust","style":"ipa","abv":6.2,"created":"2021-06-01T12:00:00Z"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("http.NewRequest(): %v", err)
+			}
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("client.Do(): %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll(): %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if got := strings.TrimSpace(string(body)); got != tt.wantBody {
+				t.Errorf("body = %s\nwant %s", got, tt.wantBody)
+			}
+		})
+	}
+}
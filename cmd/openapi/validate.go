@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxValidatedResponse bounds how much of a response we buffer to validate in debug mode
+const maxValidatedResponse = 1 << 20
+
+// validator checks every request against our spec before it reaches a handler, in debug mode it also checks what
+// our handlers respond with so a handler drifting from the contract shows up in our logs instead of in a client
+type validator struct {
+	router routers.Router
+	logger *logx.AppLogger
+	debug  bool
+}
+
+func (v *validator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		route, pathParams, err := v.router.FindRoute(request)
+		switch {
+		case errors.Is(err, routers.ErrMethodNotAllowed):
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "method_not_allowed", Message: httpx.Localize(ctx, "method not allowed")}, http.StatusMethodNotAllowed)
+			return
+		case err != nil:
+			httpx.RespondError(writer, request, errs.New(errs.NotFound, "no such operation"))
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{MultiError: true, AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if err := openapi3filter.ValidateRequest(ctx, input); err != nil {
+			// schema errors describe what the caller sent, they are safe to hand back
+			err = errs.Invalid(fieldErrors(err)...)
+			httpx.LogInvalid(ctx, v.logger, err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+
+		if !v.debug {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		wrapped, rec := httpx.Record(writer, maxValidatedResponse)
+		next.ServeHTTP(wrapped, request)
+		if rec.Truncated() {
+			return
+		}
+		v.validateResponse(ctx, input, wrapped.Header(), rec)
+	})
+}
+
+func (v *validator) validateResponse(ctx context.Context, input *openapi3filter.RequestValidationInput, header http.Header, rec *httpx.Recorder) {
+	err := openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rec.Status,
+		Header:                 header,
+		Body:                   ioutil.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		Options:                &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+	})
+	if err != nil {
+		v.logger.WrapTraceContext(ctx).Errorw("response violates openapi spec",
+			"operation", input.Route.Operation.OperationID,
+			"status", rec.Status,
+			"err", err,
+		)
+	}
+}
+
+// fieldErrors flattens kin-openapi errors into one field error per problem, their Error() embeds the whole schema
+func fieldErrors(err error) []errs.FieldError {
+	var fields []errs.FieldError
+	var walk func(field errs.FieldError, err error)
+	walk = func(field errs.FieldError, err error) {
+		switch e := err.(type) {
+		case openapi3.MultiError:
+			for _, inner := range e {
+				walk(field, inner)
+			}
+		case *openapi3filter.RequestError:
+			field := errs.FieldError{In: "body"}
+			if e.Parameter != nil {
+				field = errs.FieldError{In: e.Parameter.In, Pointer: errs.Pointer(e.Parameter.Name)}
+			}
+			if e.Err == nil {
+				field.Constraint, field.Message = "request", e.Reason
+				fields = append(fields, field)
+				return
+			}
+			walk(field, e.Err)
+		case *openapi3.SchemaError:
+			if pointer := e.JSONPointer(); len(pointer) > 0 {
+				field.Pointer += errs.Pointer(pointer...)
+			}
+			field.Constraint, field.Message = e.SchemaField, e.Reason
+			fields = append(fields, field)
+		default:
+			field.Constraint, field.Message = "request", err.Error()
+			fields = append(fields, field)
+		}
+	}
+	walk(errs.FieldError{In: "request"}, err)
+	return fields
+}
+
+// loadSpec parses and validates our embedded spec, a broken spec fails at startup rather than on the first request
+func loadSpec(ctx context.Context, data []byte) (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(ctx); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -1,30 +1,114 @@
 package main
 
 import (
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/fanout"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/pubsubx"
+	"github.com/amammay/effectivecloudrun/internal/revisionx"
+	"github.com/amammay/effectivecloudrun/internal/saga"
+	"github.com/amammay/effectivecloudrun/internal/slo"
+	"github.com/amammay/effectivecloudrun/internal/tenantx"
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/gorilla/mux"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
-	"golang.org/x/sync/errgroup"
 	"net/http"
+	"strings"
 	"time"
 )
 
 func (s *server) routes() {
+	// shed load before doing any other work, max_in_flight defaults to the cloud run concurrency of 80
+	maxInFlight, _ := s.cfg.Int("max_in_flight")
+	rateLimit, _ := s.cfg.Int("rate_limit")
+	shedOpts := []httpx.ShedOption{httpx.WithMaxInFlight(maxInFlight)}
+	if rateLimit > 0 {
+		shedOpts = append(shedOpts, httpx.WithRateLimit(float64(rateLimit), rateLimit))
+	}
+	s.router.Use(httpx.NewShedder(shedOpts...).Middleware)
+
 	// setup otelmux middleware, this will auto create spans for processing within the mux realm
 	// such as status code and other http attributes
 	s.router.Use(otelmux.Middleware(AppName))
+	// the entries carry whether our upstream calls were answered by the response cache
+	if every, err := s.cfg.Int("access_log_sample_every"); err == nil && every > 0 {
+		s.router.Use(httpx.NewAccessLog(s.logger, httpx.WithAccessSampleEvery(every)).Middleware)
+	}
+	// label logs, spans and metrics with our revision and the traffic tag the request came in on
+	var trafficTags []string
+	if tags := s.cfg.String("traffic_header_tags"); tags != "" {
+		trafficTags = strings.Split(tags, ",")
+	}
+	s.router.Use(revisionx.Middleware("", trafficTags...))
+	// every firestore and httpbin call below uses the request context, so a client that leaves aborts them for us
+	disconnects := httpx.NewDisconnectWatcher(s.logger, httpx.WithDraining(func() bool {
+		return s.draining != nil && s.draining()
+	}))
+	s.router.Use(disconnects.Middleware)
+	// a request stuck on httpbin is logged with where it waits while it still waits
+	slowThreshold, _ := s.cfg.Duration("slow_request_threshold")
+	s.router.Use(httpx.NewWatchdog(s.logger, slowThreshold, httpx.WithWatchdogRoute(routeTemplate)).Middleware)
+	s.router.HandleFunc("/version", buildinfo.Handler()).Methods(http.MethodGet)
+
+	// capture sanitized request/response bodies when debug_capture is on, or for a single request signed with
+	// debug_capture_secret, see httpx.SignDebugHeader
+	captureAll, _ := s.cfg.Bool("debug_capture")
+	debugCapture := httpx.NewDebugCapture(s.logger,
+		httpx.WithDebugAlways(captureAll),
+		httpx.WithDebugSecret([]byte(s.cfg.String("debug_capture_secret"))),
+	)
+	s.router.Use(debugCapture.Middleware)
 	apiRouter := s.router.PathPrefix("/api").Subrouter()
 
 	func(r *mux.Router) {
 		// we will focus on http related traces
-		r.HandleFunc("/http", s.handleCallUpstreamHttpRequest()).Methods(http.MethodGet)
-
-		r.HandleFunc("/grpc", s.handleCallUpstreamGrpcRequest()).Methods(http.MethodGet)
-
+		// every call to httpbin waits on delay/6 twice so our latency objective has to be generous
+		r.Handle("/http", s.slo.Track(s.handleCallUpstreamHttpRequest(),
+			slo.Objective{Name: "api_http_availability", Target: 0.99},
+			slo.Objective{Name: "api_http_latency", Latency: 15 * time.Second, Target: 0.95},
+		)).Methods(http.MethodGet)
+
+		r.Handle("/grpc", s.slo.Track(s.handleCallUpstreamGrpcRequest(),
+			slo.Objective{Name: "api_grpc_availability", Target: 0.995},
+			slo.Objective{Name: "api_grpc_latency", Latency: time.Second, Target: 0.99},
+		)).Methods(http.MethodGet)
+
+		// streams progress while it works, see handleReport
+		r.HandleFunc("/report", s.handleReport()).Methods(http.MethodGet)
 	}(apiRouter)
+
+	// our multi tenant api, tenants come from the subdomain of tenant_domain. the X-Tenant-ID header is only taken from
+	// the callers tenantVerifier verified, a header anyone else sends could name any tenant
+	tenantRouter := apiRouter.PathPrefix("/tenant").Subrouter()
+	tenantSources := []tenantx.Source{tenantx.FromHost(s.cfg.String("tenant_domain"))}
+	if s.tenantVerifier != nil {
+		tenantRouter.Use(s.tenantVerifier.Middleware)
+		tenantSources = append(tenantSources, tenantx.FromVerifiedHeader(""))
+	}
+	tenantRouter.Use(tenantx.Middleware(tenantSources...))
+	tenantRouter.HandleFunc("/beers", s.handleListTenantBeers()).Methods(http.MethodGet)
+	tenantRouter.HandleFunc("/beers", s.handleCreateTenantBeer()).Methods(http.MethodPost)
+
+	// the slides of the slideshow in two versions of our api, /api/v2 pages them in an envelope. a client can also ask
+	// for a version with Accept: application/vnd.opentelemetry.v2+json on /api/slides, v1 is deprecated
+	sunset, _ := time.Parse("2006-01-02", s.cfg.String("api_v1_sunset"))
+	versioning := httpx.NewVersioning("/api", []string{"v1", "v2"},
+		httpx.WithVersionVendor(AppName),
+		httpx.WithDeprecatedVersion("v1", sunset),
+	)
+	s.handler = versioning.Handler(s.router)
+	apiRouter.PathPrefix("/v1").Subrouter().HandleFunc("/slides", s.handleListSlidesV1()).Methods(http.MethodGet)
+	v2Router := apiRouter.PathPrefix("/v2").Subrouter()
+	v2Router.Use(httpx.Enveloped)
+	v2Router.HandleFunc("/slides", s.handleListSlidesV2()).Methods(http.MethodGet)
 }
 
 // handleCallUpstreamHttpRequest is our handler for http endpoint
@@ -38,8 +122,9 @@ func (s *server) handleCallUpstreamHttpRequest() http.HandlerFunc {
 		// do some sort of heavy processing
 		val, err := client.doHeavyProcessingSerial(ctx)
 		if err != nil {
+			err = errs.Wrapf(err, errs.Unavailable, "client.doHeavyProcessingSerial()")
 			logger.Errorw("client.doHeavyProcessingSerial()", "err", err)
-			s.respondJSON(writer, createErrorMessage(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpx.RespondError(writer, request, err)
 			return
 		}
 		logger.Debug("finished doHeavyProcessingSerial()")
@@ -47,13 +132,20 @@ func (s *server) handleCallUpstreamHttpRequest() http.HandlerFunc {
 		// do more heavy processing
 		val, err = client.doHeavyProcessingConcurrent(ctx)
 		if err != nil {
+			err = errs.Wrapf(err, errs.Unavailable, "client.doHeavyProcessingConcurrent()")
 			logger.Errorw("client.doHeavyProcessingConcurrent()", "err", err)
-			s.respondJSON(writer, createErrorMessage(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpx.RespondError(writer, request, err)
 			return
 		}
 		logger.Debug("finished doHeavyProcessingConcurrent()")
 
-		s.respondJSON(writer, &val, http.StatusOK)
+		// recording the visit is queued and committed in the background with other visits
+		visit := map[string]interface{}{"path": request.URL.Path, "created": firestore.ServerTimestamp}
+		if err := s.writes.Set(ctx, s.firestore.Collection("visits").NewDoc(), visit); err != nil {
+			logger.Warnw("s.writes.Set()", "err", err)
+		}
+
+		httpx.RespondJSON(writer, &val, http.StatusOK)
 	}
 }
 
@@ -79,8 +171,10 @@ func (s *server) handleCallUpstreamGrpcRequest() http.HandlerFunc {
 			DocID:    docRef.ID,
 		})
 		if err != nil {
+			// firestore returns grpc status errors, errs maps their codes for us
+			err = errs.Wrapf(err, errs.Unknown, "fs.Collection(beer).Create()")
 			logger.Errorw("fs.Collection(beer).Create()", "path", docRef.Path, "err", err)
-			s.respondJSON(writer, createErrorMessage(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpx.RespondError(writer, request, err)
 			return
 		}
 
@@ -91,8 +185,9 @@ func (s *server) handleCallUpstreamGrpcRequest() http.HandlerFunc {
 			Where("created", "<", tomorrow).
 			Documents(ctx).GetAll()
 		if err != nil {
+			err = errs.Wrapf(err, errs.Unknown, "fs.Collection(beer).Where")
 			logger.Errorw("fs.Collection(beer).Where", "created <", today, "path", docRef.Path, "err", err)
-			s.respondJSON(writer, createErrorMessage(http.StatusInternalServerError), http.StatusInternalServerError)
+			httpx.RespondError(writer, request, err)
 			return
 		}
 		logger.Debugf("located %d beers created today", len(all))
@@ -101,54 +196,118 @@ func (s *server) handleCallUpstreamGrpcRequest() http.HandlerFunc {
 			b := &beer{}
 			err := snapshot.DataTo(b)
 			if err != nil {
+				err = errs.Wrapf(err, errs.Internal, "snapshot.DataTo")
 				logger.Errorw("snapshot.DataTo", "path", snapshot.Ref.Path, "err", err)
-				s.respondJSON(writer, createErrorMessage(http.StatusInternalServerError), http.StatusInternalServerError)
+				httpx.RespondError(writer, request, err)
 				return
 			}
 			beers = append(beers, b)
 		}
 
-		s.respondJSON(writer, beers, http.StatusOK)
+		httpx.RespondJSON(writer, beers, http.StatusOK)
 	}
 }
 
-// respondJSON is an util method for writing json back
-func (s *server) respondJSON(writer http.ResponseWriter, data interface{}, statusCode int) {
-	marshal, err := json.Marshal(data)
-	if err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-	writer.Header().Set("Content-Type", "application/json")
-	writer.WriteHeader(statusCode)
+type tenantBeer struct {
+	Created  time.Time `json:"created" firestore:"created,serverTimestamp"`
+	BeerName string    `json:"beer_name" firestore:"beer_name"`
+}
+
+// handleCreateTenantBeer stores a random beer under the tenant of the request and announces it on beer_events_topic.
+// the beer is deleted again if its event can't be published, so subscribers never miss a beer we kept
+func (s *server) handleCreateTenantBeer() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		logger := s.logger.WrapTraceContext(ctx)
 
-	if _, err := writer.Write(marshal); err != nil {
-		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		beers, err := tenantx.Collection(ctx, s.firestore, "beer")
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "tenantx.Collection()"))
+			return
+		}
+		b := &tenantBeer{BeerName: gofakeit.BeerName()}
+		doc := beers.NewDoc()
+
+		create := saga.New("create_tenant_beer", saga.WithLogger(s.logger)).Step("store",
+			func(ctx context.Context) error {
+				if _, err := doc.Create(ctx, b); err != nil {
+					return errs.Wrapf(err, errs.Unknown, "doc.Create()")
+				}
+				return nil
+			},
+			func(ctx context.Context) error {
+				_, err := doc.Delete(ctx)
+				return err
+			},
+		)
+		if s.beerEvents != nil {
+			create.Step("publish", func(ctx context.Context) error {
+				data, err := json.Marshal(map[string]string{"type": "beer.created", "path": doc.Path, "beer_name": b.BeerName})
+				if err != nil {
+					return errs.Wrapf(err, errs.Internal, "json.Marshal()")
+				}
+				tenant, _ := tenantx.FromContext(ctx)
+				message := &pubsub.Message{Data: data, Attributes: map[string]string{"tenant": tenant}}
+				if _, err := pubsubx.Publish(ctx, s.beerEvents, message, s.publishRetry); err != nil {
+					return errs.Wrapf(err, errs.Unavailable, "pubsubx.Publish()")
+				}
+				return nil
+			}, nil)
+		}
+		if err := create.Run(ctx); err != nil {
+			logger.Errorw("create.Run()", "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		logger.Infow("created tenant beer", "beer_name", b.BeerName)
+		httpx.RespondJSON(writer, b, http.StatusCreated)
 	}
 }
 
-type errResponse struct {
-	Message string `json:"message"`
-}
+// handleListTenantBeers only ever sees the beers of the tenant of the request
+func (s *server) handleListTenantBeers() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		logger := s.logger.WrapTraceContext(ctx)
 
-func createErrorMessage(httpStatusCode int) *errResponse {
-	return &errResponse{Message: http.StatusText(httpStatusCode)}
+		beers, err := tenantx.Collection(ctx, s.firestore, "beer")
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "tenantx.Collection()"))
+			return
+		}
+		snapshots, err := beers.OrderBy("created", firestore.Desc).Limit(50).Documents(ctx).GetAll()
+		if err != nil {
+			err = errs.Wrapf(err, errs.Unknown, "beers.Documents()")
+			logger.Errorw("beers.Documents()", "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		out := make([]*tenantBeer, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			b := &tenantBeer{}
+			if err := snapshot.DataTo(b); err != nil {
+				err = errs.Wrapf(err, errs.Internal, "snapshot.DataTo")
+				logger.Errorw("snapshot.DataTo", "path", snapshot.Ref.Path, "err", err)
+				httpx.RespondError(writer, request, err)
+				return
+			}
+			out = append(out, b)
+		}
+		httpx.RespondJSON(writer, out, http.StatusOK)
+	}
 }
 
 type binClient struct {
-	httpClient *http.Client
-	baseURL    string
+	client *clientx.Client
+	// cache holds the httpbin json document per instance, nil disables caching
+	cache *cachex.Cache
 }
 
-func NewBinClient(httpClient *http.Client, baseURL string) *binClient {
-	if httpClient == nil {
-		client := &http.Client{
-			Timeout: 30 * time.Second,
-		}
-		httpClient = client
+func NewBinClient(client *clientx.Client, cache *cachex.Cache) *binClient {
+	if client == nil {
+		client = clientx.New(clientx.WithBaseURL("https://httpbin.org/"))
 	}
-	return &binClient{httpClient: httpClient, baseURL: baseURL}
+	return &binClient{client: client, cache: cache}
 }
 
 type binJson struct {
@@ -173,9 +332,9 @@ func (i *binClient) doHeavyProcessingSerial(ctx context.Context) (*binJson, erro
 		return nil, fmt.Errorf("i.makeCall(delay/6): %v", err)
 	}
 
-	b := &binJson{}
-	if err := i.makeCall(ctx, "json", http.MethodGet, b); err != nil {
-		return nil, fmt.Errorf("i.makeCall(json): %v", err)
+	b, err := i.slideshow(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("i.slideshow(): %v", err)
 	}
 	return b, nil
 }
@@ -184,53 +343,68 @@ func (i *binClient) doHeavyProcessingConcurrent(ctx context.Context) (*binJson,
 	ctx, span := startSpan(ctx, "binClient.doHeavyProcessingConcurrent")
 	defer span.End()
 
-	binChan := make(chan *binJson, 1)
+	var b *binJson
+	err := fanout.Do(ctx, 2,
+		fanout.Named("delay", func(ctx context.Context) error {
+			m1 := make(map[string]interface{})
+			if err := i.makeCall(ctx, "delay/6", http.MethodPost, &m1); err != nil {
+				return fmt.Errorf("i.makeCall(delay/6): %v", err)
+			}
+			return nil
+		}),
+		fanout.Named("json", func(ctx context.Context) error {
+			var err error
+			if b, err = i.slideshow(ctx); err != nil {
+				return fmt.Errorf("i.slideshow(): %v", err)
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fanout.Do(): %v", err)
+	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		m1 := make(map[string]interface{})
-		if err := i.makeCall(ctx, "delay/6", http.MethodPost, &m1); err != nil {
-			return fmt.Errorf("i.makeCall(delay/6): %v", err)
-		}
-		return nil
-	})
+	return b, nil
+}
 
-	g.Go(func() error {
+// slideshow fetches the httpbin json document, which never changes, so we serve it from our cache when we can
+func (i *binClient) slideshow(ctx context.Context) (*binJson, error) {
+	load := func(ctx context.Context) (interface{}, error) {
 		b := &binJson{}
 		if err := i.makeCall(ctx, "json", http.MethodGet, b); err != nil {
-			return fmt.Errorf("i.makeCall(json): %v", err)
+			return nil, fmt.Errorf("i.makeCall(json): %v", err)
 		}
-		binChan <- b
-		return nil
-	})
-
-	if err := g.Wait(); err != nil {
-		return nil, fmt.Errorf("g.Wait(): %v", err)
+		return b, nil
 	}
-	b := <-binChan
-
-	return b, nil
-}
-
-func (i *binClient) makeCall(ctx context.Context, url, method string, responseData interface{}) error {
-	path := fmt.Sprintf("%s/%s", i.baseURL, url)
-	req, err := http.NewRequestWithContext(ctx, method, path, nil)
-	if err != nil {
-		return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	if i.cache == nil {
+		v, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return v.(*binJson), nil
 	}
-
-	do, err := i.httpClient.Do(req)
+	v, err := i.cache.GetOrLoad(ctx, "httpbin/json", load)
 	if err != nil {
-		return fmt.Errorf("i.httpClient.Do(): %v", err)
+		return nil, err
 	}
-	defer do.Body.Close()
+	// hand out a copy so callers can't mutate the cached document
+	b := *v.(*binJson)
+	return &b, nil
+}
 
-	if do.StatusCode != http.StatusOK {
-		return fmt.Errorf("bin non 200 status code: %d, status: %q", do.StatusCode, do.Status)
+func (i *binClient) makeCall(ctx context.Context, url, method string, responseData interface{}) error {
+	if err := i.client.JSON(ctx, method, url, nil, responseData); err != nil {
+		return fmt.Errorf("i.client.JSON(): %w", err)
 	}
+	return nil
+}
 
-	if err := json.NewDecoder(do.Body).Decode(responseData); err != nil {
-		return fmt.Errorf("json.NewDecoder(): %v", err)
+// routeTemplate is the path template of the route matching request, eg /api/tenant/beers, or its path without one
+func routeTemplate(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
 	}
-	return nil
+	return request.URL.Path
 }
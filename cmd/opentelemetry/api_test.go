@@ -0,0 +1,183 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"github.com/amammay/effectivecloudrun/internal/firestorex"
+	"github.com/amammay/effectivecloudrun/internal/testinfra"
+	"github.com/amammay/effectivecloudrun/internal/testkit"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	testinfra.Stop()
+	os.Exit(code)
+}
+
+// fakeBin answers the httpbin calls of binClient without the six second delays
+func fakeBin(tb testing.TB) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/delay/6", func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, `{"url": "https://httpbin.org/delay/6"}`)
+	})
+	mux.HandleFunc("/json", func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, `{"slideshow": {"author": "Yours Truly", "title": "Sample Slide Show", "slides": [{"title": "Wake up to WonderWidgets!", "type": "all"}]}}`)
+	})
+	srv := httptest.NewServer(mux)
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestKit serves our api the way run wires it, minus the parts that need gcp. fs may be nil for tests that never
+// reach firestore
+func newTestKit(tb testing.TB, fs *firestore.Client) (*testkit.Kit, *firestorex.Batcher) {
+	tb.Helper()
+	cfg, err := configx.Load(configx.WithProfile(configx.ProfileDev), configx.WithDefaults(map[string]string{
+		"max_in_flight":          "80",
+		"rate_limit":             "0",
+		"tenant_domain":          "example.com",
+		"slow_request_threshold": "15s",
+	}))
+	if err != nil {
+		tb.Fatalf("configx.Load(): %v", err)
+	}
+
+	kit := testkit.New(tb, "testkit-project")
+	var writes *firestorex.Batcher
+	if fs != nil {
+		// only an explicit Flush commits, a commit in the background would land in a trace of its own
+		writes, err = firestorex.NewBatcher(fs, firestorex.WithBatchName("visits"), firestorex.WithFlushInterval(time.Hour))
+		if err != nil {
+			tb.Fatalf("firestorex.NewBatcher(): %v", err)
+		}
+		tb.Cleanup(func() { writes.Close(context.Background()) })
+	}
+	bin := NewBinClient(clientx.New(clientx.WithBaseURL(fakeBin(tb).URL+"/")), nil)
+
+	kit.Serve(newServer(kit.Logger, cfg, fs, bin, writes, nil))
+	return kit, writes
+}
+
+// withHost sends the request to host, which is where our tenants come from
+func withHost(host string) testkit.Header {
+	return func(r *http.Request) {
+		r.Host = host
+	}
+}
+
+func TestHandleCallUpstreamHttpRequest(t *testing.T) {
+	fs := testinfra.Firestore(t)
+	kit, writes := newTestKit(t, fs)
+
+	trace := testkit.NewTrace(true)
+	resp, body := kit.Get("/api/http", trace.CloudTraceContext())
+	kit.AssertStatus(resp, http.StatusOK)
+	kit.AssertLogsCorrelated(trace)
+	kit.AssertSpansIn(trace)
+
+	got := &binJson{}
+	if err := json.Unmarshal(body, got); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	if got.Slideshow.Title != "Sample Slide Show" {
+		t.Errorf("slideshow title = %q, want Sample Slide Show", got.Slideshow.Title)
+	}
+
+	// the visit waits in our batcher until it is flushed
+	ctx := context.Background()
+	if err := writes.Flush(ctx); err != nil {
+		t.Fatalf("writes.Flush(): %v", err)
+	}
+	visits, err := fs.Collection("visits").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("fs.Collection(visits).GetAll(): %v", err)
+	}
+	if len(visits) != 1 || visits[0].Data()["path"] != "/api/http" {
+		t.Errorf("recorded %d visits, want a single visit of /api/http", len(visits))
+	}
+}
+
+func TestHandleCallUpstreamGrpcRequest(t *testing.T) {
+	fs := testinfra.Firestore(t)
+	kit, _ := newTestKit(t, fs)
+
+	trace := testkit.NewTrace(true)
+	resp, body := kit.Get("/api/grpc", trace.Traceparent())
+	kit.AssertStatus(resp, http.StatusOK)
+	kit.AssertLogsCorrelated(trace)
+	kit.AssertSpansIn(trace)
+
+	var beers []map[string]interface{}
+	if err := json.Unmarshal(body, &beers); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	if len(beers) != 1 || beers[0]["beer_name"] == "" {
+		t.Errorf("listed %v, want the one beer we just created", beers)
+	}
+}
+
+func TestTenantBeers(t *testing.T) {
+	fs := testinfra.Firestore(t)
+	kit, _ := newTestKit(t, fs)
+
+	req, err := http.NewRequest(http.MethodPost, kit.Server.URL+"/api/tenant/beers", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): %v", err)
+	}
+	trace := testkit.NewTrace(true)
+	resp, _ := kit.Do(req, withHost("acme.example.com"), trace.CloudTraceContext())
+	kit.AssertStatus(resp, http.StatusCreated)
+	kit.AssertLogsCorrelated(trace)
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{host: "acme.example.com", want: 1},
+		// another tenant never sees the beers of acme
+		{host: "globex.example.com", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			resp, body := kit.Get("/api/tenant/beers", withHost(tt.host))
+			kit.AssertStatus(resp, http.StatusOK)
+			var beers []tenantBeer
+			if err := json.Unmarshal(body, &beers); err != nil {
+				t.Fatalf("json.Unmarshal(): %v", err)
+			}
+			if len(beers) != tt.want {
+				t.Errorf("%s listed %d beers, want %d", tt.host, len(beers), tt.want)
+			}
+		})
+	}
+}
+
+// TestTenantRequired runs without an emulator, a request without a tenant never reaches firestore
+func TestTenantRequired(t *testing.T) {
+	kit, _ := newTestKit(t, nil)
+
+	tests := []struct {
+		name    string
+		headers []testkit.Header
+	}{
+		{name: "no_tenant"},
+		{name: "other_domain", headers: []testkit.Header{withHost("acme.example.org")}},
+		// without tenant_header_audience nobody is trusted to pick a tenant with a header
+		{name: "unverified_header", headers: []testkit.Header{testkit.WithHeader("X-Tenant-ID", "acme")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := kit.Get("/api/tenant/beers", tt.headers...)
+			kit.AssertStatus(resp, http.StatusBadRequest)
+		})
+	}
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
-	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
 	"context"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/checks"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"github.com/amammay/effectivecloudrun/internal/firestorex"
 	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/slo"
+	"github.com/amammay/effectivecloudrun/internal/tenantx"
+	"github.com/amammay/effectivecloudrun/internal/tracex"
 	"github.com/gorilla/mux"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,18 +35,33 @@ const (
 )
 
 type server struct {
-	router    *mux.Router
+	router *mux.Router
+	// handler is router behind our api versioning, which has to pick the version before a route is matched
+	handler   http.Handler
 	logger    *logx.AppLogger
+	cfg       *configx.Config
 	firestore *firestore.Client
 	bin       *binClient
+	// writes batches fire and forget firestore writes so requests don't wait on them
+	writes *firestorex.Batcher
+	slo    *slo.Tracker
+	// beerEvents gets an event for every tenant beer we create, nil when beer_events_topic isn't configured
+	beerEvents *pubsub.Topic
+	// publishRetry is how publishing beerEvents is retried, from pubsub_retry
+	publishRetry retry.Policy
+	// draining is set to serverx.Server.Draining once our server exists
+	draining func() bool
+	// tenantVerifier verifies the callers trusted to pick a tenant with the X-Tenant-ID header, nil when
+	// tenant_header_audience isn't configured
+	tenantVerifier *authx.Verifier
 }
 
 func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	s.router.ServeHTTP(writer, request)
+	s.handler.ServeHTTP(writer, request)
 }
 
-func newServer(logger *logx.AppLogger, firestoreClient *firestore.Client, binClient *binClient) *server {
-	s := &server{router: mux.NewRouter(), logger: logger, firestore: firestoreClient, bin: binClient}
+func newServer(logger *logx.AppLogger, cfg *configx.Config, firestoreClient *firestore.Client, binClient *binClient, writes *firestorex.Batcher, tenantVerifier *authx.Verifier) *server {
+	s := &server{router: mux.NewRouter(), logger: logger, cfg: cfg, firestore: firestoreClient, bin: binClient, writes: writes, slo: slo.NewTracker(), tenantVerifier: tenantVerifier}
 	s.routes()
 	return s
 }
@@ -48,39 +73,79 @@ func main() {
 }
 
 func run() error {
-	// retrieves our project id from the gcp metadata server
-	projectID := "mammay-labs"
-	onGCE := metadata.OnGCE()
-	if onGCE {
-		id, err := metadata.ProjectID()
-		if err != nil {
-			return fmt.Errorf("metadata.ProjectID(): %v", err)
-		}
-		projectID = id
-	}
-
-	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	// layer our config, defaults < ./config/<profile>.json < APP_* env < secrets mounted at /secrets
+	cfg, err := configx.Load(
+		configx.WithDefaults(map[string]string{
+			"port":               "8080",
+			"bin_base_url":       "https://httpbin.org/",
+			"http_timeout":       "30s",
+			"trace_sample_ratio": "1",
+			"admin_addr":         "localhost:8081",
+			"admin_audience":     "",
+			"debug_capture":      "false",
+			"hedge_delay":        "0s",
+			"max_in_flight":      "80",
+			"rate_limit":         "0",
+			"egress_allowlist":   "",
+			"tenant_domain":      "example.com",
+			"mirror_url":         "",
+			"mirror_sample":      "0.1",
+			"bin_regions":        "",
+			// the id of a pub/sub topic announcing new tenant beers, a beer is only kept once its event was published
+			"beer_events_topic": "",
+			// our own access log, 0 leaves it to cloud run's request log, 1 logs every request, n logs 1 in n successes
+			"access_log_sample_every": "0",
+			// requests running longer are logged with the stack they are stuck on, in line with our slowest objective
+			"slow_request_threshold": "15s",
+			// keep in sync with the --timeout of the cloud run service, 5 minutes is the cloud run default
+			"request_timeout": "5m",
+			// the date /api/v1 goes away, eg 2027-06-30, announced in the Sunset header of its responses
+			"api_v1_sunset": "",
+			// how our clients retry, eg attempts=5,initial=200ms,max=10s,multiplier=2,jitter=full, on top of
+			// retry.Default, see retry.Parse
+			"http_retry":      "",
+			"firestore_retry": "",
+			"pubsub_retry":    "",
+			// the audience of the identity tokens that let a caller pick a tenant with X-Tenant-ID, eg of our api
+			// gateway, empty takes tenants from the host only. tenant_header_callers, the emails of those callers, is required
+			// with it
+			"tenant_header_audience": "",
+			"tenant_header_callers":  "",
+			// the traffic tags taken from the X-Traffic-Tag header, eg "canary,beta" when a load balancer routes a custom
+			// domain to tagged revisions, empty takes tags from tagged run.app urls only
+			"traffic_header_tags": "",
+		}),
+		configx.WithProfileDir("config"),
+		configx.WithEnvPrefix("APP"),
+		configx.WithSecretsDir("/secrets"),
+		configx.WithSensitiveKeys("debug_capture_secret"),
+	)
 	if err != nil {
-		return fmt.Errorf("logx.NewLogger(): %v", err)
+		return fmt.Errorf("configx.Load(): %v", err)
 	}
 
-	logger := loggerClient.Sugar()
-	defer logger.Sync()
-
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	// setup tracing, defer the teardown of the tracer to flush it
-	tracingTeardown, err := initTracing(ctx, logger, projectID)
+	sampleRatio, err := strconv.ParseFloat(cfg.String("trace_sample_ratio"), 64)
 	if err != nil {
-		return fmt.Errorf("initTracing(): %v", err)
+		return fmt.Errorf("strconv.ParseFloat(trace_sample_ratio): %v", err)
+	}
+	sampler, err := tracex.NewSampler(sampleRatio)
+	if err != nil {
+		return fmt.Errorf("tracex.NewSampler(): %v", err)
 	}
-	defer func() {
-		err := tracingTeardown()
-		if err != nil {
-			logger.Errorf("tracingTeardown(): %v", err)
-		}
-	}()
+
+	// logs, traces and metrics, torn down together once our server has shut down
+	telemetry, err := obs.Init(ctx, obs.Config{ServiceName: AppName, Sampler: sampler})
+	if err != nil {
+		return fmt.Errorf("obs.Init(): %v", err)
+	}
+	projectID := telemetry.ProjectID
+	loggerClient := telemetry.Logger
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+	cfg.Log(logger)
 
 	unaryInterceptor := grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor())
 	streamInterceptor := grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor())
@@ -89,47 +154,175 @@ func run() error {
 		return fmt.Errorf("firestore.NewClient(): %v", err)
 	}
 
-	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
+	// every client backs off the same way, each tunable per environment
+	httpRetry, err := retry.FromConfig(cfg, "http_retry", retry.Default())
+	if err != nil {
+		return fmt.Errorf("retry.FromConfig(): %v", err)
+	}
+	firestoreRetry, err := retry.FromConfig(cfg, "firestore_retry", retry.Default())
+	if err != nil {
+		return fmt.Errorf("retry.FromConfig(): %v", err)
+	}
+	publishRetry, err := retry.FromConfig(cfg, "pubsub_retry", retry.Default())
+	if err != nil {
+		return fmt.Errorf("retry.FromConfig(): %v", err)
+	}
+	logger.Infow("retry policies", "http", httpRetry.String(), "firestore", firestoreRetry.String(), "pubsub", publishRetry.String())
+
+	// visits are sets, committing a batch twice writes the same documents twice
+	writes, err := firestorex.NewBatcher(firestoreClient,
+		firestorex.WithBatchName("visits"),
+		firestorex.WithBatchLogger(logger),
+		firestorex.WithCommitRetry(firestoreRetry),
+	)
+	if err != nil {
+		return fmt.Errorf("firestorex.NewBatcher(): %v", err)
+	}
+
+	httpTimeout, err := cfg.Duration("http_timeout")
+	if err != nil {
+		return fmt.Errorf("cfg.Duration(): %v", err)
 	}
-	httpClient.Transport = otelhttp.NewTransport(httpClient.Transport)
-	binClient := NewBinClient(httpClient, "https://httpbin.org/")
+	// only our idempotent GET calls will be retried, the retry budget keeps retries from amplifying an httpbin outage
+	binRetry := clientx.DefaultRetryPolicy()
+	binRetry.Policy = httpRetry
+	clientOpts := []clientx.Option{
+		clientx.WithBaseURL(cfg.String("bin_base_url")),
+		clientx.WithTimeout(httpTimeout),
+		clientx.WithRetryPolicy(binRetry),
+		clientx.WithRetryBudget(clientx.NewRetryBudget(0.1, 5)),
+		// concurrent requests for the same httpbin GET share a single upstream call
+		clientx.WithCoalescing(httpTimeout),
+		clientx.WithMaxResponseBytes(1 << 20),
+		clientx.WithAuditLog(loggerClient),
+	}
+	// hedge slow GET calls when a hedge_delay is configured, a good starting point is the upstream p95 latency
+	if hedgeDelay, err := cfg.Duration("hedge_delay"); err == nil && hedgeDelay > 0 {
+		clientOpts = append(clientOpts, clientx.WithHedging(hedgeDelay, nil))
+	}
+	// a small slice of our memory limit is plenty for the handful of httpbin documents we cache
+	binCache, err := cachex.New(cachex.WithName("httpbin"), cachex.WithMemoryPercent(5), cachex.WithTTL(5*time.Minute))
+	if err != nil {
+		return fmt.Errorf("cachex.New(): %v", err)
+	}
+	// httpbin's /cache/{n} and /etag/{etag} answer with Cache-Control and ETag, which our response cache honors
+	responseCache, err := cachex.New(cachex.WithName("httpbin_responses"), cachex.WithMemoryPercent(5))
+	if err != nil {
+		return fmt.Errorf("cachex.New(): %v", err)
+	}
+	clientOpts = append(clientOpts, clientx.WithResponseCache(responseCache))
+	// a comma separated egress_allowlist, eg "httpbin.org,*.googleapis.com", restricts who the bin client can call
+	if entries := cfg.String("egress_allowlist"); entries != "" {
+		allowlist, err := clientx.NewAllowlist(loggerClient, strings.Split(entries, ",")...)
+		if err != nil {
+			return fmt.Errorf("clientx.NewAllowlist(): %v", err)
+		}
+		clientOpts = append(clientOpts, clientx.WithAllowlist(allowlist))
+	}
+	// mirror_url, eg the url of a canary deployment of httpbin, gets a copy of a sample of our calls and every response
+	// that differs from the primary is logged as a "mirror diff"
+	if mirrorURL := cfg.String("mirror_url"); mirrorURL != "" {
+		mirrorSample, err := strconv.ParseFloat(cfg.String("mirror_sample"), 64)
+		if err != nil {
+			return fmt.Errorf("strconv.ParseFloat(mirror_sample): %v", err)
+		}
+		mirror, err := clientx.NewMirror(mirrorURL,
+			clientx.WithMirrorSample(mirrorSample),
+			clientx.WithMirrorLogger(loggerClient),
+			// httpbin echoes who called it, which is never going to match
+			clientx.WithMirrorIgnoreFields("origin", "headers"),
+		)
+		if err != nil {
+			return fmt.Errorf("clientx.NewMirror(): %v", err)
+		}
+		clientOpts = append(clientOpts, clientx.WithMirror(mirror))
+	}
+	// bin_regions, eg "europe-west1=https://bin-abc-ew.a.run.app,us-central1=https://bin-abc-uc.a.run.app", spreads our
+	// calls over a multi region deployment, going to the fastest healthy region and failing over when one breaks
+	if entries := cfg.String("bin_regions"); entries != "" {
+		var regions []clientx.Region
+		for _, entry := range strings.Split(entries, ",") {
+			parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("bin_regions: %q is not <region>=<url>", entry)
+			}
+			regions = append(regions, clientx.Region{Name: parts[0], URL: parts[1]})
+		}
+		binRegions, err := clientx.NewRegions(regions, clientx.WithLatencyRouting(), clientx.WithRegionTimeout(httpTimeout/2))
+		if err != nil {
+			return fmt.Errorf("clientx.NewRegions(): %v", err)
+		}
+		clientOpts = append(clientOpts, clientx.WithRegions(binRegions))
+	}
+	binClient := NewBinClient(clientx.New(clientOpts...), binCache)
 
+	// cloud run sets the PORT env variable for us to listen on, which always wins over our config
 	port := os.Getenv("PORT")
 	if port == "" {
-		port = "8080"
+		port = cfg.String("port")
 	}
 
-	httpServer := &http.Server{
-		Addr:    ":" + port,
-		Handler: newServer(loggerClient, firestoreClient, binClient),
+	// dependency checks run in the background and /readyz only reads their cached result
+	firestoreCheck := checks.Firestore(firestoreClient, "warmup", "ping")
+	firestoreChecker := checks.New("firestore", firestoreCheck)
+	binChecker := checks.New("httpbin", checks.HTTPHead(nil, cfg.String("bin_base_url")), checks.WithInterval(30*time.Second))
+
+	serverOpts := []serverx.Option{
+		serverx.WithReadinessCheck(firestoreChecker.Name(), firestoreChecker.Ready),
+		serverx.WithReadinessCheck(binChecker.Name(), binChecker.Ready),
+		serverx.WithConfig(cfg),
+		serverx.WithLogLevel(loggerClient.Level),
+		serverx.WithTraceSampling(sampler),
+		// dial the firestore grpc channel and open an httpbin connection before our startup probe passes. the slides
+		// take a single cached httpbin GET, /api/http would sit on delay/6 twice and blow the warmup timeout
+		serverx.WithWarmup("firestore", serverx.WarmupFunc(firestoreCheck)),
+		serverx.WithWarmupRequests("/api/v2/slides"),
+	}
+	// when an audience is configured we expose the admin endpoints publicly under /admin/ guarded by identity tokens,
+	// otherwise they only listen on a local port that cloud run never routes traffic to
+	if audience := cfg.String("admin_audience"); audience != "" {
+		verifier, err := authx.NewVerifier(ctx, audience)
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(): %v", err)
+		}
+		serverOpts = append(serverOpts, serverx.WithAdminGuard(verifier.Middleware))
+	} else {
+		serverOpts = append(serverOpts, serverx.WithAdminAddr(cfg.String("admin_addr")))
 	}
-	// setup our shutdown signal
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(
-		shutdown,
-		os.Interrupt,    // Capture ctrl + c events
-		syscall.SIGTERM, // Capture actual sig term event (kill command).
-	)
 
-	// setup our errgroup is listen for shutdown signal, from there attempt to shutdown our http server and capture any errors during shutdown
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		o := <-shutdown
-		logger.Infof("sig: %s - starting shutting down sequence...", o)
-		// we need to use a fresh context.Background() because the parent ctx we have in our current scope will be cancelled during the Shutdown method call
-		graceFull, cancel := context.WithTimeout(context.Background(), 9*time.Second)
-		defer cancel()
-		// Shutdown the server with a timeout
-		if err := httpServer.Shutdown(graceFull); err != nil {
-			return fmt.Errorf("httpServer.Shutdown(): %w", err)
+	var tenantVerifier *authx.Verifier
+	if audience := cfg.String("tenant_header_audience"); audience != "" {
+		tenantVerifier, err = tenantx.NewHeaderVerifier(ctx, audience, strings.Split(cfg.String("tenant_header_callers"), ",")...)
+		if err != nil {
+			return fmt.Errorf("tenant_header_callers: %v", err)
 		}
-		logger.Info("server has shutdown gracefully")
-		return nil
-	})
-	logger.Infof("starting server on %s", httpServer.Addr)
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		return fmt.Errorf("httpServer.ListenAndServe(): %v", err)
-	}
-	return g.Wait()
+	}
+
+	handler := newServer(loggerClient, cfg, firestoreClient, binClient, writes, tenantVerifier)
+	handler.publishRetry = publishRetry
+	// telemetry is flushed after every hook so it includes them
+	serverOpts = append(serverOpts, telemetry.ServerOptions()...)
+	srv := serverx.New(":"+port, handler, logger, serverOpts...)
+	handler.draining = srv.Draining
+	if topicID := cfg.String("beer_events_topic"); topicID != "" {
+		pubsubClient, err := pubsub.NewClient(ctx, projectID)
+		if err != nil {
+			return fmt.Errorf("pubsub.NewClient(): %v", err)
+		}
+		handler.beerEvents = pubsubClient.Topic(topicID)
+		srv.OnShutdown(func(ctx context.Context) error {
+			handler.beerEvents.Stop()
+			if err := pubsubClient.Close(); err != nil {
+				return fmt.Errorf("pubsubClient.Close(): %v", err)
+			}
+			return nil
+		})
+	}
+	srv.AdminHandle("/slo", handler.slo)
+	// hooks run in order after the server drains, so every visit recorded by an in flight request is committed
+	srv.OnShutdown(writes.Close)
+	srv.OnShutdown(binCache.Flush)
+	srv.OnShutdown(firestoreChecker.Close)
+	srv.OnShutdown(binChecker.Close)
+	return srv.ListenAndServe()
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+// deadlineMargin is left over at the end of our request timeout to tell the client we ran out of time, instead of
+// having cloud run cut the connection mid stream
+const deadlineMargin = 5 * time.Second
+
+// reportStage is one step of building a report, estimate is how long it usually takes so we don't start a stage we
+// can't finish in time
+type reportStage struct {
+	name     string
+	estimate time.Duration
+	run      func(ctx context.Context, r *report) error
+}
+
+type report struct {
+	SlideshowTitle string        `json:"slideshow_title"`
+	Slides         int           `json:"slides"`
+	BeersToday     int           `json:"beers_today"`
+	Took           time.Duration `json:"took_ns"`
+}
+
+type reportProgress struct {
+	Stage     string `json:"stage"`
+	Step      int    `json:"step"`
+	Steps     int    `json:"steps"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+}
+
+func (s *server) reportStages() []reportStage {
+	return []reportStage{
+		{name: "slideshow", estimate: time.Second, run: func(ctx context.Context, r *report) error {
+			b, err := s.bin.slideshow(ctx)
+			if err != nil {
+				return fmt.Errorf("s.bin.slideshow(): %v", err)
+			}
+			r.SlideshowTitle = b.Slideshow.Title
+			r.Slides = len(b.Slideshow.Slides)
+			return nil
+		}},
+		{name: "upstream", estimate: 7 * time.Second, run: func(ctx context.Context, r *report) error {
+			m := make(map[string]interface{})
+			if err := s.bin.makeCall(ctx, "delay/6", http.MethodGet, &m); err != nil {
+				return fmt.Errorf("s.bin.makeCall(delay/6): %v", err)
+			}
+			return nil
+		}},
+		{name: "beers", estimate: 2 * time.Second, run: func(ctx context.Context, r *report) error {
+			today := time.Now().UTC().Truncate(24 * time.Hour)
+			all, err := s.firestore.Collection("beer").Where("created", ">=", today).Documents(ctx).GetAll()
+			if err != nil {
+				return fmt.Errorf("fs.Collection(beer).Where(): %v", err)
+			}
+			r.BeersToday = len(all)
+			return nil
+		}},
+	}
+}
+
+// handleReport builds a report in multiple stages and streams progress to the client as ndjson, or server sent
+// events with "Accept: text/event-stream", so a long request never looks stuck
+func (s *server) handleReport() http.HandlerFunc {
+	requestTimeout, err := s.cfg.Duration("request_timeout")
+	if err != nil || requestTimeout <= deadlineMargin {
+		requestTimeout = 5 * time.Minute
+	}
+	stages := s.reportStages()
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		ctx, span := startSpan(request.Context(), "server.handleReport()")
+		defer span.End()
+		logger := s.logger.WrapTraceContext(ctx)
+
+		stream, err := httpx.NewStream(writer, request.WithContext(ctx))
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "httpx.NewStream()"))
+			return
+		}
+
+		// cloud run ends the request at its timeout no matter what, stop short of it so we can still say why
+		budget := ctxutil.NewBudget(ctx, ctxutil.WithFallback(requestTimeout), ctxutil.WithReserve(deadlineMargin))
+
+		r := &report{}
+		for i, stage := range stages {
+			stageCtx, cancel, err := budget.Step(ctx, stage.name, stage.estimate)
+			if err != nil {
+				logger.Warnw("report out of time", "stage", stage.name, "err", err)
+				stream.Fail(errs.New(errs.Unavailable, fmt.Sprintf("not enough time left to run %s, try again later", stage.name)))
+				return
+			}
+			if err := stream.Send("progress", &reportProgress{Stage: stage.name, Step: i + 1, Steps: len(stages), ElapsedMS: time.Since(start).Milliseconds()}); err != nil {
+				cancel()
+				s.clientGone(ctx, stage.name, err)
+				return
+			}
+
+			stageCtx, stageSpan := startSpan(stageCtx, "report."+stage.name)
+			err = budget.Wrap(stageCtx, stage.name, stage.run(stageCtx, r))
+			if err != nil {
+				stageSpan.RecordError(err)
+				stageSpan.SetStatus(codes.Error, err.Error())
+			}
+			stageSpan.End()
+			cancel()
+
+			switch {
+			case request.Context().Err() != nil:
+				s.clientGone(ctx, stage.name, request.Context().Err())
+				return
+			case errors.Is(err, ctxutil.ErrBudgetExceeded):
+				logger.Warnw("report ran out of time", "stage", stage.name, "err", err)
+				stream.Fail(errs.Wrapf(err, errs.Unavailable, "ran out of time during %s", stage.name))
+				return
+			case err != nil:
+				err = errs.Wrapf(err, errs.Unavailable, "stage %s failed", stage.name)
+				logger.Errorw("report stage failed", "stage", stage.name, "err", err)
+				stream.Fail(err)
+				return
+			}
+		}
+
+		r.Took = time.Since(start)
+		if err := stream.Done(r); err != nil {
+			s.clientGone(ctx, "done", err)
+		}
+	}
+}
+
+// clientGone is the client disconnecting mid report, there is nobody left to tell so we only note it on our span
+func (s *server) clientGone(ctx context.Context, stage string, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("report.abandoned_at", stage))
+	span.SetStatus(codes.Error, "client cancelled")
+	s.logger.WrapTraceContext(ctx).Infow("client went away mid report", "stage", stage, "err", err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"net/http"
+	"strconv"
+)
+
+// slide is a slide of the httpbin slideshow as v2 serves it, v1 serves httpbin's own shape
+type slide struct {
+	Index int      `json:"index"`
+	Title string   `json:"title"`
+	Type  string   `json:"type"`
+	Items []string `json:"items,omitempty"`
+}
+
+// handleListSlidesV1 serves every slide of the slideshow at once as a bare array, the way our first clients got them
+func (s *server) handleListSlidesV1() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		show, err := s.bin.slideshow(request.Context())
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.bin.slideshow()"))
+			return
+		}
+		httpx.RespondJSON(writer, show.Slideshow.Slides, http.StatusOK)
+	}
+}
+
+// handleListSlidesV2 serves a page of slides in an envelope, page_size defaults to 10 and page_token is the
+// next_page_token of the page before
+func (s *server) handleListSlidesV2() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		query := request.URL.Query()
+		size, offset := 10, 0
+		var fields []errs.FieldError
+		if v := query.Get("page_size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 100 {
+				fields = append(fields, errs.FieldError{In: "query", Pointer: "/page_size", Constraint: "range", Message: "page_size is a number between 1 and 100"})
+			}
+			size = n
+		}
+		if v := query.Get("page_token"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				fields = append(fields, errs.FieldError{In: "query", Pointer: "/page_token", Constraint: "format", Message: "page_token is the next_page_token of an earlier page"})
+			}
+			offset = n
+		}
+		if len(fields) > 0 {
+			err := errs.Invalid(fields...)
+			httpx.LogInvalid(ctx, s.logger, err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+
+		show, err := s.bin.slideshow(ctx)
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.bin.slideshow()"))
+			return
+		}
+		all := show.Slideshow.Slides
+		slides := []slide{}
+		for i := offset; i < len(all) && i < offset+size; i++ {
+			slides = append(slides, slide{Index: i, Title: all[i].Title, Type: all[i].Type, Items: all[i].Items})
+		}
+		page := httpx.Page{Size: len(slides), Total: len(all)}
+		if offset+size < len(all) {
+			page.NextPageToken = strconv.Itoa(offset + size)
+		}
+		httpx.SetPage(ctx, page)
+		httpx.RespondData(writer, request, slides, http.StatusOK)
+	}
+}
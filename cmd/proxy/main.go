@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"fmt"
+	cloudprop "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	prop "go.opentelemetry.io/otel/propagation"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+// route sends every request under prefix to upstream
+type route struct {
+	prefix   string
+	upstream *url.URL
+	proxy    *httputil.ReverseProxy
+}
+
+func run() error {
+	ctx := context.Background()
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// keep both the header the GFE sets and w3c traceparent flowing through to our upstreams
+	otel.SetTextMapPropagator(prop.NewCompositeTextMapPropagator(
+		cloudprop.CloudTraceFormatPropagator{},
+		prop.TraceContext{},
+		prop.Baggage{},
+	))
+
+	// ROUTES is a comma separated list of prefix=url, eg "/api/=https://api-xyz.a.run.app,/=https://web-xyz.a.run.app"
+	routes, err := parseRoutes(ctx, os.Getenv("ROUTES"), loggerClient)
+	if err != nil {
+		return fmt.Errorf("parseRoutes(): %v", err)
+	}
+
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for _, r := range routes {
+			if strings.HasPrefix(request.URL.Path, r.prefix) {
+				// the GFE already appended the real client to X-Forwarded-For, our peer is just the GFE so we drop it
+				// to keep ReverseProxy from adding a hop that means nothing to the upstream
+				request.RemoteAddr = ""
+				r.proxy.ServeHTTP(writer, request)
+				return
+			}
+		}
+		httpx.RespondError(writer, request, errs.New(errs.NotFound, "no route"))
+	})
+
+	srv := serverx.New("", otelhttp.NewHandler(handler, "proxy"), logger)
+	return srv.ListenAndServe()
+}
+
+func parseRoutes(ctx context.Context, spec string, logger *logx.AppLogger) ([]*route, error) {
+	if spec == "" {
+		return nil, fmt.Errorf("ROUTES must be set")
+	}
+	var routes []*route
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid route %q, expected prefix=url", entry)
+		}
+		upstream, err := url.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse(%s): %v", parts[1], err)
+		}
+		proxy, err := newProxy(ctx, upstream, logger)
+		if err != nil {
+			return nil, fmt.Errorf("newProxy(%s): %v", upstream, err)
+		}
+		routes = append(routes, &route{prefix: parts[0], upstream: upstream, proxy: proxy})
+	}
+	return routes, nil
+}
+
+// newProxy builds a reverse proxy that authenticates to a private cloud run service with an identity token minted for
+// its url, the audience cloud run expects
+func newProxy(ctx context.Context, upstream *url.URL, logger *logx.AppLogger) (*httputil.ReverseProxy, error) {
+	audience := upstream.Scheme + "://" + upstream.Host
+	tokens, err := idtoken.NewTokenSource(ctx, audience)
+	if err != nil {
+		return nil, fmt.Errorf("idtoken.NewTokenSource(): %v", err)
+	}
+
+	director := func(request *http.Request) {
+		// keep what the client told us about itself, the upstream sees the GFE as its peer just like we did
+		if request.Header.Get("X-Forwarded-Proto") == "" {
+			request.Header.Set("X-Forwarded-Proto", "https")
+		}
+		if request.Header.Get("X-Forwarded-Host") == "" {
+			request.Header.Set("X-Forwarded-Host", request.Host)
+		}
+		// our identity token replaces the callers credentials, pass theirs along the way api gateway does. whatever
+		// the client sent as X-Forwarded-Authorization itself is dropped, upstreams trust it to come from us
+		request.Header.Del("X-Forwarded-Authorization")
+		if auth := request.Header.Get("Authorization"); auth != "" {
+			request.Header.Set("X-Forwarded-Authorization", auth)
+			request.Header.Del("Authorization")
+		}
+
+		request.URL.Scheme = upstream.Scheme
+		request.URL.Host = upstream.Host
+		request.URL.Path = singleJoiningSlash(upstream.Path, request.URL.Path)
+		// cloud run routes on the host header, it has to be the upstream and not us
+		request.Host = upstream.Host
+	}
+
+	return &httputil.ReverseProxy{
+		Director: director,
+		// tracing below the token transport so the outgoing span covers the whole round trip
+		Transport: &oauth2.Transport{Source: tokens, Base: otelhttp.NewTransport(clientx.DefaultTransport())},
+		// stream every write straight to the client, server sent events and chunked downloads work as expected
+		FlushInterval: -1,
+		ErrorHandler: func(writer http.ResponseWriter, request *http.Request, err error) {
+			err = errs.Wrapf(err, errs.Unavailable, "proxy %s", upstream.Host)
+			logger.WrapTraceContext(request.Context()).Errorw("proxy upstream failed", "upstream", upstream.Host, "err", err)
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "bad_gateway", Message: errs.Message(err)}, http.StatusBadGateway)
+		},
+	}, nil
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/"); {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	prop "go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/cmd/replay"
+
+// the most differing json paths we print for a single request
+const maxDiffs = 10
+
+// dropped are the headers of a capture we never send again, they describe the hop the capture was made on, our own
+// identity or trace, or are set anew for the replay
+var dropped = map[string]bool{
+	"Authorization":          true,
+	"Connection":             true,
+	"Content-Length":         true,
+	"Accept-Encoding":        true,
+	"Forwarded":              true,
+	"Host":                   true,
+	"Traceparent":            true,
+	"Tracestate":             true,
+	"X-Cloud-Trace-Context":  true,
+	"X-Forwarded-For":        true,
+	"X-Forwarded-Proto":      true,
+	httpx.DebugCaptureHeader: true,
+	"X-Debug-Trace":          true,
+}
+
+type config struct {
+	target        string
+	baseline      string
+	token         string
+	auth          bool
+	methods       string
+	ignore        string
+	allowRedacted bool
+	debugSecret   string
+	traceProject  string
+	timeout       time.Duration
+	delay         time.Duration
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: replay -target <url> [flags] capture.json|file.har ...\n\n")
+		flag.PrintDefaults()
+	}
+	cfg := config{}
+	flag.StringVar(&cfg.target, "target", "", "url of the service to replay against, eg the tagged url of a new revision")
+	flag.StringVar(&cfg.baseline, "baseline", "", "replay against this url as well and compare the two, rather than with the captured responses")
+	flag.StringVar(&cfg.token, "token", "", "identity token to send, eg $(gcloud auth print-identity-token)")
+	flag.BoolVar(&cfg.auth, "auth", true, "mint identity tokens for each url from application default credentials when no -token is given")
+	flag.StringVar(&cfg.methods, "methods", "GET,HEAD", "comma separated methods replayed, others are skipped, replaying a POST creates what it created again")
+	flag.StringVar(&cfg.ignore, "ignore", "id,created,updated,trace_id,request_id,doc_id", "comma separated json fields expected to differ, ignored at any depth")
+	flag.BoolVar(&cfg.allowRedacted, "allow-redacted", false, "replay requests whose body had fields redacted, sending the placeholder in their place")
+	flag.StringVar(&cfg.debugSecret, "debug-secret", os.Getenv("DEBUG_SECRET"), "sign X-Debug-Capture and X-Debug-Trace headers so the target captures and traces what we replay")
+	flag.StringVar(&cfg.traceProject, "trace-project", "", "export our spans to cloud trace in this project, each links the trace of the request it replays")
+	flag.DurationVar(&cfg.timeout, "timeout", 30*time.Second, "per request timeout")
+	flag.DurationVar(&cfg.delay, "delay", 0, "wait between requests")
+	flag.Parse()
+
+	if cfg.target == "" || flag.NArg() == 0 {
+		flag.Usage()
+		return fmt.Errorf("-target and at least one capture file must be given")
+	}
+	var requests []captured
+	for _, file := range flag.Args() {
+		loaded, err := load(file)
+		if err != nil {
+			return fmt.Errorf("load(%s): %v", file, err)
+		}
+		requests = append(requests, loaded...)
+	}
+	if len(requests) == 0 {
+		return fmt.Errorf("no captured requests in %v, captures are the \"debug capture\" entries of httpx.DebugCapture", flag.Args())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// every replayed request gets a trace of its own, sent to cloud trace only when -trace-project is set. the target
+	// continues it from the headers we send, X-Cloud-Trace-Context and traceparent
+	if cfg.traceProject == "" {
+		// spans that go nowhere, but with trace ids for the target to continue
+		otel.SetTextMapPropagator(obs.Propagator())
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample())))
+	} else {
+		telemetry, err := obs.Init(ctx, obs.Config{ServiceName: "replay", ProjectID: cfg.traceProject})
+		if err != nil {
+			return fmt.Errorf("obs.Init(): %v", err)
+		}
+		defer func() {
+			// our ctx may be cancelled by then, the spans of a replay that was interrupted are the interesting ones
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := telemetry.Shutdown(shutdownCtx); err != nil {
+				log.Printf("telemetry.Shutdown(): %v", err)
+			}
+		}()
+	}
+
+	target, err := newTarget(ctx, cfg.target, cfg)
+	if err != nil {
+		return fmt.Errorf("newTarget(target): %v", err)
+	}
+	var baseline *replayTarget
+	if cfg.baseline != "" {
+		if baseline, err = newTarget(ctx, cfg.baseline, cfg); err != nil {
+			return fmt.Errorf("newTarget(baseline): %v", err)
+		}
+	}
+
+	methods := map[string]bool{}
+	for _, method := range strings.Split(cfg.methods, ",") {
+		methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+	ignore := map[string]bool{}
+	for _, field := range strings.Split(cfg.ignore, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignore[field] = true
+		}
+	}
+
+	var sum summary
+	for i, c := range requests {
+		if ctx.Err() != nil {
+			break
+		}
+		if i > 0 && cfg.delay > 0 {
+			time.Sleep(cfg.delay)
+		}
+		switch {
+		case !methods[c.method]:
+			sum.skip(c, "its method isn't in -methods")
+			continue
+		case c.unreplayable != "":
+			sum.skip(c, c.unreplayable)
+			continue
+		case c.redacted && !cfg.allowRedacted:
+			sum.skip(c, "its body had fields redacted, pass -allow-redacted to send it anyway")
+			continue
+		}
+		sum.add(c, replay(ctx, c, target, baseline, ignore, cfg))
+	}
+
+	fmt.Println()
+	sum.print(os.Stdout)
+	if sum.differed > 0 || sum.failed > 0 {
+		return fmt.Errorf("%d of %d replayed requests differ, %d failed", sum.differed, sum.replayed, sum.failed)
+	}
+	return nil
+}
+
+// replayTarget is a service we replay against, with identity tokens minted for it
+type replayTarget struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// newTarget authenticates every request with an identity token for rawURL, the audience cloud run expects
+func newTarget(ctx context.Context, rawURL string, cfg config) (*replayTarget, error) {
+	base, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse(): %v", err)
+	}
+	transport := clientx.NewTransport()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.timeout,
+		// a redirect is a response like any other, it is compared rather than followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	switch {
+	case cfg.token != "":
+		client.Transport = &oauth2.Transport{Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: cfg.token}), Base: transport}
+	case cfg.auth:
+		// user credentials from gcloud can't mint identity tokens for an arbitrary audience, pass -token for those
+		tokens, err := idtoken.NewTokenSource(ctx, base.Scheme+"://"+base.Host)
+		if err != nil {
+			return nil, fmt.Errorf("idtoken.NewTokenSource(): %v, pass -token or -auth=false", err)
+		}
+		client.Transport = &oauth2.Transport{Source: tokens, Base: transport}
+	}
+	return &replayTarget{base: base, client: client}, nil
+}
+
+// response is what a replayed request got back
+type response struct {
+	status  int
+	body    []byte
+	latency time.Duration
+	err     error
+}
+
+// outcome is how a replayed request compared
+type outcome struct {
+	got     response
+	want    response
+	against string
+	diffs   []string
+	traceID string
+}
+
+// replay sends c to target, and to baseline when there is one, each in a new trace that links the original one
+func replay(ctx context.Context, c captured, target, baseline *replayTarget, ignore map[string]bool, cfg config) outcome {
+	var opts []trace.SpanStartOption
+	opts = append(opts, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("replay.source", c.source),
+		attribute.String("http.method", c.method),
+		attribute.String("http.target", c.path),
+	))
+	if original := originalSpan(c); original.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: original}))
+		opts = append(opts, trace.WithAttributes(attribute.String("replay.original_trace_id", c.traceID)))
+	}
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "replay "+c.method+" "+c.path, opts...)
+	defer span.End()
+
+	out := outcome{traceID: span.SpanContext().TraceID().String(), against: "capture"}
+	out.got = send(ctx, target, c, cfg)
+	if out.got.err != nil {
+		span.RecordError(out.got.err)
+		span.SetStatus(codes.Error, out.got.err.Error())
+		return out
+	}
+
+	ignoreHere := ignore
+	switch {
+	case baseline != nil:
+		out.against = "baseline"
+		out.want = send(ctx, baseline, c, cfg)
+		if out.want.err != nil {
+			span.RecordError(out.want.err)
+			span.SetStatus(codes.Error, out.want.err.Error())
+			return out
+		}
+	default:
+		out.want = response{status: c.status, body: c.response}
+		// fields redacted in the capture can't be compared, whatever they hold now
+		if len(c.responseRedacted) > 0 {
+			ignoreHere = make(map[string]bool, len(ignore)+len(c.responseRedacted))
+			for k := range ignore {
+				ignoreHere[k] = true
+			}
+			for k := range c.responseRedacted {
+				ignoreHere[k] = true
+			}
+		}
+	}
+
+	if out.got.status != out.want.status {
+		out.diffs = append(out.diffs, fmt.Sprintf("status %d, was %d", out.got.status, out.want.status))
+	}
+	// a capture without its response body, eg one that was truncated, only has its status to compare
+	if out.want.body != nil || baseline != nil {
+		out.diffs = append(out.diffs, clientx.DiffBodies(out.want.body, out.got.body, ignoreHere, maxDiffs)...)
+	}
+	span.SetAttributes(attribute.Int("http.status_code", out.got.status), attribute.Int("replay.diffs", len(out.diffs)))
+	return out
+}
+
+// send replays c against t, with the headers it was captured with but our own identity and trace
+func send(ctx context.Context, t *replayTarget, c captured, cfg config) response {
+	u := *t.base
+	rel, err := url.Parse(c.path)
+	if err != nil {
+		return response{err: fmt.Errorf("url.Parse(): %v", err)}
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + rel.Path
+	u.RawQuery = rel.RawQuery
+
+	var body io.Reader
+	if len(c.body) > 0 {
+		body = bytes.NewReader(c.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, c.method, u.String(), body)
+	if err != nil {
+		return response{err: fmt.Errorf("http.NewRequestWithContext(): %v", err)}
+	}
+	for k, v := range c.header {
+		if !dropped[http.CanonicalHeaderKey(k)] {
+			req.Header[k] = v
+		}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, prop.HeaderCarrier(req.Header))
+	if cfg.debugSecret != "" {
+		signed := httpx.SignDebugHeader([]byte(cfg.debugSecret), req.Method, req.URL.Path, time.Now())
+		req.Header.Set(httpx.DebugCaptureHeader, signed)
+		req.Header.Set("X-Debug-Trace", signed)
+	}
+
+	started := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return response{err: fmt.Errorf("client.Do(): %v", err), latency: time.Since(started)}
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return response{err: fmt.Errorf("ioutil.ReadAll(): %v", err), latency: time.Since(started)}
+	}
+	return response{status: resp.StatusCode, body: b, latency: time.Since(started)}
+}
+
+// originalSpan is the span the captured request was served in, to link ours to
+func originalSpan(c captured) trace.SpanContext {
+	traceID, err := trace.TraceIDFromHex(c.traceID)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	spanID, err := trace.SpanIDFromHex(c.spanID)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, Remote: true})
+}
+
+// summary counts how the replay went and prints a line per request as it goes
+type summary struct {
+	replayed int
+	matched  int
+	differed int
+	failed   int
+	skipped  int
+}
+
+func (s *summary) skip(c captured, reason string) {
+	s.skipped++
+	fmt.Printf("skip  %s %s, %s (%s)\n", c.method, c.path, reason, c.source)
+}
+
+func (s *summary) add(c captured, out outcome) {
+	s.replayed++
+	switch {
+	case out.got.err != nil:
+		s.failed++
+		fmt.Printf("fail  %s %s: %v (%s)\n", c.method, c.path, out.got.err, c.source)
+	case out.want.err != nil:
+		s.failed++
+		fmt.Printf("fail  %s %s against the baseline: %v (%s)\n", c.method, c.path, out.want.err, c.source)
+	case len(out.diffs) > 0:
+		s.differed++
+		fmt.Printf("diff  %s %s %d in %s, trace %s (%s)\n", c.method, c.path, out.got.status, out.got.latency.Round(time.Millisecond), out.traceID, c.source)
+		for _, d := range out.diffs {
+			fmt.Printf("        %s\n", d)
+		}
+	default:
+		s.matched++
+		fmt.Printf("ok    %s %s %d in %s, matches the %s\n", c.method, c.path, out.got.status, out.got.latency.Round(time.Millisecond), out.against)
+	}
+}
+
+func (s *summary) print(w io.Writer) {
+	fmt.Fprintf(w, "%d replayed, %d matched, %d differ, %d failed, %d skipped\n", s.replayed, s.matched, s.differed, s.failed, s.skipped)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// captured is a request to replay and the response it got back then
+type captured struct {
+	// source is where it came from, file and position, to point at it in our output
+	source string
+	method string
+	// path is the path and query, whoever served it is replaced by our target
+	path   string
+	header http.Header
+	body   []byte
+	// unreplayable says why we can't send it as it was, eg a truncated or binary body
+	unreplayable string
+	// redacted is set when the request body had values redacted, replaying it would send the placeholder instead
+	redacted bool
+	// timestamp is when it was served, rfc 3339
+	timestamp string
+	// traceID and spanID are those of the original request, when the capture has them
+	traceID string
+	spanID  string
+
+	status int
+	// response is nil when the capture has none to compare with, eg it was truncated
+	response []byte
+	// responseRedacted are the json fields redacted in response, they can't be compared
+	responseRedacted map[string]bool
+}
+
+// load reads the requests in file, either entries logged by httpx.DebugCapture, as `gcloud logging read --format=json`
+// prints them or one json entry per line as our logger writes them, or a HAR file saved from a browser
+func load(file string) ([]captured, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile(): %v", err)
+	}
+	b = bytes.TrimSpace(b)
+
+	var entries []map[string]interface{}
+	switch {
+	case bytes.HasPrefix(b, []byte("[")):
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal(%s): %v", file, err)
+		}
+	case bytes.HasPrefix(b, []byte("{")) && isHAR(b):
+		return loadHAR(file, b)
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+		for line := 1; scanner.Scan(); line++ {
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal(text, &entry); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			entries = append(entries, entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("scanner.Err(): %v", err)
+		}
+	}
+
+	var requests []captured
+	for i, entry := range entries {
+		c, ok := fromCapture(entry)
+		if !ok {
+			continue
+		}
+		c.source = fmt.Sprintf("%s#%d", file, i+1)
+		requests = append(requests, c)
+	}
+	// logs are read newest first, requests are replayed in the order they were served
+	if len(requests) > 1 && requests[0].newerThan(requests[len(requests)-1]) {
+		for i, j := 0, len(requests)-1; i < j; i, j = i+1, j-1 {
+			requests[i], requests[j] = requests[j], requests[i]
+		}
+	}
+	return requests, nil
+}
+
+func (c captured) newerThan(other captured) bool {
+	a, errA := time.Parse(time.RFC3339Nano, c.timestamp)
+	b, errB := time.Parse(time.RFC3339Nano, other.timestamp)
+	return errA == nil && errB == nil && a.After(b)
+}
+
+// fromCapture reads a "debug capture" entry, the payload of a cloud logging entry or a line of our logs alike
+func fromCapture(entry map[string]interface{}) (captured, bool) {
+	payload := entry
+	if p, ok := entry["jsonPayload"].(map[string]interface{}); ok {
+		payload = p
+	}
+	request, ok := payload["request"].(map[string]interface{})
+	if !ok {
+		return captured{}, false
+	}
+	response, _ := payload["response"].(map[string]interface{})
+
+	c := captured{header: http.Header{}, responseRedacted: map[string]bool{}}
+	c.method, _ = request["method"].(string)
+	rawURL, _ := request["url"].(string)
+	if u, err := url.Parse(rawURL); err == nil {
+		c.path = u.RequestURI()
+	}
+	if headers, ok := request["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			if s, ok := v.(string); ok && s != httpx.RedactedValue {
+				c.header.Set(k, s)
+			}
+		}
+	}
+	c.body, c.unreplayable = captureBody(request["body"])
+	if truncated, _ := request["truncated"].(bool); truncated {
+		c.unreplayable = "its body was truncated when it was captured"
+	}
+	c.redacted = redactedFields(request["body"], nil)
+
+	c.traceID, c.spanID = traceOf(entry, payload)
+	if response != nil {
+		status, _ := response["status"].(float64)
+		c.status = int(status)
+		truncated, _ := response["truncated"].(bool)
+		if body, reason := captureBody(response["body"]); reason == "" && !truncated {
+			c.response = body
+			redactedFields(response["body"], c.responseRedacted)
+		}
+	}
+	if timestamp, ok := entry["timestamp"].(string); ok {
+		c.timestamp = timestamp
+	}
+	return c, c.method != "" && c.path != ""
+}
+
+// captureBody turns a captured body back into bytes, json was logged as json and text as a string
+func captureBody(v interface{}) ([]byte, string) {
+	switch body := v.(type) {
+	case nil:
+		return nil, ""
+	case string:
+		if strings.HasPrefix(body, "<") && strings.HasSuffix(body, " bytes of binary data>") {
+			return nil, "its body was binary, captures only keep text"
+		}
+		return []byte(body), ""
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Sprintf("its body can't be encoded again: %v", err)
+		}
+		return b, ""
+	}
+}
+
+// redactedFields reports whether v has any redacted json field, adding their names to fields when it is not nil
+func redactedFields(v interface{}, fields map[string]bool) bool {
+	found := false
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if val == httpx.RedactedValue {
+				found = true
+				if fields != nil {
+					fields[k] = true
+				}
+				continue
+			}
+			found = redactedFields(val, fields) || found
+		}
+	case []interface{}:
+		for _, val := range t {
+			found = redactedFields(val, fields) || found
+		}
+	}
+	return found
+}
+
+// traceOf finds the trace and span of the original request, cloud logging has them on the entry and our logger in its
+// payload, both as projects/<project>/traces/<trace id>
+func traceOf(entry, payload map[string]interface{}) (string, string) {
+	trace, _ := entry["trace"].(string)
+	span, _ := entry["spanId"].(string)
+	if trace == "" {
+		trace, _ = payload["logging.googleapis.com/trace"].(string)
+		span, _ = payload["logging.googleapis.com/spanId"].(string)
+	}
+	return trace[strings.LastIndex(trace, "/")+1:], span
+}
+
+func isHAR(b []byte) bool {
+	var probe struct {
+		Log *json.RawMessage `json:"log"`
+	}
+	return json.Unmarshal(b, &probe) == nil && probe.Log != nil
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime string `json:"startedDateTime"`
+			Request         struct {
+				Method   string       `json:"method"`
+				URL      string       `json:"url"`
+				Headers  []harHeader  `json:"headers"`
+				PostData *harPostData `json:"postData"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	Text string `json:"text"`
+}
+
+// loadHAR reads the requests of a HAR file, in the order the browser sent them
+func loadHAR(file string, b []byte) ([]captured, error) {
+	var har harFile
+	if err := json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(%s): %v", file, err)
+	}
+	requests := make([]captured, 0, len(har.Log.Entries))
+	for i, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s#%d: url.Parse(): %v", file, i+1, err)
+		}
+		c := captured{
+			source:           fmt.Sprintf("%s#%d", file, i+1),
+			method:           entry.Request.Method,
+			path:             u.RequestURI(),
+			header:           http.Header{},
+			status:           entry.Response.Status,
+			responseRedacted: map[string]bool{},
+			timestamp:        entry.StartedDateTime,
+		}
+		for _, h := range entry.Request.Headers {
+			// http/2 pseudo headers, eg :authority, are how the browser sent it rather than part of the request
+			if !strings.HasPrefix(h.Name, ":") {
+				c.header.Add(h.Name, h.Value)
+			}
+		}
+		if entry.Request.PostData != nil {
+			c.body = []byte(entry.Request.PostData.Text)
+		}
+		// base64 content is binary, browsers leave content out altogether for some responses
+		if entry.Response.Content.Encoding == "" && entry.Response.Content.Text != "" {
+			c.response = []byte(entry.Response.Content.Text)
+		}
+		if sc := c.header.Get("X-Cloud-Trace-Context"); sc != "" {
+			c.traceID = strings.SplitN(sc, "/", 2)[0]
+		}
+		requests = append(requests, c)
+	}
+	return requests, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fixture is a document to write, data converted to what firestore should store
+type fixture struct {
+	path   string
+	data   map[string]interface{}
+	source string
+}
+
+// collection is the path of the collection the document is in, eg tenants/acme/beer
+func (f fixture) collection() string {
+	return path.Dir(f.path)
+}
+
+// loadFixtures reads every fixture file in paths, a directory stands for the json files in it. without paths the
+// fixtures we ship with are used. a document in two files is an error rather than whichever came last
+func loadFixtures(paths []string) ([]fixture, error) {
+	var fixtures []fixture
+	seen := map[string]string{}
+	add := func(source string, b []byte) error {
+		loaded, err := parseFixtures(source, b)
+		if err != nil {
+			return err
+		}
+		for _, f := range loaded {
+			if other, ok := seen[f.path]; ok {
+				return fmt.Errorf("%s is in both %s and %s", f.path, other, source)
+			}
+			seen[f.path] = source
+			fixtures = append(fixtures, f)
+		}
+		return nil
+	}
+
+	if len(paths) == 0 {
+		names, err := fs.Glob(embedded, "fixtures/*.json")
+		if err != nil {
+			return nil, fmt.Errorf("fs.Glob(): %v", err)
+		}
+		for _, name := range names {
+			b, err := embedded.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("embedded.ReadFile(%s): %v", name, err)
+			}
+			if err := add(name, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, p := range paths {
+		files := []string{p}
+		if info, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("os.Stat(): %v", err)
+		} else if info.IsDir() {
+			if files, err = filepath.Glob(filepath.Join(p, "*.json")); err != nil {
+				return nil, fmt.Errorf("filepath.Glob(): %v", err)
+			}
+		}
+		for _, file := range files {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("ioutil.ReadFile(): %v", err)
+			}
+			if err := add(file, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the same fixtures are written in the same order every time
+	sort.Slice(fixtures, func(i, j int) bool { return fixtures[i].path < fixtures[j].path })
+	return fixtures, nil
+}
+
+// parseFixtures parses a file shaped like testinfra.SeedFile expects, {"beers/ipa": {"name": "..."}}. whole numbers
+// are stored as integers rather than doubles, and {"$timestamp": "<rfc 3339>"} as a timestamp since json has none
+func parseFixtures(source string, b []byte) ([]fixture, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var docs map[string]map[string]interface{}
+	if err := decoder.Decode(&docs); err != nil {
+		return nil, fmt.Errorf("decoder.Decode(%s): %v", source, err)
+	}
+	fixtures := make([]fixture, 0, len(docs))
+	for p, data := range docs {
+		p = strings.Trim(p, "/")
+		if strings.Count(p, "/")%2 != 1 {
+			return nil, fmt.Errorf("%s: %q is not a document path", source, p)
+		}
+		converted, err := convert(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", source, p, err)
+		}
+		fixtures = append(fixtures, fixture{path: p, data: converted.(map[string]interface{}), source: source})
+	}
+	return fixtures, nil
+}
+
+func convert(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		for i := range v {
+			converted, err := convert(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	case map[string]interface{}:
+		if raw, ok := v["$timestamp"]; ok && len(v) == 1 {
+			s, _ := raw.(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("$timestamp %v: %v", raw, err)
+			}
+			return t, nil
+		}
+		for key, value := range v {
+			converted, err := convert(value)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	}
+	return v, nil
+}
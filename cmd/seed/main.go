@@ -0,0 +1,264 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/cmd/seed"
+
+// emulatorProjectID is the project the emulator is seeded under, the one testinfra uses
+const emulatorProjectID = "testinfra"
+
+// maxBatchSize is the most writes firestore accepts in a single commit
+const maxBatchSize = 500
+
+//go:embed fixtures/*.json
+var embedded embed.FS
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: seed [flags] [fixture.json|dir ...]\n\n")
+		flag.PrintDefaults()
+	}
+	project := flag.String("project", "", "project to seed, required unless FIRESTORE_EMULATOR_HOST is set")
+	clear := flag.Bool("clear", false, "delete every document of the collections the fixtures are in before writing them")
+	dryRun := flag.Bool("dry-run", false, "report what would be cleared and written without touching firestore")
+	traced := flag.Bool("trace", false, "export our spans to cloud trace in -project")
+	flag.Parse()
+
+	projectID := *project
+	emulator := os.Getenv("FIRESTORE_EMULATOR_HOST")
+	if projectID == "" {
+		// a project is never seeded by accident, it has to be named
+		if emulator == "" {
+			return fmt.Errorf("-project is required outside of the emulator, set FIRESTORE_EMULATOR_HOST to seed the emulator")
+		}
+		projectID = emulatorProjectID
+	}
+	fixtures, err := loadFixtures(flag.Args())
+	if err != nil {
+		return fmt.Errorf("loadFixtures(): %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *traced {
+		telemetry, err := obs.Init(ctx, obs.Config{ServiceName: "seed", ProjectID: projectID})
+		if err != nil {
+			return fmt.Errorf("obs.Init(): %v", err)
+		}
+		defer func() {
+			// our ctx may be cancelled by then, the spans of a seed that was interrupted are the interesting ones
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := telemetry.Shutdown(shutdownCtx); err != nil {
+				log.Printf("telemetry.Shutdown(): %v", err)
+			}
+		}()
+	}
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "seed", trace.WithAttributes(
+		attribute.String("project", projectID),
+		attribute.Bool("emulator", emulator != ""),
+		attribute.Int("fixtures", len(fixtures)),
+		attribute.Bool("clear", *clear),
+		attribute.Bool("dry_run", *dryRun),
+	))
+	defer span.End()
+
+	rep := newReport(fixtures)
+	rep.clear = *clear
+	if *dryRun {
+		rep.print(os.Stdout, projectID, emulator, span.SpanContext(), true)
+		return nil
+	}
+
+	client, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	defer client.Close()
+
+	started := time.Now()
+	if *clear {
+		for _, collection := range rep.collections() {
+			cleared, err := clearCollection(ctx, client, collection)
+			rep.cleared[collection] = cleared
+			if err != nil {
+				recordError(span, err)
+				return fmt.Errorf("clearCollection(%s): %v", collection, err)
+			}
+		}
+	}
+	if err := write(ctx, client, fixtures); err != nil {
+		recordError(span, err)
+		return fmt.Errorf("write(): %v", err)
+	}
+	rep.took = time.Since(started)
+	rep.print(os.Stdout, projectID, emulator, span.SpanContext(), false)
+	return nil
+}
+
+// write sets every fixture, replacing what its document held, in commits of at most 500
+func write(ctx context.Context, client *firestore.Client, fixtures []fixture) error {
+	for start := 0; start < len(fixtures); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(fixtures) {
+			end = len(fixtures)
+		}
+		if err := writeBatch(ctx, client, fixtures[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBatch(ctx context.Context, client *firestore.Client, fixtures []fixture) error {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "seed.write", trace.WithAttributes(attribute.Int("docs", len(fixtures))))
+	defer span.End()
+	batch := client.Batch()
+	for _, f := range fixtures {
+		batch.Set(client.Doc(f.path), f.data)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		recordError(span, err)
+		return fmt.Errorf("batch.Commit(): %v", err)
+	}
+	return nil
+}
+
+// clearCollection deletes every document in collection, the documents below them are left alone like firestore
+// itself does. it returns how many were deleted, also when it fails part way
+func clearCollection(ctx context.Context, client *firestore.Client, collection string) (int, error) {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "seed.clear", trace.WithAttributes(attribute.String("collection", collection)))
+	defer span.End()
+
+	deleted := 0
+	iter := client.Collection(collection).DocumentRefs(ctx)
+	for {
+		batch := client.Batch()
+		n := 0
+		for n < maxBatchSize {
+			ref, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				recordError(span, err)
+				return deleted, fmt.Errorf("iter.Next(): %v", err)
+			}
+			batch.Delete(ref)
+			n++
+		}
+		if n == 0 {
+			span.SetAttributes(attribute.Int("deleted", deleted))
+			return deleted, nil
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			recordError(span, err)
+			return deleted, fmt.Errorf("batch.Commit(): %v", err)
+		}
+		deleted += n
+	}
+}
+
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// report is what a seed wrote and cleared, by collection
+type report struct {
+	written map[string]int
+	sources map[string]map[string]bool
+	cleared map[string]int
+	// clear is whether the collections are cleared first, a dry run has no counts for them
+	clear bool
+	took  time.Duration
+}
+
+func newReport(fixtures []fixture) *report {
+	r := &report{written: map[string]int{}, sources: map[string]map[string]bool{}, cleared: map[string]int{}}
+	for _, f := range fixtures {
+		r.written[f.collection()]++
+		if r.sources[f.collection()] == nil {
+			r.sources[f.collection()] = map[string]bool{}
+		}
+		r.sources[f.collection()][f.source] = true
+	}
+	return r
+}
+
+func (r *report) collections() []string {
+	collections := make([]string, 0, len(r.written))
+	for collection := range r.written {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	return collections
+}
+
+func (r *report) print(out io.Writer, projectID, emulator string, sc trace.SpanContext, dryRun bool) {
+	target := "project " + projectID
+	if emulator != "" {
+		target = "emulator " + emulator
+	}
+	verb := "seeded"
+	if dryRun {
+		verb = "would seed"
+	}
+	fmt.Fprintf(out, "%s %s\n\n", verb, target)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTION\tWRITTEN\tCLEARED\tFROM")
+	total := 0
+	for _, collection := range r.collections() {
+		sources := make([]string, 0, len(r.sources[collection]))
+		for source := range r.sources[collection] {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		cleared := "-"
+		if n, ok := r.cleared[collection]; ok {
+			cleared = fmt.Sprint(n)
+		} else if r.clear {
+			cleared = "all"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", collection, r.written[collection], cleared, sources)
+		total += r.written[collection]
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\n%d documents", total)
+	if !dryRun {
+		fmt.Fprintf(out, " in %s", r.took.Round(time.Millisecond))
+	}
+	fmt.Fprintln(out)
+	if sc.IsSampled() {
+		fmt.Fprintf(out, "trace https://console.cloud.google.com/traces/list?project=%s&tid=%s\n", projectID, sc.TraceID())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/logx/logtest"
+	"github.com/amammay/effectivecloudrun/internal/obs"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const contractProject = "my-project"
+
+// specialFields are the fields cloud logging correlates and filters entries by, every logger we show has to write
+// them the same way or a request's logs stop lining up with its trace depending on which logger wrote them
+var specialFields = []string{
+	"severity",
+	"logging.googleapis.com/trace",
+	"logging.googleapis.com/spanId",
+	"logging.googleapis.com/trace_sampled",
+}
+
+// backend logs an info entry for a request carrying header as its X-Cloud-Trace-Context and returns the entry
+type backend func(t *testing.T, header string) map[string]interface{}
+
+var backends = map[string]backend{
+	// the entries we write by hand in structuredlogging.go
+	"handwritten": func(t *testing.T, header string) map[string]interface{} {
+		var buf bytes.Buffer
+		output := logOutput
+		logOutput = &buf
+		defer func() { logOutput = output }()
+		info(requestWithTrace(header), "hello", contractProject)
+		return decodeEntry(t, buf.Bytes())
+	},
+	// uberzaplogger, zapdriver with the fields of the raw header
+	"zapdriver": func(t *testing.T, header string) map[string]interface{} {
+		var buf bytes.Buffer
+		core := zapcore.NewCore(zapcore.NewJSONEncoder(zapdriver.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zap.DebugLevel)
+		zap.New(core).With(zapTraceContext(header, contractProject)...).Info("hello")
+		return decodeEntry(t, buf.Bytes())
+	},
+	// logx for handlers that aren't instrumented with otel
+	"logx_cloud_trace_context": func(t *testing.T, header string) map[string]interface{} {
+		logger, capture := logtest.New(t, contractProject)
+		logger.WrapCloudTraceContext(header).Info("hello")
+		return onlyEntry(t, capture.Entries())
+	},
+	// logx for the rest of our services, the trace comes from the span otel extracted from the request
+	"logx_otel": func(t *testing.T, header string) map[string]interface{} {
+		logger, capture := logtest.New(t, contractProject)
+		request := requestWithTrace(header)
+		ctx := obs.Propagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		logger.WrapTraceContext(ctx).Info("hello")
+		return onlyEntry(t, capture.Entries())
+	},
+}
+
+func TestSpecialFieldsContract(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "sampled",
+			header: "105445aa7843bc8bf206b120001000ab/1;o=1",
+			want: map[string]interface{}{
+				"severity":                             "INFO",
+				"logging.googleapis.com/trace":         "projects/my-project/traces/105445aa7843bc8bf206b120001000ab",
+				"logging.googleapis.com/spanId":        "0000000000000001",
+				"logging.googleapis.com/trace_sampled": true,
+			},
+		},
+		{
+			name:   "not_sampled",
+			header: "105445aa7843bc8bf206b120001000ab/255;o=0",
+			want: map[string]interface{}{
+				"severity":                             "INFO",
+				"logging.googleapis.com/trace":         "projects/my-project/traces/105445aa7843bc8bf206b120001000ab",
+				"logging.googleapis.com/spanId":        "00000000000000ff",
+				"logging.googleapis.com/trace_sampled": false,
+			},
+		},
+		{
+			name:   "untraced",
+			header: "",
+			want:   map[string]interface{}{"severity": "INFO", "logging.googleapis.com/trace_sampled": false},
+		},
+		{
+			name:   "malformed",
+			header: "not-a-trace/xyz;o=1",
+			want:   map[string]interface{}{"severity": "INFO", "logging.googleapis.com/trace_sampled": false},
+		},
+	}
+	for _, tt := range tests {
+		for name, log := range backends {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				if got := special(log(t, tt.header)); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("special fields = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// special picks the special fields out of entry. cloud logging reads a missing trace_sampled as false, some of our
+// loggers leave it out when it is, so it is compared as false
+func special(entry map[string]interface{}) map[string]interface{} {
+	got := map[string]interface{}{"logging.googleapis.com/trace_sampled": false}
+	for _, field := range specialFields {
+		if v, ok := entry[field]; ok {
+			got[field] = v
+		}
+	}
+	return got
+}
+
+func requestWithTrace(header string) *http.Request {
+	request := httptest.NewRequest("GET", "/structuredlogger", nil)
+	if header != "" {
+		request.Header.Set("X-Cloud-Trace-Context", header)
+	}
+	return request
+}
+
+func decodeEntry(t *testing.T, line []byte) map[string]interface{} {
+	t.Helper()
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", line, err)
+	}
+	return entry
+}
+
+func onlyEntry(t *testing.T, entries []map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(entries))
+	}
+	return entries[0]
+}
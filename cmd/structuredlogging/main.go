@@ -2,15 +2,31 @@ package main
 
 import (
 	"cloud.google.com/go/compute/metadata"
+	"embed"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
 	"github.com/blendle/zapdriver"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 )
 
+// templates are the pages we greet with, html/template escapes the user agent we echo back so a crafted one can't
+// inject markup into them
+//
+//go:embed templates
+var templates embed.FS
+
+// hello is the data of templates/hello.html
+type hello struct {
+	Logger    string
+	Greeting  string
+	UserAgent string
+}
+
 func main() {
 	if err := run(); err != nil {
 		log.Fatalf("run(): %v", err)
@@ -30,10 +46,19 @@ func run() error {
 		projectID = id
 	}
 
+	pages, err := fs.Sub(templates, "templates")
+	if err != nil {
+		return fmt.Errorf("fs.Sub(): %v", err)
+	}
+	html, err := httpx.NewHTML(pages)
+	if err != nil {
+		return fmt.Errorf("httpx.NewHTML(): %v", err)
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/stdlogger", stdlogger())
-	mux.HandleFunc("/structuredlogger", structuredlogger(projectID))
-	mux.HandleFunc("/uberzaplogger", uberzaplogger(projectID, onGCE))
+	mux.HandleFunc("/stdlogger", stdlogger(html))
+	mux.HandleFunc("/structuredlogger", structuredlogger(html, projectID))
+	mux.HandleFunc("/uberzaplogger", uberzaplogger(html, projectID, onGCE))
 
 	// cloud run sets the PORT env variable for us to listen on
 	port := os.Getenv("PORT")
@@ -45,16 +70,16 @@ func run() error {
 }
 
 // stdlogger showcases the most basic of loggers that is included with golang, better then having nothing
-func stdlogger() http.HandlerFunc {
+func stdlogger(html *httpx.HTML) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		log.Printf("hello %q! im an standard logger from the golang standard library", request.UserAgent())
-		fmt.Fprintf(writer, "<h1> howdy i am an standard logger %q", request.UserAgent())
+		html.Render(writer, request, "hello.html", &hello{Logger: "stdlogger", Greeting: "howdy i am an standard logger", UserAgent: request.UserAgent()}, http.StatusOK)
 	}
 }
 
 // structuredlogger showcases how we can optimize logging for google cloud to get more bang for our buck when writing logs
 // there is definitely opportunities for natural abstractions to arise with this, therefore allowing teams to have full control if needed
-func structuredlogger(projectID string) http.HandlerFunc {
+func structuredlogger(html *httpx.HTML, projectID string) http.HandlerFunc {
 
 	return func(writer http.ResponseWriter, request *http.Request) {
 
@@ -67,7 +92,7 @@ func structuredlogger(projectID string) http.HandlerFunc {
 		alert(request, "alert message", projectID)
 		emergency(request, "emergency message", projectID)
 
-		fmt.Fprintf(writer, "<h1> structured logger is saying hello %q", request.UserAgent())
+		html.Render(writer, request, "hello.html", &hello{Logger: "structuredlogger", Greeting: "structured logger is saying hello", UserAgent: request.UserAgent()}, http.StatusOK)
 
 	}
 }
@@ -75,7 +100,7 @@ func structuredlogger(projectID string) http.HandlerFunc {
 // uberzaplogger showcases how using a third party logger introduces various quality of life updates from the structuredlogger
 // the only downside is that its another third party library you are learning. overall the api surface is pretty straight forward with uber-zap
 // we are just using a wrapper around zap to provide the correct configurations for gcp logging.
-func uberzaplogger(projectID string, onGCE bool) http.HandlerFunc {
+func uberzaplogger(html *httpx.HTML, projectID string, onGCE bool) http.HandlerFunc {
 
 	var config zap.Config
 	// if on the cloud we will use a production config
@@ -98,9 +123,7 @@ func uberzaplogger(projectID string, onGCE bool) http.HandlerFunc {
 	}
 
 	wrapTraceContext := func(header string) *zap.SugaredLogger {
-		traceID, spanID, sampled := deconstructXCloudTraceContext(header)
-		fields := zapdriver.TraceContext(traceID, spanID, sampled, projectID)
-		setFields := clientLogger.With(fields...)
+		setFields := clientLogger.With(zapTraceContext(header, projectID)...)
 		return setFields.Sugar()
 	}
 
@@ -115,7 +138,17 @@ func uberzaplogger(projectID string, onGCE bool) http.HandlerFunc {
 		// logger.Panic("alert message")
 		// logger.Fatal("EMERGENCY message")
 
-		fmt.Fprintf(writer, "<h1> uber zap is saying hello %q", request.UserAgent())
+		html.Render(writer, request, "hello.html", &hello{Logger: "uberzaplogger", Greeting: "uber zap is saying hello", UserAgent: request.UserAgent()}, http.StatusOK)
+
+	}
+}
 
+// zapTraceContext is the trace fields zapdriver writes for the X-Cloud-Trace-Context header, none for a request
+// without a trace, like our other loggers
+func zapTraceContext(header, projectID string) []zap.Field {
+	traceID, spanID, sampled := deconstructXCloudTraceContext(header)
+	if traceID == "" {
+		return nil
 	}
+	return zapdriver.TraceContext(traceID, spanID, sampled, projectID)
 }
@@ -3,9 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"io"
 	"net/http"
 	"os"
-	"regexp"
 	"time"
 )
 
@@ -57,7 +58,9 @@ type sourceLocation struct {
 func info(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "INFO",
 		Message:  message,
@@ -77,46 +80,40 @@ func info(r *http.Request, message interface{}, projectID string) {
 	writelog(&entry)
 }
 
+// logOutput is where our entries go, cloud run picks them up from stderr
+var logOutput io.Writer = os.Stderr
+
 func writelog(entry *logEntry) {
-	if err := json.NewEncoder(os.Stderr).Encode(entry); err != nil {
+	if err := json.NewEncoder(logOutput).Encode(entry); err != nil {
 		fmt.Printf("failure to write structured log entry: %v", err)
 	}
 }
 
-// taken from https://github.com/googleapis/google-cloud-go/blob/master/logging/logging.go#L774
-var reCloudTraceContext = regexp.MustCompile(
-	// Matches on "TRACE_ID"
-	`([a-f\d]+)?` +
-		// Matches on "/SPAN_ID"
-		`(?:/([a-f\d]+))?` +
-		// Matches on ";0=TRACE_TRUE"
-		`(?:;o=(\d))?`)
-
 func deconstructXCloudTraceContext(s string) (traceID, spanID string, traceSampled bool) {
 	// As per the format described at https://cloud.google.com/trace/docs/setup#force-trace
 	//    "X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=TRACE_TRUE"
 	// for example:
-	//    "X-Cloud-Trace-Context: 105445aa7843bc8bf206b120001000/1;o=1"
+	//    "X-Cloud-Trace-Context: 105445aa7843bc8bf206b120001000ab/1;o=1"
 	//
 	// We expect:
-	//   * traceID (optional): 			"105445aa7843bc8bf206b120001000"
-	//   * spanID (optional):       	"1"
+	//   * traceID: 			"105445aa7843bc8bf206b120001000ab"
+	//   * spanID (optional):       	"0000000000000001", cloud logging wants the span id in hex
 	//   * traceSampled (optional): 	true
-	matches := reCloudTraceContext.FindStringSubmatch(s)
-
-	traceID, spanID, traceSampled = matches[1], matches[2], matches[3] == "1"
-
-	if spanID == "0" {
-		spanID = ""
+	//
+	// the header comes straight from the client, a malformed one just leaves the entry without trace correlation
+	tc, err := logx.ParseCloudTraceContext(s)
+	if err != nil {
+		return "", "", false
 	}
-
-	return
+	return tc.TraceID, tc.SpanID, tc.Sampled
 }
 
 func debug(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "DEBUG",
 		Message:  message,
@@ -139,7 +136,9 @@ func debug(r *http.Request, message interface{}, projectID string) {
 func notice(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "NOTICE",
 		Message:  message,
@@ -162,7 +161,9 @@ func notice(r *http.Request, message interface{}, projectID string) {
 func warning(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "WARNING",
 		Message:  message,
@@ -185,7 +186,9 @@ func warning(r *http.Request, message interface{}, projectID string) {
 func errorl(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "ERROR",
 		Message:  message,
@@ -208,7 +211,9 @@ func errorl(r *http.Request, message interface{}, projectID string) {
 func critical(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "CRITICAL",
 		Message:  message,
@@ -231,7 +236,9 @@ func critical(r *http.Request, message interface{}, projectID string) {
 func alert(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "ALERT",
 		Message:  message,
@@ -254,7 +261,9 @@ func alert(r *http.Request, message interface{}, projectID string) {
 func emergency(r *http.Request, message interface{}, projectID string) {
 	get := r.Header.Get("X-Cloud-Trace-Context")
 	traceID, spanID, traceSampled := deconstructXCloudTraceContext(get)
-	traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	if traceID != "" {
+		traceID = fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+	}
 	entry := logEntry{
 		Severity: "EMERGENCY",
 		Message:  message,
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+// BenchmarkInfo covers writing a whole entry by hand, parsing the trace header and encoding the entry
+func BenchmarkInfo(b *testing.B) {
+	output := logOutput
+	logOutput = ioutil.Discard
+	b.Cleanup(func() { logOutput = output })
+	request := httptest.NewRequest("GET", "/structuredlogger", nil)
+	request.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b120001000ab/1;o=1")
+	request.Header.Set("User-Agent", "benchmark")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		info(request, "hello", "my-project")
+	}
+}
+
+func BenchmarkDeconstructXCloudTraceContext(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		deconstructXCloudTraceContext("105445aa7843bc8bf206b120001000ab/1;o=1")
+	}
+}
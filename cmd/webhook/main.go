@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/firestorex"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/lazyinit"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"github.com/amammay/effectivecloudrun/internal/webhookx"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatalf("run(): %v", err)
+	}
+}
+
+type server struct {
+	mux    *http.ServeMux
+	logger *logx.AppLogger
+	// allowlist holds the hosts we deliver webhooks to
+	allowlist *clientx.Allowlist
+}
+
+func (s *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.mux.ServeHTTP(writer, request)
+}
+
+func run() error {
+	projectID := "mammay-labs"
+	onGCE := metadata.OnGCE()
+	if onGCE {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return fmt.Errorf("metadata.ProjectID(): %v", err)
+		}
+		projectID = id
+	}
+
+	loggerClient, err := logx.NewLogger(projectID, onGCE)
+	if err != nil {
+		return fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := loggerClient.Sugar()
+	defer logger.Sync()
+
+	// mount the secrets with --set-secrets so they never show up in the service yaml
+	githubSecret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	internalSecret := os.Getenv("WEBHOOK_SECRET")
+	if githubSecret == "" || internalSecret == "" {
+		return fmt.Errorf("GITHUB_WEBHOOK_SECRET and WEBHOOK_SECRET must be set")
+	}
+
+	s := &server{mux: http.NewServeMux(), logger: loggerClient}
+	github := webhookx.NewReceiver(webhookx.GitHub([]byte(githubSecret)))
+	s.mux.Handle("/webhooks/github", github.Middleware(s.handleGitHub()))
+
+	// deliveries from our own webhookx.Dispatcher, signed the same way stripe signs theirs
+	internal := webhookx.NewReceiver(webhookx.TimestampedHMAC(webhookx.SignatureHeader, 5*time.Minute, []byte(internalSecret)))
+	s.mux.Handle("/webhooks/internal", internal.Middleware(s.handleInternal()))
+
+	// sending webhooks is optional, it needs a cloud tasks queue and a service account that can invoke us
+	if queueName := os.Getenv("WEBHOOK_QUEUE"); queueName != "" {
+		ctx := context.Background()
+		// what we send is signed with a secret of its own, a signature we hand a subscriber must never get a payload
+		// through our own /webhooks/internal
+		signingSecret := os.Getenv("WEBHOOK_SIGNING_SECRET")
+		if signingSecret == "" || signingSecret == internalSecret {
+			return fmt.Errorf("WEBHOOK_SIGNING_SECRET must be set and differ from WEBHOOK_SECRET")
+		}
+		// subscribers are only called on hosts we allow, a delivery url is whatever a caller sent us
+		allowedHosts := strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",")
+		allowlist, err := clientx.NewAllowlist(loggerClient, allowedHosts...)
+		if err != nil {
+			return fmt.Errorf("clientx.NewAllowlist(): %v", err)
+		}
+		audience := os.Getenv("WEBHOOK_API_AUDIENCE")
+		if audience == "" {
+			return fmt.Errorf("WEBHOOK_API_AUDIENCE must be set to send webhooks")
+		}
+		// any google identity can mint a token for our audiences, so who may call us is never left open
+		tasksServiceAccount := os.Getenv("WEBHOOK_TASKS_SERVICE_ACCOUNT")
+		callers := os.Getenv("WEBHOOK_API_CALLERS")
+		if tasksServiceAccount == "" || callers == "" {
+			return fmt.Errorf("WEBHOOK_TASKS_SERVICE_ACCOUNT and WEBHOOK_API_CALLERS must be set to send webhooks")
+		}
+
+		target := os.Getenv("WEBHOOK_DELIVER_URL")
+		queue, err := webhookx.NewCloudTasksQueue(ctx, queueName, target, tasksServiceAccount)
+		if err != nil {
+			return fmt.Errorf("webhookx.NewCloudTasksQueue(): %v", err)
+		}
+		// most of our requests are webhooks we receive, firestore and the dispatcher are only set up for the first one
+		// we send or deliver
+		fs := firestorex.NewLazyClient(projectID)
+		defer fs.Close()
+		dispatcher := lazyinit.New("webhook_dispatcher", func(ctx context.Context) (interface{}, error) {
+			client, err := fs.Get(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return webhookx.NewDispatcher(client, queue, []byte(signingSecret),
+				webhookx.WithDeliveryClient(clientx.New(clientx.WithTimeout(30*time.Second), clientx.WithAllowlist(allowlist))),
+				webhookx.WithDispatchLogger(logger),
+			), nil
+		})
+
+		// only cloud tasks, presenting an identity token of its service account for our deliver url, may trigger an
+		// attempt
+		deliverVerifier, err := authx.NewVerifier(ctx, target, authx.WithAllowedEmails(tasksServiceAccount))
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(): %v", err)
+		}
+		// sending and looking up deliveries takes an identity token for our api, of one of WEBHOOK_API_CALLERS
+		apiVerifier, err := authx.NewVerifier(ctx, audience, authx.WithAllowedEmails(strings.Split(callers, ",")...))
+		if err != nil {
+			return fmt.Errorf("authx.NewVerifier(): %v", err)
+		}
+		s.allowlist = allowlist
+		s.mux.Handle("/webhooks/deliver", deliverVerifier.Middleware(withDispatcher(dispatcher, (*webhookx.Dispatcher).DeliverHandler)))
+		s.mux.Handle("/webhooks/deliveries", apiVerifier.Middleware(withDispatcher(dispatcher, (*webhookx.Dispatcher).StatusHandler)))
+		s.mux.Handle("/webhooks/send", apiVerifier.Middleware(withDispatcher(dispatcher, s.handleSend)))
+	}
+
+	srv := serverx.New("", s, logger)
+	return srv.ListenAndServe()
+}
+
+// withDispatcher serves a request with the handler handler returns for our dispatcher, a 503 while it can't be set up
+func withDispatcher(dispatcher *lazyinit.Value, handler func(d *webhookx.Dispatcher) http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		d, err := dispatcher.Get(request.Context())
+		if err != nil {
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		handler(d.(*webhookx.Dispatcher)).ServeHTTP(writer, request)
+	})
+}
+
+// handleGitHub logs the pushes we receive, every request that reaches us has a verified signature
+func (s *server) handleGitHub() http.HandlerFunc {
+	type pushEvent struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		logger := s.logger.WrapTraceContext(ctx)
+
+		event := request.Header.Get("X-GitHub-Event")
+		if event != "push" {
+			logger.Infow("ignoring github event", "event", event)
+			httpx.RespondJSON(writer, map[string]string{"status": "ignored"}, http.StatusOK)
+			return
+		}
+		var push pushEvent
+		if err := json.Unmarshal(webhookx.RawBody(ctx), &push); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "json.Unmarshal()"))
+			return
+		}
+		logger.Infow("received push", "repository", push.Repository.FullName, "ref", push.Ref, "sha", push.After)
+		httpx.RespondJSON(writer, map[string]string{"status": "ok"}, http.StatusOK)
+	}
+}
+
+// handleSend enqueues a webhook, the response carries the delivery id to poll /webhooks/deliveries with
+func (s *server) handleSend(dispatcher *webhookx.Dispatcher) http.HandlerFunc {
+	type sendRequest struct {
+		URL     string                 `json:"url"`
+		Event   string                 `json:"event"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		var send sendRequest
+		if err := json.NewDecoder(request.Body).Decode(&send); err != nil || send.URL == "" {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "url is required"))
+			return
+		}
+		// the delivery client blocks it anyway, a caller learns of a url we won't call now rather than from a dead
+		// delivery
+		target, err := url.Parse(send.URL)
+		if err != nil || target.Scheme != "https" || target.Host == "" {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "url must be an https url"))
+			return
+		}
+		if err := s.allowlist.Check(ctx, target.Hostname()); err != nil {
+			s.logger.WrapTraceContext(ctx).Warnw("webhook url not allowed", "url", send.URL, "err", err)
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "url is not on our allowlist"))
+			return
+		}
+		delivery, err := dispatcher.Enqueue(ctx, send.URL, send.Event, send.Payload)
+		if err != nil {
+			s.logger.WrapTraceContext(ctx).Errorw("dispatcher.Enqueue()", "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		httpx.RespondJSON(writer, delivery, http.StatusAccepted)
+	}
+}
+
+func (s *server) handleInternal() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		var payload map[string]interface{}
+		if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "json.Decode()"))
+			return
+		}
+		s.logger.WrapTraceContext(ctx).Infow("received internal webhook", "type", payload["type"])
+		httpx.RespondJSON(writer, map[string]string{"status": "ok"}, http.StatusOK)
+	}
+}
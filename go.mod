@@ -5,20 +5,30 @@ go 1.16
 require (
 	cloud.google.com/go v0.93.3
 	cloud.google.com/go/firestore v1.5.0
+	cloud.google.com/go/monitoring v0.1.0 // indirect
+	cloud.google.com/go/pubsub v1.15.0
 	cloud.google.com/go/trace v0.1.0 // indirect
 	github.com/GoogleCloudPlatform/opentelemetry-operations-go v1.0.0-RC2.0.20210816152642-29dd0bfc39f0
+	github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric v0.22.0
 	github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace v1.0.0-RC2.0.20210816152642-29dd0bfc39f0
 	github.com/blendle/zapdriver v1.3.1
 	github.com/brianvoe/gofakeit/v6 v6.7.1
+	github.com/felixge/httpsnoop v1.0.2
+	github.com/getkin/kin-openapi v0.76.0
 	github.com/gorilla/mux v1.8.0
+	github.com/graph-gophers/graphql-go v1.1.0
 	go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux v0.22.0
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.22.0
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.22.0
 	go.opentelemetry.io/otel v1.0.0-RC2
+	go.opentelemetry.io/otel/metric v0.22.0
 	go.opentelemetry.io/otel/sdk v1.0.0-RC2
+	go.opentelemetry.io/otel/sdk/metric v0.22.0
 	go.opentelemetry.io/otel/trace v1.0.0-RC2
 	go.uber.org/zap v1.19.0
+	golang.org/x/oauth2 v0.0.0-20210805134026-6f1e6394065a
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/text v0.3.6
 	google.golang.org/api v0.54.0
 	google.golang.org/grpc v1.39.1
 )
@@ -0,0 +1,361 @@
+package abuse
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/abuse"
+
+// defaultLimit is how many requests a subject of a kind without WithLimit makes per window before it is banned
+const defaultLimit = 600
+
+// Ban keeps a subject out until it expires
+type Ban struct {
+	// Kind is what the subject is, eg ip or identity
+	Kind    string
+	Subject string
+	Until   time.Time
+	// Requests is what the subject made within a window when it was banned
+	Requests int
+	Reason   string
+}
+
+// Store shares bans between instances, a subject banned by one is turned away by all of them once they synced
+type Store interface {
+	Ban(ctx context.Context, ban Ban) error
+	// Active returns the bans that haven't expired at now
+	Active(ctx context.Context, now time.Time) ([]Ban, error)
+}
+
+type memoryStore struct {
+	mu   sync.Mutex
+	bans map[string]Ban
+}
+
+// NewMemory keeps bans on this instance, only good for a single instance or local development
+func NewMemory() Store {
+	return &memoryStore{bans: map[string]Ban{}}
+}
+
+func (m *memoryStore) Ban(ctx context.Context, ban Ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans[ban.Kind+":"+ban.Subject] = ban
+	return nil
+}
+
+func (m *memoryStore) Active(ctx context.Context, now time.Time) ([]Ban, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var active []Ban
+	for k, ban := range m.bans {
+		if !now.Before(ban.Until) {
+			delete(m.bans, k)
+			continue
+		}
+		active = append(active, ban)
+	}
+	return active, nil
+}
+
+// window counts the requests of a subject in a sliding window, approximated from the count of the fixed window
+// before the current one weighted by how much of it still overlaps
+type window struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+func (w *window) add(now time.Time, size time.Duration) int {
+	switch elapsed := now.Sub(w.start); {
+	case elapsed >= 2*size:
+		w.start, w.previous, w.current = now.Truncate(size), 0, 0
+	case elapsed >= size:
+		w.start, w.previous, w.current = w.start.Add(size), w.current, 0
+	}
+	w.current++
+	overlap := 1 - float64(now.Sub(w.start))/float64(size)
+	return int(math.Round(float64(w.previous)*overlap)) + w.current
+}
+
+// Guard bans subjects, client ips or caller identities, that make more requests in a window than their kind is
+// allowed, for a while. requests are counted on every instance on its own and bans are shared through a Store, so a
+// subject spreading a burst over many instances gets further before it is banned. every ban, and the requests a ban
+// turns away, the first and every 100th, are logged with a security label, the label to export our abuse logs by
+type Guard struct {
+	logger *logx.AppLogger
+	store  Store
+	size   time.Duration
+	banFor time.Duration
+	limits map[string]int
+	exempt func(request *http.Request) bool
+	ip     func(request *http.Request) string
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]*window
+	bans      map[string]Ban
+	blocked   map[string]int
+	lastSweep time.Time
+
+	requests metric.Int64Counter
+	banned   metric.Int64Counter
+}
+
+type Option func(g *Guard)
+
+// WithWindow counts requests over d, defaults to a minute
+func WithWindow(d time.Duration) Option {
+	return func(g *Guard) {
+		g.size = d
+	}
+}
+
+// WithLimit bans a subject of kind once it makes more than n requests in a window, subjects of other kinds get 600
+func WithLimit(kind string, n int) Option {
+	return func(g *Guard) {
+		g.limits[kind] = n
+	}
+}
+
+// WithBanDuration keeps a banned subject out for d, defaults to 10 minutes
+func WithBanDuration(d time.Duration) Option {
+	return func(g *Guard) {
+		g.banFor = d
+	}
+}
+
+// WithExempt leaves the requests exempt returns true for alone, eg our own health checks or trusted callers
+func WithExempt(exempt func(request *http.Request) bool) Option {
+	return func(g *Guard) {
+		g.exempt = exempt
+	}
+}
+
+// WithProxyHops has ClientIP skip the addresses n proxies of ours append to X-Forwarded-For, see ForwardedIP
+func WithProxyHops(n int) Option {
+	return func(g *Guard) {
+		g.ip = ForwardedIP(n)
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through windows
+func WithClock(now func() time.Time) Option {
+	return func(g *Guard) {
+		g.now = now
+	}
+}
+
+// New shares its bans through store, see Firestore
+func New(logger *logx.AppLogger, store Store, opts ...Option) *Guard {
+	meter := metric.Must(global.Meter(instrumentationName))
+	g := &Guard{
+		logger:  logger,
+		store:   store,
+		size:    time.Minute,
+		banFor:  10 * time.Minute,
+		limits:  map[string]int{},
+		exempt:  func(*http.Request) bool { return false },
+		ip:      ForwardedIP(0),
+		now:     time.Now,
+		windows: map[string]*window{},
+		bans:    map[string]Ban{},
+		blocked: map[string]int{},
+		requests: meter.NewInt64Counter("abuse.requests",
+			metric.WithDescription("requests checked by kind of subject and outcome, allowed, banned or blocked by a ban")),
+		banned: meter.NewInt64Counter("abuse.bans",
+			metric.WithDescription("subjects banned by this instance by kind")),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// ForwardedIP is the client ip of a request as cloud run saw it. the google front end appends the address it was
+// called from to X-Forwarded-For, whatever a client put in front of it is theirs to forge. hops is how many proxies
+// of ours append to it after that, 0 when cloud run is called directly, 1 behind an external load balancer
+func ForwardedIP(hops int) func(request *http.Request) string {
+	return func(request *http.Request) string {
+		forwarded := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+		if i := len(forwarded) - 1 - hops; i >= 0 {
+			if ip := strings.TrimSpace(forwarded[i]); ip != "" {
+				return ip
+			}
+		}
+		return request.RemoteAddr
+	}
+}
+
+// ClientIP is the client ip of request behind WithProxyHops proxies, the subject of the ip kind
+func (g *Guard) ClientIP(request *http.Request) string {
+	return g.ip(request)
+}
+
+// Middleware counts every request against the subject of kind subject returns for it, requests it returns nothing
+// for pass through. a subject over its limit is banned, its requests get a 429 with a Retry-After of when the ban
+// ends. count identities after authentication, a token that wasn't verified lets anyone get someone else banned
+func (g *Guard) Middleware(kind string, subject func(request *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if g.exempt(request) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			s := subject(request)
+			if s == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			ctx := request.Context()
+			ban, blocked := g.check(kind, s)
+			switch {
+			case ban == nil:
+				g.requests.Add(ctx, 1, attribute.String("kind", kind), attribute.String("outcome", "allowed"))
+				next.ServeHTTP(writer, request)
+				return
+			case blocked == 0:
+				g.requests.Add(ctx, 1, attribute.String("kind", kind), attribute.String("outcome", "banned"))
+				g.banned.Add(ctx, 1, attribute.String("kind", kind))
+				g.log(ctx, request, "ban", ban, 0)
+				// the ban holds on this instance already, the store only spreads it to the others
+				storeCtx, cancel := context.WithTimeout(ctxutil.Detach(ctx), 2*time.Second)
+				err := g.store.Ban(storeCtx, *ban)
+				cancel()
+				if err != nil {
+					g.logger.WrapTraceContext(ctx).Warnw("sharing a ban, it only holds on this instance", "kind", kind, "subject", s, "err", err)
+				}
+			default:
+				g.requests.Add(ctx, 1, attribute.String("kind", kind), attribute.String("outcome", "blocked"))
+				if blocked == 1 || blocked%100 == 0 {
+					g.log(ctx, request, "blocked", ban, blocked)
+				}
+			}
+
+			retryAfter := int64(math.Ceil(ban.Until.Sub(g.now()).Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			writer.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{
+				Code:    "temporarily_blocked",
+				Message: "too many requests, retry after the Retry-After header",
+			}, http.StatusTooManyRequests)
+		})
+	}
+}
+
+// check counts a request of subject and returns the ban it is under along with how many requests it blocked, none
+// when the request is the one that got it banned
+func (g *Guard) check(kind, subject string) (*Ban, int) {
+	now := g.now()
+	key := kind + ":" + subject
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+	if ban, ok := g.bans[key]; ok && now.Before(ban.Until) {
+		g.blocked[key]++
+		return &ban, g.blocked[key]
+	}
+	w, ok := g.windows[key]
+	if !ok {
+		w = &window{start: now.Truncate(g.size)}
+		g.windows[key] = w
+	}
+	limit, ok := g.limits[kind]
+	if !ok {
+		limit = defaultLimit
+	}
+	count := w.add(now, g.size)
+	if count <= limit {
+		return nil, 0
+	}
+	ban := Ban{
+		Kind:     kind,
+		Subject:  subject,
+		Until:    now.Add(g.banFor),
+		Requests: count,
+		Reason:   fmt.Sprintf("%d requests within %s, the limit is %d", count, g.size, limit),
+	}
+	g.bans[key] = ban
+	delete(g.windows, key)
+	return &ban, 0
+}
+
+// sweep forgets windows and bans that ended, at most once a window, g.mu is held
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.size {
+		return
+	}
+	g.lastSweep = now
+	for key, w := range g.windows {
+		if now.Sub(w.start) >= 2*g.size {
+			delete(g.windows, key)
+		}
+	}
+	for key, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, key)
+			delete(g.blocked, key)
+		}
+	}
+}
+
+// Sync picks up the bans other instances shared, run it every few seconds with serverx.WithBackground
+func (g *Guard) Sync(ctx context.Context) error {
+	active, err := g.store.Active(ctx, g.now())
+	if err != nil {
+		return fmt.Errorf("g.store.Active(): %v", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, ban := range active {
+		key := ban.Kind + ":" + ban.Subject
+		if existing, ok := g.bans[key]; !ok || existing.Until.Before(ban.Until) {
+			g.bans[key] = ban
+		}
+	}
+	return nil
+}
+
+// log writes a security event, labeled security=abuse with the request in its httpRequest so a log sink or log based
+// metric can pick them out, eg to feed a cloud armor deny list
+func (g *Guard) log(ctx context.Context, request *http.Request, event string, ban *Ban, blocked int) {
+	logger := g.logger.WrapTraceContext(ctx)
+	fields := []interface{}{
+		zapdriver.Label("security", "abuse"),
+		zapdriver.HTTP(&zapdriver.HTTPPayload{
+			RequestMethod: request.Method,
+			RequestURL:    request.URL.String(),
+			Status:        http.StatusTooManyRequests,
+			UserAgent:     request.UserAgent(),
+			RemoteIP:      g.ip(request),
+			Referer:       request.Referer(),
+			Protocol:      request.Proto,
+		}),
+		"event", event,
+		"kind", ban.Kind,
+		"subject", ban.Subject,
+		"until", ban.Until.UTC().Format(time.RFC3339),
+	}
+	if event == "ban" {
+		logger.Warnw("subject banned", append(fields, "requests", ban.Requests, "reason", ban.Reason)...)
+		return
+	}
+	logger.Infow("requests of a banned subject blocked", append(fields, "blocked_requests", blocked)...)
+}
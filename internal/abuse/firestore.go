@@ -0,0 +1,55 @@
+package abuse
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// banDoc is how a ban is stored, a firestore ttl policy on until deletes the ones that ended
+type banDoc struct {
+	Kind     string    `firestore:"kind"`
+	Subject  string    `firestore:"subject"`
+	Until    time.Time `firestore:"until"`
+	Requests int       `firestore:"requests"`
+	Reason   string    `firestore:"reason"`
+	Banned   time.Time `firestore:"banned,serverTimestamp"`
+}
+
+type firestoreStore struct {
+	collection *firestore.CollectionRef
+}
+
+// Firestore keeps a document per banned subject in collection, subjects are hashed into document ids since an ip
+// of v6 or an email isn't one. a subject banned again replaces its ban
+func Firestore(client *firestore.Client, collection string) Store {
+	return &firestoreStore{collection: client.Collection(collection)}
+}
+
+func (f *firestoreStore) Ban(ctx context.Context, ban Ban) error {
+	sum := sha256.Sum256([]byte(ban.Kind + ":" + ban.Subject))
+	doc := &banDoc{Kind: ban.Kind, Subject: ban.Subject, Until: ban.Until, Requests: ban.Requests, Reason: ban.Reason}
+	if _, err := f.collection.Doc(hex.EncodeToString(sum[:])).Set(ctx, doc); err != nil {
+		return fmt.Errorf("Set(): %v", err)
+	}
+	return nil
+}
+
+func (f *firestoreStore) Active(ctx context.Context, now time.Time) ([]Ban, error) {
+	snapshots, err := f.collection.Where("until", ">", now).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("GetAll(): %v", err)
+	}
+	bans := make([]Ban, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var doc banDoc
+		if err := snapshot.DataTo(&doc); err != nil {
+			return nil, fmt.Errorf("snapshot.DataTo(): %v", err)
+		}
+		bans = append(bans, Ban{Kind: doc.Kind, Subject: doc.Subject, Until: doc.Until, Requests: doc.Requests, Reason: doc.Reason})
+	}
+	return bans, nil
+}
@@ -0,0 +1,151 @@
+package authx
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"google.golang.org/api/idtoken"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// claimsKey shows who called and for what in a ctxval.Dump, leaving the raw token out
+var claimsKey = ctxval.New("authx.claims", ctxval.WithFormat(func(v interface{}) string {
+	c := v.(*Claims)
+	return fmt.Sprintf("subject=%s email=%s audience=%s expires=%s", c.Subject, c.Email, c.Audience, c.Expires.Format(time.RFC3339))
+}))
+
+// Claims is the subset of a google signed identity token that our handlers care about
+type Claims struct {
+	Subject  string
+	Email    string
+	Audience string
+	Issuer   string
+	Expires  time.Time
+	Raw      map[string]interface{}
+}
+
+// ClaimsFromContext returns the verified caller identity, only present behind Verifier.Middleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := claimsKey.Value(ctx)
+	if !ok {
+		return nil, false
+	}
+	return c.(*Claims), true
+}
+
+func WithClaims(ctx context.Context, c *Claims) context.Context {
+	return claimsKey.With(ctx, c)
+}
+
+// Verifier validates google signed identity tokens, the same tokens cloud run's own IAM invoker check uses
+type Verifier struct {
+	validator *idtoken.Validator
+	audience  string
+	allowed   map[string]bool
+}
+
+type Option func(v *Verifier)
+
+// WithAllowedEmails restricts callers to the given service account or user emails
+func WithAllowedEmails(emails ...string) Option {
+	return func(v *Verifier) {
+		for _, email := range emails {
+			v.allowed[strings.ToLower(email)] = true
+		}
+	}
+}
+
+func NewVerifier(ctx context.Context, audience string, opts ...Option) (*Verifier, error) {
+	validator, err := idtoken.NewValidator(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("idtoken.NewValidator(): %v", err)
+	}
+	v := &Verifier{validator: validator, audience: audience, allowed: map[string]bool{}}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// Verify validates a raw bearer token and returns the callers claims
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	payload, err := v.validator.Validate(ctx, token, v.audience)
+	if err != nil {
+		return nil, fmt.Errorf("v.validator.Validate(): %v", err)
+	}
+	c := &Claims{
+		Subject:  payload.Subject,
+		Audience: payload.Audience,
+		Issuer:   payload.Issuer,
+		Expires:  time.Unix(payload.Expires, 0),
+		Raw:      payload.Claims,
+	}
+	if email, ok := payload.Claims["email"].(string); ok {
+		c.Email = email
+	}
+	if len(v.allowed) > 0 && !v.allowed[strings.ToLower(c.Email)] {
+		return nil, fmt.Errorf("caller %q is not allowed", c.Email)
+	}
+	return c, nil
+}
+
+// Middleware rejects any request without a valid "Authorization: Bearer <token>" header
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token := BearerToken(request)
+		if token == "" {
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		claims, err := v.Verify(request.Context(), token)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(WithClaims(request.Context(), claims)))
+	})
+}
+
+// PeekClaims reads the claims of a request's bearer token without verifying it, anyone can put anything in there. it
+// is only for cheap decisions ahead of Middleware that Middleware enforces anyway, eg the priority a caller is queued
+// with, a forged token only gets its request to a 403 sooner
+func PeekClaims(r *http.Request) (*Claims, bool) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, false
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(decoded, &raw); err != nil {
+		return nil, false
+	}
+	c := &Claims{Raw: raw}
+	c.Subject, _ = raw["sub"].(string)
+	c.Email, _ = raw["email"].(string)
+	c.Audience, _ = raw["aud"].(string)
+	c.Issuer, _ = raw["iss"].(string)
+	if exp, ok := raw["exp"].(float64); ok {
+		c.Expires = time.Unix(int64(exp), 0)
+	}
+	return c, true
+}
+
+// BearerToken extracts the token from the Authorization header, an empty string is returned if there is none
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
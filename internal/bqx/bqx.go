@@ -0,0 +1,117 @@
+package bqx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/bigquery/v2"
+	"strings"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/bqx"
+
+// maxInsertRows is the most rows bigquery recommends streaming in a single insertAll request
+const maxInsertRows = 500
+
+// Table is a bigquery table rows are streamed into
+type Table struct {
+	Project string
+	Dataset string
+	Table   string
+}
+
+// InsertError is a streaming insert bigquery rejected rows of, nothing of the request was written
+type InsertError struct {
+	Table Table
+	// Rows are the reasons by the index of the row within the request
+	Rows map[int64]string
+}
+
+func (e *InsertError) Error() string {
+	reasons := make([]string, 0, len(e.Rows))
+	for index, reason := range e.Rows {
+		reasons = append(reasons, fmt.Sprintf("row %d: %s", index, reason))
+	}
+	return fmt.Sprintf("bqx: inserting into %s.%s: %s", e.Table.Dataset, e.Table.Table, strings.Join(reasons, "; "))
+}
+
+// InsertSink streams records into table through insertAll, in requests of at most 500 rows, its signature matches
+// httpx.IngestSink. records are sent as their json encoding, so their json tags have to match the columns of the
+// table. insertID names the row of a record for bigquery to drop a second insert of it on a retry, on a best
+// effort basis within about a minute, records it returns no id for may be duplicated by a retry
+func InsertSink(svc *bigquery.Service, table Table, insertID func(record interface{}) string) func(ctx context.Context, records []interface{}) error {
+	tracer := otel.Tracer(instrumentationName)
+	return func(ctx context.Context, records []interface{}) error {
+		for start := 0; start < len(records); start += maxInsertRows {
+			end := start + maxInsertRows
+			if end > len(records) {
+				end = len(records)
+			}
+			if err := insert(ctx, tracer, svc, table, insertID, records[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func insert(ctx context.Context, tracer trace.Tracer, svc *bigquery.Service, table Table, insertID func(record interface{}) string, records []interface{}) (err error) {
+	ctx, span := tracer.Start(ctx, "bqx.insertAll", trace.WithAttributes(
+		attribute.String("bigquery.dataset", table.Dataset),
+		attribute.String("bigquery.table", table.Table),
+		attribute.Int("rows", len(records)),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	rows := make([]*bigquery.TableDataInsertAllRequestRows, 0, len(records))
+	for _, record := range records {
+		row, err := jsonRow(record)
+		if err != nil {
+			return err
+		}
+		if insertID != nil {
+			row.InsertId = insertID(record)
+		}
+		rows = append(rows, row)
+	}
+	resp, err := svc.Tabledata.InsertAll(table.Project, table.Dataset, table.Table, &bigquery.TableDataInsertAllRequest{Rows: rows}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Tabledata.InsertAll(): %w", err)
+	}
+	if len(resp.InsertErrors) > 0 {
+		insertErr := &InsertError{Table: table, Rows: map[int64]string{}}
+		for _, rowErr := range resp.InsertErrors {
+			// rows that are fine themselves are rejected along with the bad ones as "stopped"
+			for _, proto := range rowErr.Errors {
+				if proto.Reason != "stopped" {
+					insertErr.Rows[rowErr.Index] = proto.Message
+				}
+			}
+		}
+		return insertErr
+	}
+	return nil
+}
+
+// jsonRow turns record into the column values of a row through its json encoding
+func jsonRow(record interface{}) (*bigquery.TableDataInsertAllRequestRows, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal(): %v", err)
+	}
+	var values map[string]bigquery.JsonValue
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal(): records must encode to a json object: %v", err)
+	}
+	return &bigquery.TableDataInsertAllRequestRows{Json: values}, nil
+}
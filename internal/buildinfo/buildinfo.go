@@ -0,0 +1,142 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// these can be stamped at build time with
+//
+//	-ldflags "-X github.com/amammay/effectivecloudrun/internal/buildinfo.version=v1.2.3"
+//
+// ko supports ldflags through .ko.yaml, anything left empty is filled in from the embedded module build info
+var (
+	version   string
+	revision  string
+	buildTime string
+)
+
+// Info describes the binary that is currently running
+type Info struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	// Service and ServiceRevision come from the cloud run container contract
+	Service         string `json:"service,omitempty"`
+	ServiceRevision string `json:"service_revision,omitempty"`
+}
+
+var (
+	once sync.Once
+	info Info
+)
+
+// Get resolves our build info once, in order of precedence ldflags, go module build info, ko data
+func Get() Info {
+	once.Do(func() {
+		info = Info{
+			Version:         version,
+			Revision:        revision,
+			BuildTime:       buildTime,
+			GoVersion:       runtime.Version(),
+			Service:         os.Getenv("K_SERVICE"),
+			ServiceRevision: os.Getenv("K_REVISION"),
+		}
+
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			info.Module = bi.Main.Path
+			if info.Version == "" {
+				info.Version = bi.Main.Version
+			}
+			readVCSSettings(bi, &info)
+		}
+
+		if info.Revision == "" {
+			info.Revision = koRevision()
+		}
+		if info.Version == "" {
+			info.Version = "(devel)"
+		}
+	})
+	return info
+}
+
+// koRevision reads the git HEAD that ko copies into the image when kodata/HEAD and kodata/refs are symlinked to .git
+func koRevision() string {
+	dir := os.Getenv("KO_DATA_PATH")
+	if dir == "" {
+		return ""
+	}
+	head, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		// detached head, the file is the commit sha itself
+		return ref
+	}
+	sha, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimPrefix(ref, "ref: ")))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(sha))
+}
+
+// ShortRevision is the first 12 characters of our revision, handy for labels
+func (i Info) ShortRevision() string {
+	if len(i.Revision) > 12 {
+		return i.Revision[:12]
+	}
+	return i.Revision
+}
+
+// LogFields are zapdriver labels so every log entry can be filtered by version in cloud logging
+func LogFields() []zap.Field {
+	i := Get()
+	fields := []zap.Field{zapdriver.Label("version", i.Version)}
+	if i.Revision != "" {
+		fields = append(fields, zapdriver.Label("revision", i.ShortRevision()))
+	}
+	if i.ServiceRevision != "" {
+		fields = append(fields, zapdriver.Label("cloud_run_revision", i.ServiceRevision))
+	}
+	return fields
+}
+
+// Attributes are otel resource attributes identifying our build on every exported span
+func Attributes() []attribute.KeyValue {
+	i := Get()
+	attrs := []attribute.KeyValue{semconv.ServiceVersionKey.String(i.Version)}
+	if i.Revision != "" {
+		attrs = append(attrs, attribute.String("vcs.revision", i.Revision))
+	}
+	if i.ServiceRevision != "" {
+		attrs = append(attrs, attribute.String("cloud_run.revision", i.ServiceRevision))
+	}
+	return attrs
+}
+
+// Handler serves our build info as json, intended for /version
+func Handler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(Get()); err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
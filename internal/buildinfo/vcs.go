@@ -0,0 +1,24 @@
+//go:build go1.18
+// +build go1.18
+
+package buildinfo
+
+import "runtime/debug"
+
+// readVCSSettings fills in what go1.18 stamps into the binary about the commit it was built from
+func readVCSSettings(bi *debug.BuildInfo, info *Info) {
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Revision == "" {
+				info.Revision = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package buildinfo
+
+import "runtime/debug"
+
+// readVCSSettings has nothing to read before go1.18, stamp the revision with ldflags or ko data instead
+func readVCSSettings(bi *debug.BuildInfo, info *Info) {}
@@ -0,0 +1,306 @@
+package cachex
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/coalesce"
+	"github.com/amammay/effectivecloudrun/internal/limits"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/cachex"
+
+// entryOverhead approximates the bookkeeping each entry costs us, list element, map bucket and entry struct
+const entryOverhead = 128
+
+// Sizer lets cached values report how many bytes they hold, anything else is charged defaultValueSize
+type Sizer interface {
+	Size() int
+}
+
+const defaultValueSize = 256
+
+// FlushFunc receives every live entry when the cache is flushed on shutdown, eg to persist hot keys somewhere durable
+type FlushFunc func(ctx context.Context, key string, value interface{}) error
+
+type entry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// Cache is a per instance LRU bounded by bytes rather than entries, sized off our container memory limit so a busy
+// instance evicts instead of getting oom killed by cloud run
+type Cache struct {
+	name     string
+	capacity int64
+	ttl      time.Duration
+	flush    FlushFunc
+	loads    *coalesce.Group
+	now      func() time.Time
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	used  int64
+
+	lookups   metric.Int64Counter
+	evictions metric.Int64Counter
+	labels    []attribute.KeyValue
+}
+
+type config struct {
+	name          string
+	memoryPercent float64
+	maxBytes      int64
+	ttl           time.Duration
+	flush         FlushFunc
+	loadTimeout   time.Duration
+}
+
+type Option func(c *config)
+
+// WithName labels our metrics
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithMemoryPercent sizes the cache as a percentage of the container memory limit, defaults to 10
+func WithMemoryPercent(percent float64) Option {
+	return func(c *config) {
+		c.memoryPercent = percent
+	}
+}
+
+// WithMaxBytes fixes our capacity, overriding any memory limit based sizing
+func WithMaxBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
+
+// WithTTL expires entries after d, zero keeps them until they are evicted
+func WithTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.ttl = d
+	}
+}
+
+// WithFlush is called for every live entry when Flush runs
+func WithFlush(fn FlushFunc) Option {
+	return func(c *config) {
+		c.flush = fn
+	}
+}
+
+// WithLoadTimeout bounds the loader passed to GetOrLoad, defaults to 10 seconds
+func WithLoadTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.loadTimeout = d
+	}
+}
+
+func New(opts ...Option) (*Cache, error) {
+	cfg := &config{name: "default", memoryPercent: 10, loadTimeout: 10 * time.Second}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	capacity := cfg.maxBytes
+	if capacity <= 0 {
+		capacity = int64(float64(limits.Memory()) * cfg.memoryPercent / 100)
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("cachex %s: unable to size cache from memory limit %d", cfg.name, limits.Memory())
+	}
+
+	c := &Cache{
+		name:     cfg.name,
+		capacity: capacity,
+		ttl:      cfg.ttl,
+		flush:    cfg.flush,
+		loads:    coalesce.New("cachex."+cfg.name, cfg.loadTimeout),
+		now:      time.Now,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+		labels:   []attribute.KeyValue{attribute.String("cache", cfg.name)},
+	}
+	if err := c.registerMetrics(); err != nil {
+		return nil, fmt.Errorf("c.registerMetrics(): %v", err)
+	}
+	return c, nil
+}
+
+func (c *Cache) registerMetrics() error {
+	meter := global.Meter(instrumentationName)
+	var err error
+	if c.lookups, err = meter.NewInt64Counter("cachex.lookups", metric.WithDescription("cache lookups by result, hit or miss")); err != nil {
+		return err
+	}
+	if c.evictions, err = meter.NewInt64Counter("cachex.evictions", metric.WithDescription("entries evicted by reason")); err != nil {
+		return err
+	}
+	_, err = meter.NewInt64ValueObserver("cachex.bytes", func(ctx context.Context, result metric.Int64ObserverResult) {
+		c.mu.Lock()
+		used := c.used
+		c.mu.Unlock()
+		result.Observe(used, c.labels...)
+	}, metric.WithDescription("estimated bytes held by the cache"), metric.WithUnit("By"))
+	return err
+}
+
+// Capacity is the number of bytes we are allowed to hold
+func (c *Cache) Capacity() int64 {
+	return c.capacity
+}
+
+// Len is the number of entries currently cached
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) Get(ctx context.Context, key string) (interface{}, bool) {
+	c.mu.Lock()
+	value, ok := c.get(ctx, key)
+	c.mu.Unlock()
+
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	c.lookups.Add(ctx, 1, append(c.labels, attribute.String("result", result))...)
+	return value, ok
+}
+
+func (c *Cache) get(ctx context.Context, key string) (interface{}, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && c.now().After(e.expires) {
+		c.removeElement(ctx, el, "expired")
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache) Set(ctx context.Context, key string, value interface{}) {
+	size := int64(len(key)+sizeOf(value)) + entryOverhead
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = c.now().Add(c.ttl)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(ctx, el, "replaced")
+	}
+	// a single value bigger than our whole budget would just flush everything else out
+	if size > c.capacity {
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry{key: key, value: value, size: size, expires: expires})
+	c.used += size
+	for c.used > c.capacity {
+		c.removeElement(ctx, c.ll.Back(), "capacity")
+	}
+}
+
+func (c *Cache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(ctx, el, "deleted")
+	}
+}
+
+// Purge drops every entry without handing them to the FlushFunc, for when none of them can be trusted anymore
+func (c *Cache) Purge(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.ll.Front(); el != nil; el = c.ll.Front() {
+		c.removeElement(ctx, el, "deleted")
+	}
+}
+
+// GetOrLoad returns the cached value or calls load, concurrent misses for the same key share a single load
+func (c *Cache) GetOrLoad(ctx context.Context, key string, load func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if value, ok := c.Get(ctx, key); ok {
+		return value, nil
+	}
+	value, _, err := c.loads.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(ctx, key, value)
+		return value, nil
+	})
+	return value, err
+}
+
+func (c *Cache) removeElement(ctx context.Context, el *list.Element, reason string) {
+	e := el.Value.(*entry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.used -= e.size
+	if reason != "replaced" && reason != "deleted" {
+		c.evictions.Add(ctx, 1, append(c.labels, attribute.String("reason", reason))...)
+	}
+}
+
+// Flush hands every live entry to the FlushFunc, most recently used first, and empties the cache. the signature
+// matches serverx.Server.OnShutdown so an instance being scaled in gets a chance to persist what it learned
+func (c *Cache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	entries := make([]*entry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*entry))
+	}
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+	c.used = 0
+	c.mu.Unlock()
+
+	if c.flush == nil {
+		return nil
+	}
+	now := c.now()
+	for _, e := range entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("cachex %s: flush interrupted: %w", c.name, err)
+		}
+		if err := c.flush(ctx, e.key, e.value); err != nil {
+			return fmt.Errorf("cachex %s: flush(%s): %w", c.name, e.key, err)
+		}
+	}
+	return nil
+}
+
+func sizeOf(value interface{}) int {
+	switch v := value.(type) {
+	case Sizer:
+		return v.Size()
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	default:
+		return defaultValueSize
+	}
+}
@@ -0,0 +1,141 @@
+package cachex
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"sync"
+	"time"
+)
+
+// LoadFunc loads the current value of key
+type LoadFunc func(ctx context.Context, key string) (interface{}, error)
+
+// Refresher keeps the hot keys of a cache fresh. keys requested through Get within the last idle period are hot,
+// Refresh reloads all of them, meant to run every interval as a serverx.WithBackground task on an instance with
+// always on cpu. a value older than its max age is reloaded on request instead, which is all that happens once the
+// background task is paused because our cpu is throttled, requests then pay for the reload rather than getting stale
+// values
+type Refresher struct {
+	cache  *Cache
+	load   LoadFunc
+	maxAge time.Duration
+	idle   time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// loaded is when each value was loaded, requested is when each key was last asked for
+	loaded    map[string]time.Time
+	requested map[string]time.Time
+
+	refreshes metric.Int64Counter
+	labels    []attribute.KeyValue
+}
+
+type RefreshOption func(r *Refresher)
+
+// WithIdle stops refreshing keys nobody asked for in d, defaults to 10 times the max age
+func WithIdle(d time.Duration) RefreshOption {
+	return func(r *Refresher) {
+		r.idle = d
+	}
+}
+
+// WithRefreshClock replaces time.Now, for tests stepping through ages
+func WithRefreshClock(now func() time.Time) RefreshOption {
+	return func(r *Refresher) {
+		r.now = now
+	}
+}
+
+// NewRefresher serves values of cache loaded by load that are at most maxAge old. refresh in the background at a
+// fraction of maxAge, so a value gets reloaded in time while a run or two is slow or skipped
+func NewRefresher(cache *Cache, load LoadFunc, maxAge time.Duration, opts ...RefreshOption) *Refresher {
+	r := &Refresher{
+		cache:     cache,
+		load:      load,
+		maxAge:    maxAge,
+		idle:      10 * maxAge,
+		now:       time.Now,
+		loaded:    map[string]time.Time{},
+		requested: map[string]time.Time{},
+		refreshes: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("cachex.refreshes",
+			metric.WithDescription("values reloaded by mode, background or request, and outcome")),
+		labels: []attribute.KeyValue{attribute.String("cache", cache.name)},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Get returns the value of key, loading it on request when it isn't cached or is older than our max age. concurrent
+// requests for the same key share a single load
+func (r *Refresher) Get(ctx context.Context, key string) (interface{}, error) {
+	now := r.now()
+	r.mu.Lock()
+	r.requested[key] = now
+	loaded, ok := r.loaded[key]
+	r.mu.Unlock()
+
+	if ok && now.Sub(loaded) <= r.maxAge {
+		if value, ok := r.cache.Get(ctx, key); ok {
+			return value, nil
+		}
+	}
+	value, _, err := r.cache.loads.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return r.reload(ctx, key, "request")
+	})
+	return value, err
+}
+
+// Refresh reloads every hot key and forgets idle ones, it returns the first error and carries on past it. its
+// signature matches serverx.WithBackground
+func (r *Refresher) Refresh(ctx context.Context) error {
+	now := r.now()
+	var keys []string
+	r.mu.Lock()
+	for key, requested := range r.requested {
+		if now.Sub(requested) > r.idle {
+			delete(r.requested, key)
+			delete(r.loaded, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, _, err := r.cache.loads.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+			return r.reload(ctx, key, "background")
+		})
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("reloading %s: %v", key, err)
+		}
+	}
+	return firstErr
+}
+
+// reload loads key and caches its value, a failure keeps the value we had
+func (r *Refresher) reload(ctx context.Context, key, mode string) (interface{}, error) {
+	value, err := r.load(ctx, key)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	r.refreshes.Add(ctx, 1, append(r.labels, attribute.String("mode", mode), attribute.String("outcome", outcome))...)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.Set(ctx, key, value)
+	r.mu.Lock()
+	r.loaded[key] = r.now()
+	r.mu.Unlock()
+	return value, nil
+}
@@ -0,0 +1,173 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/checks"
+
+// ErrPending is reported until a checker has completed its first run
+var ErrPending = errors.New("checks: first check has not completed")
+
+// Func checks a single dependency
+type Func func(ctx context.Context) error
+
+var (
+	meter    = metric.Must(global.Meter(instrumentationName))
+	duration = meter.NewFloat64ValueRecorder("checks.duration",
+		metric.WithDescription("dependency check latency by outcome"),
+		metric.WithUnit("ms"),
+	)
+
+	registryMu sync.Mutex
+	registry   []*Checker
+	_          = meter.NewInt64ValueObserver("checks.healthy", func(ctx context.Context, result metric.Int64ObserverResult) {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for _, c := range registry {
+			healthy := int64(0)
+			if c.Ready(ctx) == nil {
+				healthy = 1
+			}
+			result.Observe(healthy, attribute.String("check", c.name))
+		}
+	}, metric.WithDescription("1 when the last check of a dependency passed"))
+)
+
+// Checker runs a check on an interval in the background and caches the result, so /readyz answers from memory and
+// a probe storm never turns into load on the dependency itself
+type Checker struct {
+	name     string
+	check    Func
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.RWMutex
+	lastErr error
+	lastRun time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type Option func(c *Checker)
+
+// WithInterval sets how often the check runs, defaults to 10 seconds
+func WithInterval(d time.Duration) Option {
+	return func(c *Checker) {
+		c.interval = d
+	}
+}
+
+// WithTimeout bounds each run of the check, defaults to 2 seconds
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+// New starts checking right away, call Close to stop
+func New(name string, check Func, opts ...Option) *Checker {
+	c := &Checker{
+		name:     name,
+		check:    check,
+		interval: 10 * time.Second,
+		timeout:  2 * time.Second,
+		lastErr:  ErrPending,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+
+	go c.loop()
+	return c
+}
+
+func (c *Checker) Name() string {
+	return c.name
+}
+
+func (c *Checker) loop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.run()
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Checker) run() {
+	// checks run on our own ticker, not for any request
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := c.check(ctx)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), attribute.String("check", c.name), attribute.String("outcome", outcome))
+
+	c.mu.Lock()
+	c.lastErr = err
+	c.lastRun = start
+	c.mu.Unlock()
+}
+
+// Ready returns the cached result of the last check, the signature matches serverx.ReadinessCheck
+func (c *Checker) Ready(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.lastErr != nil {
+		return c.lastErr
+	}
+	// a stuck loop shouldn't keep reporting a stale success forever
+	if stale := 3 * c.interval; time.Since(c.lastRun) > stale {
+		return fmt.Errorf("checks: %s has not completed in %s", c.name, stale)
+	}
+	return nil
+}
+
+// Close stops the background loop, the signature matches serverx.Server.OnShutdown
+func (c *Checker) Close(ctx context.Context) error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+
+	registryMu.Lock()
+	for i, r := range registry {
+		if r == c {
+			registry = append(registry[:i], registry[i+1:]...)
+			break
+		}
+	}
+	registryMu.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+package checks
+
+import (
+	"bufio"
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Firestore does a shallow read of a single document, the document doesn't need to exist, a NotFound still proves
+// our channel and credentials work
+func Firestore(client *firestore.Client, collection, doc string) Func {
+	return func(ctx context.Context) error {
+		_, err := client.Collection(collection).Doc(doc).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("firestore %s/%s: %v", collection, doc, err)
+		}
+		return nil
+	}
+}
+
+// HTTPHead sends a HEAD to url, anything but a 5xx means the upstream is up
+func HTTPHead(client *http.Client, url string) Func {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("client.Do(): %v", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("HEAD %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// RedisPing sends a PING to the redis (or memorystore) instance at addr, speaking just enough RESP that we don't need
+// a redis client dependency
+func RedisPing(addr string) Func {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("dialer.DialContext(): %v", err)
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+			return fmt.Errorf("conn.Write(): %v", err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reader.ReadString(): %v", err)
+		}
+		if reply := strings.TrimSpace(line); reply != "+PONG" {
+			return fmt.Errorf("redis %s: unexpected reply %q", addr, reply)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,159 @@
+package clientx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrHostNotAllowed matches every BlockedError with errors.Is
+var ErrHostNotAllowed = errors.New("clientx: host not on allowlist")
+
+var egressBlocked = meter.NewInt64Counter("clientx.egress.blocked", metric.WithDescription("outbound requests blocked by the allowlist by host"))
+
+// metadataHosts are always allowed, without the metadata server we can't get credentials or our project id
+var metadataHosts = []string{"metadata.google.internal", "metadata", "169.254.169.254"}
+
+// BlockedError is returned for a request to a host that isn't on the allowlist
+type BlockedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("clientx: request to %s blocked: %s", e.Host, e.Reason)
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrHostNotAllowed
+}
+
+// Allowlist decides which hosts we are allowed to talk to. entries are exact hostnames, wildcard suffixes such as
+// "*.googleapis.com", ip addresses or CIDR ranges. hostnames that don't match a name entry are resolved and every
+// address has to fall into an allowed range
+type Allowlist struct {
+	hosts    map[string]bool
+	suffixes []string
+	nets     []*net.IPNet
+	logger   *logx.AppLogger
+	resolver *net.Resolver
+}
+
+// NewAllowlist parses entries, logger receives a security event for every blocked request and may be nil
+func NewAllowlist(logger *logx.AppLogger, entries ...string) (*Allowlist, error) {
+	a := &Allowlist{hosts: map[string]bool{}, logger: logger, resolver: net.DefaultResolver}
+	for _, host := range metadataHosts {
+		a.hosts[host] = true
+	}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "*."):
+			a.suffixes = append(a.suffixes, entry[1:])
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("net.ParseCIDR(%s): %v", entry, err)
+			}
+			a.nets = append(a.nets, ipNet)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			a.hosts[entry] = true
+		}
+	}
+	return a, nil
+}
+
+// Check returns a BlockedError when host isn't allowed
+func (a *Allowlist) Check(ctx context.Context, host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if a.hosts[host] {
+		return nil
+	}
+	for _, suffix := range a.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return nil
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if a.allowedIP(ip) {
+			return nil
+		}
+		return &BlockedError{Host: host, Reason: "address not in an allowed range"}
+	}
+	if len(a.nets) == 0 {
+		return &BlockedError{Host: host, Reason: "host not allowed"}
+	}
+	addrs, err := a.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return &BlockedError{Host: host, Reason: fmt.Sprintf("unable to resolve: %v", err)}
+	}
+	for _, addr := range addrs {
+		if !a.allowedIP(addr.IP) {
+			return &BlockedError{Host: host, Reason: fmt.Sprintf("resolves to %s which is not in an allowed range", addr.IP)}
+		}
+	}
+	return nil
+}
+
+func (a *Allowlist) allowedIP(ip net.IP) bool {
+	if ip.Equal(net.ParseIP("169.254.169.254")) {
+		return true
+	}
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAllowlist blocks requests, including redirects, to any host not on allowlist before they reach retries or the
+// network. resolving names here doesn't protect against dns rebinding, pair it with vpc egress controls when running
+// untrusted code
+func WithAllowlist(allowlist *Allowlist) Option {
+	return func(c *config) {
+		c.allowlist = allowlist
+	}
+}
+
+type allowlistTransport struct {
+	next      http.RoundTripper
+	allowlist *Allowlist
+}
+
+func (a *allowlistTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Hostname()
+	if err := a.allowlist.Check(ctx, host); err != nil {
+		egressBlocked.Add(ctx, 1, attribute.String("host", host))
+		if a.allowlist.logger != nil {
+			a.allowlist.logger.WrapTraceContext(ctx).Warnw("egress blocked",
+				"security_event", "egress_blocked",
+				"host", host,
+				"method", req.Method,
+				"path", PathTemplate(req.URL.Path),
+				"err", err,
+			)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return a.next.RoundTrip(req)
+}
@@ -0,0 +1,167 @@
+package clientx
+
+import (
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	egressRequests = meter.NewInt64Counter("clientx.egress.requests", metric.WithDescription("outbound requests by host and status class"))
+	egressLatency  = meter.NewFloat64ValueRecorder("clientx.egress.latency",
+		metric.WithDescription("outbound request latency by host until the response body was closed"),
+		metric.WithUnit("ms"),
+	)
+	egressBytes = meter.NewInt64Counter("clientx.egress.bytes",
+		metric.WithDescription("outbound bytes by host and direction"),
+		metric.WithUnit("By"),
+	)
+)
+
+// WithAuditLog logs every outbound attempt as a structured "egress" entry correlated with its trace, so we can audit
+// what a service actually talks to. it sits below tracing and retries, each attempt gets its own entry, written once
+// the response body is closed
+func WithAuditLog(logger *logx.AppLogger) Option {
+	return func(c *config) {
+		c.audit = logger
+	}
+}
+
+type auditTransport struct {
+	next   http.RoundTripper
+	logger *logx.AppLogger
+}
+
+func (a *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := a.next.RoundTrip(req)
+	entry := &egressEntry{
+		logger:  a.logger,
+		req:     req,
+		start:   start,
+		host:    req.URL.Hostname(),
+		sent:    req.ContentLength,
+		pathTpl: PathTemplate(req.URL.Path),
+	}
+	if err != nil {
+		entry.finish(0, err)
+		return nil, err
+	}
+	entry.status = resp.StatusCode
+	// we only know the size and full latency of the response once the caller is done reading it
+	resp.Body = &auditBody{ReadCloser: resp.Body, entry: entry}
+	return resp, nil
+}
+
+type egressEntry struct {
+	logger  *logx.AppLogger
+	req     *http.Request
+	start   time.Time
+	host    string
+	pathTpl string
+	status  int
+	sent    int64
+
+	once sync.Once
+}
+
+func (e *egressEntry) finish(received int64, err error) {
+	e.once.Do(func() {
+		ctx := e.req.Context()
+		latency := time.Since(e.start)
+		class := "error"
+		if e.status > 0 {
+			class = strconv.Itoa(e.status/100) + "xx"
+		}
+		hostLabel := attribute.String("host", e.host)
+		egressRequests.Add(ctx, 1, hostLabel, attribute.String("status_class", class))
+		egressLatency.Record(ctx, float64(latency)/float64(time.Millisecond), hostLabel)
+		if e.sent > 0 {
+			egressBytes.Add(ctx, e.sent, hostLabel, attribute.String("direction", "sent"))
+		}
+		egressBytes.Add(ctx, received, hostLabel, attribute.String("direction", "received"))
+
+		fields := []interface{}{
+			"host", e.host,
+			"method", e.req.Method,
+			"path", e.pathTpl,
+			"status", e.status,
+			"latency", latency.String(),
+			"bytes_sent", e.sent,
+			"bytes_received", received,
+		}
+		if err != nil {
+			fields = append(fields, "err", err)
+		}
+		e.logger.WrapTraceContext(ctx).Infow("egress", fields...)
+	})
+}
+
+type auditBody struct {
+	io.ReadCloser
+	entry *egressEntry
+	read  int64
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.entry.finish(b.read, nil)
+	return err
+}
+
+// PathTemplate replaces path segments that look like ids (numbers, uuids, long hex or random looking tokens) with
+// {id}, keeping our logs and metric labels low cardinality
+func PathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if looksLikeID(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func looksLikeID(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	digits, hex, letters := 0, 0, 0
+	for _, r := range segment {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+			hex++
+		case (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F'):
+			hex++
+			letters++
+		case (r >= 'g' && r <= 'z') || (r >= 'G' && r <= 'Z'):
+			letters++
+		case r == '-' || r == '_':
+		default:
+			return false
+		}
+	}
+	switch {
+	case digits == len(segment):
+		return true
+	// uuids and hashes
+	case hex+strings.Count(segment, "-") == len(segment) && hex >= 16:
+		return true
+	// firestore style auto ids mix digits and letters
+	case len(segment) >= 20 && digits > 0 && letters > 0:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package clientx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maxDrainBytes is how much of an unread body we are willing to read just to keep its connection, past that closing
+// the connection is cheaper
+const maxDrainBytes = 64 << 10
+
+// DrainAndClose reads what is left of body, up to 64KiB, and closes it. the transport only reuses a connection once its
+// body was read to the end and closed, a body that is left unread costs a new dial and one that is never closed leaks
+// the connection along with two goroutines. use it in place of resp.Body.Close(), including on error paths
+func DrainAndClose(body io.ReadCloser) error {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainBytes))
+	return body.Close()
+}
+
+// WithLeakCheck reports response bodies that were garbage collected without being closed, logging the request and the
+// stack of the code that made it before closing the body for it. it costs a finalizer and a stack capture per call,
+// turn it on in development or for a short while when serverx.LeakDetector shows connections piling up
+func WithLeakCheck(logger *logx.AppLogger) Option {
+	return func(c *config) {
+		c.leakCheck = logger
+	}
+}
+
+var leakedBodies = metric.Must(global.Meter(instrumentationName)).NewInt64Counter(
+	"clientx.leaked_bodies",
+	metric.WithDescription("response bodies garbage collected without being closed"),
+)
+
+type leakTransport struct {
+	next   http.RoundTripper
+	logger *logx.AppLogger
+}
+
+func (t *leakTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp, err
+	}
+	body := &trackedBody{
+		ReadCloser: resp.Body,
+		logger:     t.logger,
+		method:     req.Method,
+		host:       req.URL.Host,
+		path:       req.URL.Path,
+		caller:     callers(),
+	}
+	runtime.SetFinalizer(body, (*trackedBody).leaked)
+	// the transport keeps the response it returned around for as long as the connection is busy, our caller gets a copy
+	// so the only references to body are theirs
+	tracked := *resp
+	tracked.Body = body
+	return &tracked, nil
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	closed int32
+
+	logger *logx.AppLogger
+	method string
+	host   string
+	path   string
+	caller []string
+}
+
+func (b *trackedBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		runtime.SetFinalizer(b, nil)
+	}
+	return b.ReadCloser.Close()
+}
+
+// leaked runs as our finalizer, nobody holds the body anymore so closing it ourselves is safe
+func (b *trackedBody) leaked() {
+	if atomic.LoadInt32(&b.closed) == 1 {
+		return
+	}
+	b.ReadCloser.Close()
+	// the request that leaked its body is long gone
+	leakedBodies.Add(context.Background(), 1, attribute.String("host", b.host))
+	b.logger.Sugar().Warnw("response body was never closed, use clientx.DrainAndClose",
+		"method", b.method,
+		"host", b.host,
+		"path", b.path,
+		"caller", b.caller,
+	)
+}
+
+// callers is the stack that made our request, without the frames of net/http, otel and our own transports
+func callers() []string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var stack []string
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "net/http.") &&
+			!strings.Contains(frame.Function, "/internal/clientx.") &&
+			!strings.HasPrefix(frame.Function, "go.opentelemetry.io/") {
+			stack = append(stack, frame.Function+" "+frame.File+":"+strconv.Itoa(frame.Line))
+		}
+		if !more || len(stack) == 5 {
+			return stack
+		}
+	}
+}
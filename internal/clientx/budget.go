@@ -0,0 +1,61 @@
+package clientx
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget is a token bucket shared across calls, every request deposits ratio tokens and every retry withdraws
+// one. a ratio of 0.1 allows retries to add at most 10% extra load on top of MinPerSecond retries per second
+type RetryBudget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	maxTokens    float64
+	tokens       float64
+	last         time.Time
+}
+
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	maxTokens := float64(minPerSecond) * 10
+	if maxTokens < 10 {
+		maxTokens = 10
+	}
+	return &RetryBudget{
+		ratio:        ratio,
+		minPerSecond: float64(minPerSecond),
+		maxTokens:    maxTokens,
+		tokens:       float64(minPerSecond),
+		last:         time.Now(),
+	}
+}
+
+func (b *RetryBudget) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens += elapsed * b.minPerSecond
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens += b.ratio
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
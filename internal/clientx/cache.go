@@ -0,0 +1,261 @@
+package clientx
+
+import (
+	"bytes"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCachedBody is the largest response body we keep, anything bigger is passed through as it streams in
+const maxCachedBody = 1 << 20
+
+var cacheRequests = meter.NewInt64Counter("clientx.cache.requests", metric.WithDescription("cacheable requests by how the response cache answered them"))
+
+// WithResponseCache keeps GET responses in cache for as long as the Cache-Control or Expires of the upstream allows,
+// and revalidates stale ones carrying an ETag or Last-Modified with a conditional request. responses marked no-store
+// or private, varying on anything but Accept and Authorization, or bigger than a megabyte are never stored. a hit
+// never reaches the upstream, so it doesn't show up in WithAuditLog either, it is reported on the access log entry
+// of the request we serve through httpx.RecordCacheLookup
+func WithResponseCache(cache *cachex.Cache) Option {
+	return func(c *config) {
+		c.cache = cache
+	}
+}
+
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	// date is when the upstream produced the response, our receive time minus its Age
+	date time.Time
+	// fresh is how long after date the response may be used without asking the upstream, zero means always ask
+	fresh time.Duration
+}
+
+func (r *cachedResponse) Size() int {
+	size := len(r.body)
+	for k, v := range r.header {
+		size += len(k)
+		for _, s := range v {
+			size += len(s)
+		}
+	}
+	return size
+}
+
+// response builds a response to req from r, the Age header tells the caller how old it is
+func (r *cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := r.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(r.date).Seconds())))
+	return &http.Response{
+		Status:        strconv.Itoa(r.status) + " " + http.StatusText(r.status),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+		Request:       req,
+	}
+}
+
+type cacheTransport struct {
+	next  http.RoundTripper
+	cache *cachex.Cache
+	now   func() time.Time
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a caller sending its own validators manages caching itself
+	if req.Method != http.MethodGet || (req.Body != nil && req.Body != http.NoBody) ||
+		req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return t.next.RoundTrip(req)
+	}
+	directives := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	key := "response:" + coalesceKey(req)
+	v, ok := t.cache.Get(ctx, key)
+	if !ok {
+		resp, filled, err := t.fetch(req, key)
+		t.record(req, "miss", false, false, filled)
+		return resp, err
+	}
+
+	cached := v.(*cachedResponse)
+	_, noCache := directives["no-cache"]
+	if !noCache && t.now().Sub(cached.date) < cached.fresh {
+		t.record(req, "hit", true, false, 0)
+		return cached.response(req, t.now()), nil
+	}
+	etag, lastModified := cached.header.Get("ETag"), cached.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		resp, filled, err := t.fetch(req, key)
+		t.record(req, "stale", false, false, filled)
+		return resp, err
+	}
+
+	conditional := req.Clone(ctx)
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := t.next.RoundTrip(conditional)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		resp.Request = req
+		resp, filled, err := t.store(resp, key)
+		t.record(req, "changed", false, false, filled)
+		return resp, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+
+	// the 304 carries the headers that changed, usually a new Date and Cache-Control
+	updated := &cachedResponse{status: cached.status, header: cached.header.Clone(), body: cached.body}
+	for k, v := range resp.Header {
+		updated.header[k] = v
+	}
+	updated.date, updated.fresh = freshness(updated.header, t.now())
+	t.cache.Set(ctx, key, updated)
+	t.record(req, "revalidated", true, true, 0)
+	return updated.response(req, t.now()), nil
+}
+
+// fetch sends req to the upstream and stores what it gets back when it may
+func (t *cacheTransport) fetch(req *http.Request, key string) (*http.Response, int64, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t.store(resp, key)
+}
+
+// store keeps resp under key when it is cacheable, returning a response with a body the caller can still read and
+// how many bytes we stored
+func (t *cacheTransport) store(resp *http.Response, key string) (*http.Response, int64, error) {
+	if !cacheable(resp) {
+		return resp, 0, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	if len(body) > maxCachedBody {
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return resp, 0, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	cached := &cachedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	cached.date, cached.fresh = freshness(resp.Header, t.now())
+	t.cache.Set(resp.Request.Context(), key, cached)
+	return resp, int64(cached.Size()), nil
+}
+
+func (t *cacheTransport) record(req *http.Request, result string, hit, validated bool, filled int64) {
+	ctx := req.Context()
+	cacheRequests.Add(ctx, 1, attribute.String("host", req.URL.Hostname()), attribute.String("result", result))
+	httpx.RecordCacheLookup(ctx, hit, validated, filled)
+}
+
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// cacheable is whether we may store resp at all, a response without freshness is only worth keeping with a validator
+func cacheable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	directives := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := directives[d]; ok {
+			return false
+		}
+	}
+	for _, vary := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			// coalesceKey already tells responses to different keyedHeaders apart
+			switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+			case "", "Accept", "Accept-Language", "Authorization", "Cookie", "X-Tenant-Id", "Accept-Encoding":
+			default:
+				return false
+			}
+		}
+	}
+	if _, fresh := freshness(resp.Header, time.Now()); fresh > 0 {
+		return true
+	}
+	return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshness returns when the response of header was produced and for how long it stays fresh after that, s-maxage
+// wins over max-age as we share responses between our callers, which win over Expires
+func freshness(header http.Header, now time.Time) (time.Time, time.Duration) {
+	date := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		date = now.Add(-time.Duration(age) * time.Second)
+	}
+
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := directives["no-cache"]; ok {
+		return date, 0
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return date, 0
+			}
+			return date, time.Duration(seconds) * time.Second
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		// Expires is relative to the upstream's clock, measure it from its Date where we have one
+		origin := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			origin = d
+		}
+		if fresh := expires.Sub(origin); fresh > 0 {
+			return date, fresh
+		}
+	}
+	return date, 0
+}
+
+// parseCacheControl splits a Cache-Control header into its directives, lowercased, with their unquoted values
+func parseCacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return directives
+}
@@ -0,0 +1,257 @@
+package clientx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"github.com/amammay/effectivecloudrun/internal/coalesce"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Middleware decorates the transport of our client, the first middleware added is the outermost
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// Client is a thin wrapper around http.Client for talking to a single upstream, it layers retries and tracing onto
+// the transport so call sites only deal with request/response data
+type Client struct {
+	httpClient       *http.Client
+	baseURL          string
+	maxResponseBytes int64
+}
+
+type config struct {
+	baseURL       string
+	timeout       time.Duration
+	transport     http.RoundTripper
+	retry         *RetryPolicy
+	perTryTimeout time.Duration
+	budget        *RetryBudget
+	middlewares   []Middleware
+	tracing       bool
+	hedgeDelay    time.Duration
+	hedgeBudget   *RetryBudget
+	coalesce      *coalesce.Group
+	cache         *cachex.Cache
+	googleAuth    *tokenCache
+	audit         *logx.AppLogger
+	allowlist     *Allowlist
+	mirror        *Mirror
+	leakCheck     *logx.AppLogger
+	regions       *Regions
+
+	maxResponseBytes int64
+}
+
+type Option func(c *config)
+
+// WithBaseURL is prefixed to every path passed to Client.JSON
+func WithBaseURL(baseURL string) Option {
+	return func(c *config) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithTimeout is the overall timeout of a call including every retry, defaults to 30 seconds
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithTransport sets the base transport, defaults to the shared DefaultTransport
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *config) {
+		c.transport = rt
+	}
+}
+
+// WithRetryPolicy enables retries, by default only idempotent requests are retried
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = &p
+	}
+}
+
+// WithPerTryTimeout bounds each individual attempt, so one slow attempt does not consume the whole timeout
+func WithPerTryTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.perTryTimeout = d
+	}
+}
+
+// WithRetryBudget caps retries to a fraction of overall traffic so retries can not amplify an upstream outage
+func WithRetryBudget(b *RetryBudget) Option {
+	return func(c *config) {
+		c.budget = b
+	}
+}
+
+// WithMiddleware adds custom transport middleware
+func WithMiddleware(mw ...Middleware) Option {
+	return func(c *config) {
+		c.middlewares = append(c.middlewares, mw...)
+	}
+}
+
+// WithoutTracing skips the otelhttp transport
+func WithoutTracing() Option {
+	return func(c *config) {
+		c.tracing = false
+	}
+}
+
+func New(opts ...Option) *Client {
+	c := &config{timeout: 30 * time.Second, tracing: true}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	rt := c.transport
+	if rt == nil {
+		rt = DefaultTransport()
+	}
+	// auditing sits right on the wire, inside tracing so each entry is correlated with the span of its attempt
+	if c.audit != nil {
+		rt = &auditTransport{next: rt, logger: c.audit}
+	}
+	// tracing sits below retries so every retry attempt shows up as its own span
+	if c.tracing {
+		rt = otelhttp.NewTransport(rt)
+	}
+	// every attempt, retried or hedged, goes out with a token that is current at the time it is sent
+	if c.googleAuth != nil {
+		auth := &googleAuthTransport{next: rt, tokens: c.googleAuth}
+		if base, err := url.Parse(c.baseURL); err == nil {
+			auth.host = strings.ToLower(base.Host)
+		}
+		rt = auth
+	}
+	// failing over between regions sits right above tracing, every regional attempt gets a span of its own
+	if c.regions != nil {
+		rt = &regionTransport{next: rt, regions: c.regions}
+	}
+	if c.hedgeDelay > 0 {
+		rt = &hedgeTransport{next: rt, delay: c.hedgeDelay, budget: c.hedgeBudget}
+	}
+	if c.retry != nil {
+		rt = &retryTransport{next: rt, policy: *c.retry, perTryTimeout: c.perTryTimeout, budget: c.budget}
+	}
+	if c.mirror != nil {
+		rt = &mirrorTransport{next: rt, mirror: c.mirror}
+	}
+	// coalescing sits outside of retries so a whole retried call is shared between waiting callers
+	if c.coalesce != nil {
+		rt = &coalesceTransport{next: rt, group: c.coalesce}
+	}
+	// a cached response skips everything below, a revalidation is coalesced and retried like any other GET
+	if c.cache != nil {
+		rt = &cacheTransport{next: rt, cache: c.cache, now: time.Now}
+	}
+	// the allowlist runs before anything else so a blocked request is never retried, hedged or shared
+	if c.allowlist != nil {
+		rt = &allowlistTransport{next: rt, allowlist: c.allowlist}
+	}
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		rt = c.middlewares[i](rt)
+	}
+	// leak checking wraps the body our caller ends up with, whatever the middlewares did to it
+	if c.leakCheck != nil {
+		rt = &leakTransport{next: rt, logger: c.leakCheck}
+	}
+
+	return &Client{
+		httpClient:       &http.Client{Timeout: c.timeout, Transport: rt},
+		baseURL:          c.baseURL,
+		maxResponseBytes: c.maxResponseBytes,
+	}
+}
+
+// HTTPClient exposes the underlying client for callers that need full control
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	return c.httpClient.Do(req)
+}
+
+// URL joins path onto our base url
+func (c *Client) URL(path string) string {
+	if c.baseURL == "" || strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimRight(c.baseURL, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// StatusError is returned when the upstream responds with a non 2xx status code
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream non 2xx status code: %d, status: %q", e.StatusCode, e.Status)
+}
+
+// JSON sends body (when non nil) as json and decodes a 2xx response into out (when non nil)
+func (c *Client) JSON(ctx context.Context, method, path string, body, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("c.httpClient.Do(): %w", err)
+	}
+	// draining even when decoding fails or we return early keeps the connection reusable
+	defer DrainAndClose(resp.Body)
+
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+	return c.decodeJSON(resp.Body, out)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("json.Marshal(): %v", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL(path), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(snippet)}
+}
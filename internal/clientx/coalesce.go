@@ -0,0 +1,92 @@
+package clientx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/coalesce"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WithCoalescing shares one in flight GET between every concurrent identical request, identical meaning the same url
+// and the same keyedHeaders. responses are buffered in memory so every caller gets its own body
+func WithCoalescing(timeout time.Duration) Option {
+	return func(c *config) {
+		c.coalesce = coalesce.New("clientx", timeout)
+	}
+}
+
+type coalesceTransport struct {
+	next  http.RoundTripper
+	group *coalesce.Group
+}
+
+type sharedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+func (t *coalesceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || (req.Body != nil && req.Body != http.NoBody) {
+		return t.next.RoundTrip(req)
+	}
+
+	v, _, err := t.group.Do(req.Context(), coalesceKey(req), func(ctx context.Context) (interface{}, error) {
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadAll(): %v", err)
+		}
+		return &sharedResponse{resp: resp, body: body}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared := v.(*sharedResponse)
+	resp := new(http.Response)
+	*resp = *shared.resp
+	resp.Header = shared.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(shared.body))
+	resp.ContentLength = int64(len(shared.body))
+	resp.Request = req
+	return resp, nil
+}
+
+// keyedHeaders tell apart requests that may get different responses for the same url. whoever the request is made
+// for, the caller's credentials, cookies and tenant (tenantx.DefaultHeader), must never get a response made for
+// someone else, and a revalidation of WithResponseCache may get a 304, which must never be handed to a plain GET
+var keyedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	// cloud run takes the identity token here when Authorization carries one for the service itself
+	"X-Serverless-Authorization",
+	"X-Api-Key",
+	"Cookie",
+	"X-Tenant-ID",
+	"Accept",
+	"Accept-Language",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+func coalesceKey(req *http.Request) string {
+	h := sha256.New()
+	for _, name := range keyedHeaders {
+		// every value, a header sent twice must not look like the same header sent once
+		for _, value := range req.Header.Values(name) {
+			h.Write([]byte(value))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	return req.URL.String() + "#" + hex.EncodeToString(h.Sum(nil))
+}
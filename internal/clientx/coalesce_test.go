@@ -0,0 +1,43 @@
+package clientx
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	newRequest := func(headers ...string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "https://beers.example.com/api/beers", nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		return req
+	}
+	base := coalesceKey(newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme"))
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		same bool
+	}{
+		{name: "identical", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme"), same: true},
+		// a new trace for every request must not stop them from sharing one
+		{name: "other_trace", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"), same: true},
+		{name: "other_tenant", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "globex")},
+		{name: "other_token", req: newRequest("Authorization", "Bearer b", "X-Tenant-ID", "acme")},
+		{name: "serverless_token", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "X-Serverless-Authorization", "Bearer c")},
+		{name: "api_key", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "X-Api-Key", "key-1")},
+		{name: "cookie", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "Cookie", "session=1")},
+		{name: "tenant_sent_twice", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "X-Tenant-ID", "acme")},
+		{name: "revalidation", req: newRequest("Authorization", "Bearer a", "X-Tenant-ID", "acme", "If-None-Match", `"v1"`)},
+		// a value can't move to another header and still look the same
+		{name: "shifted", req: newRequest("Proxy-Authorization", "Bearer a", "X-Tenant-ID", "acme")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := coalesceKey(tt.req) == base; got != tt.same {
+				t.Errorf("coalesceKey() matches the base request: %t, want %t", got, tt.same)
+			}
+		})
+	}
+}
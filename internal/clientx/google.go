@@ -0,0 +1,210 @@
+package clientx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/lazyinit"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CloudPlatformScope covers every google api our identity has been granted roles on
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var googleAuthRefreshes = meter.NewInt64Counter("clientx.google_auth.refreshes", metric.WithDescription("access tokens fetched by reason, a steady stream of rejected means the api doesn't take our token"))
+
+// GoogleTokenSource returns access tokens for scopes from the default credentials, the metadata server of our service
+// identity on cloud run and the application default credentials of gcloud locally. defaults to CloudPlatformScope
+func GoogleTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if len(scopes) == 0 {
+		scopes = []string{CloudPlatformScope}
+	}
+	ts, err := google.DefaultTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("google.DefaultTokenSource(): %v", err)
+	}
+	return ts, nil
+}
+
+// DeferredGoogleTokenSource is GoogleTokenSource finding our credentials on the first token rather than up front, a
+// client for an api we only call on some requests costs nothing at startup. concurrent first tokens find them once, a
+// failure to is returned to every token for a few seconds before it is tried again
+func DeferredGoogleTokenSource(scopes ...string) oauth2.TokenSource {
+	return &deferredTokenSource{credentials: lazyinit.New("google_credentials", func(ctx context.Context) (interface{}, error) {
+		// the token source fetches every token with the context it is created with
+		return GoogleTokenSource(ctxutil.Detach(ctx), scopes...)
+	})}
+}
+
+type deferredTokenSource struct {
+	credentials *lazyinit.Value
+}
+
+func (s *deferredTokenSource) Token() (*oauth2.Token, error) {
+	// oauth2.TokenSource takes no context, our tokenCache already keeps requests from waiting on it past their own
+	ts, err := s.credentials.Get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return ts.(oauth2.TokenSource).Token()
+}
+
+// WithGoogleAuth sends an access token from ts on requests to the host of WithBaseURL and to *.googleapis.com, for
+// calling google rest apis that have no go client library. a request to any other host, eg one an api redirected us
+// to, goes out without it. tokens are reused until shortly before they expire, and a request the api answers with a 401 is sent once
+// more with a freshly fetched token, a token can be revoked or the metadata server rotate it ahead of its expiry
+func WithGoogleAuth(ts oauth2.TokenSource) Option {
+	return func(c *config) {
+		c.googleAuth = &tokenCache{source: ts}
+	}
+}
+
+// tokenCache is oauth2.ReuseTokenSource with a way to drop a token the api rejected. oauth2.TokenSource takes no
+// context, so a token is fetched on its own while requests wait for it only as long as their context allows, one slow
+// metadata server mustn't hang every request past its deadline
+type tokenCache struct {
+	source oauth2.TokenSource
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	// fetching is the fetch in flight, nil when there is none
+	fetching *tokenFetch
+}
+
+type tokenFetch struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+func (c *tokenCache) get(ctx context.Context, reason string) (*oauth2.Token, error) {
+	c.mu.Lock()
+	if c.token.Valid() {
+		token := c.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	fetch := c.fetching
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		c.fetching = fetch
+		go c.fetch(ctx, fetch, reason)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for an access token: %w", ctx.Err())
+	}
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	return fetch.token, nil
+}
+
+// fetch gets a token from our source, spanned under the request that needed it first
+func (c *tokenCache) fetch(ctx context.Context, fetch *tokenFetch, reason string) {
+	// the fetch outlives a request that gives up waiting on it, the next one waits on it instead
+	ctx, span := otel.Tracer(instrumentationName).Start(ctxutil.Detach(ctx), "clientx.google_auth.refresh", trace.WithAttributes(attribute.String("reason", reason)))
+	defer span.End()
+	token, err := c.source.Token()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		err = fmt.Errorf("source.Token(): %v", err)
+	}
+
+	c.mu.Lock()
+	fetch.token, fetch.err = token, err
+	if err == nil {
+		c.token = token
+		googleAuthRefreshes.Add(ctx, 1, attribute.String("reason", reason))
+	}
+	c.fetching = nil
+	c.mu.Unlock()
+	close(fetch.done)
+}
+
+// invalidate drops token unless another request already replaced it
+func (c *tokenCache) invalidate(token *oauth2.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = nil
+	}
+}
+
+type googleAuthTransport struct {
+	next   http.RoundTripper
+	tokens *tokenCache
+	// host is the host of our base url, empty without one
+	host string
+}
+
+// trusts reports if a request to host may carry our token, our access token is good for every api we have roles on
+func (t *googleAuthTransport) trusts(host string) bool {
+	host = strings.ToLower(host)
+	if t.host != "" && host == t.host {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	return hostname == "googleapis.com" || strings.HasSuffix(hostname, ".googleapis.com")
+}
+
+func (t *googleAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !t.trusts(req.URL.Host) {
+		if req.Header.Get("Authorization") == "" {
+			return t.next.RoundTrip(req)
+		}
+		stripped := req.Clone(ctx)
+		stripped.Header.Del("Authorization")
+		return t.next.RoundTrip(stripped)
+	}
+	token, err := t.tokens.get(ctx, "expired")
+	if err != nil {
+		return nil, err
+	}
+	authed := req.Clone(ctx)
+	token.SetAuthHeader(authed)
+	resp, err := t.next.RoundTrip(authed)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// we can only send it again when we can rewind its body
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+
+	t.tokens.invalidate(token)
+	if token, err = t.tokens.get(ctx, "rejected"); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("req.GetBody(): %v", err)
+		}
+	}
+	token.SetAuthHeader(retry)
+	return t.next.RoundTrip(retry)
+}
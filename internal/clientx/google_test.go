@@ -0,0 +1,47 @@
+package clientx
+
+import (
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGoogleAuthOnlyForTrustedHosts(t *testing.T) {
+	auth := map[string]string{}
+	transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		auth[req.URL.Host] = req.Header.Get("Authorization")
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("{}")), Header: http.Header{}}, nil
+	})
+	client := New(
+		WithBaseURL("https://beers-ew.a.run.app/"),
+		WithGoogleAuth(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "our-token"})),
+		WithTransport(transport),
+		WithoutTracing(),
+	)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://beers-ew.a.run.app/api/beers", want: "Bearer our-token"},
+		{url: "https://run.googleapis.com/v2/services", want: "Bearer our-token"},
+		{url: "https://storage.googleapis.com:443/b", want: "Bearer our-token"},
+		{url: "https://example.com/upload", want: ""},
+		{url: "https://googleapis.com.example.com/upload", want: ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		// whatever Authorization a request already had never reaches a host we do not trust either
+		req.Header.Set("Authorization", "Bearer leaked")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do(%s): %v", tt.url, err)
+		}
+		resp.Body.Close()
+		if got := auth[req.URL.Host]; got != tt.want {
+			t.Errorf("Authorization to %s = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package clientx
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"net/http"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/clientx"
+
+var (
+	meter        = metric.Must(global.Meter(instrumentationName))
+	hedgeCounter = meter.NewInt64Counter("clientx.hedge.attempts", metric.WithDescription("hedged requests that were sent"))
+	hedgeWins    = meter.NewInt64Counter("clientx.hedge.wins", metric.WithDescription("hedged requests that beat the original request"))
+)
+
+// WithHedging sends a second copy of idempotent GET/HEAD requests when the first has not responded within delay, the
+// first response wins and the loser is cancelled. budget bounds how many requests can be hedged, a nil budget allows
+// hedging at most 10% of requests
+func WithHedging(delay time.Duration, budget *RetryBudget) Option {
+	if budget == nil {
+		budget = NewRetryBudget(0.1, 1)
+	}
+	return func(c *config) {
+		c.hedgeDelay = delay
+		c.hedgeBudget = budget
+	}
+}
+
+type hedgeTransport struct {
+	next   http.RoundTripper
+	delay  time.Duration
+	budget *RetryBudget
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedged bool
+}
+
+func hedgeable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.next.RoundTrip(req)
+	}
+	t.budget.deposit()
+
+	results := make(chan hedgeResult, 2)
+	cancels := map[bool]context.CancelFunc{}
+	send := func(hedged bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[hedged] = cancel
+		attempt := req.Clone(ctx)
+		go func() {
+			resp, err := t.next.RoundTrip(attempt)
+			results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+		}()
+	}
+
+	send(false)
+	inflight := 1
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	labels := []attribute.KeyValue{attribute.String("host", req.URL.Host)}
+	var failed *hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			if inflight == 1 && failed == nil && t.budget.withdraw() {
+				hedgeCounter.Add(req.Context(), 1, labels...)
+				send(true)
+				inflight++
+			}
+		case r := <-results:
+			inflight--
+			won := r.err == nil && r.resp.StatusCode < http.StatusInternalServerError
+			if !won && inflight > 0 {
+				// this attempt failed but the other one is still in flight, hold on to it in case both fail
+				failed = &r
+				continue
+			}
+			// lost is the attempt that failed before this one, or this one when we return that instead
+			lost := failed
+			if !won && failed != nil && r.err != nil {
+				// both failed, a response is more useful to our caller than a transport error
+				transportErr := r
+				r, lost = *failed, &transportErr
+			}
+			if won && r.hedged {
+				hedgeWins.Add(req.Context(), 1, labels...)
+			}
+
+			// cancel and clean up whichever attempt did not win
+			loser := cancels[!r.hedged]
+			if loser != nil {
+				loser()
+			}
+			if inflight > 0 {
+				go drainLoser(results)
+			}
+			if lost != nil && lost.resp != nil {
+				lost.resp.Body.Close()
+			}
+
+			if r.err != nil {
+				cancels[r.hedged]()
+				return nil, r.err
+			}
+			// the winner is only cancelled once its body has been read and closed
+			r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: cancels[r.hedged]}
+			return r.resp, nil
+		}
+	}
+}
+
+func drainLoser(results chan hedgeResult) {
+	r := <-results
+	if r.resp != nil {
+		r.resp.Body.Close()
+	}
+}
@@ -0,0 +1,388 @@
+package clientx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	mirrorRequests = meter.NewInt64Counter("clientx.mirror.requests", metric.WithDescription("mirrored requests by outcome"))
+	mirrorLatency  = meter.NewFloat64ValueRecorder("clientx.mirror.latency_delta",
+		metric.WithDescription("shadow latency minus primary latency, positive means the shadow is slower"),
+		metric.WithUnit("ms"),
+	)
+)
+
+// the most differing json paths we log for a single mirrored request
+const maxMirrorDiffs = 10
+
+// Mirror sends a sample of our requests to a shadow upstream as well, eg the tagged url of a canary revision, and
+// compares the two responses. the shadow call runs in the background on a detached context and its response is only
+// ever compared, a slow or failing shadow can't affect the primary call
+type Mirror struct {
+	target       *url.URL
+	sample       float64
+	logger       *logx.AppLogger
+	transport    http.RoundTripper
+	timeout      time.Duration
+	maxBodyBytes int64
+	methods      map[string]bool
+	ignore       map[string]bool
+	slots        chan struct{}
+}
+
+type MirrorOption func(m *Mirror)
+
+// WithMirrorSample is the fraction of requests that are mirrored, defaults to 0.1
+func WithMirrorSample(ratio float64) MirrorOption {
+	return func(m *Mirror) {
+		m.sample = ratio
+	}
+}
+
+// WithMirrorLogger logs every mismatch as a "mirror diff" entry
+func WithMirrorLogger(logger *logx.AppLogger) MirrorOption {
+	return func(m *Mirror) {
+		m.logger = logger
+	}
+}
+
+// WithMirrorTransport sets the transport of shadow requests, pass one that mints its own identity tokens when the
+// shadow is an authenticated cloud run service, a token minted for the primary has the wrong audience
+func WithMirrorTransport(rt http.RoundTripper) MirrorOption {
+	return func(m *Mirror) {
+		m.transport = rt
+	}
+}
+
+// WithMirrorTimeout bounds each shadow request, defaults to 10 seconds
+func WithMirrorTimeout(d time.Duration) MirrorOption {
+	return func(m *Mirror) {
+		m.timeout = d
+	}
+}
+
+// WithMirrorMaxInFlight caps concurrent shadow requests, anything over it is dropped rather than queued. defaults to 10
+func WithMirrorMaxInFlight(n int) MirrorOption {
+	return func(m *Mirror) {
+		m.slots = make(chan struct{}, n)
+	}
+}
+
+// WithMirrorMaxBodyBytes is how much of each response body is compared, larger bodies only have their status
+// compared. defaults to 64KiB
+func WithMirrorMaxBodyBytes(n int64) MirrorOption {
+	return func(m *Mirror) {
+		m.maxBodyBytes = n
+	}
+}
+
+// WithMirrorMethods allows mirroring more than GET and HEAD, only add methods the shadow can safely receive twice
+func WithMirrorMethods(methods ...string) MirrorOption {
+	return func(m *Mirror) {
+		for _, method := range methods {
+			m.methods[strings.ToUpper(method)] = true
+		}
+	}
+}
+
+// WithMirrorIgnoreFields skips json fields that are expected to differ between responses, eg timestamps or generated
+// ids, a field is ignored at any depth
+func WithMirrorIgnoreFields(fields ...string) MirrorOption {
+	return func(m *Mirror) {
+		for _, f := range fields {
+			m.ignore[f] = true
+		}
+	}
+}
+
+// NewMirror mirrors requests to target, the scheme and host of target replace those of the request and its path is
+// used as a prefix
+func NewMirror(target string, opts ...MirrorOption) (*Mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse(): %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("clientx: mirror target %q needs a scheme and host", target)
+	}
+	m := &Mirror{
+		target:       u,
+		sample:       0.1,
+		timeout:      10 * time.Second,
+		maxBodyBytes: 64 << 10,
+		methods:      map[string]bool{http.MethodGet: true, http.MethodHead: true},
+		ignore:       map[string]bool{},
+		slots:        make(chan struct{}, 10),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.transport == nil {
+		m.transport = otelhttp.NewTransport(DefaultTransport())
+	}
+	return m, nil
+}
+
+// WithMirror mirrors a sample of requests with m. it sits outside retries so a shadow sees each call once, no matter
+// how many attempts the primary took
+func WithMirror(m *Mirror) Option {
+	return func(c *config) {
+		c.mirror = m
+	}
+}
+
+type mirrorTransport struct {
+	next   http.RoundTripper
+	mirror *Mirror
+}
+
+// mirroredResponse is what we know about one side of a mirrored request
+type mirroredResponse struct {
+	status   int
+	latency  time.Duration
+	body     []byte
+	complete bool
+	err      error
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := t.mirror
+	if !m.methods[req.Method] || rand.Float64() >= m.sample {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// we would have to consume the body of the primary to replay it
+		return t.next.RoundTrip(req)
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrorRequests.Add(req.Context(), 1, attribute.String("outcome", "dropped"))
+		return t.next.RoundTrip(req)
+	}
+
+	shadowReq, cancel, err := m.shadowRequest(req)
+	if err != nil {
+		<-m.slots
+		mirrorRequests.Add(req.Context(), 1, attribute.String("outcome", "error"))
+		return t.next.RoundTrip(req)
+	}
+	shadow := make(chan *mirroredResponse, 1)
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+		shadow <- m.send(shadowReq)
+	}()
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	primary := &mirroredResponse{latency: time.Since(start), err: err}
+	if err != nil {
+		go m.compare(ctxutil.Detach(req.Context()), req, primary, shadow)
+		return nil, err
+	}
+	primary.status = resp.StatusCode
+	resp.Body = &mirrorBody{ReadCloser: resp.Body, limit: m.maxBodyBytes, done: func(body []byte, complete bool) {
+		primary.body, primary.complete = body, complete
+		go m.compare(ctxutil.Detach(req.Context()), req, primary, shadow)
+	}}
+	return resp, nil
+}
+
+// shadowRequest copies req onto our target, it keeps the trace values of req but none of its cancellation
+func (m *Mirror) shadowRequest(req *http.Request) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(ctxutil.Detach(req.Context()), m.timeout)
+	shadowReq := req.Clone(ctx)
+	shadowReq.URL.Scheme = m.target.Scheme
+	shadowReq.URL.Host = m.target.Host
+	shadowReq.URL.Path = strings.TrimRight(m.target.Path, "/") + req.URL.Path
+	shadowReq.URL.RawPath = ""
+	shadowReq.Host = m.target.Host
+	shadowReq.RequestURI = ""
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("req.GetBody(): %v", err)
+		}
+		shadowReq.Body = body
+	}
+	return shadowReq, cancel, nil
+}
+
+func (m *Mirror) send(req *http.Request) *mirroredResponse {
+	start := time.Now()
+	resp, err := m.transport.RoundTrip(req)
+	r := &mirroredResponse{latency: time.Since(start), err: err}
+	if err != nil {
+		return r
+	}
+	defer DrainAndClose(resp.Body)
+	r.status = resp.StatusCode
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, m.maxBodyBytes+1))
+	r.body = body
+	r.complete = err == nil && int64(len(body)) <= m.maxBodyBytes
+	return r
+}
+
+func (m *Mirror) compare(ctx context.Context, req *http.Request, primary *mirroredResponse, shadowCh <-chan *mirroredResponse) {
+	shadow := <-shadowCh
+
+	outcome := "match"
+	var diffs []string
+	switch {
+	case primary.err != nil || shadow.err != nil:
+		outcome = "error"
+	case primary.status != shadow.status:
+		outcome = "status_mismatch"
+	case primary.complete && shadow.complete:
+		diffs = DiffBodies(primary.body, shadow.body, m.ignore, maxMirrorDiffs)
+		if len(diffs) > 0 {
+			outcome = "body_mismatch"
+		}
+	}
+
+	host := attribute.String("host", req.URL.Hostname())
+	mirrorRequests.Add(ctx, 1, host, attribute.String("outcome", outcome))
+	if primary.err == nil && shadow.err == nil {
+		mirrorLatency.Record(ctx, float64(shadow.latency-primary.latency)/float64(time.Millisecond), host)
+	}
+	if outcome == "match" || m.logger == nil {
+		return
+	}
+
+	fields := []interface{}{
+		"outcome", outcome,
+		"method", req.Method,
+		"host", req.URL.Hostname(),
+		"shadow_host", m.target.Host,
+		"path", PathTemplate(req.URL.Path),
+		"primary_status", primary.status,
+		"shadow_status", shadow.status,
+		"primary_latency_ms", primary.latency.Milliseconds(),
+		"shadow_latency_ms", shadow.latency.Milliseconds(),
+	}
+	if len(diffs) > 0 {
+		fields = append(fields, "diff", diffs)
+	}
+	if primary.err != nil {
+		fields = append(fields, "primary_err", primary.err.Error())
+	}
+	if shadow.err != nil {
+		fields = append(fields, "shadow_err", shadow.err.Error())
+	}
+	m.logger.WrapTraceContext(ctx).Warnw("mirror diff", fields...)
+}
+
+// DiffBodies compares json bodies field by field, anything else byte for byte, and returns the json paths that
+// differ, at most max of them. fields in ignore are skipped at any depth, eg timestamps or generated ids
+func DiffBodies(a, b []byte, ignore map[string]bool, max int) []string {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		if bytes.Equal(a, b) {
+			return nil
+		}
+		return []string{"body"}
+	}
+	var diffs []string
+	diffJSON("$", av, bv, ignore, max, &diffs)
+	return diffs
+}
+
+func diffJSON(path string, a, b interface{}, ignore map[string]bool, max int, diffs *[]string) {
+	if len(*diffs) >= max {
+		return
+	}
+	switch at := a.(type) {
+	case map[string]interface{}:
+		bt, ok := b.(map[string]interface{})
+		if !ok {
+			*diffs = append(*diffs, path)
+			return
+		}
+		keys := make([]string, 0, len(at)+len(bt))
+		for k := range at {
+			keys = append(keys, k)
+		}
+		for k := range bt {
+			if _, ok := at[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ignore[k] {
+				continue
+			}
+			diffJSON(path+"."+k, at[k], bt[k], ignore, max, diffs)
+		}
+	case []interface{}:
+		bt, ok := b.([]interface{})
+		if !ok || len(at) != len(bt) {
+			*diffs = append(*diffs, path)
+			return
+		}
+		for i := range at {
+			diffJSON(path+"["+strconv.Itoa(i)+"]", at[i], bt[i], ignore, max, diffs)
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			*diffs = append(*diffs, path)
+		}
+	}
+}
+
+// mirrorBody captures the primary response as our caller reads it, without holding up a single read
+type mirrorBody struct {
+	io.ReadCloser
+	limit int64
+	done  func(body []byte, complete bool)
+
+	buf      bytes.Buffer
+	overflow bool
+	eof      bool
+	once     sync.Once
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *mirrorBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.done(b.buf.Bytes(), b.eof && !b.overflow)
+	})
+	return err
+}
@@ -0,0 +1,271 @@
+package clientx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	regionRequests  = meter.NewInt64Counter("clientx.region.requests", metric.WithDescription("requests by region and outcome"))
+	regionFailovers = meter.NewInt64Counter("clientx.region.failovers", metric.WithDescription("requests moved on to the next region"))
+)
+
+// Region is one deployment of an upstream service, URL is its base url, eg https://beers-abc123-ew.a.run.app
+type Region struct {
+	Name string
+	URL  string
+}
+
+// Regions spreads calls to a service deployed in several regions. requests go to the first healthy region, or the
+// fastest with WithLatencyRouting, and move on to the next one when a region fails. a region that keeps failing is
+// ejected for a while and only tried once every other region failed too. the host of each request is replaced, so
+// authenticated upstreams need an identity token every region accepts, eg a custom audience shared by all of them
+type Regions struct {
+	endpoints  []*regionEndpoint
+	latency    bool
+	ejectAfter int
+	cooldown   time.Duration
+	timeout    time.Duration
+	now        func() time.Time
+
+	mu sync.Mutex
+}
+
+type regionEndpoint struct {
+	name string
+	url  *url.URL
+
+	// latency is an ewma of successful responses, failures is the number of failures in a row
+	latency      time.Duration
+	failures     int
+	ejectedUntil time.Time
+}
+
+type RegionsOption func(r *Regions)
+
+// WithLatencyRouting sends requests to the healthy region with the lowest latency instead of the first one, regions we
+// have no latency for yet are tried first so each gets measured
+func WithLatencyRouting() RegionsOption {
+	return func(r *Regions) {
+		r.latency = true
+	}
+}
+
+// WithEjection takes a region out of rotation for cooldown after failures failed requests in a row, defaults to 3
+// failures and 30 seconds
+func WithEjection(failures int, cooldown time.Duration) RegionsOption {
+	return func(r *Regions) {
+		r.ejectAfter = failures
+		r.cooldown = cooldown
+	}
+}
+
+// WithRegionTimeout bounds each regional attempt so a region that hangs still leaves time to fail over, without it
+// an attempt can use up the whole deadline of the request
+func WithRegionTimeout(d time.Duration) RegionsOption {
+	return func(r *Regions) {
+		r.timeout = d
+	}
+}
+
+// WithRegionsClock replaces time.Now, for tests stepping through ejections
+func WithRegionsClock(now func() time.Time) RegionsOption {
+	return func(r *Regions) {
+		r.now = now
+	}
+}
+
+// NewRegions takes our regions in order of preference
+func NewRegions(regions []Region, opts ...RegionsOption) (*Regions, error) {
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("clientx: no regions")
+	}
+	r := &Regions{ejectAfter: 3, cooldown: 30 * time.Second, now: time.Now}
+	for _, region := range regions {
+		u, err := url.Parse(region.URL)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse(%s): %v", region.URL, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("clientx: region %s needs an absolute url, got %q", region.Name, region.URL)
+		}
+		r.endpoints = append(r.endpoints, &regionEndpoint{name: region.Name, url: u})
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	meter.NewInt64ValueObserver("clientx.region.healthy", func(ctx context.Context, result metric.Int64ObserverResult) {
+		now := r.now()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, e := range r.endpoints {
+			healthy := int64(1)
+			if now.Before(e.ejectedUntil) {
+				healthy = 0
+			}
+			result.Observe(healthy, attribute.String("region", e.name))
+		}
+	}, metric.WithDescription("1 while a region is in rotation, 0 while it is ejected"))
+	return r, nil
+}
+
+// WithRegions routes every request through regions, the scheme and host of the request url are replaced by those of
+// the region serving it
+func WithRegions(r *Regions) Option {
+	return func(c *config) {
+		c.regions = r
+	}
+}
+
+// order returns the regions to try, healthy ones first
+func (r *Regions) order() []*regionEndpoint {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var healthy, ejected []*regionEndpoint
+	for _, e := range r.endpoints {
+		if now.Before(e.ejectedUntil) {
+			ejected = append(ejected, e)
+			continue
+		}
+		healthy = append(healthy, e)
+	}
+	if r.latency {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].latency < healthy[j].latency
+		})
+	}
+	// the region that comes back soonest is our best bet among the ejected ones
+	sort.SliceStable(ejected, func(i, j int) bool {
+		return ejected[i].ejectedUntil.Before(ejected[j].ejectedUntil)
+	})
+	return append(healthy, ejected...)
+}
+
+func (r *Regions) record(e *regionEndpoint, latency time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		e.failures = 0
+		e.ejectedUntil = time.Time{}
+		if e.latency == 0 {
+			e.latency = latency
+		} else {
+			e.latency = (e.latency*4 + latency) / 5
+		}
+		return
+	}
+	e.failures++
+	if r.ejectAfter > 0 && e.failures >= r.ejectAfter {
+		e.ejectedUntil = r.now().Add(r.cooldown)
+	}
+}
+
+type regionTransport struct {
+	next    http.RoundTripper
+	regions *Regions
+}
+
+// regionFailed is an outcome worth trying another region for, the ones our retry policy considers retryable
+func regionFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// neverSent reports errors that happened before any of our request went out, connecting to a region that is down is
+// safe to retry elsewhere whatever the method
+func neverSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func (t *regionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// only a request we can safely send twice moves on to another region
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	canFailover := idempotent(req) && replayable
+
+	var resp *http.Response
+	var err error
+	endpoints := t.regions.order()
+	for i, e := range endpoints {
+		if i > 0 {
+			regionFailovers.Add(req.Context(), 1, attribute.String("from", endpoints[i-1].name), attribute.String("to", e.name))
+		}
+		resp, err = t.send(req, e, i > 0)
+		last := !(canFailover || replayable && neverSent(err)) || i == len(endpoints)-1 || req.Context().Err() != nil
+		if !regionFailed(resp, err) || last {
+			return resp, err
+		}
+		// the next region gets a fresh attempt, this response is never going to be read
+		if resp != nil {
+			DrainAndClose(resp.Body)
+		}
+	}
+	return resp, err
+}
+
+func (t *regionTransport) send(req *http.Request, e *regionEndpoint, replay bool) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.regions.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.regions.timeout)
+	}
+	attempt := req.Clone(ctx)
+	attempt.URL.Scheme = e.url.Scheme
+	attempt.URL.Host = e.url.Host
+	// an empty Host has net/http send the host of our url, which is what cloud run routes on
+	attempt.Host = ""
+	if replay && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("req.GetBody(): %v", err)
+		}
+		attempt.Body = body
+	}
+
+	start := t.regions.now()
+	resp, err := t.next.RoundTrip(attempt)
+	failed := regionFailed(resp, err)
+	// a caller that gave up says nothing about the region, only our own region timeout running out does
+	canceled := err != nil && req.Context().Err() != nil
+	if !canceled {
+		t.regions.record(e, t.regions.now().Sub(start), !failed)
+	}
+
+	outcome := "ok"
+	switch {
+	case canceled:
+		outcome = "canceled"
+	case err != nil:
+		outcome = "error"
+	case failed:
+		outcome = "status_" + strconv.Itoa(resp.StatusCode)
+	}
+	regionRequests.Add(req.Context(), 1, attribute.String("region", e.name), attribute.String("outcome", outcome))
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the attempt is only cancelled once its body has been read and closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
@@ -0,0 +1,72 @@
+package clientx
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers requests with a function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRegionsIgnoreCallerCancellation(t *testing.T) {
+	regions, err := NewRegions([]Region{
+		{Name: "europe-west1", URL: "https://beers-ew.a.run.app"},
+		{Name: "us-central1", URL: "https://beers-uc.a.run.app"},
+	}, WithEjection(1, time.Minute), WithRegionTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewRegions(): %v", err)
+	}
+	var hosts []string
+	transport := &regionTransport{regions: regions, next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hosts = append(hosts, req.URL.Host)
+		if req.URL.Host == "beers-ew.a.run.app" && req.Header.Get("X-Hang") != "" {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+	})}
+	send := func(ctx context.Context, hang bool) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://beers/api/beers", nil)
+		if hang {
+			req.Header.Set("X-Hang", "true")
+		}
+		return transport.RoundTrip(req)
+	}
+
+	// the caller gives up long before our region timeout, europe-west1 did nothing wrong
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	_, err = send(ctx, true)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RoundTrip() = %v, want the deadline of the caller", err)
+	}
+	if len(hosts) != 1 {
+		t.Errorf("a cancelled request went to %v, want no failover", hosts)
+	}
+	if first := regions.order()[0].name; first != "europe-west1" {
+		t.Errorf("first region after a cancelled request = %s, want europe-west1 still in rotation", first)
+	}
+
+	// the region timeout running out is the region failing, it is ejected and we fail over
+	hosts = nil
+	resp, err := send(context.Background(), true)
+	if err != nil {
+		t.Fatalf("RoundTrip(): %v", err)
+	}
+	resp.Body.Close()
+	if len(hosts) != 2 || hosts[1] != "beers-uc.a.run.app" {
+		t.Errorf("a hanging region was followed by %v, want a failover to us-central1", hosts)
+	}
+	if first := regions.order()[0].name; first != "us-central1" {
+		t.Errorf("first region after a region timeout = %s, want europe-west1 ejected", first)
+	}
+}
@@ -0,0 +1,163 @@
+package clientx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy is a retry.Policy for http calls, adding which responses are retried and whether requests that aren't
+// idempotent are
+type RetryPolicy struct {
+	retry.Policy
+	// RetryableStatus defaults to 429, 502, 503 and 504
+	RetryableStatus []int
+	// RetryNonIdempotent allows retrying POST/PATCH, only turn this on if the upstream dedupes requests
+	RetryNonIdempotent bool
+}
+
+// DefaultRetryPolicy is a sensible policy for calling other cloud run services
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Policy:          retry.Default(),
+		RetryableStatus: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+func (p RetryPolicy) retryableStatus(code int) bool {
+	for _, s := range p.RetryableStatus {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotent follows https://datatracker.ietf.org/doc/html/rfc7231#section-4.2.2, a request carrying an
+// Idempotency-Key header is treated as safe to replay
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+type retryTransport struct {
+	next          http.RoundTripper
+	policy        RetryPolicy
+	perTryTimeout time.Duration
+	budget        *RetryBudget
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.budget != nil {
+		t.budget.deposit()
+	}
+
+	canRetry := t.policy.MaxAttempts > 1 && (idempotent(req) || t.policy.RetryNonIdempotent)
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// we have no way to replay the body
+		canRetry = false
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("req.GetBody(): %v", err)
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.try(attemptReq)
+
+		if !canRetry || attempt >= t.policy.MaxAttempts || !t.shouldRetry(req.Context(), resp, err) {
+			return resp, err
+		}
+		if t.budget != nil && !t.budget.withdraw() {
+			return resp, err
+		}
+
+		wait := t.policy.Backoff(attempt)
+		if resp != nil {
+			if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > wait {
+				wait = retryAfter
+			}
+			if t.policy.MaxBackoff > 0 && wait > t.policy.MaxBackoff {
+				wait = t.policy.MaxBackoff
+			}
+			// drain the body so the connection can be reused for the next attempt
+			DrainAndClose(resp.Body)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// try performs a single attempt, applying our per try timeout. the timeout is released once the body is closed
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if t.perTryTimeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.perTryTimeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *retryTransport) shouldRetry(parent context.Context, resp *http.Response, err error) bool {
+	// our caller gave up, there is no point in trying again
+	if parent.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// transport errors are retried unless a classifier of our own says otherwise
+		if t.policy.Retryable != nil {
+			return t.policy.Retryable(err)
+		}
+		return !errors.Is(err, context.Canceled)
+	}
+	return t.policy.retryableStatus(resp.StatusCode)
+}
+
+// parseRetryAfter supports both the delay-seconds and http-date forms
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
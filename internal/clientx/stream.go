@@ -0,0 +1,105 @@
+package clientx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ErrResponseTooLarge is returned once an upstream response exceeds the configured max response size
+var ErrResponseTooLarge = errors.New("clientx: upstream response exceeded max response size")
+
+// WithMaxResponseBytes caps how much of a response body we are willing to read, cloud run instances can have as
+// little as 128MiB of memory so one unexpectedly large upstream payload is enough to get us OOM killed
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *config) {
+		c.maxResponseBytes = n
+	}
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// pooled buffers that grew past this are dropped instead of being kept alive by the pool
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// limitedReader behaves like io.LimitReader but reports ErrResponseTooLarge instead of a silent io.EOF
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// probe for one more byte to tell the difference between exactly at the limit and over it
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (c *Client) limitBody(r io.Reader) io.Reader {
+	if c.maxResponseBytes <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, remaining: c.maxResponseBytes}
+}
+
+// decodeJSON reads the body into a pooled buffer, enforcing our size limit, before unmarshalling it
+func (c *Client) decodeJSON(r io.Reader, out interface{}) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(c.limitBody(r)); err != nil {
+		return fmt.Errorf("buf.ReadFrom(): %w", err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), out); err != nil {
+		return fmt.Errorf("json.Unmarshal(): %v", err)
+	}
+	return nil
+}
+
+// Stream hands a 2xx response body to fn without buffering it, the body is size limited and always drained and
+// closed once fn returns. use it for large payloads that can be processed incrementally, eg with json.Decoder.Token
+func (c *Client) Stream(ctx context.Context, method, path string, body interface{}, fn func(r io.Reader, resp *http.Response) error) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("c.httpClient.Do(): %w", err)
+	}
+	defer DrainAndClose(resp.Body)
+
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	return fn(c.limitBody(resp.Body), resp)
+}
@@ -0,0 +1,64 @@
+package coalesce
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"golang.org/x/sync/singleflight"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/coalesce"
+
+var (
+	meter       = metric.Must(global.Meter(instrumentationName))
+	sharedCalls = meter.NewInt64Counter("coalesce.shared", metric.WithDescription("calls that were served by another in flight call"))
+	leaderCalls = meter.NewInt64Counter("coalesce.leader", metric.WithDescription("calls that actually executed"))
+)
+
+// Group collapses identical concurrent calls within an instance into one, with a cloud run concurrency of 80 a cold
+// cache can otherwise send 80 identical requests upstream at the same time
+type Group struct {
+	name    string
+	sf      singleflight.Group
+	timeout time.Duration
+}
+
+// New creates a group, name is used as a metric label. timeout bounds the shared call since it is no longer tied to
+// any single caller's context
+func New(name string, timeout time.Duration) *Group {
+	return &Group{name: name, timeout: timeout}
+}
+
+// Do executes fn once per key for every concurrent caller. fn receives a context that keeps the values of the first
+// caller (trace context, loggers) but is not cancelled when that caller goes away, each caller can still give up
+// waiting on its own context
+func (g *Group) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, bool, error) {
+	ch := g.sf.DoChan(key, func() (interface{}, error) {
+		leaderCalls.Add(ctx, 1, attribute.String("group", g.name))
+		callCtx := ctxutil.Detach(ctx)
+		if g.timeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(callCtx, g.timeout)
+			defer cancel()
+		}
+		return fn(callCtx)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Shared {
+			sharedCalls.Add(ctx, 1, attribute.String("group", g.name))
+		}
+		return res.Val, res.Shared, res.Err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// Forget drops an in flight key so the next caller starts a fresh call
+func (g *Group) Forget(key string) {
+	g.sf.Forget(key)
+}
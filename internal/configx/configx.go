@@ -0,0 +1,331 @@
+package configx
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source describes where a config value was resolved from, sources are ordered from lowest to highest precedence
+type Source int
+
+const (
+	SourceDefault Source = iota
+	SourceFile
+	SourceEnv
+	SourceSecret
+	// SourceOverride is a value set at runtime with Config.Override, it lasts until the instance goes away
+	SourceOverride
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceFile:
+		return "file"
+	case SourceEnv:
+		return "env"
+	case SourceSecret:
+		return "secret"
+	case SourceOverride:
+		return "override"
+	}
+	return "unknown"
+}
+
+const redacted = "[REDACTED]"
+
+// Value is a single resolved config value along with where it came from
+type Value struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source Source `json:"-"`
+	Secret bool   `json:"-"`
+}
+
+// Config is safe for concurrent use, a reload swaps every value at once so readers never see half of one
+type Config struct {
+	profile Profile
+	// loader is what Load read us with, Reload reads the same layers again
+	loader *loader
+
+	mu        sync.RWMutex
+	values    map[string]Value
+	overrides map[string]string
+
+	// reloadMu serializes reloads along with the validators and listeners they run
+	reloadMu   sync.Mutex
+	validators []func(c *Config) error
+	listeners  []listener
+}
+
+type loader struct {
+	profile    Profile
+	defaults   map[string]string
+	profileDir string
+	envPrefix  string
+	secretsDir string
+	sensitive  map[string]bool
+}
+
+type Option func(l *loader)
+
+// WithProfile forces a profile instead of resolving it from the environment
+func WithProfile(p Profile) Option {
+	return func(l *loader) {
+		l.profile = p
+	}
+}
+
+// WithDefaults sets the lowest precedence layer of config values
+func WithDefaults(defaults map[string]string) Option {
+	return func(l *loader) {
+		for k, v := range defaults {
+			l.defaults[k] = v
+		}
+	}
+}
+
+// WithProfileDir will load a flat json object from <dir>/<profile>.json, a missing file is not an error
+func WithProfileDir(dir string) Option {
+	return func(l *loader) {
+		l.profileDir = dir
+	}
+}
+
+// WithEnvPrefix will resolve the key "upstream_url" from the env variable PREFIX_UPSTREAM_URL
+func WithEnvPrefix(prefix string) Option {
+	return func(l *loader) {
+		l.envPrefix = prefix
+	}
+}
+
+// WithSecretsDir will resolve values from files within dir, this lines up with how cloud run mounts secret manager
+// secrets as volumes, every file name is treated as a key
+func WithSecretsDir(dir string) Option {
+	return func(l *loader) {
+		l.secretsDir = dir
+	}
+}
+
+// WithSensitiveKeys marks keys that should be redacted when dumped, values sourced from secrets are always redacted
+func WithSensitiveKeys(keys ...string) Option {
+	return func(l *loader) {
+		for _, key := range keys {
+			l.sensitive[key] = true
+		}
+	}
+}
+
+// Load resolves the active profile and merges all config layers, defaults < file < env < secrets
+func Load(opts ...Option) (*Config, error) {
+	l := &loader{defaults: map[string]string{}, sensitive: map[string]bool{}}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.profile == "" {
+		l.profile = ResolveProfile()
+	}
+	c, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	c.loader = l
+	return c, nil
+}
+
+// load reads every layer into a new config
+func (l *loader) load() (*Config, error) {
+	c := &Config{profile: l.profile, values: map[string]Value{}, overrides: map[string]string{}}
+	for k, v := range l.defaults {
+		c.set(k, v, SourceDefault)
+	}
+
+	if l.profileDir != "" {
+		if err := l.loadFile(c); err != nil {
+			return nil, fmt.Errorf("l.loadFile(): %v", err)
+		}
+	}
+
+	if l.envPrefix != "" {
+		l.loadEnv(c)
+	}
+
+	if l.secretsDir != "" {
+		if err := l.loadSecrets(c); err != nil {
+			return nil, fmt.Errorf("l.loadSecrets(): %v", err)
+		}
+	}
+
+	for k, v := range c.values {
+		if l.sensitive[k] {
+			v.Secret = true
+			c.values[k] = v
+		}
+	}
+	return c, nil
+}
+
+func (l *loader) loadFile(c *Config) error {
+	path := filepath.Join(l.profileDir, string(l.profile)+".json")
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadFile(%s): %v", path, err)
+	}
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("json.Unmarshal(%s): %v", path, err)
+	}
+	for k, v := range raw {
+		switch t := v.(type) {
+		case string:
+			c.set(k, t, SourceFile)
+		case map[string]interface{}, []interface{}, nil:
+			return fmt.Errorf("%s: key %q must be a scalar value", path, k)
+		default:
+			c.set(k, fmt.Sprint(t), SourceFile)
+		}
+	}
+	return nil
+}
+
+func (l *loader) loadEnv(c *Config) {
+	prefix := strings.ToUpper(l.envPrefix) + "_"
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		idx := strings.Index(kv, "=")
+		if idx < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(kv[:idx], prefix))
+		c.set(key, kv[idx+1:], SourceEnv)
+	}
+}
+
+func (l *loader) loadSecrets(c *Config) error {
+	entries, err := ioutil.ReadDir(l.secretsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadDir(%s): %v", l.secretsDir, err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(l.secretsDir, entry.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("ioutil.ReadFile(%s): %v", path, err)
+		}
+		c.set(entry.Name(), strings.TrimSpace(string(b)), SourceSecret)
+		v := c.values[entry.Name()]
+		v.Secret = true
+		c.values[entry.Name()] = v
+	}
+	return nil
+}
+
+func (c *Config) set(key, value string, source Source) {
+	c.values[key] = Value{Key: key, Value: value, Source: source}
+}
+
+func (c *Config) Profile() Profile {
+	return c.profile
+}
+
+func (c *Config) Lookup(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.values[key]
+	return v.Value, ok
+}
+
+func (c *Config) String(key string) string {
+	v, _ := c.Lookup(key)
+	return v
+}
+
+func (c *Config) Int(key string) (int, error) {
+	i, err := strconv.Atoi(c.String(key))
+	if err != nil {
+		return 0, fmt.Errorf("strconv.Atoi(%s): %v", key, err)
+	}
+	return i, nil
+}
+
+func (c *Config) Bool(key string) (bool, error) {
+	b, err := strconv.ParseBool(c.String(key))
+	if err != nil {
+		return false, fmt.Errorf("strconv.ParseBool(%s): %v", key, err)
+	}
+	return b, nil
+}
+
+func (c *Config) Duration(key string) (time.Duration, error) {
+	d, err := time.ParseDuration(c.String(key))
+	if err != nil {
+		return 0, fmt.Errorf("time.ParseDuration(%s): %v", key, err)
+	}
+	return d, nil
+}
+
+// Values returns every resolved value sorted by key, secret values are redacted
+func (c *Config) Values() []Value {
+	c.mu.RLock()
+	values := make([]Value, 0, len(c.values))
+	for _, v := range c.values {
+		if v.Secret {
+			v.Value = redacted
+		}
+		values = append(values, v)
+	}
+	c.mu.RUnlock()
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values
+}
+
+// Redacted is a flat key/value dump of the config that is safe to log or serve on an admin endpoint
+func (c *Config) Redacted() map[string]string {
+	values := c.Values()
+	m := make(map[string]string, len(values))
+	for _, v := range values {
+		m[v.Key] = v.Value
+	}
+	return m
+}
+
+// Provenance maps every key to the source that won the merge
+func (c *Config) Provenance() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m := make(map[string]string, len(c.values))
+	for k, v := range c.values {
+		m[k] = v.Source.String()
+	}
+	return m
+}
+
+// Log writes a single startup entry describing the resolved profile and where every value came from
+func (c *Config) Log(logger *zap.SugaredLogger) {
+	logger.Infow("config loaded",
+		"profile", c.profile,
+		"values", c.Redacted(),
+		"provenance", c.Provenance(),
+	)
+}
@@ -0,0 +1,80 @@
+package configx
+
+import (
+	"os"
+	"strings"
+)
+
+type Profile string
+
+const (
+	ProfileDev     Profile = "dev"
+	ProfileStaging Profile = "staging"
+	ProfileProd    Profile = "prod"
+)
+
+// ResolveProfile picks our config profile, in order of preference
+//   - ENVIRONMENT env variable set explicitly on the service
+//   - a -dev/-staging/-prod suffix (or prefix) on K_SERVICE, cloud run sets this to our service name
+//   - the same naming convention on K_REVISION, once the -00003-wil cloud run appends to it is dropped
+//   - prod if we are running on cloud run at all, otherwise dev for local development
+func ResolveProfile() Profile {
+	if env := os.Getenv("ENVIRONMENT"); env != "" {
+		if p, ok := parseProfile(env); ok {
+			return p
+		}
+	}
+
+	if p, ok := profileFromName(os.Getenv("K_SERVICE")); ok {
+		return p
+	}
+	if p, ok := profileFromName(trimRevisionSuffix(os.Getenv("K_REVISION"))); ok {
+		return p
+	}
+
+	if os.Getenv("K_SERVICE") != "" {
+		return ProfileProd
+	}
+	return ProfileDev
+}
+
+func parseProfile(s string) (Profile, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "dev", "development", "local":
+		return ProfileDev, true
+	case "staging", "stage", "stg":
+		return ProfileStaging, true
+	case "prod", "production", "prd":
+		return ProfileProd, true
+	}
+	return "", false
+}
+
+// profileFromName looks at the first and last dash separated segment of a service name, eg "orders-staging" or
+// "staging-orders". a segment in the middle is part of the name, "orders-local-cache" is no dev service
+func profileFromName(name string) (Profile, bool) {
+	if name == "" {
+		return "", false
+	}
+	segments := strings.Split(name, "-")
+	if p, ok := parseProfile(segments[len(segments)-1]); ok {
+		return p, true
+	}
+	return parseProfile(segments[0])
+}
+
+// trimRevisionSuffix drops the "-00003-wil" cloud run appends to the service name of a revision, its three random
+// letters could otherwise read as "dev" or "stg". a name without that exact suffix, eg one set with
+// --revision-suffix, is returned as is
+func trimRevisionSuffix(revision string) string {
+	segments := strings.Split(revision, "-")
+	if len(segments) < 3 {
+		return revision
+	}
+	number, random := segments[len(segments)-2], segments[len(segments)-1]
+	if len(number) != 5 || len(random) != 3 || strings.Trim(number, "0123456789") != "" ||
+		strings.Trim(random, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return revision
+	}
+	return strings.Join(segments[:len(segments)-2], "-")
+}
@@ -0,0 +1,55 @@
+package configx
+
+import (
+	"os"
+	"testing"
+)
+
+// setenv sets the env of ResolveProfile for the rest of the test, empty values unset it
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range env {
+		old, had := os.LookupEnv(key)
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+		key := key
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, old)
+				return
+			}
+			os.Unsetenv(key)
+		})
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		revision string
+		want     Profile
+	}{
+		{name: "local", want: ProfileDev},
+		{name: "service_suffix", service: "orders-staging", revision: "orders-staging-00003-wil", want: ProfileStaging},
+		{name: "service_prefix", service: "dev-orders", revision: "dev-orders-00003-wil", want: ProfileDev},
+		// the random letters of a revision are no profile, whatever they spell
+		{name: "random_dev", service: "orders", revision: "orders-00003-dev", want: ProfileProd},
+		{name: "random_stg", service: "orders", revision: "orders-00012-stg", want: ProfileProd},
+		// neither is a segment in the middle of a name
+		{name: "middle", service: "orders-local-cache", revision: "orders-local-cache-00001-abc", want: ProfileProd},
+		{name: "revision_only", revision: "orders-staging-00003-wil", want: ProfileStaging},
+		{name: "revision_suffix_flag", revision: "orders-prod", want: ProfileProd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, map[string]string{"ENVIRONMENT": "", "K_SERVICE": tt.service, "K_REVISION": tt.revision})
+			if got := ResolveProfile(); got != tt.want {
+				t.Errorf("ResolveProfile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package configx
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Subscribe reloads c for every message published on topicID until ctx is done, an empty message reloads and a json
+// object of string values overrides them, see Override. a push subscription would only reach one of our instances, so
+// every instance pulls from a subscription of its own, subscriptionID, which we delete once ctx is done and which pub/sub
+// expires a day after we are gone when we couldn't. with cpu only allocated during requests an idle instance picks up a
+// change with its next request
+func (c *Config) Subscribe(ctx context.Context, client *pubsub.Client, topicID, subscriptionID string, logger *zap.SugaredLogger) error {
+	sub, err := client.CreateSubscription(ctx, subscriptionID, pubsub.SubscriptionConfig{
+		Topic:            client.Topic(topicID),
+		AckDeadline:      10 * time.Second,
+		ExpirationPolicy: 24 * time.Hour,
+		// a change published before we started is already part of what we loaded
+		RetentionDuration: 10 * time.Minute,
+	})
+	if err != nil {
+		return fmt.Errorf("client.CreateSubscription(%s): %v", subscriptionID, err)
+	}
+	defer func() {
+		// ctx is done by now
+		deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sub.Delete(deleteCtx); err != nil {
+			logger.Warnw("deleting our config subscription", "subscription", subscriptionID, "err", err)
+		}
+	}()
+
+	// changes are applied in the order they arrive, one at a time
+	sub.ReceiveSettings.NumGoroutines = 1
+	sub.ReceiveSettings.MaxOutstandingMessages = 1
+	err = sub.Receive(ctx, func(ctx context.Context, message *pubsub.Message) {
+		// a change we can't apply won't apply any better redelivered, so everything is acked
+		defer message.Ack()
+		var updates map[string]string
+		if len(message.Data) > 0 {
+			if err := json.Unmarshal(message.Data, &updates); err != nil {
+				logger.Errorw("config change is not a json object of string values", "message_id", message.ID, "err", err)
+				return
+			}
+		}
+		changed, err := c.Override(updates)
+		if err != nil {
+			logger.Errorw("applying config change", "message_id", message.ID, "err", err)
+			return
+		}
+		logger.Infow("config changed", "message_id", message.ID, "changed", changed)
+	})
+	if err != nil {
+		return fmt.Errorf("sub.Receive(): %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package configx
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// ErrRejected wraps every reload a validator or the override rules turned down, nothing changed
+var ErrRejected = errors.New("configx: reload rejected")
+
+type listener struct {
+	keys map[string]bool
+	fn   func(c *Config, changed []string)
+}
+
+// Validate has every reload checked by fn before it is swapped in, fn sees the config as it would be afterwards. a
+// reload fn returns an error for is rejected as a whole
+func (c *Config) Validate(fn func(c *Config) error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.validators = append(c.validators, fn)
+}
+
+// OnChange calls fn once a reload changed any of keys, or any key at all when none are given. listeners run in the
+// order they were added, right after the swap on the goroutine that reloaded, and read the new values from c. they run
+// once the reload let go of its lock, so a listener may reload c itself, and a listener of an earlier reload racing a
+// later one still reads the latest values
+func (c *Config) OnChange(fn func(c *Config, changed []string), keys ...string) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	l := listener{fn: fn}
+	if len(keys) > 0 {
+		l.keys = map[string]bool{}
+		for _, key := range keys {
+			l.keys[key] = true
+		}
+	}
+	c.listeners = append(c.listeners, l)
+}
+
+// Reload reads every layer again, eg a secret mounted from the latest version in secret manager, keeps our overrides
+// on top and swaps the result in once every validator accepted it. it returns the keys whose value changed
+func (c *Config) Reload() ([]string, error) {
+	return c.notify(c.apply(nil))
+}
+
+// Override sets values above every other layer until the instance goes away, an empty value drops the override of its
+// key. only keys we already know can be overridden, and never secrets. the other layers are read again like Reload
+// does, it returns the keys whose value changed
+func (c *Config) Override(values map[string]string) ([]string, error) {
+	return c.notify(c.apply(values))
+}
+
+// notify calls the listeners interested in changed, outside of reloadMu
+func (c *Config) notify(changed []string, listeners []listener, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if l.interested(changed) {
+			l.fn(c, changed)
+		}
+	}
+	return changed, nil
+}
+
+// apply swaps in the reloaded config and returns the keys that changed along with the listeners to tell about them
+func (c *Config) apply(updates map[string]string) ([]string, []listener, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if c.loader == nil {
+		return nil, nil, fmt.Errorf("configx: only a config made by Load can be reloaded")
+	}
+	next, err := c.loader.load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("c.loader.load(): %v", err)
+	}
+
+	c.mu.RLock()
+	overrides := make(map[string]string, len(c.overrides)+len(updates))
+	for k, v := range c.overrides {
+		overrides[k] = v
+	}
+	c.mu.RUnlock()
+	for k, v := range updates {
+		if v == "" {
+			delete(overrides, k)
+			continue
+		}
+		overrides[k] = v
+	}
+	for k, v := range overrides {
+		current, ok := next.values[k]
+		switch {
+		case !ok:
+			return nil, nil, fmt.Errorf("%w: unknown key %q", ErrRejected, k)
+		case current.Secret:
+			return nil, nil, fmt.Errorf("%w: %q is a secret", ErrRejected, k)
+		}
+		next.set(k, v, SourceOverride)
+	}
+	next.overrides = overrides
+
+	for _, validate := range c.validators {
+		if err := validate(next); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+
+	c.mu.Lock()
+	changed := []string{}
+	for k, v := range next.values {
+		if old, ok := c.values[k]; !ok || old.Value != v.Value {
+			changed = append(changed, k)
+		}
+	}
+	for k := range c.values {
+		if _, ok := next.values[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	c.values, c.overrides = next.values, next.overrides
+	c.mu.Unlock()
+
+	sort.Strings(changed)
+	return changed, append([]listener(nil), c.listeners...), nil
+}
+
+func (l listener) interested(changed []string) bool {
+	if len(changed) == 0 {
+		return false
+	}
+	if l.keys == nil {
+		return true
+	}
+	for _, key := range changed {
+		if l.keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadResponse is what ReloadHandler answers with
+type ReloadResponse struct {
+	Changed []string `json:"changed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ReloadHandler reloads on POST, a body with a json object of string values overrides them. it belongs on an admin
+// endpoint, anyone who can reach it can change our config
+func (c *Config) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if request.Method != http.MethodPost {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(writer).Encode(&ReloadResponse{Error: "reload with a POST"})
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, 64<<10))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(writer).Encode(&ReloadResponse{Error: err.Error()})
+			return
+		}
+		var updates map[string]string
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &updates); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(writer).Encode(&ReloadResponse{Error: "body has to be a json object of string values"})
+				return
+			}
+		}
+		changed, err := c.Override(updates)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrRejected) {
+				status = http.StatusUnprocessableEntity
+			}
+			writer.WriteHeader(status)
+			json.NewEncoder(writer).Encode(&ReloadResponse{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(writer).Encode(&ReloadResponse{Changed: changed})
+	})
+}
@@ -0,0 +1,66 @@
+package configx
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOnChangeMayReload(t *testing.T) {
+	c, err := Load(WithProfile(ProfileDev), WithDefaults(map[string]string{"log_level": "debug", "max_in_flight": "80"}))
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	// a listener reloading c would deadlock if listeners ran while the reload still held its lock
+	var seen []string
+	c.OnChange(func(c *Config, changed []string) {
+		seen = append(seen, c.String("max_in_flight"))
+		if c.String("log_level") == "info" {
+			if _, err := c.Override(map[string]string{"max_in_flight": "40"}); err != nil {
+				t.Errorf("c.Override() in a listener: %v", err)
+			}
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.Override(map[string]string{"log_level": "info"}); err != nil {
+			t.Errorf("c.Override(): %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("c.Override() deadlocked on a listener that reloads")
+	}
+	if got := c.String("max_in_flight"); got != "40" {
+		t.Errorf("max_in_flight = %q, want 40", got)
+	}
+	if len(seen) != 2 {
+		t.Errorf("listener ran %d times, want 2", len(seen))
+	}
+}
+
+func TestRedactedDuringReload(t *testing.T) {
+	c, err := Load(WithProfile(ProfileDev), WithDefaults(map[string]string{"log_level": "debug"}))
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	// run with -race, /config reads our values while an override swaps them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if _, err := c.Override(map[string]string{"log_level": strconv.Itoa(i)}); err != nil {
+				t.Errorf("c.Override(): %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if got := c.Redacted()["log_level"]; got == "" {
+			t.Fatalf("Redacted() lost log_level")
+		}
+	}
+	<-done
+}
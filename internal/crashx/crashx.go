@@ -0,0 +1,212 @@
+package crashx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Breadcrumb is what we remember of a recent request, Status stays 0 while it is in flight
+type Breadcrumb struct {
+	Start      time.Time `json:"start"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	SpanID     string    `json:"span_id,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+}
+
+// Recorder keeps breadcrumbs of our most recent requests and writes them out as one CRITICAL entry when a panic
+// escapes a handler or memory gets close to our limit. cloud run kills an instance that runs out of memory without a
+// word in our logs, the entry we managed to write just before is often all there is to go on
+type Recorder struct {
+	logger    *logx.AppLogger
+	now       func() time.Time
+	threshold uint64
+	interval  time.Duration
+
+	mu     sync.Mutex
+	crumbs []*Breadcrumb
+	next   int
+	// armed is cleared once we flushed for memory, and set again once memory drops back below 90% of threshold
+	armed bool
+}
+
+type Option func(r *Recorder)
+
+// WithCapacity keeps the last n requests, defaults to 64
+func WithCapacity(n int) Option {
+	return func(r *Recorder) {
+		r.crumbs = make([]*Breadcrumb, n)
+	}
+}
+
+// WithMemoryThreshold flushes once the memory the go runtime holds crosses bytes, eg 90% of memx.Tuning.ContainerLimit.
+// without one only panics flush
+func WithMemoryThreshold(bytes uint64) Option {
+	return func(r *Recorder) {
+		r.threshold = bytes
+	}
+}
+
+// WithMemoryInterval checks memory every d, defaults to 5 seconds
+func WithMemoryInterval(d time.Duration) Option {
+	return func(r *Recorder) {
+		r.interval = d
+	}
+}
+
+// WithClock replaces time.Now, for the times on our breadcrumbs
+func WithClock(now func() time.Time) Option {
+	return func(r *Recorder) {
+		r.now = now
+	}
+}
+
+func New(logger *logx.AppLogger, opts ...Option) *Recorder {
+	r := &Recorder{logger: logger, now: time.Now, interval: 5 * time.Second, crumbs: make([]*Breadcrumb, 64), armed: true}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Middleware records a breadcrumb for every request and flushes them when the handler panics, the panic carries on
+// afterwards so net/http still aborts the response. it has to run after the middleware that starts the span
+func (r *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		crumb := &Breadcrumb{Start: r.now(), Method: request.Method, Path: request.URL.Path}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			crumb.TraceID = sc.TraceID().String()
+			crumb.SpanID = sc.SpanID().String()
+		}
+		r.add(crumb)
+
+		wrapped, rec := httpx.Record(writer, 0)
+		defer func() {
+			r.finish(crumb, rec.Status)
+			if p := recover(); p != nil {
+				// an aborted handler is net/http's way of bailing out quietly, not a crash
+				if p != http.ErrAbortHandler {
+					r.flush(ctx, "panic", zap.String("panic", fmt.Sprint(p)), zap.ByteString("stack", debug.Stack()))
+				}
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(wrapped, request)
+	})
+}
+
+// Recover flushes our breadcrumbs if the calling goroutine panics, before letting the panic crash us as it would have
+// anyway. defer it at the top of main and of goroutines we start ourselves
+func (r *Recorder) Recover() {
+	if p := recover(); p != nil {
+		// whoever deferred Recover has no context to give us, and the flush has to happen either way
+		r.flush(context.Background(), "panic", zap.String("panic", fmt.Sprint(p)), zap.ByteString("stack", debug.Stack()))
+		panic(p)
+	}
+}
+
+// Watch checks memory every interval until ctx is done, it does nothing without a threshold
+func (r *Recorder) Watch(ctx context.Context) {
+	if r.threshold == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.checkMemory(ctx)
+		}
+	}
+}
+
+func (r *Recorder) checkMemory(ctx context.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	// what the runtime got from the os minus what it gave back, the closest we get to what counts against our limit
+	used := mem.Sys - mem.HeapReleased
+
+	r.mu.Lock()
+	flush := r.armed && used >= r.threshold
+	if flush {
+		r.armed = false
+	} else if !r.armed && used < r.threshold/10*9 {
+		r.armed = true
+	}
+	r.mu.Unlock()
+
+	if flush {
+		r.flush(ctx, "memory",
+			zap.Uint64("memory_bytes", used),
+			zap.Uint64("threshold_bytes", r.threshold),
+			zap.Uint64("heap_inuse_bytes", mem.HeapInuse),
+			zap.Int("goroutines", runtime.NumGoroutine()),
+		)
+	}
+}
+
+func (r *Recorder) add(crumb *Breadcrumb) {
+	r.mu.Lock()
+	r.crumbs[r.next] = crumb
+	r.next = (r.next + 1) % len(r.crumbs)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) finish(crumb *Breadcrumb, status int) {
+	r.mu.Lock()
+	crumb.Status = status
+	crumb.DurationMS = r.now().Sub(crumb.Start).Milliseconds()
+	r.mu.Unlock()
+}
+
+// Breadcrumbs returns a copy of what we remember, oldest first
+func (r *Recorder) Breadcrumbs() []Breadcrumb {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	crumbs := make([]Breadcrumb, 0, len(r.crumbs))
+	for i := range r.crumbs {
+		if c := r.crumbs[(r.next+i)%len(r.crumbs)]; c != nil {
+			crumbs = append(crumbs, *c)
+		}
+	}
+	return crumbs
+}
+
+// flush writes our breadcrumbs as a single CRITICAL entry and syncs, we may not get another chance. it goes straight
+// to the core, the logger itself would turn DPanic into a panic of its own in development
+func (r *Recorder) flush(ctx context.Context, reason string, fields ...zap.Field) {
+	crumbs := r.Breadcrumbs()
+	inFlight := 0
+	for _, c := range crumbs {
+		if c.Status == 0 {
+			inFlight++
+		}
+	}
+	fields = append(fields,
+		zap.String("reason", reason),
+		zap.Int("in_flight", inFlight),
+		zap.Any("breadcrumbs", crumbs),
+	)
+
+	logger := r.logger.WrapTraceContext(ctx).Desugar()
+	entry := zapcore.Entry{Level: zapcore.DPanicLevel, Time: time.Now(), Message: "crash breadcrumbs"}
+	if ce := logger.Core().Check(entry, nil); ce != nil {
+		ce.Write(fields...)
+	}
+	logger.Sync()
+}
@@ -0,0 +1,133 @@
+package ctxutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// ErrBudgetExceeded is matched by every BudgetExceededError
+var ErrBudgetExceeded = errors.New("ctxutil: deadline budget exceeded")
+
+// BudgetExceededError tells which step ran out of time and how much time it had left
+type BudgetExceededError struct {
+	Step      string
+	Remaining time.Duration
+	// Needed is what the step asked for, zero when the step started but didn't finish in time
+	Needed time.Duration
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Needed > 0 {
+		return fmt.Sprintf("ctxutil: budget exceeded before %s: %s left, %s needed", e.Step, e.Remaining.Round(time.Millisecond), e.Needed)
+	}
+	return fmt.Sprintf("ctxutil: budget exceeded during %s", e.Step)
+}
+
+// Is matches ErrBudgetExceeded and context.DeadlineExceeded, so code that only knows about context errors still
+// treats a blown budget as a timeout
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded || target == context.DeadlineExceeded
+}
+
+// Budget splits the deadline of a request across the sequential calls made to serve it. every step gets a deadline
+// within the budget, and a step that can't possibly finish in what is left fails right away instead of eating the
+// rest of the request timeout
+type Budget struct {
+	deadline time.Time
+	now      func() time.Time
+}
+
+type BudgetOption func(c *budgetConfig)
+
+type budgetConfig struct {
+	reserve  time.Duration
+	fallback time.Duration
+	now      func() time.Time
+}
+
+// WithReserve holds back d at the end of the deadline for encoding and writing our response
+func WithReserve(d time.Duration) BudgetOption {
+	return func(c *budgetConfig) {
+		c.reserve = d
+	}
+}
+
+// WithFallback is the budget when ctx has no deadline, cloud run doesn't put its request timeout on our context so
+// pass the --timeout of the service here. defaults to 5 minutes, the cloud run default
+func WithFallback(d time.Duration) BudgetOption {
+	return func(c *budgetConfig) {
+		c.fallback = d
+	}
+}
+
+// NewBudget starts a budget from the deadline of ctx
+func NewBudget(ctx context.Context, opts ...BudgetOption) *Budget {
+	c := &budgetConfig{fallback: 5 * time.Minute, now: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = c.now().Add(c.fallback)
+	}
+	return &Budget{deadline: deadline.Add(-c.reserve), now: c.now}
+}
+
+// Deadline is when the budget runs out, the reserve already taken off
+func (b *Budget) Deadline() time.Time {
+	return b.deadline
+}
+
+// Remaining is what is left of the budget, never negative
+func (b *Budget) Remaining() time.Duration {
+	remaining := b.deadline.Sub(b.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Step starts a step that usually needs about need, it fails fast with a BudgetExceededError when less than that is
+// left. the step may use everything that is left, pass need 0 to only check the budget isn't spent already
+func (b *Budget) Step(ctx context.Context, name string, need time.Duration) (context.Context, context.CancelFunc, error) {
+	return b.step(ctx, name, need, b.deadline)
+}
+
+// Split starts one of steps sequential steps that are still left to run, including this one, and bounds it to an even
+// share of what remains so a slow first call can't starve the ones after it
+func (b *Budget) Split(ctx context.Context, name string, steps int) (context.Context, context.CancelFunc, error) {
+	if steps < 1 {
+		steps = 1
+	}
+	return b.step(ctx, name, 0, b.now().Add(b.Remaining()/time.Duration(steps)))
+}
+
+func (b *Budget) step(ctx context.Context, name string, need time.Duration, deadline time.Time) (context.Context, context.CancelFunc, error) {
+	remaining := b.Remaining()
+	trace.SpanFromContext(ctx).AddEvent("budget.step", trace.WithAttributes(
+		attribute.String("budget.step", name),
+		attribute.Int64("budget.remaining_ms", remaining.Milliseconds()),
+		attribute.Int64("budget.need_ms", need.Milliseconds()),
+	))
+	if remaining <= 0 || remaining < need {
+		return ctx, func() {}, &BudgetExceededError{Step: name, Remaining: remaining, Needed: need}
+	}
+	stepCtx, cancel := context.WithDeadline(ctx, deadline)
+	return stepCtx, cancel, nil
+}
+
+// Wrap turns err into a BudgetExceededError when the step ran into its deadline, other errors are returned as is.
+// pass it the error of a call made with the context of the step
+func (b *Budget) Wrap(stepCtx context.Context, name string, err error) error {
+	if err == nil || errors.Is(err, ErrBudgetExceeded) {
+		return err
+	}
+	if errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+		return &BudgetExceededError{Step: name, Remaining: b.Remaining()}
+	}
+	return err
+}
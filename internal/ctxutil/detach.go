@@ -0,0 +1,21 @@
+package ctxutil
+
+import (
+	"context"
+	"time"
+)
+
+// Detach keeps the values of ctx, our trace and logging fields, without inheriting its deadline or cancellation. use
+// it for work that has to outlive the request that started it
+func Detach(ctx context.Context) context.Context {
+	return detached{ctx}
+}
+
+type detached struct {
+	parent context.Context
+}
+
+func (d detached) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detached) Done() <-chan struct{}             { return nil }
+func (d detached) Err() error                        { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
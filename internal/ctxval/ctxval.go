@@ -0,0 +1,164 @@
+package ctxval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	mu       sync.Mutex
+	registry = map[string]*Key{}
+)
+
+// Key is one value a request context carries, registered under a name so Dump can tell what ctx holds. a Key is
+// stored in a package variable of the package that owns the value, which wraps it in accessors taking and returning
+// the actual type, or use String and Bool for values that are just that
+type Key struct {
+	name   string
+	format func(v interface{}) string
+}
+
+type Option func(k *Key)
+
+// WithFormat has Dump show values as format returns them rather than with %+v, eg to leave out personal data or to
+// read a value that changes under atomics
+func WithFormat(format func(v interface{}) string) Option {
+	return func(k *Key) {
+		k.format = format
+	}
+}
+
+// Redacted has Dump show that ctx carries a value but not what it is, for secrets and request bodies
+func Redacted() Option {
+	return WithFormat(func(interface{}) string {
+		return "redacted"
+	})
+}
+
+// New registers a key under name, meant for package variables. a second key under the same name panics at init rather
+// than have two packages read each other's values in a dump
+func New(name string, opts ...Option) *Key {
+	k := &Key{name: name, format: func(v interface{}) string { return fmt.Sprintf("%+v", v) }}
+	for _, opt := range opts {
+		opt(k)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("ctxval: " + name + " is registered twice")
+	}
+	registry[name] = k
+	return k
+}
+
+// Name is what the key was registered under
+func (k *Key) Name() string {
+	return k.name
+}
+
+// With returns a copy of ctx carrying v
+func (k *Key) With(ctx context.Context, v interface{}) context.Context {
+	return context.WithValue(ctx, k, v)
+}
+
+// Value returns what ctx carries, false when nothing was stored or nil was
+func (k *Key) Value(ctx context.Context) (interface{}, bool) {
+	v := ctx.Value(k)
+	return v, v != nil
+}
+
+// String is a Key whose values are strings
+type String struct {
+	key *Key
+}
+
+// NewString registers a key for strings under name, see New
+func NewString(name string, opts ...Option) String {
+	return String{key: New(name, opts...)}
+}
+
+// With returns a copy of ctx carrying v
+func (k String) With(ctx context.Context, v string) context.Context {
+	return k.key.With(ctx, v)
+}
+
+// Value returns the string ctx carries
+func (k String) Value(ctx context.Context) (string, bool) {
+	v, ok := k.key.Value(ctx)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+// Bool is a Key whose values are bools
+type Bool struct {
+	key *Key
+}
+
+// NewBool registers a key for bools under name, see New
+func NewBool(name string, opts ...Option) Bool {
+	return Bool{key: New(name, opts...)}
+}
+
+// With returns a copy of ctx carrying v
+func (k Bool) With(ctx context.Context, v bool) context.Context {
+	return k.key.With(ctx, v)
+}
+
+// Value returns the bool ctx carries, false when it carries none
+func (k Bool) Value(ctx context.Context) bool {
+	v, ok := k.key.Value(ctx)
+	return ok && v.(bool)
+}
+
+// Dump formats every registered value ctx carries by the name of its key, for logging what a request looked like to
+// a handler while troubleshooting. values of context.WithValue calls outside of this package aren't in it
+func Dump(ctx context.Context) map[string]string {
+	mu.Lock()
+	keys := make([]*Key, 0, len(registry))
+	for _, k := range registry {
+		keys = append(keys, k)
+	}
+	mu.Unlock()
+
+	dump := map[string]string{}
+	for _, k := range keys {
+		if v, ok := k.Value(ctx); ok {
+			dump[k.name] = k.format(v)
+		}
+	}
+	return dump
+}
+
+// Names lists every registered key, sorted
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler responds with the Dump of the request it serves as json, mount it behind the middleware whose values you
+// want to see and keep it away from the public, eg only for requests tracex.Debug forced
+func Handler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body, err := json.MarshalIndent(Dump(request.Context()), "", "  ")
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+		writer.Write(append(body, '\n'))
+	}
+}
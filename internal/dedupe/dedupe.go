@@ -0,0 +1,304 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/dedupe"
+
+var (
+	// ErrDuplicate is returned by Do for a key that was already processed
+	ErrDuplicate = errors.New("dedupe: already processed")
+	// ErrInProgress is returned by Do for a key another request is processing right now
+	ErrInProgress = errors.New("dedupe: in progress")
+)
+
+// Entry is what a Store keeps per key, in progress until whoever claimed the key is done with it
+type Entry struct {
+	// Fingerprint tells apart two requests that were given the same key, eg a hash of a request body
+	Fingerprint string
+	Done        bool
+	// LockedUntil is when an entry still in progress stops counting, so a claim by an instance that died mid request
+	// doesn't hold its key until it expires
+	LockedUntil time.Time
+	Expires     time.Time
+	// Value is whatever the claimer kept once it was done, eg the response to replay
+	Value []byte
+}
+
+// live reports if an entry still counts at now
+func (e *Entry) live(now time.Time) bool {
+	if now.After(e.Expires) {
+		return false
+	}
+	return e.Done || now.Before(e.LockedUntil)
+}
+
+// Store is where pub/sub messages, cloud tasks and http requests record what they processed. Claim stores entry when
+// key has no live entry and returns nil, otherwise it returns the live entry untouched. a store shared by every
+// instance, like Firestore, lets only one of them claim a key
+type Store interface {
+	Claim(ctx context.Context, key string, entry *Entry) (*Entry, error)
+	// Complete replaces the entry of key once its processing is done
+	Complete(ctx context.Context, key string, entry *Entry) error
+	// Release drops the entry of key, so it can be processed again
+	Release(ctx context.Context, key string) error
+}
+
+// Sweeper is implemented by stores that need expired entries deleted for them, see cmd/dedupesweep
+type Sweeper interface {
+	// Sweep deletes the entries that expired before now and returns how many it deleted
+	Sweep(ctx context.Context, now time.Time) (int, error)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	now     func() time.Time
+}
+
+// NewMemory keeps entries on this instance, only good for a single instance or local development. expired entries are
+// swept as new ones are claimed
+func NewMemory() Store {
+	return &memoryStore{entries: map[string]*Entry{}, now: time.Now}
+}
+
+func (m *memoryStore) Claim(ctx context.Context, key string, entry *Entry) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+	if existing, ok := m.entries[key]; ok && existing.live(now) {
+		copied := *existing
+		return &copied, nil
+	}
+	copied := *entry
+	m.entries[key] = &copied
+	return nil, nil
+}
+
+func (m *memoryStore) Complete(ctx context.Context, key string, entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *entry
+	m.entries[key] = &copied
+	return nil
+}
+
+func (m *memoryStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memoryStore) Sweep(ctx context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sweep(now), nil
+}
+
+func (m *memoryStore) sweep(now time.Time) int {
+	swept := 0
+	for k, e := range m.entries {
+		if now.After(e.Expires) {
+			delete(m.entries, k)
+			swept++
+		}
+	}
+	return swept
+}
+
+// Deduper processes every key once for one source of work, eg a push subscription, a task queue or an api. sources
+// can share a store, their keys are kept apart. a key whose processing fails is released, so the retry of its sender
+// runs again
+type Deduper struct {
+	store   Store
+	source  string
+	ttl     time.Duration
+	lockTTL time.Duration
+	now     func() time.Time
+
+	checks metric.Int64Counter
+}
+
+type Option func(d *Deduper)
+
+// WithTTL remembers processed keys for d, defaults to 24 hours. match it to how long the sender keeps retrying, eg 7
+// days for pub/sub message retention
+func WithTTL(d time.Duration) Option {
+	return func(dd *Deduper) {
+		dd.ttl = d
+	}
+}
+
+// WithLockTTL has a duplicate of a key in progress wait for it for at most d, defaults to 10 minutes. set it past the
+// longest processing can take, a claim older than it is taken over and its key processed twice
+func WithLockTTL(d time.Duration) Option {
+	return func(dd *Deduper) {
+		dd.lockTTL = d
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through ttls
+func WithClock(now func() time.Time) Option {
+	return func(dd *Deduper) {
+		dd.now = now
+	}
+}
+
+// New dedupes the keys of source in store, source names the work in our metrics, eg pubsub or http
+func New(store Store, source string, opts ...Option) *Deduper {
+	d := &Deduper{
+		store:   store,
+		source:  source,
+		ttl:     24 * time.Hour,
+		lockTTL: 10 * time.Minute,
+		now:     time.Now,
+		checks: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("dedupe.checks",
+			metric.WithDescription("keys checked by source and outcome, duplicate over all of them is the duplicate rate")),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Claim claims key for processing and returns nil, or returns the live entry of key when it was claimed before. it is
+// for callers that keep a value or a fingerprint, most want Do
+func (d *Deduper) Claim(ctx context.Context, key, fingerprint string) (*Entry, error) {
+	now := d.now()
+	existing, err := d.store.Claim(ctx, d.source+":"+key, &Entry{Fingerprint: fingerprint, LockedUntil: now.Add(d.lockTTL), Expires: now.Add(d.ttl)})
+	if err != nil {
+		d.count(ctx, "failed")
+		return nil, fmt.Errorf("d.store.Claim(): %v", err)
+	}
+	switch {
+	case existing == nil:
+		d.count(ctx, "first")
+	case existing.Done:
+		d.count(ctx, "duplicate")
+	default:
+		d.count(ctx, "in_progress")
+	}
+	return existing, nil
+}
+
+// Complete marks key done, keeping value for its duplicates
+func (d *Deduper) Complete(ctx context.Context, key, fingerprint string, value []byte) error {
+	entry := &Entry{Fingerprint: fingerprint, Done: true, Expires: d.now().Add(d.ttl), Value: value}
+	if err := d.store.Complete(ctx, d.source+":"+key, entry); err != nil {
+		return fmt.Errorf("d.store.Complete(): %v", err)
+	}
+	return nil
+}
+
+// Release forgets key, so it is processed again
+func (d *Deduper) Release(ctx context.Context, key string) error {
+	d.count(ctx, "released")
+	if err := d.store.Release(ctx, d.source+":"+key); err != nil {
+		return fmt.Errorf("d.store.Release(): %v", err)
+	}
+	return nil
+}
+
+// Seen marks key done right away and reports if it already was, for work that can't be retried once it started. a
+// key of work that can fail and be retried wants Do, Seen keeps it even when the work failed
+func (d *Deduper) Seen(ctx context.Context, key string) (bool, error) {
+	existing, err := d.Claim(ctx, key, "")
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		return true, nil
+	}
+	if err := d.Complete(ctx, key, "", nil); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// Do runs fn unless key was already processed, ErrDuplicate, or is being processed, ErrInProgress. key is completed
+// when fn succeeds and released when it fails, even once ctx is done
+func (d *Deduper) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	existing, err := d.Claim(ctx, key, "")
+	switch {
+	case err != nil:
+		return err
+	case existing != nil && existing.Done:
+		return ErrDuplicate
+	case existing != nil:
+		return ErrInProgress
+	}
+
+	// ctx may be done by the time fn returns, our bookkeeping still has to happen
+	settle := func(fn func(ctx context.Context) error) error {
+		ctx, cancel := context.WithTimeout(ctxutil.Detach(ctx), 5*time.Second)
+		defer cancel()
+		return fn(ctx)
+	}
+	if err := fn(ctx); err != nil {
+		if releaseErr := settle(func(ctx context.Context) error { return d.Release(ctx, key) }); releaseErr != nil {
+			return fmt.Errorf("%w, and releasing its key: %v", err, releaseErr)
+		}
+		return err
+	}
+	return settle(func(ctx context.Context) error { return d.Complete(ctx, key, "", nil) })
+}
+
+// Middleware runs each request once per key, eg the X-CloudTasks-TaskName of a cloud tasks delivery. a duplicate is
+// acknowledged with a 200 so its sender stops retrying, one still in progress gets a 409 to be retried later, and a
+// response of 5xx releases its key. requests key returns nothing for pass through
+func (d *Deduper) Middleware(key func(request *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			k := key(request)
+			if k == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			ran := false
+			err := d.Do(request.Context(), k, func(ctx context.Context) error {
+				ran = true
+				wrapped, rec := httpx.Record(writer, 0)
+				next.ServeHTTP(wrapped, request)
+				if rec.Status >= http.StatusInternalServerError {
+					return fmt.Errorf("status %d", rec.Status)
+				}
+				return nil
+			})
+			switch {
+			case ran:
+				// the handler responded, failing to settle its key only means a retry may run it again
+			case errors.Is(err, ErrDuplicate):
+				httpx.RespondJSON(writer, map[string]string{"status": "duplicate"}, http.StatusOK)
+			case errors.Is(err, ErrInProgress):
+				writer.Header().Set("Retry-After", strconv.Itoa(int(d.lockTTL.Seconds())))
+				httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "in_progress", Message: "already being processed, retry later"}, http.StatusConflict)
+			case err != nil:
+				httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "d.Do()"))
+			}
+		})
+	}
+}
+
+// TaskName keys cloud tasks deliveries by their task name, which stays the same across retries of a task
+func TaskName(request *http.Request) string {
+	return request.Header.Get("X-CloudTasks-TaskName")
+}
+
+func (d *Deduper) count(ctx context.Context, outcome string) {
+	d.checks.Add(ctx, 1, attribute.String("source", d.source), attribute.String("outcome", outcome))
+}
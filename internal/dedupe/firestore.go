@@ -0,0 +1,120 @@
+package dedupe
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// entryDoc is how an entry is stored, a firestore ttl policy on expires deletes old entries without cmd/dedupesweep
+type entryDoc struct {
+	Key         string    `firestore:"key"`
+	Fingerprint string    `firestore:"fingerprint,omitempty"`
+	Done        bool      `firestore:"done"`
+	LockedUntil time.Time `firestore:"locked_until"`
+	Expires     time.Time `firestore:"expires"`
+	Value       []byte    `firestore:"value,omitempty"`
+}
+
+type firestoreStore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+	now        func() time.Time
+}
+
+// Firestore stores a document per key in collection, keys are hashed into document ids since senders and clients
+// pick them. Claim runs in a transaction, so of two instances racing for a key only one gets it
+func Firestore(client *firestore.Client, collection string) Store {
+	return &firestoreStore{client: client, collection: client.Collection(collection), now: time.Now}
+}
+
+func (f *firestoreStore) doc(key string) *firestore.DocumentRef {
+	sum := sha256.Sum256([]byte(key))
+	return f.collection.Doc(hex.EncodeToString(sum[:]))
+}
+
+func (f *firestoreStore) Claim(ctx context.Context, key string, entry *Entry) (*Entry, error) {
+	ref := f.doc(key)
+	var existing *Entry
+	err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing = nil
+		snapshot, err := tx.Get(ref)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return fmt.Errorf("tx.Get(): %v", err)
+		default:
+			var doc entryDoc
+			if err := snapshot.DataTo(&doc); err != nil {
+				return fmt.Errorf("snapshot.DataTo(): %v", err)
+			}
+			if e := fromDoc(&doc); e.live(f.now()) {
+				existing = e
+				return nil
+			}
+		}
+		return tx.Set(ref, toDoc(key, entry))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("f.client.RunTransaction(): %v", err)
+	}
+	return existing, nil
+}
+
+func (f *firestoreStore) Complete(ctx context.Context, key string, entry *Entry) error {
+	if _, err := f.doc(key).Set(ctx, toDoc(key, entry)); err != nil {
+		return fmt.Errorf("Set(): %v", err)
+	}
+	return nil
+}
+
+func (f *firestoreStore) Release(ctx context.Context, key string) error {
+	if _, err := f.doc(key).Delete(ctx); err != nil {
+		return fmt.Errorf("Delete(): %v", err)
+	}
+	return nil
+}
+
+// Sweep deletes expired entries in batches of 500, the most a firestore batch takes
+func (f *firestoreStore) Sweep(ctx context.Context, now time.Time) (int, error) {
+	swept := 0
+	for {
+		iter := f.collection.Where("expires", "<", now).Limit(500).Documents(ctx)
+		batch := f.client.Batch()
+		n := 0
+		for {
+			snapshot, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return swept, fmt.Errorf("iter.Next(): %v", err)
+			}
+			batch.Delete(snapshot.Ref)
+			n++
+		}
+		iter.Stop()
+		if n == 0 {
+			return swept, nil
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return swept, fmt.Errorf("batch.Commit(): %v", err)
+		}
+		swept += n
+	}
+}
+
+func toDoc(key string, e *Entry) *entryDoc {
+	return &entryDoc{Key: key, Fingerprint: e.Fingerprint, Done: e.Done, LockedUntil: e.LockedUntil, Expires: e.Expires, Value: e.Value}
+}
+
+func fromDoc(d *entryDoc) *Entry {
+	return &Entry{Fingerprint: d.Fingerprint, Done: d.Done, LockedUntil: d.LockedUntil, Expires: d.Expires, Value: d.Value}
+}
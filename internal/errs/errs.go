@@ -0,0 +1,194 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Kind classifies an error so every transport maps it to the same status code
+type Kind int
+
+const (
+	// Unknown means the kind is inherited from the wrapped error, an error with no kind at all is Internal
+	Unknown Kind = iota
+	Internal
+	NotFound
+	InvalidArgument
+	Unauthenticated
+	// PermissionDenied is a caller we know who is not allowed to do this, unlike Unauthenticated authenticating again
+	// won't help
+	PermissionDenied
+	Unavailable
+	// DeadlineExceeded is our own request deadline running out, errors of upstream deadlines stay Unavailable
+	DeadlineExceeded
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Internal:
+		return "internal"
+	case NotFound:
+		return "not_found"
+	case InvalidArgument:
+		return "invalid_argument"
+	case Unauthenticated:
+		return "unauthenticated"
+	case PermissionDenied:
+		return "permission_denied"
+	case Unavailable:
+		return "unavailable"
+	case DeadlineExceeded:
+		return "deadline_exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultMessage is what clients see when nobody gave us a safe message
+func (k Kind) defaultMessage() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case InvalidArgument:
+		return "invalid argument"
+	case Unauthenticated:
+		return "unauthenticated"
+	case PermissionDenied:
+		return "permission denied"
+	case Unavailable:
+		return "service unavailable, try again later"
+	case DeadlineExceeded:
+		return "request timed out"
+	default:
+		return "internal error"
+	}
+}
+
+// Error carries a Kind, an internal message for our logs and optionally a message that is safe to show clients
+type Error struct {
+	Kind Kind
+	// msg is for our logs only, it may contain ids, paths or upstream responses
+	msg string
+	// safe is shown to clients as is
+	safe string
+	// fields are set by Invalid
+	fields []FieldError
+	err    error
+	stack  []uintptr
+}
+
+// New creates an error whose message is safe to return to clients, eg errs.New(errs.NotFound, "beer not found")
+func New(kind Kind, message string) error {
+	return &Error{Kind: kind, msg: message, safe: message, stack: callers()}
+}
+
+// Wrapf adds internal context to err and classifies it, pass Unknown to keep the kind of err. a nil err stays nil
+func Wrapf(err error, kind Kind, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Kind: kind, msg: fmt.Sprintf(format, args...), err: err}
+	// only the innermost Error records a stack, that is where things actually went wrong
+	var inner *Error
+	if !errors.As(err, &inner) {
+		e.stack = callers()
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Format prints the stack of where the error was created with %+v
+func (e *Error) Format(s fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && s.Flag('+'):
+		fmt.Fprint(s, e.Error())
+		if stack := Stack(e); len(stack) > 0 {
+			fmt.Fprint(s, "\n"+strings.Join(stack, "\n"))
+		}
+	case verb == 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	default:
+		fmt.Fprint(s, e.Error())
+	}
+}
+
+func callers() []uintptr {
+	pcs := make([]uintptr, 32)
+	// skip runtime.Callers, callers and New/Wrapf
+	n := runtime.Callers(3, pcs)
+	return pcs[:n]
+}
+
+// Stack returns the innermost recorded stack of err as "function file:line" lines
+func Stack(err error) []string {
+	var pcs []uintptr
+	for err != nil {
+		if e, ok := err.(*Error); ok && len(e.stack) > 0 {
+			pcs = e.stack
+		}
+		err = errors.Unwrap(err)
+	}
+	if len(pcs) == 0 {
+		return nil
+	}
+	frames := runtime.CallersFrames(pcs)
+	var out []string
+	for {
+		frame, more := frames.Next()
+		out = append(out, fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line))
+		if !more {
+			break
+		}
+	}
+	return out
+}
+
+// KindOf finds the outermost kind in err's chain, falling back to grpc status codes and context errors
+func KindOf(err error) Kind {
+	if err == nil {
+		return Unknown
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if typed, ok := e.(*Error); ok && typed.Kind != Unknown {
+			return typed.Kind
+		}
+	}
+	if kind, ok := grpcKind(err); ok {
+		return kind
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return Unavailable
+	}
+	return Internal
+}
+
+// Message is the text we can safely return to a client, the outermost safe message or a generic one for the kind
+func Message(err error) string {
+	if err == nil {
+		return ""
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if typed, ok := e.(*Error); ok && typed.safe != "" {
+			return typed.safe
+		}
+	}
+	return KindOf(err).defaultMessage()
+}
+
+// Is reports whether err is classified as kind
+func Is(err error, kind Kind) bool {
+	return KindOf(err) == kind
+}
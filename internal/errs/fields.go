@@ -0,0 +1,52 @@
+package errs
+
+import (
+	"errors"
+	"strings"
+)
+
+// FieldError is one problem with one part of a request, machine readable so a client can point at the input that
+// caused it
+type FieldError struct {
+	// In is where the field is, body, query, path or header
+	In string `json:"in"`
+	// Pointer is a json pointer (rfc 6901) into the body, eg /items/0/name, or /name for a parameter
+	Pointer string `json:"pointer"`
+	// Constraint is what the field violated, eg required, type or maxLength
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+// Invalid is an InvalidArgument error listing every problem we found with a request, its safe message joins them so
+// clients that only read the message still learn what to fix
+func Invalid(fields ...FieldError) error {
+	problems := make([]string, 0, len(fields))
+	for _, f := range fields {
+		problems = append(problems, f.In+f.Pointer+": "+f.Message)
+	}
+	message := strings.Join(problems, "; ")
+	if message == "" {
+		message = InvalidArgument.defaultMessage()
+	}
+	return &Error{Kind: InvalidArgument, msg: message, safe: message, fields: fields, stack: callers()}
+}
+
+// Fields returns the field errors of the outermost error in err's chain that has any
+func Fields(err error) []FieldError {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if typed, ok := e.(*Error); ok && len(typed.fields) > 0 {
+			return typed.fields
+		}
+	}
+	return nil
+}
+
+// Pointer builds a json pointer from its reference tokens, escaping ~ and / within them
+func Pointer(tokens ...string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// HTTPStatus maps the kind of err to a status code
+func HTTPStatus(err error) int {
+	switch KindOf(err) {
+	case Unknown:
+		return http.StatusOK
+	case NotFound:
+		return http.StatusNotFound
+	case InvalidArgument:
+		return http.StatusBadRequest
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	case PermissionDenied:
+		return http.StatusForbidden
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GRPCCode maps the kind of err to a grpc status code
+func GRPCCode(err error) codes.Code {
+	switch KindOf(err) {
+	case Unknown:
+		return codes.OK
+	case NotFound:
+		return codes.NotFound
+	case InvalidArgument:
+		return codes.InvalidArgument
+	case Unauthenticated:
+		return codes.Unauthenticated
+	case PermissionDenied:
+		return codes.PermissionDenied
+	case Unavailable:
+		return codes.Unavailable
+	case DeadlineExceeded:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+// GRPCStatus converts err into a grpc status error that only carries the client safe message. a status error made by
+// the handler itself, eg with status.Error, is already meant for the client and passes through as is
+func GRPCStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	return status.Error(GRPCCode(err), Message(err))
+}
+
+// UnaryServerInterceptor returns the errors of unary handlers through GRPCStatus, so they get the code of their kind
+// and never leak their internal message
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		return resp, GRPCStatus(err)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming handlers
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return GRPCStatus(handler(srv, stream))
+	}
+}
+
+// grpcKind classifies errors coming back from grpc clients such as firestore
+func grpcKind(err error) (Kind, bool) {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return Unknown, false
+	}
+	switch grpcErr.GRPCStatus().Code() {
+	case codes.NotFound:
+		return NotFound, true
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange, codes.AlreadyExists:
+		return InvalidArgument, true
+	case codes.Unauthenticated:
+		return Unauthenticated, true
+	case codes.PermissionDenied:
+		return PermissionDenied, true
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Canceled:
+		return Unavailable, true
+	default:
+		return Internal, true
+	}
+}
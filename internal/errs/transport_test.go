@@ -0,0 +1,73 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+)
+
+func TestTransportMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantHTTP int
+		wantGRPC codes.Code
+	}{
+		{name: "not_found", err: New(NotFound, "beer not found"), wantHTTP: http.StatusNotFound, wantGRPC: codes.NotFound},
+		{name: "unauthenticated", err: New(Unauthenticated, "sign in"), wantHTTP: http.StatusUnauthorized, wantGRPC: codes.Unauthenticated},
+		{name: "permission_denied", err: New(PermissionDenied, "not yours"), wantHTTP: http.StatusForbidden, wantGRPC: codes.PermissionDenied},
+		{name: "upstream_permission_denied", err: fmt.Errorf("firestore: %w", status.Error(codes.PermissionDenied, "missing iam role")),
+			wantHTTP: http.StatusForbidden, wantGRPC: codes.PermissionDenied},
+		{name: "upstream_unauthenticated", err: status.Error(codes.Unauthenticated, "expired token"), wantHTTP: http.StatusUnauthorized, wantGRPC: codes.Unauthenticated},
+		{name: "plain", err: errors.New("boom"), wantHTTP: http.StatusInternalServerError, wantGRPC: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTTPStatus(tt.err); got != tt.wantHTTP {
+				t.Errorf("HTTPStatus() = %d, want %d", got, tt.wantHTTP)
+			}
+			if got := GRPCCode(tt.err); got != tt.wantGRPC {
+				t.Errorf("GRPCCode() = %s, want %s", got, tt.wantGRPC)
+			}
+		})
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		{name: "nil", wantCode: codes.OK},
+		{name: "kind", err: Wrapf(errors.New("projects/p/databases/(default) is gone"), Unavailable, "fs.Get()"),
+			wantCode: codes.Unavailable, wantMessage: "service unavailable, try again later"},
+		{name: "safe_message", err: New(PermissionDenied, "not your topic"), wantCode: codes.PermissionDenied, wantMessage: "not your topic"},
+		{name: "status", err: status.Error(codes.ResourceExhausted, "slow down"), wantCode: codes.ResourceExhausted, wantMessage: "slow down"},
+	}
+	intercept := StreamServerInterceptor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := intercept(nil, nil, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+				return tt.err
+			})
+			got := status.Convert(err)
+			if got.Code() != tt.wantCode || got.Message() != tt.wantMessage {
+				t.Errorf("interceptor returned %s %q, want %s %q", got.Code(), got.Message(), tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+
+	_, err := UnaryServerInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, New(NotFound, "beer not found")
+	})
+	if got := status.Code(err); got != codes.NotFound {
+		t.Errorf("unary interceptor returned %s, want %s", got, codes.NotFound)
+	}
+}
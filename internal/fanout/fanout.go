@@ -0,0 +1,189 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/fanout"
+
+// Task is a single unit of work, tasks report their results by writing to variables they close over
+type Task struct {
+	Name string
+	// Timeout bounds this task alone, zero means the task only inherits the parent deadline
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Named is shorthand for a task without its own timeout
+func Named(name string, run func(ctx context.Context) error) Task {
+	return Task{Name: name, Run: run}
+}
+
+// Policy decides what happens to the remaining tasks once one fails
+type Policy int
+
+const (
+	// FirstError cancels every other task as soon as one fails and returns that error
+	FirstError Policy = iota
+	// CollectAll lets every task finish and returns an *Errors describing each failure, useful for partial results
+	CollectAll
+)
+
+type Runner struct {
+	policy      Policy
+	taskTimeout time.Duration
+}
+
+type Option func(r *Runner)
+
+func WithPolicy(p Policy) Option {
+	return func(r *Runner) {
+		r.policy = p
+	}
+}
+
+// WithTaskTimeout applies to every task that does not set its own Timeout
+func WithTaskTimeout(d time.Duration) Option {
+	return func(r *Runner) {
+		r.taskTimeout = d
+	}
+}
+
+func New(opts ...Option) *Runner {
+	r := &Runner{policy: FirstError}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Do runs tasks with the FirstError policy and at most limit running at once
+func Do(ctx context.Context, limit int, tasks ...Task) error {
+	return New().Do(ctx, limit, tasks...)
+}
+
+// TaskError is a single failed task
+type TaskError struct {
+	Name string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// Errors is returned by the CollectAll policy
+type Errors []*TaskError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d task(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Do runs every task with bounded parallelism, limit <= 0 means unbounded. every task gets its own child span
+func (r *Runner) Do(ctx context.Context, limit int, tasks ...Task) error {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "fanout.Do")
+	defer span.End()
+	span.SetAttributes(attribute.Int("fanout.tasks", len(tasks)), attribute.Int("fanout.limit", limit))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if limit <= 0 || limit > len(tasks) {
+		limit = len(tasks)
+	}
+	sem := make(chan struct{}, limit)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		errs     Errors
+	)
+	for i := range tasks {
+		task := tasks[i]
+		if task.Name == "" {
+			task.Name = fmt.Sprintf("task-%d", i)
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			// we only get here when the parent was cancelled or a task failed under FirstError
+			mu.Lock()
+			errs = append(errs, &TaskError{Name: task.Name, Err: ctx.Err()})
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := r.run(ctx, task); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, &TaskError{Name: task.Name, Err: err})
+				if firstErr == nil {
+					firstErr = errs[len(errs)-1]
+					if r.policy == FirstError {
+						cancel()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	span.SetStatus(codes.Error, "one or more tasks failed")
+	if r.policy == CollectAll {
+		return errs
+	}
+	if firstErr == nil {
+		return errs[0]
+	}
+	return firstErr
+}
+
+func (r *Runner) run(ctx context.Context, task Task) (err error) {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "fanout."+task.Name)
+	defer span.End()
+
+	timeout := task.Timeout
+	if timeout == 0 {
+		timeout = r.taskTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}()
+	return task.Run(ctx)
+}
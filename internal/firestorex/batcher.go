@@ -0,0 +1,329 @@
+package firestorex
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/firestorex"
+
+// maxBatchSize is the most writes firestore accepts in a single commit
+const maxBatchSize = 500
+
+var (
+	// ErrClosed is returned when writing to a batcher that has been closed
+	ErrClosed = errors.New("firestorex: batcher is closed")
+	// ErrBacklog is returned when too many writes are waiting to be committed, callers can fall back to a direct write
+	ErrBacklog = errors.New("firestorex: too many pending writes")
+)
+
+type writeKind int
+
+const (
+	kindSet writeKind = iota
+	kindCreate
+	kindDelete
+)
+
+func (k writeKind) String() string {
+	switch k {
+	case kindSet:
+		return "set"
+	case kindCreate:
+		return "create"
+	default:
+		return "delete"
+	}
+}
+
+type write struct {
+	kind writeKind
+	doc  *firestore.DocumentRef
+	data interface{}
+	opts []firestore.SetOption
+	// link ties the batch span back to the request that queued the write
+	link trace.Link
+}
+
+// Batcher is a write behind buffer for telemetry like writes where a request shouldn't pay for a firestore round
+// trip. writes are committed in batches once enough of them pile up, on a timer, and when the instance shuts down. a
+// write that was queued is not durable until its batch commits, don't use it for anything you can't afford to lose
+type Batcher struct {
+	client        *firestore.Client
+	name          string
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+	flushTimeout  time.Duration
+	logger        *zap.SugaredLogger
+	tracer        trace.Tracer
+	retry         retry.Policy
+
+	mu      sync.Mutex
+	pending []write
+	closed  bool
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	committed metric.Int64Counter
+	latency   metric.Float64ValueRecorder
+}
+
+type BatchOption func(b *Batcher)
+
+// WithBatchName labels our spans and metrics
+func WithBatchName(name string) BatchOption {
+	return func(b *Batcher) {
+		b.name = name
+	}
+}
+
+// WithBatchSize commits once n writes are pending, capped at the firestore limit of 500
+func WithBatchSize(n int) BatchOption {
+	return func(b *Batcher) {
+		b.batchSize = n
+	}
+}
+
+// WithFlushInterval commits whatever is pending every d, defaults to 1 second
+func WithFlushInterval(d time.Duration) BatchOption {
+	return func(b *Batcher) {
+		b.flushInterval = d
+	}
+}
+
+// WithFlushTimeout bounds each flush in the background, defaults to 30 seconds. a firestore that hangs fails the
+// flush, its writes are lost like any write whose commit failed
+func WithFlushTimeout(d time.Duration) BatchOption {
+	return func(b *Batcher) {
+		b.flushTimeout = d
+	}
+}
+
+// WithMaxPending bounds how many writes can wait in memory, defaults to 10 batches worth
+func WithMaxPending(n int) BatchOption {
+	return func(b *Batcher) {
+		b.maxPending = n
+	}
+}
+
+// WithCommitRetry commits a batch that failed again by p, by default a batch is committed once. a commit that failed
+// after firestore applied it is committed again, writes queued with Create fail the batch as already existing then
+func WithCommitRetry(p retry.Policy) BatchOption {
+	return func(b *Batcher) {
+		b.retry = p
+	}
+}
+
+func WithBatchLogger(logger *zap.SugaredLogger) BatchOption {
+	return func(b *Batcher) {
+		b.logger = logger
+	}
+}
+
+func NewBatcher(client *firestore.Client, opts ...BatchOption) (*Batcher, error) {
+	b := &Batcher{
+		client:        client,
+		name:          "default",
+		batchSize:     maxBatchSize,
+		flushInterval: time.Second,
+		flushTimeout:  30 * time.Second,
+		logger:        zap.NewNop().Sugar(),
+		tracer:        otel.Tracer(instrumentationName),
+		full:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.batchSize <= 0 || b.batchSize > maxBatchSize {
+		b.batchSize = maxBatchSize
+	}
+	if b.maxPending <= 0 {
+		b.maxPending = 10 * b.batchSize
+	}
+
+	meter := global.Meter(instrumentationName)
+	var err error
+	if b.committed, err = meter.NewInt64Counter("firestorex.batch.writes", metric.WithDescription("writes committed by outcome")); err != nil {
+		return nil, fmt.Errorf("meter.NewInt64Counter(): %v", err)
+	}
+	if b.latency, err = meter.NewFloat64ValueRecorder("firestorex.batch.commit_latency", metric.WithDescription("batch commit latency"), metric.WithUnit("ms")); err != nil {
+		return nil, fmt.Errorf("meter.NewFloat64ValueRecorder(): %v", err)
+	}
+
+	go b.loop()
+	return b, nil
+}
+
+// Set queues a set of doc, see firestore.DocumentRef.Set
+func (b *Batcher) Set(ctx context.Context, doc *firestore.DocumentRef, data interface{}, opts ...firestore.SetOption) error {
+	return b.enqueue(ctx, write{kind: kindSet, doc: doc, data: data, opts: opts})
+}
+
+// Create queues a create of doc, the whole batch fails if doc already exists so prefer Set for anything retried
+func (b *Batcher) Create(ctx context.Context, doc *firestore.DocumentRef, data interface{}) error {
+	return b.enqueue(ctx, write{kind: kindCreate, doc: doc, data: data})
+}
+
+// Delete queues a delete of doc
+func (b *Batcher) Delete(ctx context.Context, doc *firestore.DocumentRef) error {
+	return b.enqueue(ctx, write{kind: kindDelete, doc: doc})
+}
+
+func (b *Batcher) enqueue(ctx context.Context, w write) error {
+	w.link = trace.LinkFromContext(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if len(b.pending) >= b.maxPending {
+		return ErrBacklog
+	}
+	b.pending = append(b.pending, w)
+	if len(b.pending) >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *Batcher) loop() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.stop:
+			return
+		}
+		b.flushInBackground()
+	}
+}
+
+// flushInBackground runs a bounded flush for loop
+func (b *Batcher) flushInBackground() {
+	// background flushes aren't tied to any request, Close picks up anything left when we are told to stop
+	ctx, cancel := context.WithTimeout(context.Background(), b.flushTimeout)
+	defer cancel()
+	if err := b.Flush(ctx); err != nil {
+		b.logger.Errorw("firestore batch flush failed", "batcher", b.name, "err", err)
+	}
+}
+
+// Flush commits every pending write, in batches of at most batchSize
+func (b *Batcher) Flush(ctx context.Context) error {
+	var firstErr error
+	for {
+		b.mu.Lock()
+		n := len(b.pending)
+		if n > b.batchSize {
+			n = b.batchSize
+		}
+		batch := b.pending[:n:n]
+		// what is left moves to a new array, re-slicing would keep the whole backlog we flushed reachable
+		b.pending = append([]write(nil), b.pending[n:]...)
+		b.mu.Unlock()
+
+		if n == 0 {
+			return firstErr
+		}
+		if err := b.commit(ctx, batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("firestorex %s: flush interrupted: %w", b.name, err)
+		}
+	}
+}
+
+func (b *Batcher) commit(ctx context.Context, writes []write) error {
+	links := make([]trace.Link, 0, len(writes))
+	for _, w := range writes {
+		if w.link.SpanContext.IsValid() {
+			links = append(links, w.link)
+		}
+	}
+	ctx, span := b.tracer.Start(ctx, "firestorex.batch.commit",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.String("batcher", b.name), attribute.Int("writes", len(writes))),
+	)
+	defer span.End()
+
+	// a write batch can only be committed once, every attempt builds its own
+	err := b.retry.Do(ctx, "firestore.batch.commit", func(ctx context.Context) error {
+		batch := b.client.Batch()
+		for _, w := range writes {
+			switch w.kind {
+			case kindSet:
+				batch.Set(w.doc, w.data, w.opts...)
+			case kindCreate:
+				batch.Create(w.doc, w.data)
+			case kindDelete:
+				batch.Delete(w.doc)
+			}
+		}
+		start := time.Now()
+		_, err := batch.Commit(ctx)
+		b.latency.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), attribute.String("batcher", b.name))
+		return err
+	})
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	b.committed.Add(ctx, int64(len(writes)), attribute.String("batcher", b.name), attribute.String("outcome", outcome))
+	if err != nil {
+		return fmt.Errorf("batch.Commit(): %w", err)
+	}
+	return nil
+}
+
+// Close stops accepting writes and commits everything still pending, the signature matches serverx.Server.OnShutdown
+// so SIGTERM flushes our buffer inside cloud run's shutdown window. Close gives up once ctx is done, even while a
+// background flush is still committing
+func (b *Batcher) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.stop)
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return fmt.Errorf("firestorex %s: close interrupted: %w", b.name, ctx.Err())
+	}
+	if err := b.Flush(ctx); err != nil {
+		return fmt.Errorf("b.Flush(): %v", err)
+	}
+	b.logger.Infow("firestore batcher flushed", "batcher", b.name)
+	return nil
+}
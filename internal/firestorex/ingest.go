@@ -0,0 +1,55 @@
+package firestorex
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// IngestSink writes records to collection, committed in batches of at most 500, its signature matches
+// httpx.IngestSink. id names the document of a record so writing it again after a failure overwrites rather than
+// duplicates it, records it returns no id for get a generated one and are only as idempotent as that allows
+func IngestSink(client *firestore.Client, collection string, id func(record interface{}) string) func(ctx context.Context, records []interface{}) error {
+	tracer := otel.Tracer(instrumentationName)
+	return func(ctx context.Context, records []interface{}) error {
+		for start := 0; start < len(records); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(records) {
+				end = len(records)
+			}
+			if err := ingestBatch(ctx, tracer, client, client.Collection(collection), id, records[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func ingestBatch(ctx context.Context, tracer trace.Tracer, client *firestore.Client, collection *firestore.CollectionRef, id func(record interface{}) string, records []interface{}) error {
+	ctx, span := tracer.Start(ctx, "firestorex.ingest.commit", trace.WithAttributes(
+		attribute.String("collection", collection.ID),
+		attribute.Int("writes", len(records)),
+	))
+	defer span.End()
+
+	batch := client.Batch()
+	for _, record := range records {
+		doc := collection.NewDoc()
+		if id != nil {
+			if name := id(record); name != "" {
+				doc = collection.Doc(name)
+			}
+		}
+		batch.Set(doc, record)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("batch.Commit(): %w", err)
+	}
+	return nil
+}
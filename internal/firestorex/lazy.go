@@ -0,0 +1,51 @@
+package firestorex
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/lazyinit"
+	"google.golang.org/api/option"
+)
+
+// LazyClient is a firestore client created on its first use, finding our credentials and opening its channel stay off
+// startup for services that only touch firestore on some of their routes
+type LazyClient struct {
+	value *lazyinit.Value
+}
+
+// NewLazyClient returns a client for projectID that is created by its first Get
+func NewLazyClient(projectID string, opts ...option.ClientOption) *LazyClient {
+	return &LazyClient{value: lazyinit.New("firestore", func(ctx context.Context) (interface{}, error) {
+		// credentials from a key file or gcloud refresh their tokens with the context the client is created with
+		client, err := firestore.NewClient(ctxutil.Detach(ctx), projectID, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("firestore.NewClient(): %v", err)
+		}
+		return client, nil
+	})}
+}
+
+// Get returns the client, creating it when nobody has yet, see lazyinit.Value.Get
+func (c *LazyClient) Get(ctx context.Context) (*firestore.Client, error) {
+	client, err := c.value.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.(*firestore.Client), nil
+}
+
+// Warm creates the client ahead of its first use, its signature matches serverx.WarmupFunc
+func (c *LazyClient) Warm(ctx context.Context) error {
+	return c.value.Warm(ctx)
+}
+
+// Close closes the client if it was ever created
+func (c *LazyClient) Close() error {
+	client, ok := c.value.Peek()
+	if !ok {
+		return nil
+	}
+	return client.(*firestore.Client).Close()
+}
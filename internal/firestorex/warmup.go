@@ -0,0 +1,109 @@
+package firestorex
+
+import (
+	"cloud.google.com/go/firestore"
+	vkit "cloud.google.com/go/firestore/apiv1"
+	"context"
+	"fmt"
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+	"math"
+	"os"
+)
+
+// WarmupMode is how much of firestore is made ready while serverx warms up rather than by the first request that
+// needs it. the more we warm, the longer until /readyz passes and the faster that first request is
+type WarmupMode string
+
+const (
+	// WarmupNone leaves it all to the first request, the channel still starts connecting in the background as the
+	// client is created
+	WarmupNone WarmupMode = "none"
+	// WarmupDial waits for the channel to connect, dns, tcp, tls and http/2 are done with
+	WarmupDial WarmupMode = "dial"
+	// WarmupRead connects the channel and reads a document, which also mints our first access token and has
+	// firestore route us to a backend
+	WarmupRead WarmupMode = "read"
+)
+
+// ParseWarmupMode parses none, dial or read
+func ParseWarmupMode(s string) (WarmupMode, error) {
+	switch mode := WarmupMode(s); mode {
+	case WarmupNone, WarmupDial, WarmupRead:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown firestore warmup %q, want none, dial or read", s)
+}
+
+// Client is a firestore client on a channel we dial ourselves, firestore.Client keeps its channel to itself and
+// nothing but a request would tell us it is connected
+type Client struct {
+	*firestore.Client
+	conn *grpc.ClientConn
+}
+
+// NewClient returns a client for projectID whose channel starts connecting right away, opts are those of
+// firestore.NewClient. against the emulator firestore dials its own channel and there is nothing to wait on
+func NewClient(ctx context.Context, projectID string, opts ...option.ClientOption) (*Client, error) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") != "" {
+		client, err := firestore.NewClient(ctx, projectID, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("firestore.NewClient(): %v", err)
+		}
+		return &Client{Client: client}, nil
+	}
+
+	// what firestore dials with by default, ahead of opts so they can still override it
+	dialOpts := []option.ClientOption{
+		option.WithEndpoint("firestore.googleapis.com:443"),
+		option.WithScopes(vkit.DefaultAuthScopes()...),
+		option.WithGRPCDialOption(grpc.WithDisableServiceConfig()),
+		option.WithGRPCDialOption(grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32))),
+	}
+	conn, err := gtransport.Dial(ctx, append(dialOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("gtransport.Dial(): %v", err)
+	}
+	// closing the client closes conn
+	client, err := firestore.NewClient(ctx, projectID, option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("firestore.NewClient(): %v", err)
+	}
+	return &Client{Client: client, conn: conn}, nil
+}
+
+// Connected waits for the channel to be ready to send on, its signature matches serverx.WarmupFunc
+func (c *Client) Connected(ctx context.Context) error {
+	if c.conn == nil {
+		return nil
+	}
+	for {
+		state := c.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("firestore channel is closed")
+		}
+		if !c.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("firestore channel still %s: %v", state, ctx.Err())
+		}
+	}
+}
+
+// Read reads collection/doc, a document that doesn't exist is as good as one that does. its signature matches
+// serverx.WarmupFunc
+func (c *Client) Read(collection, doc string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := c.Collection(collection).Doc(doc).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("firestore %s/%s: %v", collection, doc, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,314 @@
+package firestorex
+
+import (
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/cachex"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WatchBatch is what changed in a watched query from one snapshot to the next
+type WatchBatch struct {
+	Changes  []firestore.DocumentChange
+	ReadTime time.Time
+	// Resync is set on the first snapshot after the listener connected, every document of the query shows up in it as
+	// added. a document deleted while we weren't listening is not in it at all, so whatever was derived from the query
+	// before has to be thrown away rather than patched
+	Resync bool
+}
+
+// WatchFunc handles the changes of a snapshot. an error has the listener reconnect, which delivers everything again as
+// a resync, so a batch that failed isn't lost
+type WatchFunc func(ctx context.Context, batch WatchBatch) error
+
+// Watcher keeps a snapshot listener open on a query and hands every change to a WatchFunc, reconnecting whenever the
+// listener fails. a listener only keeps up on an instance with cpu outside of requests, deploy with
+// --no-cpu-throttling and --min-instances, and check Live before trusting anything derived from it. an instance that
+// scaled to zero hears nothing at all, the instance that starts next picks up from a resync
+type Watcher struct {
+	// generation counts the snapshots we started handing to fn, see Generation. first so it is 64 bit aligned for
+	// atomic on 32 bit platforms
+	generation uint64
+
+	name       string
+	query      firestore.Query
+	fn         WatchFunc
+	logger     *zap.SugaredLogger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	paused     func() bool
+
+	mu       sync.Mutex
+	live     bool
+	readTime time.Time
+
+	changes    metric.Int64Counter
+	reconnects metric.Int64Counter
+}
+
+type WatchOption func(w *Watcher)
+
+func WithWatchLogger(logger *zap.SugaredLogger) WatchOption {
+	return func(w *Watcher) {
+		w.logger = logger
+	}
+}
+
+// WithWatchBackoff waits min before reconnecting a listener that failed, doubling up to max while it keeps failing.
+// defaults to 1 and 30 seconds
+func WithWatchBackoff(min, max time.Duration) WatchOption {
+	return func(w *Watcher) {
+		w.minBackoff, w.maxBackoff = min, max
+	}
+}
+
+// WithPausedWhen has Live report false while paused does, eg serverx.Server.CPUThrottled. a listener on an instance
+// whose cpu is throttled between requests stalls without failing, it only catches up once a request comes in
+func WithPausedWhen(paused func() bool) WatchOption {
+	return func(w *Watcher) {
+		w.paused = paused
+	}
+}
+
+// NewWatcher watches query once Run is called, name labels our logs and metrics
+func NewWatcher(name string, query firestore.Query, fn WatchFunc, opts ...WatchOption) (*Watcher, error) {
+	w := &Watcher{
+		name:       name,
+		query:      query,
+		fn:         fn,
+		logger:     zap.NewNop().Sugar(),
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	meter := global.Meter(instrumentationName)
+	var err error
+	if w.changes, err = meter.NewInt64Counter("firestorex.watch.changes", metric.WithDescription("document changes heard by watch and kind")); err != nil {
+		return nil, fmt.Errorf("meter.NewInt64Counter(): %v", err)
+	}
+	if w.reconnects, err = meter.NewInt64Counter("firestorex.watch.reconnects", metric.WithDescription("listeners reconnected after failing, by watch")); err != nil {
+		return nil, fmt.Errorf("meter.NewInt64Counter(): %v", err)
+	}
+	return w, nil
+}
+
+// Live reports if our listener is connected and caught up, as of its last snapshot. while it isn't, changes may be
+// going unheard and callers should fall back to reading firestore themselves
+func (w *Watcher) Live() bool {
+	if w.paused != nil && w.paused() {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.live
+}
+
+// ReadTime is the time of the last snapshot we handled, zero before the first
+func (w *Watcher) ReadTime() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.readTime
+}
+
+// Generation changes whenever a snapshot is about to reach our WatchFunc. a load of something the WatchFunc
+// invalidates captures it before reading firestore and only caches what it read when it is still the same after,
+// anything else may have read a document just before a change whose invalidation already ran
+func (w *Watcher) Generation() uint64 {
+	return atomic.LoadUint64(&w.generation)
+}
+
+// Run listens until ctx is done, reconnecting with backoff whenever the listener or our WatchFunc fails. it always
+// returns nil, its signature matches serverx.WithDaemon
+func (w *Watcher) Run(ctx context.Context) error {
+	backoff := w.minBackoff
+	for {
+		synced, err := w.listen(ctx)
+		w.setLive(false, time.Time{})
+		if ctx.Err() != nil {
+			return nil
+		}
+		// a listener that got going before failing starts over from a short wait
+		if synced {
+			backoff = w.minBackoff
+		}
+		w.logger.Warnw("firestore listener failed, reconnecting", "watch", w.name, "backoff", backoff.String(), "err", err)
+		w.reconnects.Add(ctx, 1, attribute.String("watch", w.name))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// listen hands every snapshot of a single listener to our WatchFunc until either fails, it reports if any snapshot
+// was handled
+func (w *Watcher) listen(ctx context.Context) (bool, error) {
+	iter := w.query.Snapshots(ctx)
+	defer iter.Stop()
+	synced := false
+	for {
+		snapshot, err := iter.Next()
+		if err != nil {
+			return synced, fmt.Errorf("iter.Next(): %v", err)
+		}
+		batch := WatchBatch{Changes: snapshot.Changes, ReadTime: snapshot.ReadTime, Resync: !synced}
+		atomic.AddUint64(&w.generation, 1)
+		if err := w.fn(ctx, batch); err != nil {
+			return synced, fmt.Errorf("%s: %v", w.name, err)
+		}
+		if !synced {
+			w.logger.Infow("firestore listener synced", "watch", w.name, "docs", len(snapshot.Changes))
+		}
+		for _, change := range snapshot.Changes {
+			w.changes.Add(ctx, 1, attribute.String("watch", w.name), attribute.String("kind", changeKind(change.Kind)))
+		}
+		synced = true
+		w.setLive(true, snapshot.ReadTime)
+	}
+}
+
+func (w *Watcher) setLive(live bool, readTime time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.live = live
+	if !readTime.IsZero() {
+		w.readTime = readTime
+	}
+}
+
+func changeKind(kind firestore.DocumentChangeKind) string {
+	switch kind {
+	case firestore.DocumentAdded:
+		return "added"
+	case firestore.DocumentModified:
+		return "modified"
+	default:
+		return "removed"
+	}
+}
+
+// InvalidateCache deletes the keys of every changed document from cache, and everything in it on a resync. keys
+// returns what a document is cached under, eg itself and the listings it shows up in. a load that read a document
+// just before it changed can still cache what it read after we deleted it, unless it checks Watcher.Generation, give
+// cache a ttl to bound how long
+func InvalidateCache(cache *cachex.Cache, keys func(doc *firestore.DocumentSnapshot) []string) WatchFunc {
+	return func(ctx context.Context, batch WatchBatch) error {
+		if batch.Resync {
+			cache.Purge(ctx)
+			return nil
+		}
+		for _, change := range batch.Changes {
+			for _, key := range keys(change.Doc) {
+				cache.Delete(ctx, key)
+			}
+		}
+		return nil
+	}
+}
+
+// ChangeMessage is the data of the pub/sub messages PublishChanges publishes
+type ChangeMessage struct {
+	// Kind is added, modified or removed
+	Kind string `json:"kind"`
+	// Path is relative to the database, eg notes/abc
+	Path       string    `json:"path"`
+	ID         string    `json:"id"`
+	UpdateTime time.Time `json:"update_time"`
+	// Data is the document after the change, empty when it was removed
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// publishCheckpoint is how far PublishChanges got, saved after every batch it published
+type publishCheckpoint struct {
+	ReadTime time.Time `firestore:"read_time"`
+}
+
+// PublishChanges publishes a ChangeMessage for every changed document on topic, with the kind and path as attributes
+// and the path as ordering key when topic.EnableMessageOrdering is set. run it on a single instance, eg the leader of a
+// lockx.Locker, every instance listening would publish every change. checkpoint is where we keep the read time of the
+// last batch we published, a resync only publishes documents updated after it so a listener that reconnects, or an
+// instance that starts where another stopped, doesn't publish the whole query again. documents deleted while no
+// listener was running are never published, mark documents as deleted rather than delete them if subscribers have to
+// hear about every one. messages are published at least once, subscribers dedupe on path and update_time
+func PublishChanges(topic *pubsub.Topic, checkpoint *firestore.DocumentRef) WatchFunc {
+	return func(ctx context.Context, batch WatchBatch) error {
+		var since time.Time
+		if batch.Resync {
+			snapshot, err := checkpoint.Get(ctx)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return fmt.Errorf("checkpoint.Get(): %v", err)
+			}
+			if err == nil {
+				var saved publishCheckpoint
+				if err := snapshot.DataTo(&saved); err != nil {
+					return fmt.Errorf("snapshot.DataTo(): %v", err)
+				}
+				since = saved.ReadTime
+			}
+		}
+
+		var results []*pubsub.PublishResult
+		var keys []string
+		for _, change := range batch.Changes {
+			if batch.Resync && !change.Doc.UpdateTime.After(since) {
+				continue
+			}
+			message := ChangeMessage{Kind: changeKind(change.Kind), Path: docPath(change.Doc.Ref), ID: change.Doc.Ref.ID, UpdateTime: change.Doc.UpdateTime}
+			if change.Kind != firestore.DocumentRemoved {
+				message.Data = change.Doc.Data()
+			}
+			data, err := json.Marshal(message)
+			if err != nil {
+				return fmt.Errorf("json.Marshal(%s): %v", message.Path, err)
+			}
+			m := &pubsub.Message{Data: data, Attributes: map[string]string{"kind": message.Kind, "path": message.Path}}
+			if topic.EnableMessageOrdering {
+				m.OrderingKey = message.Path
+			}
+			results = append(results, topic.Publish(ctx, m))
+			keys = append(keys, m.OrderingKey)
+		}
+		for i, result := range results {
+			if _, err := result.Get(ctx); err != nil {
+				// a failed publish pauses its ordering key, the resync after we return publishes it again
+				if keys[i] != "" {
+					topic.ResumePublish(keys[i])
+				}
+				return fmt.Errorf("result.Get(): %v", err)
+			}
+		}
+		if _, err := checkpoint.Set(ctx, publishCheckpoint{ReadTime: batch.ReadTime}); err != nil {
+			return fmt.Errorf("checkpoint.Set(): %v", err)
+		}
+		return nil
+	}
+}
+
+// docPath is the path of ref relative to the database, ref.Path is the full resource name
+func docPath(ref *firestore.DocumentRef) string {
+	if ref.Parent.Parent == nil {
+		return ref.Parent.ID + "/" + ref.ID
+	}
+	return docPath(ref.Parent.Parent) + "/" + ref.Parent.ID + "/" + ref.ID
+}
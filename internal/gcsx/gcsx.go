@@ -0,0 +1,82 @@
+package gcsx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+	"io"
+)
+
+// writer streams what is written to it into a single object, through a pipe into a resumable upload
+type writer struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	if err != nil {
+		// the upload stopped reading, its own error says why
+		<-w.done
+		if w.err != nil {
+			return n, w.err
+		}
+	}
+	return n, err
+}
+
+// Close finishes the object and waits for gcs to have it, unless ctx was cancelled, then nothing is kept
+func (w *writer) Close() error {
+	w.pipe.Close()
+	<-w.done
+	return w.err
+}
+
+type config struct {
+	chunkSize int
+}
+
+type Option func(c *config)
+
+// WithChunkSize sends objects in chunks of n bytes, rounded up to a multiple of 256KiB, defaults to 2MiB. a chunk is
+// held in memory for every upload in progress, so it trades memory for fewer requests to gcs
+func WithChunkSize(n int) Option {
+	return func(c *config) {
+		c.chunkSize = n
+	}
+}
+
+// NewWriter writes the object name of bucket. cancelling ctx before Close aborts the upload and no object is created
+func NewWriter(ctx context.Context, svc *storage.Service, bucket, name, contentType string, opts ...Option) io.WriteCloser {
+	c := &config{chunkSize: 2 << 20}
+	for _, opt := range opts {
+		opt(c)
+	}
+	reader, pipe := io.Pipe()
+	w := &writer{pipe: pipe, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		// Media reads the first chunk right away, it has to wait for our writes along with the rest of the upload
+		call := svc.Objects.Insert(bucket, &storage.Object{Name: name, ContentType: contentType}).
+			Media(reader, googleapi.ChunkSize(c.chunkSize), googleapi.ContentType(contentType)).
+			Context(ctx)
+		if _, err := call.Do(); err != nil {
+			w.err = fmt.Errorf("Objects.Insert(%s): %v", name, err)
+		}
+		// stops writes that are still coming once the upload gave up
+		reader.CloseWithError(w.err)
+	}()
+	return w
+}
+
+// Sink writes every upload to an object of bucket, named by name. the location of an upload is its gs:// url
+func Sink(svc *storage.Service, bucket string, name func(upload *httpx.Upload) string, opts ...Option) httpx.UploadSink {
+	return func(ctx context.Context, upload *httpx.Upload) (io.WriteCloser, error) {
+		object := name(upload)
+		upload.Location = "gs://" + bucket + "/" + object
+		return NewWriter(ctx, svc, bucket, object, upload.ContentType, opts...), nil
+	}
+}
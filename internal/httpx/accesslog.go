@@ -0,0 +1,233 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLog writes an entry per request with an httpRequest payload, so the request shows up in cloud logging with
+// our trace and log labels attached. cloud run's own request log already has every request, what ours adds is the
+// correlation, and at a high enough qps it is one of the larger lines of a logging bill. errors and slow requests are
+// always logged, successful ones can be sampled
+type AccessLog struct {
+	// seen counts successful requests for 1-in-N sampling
+	seen uint64
+	// unlogged counts the successful requests sampled away since the last sampled entry, whichever of 1-in-N or the
+	// rate limit dropped them
+	unlogged uint64
+
+	logger      *logx.AppLogger
+	sampleEvery uint64
+	slow        time.Duration
+	now         func() time.Time
+
+	// rate limiting of successful entries is a token bucket refilled at rate tokens per second
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	entries metric.Int64Counter
+}
+
+type AccessLogOption func(a *AccessLog)
+
+// WithAccessSampleEvery logs 1 in n successful requests. defaults to 1, every request. a sampled entry records the
+// successful requests it stands for as sample_every, itself and those sampled away since the entry before it, so
+// summing sample_every scales counts back up even when WithAccessRate dropped some of the 1 in n
+func WithAccessSampleEvery(n int) AccessLogOption {
+	return func(a *AccessLog) {
+		if n > 0 {
+			a.sampleEvery = uint64(n)
+		}
+	}
+}
+
+// WithAccessRate logs at most perSecond successful requests a second, on top of WithAccessSampleEvery. it bounds what
+// a traffic spike costs us in logging
+func WithAccessRate(perSecond float64) AccessLogOption {
+	return func(a *AccessLog) {
+		a.rate = perSecond
+		a.tokens = perSecond
+	}
+}
+
+// WithSlowRequest always logs requests that took d or longer, whatever their status, defaults to a second
+func WithSlowRequest(d time.Duration) AccessLogOption {
+	return func(a *AccessLog) {
+		a.slow = d
+	}
+}
+
+// WithAccessClock replaces time.Now, for latencies and the rate limit
+func WithAccessClock(now func() time.Time) AccessLogOption {
+	return func(a *AccessLog) {
+		a.now = now
+	}
+}
+
+func NewAccessLog(logger *logx.AppLogger, opts ...AccessLogOption) *AccessLog {
+	a := &AccessLog{
+		logger:      logger,
+		sampleEvery: 1,
+		slow:        time.Second,
+		now:         time.Now,
+		entries:     metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.access_log.entries", metric.WithDescription("requests by whether their access log entry was written or sampled away")),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.last = a.now()
+	return a
+}
+
+// Middleware has to run after the middleware that starts our span, so entries carry our trace
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := a.now()
+		cache := &cacheStatus{}
+		ctx := cacheStatusKey.With(request.Context(), cache)
+		wrapped, rec := Record(writer, 0)
+		next.ServeHTTP(wrapped, request.WithContext(ctx))
+		latency := a.now().Sub(start)
+
+		reason, represents := a.reason(rec.Status, latency)
+		a.entries.Add(ctx, 1, attribute.String("reason", reason))
+		if reason == "sampled_out" {
+			return
+		}
+
+		payload := &zapdriver.HTTPPayload{
+			RequestMethod: request.Method,
+			RequestURL:    request.URL.String(),
+			Status:        rec.Status,
+			ResponseSize:  strconv.FormatInt(rec.BytesWritten, 10),
+			UserAgent:     request.UserAgent(),
+			RemoteIP:      remoteIP(request),
+			Referer:       request.Referer(),
+			Latency:       strconv.FormatFloat(latency.Seconds(), 'f', 9, 64) + "s",
+			Protocol:      request.Proto,
+		}
+		if request.ContentLength > 0 {
+			payload.RequestSize = strconv.FormatInt(request.ContentLength, 10)
+		}
+		cache.fill(payload)
+		logger := a.logger.WrapTraceContext(ctx)
+		fields := []interface{}{zapdriver.HTTP(payload), "reason", reason}
+		if reason == "sampled" {
+			fields = append(fields, "sample_every", represents)
+		}
+		switch {
+		case rec.Status >= http.StatusInternalServerError:
+			logger.Errorw("request", fields...)
+		case rec.Status >= http.StatusBadRequest || reason == "slow":
+			logger.Warnw("request", fields...)
+		default:
+			logger.Infow("request", fields...)
+		}
+	})
+}
+
+// reason decides whether a request is logged: errors and slow requests always are, the rest are sampled. a sampled
+// request also returns how many successful requests its entry stands for
+func (a *AccessLog) reason(status int, latency time.Duration) (string, uint64) {
+	switch {
+	case status >= http.StatusBadRequest:
+		return "error", 0
+	case a.slow > 0 && latency >= a.slow:
+		return "slow", 0
+	case a.sampleEvery <= 1 && a.rate <= 0:
+		return "all", 0
+	}
+	atomic.AddUint64(&a.unlogged, 1)
+	if a.sampleEvery > 1 && (atomic.AddUint64(&a.seen, 1)-1)%a.sampleEvery != 0 {
+		return "sampled_out", 0
+	}
+	if a.rate > 0 && !a.take() {
+		return "sampled_out", 0
+	}
+	return "sampled", atomic.SwapUint64(&a.unlogged, 0)
+}
+
+func (a *AccessLog) take() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	// below one a second the bucket still has to hold a whole token
+	burst := math.Max(a.rate, 1)
+	a.tokens = math.Min(a.tokens+now.Sub(a.last).Seconds()*a.rate, burst)
+	a.last = now
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// remoteIP is the client as the google front end saw it, the first address of X-Forwarded-For
+func remoteIP(request *http.Request) string {
+	if forwarded := request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return request.RemoteAddr
+}
+
+// cacheStatus collects the cache lookups made while serving a request, for the cache fields of its entry
+type cacheStatus struct {
+	lookups   int64
+	hits      int64
+	validated int64
+	filled    int64
+}
+
+var cacheStatusKey = ctxval.New("httpx.cache_status", ctxval.WithFormat(func(v interface{}) string {
+	s := v.(*cacheStatus)
+	return fmt.Sprintf("lookups=%d hits=%d validated=%d filled=%d",
+		atomic.LoadInt64(&s.lookups), atomic.LoadInt64(&s.hits), atomic.LoadInt64(&s.validated), atomic.LoadInt64(&s.filled))
+}))
+
+// RecordCacheLookup lets a cache used while serving the request of ctx, eg clientx.WithResponseCache, report a lookup
+// on its access log entry. validated is a hit that had to be confirmed by the origin first, filled the bytes a miss
+// stored. it does nothing outside of AccessLog.Middleware
+func RecordCacheLookup(ctx context.Context, hit, validated bool, filled int64) {
+	v, ok := cacheStatusKey.Value(ctx)
+	if !ok {
+		return
+	}
+	status := v.(*cacheStatus)
+	atomic.AddInt64(&status.lookups, 1)
+	if hit {
+		atomic.AddInt64(&status.hits, 1)
+	}
+	if validated {
+		atomic.AddInt64(&status.validated, 1)
+	}
+	atomic.AddInt64(&status.filled, filled)
+}
+
+// fill sets the cache fields of payload, a request counts as a cache hit when every lookup it made was one
+func (c *cacheStatus) fill(payload *zapdriver.HTTPPayload) {
+	lookups := atomic.LoadInt64(&c.lookups)
+	if lookups == 0 {
+		return
+	}
+	payload.CacheLookup = true
+	payload.CacheHit = atomic.LoadInt64(&c.hits) == lookups
+	payload.CacheValidatedWithOriginServer = payload.CacheHit && atomic.LoadInt64(&c.validated) > 0
+	if filled := atomic.LoadInt64(&c.filled); filled > 0 {
+		payload.CacheFillBytes = strconv.FormatInt(filled, 10)
+	}
+}
@@ -0,0 +1,66 @@
+package httpx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLogSampleEvery(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	tests := []struct {
+		name    string
+		opts    []AccessLogOption
+		entries int
+		// total is what sample_every adds up to, every request up to the last entry
+		total uint64
+	}{
+		{name: "sample_every", opts: []AccessLogOption{WithAccessSampleEvery(4)}, entries: 10, total: 37},
+		{name: "rate", opts: []AccessLogOption{WithAccessRate(2)}, entries: 4, total: 22},
+		// the rate limit drops most of the 1 in 2, their entries would undercount without the ones it dropped
+		{name: "sample_every_and_rate", opts: []AccessLogOption{WithAccessSampleEvery(2), WithAccessRate(1)}, entries: 2, total: 21},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+			var buf bytes.Buffer
+			log := NewAccessLog(logx.NewWriterLogger("test-project", &buf), append(tt.opts, WithAccessClock(clock))...)
+			handler := log.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+
+			const requests = 40
+			for i := 0; i < requests; i++ {
+				// the clock only moves halfway, so the rate limit refills once within our requests
+				if i == requests/2 {
+					now = now.Add(2 * time.Second)
+				}
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+
+			var entries int
+			var total uint64
+			scanner := bufio.NewScanner(&buf)
+			for scanner.Scan() {
+				var entry struct {
+					SampleEvery uint64 `json:"sample_every"`
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+					t.Fatalf("json.Unmarshal(%s): %v", scanner.Bytes(), err)
+				}
+				entries++
+				total += entry.SampleEvery
+			}
+			if entries != tt.entries {
+				t.Errorf("logged %d entries, want %d", entries, tt.entries)
+			}
+			if total != tt.total {
+				t.Errorf("sample_every adds up to %d, want %d", total, tt.total)
+			}
+		})
+	}
+}
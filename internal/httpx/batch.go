@@ -0,0 +1,257 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/fanout"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errBatchItemTooLarge = errors.New("httpx: batch item response too large")
+
+// BatchItem is one request of a batch, Body is sent as is and should be json
+type BatchItem struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchRequest is the body of a request to a batch endpoint
+type BatchRequest struct {
+	Requests []BatchItem `json:"requests"`
+}
+
+// BatchResult is the response to one item, Body is the json the item responded with or a string for anything else
+type BatchResult struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse always comes with a 200, the outcome of every item is in its own status
+type BatchResponse struct {
+	Responses []BatchResult `json:"responses"`
+}
+
+// Batch serves many requests in one round trip, which matters to mobile clients on slow networks where every request
+// to cloud run pays for its own latency. every item goes through handler as a request of its own, with the headers of
+// the batch request, our auth included, overlaid by its own, and runs in a span of its own with at most parallelism
+// items running at once. responses come back in the order of the items
+type Batch struct {
+	handler       http.Handler
+	maxItems      int
+	parallelism   int
+	maxBodyBytes  int64
+	maxItemBytes  int
+	allowedPrefix string
+
+	items metric.Int64Counter
+}
+
+type BatchOption func(b *Batch)
+
+// WithBatchLimits allows at most maxItems items in a batch with at most parallelism running at once, defaults to 20 and 4
+func WithBatchLimits(maxItems, parallelism int) BatchOption {
+	return func(b *Batch) {
+		b.maxItems = maxItems
+		b.parallelism = parallelism
+	}
+}
+
+// WithBatchBodyLimits caps the batch request body at maxBodyBytes and the response body of each item at maxItemBytes,
+// defaults to 1MiB each. an item whose response is too large gets a 502 instead
+func WithBatchBodyLimits(maxBodyBytes int64, maxItemBytes int) BatchOption {
+	return func(b *Batch) {
+		b.maxBodyBytes = maxBodyBytes
+		b.maxItemBytes = maxItemBytes
+	}
+}
+
+// WithBatchPrefix only allows items whose path starts with prefix, eg "/api/", so a batch can't reach anything else
+// our handler serves
+func WithBatchPrefix(prefix string) BatchOption {
+	return func(b *Batch) {
+		b.allowedPrefix = prefix
+	}
+}
+
+func NewBatch(handler http.Handler, opts ...BatchOption) *Batch {
+	b := &Batch{
+		handler:      handler,
+		maxItems:     20,
+		parallelism:  4,
+		maxBodyBytes: 1 << 20,
+		maxItemBytes: 1 << 20,
+		items:        metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.batch.items", metric.WithDescription("items served through a batch endpoint by status code")),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// batchKey holds the id of the batch item a request is for
+var batchKey = ctxval.NewString("httpx.batch_item")
+
+// InBatch reports whether ctx is the request of a batch item
+func InBatch(ctx context.Context) bool {
+	_, ok := batchKey.Value(ctx)
+	return ok
+}
+
+func (b *Batch) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	if request.Method != http.MethodPost {
+		RespondJSON(writer, &ErrorResponse{Code: "method_not_allowed", Message: "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	if InBatch(ctx) {
+		RespondError(writer, request, errs.New(errs.InvalidArgument, "batches can't be nested"))
+		return
+	}
+	var batch BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, b.maxBodyBytes)).Decode(&batch); err != nil {
+		RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "Decode()"))
+		return
+	}
+	if len(batch.Requests) == 0 || len(batch.Requests) > b.maxItems {
+		RespondError(writer, request, errs.New(errs.InvalidArgument, "a batch needs between 1 and "+strconv.Itoa(b.maxItems)+" requests"))
+		return
+	}
+	for _, item := range batch.Requests {
+		if !strings.HasPrefix(item.Path, "/") || !strings.HasPrefix(item.Path, b.allowedPrefix) {
+			RespondError(writer, request, errs.New(errs.InvalidArgument, "path "+strconv.Quote(item.Path)+" is not allowed in a batch"))
+			return
+		}
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("batch.items", len(batch.Requests)))
+
+	results := make([]BatchResult, len(batch.Requests))
+	tasks := make([]fanout.Task, len(batch.Requests))
+	for i := range batch.Requests {
+		i, item := i, batch.Requests[i]
+		results[i].ID = item.ID
+		tasks[i] = fanout.Named("batch_item", func(ctx context.Context) error {
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.String("batch.item_id", item.ID),
+				attribute.String("http.method", item.Method),
+				attribute.String("http.target", item.Path),
+			)
+			results[i] = b.serve(ctx, request, item)
+			return nil
+		})
+	}
+	// items fail on their own, a panic in one of them shouldn't take the others down with it
+	fanout.New(fanout.WithPolicy(fanout.CollectAll)).Do(ctx, b.parallelism, tasks...)
+
+	for i := range results {
+		if results[i].Status == 0 {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Body = mustJSON(&ErrorResponse{Code: errs.Internal.String(), Message: "internal error"})
+		}
+		b.items.Add(ctx, 1, attribute.Int("status", results[i].Status))
+	}
+	RespondJSON(writer, &BatchResponse{Responses: results}, http.StatusOK)
+}
+
+// serve runs a single item through our handler
+func (b *Batch) serve(ctx context.Context, parent *http.Request, item BatchItem) BatchResult {
+	method := item.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader = http.NoBody
+	if len(item.Body) > 0 {
+		body = bytes.NewReader(item.Body)
+	}
+	request, err := http.NewRequestWithContext(batchKey.With(ctx, item.ID), method, item.Path, body)
+	if err != nil {
+		return BatchResult{ID: item.ID, Status: http.StatusBadRequest, Body: mustJSON(&ErrorResponse{Code: errs.InvalidArgument.String(), Message: "invalid request"})}
+	}
+	request.Header = parent.Header.Clone()
+	request.Header.Del("Content-Length")
+	// the span of our item is the parent of whatever the handler starts, not the trace the batch came in with
+	request.Header.Del("Traceparent")
+	request.Header.Del("Tracestate")
+	request.Header.Del("X-Cloud-Trace-Context")
+	for k, v := range item.Headers {
+		request.Header.Set(k, v)
+	}
+	if len(item.Body) > 0 && request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Host = parent.Host
+	request.RemoteAddr = parent.RemoteAddr
+
+	w := &batchWriter{header: http.Header{}, limit: b.maxItemBytes}
+	b.handler.ServeHTTP(w, request)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.truncated {
+		return BatchResult{ID: item.ID, Status: http.StatusBadGateway, Body: mustJSON(&ErrorResponse{Code: "response_too_large", Message: "response too large for a batch"})}
+	}
+
+	result := BatchResult{ID: item.ID, Status: w.status, Headers: map[string]string{}}
+	w.header.Del("Content-Length")
+	for k := range w.header {
+		result.Headers[k] = w.header.Get(k)
+	}
+	if w.body.Len() > 0 {
+		if json.Valid(w.body.Bytes()) {
+			result.Body = w.body.Bytes()
+		} else {
+			result.Body = mustJSON(w.body.String())
+		}
+	}
+	return result
+}
+
+func mustJSON(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// batchWriter buffers the response of an item, up to limit bytes
+type batchWriter struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *batchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *batchWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(p) > w.limit {
+		w.truncated = true
+		return 0, errBatchItemTooLarge
+	}
+	return w.body.Write(p)
+}
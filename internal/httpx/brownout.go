@@ -0,0 +1,160 @@
+package httpx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Brownout turns off expensive features one by one as pressure builds, eg serving a listing we already have instead of
+// querying for it again, so the requests we still take stay cheap enough that the shedder doesn't have to reject them.
+// each feature registers the pressure it degrades at and what it does instead
+type Brownout struct {
+	pressure func() float64
+	logger   *logx.AppLogger
+	hold     time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	features map[string]*brownoutFeature
+
+	degraded metric.Int64Counter
+}
+
+type brownoutFeature struct {
+	threshold float64
+	behavior  string
+	degraded  bool
+	// since is when the brownout started and over the last time pressure was at or above threshold
+	since time.Time
+	over  time.Time
+	// requests counts the degraded requests of the current brownout
+	requests int64
+}
+
+type BrownoutOption func(b *Brownout)
+
+// WithBrownoutHold keeps a feature degraded until pressure stayed below its threshold for d, defaults to 30s. without
+// it a feature would flap with every request that comes in or finishes around the threshold
+func WithBrownoutHold(d time.Duration) BrownoutOption {
+	return func(b *Brownout) {
+		b.hold = d
+	}
+}
+
+// WithBrownoutClock replaces time.Now, for tests that step through the hold
+func WithBrownoutClock(now func() time.Time) BrownoutOption {
+	return func(b *Brownout) {
+		b.now = now
+	}
+}
+
+// NewBrownout degrades features by pressure, a fraction of our capacity in use, eg Shedder.Pressure
+func NewBrownout(pressure func() float64, logger *logx.AppLogger, opts ...BrownoutOption) *Brownout {
+	b := &Brownout{
+		pressure: pressure,
+		logger:   logger,
+		hold:     30 * time.Second,
+		now:      time.Now,
+		features: map[string]*brownoutFeature{},
+		degraded: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.brownout.degraded",
+			metric.WithDescription("requests served with a degraded feature, by feature")),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Register degrades feature once pressure reaches threshold, behavior says what we do instead for our logs and the
+// status we serve, eg "serve the last listing". registering a feature again replaces its threshold and behavior
+func (b *Brownout) Register(feature string, threshold float64, behavior string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f, ok := b.features[feature]; ok {
+		f.threshold, f.behavior = threshold, behavior
+		return
+	}
+	b.features[feature] = &brownoutFeature{threshold: threshold, behavior: behavior}
+}
+
+// Degraded reports if the request of ctx should fall back to the degraded behavior of feature. a feature that was
+// never registered is never degraded. the first and last degraded request of a brownout log a brownout_start and
+// brownout_end event, every degraded request is counted and marked on its span
+func (b *Brownout) Degraded(ctx context.Context, feature string) bool {
+	pressure := b.pressure()
+	now := b.now()
+
+	b.mu.Lock()
+	f, ok := b.features[feature]
+	if !ok {
+		b.mu.Unlock()
+		return false
+	}
+	if pressure >= f.threshold {
+		f.over = now
+	}
+	logger := b.logger.WrapTraceContext(ctx)
+	switch {
+	case !f.degraded && pressure >= f.threshold:
+		f.degraded, f.since, f.requests = true, now, 0
+		logger.Warnw("brownout started", "event", "brownout_start", "feature", feature, "behavior", f.behavior,
+			"pressure", pressure, "threshold", f.threshold)
+	case f.degraded && now.Sub(f.over) >= b.hold:
+		f.degraded = false
+		logger.Infow("brownout ended", "event", "brownout_end", "feature", feature, "behavior", f.behavior,
+			"pressure", pressure, "threshold", f.threshold, "degraded_requests", f.requests,
+			"lasted_s", int64(now.Sub(f.since).Seconds()))
+	}
+	degraded := f.degraded
+	if degraded {
+		f.requests++
+	}
+	b.mu.Unlock()
+
+	if degraded {
+		b.degraded.Add(ctx, 1, attribute.String("feature", feature))
+		trace.SpanFromContext(ctx).AddEvent("brownout", trace.WithAttributes(
+			attribute.String("brownout.feature", feature),
+			attribute.Float64("brownout.pressure", pressure),
+		))
+	}
+	return degraded
+}
+
+// BrownoutStatus is where a feature stands, served by Brownout.ServeHTTP
+type BrownoutStatus struct {
+	Feature   string     `json:"feature"`
+	Threshold float64    `json:"threshold"`
+	Behavior  string     `json:"behavior"`
+	Degraded  bool       `json:"degraded"`
+	Since     *time.Time `json:"since,omitempty"`
+	Requests  int64      `json:"degraded_requests,omitempty"`
+}
+
+// ServeHTTP serves our current pressure and the status of every feature, it belongs on an admin endpoint
+func (b *Brownout) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	pressure := b.pressure()
+	b.mu.Lock()
+	statuses := make([]BrownoutStatus, 0, len(b.features))
+	for name, f := range b.features {
+		status := BrownoutStatus{Feature: name, Threshold: f.threshold, Behavior: f.behavior, Degraded: f.degraded}
+		if f.degraded {
+			since := f.since
+			status.Since, status.Requests = &since, f.requests
+		}
+		statuses = append(statuses, status)
+	}
+	b.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Feature < statuses[j].Feature
+	})
+	RespondJSON(writer, map[string]interface{}{"pressure": pressure, "features": statuses}, http.StatusOK)
+}
@@ -0,0 +1,307 @@
+package httpx
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DebugCaptureHeader enables capturing for a single request, its value is "<unix seconds>.<hex hmac-sha256>" with the
+// mac taken over the timestamp, method and path of the request, see SignDebugHeader
+const DebugCaptureHeader = "X-Debug-Capture"
+
+// RedactedValue replaces what a captured header, query parameter or body field held, tooling reading captures can tell what is missing
+const RedactedValue = "[REDACTED]"
+
+const (
+	defaultMaxCaptureBytes = 16 << 10
+	debugHeaderMaxAge      = 5 * time.Minute
+)
+
+var defaultRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key", DebugCaptureHeader}
+
+var defaultRedactedFields = []string{"password", "secret", "token", "access_token", "refresh_token", "api_key", "authorization"}
+
+// DebugCapture logs sanitized request and response bodies alongside our trace id, capturing is opt-in either for
+// every request (a per service flag) or per request with a signed header so production traffic can be inspected
+// without a redeploy
+type DebugCapture struct {
+	logger          *logx.AppLogger
+	secret          []byte
+	always          bool
+	maxBytes        int
+	redactedHeaders map[string]bool
+	redactedFields  map[string]bool
+	now             func() time.Time
+}
+
+type DebugOption func(d *DebugCapture)
+
+// WithDebugSecret enables per request capturing for callers that can sign DebugCaptureHeader
+func WithDebugSecret(secret []byte) DebugOption {
+	return func(d *DebugCapture) {
+		d.secret = secret
+	}
+}
+
+// WithDebugAlways captures every request, meant to be flipped on through config for a short window
+func WithDebugAlways(always bool) DebugOption {
+	return func(d *DebugCapture) {
+		d.always = always
+	}
+}
+
+// WithMaxCaptureBytes limits how much of each body we keep, defaults to 16KiB
+func WithMaxCaptureBytes(n int) DebugOption {
+	return func(d *DebugCapture) {
+		d.maxBytes = n
+	}
+}
+
+// WithRedactedFields adds json keys and query parameters whose values are replaced before logging, matching is case
+// insensitive
+func WithRedactedFields(fields ...string) DebugOption {
+	return func(d *DebugCapture) {
+		for _, f := range fields {
+			d.redactedFields[strings.ToLower(f)] = true
+		}
+	}
+}
+
+// WithRedactedHeaders adds headers whose values are replaced before logging
+func WithRedactedHeaders(headers ...string) DebugOption {
+	return func(d *DebugCapture) {
+		for _, h := range headers {
+			d.redactedHeaders[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+}
+
+// WithDebugClock replaces time.Now, for the signed header check and the logged latency
+func WithDebugClock(now func() time.Time) DebugOption {
+	return func(d *DebugCapture) {
+		d.now = now
+	}
+}
+
+func NewDebugCapture(logger *logx.AppLogger, opts ...DebugOption) *DebugCapture {
+	d := &DebugCapture{
+		logger:          logger,
+		maxBytes:        defaultMaxCaptureBytes,
+		redactedHeaders: map[string]bool{},
+		redactedFields:  map[string]bool{},
+		now:             time.Now,
+	}
+	WithRedactedHeaders(defaultRedactedHeaders...)(d)
+	WithRedactedFields(defaultRedactedFields...)(d)
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// SignDebugHeader produces a DebugCaptureHeader value valid for a few minutes for a single method and path, a header
+// seen on one request can't switch capturing on for any other endpoint. used by tooling such as cmd/replay
+func SignDebugHeader(secret []byte, method, path string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + hex.EncodeToString(debugMAC(secret, ts, method, path))
+}
+
+func debugMAC(secret []byte, ts, method, path string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	// none of the parts can hold a newline, so no two requests sign the same bytes
+	mac.Write([]byte(ts + "\n" + method + "\n" + path))
+	return mac.Sum(nil)
+}
+
+func (d *DebugCapture) enabled(r *http.Request) bool {
+	if d.always {
+		return true
+	}
+	return VerifyDebugHeader(d.secret, r.Header.Get(DebugCaptureHeader), r.Method, r.URL.Path, d.now())
+}
+
+// VerifyDebugHeader checks a value made by SignDebugHeader, it has to be signed with secret for method and path and be
+// at most a few minutes old. nothing verifies without a secret
+func VerifyDebugHeader(secret []byte, header, method, path string, now time.Time) bool {
+	if header == "" || len(secret) == 0 {
+		return false
+	}
+	idx := strings.Index(header, ".")
+	if idx < 0 {
+		return false
+	}
+	ts, sig := header[:idx], header[idx+1:]
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > debugHeaderMaxAge || age < -debugHeaderMaxAge {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, debugMAC(secret, ts, method, path))
+}
+
+// Middleware should be placed after our tracing middleware so the captured entry is correlated with the trace
+func (d *DebugCapture) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !d.enabled(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		start := d.now()
+		reqBody := &captureReader{ReadCloser: request.Body, limit: d.maxBytes}
+		if request.Body != nil && request.Body != http.NoBody {
+			request.Body = reqBody
+		}
+		wrapped, rec := Record(writer, d.maxBytes)
+		next.ServeHTTP(wrapped, request)
+
+		logger := d.logger.WrapTraceContext(request.Context())
+		logger.Infow("debug capture",
+			"request", map[string]interface{}{
+				"method":    request.Method,
+				"url":       d.sanitizeURL(request.URL),
+				"host":      request.Host,
+				"headers":   d.sanitizeHeaders(request.Header),
+				"body":      d.sanitizeBody(reqBody.buf.Bytes(), request.Header.Get("Content-Type")),
+				"truncated": reqBody.truncated,
+			},
+			"response", map[string]interface{}{
+				"status":    rec.Status,
+				"headers":   d.sanitizeHeaders(wrapped.Header()),
+				"body":      d.sanitizeBody(rec.Body.Bytes(), wrapped.Header().Get("Content-Type")),
+				"truncated": rec.Truncated(),
+				"bytes":     rec.BytesWritten,
+			},
+			"latency", d.now().Sub(start).String(),
+		)
+	})
+}
+
+func (d *DebugCapture) sanitizeHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if d.redactedHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = RedactedValue
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// sanitizeURL redacts the query parameters named like a redacted field, eg ?token=
+func (d *DebugCapture) sanitizeURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		// we can't tell the parameters apart, so none of them are logged
+		sanitized := *u
+		sanitized.RawQuery = RedactedValue
+		return sanitized.String()
+	}
+	sanitized := *u
+	sanitized.RawQuery = d.redactValues(query).Encode()
+	return sanitized.String()
+}
+
+// sanitizeBody redacts sensitive keys out of json and form payloads, anything else is logged as text when it is valid
+// utf8. a json or form body we can't parse, most often one cut off at maxBytes, is never logged since we can't tell
+// which parts of it are sensitive
+func (d *DebugCapture) sanitizeBody(b []byte, contentType string) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	switch {
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Sprintf("<unparsed json, %d bytes>", len(b))
+		}
+		return d.redact(v)
+	case strings.Contains(contentType, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(b))
+		if err != nil {
+			return fmt.Sprintf("<unparsed form, %d bytes>", len(b))
+		}
+		return d.redactValues(form).Encode()
+	}
+	if !utf8.Valid(b) {
+		return fmt.Sprintf("<%d bytes of binary data>", len(b))
+	}
+	return string(b)
+}
+
+func (d *DebugCapture) redactValues(values url.Values) url.Values {
+	for k, v := range values {
+		if d.redactedFields[strings.ToLower(k)] {
+			for i := range v {
+				v[i] = RedactedValue
+			}
+		}
+	}
+	return values
+}
+
+func (d *DebugCapture) redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if d.redactedFields[strings.ToLower(k)] {
+				t[k] = RedactedValue
+				continue
+			}
+			t[k] = d.redact(val)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = d.redact(val)
+		}
+	}
+	return v
+}
+
+// captureReader keeps the first limit bytes the handler reads from the request body
+type captureReader struct {
+	io.ReadCloser
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		remaining := c.limit - c.buf.Len()
+		switch {
+		case remaining >= n:
+			c.buf.Write(p[:n])
+		case remaining > 0:
+			c.buf.Write(p[:remaining])
+			c.truncated = true
+		default:
+			c.truncated = true
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,89 @@
+package httpx
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyDebugHeader(t *testing.T) {
+	secret := []byte("debug-secret")
+	now := time.Unix(1622548800, 0)
+	header := SignDebugHeader(secret, http.MethodGet, "/api/notes", now)
+
+	tests := []struct {
+		name   string
+		secret []byte
+		method string
+		path   string
+		now    time.Time
+		want   bool
+	}{
+		{name: "signed", secret: secret, method: http.MethodGet, path: "/api/notes", now: now, want: true},
+		{name: "still_fresh", secret: secret, method: http.MethodGet, path: "/api/notes", now: now.Add(4 * time.Minute), want: true},
+		{name: "expired", secret: secret, method: http.MethodGet, path: "/api/notes", now: now.Add(6 * time.Minute)},
+		{name: "other_method", secret: secret, method: http.MethodDelete, path: "/api/notes", now: now},
+		{name: "other_path", secret: secret, method: http.MethodGet, path: "/api/notes/42", now: now},
+		{name: "other_secret", secret: []byte("another-secret"), method: http.MethodGet, path: "/api/notes", now: now},
+		{name: "no_secret", method: http.MethodGet, path: "/api/notes", now: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyDebugHeader(tt.secret, header, tt.method, tt.path, tt.now); got != tt.want {
+				t.Errorf("VerifyDebugHeader(%s %s) = %t, want %t", tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeURL(t *testing.T) {
+	d := NewDebugCapture(nil, WithRedactedFields("session"))
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "/api/notes", want: "/api/notes"},
+		{url: "/api/notes?page=2", want: "/api/notes?page=2"},
+		{url: "/api/notes?Token=abc&page=2", want: "/api/notes?Token=%5BREDACTED%5D&page=2"},
+		{url: "/api/notes?session=abc&session=def", want: "/api/notes?session=%5BREDACTED%5D&session=%5BREDACTED%5D"},
+		{url: "/api/notes?token=abc;page=2", want: "/api/notes?[REDACTED]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatalf("url.Parse(): %v", err)
+			}
+			if got := d.sanitizeURL(u); got != tt.want {
+				t.Errorf("sanitizeURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeBody(t *testing.T) {
+	d := NewDebugCapture(nil, WithRedactedFields("session"))
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        interface{}
+	}{
+		{name: "empty", contentType: "application/json", want: nil},
+		{name: "json", body: `{"password":"hunter2","title":"groceries"}`, contentType: "application/json", want: map[string]interface{}{"password": RedactedValue, "title": "groceries"}},
+		{name: "truncated_json", body: `{"title":"groceries","password":"hun`, contentType: "application/json", want: "<unparsed json, 36 bytes>"},
+		{name: "form", body: "session=abc&page=2", contentType: "application/x-www-form-urlencoded", want: "page=2&session=%5BREDACTED%5D"},
+		{name: "unparsable_form", body: "session=abc;page=2", contentType: "application/x-www-form-urlencoded; charset=utf-8", want: "<unparsed form, 18 bytes>"},
+		{name: "text", body: "hello", contentType: "text/plain", want: "hello"},
+		{name: "binary", body: "\xff\xfe", contentType: "application/octet-stream", want: "<2 bytes of binary data>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.sanitizeBody([]byte(tt.body), tt.contentType); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeBody() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Validatable is implemented by request bodies that check themselves once decoded, every problem is reported at once
+// rather than one per round trip
+type Validatable interface {
+	Validate() []errs.FieldError
+}
+
+// DecodeJSON decodes the body of request into v, reading at most maxBytes, and validates it when v is Validatable.
+// what is wrong with the body comes back as errs.Invalid, which RespondError answers with a 400 listing every field
+func DecodeJSON(writer http.ResponseWriter, request *http.Request, v interface{}, maxBytes int64) error {
+	if err := invalidJSON(json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxBytes)).Decode(v), maxBytes); err != nil {
+		return err
+	}
+	if validatable, ok := v.(Validatable); ok {
+		if fields := validatable.Validate(); len(fields) > 0 {
+			return errs.Invalid(fields...)
+		}
+	}
+	return nil
+}
+
+// invalidJSON turns an error decoding json into errs.Invalid saying what is wrong with the json, nil stays nil
+func invalidJSON(err error, maxBytes int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		return errs.Invalid(errs.FieldError{In: "body", Constraint: "required", Message: "a json body is required"})
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errs.Invalid(errs.FieldError{In: "body", Constraint: "syntax", Message: "json body ends early"})
+	case errors.As(err, &syntaxErr):
+		return errs.Invalid(errs.FieldError{In: "body", Constraint: "syntax",
+			Message: fmt.Sprintf("invalid json at byte %d", syntaxErr.Offset)})
+	case errors.As(err, &typeErr):
+		return errs.Invalid(errs.FieldError{In: "body", Pointer: fieldPointer(typeErr.Field), Constraint: "type",
+			Message: fmt.Sprintf("must be %s, got %s", jsonType(typeErr.Type.Kind().String()), typeErr.Value)})
+	// http.MaxBytesReader has no error type of its own before go 1.19
+	case strings.Contains(err.Error(), "request body too large"):
+		return errs.Invalid(errs.FieldError{In: "body", Constraint: "maxBytes",
+			Message: fmt.Sprintf("must be at most %d bytes", maxBytes)})
+	default:
+		return errs.Wrapf(err, errs.InvalidArgument, "json.Decode()")
+	}
+	return nil
+}
+
+// LogInvalid logs the field errors of err at debug with the trace of ctx, so support can look up what a client got
+// wrong by the trace id without every bad request cluttering our logs at info
+func LogInvalid(ctx context.Context, logger *logx.AppLogger, err error) {
+	fields := errs.Fields(err)
+	if len(fields) == 0 {
+		return
+	}
+	logger.WrapTraceContext(ctx).Debugw("invalid request", "fields", fields)
+}
+
+// fieldPointer turns the dotted path encoding/json reports, eg items.0.name, into a json pointer
+func fieldPointer(field string) string {
+	if field == "" {
+		return ""
+	}
+	return errs.Pointer(strings.Split(field, ".")...)
+}
+
+// jsonType names a go kind the way a client of our json api knows it
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "slice", kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
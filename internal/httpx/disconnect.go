@@ -0,0 +1,133 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var disconnectKey = ctxval.New("httpx.disconnected", ctxval.WithFormat(func(v interface{}) string {
+	return strconv.FormatBool(atomic.LoadInt32(v.(*int32)) == 1)
+}))
+
+// Disconnected reports if the client of the request behind ctx went away, handlers doing work in a loop (or with a
+// detached context) should check it and stop early, nobody is going to read what they produce
+func Disconnected(ctx context.Context) bool {
+	flag, ok := disconnectKey.Value(ctx)
+	return ok && atomic.LoadInt32(flag.(*int32)) == 1
+}
+
+// DisconnectWatcher notices requests whose context gets cancelled while the handler is still running. go cancels the
+// request context as soon as the client closes the connection, which aborts every firestore query and upstream call
+// made with it. the watcher makes those aborts visible, a "client_disconnected" span event and log entry plus metrics
+// on how often it happens and how much work the handler kept doing afterwards
+type DisconnectWatcher struct {
+	logger   *logx.AppLogger
+	draining func() bool
+	now      func() time.Time
+
+	disconnects metric.Int64Counter
+	wasted      metric.Float64ValueRecorder
+}
+
+type DisconnectOption func(w *DisconnectWatcher)
+
+// WithDraining tells a shutdown apart from a client disconnect, our server cancels every request context when it starts
+// draining, pass serverx.Server.Draining
+func WithDraining(draining func() bool) DisconnectOption {
+	return func(w *DisconnectWatcher) {
+		w.draining = draining
+	}
+}
+
+// WithDisconnectClock replaces time.Now, for the time a handler kept running after its client left
+func WithDisconnectClock(now func() time.Time) DisconnectOption {
+	return func(w *DisconnectWatcher) {
+		w.now = now
+	}
+}
+
+// NewDisconnectWatcher logs with logger when it is non nil
+func NewDisconnectWatcher(logger *logx.AppLogger, opts ...DisconnectOption) *DisconnectWatcher {
+	meter := metric.Must(global.Meter(instrumentationName))
+	w := &DisconnectWatcher{
+		logger:      logger,
+		draining:    func() bool { return false },
+		now:         time.Now,
+		disconnects: meter.NewInt64Counter("httpx.client_disconnects", metric.WithDescription("requests whose client went away before we responded")),
+		wasted: meter.NewFloat64ValueRecorder("httpx.client_disconnects.wasted",
+			metric.WithDescription("time the handler kept running after the client went away"),
+			metric.WithUnit("ms"),
+		),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+func (w *DisconnectWatcher) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		flag := new(int32)
+		request = request.WithContext(disconnectKey.With(ctx, flag))
+
+		done, exited := make(chan struct{}), make(chan struct{})
+		var gone time.Time
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				// a deadline is our own timeout doing its job, only a cancellation means someone left
+				if errors.Is(ctx.Err(), context.Canceled) {
+					gone = w.now()
+					atomic.StoreInt32(flag, 1)
+					w.record(ctx, request)
+				}
+				<-done
+			}
+		}()
+
+		next.ServeHTTP(writer, request)
+		finished := w.now()
+		close(done)
+		<-exited
+
+		if atomic.LoadInt32(flag) == 1 {
+			w.wasted.Record(ctx, float64(finished.Sub(gone))/float64(time.Millisecond), w.reason())
+		}
+	})
+}
+
+func (w *DisconnectWatcher) reason() attribute.KeyValue {
+	if w.draining() {
+		return attribute.String("reason", "server_shutdown")
+	}
+	return attribute.String("reason", "client_disconnected")
+}
+
+func (w *DisconnectWatcher) record(ctx context.Context, request *http.Request) {
+	reason := w.reason()
+	w.disconnects.Add(ctx, 1, reason)
+	trace.SpanFromContext(ctx).AddEvent(reason.Value.AsString(), trace.WithAttributes(
+		attribute.String("http.method", request.Method),
+		attribute.String("http.target", request.URL.Path),
+	))
+	if w.logger != nil {
+		w.logger.WrapTraceContext(ctx).Infow("request context cancelled before we responded",
+			"reason", reason.Value.AsString(),
+			"method", request.Method,
+			"path", request.URL.Path,
+		)
+	}
+}
@@ -0,0 +1,102 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync/atomic"
+)
+
+// Envelope wraps every response of an enveloped api, clients always find the payload in data or what went wrong in
+// error, and everything about the response itself in meta
+type Envelope struct {
+	Data  interface{}    `json:"data,omitempty"`
+	Error *ErrorResponse `json:"error,omitempty"`
+	Meta  Meta           `json:"meta"`
+}
+
+// Meta is what an envelope says about its response
+type Meta struct {
+	// RequestID is the X-Request-Id the request came with, or our trace id without one
+	RequestID  string `json:"request_id,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+	Page       *Page  `json:"page,omitempty"`
+}
+
+// Page describes one page of a listing, the next page is requested with next_page_token until there is none
+type Page struct {
+	Size          int    `json:"size"`
+	NextPageToken string `json:"next_page_token,omitempty"`
+	// Total is the size of the whole listing when it is cheap to know
+	Total int `json:"total,omitempty"`
+}
+
+var envelopeKey = ctxval.New("httpx.envelope", ctxval.WithFormat(func(v interface{}) string {
+	if page := v.(*envelope).page; page != nil {
+		return fmt.Sprintf("page=%+v", *page)
+	}
+	return "enveloped"
+}))
+
+// envelopeFrom returns the envelope Enveloped put in ctx
+func envelopeFrom(ctx context.Context) (*envelope, bool) {
+	e, ok := envelopeKey.Value(ctx)
+	if !ok {
+		return nil, false
+	}
+	return e.(*envelope), true
+}
+
+// envelope is what a handler adds to the meta of its response before responding
+type envelope struct {
+	page *Page
+}
+
+// Enveloped wraps what RespondData and RespondError answer with for every request it serves in an Envelope, RespondJSON
+// is left as it is for responses that have their own format
+func Enveloped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := envelopeKey.With(request.Context(), &envelope{})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// SetPage adds page to the meta of the enveloped response of ctx, it does nothing for requests that aren't enveloped
+func SetPage(ctx context.Context, page Page) {
+	if e, ok := envelopeFrom(ctx); ok {
+		e.page = &page
+	}
+}
+
+// RespondData responds with data, in an Envelope when Enveloped serves request
+func RespondData(writer http.ResponseWriter, request *http.Request, data interface{}, statusCode int) {
+	if e, ok := envelopeFrom(request.Context()); ok {
+		RespondJSON(writer, &Envelope{Data: data, Meta: e.meta(request)}, statusCode)
+		return
+	}
+	RespondJSON(writer, data, statusCode)
+}
+
+// respondEnveloped responds with resp in an Envelope when Enveloped serves request and reports if it did
+func respondEnveloped(writer http.ResponseWriter, request *http.Request, resp *ErrorResponse, statusCode int) bool {
+	e, ok := envelopeFrom(request.Context())
+	if !ok {
+		return false
+	}
+	RespondJSON(writer, &Envelope{Error: resp, Meta: e.meta(request)}, statusCode)
+	return true
+}
+
+func (e *envelope) meta(request *http.Request) Meta {
+	ctx := request.Context()
+	meta := Meta{APIVersion: APIVersion(ctx), Page: e.page, RequestID: request.Header.Get(RequestIDHeader)}
+	if len(meta.RequestID) > 128 {
+		meta.RequestID = ""
+	}
+	if sc := trace.SpanContextFromContext(ctx); meta.RequestID == "" && sc.IsValid() && atomic.LoadInt32(&hideIDs) == 0 {
+		meta.RequestID = sc.TraceID().String()
+	}
+	return meta
+}
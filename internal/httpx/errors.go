@@ -0,0 +1,73 @@
+package httpx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// TraceIDHeader carries the trace id of a failed request, the id cloud trace and our logs file it under
+	TraceIDHeader = "X-Trace-Id"
+	// RequestIDHeader is echoed back on a failed request when the client or a proxy in front of us sent one
+	RequestIDHeader = "X-Request-Id"
+)
+
+// ErrorResponse is the body of every error we return, message is always safe to show the caller. server errors and
+// requests with field errors carry trace_id and request_id so whoever reports them gives us something to look up
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	TraceID   string `json:"trace_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Fields lists every problem with an invalid request, see errs.Invalid
+	Fields []errs.FieldError `json:"fields,omitempty"`
+}
+
+// hideIDs is set by SetCorrelationIDs(false)
+var hideIDs int32
+
+// SetCorrelationIDs turns trace and request ids on server errors on or off, they are on by default. turn them off
+// where a trace id is considered sensitive, eg a public api whose traces share a project with internal services
+func SetCorrelationIDs(enabled bool) {
+	v := int32(1)
+	if enabled {
+		v = 0
+	}
+	atomic.StoreInt32(&hideIDs, v)
+}
+
+// correlate adds our trace and request ids to resp and to the headers of writer, unless they are turned off
+func correlate(ctx context.Context, request *http.Request, writer http.ResponseWriter, resp *ErrorResponse) {
+	if atomic.LoadInt32(&hideIDs) == 1 {
+		return
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		resp.TraceID = sc.TraceID().String()
+		writer.Header().Set(TraceIDHeader, resp.TraceID)
+	}
+	if request != nil {
+		if id := request.Header.Get(RequestIDHeader); id != "" && len(id) <= 128 {
+			resp.RequestID = id
+			writer.Header().Set(RequestIDHeader, id)
+		}
+	}
+}
+
+// RespondError maps err to a status code and a client safe message, in the language Catalog.Middleware negotiated
+// when it ran, and in an Envelope when Enveloped serves request. the internal details of err are left for the caller
+// to log. server errors and field errors get the ids of request, see SetCorrelationIDs
+func RespondError(writer http.ResponseWriter, request *http.Request, err error) {
+	status := errs.HTTPStatus(err)
+	resp := &ErrorResponse{Code: errs.KindOf(err).String(), Message: errs.Message(err), Fields: errs.Fields(err)}
+	if status >= http.StatusInternalServerError || len(resp.Fields) > 0 {
+		correlate(request.Context(), request, writer, resp)
+	}
+	localizeError(request, writer, resp)
+	if respondEnveloped(writer, request, resp, status) {
+		return
+	}
+	RespondJSON(writer, resp, status)
+}
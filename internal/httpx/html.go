@@ -0,0 +1,132 @@
+package httpx
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// HTML renders pages from html/template, which escapes whatever a page is given for where it lands, so a user agent
+// or a note text can't inject markup or script into our responses the way fmt.Fprintf into a page can. pages are
+// parsed once at startup, usually from an embed.FS
+type HTML struct {
+	layout string
+	funcs  template.FuncMap
+	pages  map[string]*template.Template
+}
+
+type HTMLOption func(h *HTML)
+
+// WithLayout renders every page inside the template file name, which calls {{template "content" .}} where the page
+// goes. pages define "content" and anything else the layout asks for, eg {{define "title"}}. defaults to
+// layout.html, an empty name renders pages on their own
+func WithLayout(name string) HTMLOption {
+	return func(h *HTML) {
+		h.layout = name
+	}
+}
+
+// WithHTMLFuncs makes funcs available to every template
+func WithHTMLFuncs(funcs template.FuncMap) HTMLOption {
+	return func(h *HTML) {
+		for name, fn := range funcs {
+			h.funcs[name] = fn
+		}
+	}
+}
+
+// NewHTML parses every .html file of fsys as a page named by its path, eg notes/list.html, except for the layout and
+// partials, files starting with an underscore, which are parsed along with every page
+func NewHTML(fsys fs.FS, opts ...HTMLOption) (*HTML, error) {
+	h := &HTML{layout: "layout.html", funcs: template.FuncMap{}, pages: map[string]*template.Template{}}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	var pages, shared []string
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || path.Ext(name) != ".html" {
+			return nil
+		}
+		if name == h.layout || strings.HasPrefix(path.Base(name), "_") {
+			shared = append(shared, name)
+			return nil
+		}
+		pages = append(pages, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fs.WalkDir(): %v", err)
+	}
+	if h.layout != "" {
+		if _, err := fs.Stat(fsys, h.layout); err != nil {
+			return nil, fmt.Errorf("httpx: layout %s: %v", h.layout, err)
+		}
+	}
+
+	for _, page := range pages {
+		// the layout goes first, it is what the page is executed as
+		files := append(append([]string{}, shared...), page)
+		if h.layout != "" {
+			files = append([]string{h.layout}, files...)
+		}
+		t, err := template.New(path.Base(files[0])).Funcs(h.funcs).ParseFS(fsys, dedupeNames(files)...)
+		if err != nil {
+			return nil, fmt.Errorf("template.ParseFS(%s): %v", page, err)
+		}
+		h.pages[page] = t
+	}
+	return h, nil
+}
+
+// dedupeNames drops the second mention of a file, the layout is also among the shared files
+func dedupeNames(names []string) []string {
+	seen := map[string]bool{}
+	deduped := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			deduped = append(deduped, name)
+		}
+	}
+	return deduped
+}
+
+// Render executes page with data into a pooled buffer and writes it with the given status code. a page that fails to
+// execute is answered with a clean error response rather than half a page. a page we don't have is a bug of ours, it
+// is answered with a 500 too
+func (h *HTML) Render(writer http.ResponseWriter, request *http.Request, page string, data interface{}, statusCode int) {
+	t, ok := h.pages[page]
+	if !ok {
+		RespondError(writer, request, errs.Wrapf(fmt.Errorf("no page %s", page), errs.Internal, "h.Render()"))
+		return
+	}
+
+	buf := respondPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledResponse {
+			buf.Reset()
+			respondPool.Put(buf)
+		}
+	}()
+	if err := t.Execute(buf, data); err != nil {
+		RespondError(writer, request, errs.Wrapf(err, errs.Internal, "t.Execute(%s)", page))
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	// browsers take our word for the content type rather than sniffing script out of a page
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(statusCode)
+	buf.WriteTo(writer)
+}
@@ -0,0 +1,128 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"golang.org/x/text/language"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Catalog translates the messages of our error responses, codes stay the same in every language so clients can keep
+// branching on them. messages are looked up by their english text, eg "beer not found", so errs.New calls don't change
+// and a message missing from a catalog, or one with values in it, stays in english
+type Catalog struct {
+	matcher  language.Matcher
+	tags     []language.Tag
+	messages map[language.Tag]map[string]string
+}
+
+// LoadCatalog reads a catalog from the <language>.json files in dir of fsys, eg locales/fr.json, each a json object
+// of english message to translation. english is the fallback and needs no file. fsys is typically a go:embed
+// embed.FS, so the catalog ships with the binary
+func LoadCatalog(fsys fs.FS, dir string) (*Catalog, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("fs.ReadDir(%s): %v", dir, err)
+	}
+	c := &Catalog{tags: []language.Tag{language.English}, messages: map[language.Tag]map[string]string{}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || path.Ext(name) != ".json" {
+			continue
+		}
+		tag, err := language.Parse(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("language.Parse(%s): %v", name, err)
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile(%s): %v", name, err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal(%s): %v", name, err)
+		}
+		c.tags = append(c.tags, tag)
+		c.messages[tag] = messages
+	}
+	c.matcher = language.NewMatcher(c.tags)
+	return c, nil
+}
+
+// Languages are the languages we have messages in, english first
+func (c *Catalog) Languages() []language.Tag {
+	return c.tags
+}
+
+var localeKey = ctxval.New("httpx.locale", ctxval.WithFormat(func(v interface{}) string {
+	return v.(locale).tag.String()
+}))
+
+// locale is the catalog of a request and the language it negotiated
+type locale struct {
+	catalog *Catalog
+	tag     language.Tag
+}
+
+// Middleware picks the language of each request from its Accept-Language header, RespondError answers in it
+func (c *Catalog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// a malformed header matches english, the same as none at all
+		preferred, _, _ := language.ParseAcceptLanguage(request.Header.Get("Accept-Language"))
+		_, index, _ := c.matcher.Match(preferred...)
+		ctx := localeKey.With(request.Context(), locale{catalog: c, tag: c.tags[index]})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Localize translates message into the language of ctx, message is returned as is without a translation
+func Localize(ctx context.Context, message string) string {
+	v, ok := localeKey.Value(ctx)
+	if !ok {
+		return message
+	}
+	l := v.(locale)
+	if translated, ok := l.catalog.messages[l.tag][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// Language is the language Catalog.Middleware negotiated for ctx, english when it didn't run
+func Language(ctx context.Context) language.Tag {
+	if l, ok := localeKey.Value(ctx); ok {
+		return l.(locale).tag
+	}
+	return language.English
+}
+
+// localizeError translates the messages of resp into the language of request, a message made of field errors is
+// put together again from their translations
+func localizeError(request *http.Request, writer http.ResponseWriter, resp *ErrorResponse) {
+	ctx := request.Context()
+	if _, ok := localeKey.Value(ctx); !ok {
+		return
+	}
+	writer.Header().Set("Content-Language", Language(ctx).String())
+	writer.Header().Add("Vary", "Accept-Language")
+	if len(resp.Fields) == 0 {
+		resp.Message = Localize(ctx, resp.Message)
+		return
+	}
+	// the fields belong to the error, translate a copy
+	fields := make([]errs.FieldError, len(resp.Fields))
+	problems := make([]string, 0, len(resp.Fields))
+	for i, f := range resp.Fields {
+		f.Message = Localize(ctx, f.Message)
+		fields[i] = f
+		problems = append(problems, f.In+f.Pointer+": "+f.Message)
+	}
+	resp.Fields = fields
+	resp.Message = strings.Join(problems, "; ")
+}
@@ -0,0 +1,289 @@
+package httpx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+)
+
+// IngestSink writes a batch of decoded records, eg to firestore or bigquery. a batch is all or nothing for the
+// client, a sink that fails half way should be safe to write again from the start
+type IngestSink func(ctx context.Context, records []interface{}) error
+
+// LineError is a line of an ingest that was rejected, lines count from 1
+type LineError struct {
+	Line    int               `json:"line"`
+	Message string            `json:"message"`
+	Fields  []errs.FieldError `json:"fields,omitempty"`
+}
+
+// IngestProgress is how far an ingest got, sent as a "progress" event after every batch the sink wrote
+type IngestProgress struct {
+	Lines    int `json:"lines"`
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+	// CommittedLine is the last line that was either written or rejected, a client that lost the stream resumes
+	// with the line after it
+	CommittedLine int `json:"committed_line"`
+}
+
+// IngestSummary is the "done" event of an ingest
+type IngestSummary struct {
+	IngestProgress
+	Errors []LineError `json:"errors,omitempty"`
+	// ErrorsTruncated is set when more lines were rejected than we report
+	ErrorsTruncated bool `json:"errors_truncated,omitempty"`
+}
+
+// Ingest takes a body of newline delimited json records and writes them to a sink in batches, for imports too large
+// to send as a single json document. lines are decoded and validated one at a time and a bad line is reported
+// rather than failing the whole ingest, so memory is bounded by a batch and a line no matter how large the body is.
+// the response is a Stream acknowledging every batch as it is written, which tells the client where to pick up when
+// an import doesn't finish
+type Ingest struct {
+	newRecord    func() interface{}
+	sink         IngestSink
+	batchSize    int
+	maxLineBytes int
+	maxBytes     int64
+	maxRejects   int
+	maxErrors    int
+
+	lines metric.Int64Counter
+}
+
+type IngestOption func(i *Ingest)
+
+// WithIngestBatchSize hands the sink n records at a time, defaults to 500, the most a firestore batch takes
+func WithIngestBatchSize(n int) IngestOption {
+	return func(i *Ingest) {
+		i.batchSize = n
+	}
+}
+
+// WithIngestMaxLineBytes rejects lines longer than n bytes without buffering them, defaults to 1MiB
+func WithIngestMaxLineBytes(n int) IngestOption {
+	return func(i *Ingest) {
+		i.maxLineBytes = n
+	}
+}
+
+// WithIngestMaxBytes bounds the whole body, defaults to 1GiB. cloud run caps http/1 requests at 32MiB, anything
+// larger has to come in over http/2
+func WithIngestMaxBytes(n int64) IngestOption {
+	return func(i *Ingest) {
+		i.maxBytes = n
+	}
+}
+
+// WithIngestMaxRejects gives up on an ingest once more than n lines were rejected, it is most likely not what we
+// expect at all. defaults to 1000, below zero never gives up
+func WithIngestMaxRejects(n int) IngestOption {
+	return func(i *Ingest) {
+		i.maxRejects = n
+	}
+}
+
+// WithIngestMaxErrors reports the first n rejected lines in the summary, defaults to 100
+func WithIngestMaxErrors(n int) IngestOption {
+	return func(i *Ingest) {
+		i.maxErrors = n
+	}
+}
+
+// NewIngest decodes every line into a new value of newRecord, which must return a pointer, and hands them to sink.
+// records that are Validatable are validated before they are accepted
+func NewIngest(newRecord func() interface{}, sink IngestSink, opts ...IngestOption) *Ingest {
+	i := &Ingest{
+		newRecord:    newRecord,
+		sink:         sink,
+		batchSize:    500,
+		maxLineBytes: 1 << 20,
+		maxBytes:     1 << 30,
+		maxRejects:   1000,
+		maxErrors:    100,
+		lines: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.ingest.lines",
+			metric.WithDescription("ingested lines by outcome, accepted or rejected")),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+func (i *Ingest) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	stream, err := NewStream(writer, request)
+	if err != nil {
+		RespondError(writer, request, errs.Wrapf(err, errs.Internal, "NewStream()"))
+		return
+	}
+	reader := bufio.NewReaderSize(http.MaxBytesReader(writer, request.Body, i.maxBytes), 64<<10)
+	span := trace.SpanFromContext(ctx)
+	// without full duplex progress waits for the whole body, what we write first would cut it off
+	duplex, read := fullDuplex(writer, request), false
+	var held *IngestProgress
+
+	var summary IngestSummary
+	batch := make([]interface{}, 0, i.batchSize)
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("ingest.lines", summary.Lines),
+			attribute.Int("ingest.accepted", summary.Accepted),
+			attribute.Int("ingest.rejected", summary.Rejected),
+		)
+	}()
+
+	// flush writes what is batched and acknowledges it, every line read so far is settled once it returns
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := i.sink(ctx, batch); err != nil {
+				return errs.Wrapf(err, errs.Unavailable, "i.sink()")
+			}
+			i.lines.Add(ctx, int64(len(batch)), attribute.String("outcome", "accepted"))
+			summary.Accepted += len(batch)
+			span.AddEvent("ingest.batch", trace.WithAttributes(
+				attribute.Int("ingest.records", len(batch)),
+				attribute.Int("ingest.line", summary.Lines),
+			))
+			batch = batch[:0]
+		}
+		summary.CommittedLine = summary.Lines
+		if !duplex && !read {
+			progress := summary.IngestProgress
+			held = &progress
+			return nil
+		}
+		return stream.Send("progress", summary.IngestProgress)
+	}
+	// fail ends the ingest, after the progress we held back so the client still knows where to pick up
+	fail := func(err error) {
+		if held != nil {
+			stream.Send("progress", held)
+		}
+		stream.Fail(err)
+	}
+
+	for {
+		line, tooLong, readErr := readLine(reader, i.maxLineBytes)
+		if readErr != nil && readErr != io.EOF {
+			// a client that went away has nobody left to tell
+			if ctx.Err() == nil {
+				fail(readError(readErr, "reader.Read()"))
+			}
+			return
+		}
+		if len(line) > 0 || tooLong {
+			summary.Lines++
+			record, rejected := i.decode(line, tooLong)
+			if rejected != nil {
+				rejected.Line = summary.Lines
+				i.lines.Add(ctx, 1, attribute.String("outcome", "rejected"))
+				summary.Rejected++
+				if len(summary.Errors) < i.maxErrors {
+					summary.Errors = append(summary.Errors, *rejected)
+				} else {
+					summary.ErrorsTruncated = true
+				}
+				if i.maxRejects >= 0 && summary.Rejected > i.maxRejects {
+					fail(errs.Invalid(errs.FieldError{In: "body", Constraint: "maxRejects",
+						Message: fmt.Sprintf("gave up after %d rejected lines, the last at line %d", summary.Rejected, summary.Lines)}))
+					return
+				}
+			} else {
+				batch = append(batch, record)
+			}
+			if len(batch) == i.batchSize {
+				if err := flush(); err != nil {
+					fail(err)
+					return
+				}
+			}
+		} else if readErr == nil {
+			// blank lines only count towards line numbers
+			summary.Lines++
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	read = true
+	if err := flush(); err != nil {
+		fail(err)
+		return
+	}
+	stream.Done(summary)
+}
+
+// fullDuplex lets us respond while the body of request is still coming in, which http/2 always does. go's http/1
+// server discards what is left of a body as soon as a handler flushes, unless the response writer has full duplex
+// enabled, which it only can from go 1.21 on. the wrappers our middleware puts around it are seen through by Unwrap
+func fullDuplex(writer http.ResponseWriter, request *http.Request) bool {
+	if request.ProtoMajor >= 2 {
+		return true
+	}
+	for {
+		if duplexer, ok := writer.(interface{ EnableFullDuplex() error }); ok {
+			return duplexer.EnableFullDuplex() == nil
+		}
+		unwrapper, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		writer = unwrapper.Unwrap()
+	}
+}
+
+// decode decodes a single line into a new record, or says why it was rejected
+func (i *Ingest) decode(line []byte, tooLong bool) (interface{}, *LineError) {
+	if tooLong {
+		return nil, &LineError{Message: fmt.Sprintf("lines are at most %d bytes", i.maxLineBytes)}
+	}
+	record := i.newRecord()
+	err := invalidJSON(json.Unmarshal(line, record), int64(i.maxLineBytes))
+	if err == nil {
+		if validatable, ok := record.(Validatable); ok {
+			if fields := validatable.Validate(); len(fields) > 0 {
+				err = errs.Invalid(fields...)
+			}
+		}
+	}
+	if err != nil {
+		return nil, &LineError{Message: errs.Message(err), Fields: errs.Fields(err)}
+	}
+	return record, nil
+}
+
+// readLine reads the next line of r without its line ending, empty when the line is blank. a line longer than max
+// is skipped rather than buffered and comes back as tooLong. the line is only valid until the next read
+func readLine(r *bufio.Reader, max int) (line []byte, tooLong bool, err error) {
+	var long []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(long)+len(bytes.TrimRight(chunk, "\r\n")) > max {
+			tooLong, long = true, nil
+		}
+		if err == bufio.ErrBufferFull {
+			if !tooLong {
+				long = append(long, chunk...)
+			}
+			continue
+		}
+		if tooLong {
+			return nil, true, err
+		}
+		if long != nil {
+			chunk = append(long, chunk...)
+		}
+		return bytes.TrimSpace(chunk), false, err
+	}
+}
@@ -0,0 +1,80 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Encoder lets a faster json implementation (segmentio/encoding/json, jsoniter, ...) replace encoding/json
+type Encoder interface {
+	Encode(w io.Writer, v interface{}) error
+}
+
+// JSONWriter can be implemented by hot response types to skip reflection entirely, eg a thin adapter around an
+// easyjson generated MarshalEasyJSON method
+type JSONWriter interface {
+	WriteJSON(w io.Writer) error
+}
+
+type stdEncoder struct{}
+
+func (stdEncoder) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+var (
+	encoderMu sync.RWMutex
+	encoder   Encoder = stdEncoder{}
+)
+
+// SetEncoder swaps the encoder used by RespondJSON, call it once during startup
+func SetEncoder(e Encoder) {
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+	encoder = e
+}
+
+func currentEncoder() Encoder {
+	encoderMu.RLock()
+	defer encoderMu.RUnlock()
+	return encoder
+}
+
+var respondPool = sync.Pool{
+	New: func() interface{} { return bytes.NewBuffer(make([]byte, 0, 4<<10)) },
+}
+
+// buffers that grew past this are dropped so one huge response does not pin memory in the pool
+const maxPooledResponse = 256 << 10
+
+// RespondJSON encodes data into a pooled buffer and writes it with the given status code. encoding into a buffer
+// first means an encoding failure can still be reported as a clean 500, instead of a half written 200
+func RespondJSON(writer http.ResponseWriter, data interface{}, statusCode int) {
+	buf := respondPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledResponse {
+			buf.Reset()
+			respondPool.Put(buf)
+		}
+	}()
+
+	var err error
+	if jw, ok := data.(JSONWriter); ok {
+		err = jw.WriteJSON(buf)
+	} else {
+		err = currentEncoder().Encode(buf, data)
+	}
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	writer.WriteHeader(statusCode)
+	buf.WriteTo(writer)
+}
@@ -0,0 +1,186 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// discardWriter is a ResponseWriter that keeps nothing, so a benchmark only measures what we allocate
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(statusCode int) {}
+
+// benchmarkResponse is the size of a typical api response, a page of a few items
+type benchmarkResponse struct {
+	ID    string            `json:"id"`
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags"`
+	Items []benchmarkItem   `json:"items"`
+	Meta  map[string]string `json:"meta"`
+}
+
+type benchmarkItem struct {
+	ID    int     `json:"id"`
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+func newBenchmarkResponse() *benchmarkResponse {
+	response := &benchmarkResponse{
+		ID:   "beer-123",
+		Name: "hazy ipa",
+		Tags: []string{"hoppy", "hazy", "new england"},
+		Meta: map[string]string{"page": "1", "page_size": "20"},
+	}
+	for i := 0; i < 20; i++ {
+		response.Items = append(response.Items, benchmarkItem{ID: i, Name: "item", Price: 4.99})
+	}
+	return response
+}
+
+func BenchmarkRespondJSON(b *testing.B) {
+	writer := &discardWriter{header: http.Header{}}
+	response := newBenchmarkResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RespondJSON(writer, response, http.StatusOK)
+	}
+}
+
+// BenchmarkRespondJSONMarshal is the baseline RespondJSON replaced, json.Marshal into a fresh slice and one Write
+func BenchmarkRespondJSONMarshal(b *testing.B) {
+	writer := &discardWriter{header: http.Header{}}
+	response := newBenchmarkResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		body, err := json.Marshal(response)
+		if err != nil {
+			b.Fatalf("json.Marshal(): %v", err)
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	}
+}
+
+// marshalEncoder stands in for a faster json implementation plugged in through SetEncoder
+type marshalEncoder struct{}
+
+func (marshalEncoder) Encode(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+func BenchmarkRespondJSONEncoder(b *testing.B) {
+	SetEncoder(marshalEncoder{})
+	b.Cleanup(func() { SetEncoder(stdEncoder{}) })
+	writer := &discardWriter{header: http.Header{}}
+	response := newBenchmarkResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RespondJSON(writer, response, http.StatusOK)
+	}
+}
+
+// writerResponse writes benchmarkResponse by hand, like an easyjson adapter would, no reflection involved
+type writerResponse struct {
+	*benchmarkResponse
+}
+
+func (r writerResponse) WriteJSON(w io.Writer) error {
+	buf := make([]byte, 0, 1<<10)
+	buf = append(buf, `{"id":`...)
+	buf = strconv.AppendQuote(buf, r.ID)
+	buf = append(buf, `,"name":`...)
+	buf = strconv.AppendQuote(buf, r.Name)
+	buf = append(buf, `,"tags":[`...)
+	for i, tag := range r.Tags {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, tag)
+	}
+	buf = append(buf, `],"items":[`...)
+	for i, item := range r.Items {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, `{"id":`...)
+		buf = strconv.AppendInt(buf, int64(item.ID), 10)
+		buf = append(buf, `,"name":`...)
+		buf = strconv.AppendQuote(buf, item.Name)
+		buf = append(buf, `,"price":`...)
+		buf = strconv.AppendFloat(buf, item.Price, 'f', -1, 64)
+		buf = append(buf, '}')
+	}
+	buf = append(buf, `],"meta":{`...)
+	// encoding/json sorts map keys, so do we
+	keys := make([]string, 0, len(r.Meta))
+	for k := range r.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, k)
+		buf = append(buf, ':')
+		buf = strconv.AppendQuote(buf, r.Meta[k])
+	}
+	buf = append(buf, "}}\n"...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func BenchmarkRespondJSONWriter(b *testing.B) {
+	writer := &discardWriter{header: http.Header{}}
+	response := writerResponse{newBenchmarkResponse()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RespondJSON(writer, response, http.StatusOK)
+	}
+}
+
+// TestRespondJSONBenchmarkBodies keeps the benchmarks honest, every variant has to produce the same body
+func TestRespondJSONBenchmarkBodies(t *testing.T) {
+	response := newBenchmarkResponse()
+	want, err := json.Marshal(response)
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+	want = append(want, '\n')
+
+	var encoded, written bytes.Buffer
+	if err := (marshalEncoder{}).Encode(&encoded, response); err != nil {
+		t.Fatalf("marshalEncoder.Encode(): %v", err)
+	}
+	if err := (writerResponse{response}).WriteJSON(&written); err != nil {
+		t.Fatalf("writerResponse.WriteJSON(): %v", err)
+	}
+	if !bytes.Equal(encoded.Bytes(), want) {
+		t.Errorf("marshalEncoder wrote %s, want %s", encoded.Bytes(), want)
+	}
+	if !bytes.Equal(written.Bytes(), want) {
+		t.Errorf("writerResponse wrote %s, want %s", written.Bytes(), want)
+	}
+}
@@ -0,0 +1,88 @@
+package httpx
+
+import (
+	"bytes"
+	"github.com/felixge/httpsnoop"
+	"io"
+	"net/http"
+)
+
+// Recorder captures what a handler wrote to the client, the wrapped writer keeps any optional interfaces the original
+// writer supported (http.Flusher, http.Hijacker, ...) so streaming handlers keep working behind our middleware
+type Recorder struct {
+	Status       int
+	BytesWritten int64
+	// Body holds up to captureLimit bytes of the response when capturing is enabled
+	Body *bytes.Buffer
+
+	captureLimit int
+	wroteHeader  bool
+}
+
+// Record wraps w, captureLimit > 0 will also buffer that many bytes of the response body
+func Record(w http.ResponseWriter, captureLimit int) (http.ResponseWriter, *Recorder) {
+	rec := &Recorder{Status: http.StatusOK, captureLimit: captureLimit}
+	if captureLimit > 0 {
+		rec.Body = &bytes.Buffer{}
+	}
+	wrapped := httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				if !rec.wroteHeader {
+					rec.Status = code
+					rec.wroteHeader = true
+				}
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				rec.wroteHeader = true
+				rec.capture(b)
+				n, err := next(b)
+				rec.BytesWritten += int64(n)
+				return n, err
+			}
+		},
+		ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				rec.wroteHeader = true
+				if rec.Body != nil {
+					src = io.TeeReader(src, writerFunc(func(b []byte) (int, error) {
+						rec.capture(b)
+						return len(b), nil
+					}))
+				}
+				n, err := next(src)
+				rec.BytesWritten += n
+				return n, err
+			}
+		},
+	})
+	return wrapped, rec
+}
+
+// Truncated reports if the response was larger than what we captured
+func (r *Recorder) Truncated() bool {
+	return r.Body != nil && r.BytesWritten > int64(r.Body.Len())
+}
+
+func (r *Recorder) capture(b []byte) {
+	if r.Body == nil {
+		return
+	}
+	remaining := r.captureLimit - r.Body.Len()
+	if remaining <= 0 {
+		return
+	}
+	if len(b) > remaining {
+		b = b[:remaining]
+	}
+	r.Body.Write(b)
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
@@ -0,0 +1,424 @@
+package httpx
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/httpx"
+
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = 30 * time.Second
+)
+
+// Backoff tells a rejected client how to space out its retries
+type Backoff struct {
+	InitialMS  int64   `json:"initial_ms"`
+	MaxMS      int64   `json:"max_ms"`
+	Multiplier float64 `json:"multiplier"`
+	Jitter     string  `json:"jitter"`
+}
+
+// RejectResponse is the body of a shed request, retry_after_ms mirrors the Retry-After header at full precision
+type RejectResponse struct {
+	ErrorResponse
+	RetryAfterMS int64   `json:"retry_after_ms"`
+	Backoff      Backoff `json:"backoff"`
+}
+
+// PriorityClass is a class of callers sharing a queue for in flight slots, see WithPriorities
+type PriorityClass struct {
+	Name string
+	// QueueSize is how many requests of the class wait for a slot at most, any more are shed right away
+	QueueSize int
+	// MaxWait is how long a request of the class waits for a slot before it is shed
+	MaxWait time.Duration
+}
+
+// waiter is a request queued for a slot, ready is closed once it was granted one
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// Shedder rejects requests we can't serve in time instead of letting them queue up behind each other. requests over
+// the rate limit get a 429 and requests over the in flight limit get a 503, both with a Retry-After that reflects how
+// long it should actually take us to have room again. with priorities, requests over the in flight limit wait in a
+// short queue of their class instead, and free slots go to the most important class waiting
+type Shedder struct {
+	// maxInFlight and inFlight are accessed atomically
+	maxInFlight int64
+	inFlight    int64
+
+	// rate limiting is a token bucket refilled at rate tokens per second
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+
+	// latency is an ewma of request latency in nanoseconds, used to estimate when a slot frees up
+	latency int64
+
+	// priority queueing, classes are ordered most important first and queues holds the waiters of each
+	classify    func(request *http.Request) string
+	classes     []PriorityClass
+	starveAfter int
+	qmu         sync.Mutex
+	queues      [][]*waiter
+	// skipped counts the slots handed to more important classes while a class had requests waiting
+	skipped []int
+
+	rejects   metric.Int64Counter
+	load      metric.Float64ValueRecorder
+	queueWait metric.Int64ValueRecorder
+}
+
+type ShedOption func(s *Shedder)
+
+// WithMaxInFlight sheds requests once n are being served, a good starting point is the cloud run concurrency setting
+func WithMaxInFlight(n int) ShedOption {
+	return func(s *Shedder) {
+		s.maxInFlight = int64(n)
+	}
+}
+
+// WithRateLimit sheds requests above perSecond, allowing bursts of up to burst requests
+func WithRateLimit(perSecond float64, burst int) ShedOption {
+	return func(s *Shedder) {
+		s.rate = perSecond
+		s.burst = float64(burst)
+		s.tokens = float64(burst)
+	}
+}
+
+// WithPriorities queues requests over the in flight limit by class instead of shedding them, classify names the class
+// of a request and classes are ordered most important first. an unknown class is queued as the least important one.
+// a free slot goes to the most important class with requests waiting, unless a less important one was passed over
+// starveAfter times in a row, so a steady stream of interactive requests can't starve batch callers completely
+func WithPriorities(classify func(request *http.Request) string, starveAfter int, classes ...PriorityClass) ShedOption {
+	return func(s *Shedder) {
+		s.classify = classify
+		s.starveAfter = starveAfter
+		s.classes = classes
+	}
+}
+
+// WithShedClock replaces time.Now, for tests that step through the token bucket
+func WithShedClock(now func() time.Time) ShedOption {
+	return func(s *Shedder) {
+		s.now = now
+	}
+}
+
+func NewShedder(opts ...ShedOption) *Shedder {
+	s := &Shedder{now: time.Now, latency: int64(100 * time.Millisecond)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.last = s.now()
+
+	meter := metric.Must(global.Meter(instrumentationName))
+	s.rejects = meter.NewInt64Counter("httpx.shed.rejects", metric.WithDescription("requests rejected by reason"))
+	s.load = meter.NewFloat64ValueRecorder("httpx.shed.load",
+		metric.WithDescription("in flight requests as a fraction of the limit, recorded per request by outcome"))
+	s.queueWait = meter.NewInt64ValueRecorder("httpx.shed.queue_wait",
+		metric.WithDescription("time requests waited for an in flight slot by priority class and outcome"), metric.WithUnit("ms"))
+	s.queues = make([][]*waiter, len(s.classes))
+	s.skipped = make([]int, len(s.classes))
+	meter.NewInt64ValueObserver("httpx.shed.in_flight", func(ctx context.Context, result metric.Int64ObserverResult) {
+		result.Observe(atomic.LoadInt64(&s.inFlight))
+	}, metric.WithDescription("requests currently being served"))
+	if len(s.classes) > 0 {
+		meter.NewInt64ValueObserver("httpx.shed.queued", func(ctx context.Context, result metric.Int64ObserverResult) {
+			s.qmu.Lock()
+			defer s.qmu.Unlock()
+			for i, class := range s.classes {
+				result.Observe(int64(len(s.queues[i])), attribute.String("class", class.Name))
+			}
+		}, metric.WithDescription("requests waiting for an in flight slot by priority class"))
+	}
+	return s
+}
+
+// SetMaxInFlight changes the in flight limit of a running shedder, 0 turns it off
+func (s *Shedder) SetMaxInFlight(n int) {
+	atomic.StoreInt64(&s.maxInFlight, int64(n))
+	// a raised limit has room for requests that are waiting
+	s.qmu.Lock()
+	defer s.qmu.Unlock()
+	s.dispatch()
+}
+
+// SetRateLimit changes the rate limit of a running shedder, a perSecond of 0 turns it off. the bucket starts out full
+func (s *Shedder) SetRateLimit(perSecond float64, burst int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = perSecond
+	s.burst = float64(burst)
+	s.tokens = float64(burst)
+	s.last = s.now()
+}
+
+// Pressure is how much of our in flight limit is in use, 1 is at the limit. it stays 0 without a limit, see Brownout
+func (s *Shedder) Pressure() float64 {
+	maxInFlight := atomic.LoadInt64(&s.maxInFlight)
+	if maxInFlight <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&s.inFlight)) / float64(maxInFlight)
+}
+
+// Middleware should sit as early as possible in the chain so rejecting a request stays cheap
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if wait, ok := s.allow(); !ok {
+			s.reject(ctx, writer, "rate_limited", http.StatusTooManyRequests, wait)
+			return
+		}
+
+		if len(s.classes) > 0 {
+			s.serveQueued(writer, request, next)
+			return
+		}
+
+		inFlight := atomic.AddInt64(&s.inFlight, 1)
+		defer atomic.AddInt64(&s.inFlight, -1)
+		if maxInFlight := atomic.LoadInt64(&s.maxInFlight); maxInFlight > 0 && inFlight > maxInFlight {
+			s.reject(ctx, writer, "overloaded", http.StatusServiceUnavailable, s.drainEstimate(inFlight, maxInFlight))
+			return
+		}
+		s.recordLoad(ctx, inFlight, "accepted")
+
+		start := s.now()
+		next.ServeHTTP(writer, request)
+		s.observeLatency(s.now().Sub(start))
+	})
+}
+
+// serveQueued serves request once its class gets an in flight slot, or sheds it when its queue is full or it waited
+// too long
+func (s *Shedder) serveQueued(writer http.ResponseWriter, request *http.Request, next http.Handler) {
+	ctx := request.Context()
+	class := s.classOf(request)
+	name := attribute.String("class", s.classes[class].Name)
+	start := s.now()
+	ok := s.acquire(ctx, class)
+	waited := s.now().Sub(start)
+	if !ok {
+		s.queueWait.Record(ctx, waited.Milliseconds(), name, attribute.String("outcome", "shed"))
+		// the requests waiting ahead are as much in the way as those in flight
+		s.qmu.Lock()
+		pending := atomic.LoadInt64(&s.inFlight) + int64(s.queued())
+		s.qmu.Unlock()
+		s.reject(ctx, writer, "overloaded", http.StatusServiceUnavailable, s.drainEstimate(pending, atomic.LoadInt64(&s.maxInFlight)))
+		return
+	}
+	defer s.release()
+	s.queueWait.Record(ctx, waited.Milliseconds(), name, attribute.String("outcome", "admitted"))
+	s.recordLoad(ctx, atomic.LoadInt64(&s.inFlight), "accepted")
+
+	start = s.now()
+	next.ServeHTTP(writer, request)
+	s.observeLatency(s.now().Sub(start))
+}
+
+// classOf is the index of the class of request
+func (s *Shedder) classOf(request *http.Request) int {
+	name := s.classify(request)
+	for i, class := range s.classes {
+		if class.Name == name {
+			return i
+		}
+	}
+	return len(s.classes) - 1
+}
+
+// acquire takes an in flight slot for a request of class, waiting in the queue of its class while there is none
+func (s *Shedder) acquire(ctx context.Context, class int) bool {
+	s.qmu.Lock()
+	maxInFlight := atomic.LoadInt64(&s.maxInFlight)
+	// nobody jumps the queue, a free slot goes to whoever waits for it
+	if maxInFlight <= 0 || (atomic.LoadInt64(&s.inFlight) < maxInFlight && s.queued() == 0) {
+		atomic.AddInt64(&s.inFlight, 1)
+		s.qmu.Unlock()
+		return true
+	}
+	if len(s.queues[class]) >= s.classes[class].QueueSize {
+		s.qmu.Unlock()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	s.queues[class] = append(s.queues[class], w)
+	s.qmu.Unlock()
+
+	timer := time.NewTimer(s.classes[class].MaxWait)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	s.qmu.Lock()
+	defer s.qmu.Unlock()
+	// granted a slot just as we gave up, it is ours to use or release
+	if w.granted {
+		return true
+	}
+	for i, queued := range s.queues[class] {
+		if queued == w {
+			s.queues[class] = append(s.queues[class][:i], s.queues[class][i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// release frees the slot of a request and hands it to the next one waiting
+func (s *Shedder) release() {
+	s.qmu.Lock()
+	defer s.qmu.Unlock()
+	atomic.AddInt64(&s.inFlight, -1)
+	s.dispatch()
+}
+
+// dispatch hands free slots to waiting requests, it is called with qmu held
+func (s *Shedder) dispatch() {
+	for {
+		maxInFlight := atomic.LoadInt64(&s.maxInFlight)
+		if maxInFlight > 0 && atomic.LoadInt64(&s.inFlight) >= maxInFlight {
+			return
+		}
+		class := s.next()
+		if class < 0 {
+			return
+		}
+		w := s.queues[class][0]
+		s.queues[class] = s.queues[class][1:]
+		w.granted = true
+		atomic.AddInt64(&s.inFlight, 1)
+		close(w.ready)
+	}
+}
+
+// next picks the class the next free slot goes to, the most important one waiting unless a less important one waiting
+// was passed over starveAfter times. -1 when nobody waits
+func (s *Shedder) next() int {
+	pick := -1
+	for i := range s.queues {
+		if len(s.queues[i]) == 0 {
+			continue
+		}
+		if pick < 0 {
+			pick = i
+			continue
+		}
+		if s.starveAfter > 0 && s.skipped[i] >= s.starveAfter {
+			pick = i
+			break
+		}
+	}
+	if pick < 0 {
+		return -1
+	}
+	for i := range s.queues {
+		if i != pick && len(s.queues[i]) > 0 {
+			s.skipped[i]++
+		}
+	}
+	s.skipped[pick] = 0
+	return pick
+}
+
+// queued counts the requests waiting for a slot, it is called with qmu held
+func (s *Shedder) queued() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// allow takes a token from our bucket, when it is empty it returns how long until the next token
+func (s *Shedder) allow() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rate <= 0 {
+		return 0, true
+	}
+	now := s.now()
+	s.tokens = math.Min(s.burst, s.tokens+now.Sub(s.last).Seconds()*s.rate)
+	s.last = now
+	if s.tokens >= 1 {
+		s.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - s.tokens) / s.rate * float64(time.Second)), false
+}
+
+// drainEstimate guesses how long until we are back under our limit, each excess request needs roughly one average
+// latency spread over maxInFlight slots
+func (s *Shedder) drainEstimate(inFlight, maxInFlight int64) time.Duration {
+	excess := inFlight - maxInFlight
+	latency := time.Duration(atomic.LoadInt64(&s.latency))
+	return latency * time.Duration(excess+maxInFlight) / time.Duration(maxInFlight)
+}
+
+func (s *Shedder) observeLatency(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		updated := int64(0.9*float64(old) + 0.1*float64(d))
+		if atomic.CompareAndSwapInt64(&s.latency, old, updated) {
+			return
+		}
+	}
+}
+
+func (s *Shedder) recordLoad(ctx context.Context, inFlight int64, outcome string) {
+	maxInFlight := atomic.LoadInt64(&s.maxInFlight)
+	if maxInFlight <= 0 {
+		return
+	}
+	s.load.Record(ctx, float64(inFlight)/float64(maxInFlight), attribute.String("outcome", outcome))
+}
+
+func (s *Shedder) reject(ctx context.Context, writer http.ResponseWriter, reason string, status int, wait time.Duration) {
+	s.rejects.Add(ctx, 1, attribute.String("reason", reason))
+	s.recordLoad(ctx, atomic.LoadInt64(&s.inFlight), reason)
+
+	if wait < minRetryAfter {
+		wait = minRetryAfter
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	// Retry-After only takes whole seconds, round up so clients never come back early
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	message := "too many requests, retry after the Retry-After header"
+	if status == http.StatusServiceUnavailable {
+		message = "server overloaded, retry after the Retry-After header"
+	}
+	RespondJSON(writer, &RejectResponse{
+		ErrorResponse: ErrorResponse{Code: reason, Message: message},
+		RetryAfterMS:  wait.Milliseconds(),
+		Backoff: Backoff{
+			InitialMS:  wait.Milliseconds(),
+			MaxMS:      maxRetryAfter.Milliseconds(),
+			Multiplier: 2,
+			Jitter:     "full",
+		},
+	}, status)
+}
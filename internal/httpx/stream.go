@@ -0,0 +1,139 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeSSE    = "text/event-stream"
+)
+
+// ErrStreamingUnsupported is returned when the response writer can't flush, eg it was wrapped by a middleware that
+// buffers the whole response
+var ErrStreamingUnsupported = errors.New("httpx: response writer does not support streaming")
+
+// StreamEvent is a single line of ndjson, or the data of a single server sent event
+type StreamEvent struct {
+	Seq   int            `json:"seq"`
+	Type  string         `json:"type"`
+	Data  interface{}    `json:"data,omitempty"`
+	Error *ErrorResponse `json:"error,omitempty"`
+}
+
+// Stream writes events to the client as they happen, flushing after every event so they make it through the cloud
+// run frontend right away. the format is server sent events when the client accepts text/event-stream and ndjson
+// otherwise. once the first event is out the status code is fixed at 200, so failures are signalled in band with an
+// event of type "error"
+type Stream struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	ctx     context.Context
+	sse     bool
+
+	mu     sync.Mutex
+	seq    int
+	closed bool
+}
+
+// NewStream negotiates the stream format from the Accept header of request, nothing is written until the first event
+func NewStream(writer http.ResponseWriter, request *http.Request) (*Stream, error) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		return nil, ErrStreamingUnsupported
+	}
+	s := &Stream{
+		writer:  writer,
+		flusher: flusher,
+		ctx:     request.Context(),
+		sse:     strings.Contains(request.Header.Get("Accept"), ContentTypeSSE),
+	}
+	header := writer.Header()
+	if s.sse {
+		header.Set("Content-Type", ContentTypeSSE)
+	} else {
+		header.Set("Content-Type", ContentTypeNDJSON)
+	}
+	header.Set("Cache-Control", "no-cache")
+	// keeps intermediate proxies (and nginx based sidecars) from buffering our events
+	header.Set("X-Accel-Buffering", "no")
+	return s, nil
+}
+
+// Send writes one event and flushes it. once the client goes away Send returns the error of the request context, so
+// handlers can stop their work as soon as nobody is listening
+func (s *Stream) Send(eventType string, data interface{}) error {
+	return s.send(&StreamEvent{Type: eventType, Data: data})
+}
+
+// Fail signals err to the client as an "error" event and ends the stream, the message follows the same client safe
+// rules as RespondError. the error is also recorded on the span of the request
+func (s *Stream) Fail(err error) error {
+	span := trace.SpanFromContext(s.ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, errs.Message(err))
+
+	sendErr := s.send(&StreamEvent{Type: "error", Error: &ErrorResponse{Code: errs.KindOf(err).String(), Message: errs.Message(err)}})
+	s.close()
+	return sendErr
+}
+
+// Done sends a final "done" event carrying data and ends the stream
+func (s *Stream) Done(data interface{}) error {
+	err := s.send(&StreamEvent{Type: "done", Data: data})
+	s.close()
+	return err
+}
+
+func (s *Stream) send(event *StreamEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("httpx: stream already ended")
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	s.seq++
+	event.Seq = s.seq
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %v", err)
+	}
+
+	var buf bytes.Buffer
+	if s.sse {
+		fmt.Fprintf(&buf, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, b)
+	} else {
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	if _, err := buf.WriteTo(s.writer); err != nil {
+		return fmt.Errorf("s.writer.Write(): %w", err)
+	}
+	s.flusher.Flush()
+
+	trace.SpanFromContext(s.ctx).AddEvent("stream.send", trace.WithAttributes(
+		attribute.Int("stream.seq", event.Seq),
+		attribute.String("stream.event", event.Type),
+	))
+	return nil
+}
+
+func (s *Stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
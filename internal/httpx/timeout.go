@@ -0,0 +1,193 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout races the cloud run request timeout. cloud run doesn't tell us about its --timeout, once it passes the
+// client gets a bare 504 from the platform and our handler keeps running as if nothing happened. Timeout puts a
+// deadline slightly ahead of it on every request context, which every ctxutil.Budget and upstream call then works
+// within, and answers with a proper 504 carrying our trace id if the handler still hasn't responded by then
+type Timeout struct {
+	logger  *logx.AppLogger
+	timeout time.Duration
+	reserve time.Duration
+
+	timeouts metric.Int64Counter
+}
+
+type TimeoutOption func(t *Timeout)
+
+// WithTimeoutReserve ends our deadline d ahead of the cloud run timeout, enough to write the 504 and for the
+// handler to unwind. defaults to a tenth of the timeout, at most 2 seconds
+func WithTimeoutReserve(d time.Duration) TimeoutOption {
+	return func(t *Timeout) {
+		t.reserve = d
+	}
+}
+
+// NewTimeout takes the --timeout of our service, logs with logger when it is non nil
+func NewTimeout(logger *logx.AppLogger, requestTimeout time.Duration, opts ...TimeoutOption) *Timeout {
+	t := &Timeout{
+		logger:   logger,
+		timeout:  requestTimeout,
+		reserve:  requestTimeout / 10,
+		timeouts: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.timeouts", metric.WithDescription("requests that ran out of time, by whether we still got to respond")),
+	}
+	if t.reserve > 2*time.Second {
+		t.reserve = 2 * time.Second
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// timeoutWriter keeps the handler and our deadline from writing at the same time. the handler sets headers on a map
+// of its own until it writes, so a 504 never goes out with half of its headers
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	wrote    bool
+	timedOut bool
+}
+
+// commit hands our headers to the real writer before the handler's first write or once it returns, mu must be held
+func (tw *timeoutWriter) commit(w http.ResponseWriter) {
+	if tw.wrote {
+		return
+	}
+	tw.wrote = true
+	dst := w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+}
+
+func (t *Timeout) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx, cancel := context.WithTimeout(request.Context(), t.timeout-t.reserve)
+		defer cancel()
+
+		tw := &timeoutWriter{header: http.Header{}}
+		wrapped := httpsnoop.Wrap(writer, httpsnoop.Hooks{
+			Header: func(next httpsnoop.HeaderFunc) httpsnoop.HeaderFunc {
+				return func() http.Header {
+					return tw.header
+				}
+			},
+			WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+				return func(code int) {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if tw.timedOut {
+						return
+					}
+					tw.commit(writer)
+					next(code)
+				}
+			},
+			Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+				return func(b []byte) (int, error) {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if tw.timedOut {
+						return 0, http.ErrHandlerTimeout
+					}
+					tw.commit(writer)
+					return next(b)
+				}
+			},
+			ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+				return func(src io.Reader) (int64, error) {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if tw.timedOut {
+						return 0, http.ErrHandlerTimeout
+					}
+					tw.commit(writer)
+					return next(src)
+				}
+			},
+			Flush: func(next httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+				return func() {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if tw.timedOut {
+						return
+					}
+					tw.commit(writer)
+					next()
+				}
+			},
+		})
+
+		done, exited := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+			case <-ctx.Done():
+				// a cancellation is our client leaving or our shutdown, only our own deadline is a timeout
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					t.expire(ctx, writer, request, tw)
+				}
+			}
+		}()
+
+		next.ServeHTTP(wrapped, request.WithContext(ctx))
+		// a handler that only set headers, eg a Location or Set-Cookie, still has net/http send them with its implicit
+		// 200 once we return
+		tw.mu.Lock()
+		if !tw.timedOut {
+			tw.commit(writer)
+		}
+		tw.mu.Unlock()
+		close(done)
+		<-exited
+	})
+}
+
+// expire answers with a 504 unless the handler already started its response, in which case all we can do is let it
+// finish within our reserve
+func (t *Timeout) expire(ctx context.Context, writer http.ResponseWriter, request *http.Request, tw *timeoutWriter) {
+	tw.mu.Lock()
+	responded := !tw.wrote
+	if responded {
+		tw.timedOut = true
+		resp := &ErrorResponse{Code: errs.DeadlineExceeded.String(), Message: "request timed out"}
+		correlate(ctx, request, writer, resp)
+		RespondJSON(writer, resp, http.StatusGatewayTimeout)
+		// get it to the client now, our handler may take a while longer to notice its context is done
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	tw.mu.Unlock()
+
+	t.timeouts.Add(ctx, 1, attribute.Bool("responded", responded))
+	span := trace.SpanFromContext(ctx)
+	span.AddEvent("request_timeout", trace.WithAttributes(attribute.Bool("responded", responded)))
+	span.SetStatus(codes.Error, "request timed out")
+	if t.logger != nil {
+		t.logger.WrapTraceContext(ctx).Warnw("request ran out of time",
+			"method", request.Method,
+			"path", request.URL.Path,
+			"deadline", (t.timeout - t.reserve).String(),
+			"responded", responded,
+		)
+	}
+}
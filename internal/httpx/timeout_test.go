@@ -0,0 +1,36 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutKeepsHeadersWithoutWrite(t *testing.T) {
+	handler := NewTimeout(nil, time.Minute).Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Location", "/api/notes/42")
+		http.SetCookie(writer, &http.Cookie{Name: "session", Value: "abc"})
+	}))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("client.Get(): %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Location"); got != "/api/notes/42" {
+		t.Errorf("Location = %q, want %q", got, "/api/notes/42")
+	}
+	if got := resp.Header.Get("Set-Cookie"); got != "session=abc" {
+		t.Errorf("Set-Cookie = %q, want %q", got, "session=abc")
+	}
+}
@@ -0,0 +1,243 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Upload is one file of an upload request
+type Upload struct {
+	// Field is the form field of a multipart upload, empty for a raw body
+	Field    string `json:"field,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	// ContentType is what the file turned out to be, not only what the client said it was
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// Location is where the sink put the file, eg gs://bucket/object
+	Location string `json:"location,omitempty"`
+}
+
+// UploadSink opens where an upload is written. an upload that fails half way is aborted by cancelling ctx before
+// Close, a sink must not keep what it was written when that happens
+type UploadSink func(ctx context.Context, upload *Upload) (io.WriteCloser, error)
+
+// Uploads streams uploaded files into a sink as they arrive, a file is never held in memory as a whole, which our
+// containers couldn't afford for anything large
+type Uploads struct {
+	sink          UploadSink
+	maxBytes      int64
+	maxFiles      int
+	contentTypes  map[string]bool
+	progressEvery int64
+}
+
+type UploadOption func(u *Uploads)
+
+// WithUploadMaxBytes bounds each file to n bytes, defaults to 32MiB
+func WithUploadMaxBytes(n int64) UploadOption {
+	return func(u *Uploads) {
+		u.maxBytes = n
+	}
+}
+
+// WithUploadMaxFiles bounds the files of a multipart upload, defaults to 1
+func WithUploadMaxFiles(n int) UploadOption {
+	return func(u *Uploads) {
+		u.maxFiles = n
+	}
+}
+
+// WithUploadContentTypes only accepts files of contentTypes, eg image/png, by default anything goes
+func WithUploadContentTypes(contentTypes ...string) UploadOption {
+	return func(u *Uploads) {
+		for _, contentType := range contentTypes {
+			u.contentTypes[contentType] = true
+		}
+	}
+}
+
+// WithUploadProgressEvery adds an upload.progress event to the span of an upload every n bytes, defaults to 4MiB
+func WithUploadProgressEvery(n int64) UploadOption {
+	return func(u *Uploads) {
+		u.progressEvery = n
+	}
+}
+
+func NewUploads(sink UploadSink, opts ...UploadOption) *Uploads {
+	u := &Uploads{sink: sink, maxBytes: 32 << 20, maxFiles: 1, contentTypes: map[string]bool{}, progressEvery: 4 << 20}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+// Receive writes the files of request to the sink and returns them once every one is written. a multipart/form-data
+// request can carry up to max files files, its fields that aren't files are skipped. any other request is a single
+// file, its body, named by the filename query parameter. files written before one fails are kept and returned with
+// the error, for the caller to clean up if it has to
+func (u *Uploads) Receive(writer http.ResponseWriter, request *http.Request) ([]*Upload, error) {
+	ctx := request.Context()
+	// room for every file and the boundaries, headers and fields around them
+	request.Body = http.MaxBytesReader(writer, request.Body, int64(u.maxFiles)*u.maxBytes+1<<20)
+
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		upload := &Upload{Filename: request.URL.Query().Get("filename"), ContentType: request.Header.Get("Content-Type")}
+		if err := u.receive(ctx, upload, request.Body); err != nil {
+			return nil, err
+		}
+		return []*Upload{upload}, nil
+	}
+
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return nil, errs.Wrapf(err, errs.InvalidArgument, "request.MultipartReader()")
+	}
+	var uploads []*Upload
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploads, readError(err, "reader.NextPart()")
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if len(uploads) == u.maxFiles {
+			return uploads, errs.Invalid(errs.FieldError{In: "body", Constraint: "maxItems",
+				Message: fmt.Sprintf("at most %d files per upload", u.maxFiles)})
+		}
+		upload := &Upload{Field: part.FormName(), Filename: part.FileName(), ContentType: part.Header.Get("Content-Type")}
+		if err := u.receive(ctx, upload, part); err != nil {
+			return uploads, err
+		}
+		uploads = append(uploads, upload)
+	}
+	if len(uploads) == 0 {
+		return nil, errs.Invalid(errs.FieldError{In: "body", Constraint: "required", Message: "a file is required"})
+	}
+	return uploads, nil
+}
+
+// receive checks what a file is from its first bytes and copies it to the sink, its span follows it along
+func (u *Uploads) receive(ctx context.Context, upload *Upload, body io.Reader) (err error) {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "httpx.Uploads.receive", trace.WithAttributes(
+		attribute.String("upload.field", upload.Field),
+		attribute.String("upload.declared_content_type", upload.ContentType),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int64("upload.bytes", upload.Size), attribute.String("upload.content_type", upload.ContentType))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	// 512 bytes is all http.DetectContentType looks at
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return readError(err, "io.ReadFull()")
+	}
+	head = head[:n]
+	upload.ContentType = detectContentType(upload.ContentType, head)
+	if len(u.contentTypes) > 0 && !u.contentTypes[upload.ContentType] {
+		return errs.Invalid(errs.FieldError{In: "body", Pointer: fieldPointer(upload.Field), Constraint: "contentType",
+			Message: fmt.Sprintf("%s files aren't accepted", upload.ContentType)})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sink, err := u.sink(ctx, upload)
+	if err != nil {
+		return errs.Wrapf(err, errs.Unavailable, "u.sink()")
+	}
+	if err := u.copy(ctx, sink, io.MultiReader(bytes.NewReader(head), body), upload); err != nil {
+		// cancelled before Close, the sink throws away what it got so far
+		cancel()
+		sink.Close()
+		return err
+	}
+	if err := sink.Close(); err != nil {
+		return errs.Wrapf(err, errs.Unavailable, "sink.Close()")
+	}
+	return nil
+}
+
+// copy copies body into sink, counting what it copied into upload and stopping once it is too large
+func (u *Uploads) copy(ctx context.Context, sink io.Writer, body io.Reader, upload *Upload) error {
+	span := trace.SpanFromContext(ctx)
+	buf := make([]byte, 32<<10)
+	next := u.progressEvery
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			upload.Size += int64(n)
+			if upload.Size > u.maxBytes {
+				return errs.Invalid(errs.FieldError{In: "body", Pointer: fieldPointer(upload.Field), Constraint: "maxBytes",
+					Message: fmt.Sprintf("files are at most %d bytes", u.maxBytes)})
+			}
+			if _, err := sink.Write(buf[:n]); err != nil {
+				return errs.Wrapf(err, errs.Unavailable, "sink.Write()")
+			}
+			if next > 0 && upload.Size >= next {
+				span.AddEvent("upload.progress", trace.WithAttributes(attribute.Int64("upload.bytes", upload.Size)))
+				next += u.progressEvery
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readError(readErr, "body.Read()")
+		}
+	}
+}
+
+// detectContentType trusts what the first bytes of a file say it is over what the client declared. only when they
+// can't tell, or only tell it's text, does a declared type fill in, so a script can't be uploaded as an image
+func detectContentType(declared string, head []byte) string {
+	declared, _, _ = mime.ParseMediaType(declared)
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	switch {
+	case declared == "":
+		return sniffed
+	case sniffed == "application/octet-stream":
+		return declared
+	case sniffed == "text/plain" && textual(declared):
+		return declared
+	}
+	return sniffed
+}
+
+// textual reports if contentType is text that sniffs as text/plain, eg json or csv
+func textual(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+// readError classifies a failure reading the request, a body past http.MaxBytesReader is too large and anything else
+// is the client going away or sending garbage
+func readError(err error, op string) error {
+	// http.MaxBytesReader has no error type of its own before go 1.19
+	if strings.Contains(err.Error(), "request body too large") {
+		return errs.Invalid(errs.FieldError{In: "body", Constraint: "maxBytes", Message: "upload too large"})
+	}
+	if errors.Is(err, context.Canceled) {
+		return errs.Wrapf(err, errs.Unavailable, op)
+	}
+	return errs.Wrapf(err, errs.InvalidArgument, op)
+}
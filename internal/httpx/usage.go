@@ -0,0 +1,129 @@
+package httpx
+
+import (
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Usage is what a request cost us. go has no per goroutine accounting, so everything but Wall is measured process wide
+// around the handler and includes whatever else ran at the same time, Concurrent says how much that was. the numbers
+// are only meaningful aggregated over many samples of a route, or with --concurrency 1
+type Usage struct {
+	Wall       time.Duration `json:"wall"`
+	UserCPU    time.Duration `json:"user_cpu"`
+	SysCPU     time.Duration `json:"sys_cpu"`
+	AllocBytes uint64        `json:"alloc_bytes"`
+	Allocs     uint64        `json:"allocs"`
+	GCs        uint32        `json:"gcs"`
+	// Concurrent is the most requests we saw in flight while measuring, including this one
+	Concurrent int64 `json:"concurrent"`
+}
+
+// UsageSampler is an experimental middleware that annotates a sample of requests with their memory and cpu usage, as
+// span attributes and a "request usage" log entry, to help pick cpu and memory settings for a service from the routes
+// that actually need them. runtime.ReadMemStats stops the world for a moment, keep the sample rate low
+type UsageSampler struct {
+	inFlight    int64
+	maxInFlight int64
+
+	logger *logx.AppLogger
+	rate   float64
+	random func() float64
+	now    func() time.Time
+}
+
+type UsageOption func(u *UsageSampler)
+
+// WithUsageSampleRate measures that fraction of requests, defaults to 1%
+func WithUsageSampleRate(rate float64) UsageOption {
+	return func(u *UsageSampler) {
+		u.rate = rate
+	}
+}
+
+// WithUsageClock replaces time.Now, for the wall time of a request
+func WithUsageClock(now func() time.Time) UsageOption {
+	return func(u *UsageSampler) {
+		u.now = now
+	}
+}
+
+// NewUsageSampler logs with logger when it is non nil
+func NewUsageSampler(logger *logx.AppLogger, opts ...UsageOption) *UsageSampler {
+	u := &UsageSampler{logger: logger, rate: 0.01, random: rand.Float64, now: time.Now}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+func (u *UsageSampler) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		current := atomic.AddInt64(&u.inFlight, 1)
+		defer atomic.AddInt64(&u.inFlight, -1)
+		u.observe(current)
+
+		if u.rate <= 0 || u.random() >= u.rate {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		// every sampled request resets the high water mark, which makes it approximate when samples overlap
+		atomic.StoreInt64(&u.maxInFlight, current)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		userBefore, sysBefore := cpuTime()
+		start := u.now()
+
+		next.ServeHTTP(writer, request)
+
+		wall := u.now().Sub(start)
+		userAfter, sysAfter := cpuTime()
+		runtime.ReadMemStats(&after)
+		usage := Usage{
+			Wall:       wall,
+			UserCPU:    userAfter - userBefore,
+			SysCPU:     sysAfter - sysBefore,
+			AllocBytes: after.TotalAlloc - before.TotalAlloc,
+			Allocs:     after.Mallocs - before.Mallocs,
+			GCs:        after.NumGC - before.NumGC,
+			Concurrent: atomic.LoadInt64(&u.maxInFlight),
+		}
+		u.record(request, usage)
+	})
+}
+
+// observe raises the high water mark of requests in flight
+func (u *UsageSampler) observe(current int64) {
+	for {
+		seen := atomic.LoadInt64(&u.maxInFlight)
+		if current <= seen || atomic.CompareAndSwapInt64(&u.maxInFlight, seen, current) {
+			return
+		}
+	}
+}
+
+func (u *UsageSampler) record(request *http.Request, usage Usage) {
+	ctx := request.Context()
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("usage.user_cpu_ms", usage.UserCPU.Milliseconds()),
+		attribute.Int64("usage.sys_cpu_ms", usage.SysCPU.Milliseconds()),
+		attribute.Int64("usage.alloc_bytes", int64(usage.AllocBytes)),
+		attribute.Int64("usage.allocs", int64(usage.Allocs)),
+		attribute.Int64("usage.gcs", int64(usage.GCs)),
+		attribute.Int64("usage.concurrent", usage.Concurrent),
+	)
+	if u.logger != nil {
+		u.logger.WrapTraceContext(ctx).Infow("request usage",
+			"method", request.Method,
+			"path", request.URL.Path,
+			"usage", usage,
+		)
+	}
+}
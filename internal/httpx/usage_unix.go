@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package httpx
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime is the user and system cpu our process has used so far
+func cpuTime() (time.Duration, time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package httpx
+
+import "time"
+
+// cpuTime isn't implemented on windows, cloud run only runs linux containers
+func cpuTime() (time.Duration, time.Duration) {
+	return 0, 0
+}
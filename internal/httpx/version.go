@@ -0,0 +1,143 @@
+package httpx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// VersionHeader is set on every response to the api version that served it
+const VersionHeader = "API-Version"
+
+// versionPattern matches a path segment naming a version, eg v2
+var versionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+// Versioning picks the api version of a request below prefix, from a version segment right after it, eg /api/v2/beers,
+// or from a vendor media type in Accept, eg application/vnd.beers.v2+json, which routes /api/beers to /api/v2/beers.
+// the path wins when a request has both, so a versioned url can be shared and always means the same thing
+type Versioning struct {
+	prefix   string
+	versions map[string]bool
+	vendor   string
+	fallback string
+	sunsets  map[string]time.Time
+}
+
+type VersionOption func(v *Versioning)
+
+// WithVersionVendor accepts application/vnd.<vendor>.<version>+json in Accept, without it only the path picks a version
+func WithVersionVendor(vendor string) VersionOption {
+	return func(v *Versioning) {
+		v.vendor = vendor
+	}
+}
+
+// WithDefaultVersion routes requests that name no version to version, without it they are passed on untouched, eg to
+// routes that predate versioning
+func WithDefaultVersion(version string) VersionOption {
+	return func(v *Versioning) {
+		v.fallback = version
+	}
+}
+
+// WithDeprecatedVersion marks version as deprecated, its responses carry a Deprecation header and, when sunset isn't
+// zero, a Sunset header with the date it goes away, so clients find out before it happens
+func WithDeprecatedVersion(version string, sunset time.Time) VersionOption {
+	return func(v *Versioning) {
+		v.sunsets[version] = sunset
+	}
+}
+
+// NewVersioning versions the api below prefix, eg /api, versions are path segments like v1 and v2
+func NewVersioning(prefix string, versions []string, opts ...VersionOption) *Versioning {
+	v := &Versioning{prefix: strings.TrimSuffix(prefix, "/"), versions: map[string]bool{}, sunsets: map[string]time.Time{}}
+	for _, version := range versions {
+		v.versions[version] = true
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+var versionKey = ctxval.NewString("httpx.api_version")
+
+// APIVersion is the api version Versioning picked for ctx, empty for requests it passed on untouched
+func APIVersion(ctx context.Context) string {
+	version, _ := versionKey.Value(ctx)
+	return version
+}
+
+// Handler has to wrap the router rather than be one of its middleware, a router has already matched a route by the
+// time its middleware runs and the version from Accept changes which route matches
+func (v *Versioning) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		rest := strings.TrimPrefix(request.URL.Path, v.prefix)
+		if rest == request.URL.Path || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		segment := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 2)[0]
+		version, fromPath := segment, versionPattern.MatchString(segment)
+		if !fromPath {
+			version = v.fromAccept(request.Header.Get("Accept"))
+		}
+		if version == "" {
+			version = v.fallback
+		}
+		switch {
+		case version == "":
+			next.ServeHTTP(writer, request)
+			return
+		case !v.versions[version]:
+			status := http.StatusNotAcceptable
+			if fromPath {
+				status = http.StatusNotFound
+			}
+			RespondJSON(writer, &ErrorResponse{Code: "unsupported_version", Message: "unsupported api version " + version}, status)
+			return
+		}
+
+		if !fromPath {
+			// route to the versioned path, a copy of the url so the caller's request is left as it was
+			u := *request.URL
+			u.Path = v.prefix + "/" + version + rest
+			u.RawPath = ""
+			request = request.Clone(request.Context())
+			request.URL = &u
+		}
+		header := writer.Header()
+		header.Set(VersionHeader, version)
+		header.Add("Vary", "Accept")
+		if sunset, ok := v.sunsets[version]; ok {
+			header.Set("Deprecation", "true")
+			if !sunset.IsZero() {
+				header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+		}
+		next.ServeHTTP(writer, request.WithContext(versionKey.With(request.Context(), version)))
+	})
+}
+
+// fromAccept finds the version of the first vendor media type in accept, eg v2 in application/vnd.beers.v2+json
+func (v *Versioning) fromAccept(accept string) string {
+	if v.vendor == "" || accept == "" {
+		return ""
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(mediaType, "application/vnd."+v.vendor+"."), "+json")
+		if name != mediaType && versionPattern.MatchString(name) {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,163 @@
+package httpx
+
+import (
+	"bytes"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watchdog flags requests the moment they run past a threshold, with the stack of the
+// goroutine handling them. a request stuck on an upstream, eg httpbin's /delay/10, otherwise only shows up once it
+// finally finishes or cloud run times it out, and neither tells us where it was waiting
+type Watchdog struct {
+	logger     *logx.AppLogger
+	threshold  time.Duration
+	stackLines int
+	route      func(request *http.Request) string
+	now        func() time.Time
+
+	slow metric.Int64Counter
+}
+
+type WatchdogOption func(w *Watchdog)
+
+// WithWatchdogStackLines keeps the top n lines of the stack we log, defaults to 40. a frame is two lines
+func WithWatchdogStackLines(n int) WatchdogOption {
+	return func(w *Watchdog) {
+		w.stackLines = n
+	}
+}
+
+// WithWatchdogRoute names the route of a request in our logs, eg the path template of the router, defaults to its path
+func WithWatchdogRoute(route func(request *http.Request) string) WatchdogOption {
+	return func(w *Watchdog) {
+		w.route = route
+	}
+}
+
+// WithWatchdogClock replaces time.Now, for the elapsed times we log
+func WithWatchdogClock(now func() time.Time) WatchdogOption {
+	return func(w *Watchdog) {
+		w.now = now
+	}
+}
+
+// NewWatchdog flags requests running for longer than threshold, a threshold of zero turns it off
+func NewWatchdog(logger *logx.AppLogger, threshold time.Duration, opts ...WatchdogOption) *Watchdog {
+	w := &Watchdog{
+		logger:     logger,
+		threshold:  threshold,
+		stackLines: 40,
+		route: func(request *http.Request) string {
+			return request.URL.Path
+		},
+		now:  time.Now,
+		slow: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("httpx.slow_requests", metric.WithDescription("requests still running past the watchdog threshold")),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Middleware has to run after the middleware that starts our span, so what we log carries our trace. it watches the
+// goroutine it was called on, a handler that hands its work to another goroutine shows up waiting on it
+func (w *Watchdog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if w.threshold <= 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		start := w.now()
+		id := goroutineID()
+		flagged := make(chan struct{})
+		timer := time.AfterFunc(w.threshold, func() {
+			defer close(flagged)
+			w.flag(request, id, start)
+		})
+
+		next.ServeHTTP(writer, request)
+
+		if timer.Stop() {
+			return
+		}
+		<-flagged
+		w.logger.WrapTraceContext(request.Context()).Infow("slow request finished",
+			"method", request.Method,
+			"route", w.route(request),
+			"elapsed", w.now().Sub(start).String(),
+		)
+	})
+}
+
+// flag reports request, handled by goroutine id, as slow
+func (w *Watchdog) flag(request *http.Request, id uint64, start time.Time) {
+	ctx := request.Context()
+	route := w.route(request)
+	elapsed := w.now().Sub(start)
+	w.slow.Add(ctx, 1, attribute.String("method", request.Method))
+	trace.SpanFromContext(ctx).AddEvent("slow_request", trace.WithAttributes(attribute.String("elapsed", elapsed.String())))
+
+	fields := []interface{}{
+		"method", request.Method,
+		"route", route,
+		"elapsed", elapsed.String(),
+		"threshold", w.threshold.String(),
+		"stack", goroutineStack(id, w.stackLines),
+	}
+	// the request may have been cancelled already and still be unwinding, which is worth knowing when reading the stack
+	if err := ctx.Err(); err != nil {
+		fields = append(fields, "ctx_err", err.Error())
+	}
+	w.logger.WrapTraceContext(ctx).Warnw("slow request", fields...)
+}
+
+// goroutineID parses the id of the calling goroutine from the header of its stack, "goroutine 18 [running]:"
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// goroutineStack returns the top lines of the stack of goroutine id, nil once it is gone. dumping every goroutine
+// stops the world for a moment, which is fine for the odd slow request but not something to do on every one
+func goroutineStack(id uint64, lines int) []string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 16<<20 {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	header := "goroutine " + strconv.FormatUint(id, 10) + " ["
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if !strings.HasPrefix(stack, header) {
+			continue
+		}
+		stackLines := strings.Split(strings.TrimSpace(stack), "\n")
+		if lines > 0 && len(stackLines) > lines {
+			stackLines = append(stackLines[:lines], "...")
+		}
+		for i := range stackLines {
+			stackLines[i] = strings.TrimSpace(stackLines[i])
+		}
+		return stackLines
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/idempotency"
+
+// Header carries the key a client picked for a request it may retry, the same key on a retry gets the same response
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses we replay from the store instead of running the handler again
+const ReplayedHeader = "Idempotent-Replayed"
+
+// response is what we keep of the first response to a key, for replaying it to retries
+type response struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header,omitempty"`
+	Body   []byte              `json:"body,omitempty"`
+}
+
+// Keys makes POSTs and PATCHes carrying an Idempotency-Key safe to retry. the first request with a key runs and its
+// response is stored, a retry with the same key and payload gets that response back without running again, and a
+// retry with another payload is rejected. a request that fails with a 5xx leaves nothing behind, so a retry runs again
+type Keys struct {
+	keys     *dedupe.Deduper
+	ttl      time.Duration
+	lockTTL  time.Duration
+	maxBody  int64
+	required bool
+	scope    Scope
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+
+	requests metric.Int64Counter
+}
+
+type Option func(k *Keys)
+
+// WithTTL keeps responses for d, defaults to 24 hours. clients must not retry with a key for longer
+func WithTTL(d time.Duration) Option {
+	return func(k *Keys) {
+		k.ttl = d
+	}
+}
+
+// WithLockTTL has a retry wait for the first request with its key for at most d, defaults to a minute. set it past
+// the request timeout of the service, a first request still running past it could run twice
+func WithLockTTL(d time.Duration) Option {
+	return func(k *Keys) {
+		k.lockTTL = d
+	}
+}
+
+// WithMaxBodyBytes bounds the request and response bodies we buffer, defaults to 256KiB. a larger response isn't
+// stored and its key is released
+func WithMaxBodyBytes(n int64) Option {
+	return func(k *Keys) {
+		k.maxBody = n
+	}
+}
+
+// WithRequired rejects unsafe requests without a key, instead of running them without the protection of one
+func WithRequired() Option {
+	return func(k *Keys) {
+		k.required = true
+	}
+}
+
+// WithLogger logs store failures
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(k *Keys) {
+		k.logger = logger
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through ttls
+func WithClock(now func() time.Time) Option {
+	return func(k *Keys) {
+		k.now = now
+	}
+}
+
+// Scope names whose keys the key of a request is among, so clients can't collide with or read each other's responses.
+// ok is false for a request we can't tell the caller of, its key is rejected
+type Scope func(request *http.Request) (scope string, ok bool)
+
+// ByCaller scopes keys to the email of the caller authx.Verifier.Middleware verified, Middleware has to go after it
+func ByCaller(request *http.Request) (string, bool) {
+	claims, ok := authx.ClaimsFromContext(request.Context())
+	if !ok || claims.Email == "" {
+		return "", false
+	}
+	return claims.Email, true
+}
+
+// Shared puts the keys of every caller together, only for a service that has a single trusted caller or none at all
+func Shared(request *http.Request) (string, bool) {
+	return "", true
+}
+
+// New keeps responses in store under the http source, it can be the store pub/sub and cloud tasks dedupe in. scope
+// keeps the keys of callers apart, see ByCaller
+func New(store dedupe.Store, scope Scope, opts ...Option) *Keys {
+	k := &Keys{
+		ttl:     24 * time.Hour,
+		lockTTL: time.Minute,
+		maxBody: 256 << 10,
+		scope:   scope,
+		logger:  zap.NewNop().Sugar(),
+		now:     time.Now,
+		requests: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("idempotency.requests",
+			metric.WithDescription("requests carrying an idempotency key by outcome")),
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	k.keys = dedupe.New(store, "http", dedupe.WithTTL(k.ttl), dedupe.WithLockTTL(k.lockTTL), dedupe.WithClock(k.now))
+	return k
+}
+
+// Middleware goes after authentication when its Scope reads the caller, and before anything with side effects
+func (k *Keys) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost && request.Method != http.MethodPatch {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ctx := request.Context()
+		key := request.Header.Get(Header)
+		switch {
+		case key == "" && k.required:
+			httpx.RespondError(writer, request, errs.Invalid(errs.FieldError{In: "header", Pointer: errs.Pointer(Header), Constraint: "required", Message: "an Idempotency-Key header is required"}))
+			return
+		case key == "":
+			next.ServeHTTP(writer, request)
+			return
+		case len(key) > 255:
+			httpx.RespondError(writer, request, errs.Invalid(errs.FieldError{In: "header", Pointer: errs.Pointer(Header), Constraint: "maxLength", Message: "an Idempotency-Key is at most 255 characters"}))
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, k.maxBody+1))
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "ioutil.ReadAll()"))
+			return
+		}
+		if int64(len(body)) > k.maxBody {
+			httpx.RespondError(writer, request, errs.Invalid(errs.FieldError{In: "body", Constraint: "maxBytes", Message: "body too large for an idempotent request"}))
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope, ok := k.scope(request)
+		if !ok {
+			k.count(ctx, "unscoped")
+			httpx.RespondError(writer, request, errs.New(errs.Unauthenticated, "an Idempotency-Key needs an authenticated caller"))
+			return
+		}
+		storeKey := scope + ":" + key
+		fingerprint := fingerprintOf(request, body)
+		existing, err := k.keys.Claim(ctx, storeKey, fingerprint)
+		if err != nil {
+			k.logger.Errorw("k.keys.Claim()", "err", err)
+			k.count(ctx, "store_failed")
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "k.keys.Claim()"))
+			return
+		}
+		switch {
+		case existing != nil && existing.Fingerprint != fingerprint:
+			k.count(ctx, "mismatch")
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "idempotency_key_reused", Message: "this Idempotency-Key was used with another request"}, http.StatusUnprocessableEntity)
+			return
+		case existing != nil && !existing.Done:
+			k.count(ctx, "in_progress")
+			writer.Header().Set("Retry-After", strconv.Itoa(1))
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "idempotency_key_in_progress", Message: "a request with this Idempotency-Key is still running, retry later"}, http.StatusConflict)
+			return
+		case existing != nil:
+			var stored response
+			if err := json.Unmarshal(existing.Value, &stored); err != nil {
+				k.logger.Errorw("json.Unmarshal()", "err", err)
+				k.count(ctx, "store_failed")
+				httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "json.Unmarshal()"))
+				return
+			}
+			k.count(ctx, "replayed")
+			for name, values := range stored.Header {
+				writer.Header()[name] = values
+			}
+			writer.Header().Set(ReplayedHeader, "true")
+			writer.WriteHeader(stored.Status)
+			writer.Write(stored.Body)
+			return
+		}
+
+		// whatever happens to the request, its key is either completed or released so a retry doesn't wait out the lock
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// ctx may be done by now, releasing still has to happen
+			releaseCtx, cancel := context.WithTimeout(ctxutil.Detach(ctx), 5*time.Second)
+			defer cancel()
+			if err := k.keys.Release(releaseCtx, storeKey); err != nil {
+				k.logger.Errorw("k.keys.Release()", "err", err)
+			}
+		}()
+		wrapped, rec := httpx.Record(writer, int(k.maxBody))
+		next.ServeHTTP(wrapped, request)
+		if rec.Status >= http.StatusInternalServerError || rec.Truncated() {
+			k.count(ctx, "released")
+			return
+		}
+		value, err := json.Marshal(&response{Status: rec.Status, Header: replayedHeaders(wrapped.Header()), Body: rec.Body.Bytes()})
+		if err != nil {
+			k.logger.Errorw("json.Marshal()", "err", err)
+			return
+		}
+		// the response is written, storing it mustn't depend on the client waiting for us
+		completeCtx, cancel := context.WithTimeout(ctxutil.Detach(ctx), 5*time.Second)
+		defer cancel()
+		if err := k.keys.Complete(completeCtx, storeKey, fingerprint, value); err != nil {
+			k.logger.Errorw("k.keys.Complete()", "err", err)
+			k.count(ctx, "store_failed")
+			return
+		}
+		completed = true
+		k.count(ctx, "stored")
+	})
+}
+
+func (k *Keys) count(ctx context.Context, outcome string) {
+	k.requests.Add(ctx, 1, attribute.String("outcome", outcome))
+}
+
+// fingerprintOf hashes what makes a request the same request
+func fingerprintOf(request *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, request.Method+" "+request.URL.Path+"?"+request.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayedHeaders are the headers of a response we keep, the ones describing its body and what it created
+func replayedHeaders(header http.Header) map[string][]string {
+	kept := map[string][]string{}
+	for _, name := range []string{"Content-Type", "Content-Language", "Location", "Etag"} {
+		if values, ok := header[name]; ok {
+			kept[name] = values
+		}
+	}
+	return kept
+}
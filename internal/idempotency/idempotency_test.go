@@ -0,0 +1,46 @@
+package idempotency
+
+import (
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestByCallerKeepsCallersApart(t *testing.T) {
+	calls := 0
+	keys := New(dedupe.NewMemory(), ByCaller)
+	handler := keys.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		writer.WriteHeader(http.StatusCreated)
+	}))
+	send := func(email string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"text":"hello"}`))
+		request.Header.Set(Header, "5b0c6c1e")
+		if email != "" {
+			request = request.WithContext(authx.WithClaims(request.Context(), &authx.Claims{Email: email}))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, request)
+		return rec
+	}
+
+	if rec := send("alice@example.com"); rec.Code != http.StatusCreated || rec.Header().Get(ReplayedHeader) != "" {
+		t.Fatalf("first request = %d replayed %q, want %d", rec.Code, rec.Header().Get(ReplayedHeader), http.StatusCreated)
+	}
+	if rec := send("alice@example.com"); rec.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("retry by the same caller wasn't replayed")
+	}
+	// the same key from someone else is a request of its own, not a replay of another caller's response
+	if rec := send("mallory@example.com"); rec.Code != http.StatusCreated || rec.Header().Get(ReplayedHeader) != "" {
+		t.Errorf("same key by another caller = %d replayed %q, want a fresh %d", rec.Code, rec.Header().Get(ReplayedHeader), http.StatusCreated)
+	}
+	if rec := send(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("key without a verified caller = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+}
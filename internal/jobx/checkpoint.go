@@ -0,0 +1,52 @@
+package jobx
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// Checkpoints keeps the progress of job tasks in a firestore collection. a task that fails is retried from the
+// start, with its progress saved as it goes the retry carries on from where the failed attempt stopped instead of
+// redoing, or worse doing differently, what was already done
+type Checkpoints struct {
+	collection *firestore.CollectionRef
+}
+
+// NewCheckpoints keeps progress in collection, one document per task
+func NewCheckpoints(client *firestore.Client, collection string) *Checkpoints {
+	return &Checkpoints{collection: client.Collection(collection)}
+}
+
+// doc is where the progress of name is kept for task, every attempt of a task shares it, other tasks and executions
+// don't. names may be paths, eg of the collection a task works on, document ids can't have slashes
+func (c *Checkpoints) doc(task Task, name string) *firestore.DocumentRef {
+	return c.collection.Doc(fmt.Sprintf("%s-%s-%d", strings.ReplaceAll(name, "/", "_"), task.Execution, task.Index))
+}
+
+// Load reads the progress saved for name into v, it reports false when nothing was saved yet
+func (c *Checkpoints) Load(ctx context.Context, task Task, name string, v interface{}) (bool, error) {
+	snapshot, err := c.doc(task, name).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("doc.Get(): %v", err)
+	}
+	if err := snapshot.DataTo(v); err != nil {
+		return false, fmt.Errorf("snapshot.DataTo(): %v", err)
+	}
+	return true, nil
+}
+
+// Save replaces the progress saved for name with v. save after the work it records is committed, never before, a
+// retry trusts it
+func (c *Checkpoints) Save(ctx context.Context, task Task, name string, v interface{}) error {
+	if _, err := c.doc(task, name).Set(ctx, v); err != nil {
+		return fmt.Errorf("doc.Set(): %v", err)
+	}
+	return nil
+}
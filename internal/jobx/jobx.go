@@ -0,0 +1,92 @@
+package jobx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Task is the cloud run job task we are running as. a job execution runs its tasks in parallel, each with its own
+// index, and retries a task that fails as a new attempt of the same index
+type Task struct {
+	Job       string
+	Execution string
+	Index     int
+	Count     int
+	Attempt   int
+}
+
+// FromEnv reads our task from the variables cloud run jobs set. outside of a job we are the single task of an
+// execution of our own, named after when we started so every local run starts from scratch
+func FromEnv() Task {
+	t := Task{
+		Job:       os.Getenv("CLOUD_RUN_JOB"),
+		Execution: os.Getenv("CLOUD_RUN_EXECUTION"),
+		Index:     envInt("CLOUD_RUN_TASK_INDEX", 0),
+		Count:     envInt("CLOUD_RUN_TASK_COUNT", 1),
+		Attempt:   envInt("CLOUD_RUN_TASK_ATTEMPT", 0),
+	}
+	if t.Execution == "" {
+		t.Execution = fmt.Sprintf("local-%d", time.Now().Unix())
+	}
+	return t
+}
+
+// Retried is whether an earlier attempt of our task failed, its progress may be worth picking up
+func (t Task) Retried() bool {
+	return t.Attempt > 0
+}
+
+func (t Task) String() string {
+	return fmt.Sprintf("%s task %d/%d attempt %d", t.Execution, t.Index, t.Count, t.Attempt)
+}
+
+func envInt(name string, fallback int) int {
+	i, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return i
+}
+
+// Pacer spaces work out to a rate, so a job deleting or rewriting a whole collection doesn't starve the services
+// sharing the database with it. a nil Pacer doesn't wait
+type Pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// NewPacer lets perSecond items through each second, averaged over the batches they go in. 0 or less doesn't wait
+func NewPacer(perSecond float64) *Pacer {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &Pacer{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until a batch of n items may go, the first batch goes right away and each after it once the one before
+// has had its share of time
+func (p *Pacer) Wait(ctx context.Context, n int) error {
+	if p == nil {
+		return ctx.Err()
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(n) * p.interval)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,152 @@
+package lazyinit
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/lazyinit"
+
+var (
+	meter       = metric.Must(global.Meter(instrumentationName))
+	initLatency = meter.NewFloat64ValueRecorder("lazyinit.latency",
+		metric.WithDescription("time taken to initialize a value by name and outcome, in milliseconds"),
+		metric.WithUnit("ms"),
+	)
+	gets = meter.NewInt64Counter("lazyinit.gets", metric.WithDescription("gets by name and outcome, ready, waited, failed or cached_error"))
+)
+
+// InitFunc creates the value, ctx keeps the values of the first caller but not its cancellation. ctx is cancelled once
+// InitFunc returns, a client that holds on to the context it is created with, like google.DefaultTokenSource, needs
+// ctxutil.Detach(ctx)
+type InitFunc func(ctx context.Context) (interface{}, error)
+
+// Value is created on its first Get rather than at startup, a cold start serves its first requests without waiting on
+// clients they don't use. concurrent first callers share a single init, a value is never created twice, and a failed
+// init is remembered for a while so a dependency that is down isn't hammered by every request
+type Value struct {
+	name       string
+	init       InitFunc
+	timeout    time.Duration
+	retryAfter time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	value interface{}
+	ready bool
+	// pending is closed once the init in flight is done, nil when there is none
+	pending  chan struct{}
+	err      error
+	failedAt time.Time
+}
+
+type Option func(v *Value)
+
+// WithTimeout bounds a single init, defaults to 30 seconds. the init doesn't end when the caller that started it
+// gives up, the callers behind it still want the value
+func WithTimeout(d time.Duration) Option {
+	return func(v *Value) {
+		v.timeout = d
+	}
+}
+
+// WithRetryAfter is how long a failed init is returned to every Get before the next Get tries again, defaults to 5
+// seconds
+func WithRetryAfter(d time.Duration) Option {
+	return func(v *Value) {
+		v.retryAfter = d
+	}
+}
+
+// New returns a value that is created by init on its first Get, name is used as a metric label
+func New(name string, init InitFunc, opts ...Option) *Value {
+	v := &Value{name: name, init: init, timeout: 30 * time.Second, retryAfter: 5 * time.Second, now: time.Now}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Get returns the value, creating it first when nobody has yet. callers waiting on an init give up once their ctx is
+// done, the init carries on for whoever comes next. the error of a failed init is Unavailable and returned as is
+// until its retry after has passed
+func (v *Value) Get(ctx context.Context) (interface{}, error) {
+	v.mu.Lock()
+	if v.ready {
+		value := v.value
+		v.mu.Unlock()
+		gets.Add(ctx, 1, attribute.String("name", v.name), attribute.String("outcome", "ready"))
+		return value, nil
+	}
+	if v.pending == nil && v.err != nil && v.now().Sub(v.failedAt) < v.retryAfter {
+		err := v.err
+		v.mu.Unlock()
+		gets.Add(ctx, 1, attribute.String("name", v.name), attribute.String("outcome", "cached_error"))
+		return nil, err
+	}
+	pending := v.pending
+	if pending == nil {
+		pending = make(chan struct{})
+		v.pending = pending
+		go v.run(ctxutil.Detach(ctx), pending)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-pending:
+	case <-ctx.Done():
+		return nil, errs.Wrapf(ctx.Err(), errs.Unavailable, "waiting on %s", v.name)
+	}
+	v.mu.Lock()
+	value, err := v.value, v.err
+	v.mu.Unlock()
+	outcome := "waited"
+	if err != nil {
+		outcome = "failed"
+	}
+	gets.Add(ctx, 1, attribute.String("name", v.name), attribute.String("outcome", outcome))
+	return value, err
+}
+
+// Warm creates the value now if nobody has yet, its signature matches serverx.WarmupFunc. with serverx.WithWarmup the
+// init runs once our listener is bound, off the first request without holding up startup
+func (v *Value) Warm(ctx context.Context) error {
+	_, err := v.Get(ctx)
+	return err
+}
+
+// Peek returns the value if it was created, without creating it. use it on shutdown to close only what was opened
+func (v *Value) Peek() (interface{}, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.value, v.ready
+}
+
+func (v *Value) run(ctx context.Context, pending chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	start := v.now()
+	value, err := v.init(ctx)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		err = errs.Wrapf(err, errs.Unavailable, "initializing %s", v.name)
+	}
+	initLatency.Record(ctx, float64(v.now().Sub(start))/float64(time.Millisecond), attribute.String("name", v.name), attribute.String("outcome", outcome))
+
+	v.mu.Lock()
+	if err == nil {
+		v.value, v.ready, v.err = value, true, nil
+	} else {
+		v.err, v.failedAt = err, v.now()
+	}
+	v.pending = nil
+	v.mu.Unlock()
+	close(pending)
+}
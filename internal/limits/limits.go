@@ -0,0 +1,121 @@
+package limits
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cgroup v1 reports "no limit" as a huge page aligned number rather than "max"
+const unlimitedThreshold = 1 << 62
+
+var (
+	cpuOnce sync.Once
+	cpu     float64
+	memOnce sync.Once
+	mem     int64
+)
+
+// CPU returns the number of cpus our container is allowed to use, cloud run enforces the --cpu setting through
+// cgroups while runtime.NumCPU reports the cores of the underlying host
+func CPU() float64 {
+	cpuOnce.Do(func() {
+		cpu = detectCPU()
+	})
+	return cpu
+}
+
+// CPUs rounds CPU up to a whole number of cpus, with a minimum of 1
+func CPUs() int {
+	n := int(math.Ceil(CPU()))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Memory returns the memory limit of our container in bytes, falling back to the total memory reported by
+// /proc/meminfo which is what the first generation cloud run sandbox exposes. zero means unknown
+func Memory() int64 {
+	memOnce.Do(func() {
+		mem = detectMemory()
+	})
+	return mem
+}
+
+func detectCPU() float64 {
+	// cgroup v2, "max 100000" or "200000 100000"
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period
+			}
+		}
+	}
+	// cgroup v1
+	quota, err1 := readInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	period, err2 := readInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+		return float64(quota) / float64(period)
+	}
+	return float64(runtime.NumCPU())
+}
+
+// CgroupMemory reads the memory limit cgroups enforce on our container and which cgroup version it came from, both
+// cloud run execution environments expose it. zero and an empty source without a limit, unlike Memory it doesn't
+// fall back to the memory of the host
+func CgroupMemory() (int64, string) {
+	// cgroup v2 says "max" without a limit
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && v > 0 {
+			return v, "cgroup v2"
+		}
+	}
+	if v, err := readInt("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil && v > 0 && v < unlimitedThreshold {
+		return v, "cgroup v1"
+	}
+	return 0, ""
+}
+
+func detectMemory() int64 {
+	if v, _ := CgroupMemory(); v > 0 {
+		return v
+	}
+	return memTotal()
+}
+
+func memTotal() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+func readInt(path string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
@@ -0,0 +1,349 @@
+package lockx
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/lockx"
+
+var (
+	// ErrHeld is returned when there is an unexpired lease on the lock, even one of ours
+	ErrHeld = errors.New("lockx: lock is held")
+	// ErrLost is returned when our lease expired or was taken over, work done under it may not be the only work anymore
+	ErrLost = errors.New("lockx: lease lost")
+)
+
+// Lease is our hold on a lock. Token grows every time the lock changes hands, pass it along with writes the lock
+// protects so a holder that stalled past its expiry can be told apart from the current one
+type Lease struct {
+	Name    string
+	Holder  string
+	Token   int64
+	Expires time.Time
+}
+
+// lockDoc is how a lock is stored, the token is kept once a lease is released so the next one still gets a higher one
+type lockDoc struct {
+	Holder  string    `firestore:"holder"`
+	Token   int64     `firestore:"token"`
+	Expires time.Time `firestore:"expires"`
+}
+
+// Locker hands out leases on locks stored as documents of a firestore collection. cloud run runs any number of copies
+// of us, a Locker is how one of them gets to be the only one doing something, like a scheduled job or a pull
+// subscriber that has to process in order. leases expire after a ttl so a lock never outlives an instance that was
+// killed while holding it, Hold and Lead renew them for as long as the work runs
+type Locker struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+	holder     string
+	ttl        time.Duration
+	retry      time.Duration
+	now        func() time.Time
+	logger     *zap.SugaredLogger
+
+	acquisitions metric.Int64Counter
+	lost         metric.Int64Counter
+}
+
+type Option func(l *Locker)
+
+// WithTTL lets a lease expire d after it was last renewed, defaults to 30 seconds. Hold renews every third of it
+func WithTTL(d time.Duration) Option {
+	return func(l *Locker) {
+		l.ttl = d
+	}
+}
+
+// WithRetryInterval has Lead try for a lock someone else holds every d, defaults to the ttl
+func WithRetryInterval(d time.Duration) Option {
+	return func(l *Locker) {
+		l.retry = d
+	}
+}
+
+// WithLogger logs leases we acquire and lose
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(l *Locker) {
+		l.logger = logger
+	}
+}
+
+// WithClock replaces time.Now, expiries are compared against it on every instance so it has to be the wall clock
+// outside of tests
+func WithClock(now func() time.Time) Option {
+	return func(l *Locker) {
+		l.now = now
+	}
+}
+
+// New stores locks in collection, holder identifies us in them, eg the instance id from the metadata server
+func New(client *firestore.Client, collection, holder string, opts ...Option) *Locker {
+	meter := metric.Must(global.Meter(instrumentationName))
+	l := &Locker{
+		client:       client,
+		collection:   client.Collection(collection),
+		holder:       holder,
+		ttl:          30 * time.Second,
+		now:          time.Now,
+		logger:       zap.NewNop().Sugar(),
+		acquisitions: meter.NewInt64Counter("lockx.acquisitions", metric.WithDescription("attempts at acquiring a lock by outcome")),
+		lost:         meter.NewInt64Counter("lockx.lost", metric.WithDescription("leases lost while their work was still running")),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.retry == 0 {
+		l.retry = l.ttl
+	}
+	return l
+}
+
+// Acquire takes lock name unless anyone, us included, holds an unexpired lease on it, in which case it returns ErrHeld
+func (l *Locker) Acquire(ctx context.Context, name string) (*Lease, error) {
+	ctx, span := startSpan(ctx, "lockx.Acquire", name)
+	lease, err := l.acquire(ctx, name)
+	endSpan(span, err)
+	return lease, err
+}
+
+func (l *Locker) acquire(ctx context.Context, name string) (*Lease, error) {
+	ref := l.collection.Doc(name)
+	var lease *Lease
+	err := l.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		current, err := l.read(tx, ref)
+		if err != nil {
+			return err
+		}
+		now := l.now()
+		// our own unexpired lease is held too, holder names an instance and two of its requests must not both win
+		if current.Holder != "" && now.Before(current.Expires) {
+			return ErrHeld
+		}
+		next := lockDoc{Holder: l.holder, Token: current.Token + 1, Expires: now.Add(l.ttl)}
+		lease = &Lease{Name: name, Holder: next.Holder, Token: next.Token, Expires: next.Expires}
+		return tx.Set(ref, next)
+	})
+
+	outcome := "acquired"
+	switch {
+	case errors.Is(err, ErrHeld):
+		outcome = "held"
+	case err != nil:
+		outcome = "error"
+	}
+	l.acquisitions.Add(ctx, 1, attribute.String("lock", name), attribute.String("outcome", outcome))
+	if err != nil {
+		if errors.Is(err, ErrHeld) {
+			return nil, ErrHeld
+		}
+		return nil, fmt.Errorf("RunTransaction(%s): %v", name, err)
+	}
+	l.logger.Infow("acquired lock", "lock", name, "token", lease.Token, "expires", lease.Expires)
+	return lease, nil
+}
+
+// Renew extends lease by our ttl, it returns ErrLost once the lock moved on to another lease
+func (l *Locker) Renew(ctx context.Context, lease *Lease) error {
+	ctx, span := startSpan(ctx, "lockx.Renew", lease.Name)
+	err := l.renew(ctx, lease)
+	endSpan(span, err)
+	return err
+}
+
+func (l *Locker) renew(ctx context.Context, lease *Lease) error {
+	ref := l.collection.Doc(lease.Name)
+	var expires time.Time
+	err := l.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := l.verify(tx, ref, lease); err != nil {
+			return err
+		}
+		expires = l.now().Add(l.ttl)
+		return tx.Update(ref, []firestore.Update{{Path: "expires", Value: expires}})
+	})
+	if errors.Is(err, ErrLost) {
+		return ErrLost
+	}
+	if err != nil {
+		return fmt.Errorf("RunTransaction(%s): %v", lease.Name, err)
+	}
+	lease.Expires = expires
+	return nil
+}
+
+// Release gives the lock up so the next holder doesn't have to wait for our lease to expire, releasing a lease we
+// already lost does nothing
+func (l *Locker) Release(ctx context.Context, lease *Lease) error {
+	ctx, span := startSpan(ctx, "lockx.Release", lease.Name)
+	err := l.release(ctx, lease)
+	endSpan(span, err)
+	return err
+}
+
+func (l *Locker) release(ctx context.Context, lease *Lease) error {
+	ref := l.collection.Doc(lease.Name)
+	err := l.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := l.verify(tx, ref, lease); err != nil {
+			return err
+		}
+		return tx.Set(ref, lockDoc{Token: lease.Token})
+	})
+	if err != nil && !errors.Is(err, ErrLost) {
+		return fmt.Errorf("RunTransaction(%s): %v", lease.Name, err)
+	}
+	return nil
+}
+
+// startSpan spans an operation on lock name, the transaction it runs nests under it
+func startSpan(ctx context.Context, op, name string) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, op, trace.WithAttributes(attribute.String("lock", name)))
+}
+
+// endSpan ends span, a lock being held or a lease lost is an outcome rather than an error
+func endSpan(span trace.Span, err error) {
+	switch {
+	case errors.Is(err, ErrHeld):
+		span.SetAttributes(attribute.String("outcome", "held"))
+	case errors.Is(err, ErrLost):
+		span.SetAttributes(attribute.String("outcome", "lost"))
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Verify fences a write inside the caller's transaction, it fails with ErrLost unless lease is still the current one.
+// our lease can expire while we stall, eg on a cpu throttled instance, and a transaction that verified it either
+// commits while we still hold the lock or not at all
+func (l *Locker) Verify(tx *firestore.Transaction, lease *Lease) error {
+	return l.verify(tx, l.collection.Doc(lease.Name), lease)
+}
+
+func (l *Locker) verify(tx *firestore.Transaction, ref *firestore.DocumentRef, lease *Lease) error {
+	current, err := l.read(tx, ref)
+	if err != nil {
+		return err
+	}
+	if current.Holder != lease.Holder || current.Token != lease.Token || !l.now().Before(current.Expires) {
+		return ErrLost
+	}
+	return nil
+}
+
+// read returns the lock document, the zero lockDoc for a lock nobody ever took
+func (l *Locker) read(tx *firestore.Transaction, ref *firestore.DocumentRef) (lockDoc, error) {
+	var current lockDoc
+	snapshot, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return current, nil
+	}
+	if err != nil {
+		return current, fmt.Errorf("tx.Get(): %v", err)
+	}
+	if err := snapshot.DataTo(&current); err != nil {
+		return current, fmt.Errorf("snapshot.DataTo(): %v", err)
+	}
+	return current, nil
+}
+
+// Hold runs fn while holding lock name, or returns ErrHeld without running it. the lease is renewed in the
+// background and fn's context is cancelled as soon as it is lost, fn should stop then. the lease is released once fn
+// returns, Hold returns what fn returned, or ErrLost if fn succeeded after we lost the lease
+func (l *Locker) Hold(ctx context.Context, name string, fn func(ctx context.Context, lease *Lease) error) error {
+	lease, err := l.Acquire(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lostc := make(chan struct{})
+	go func() {
+		if l.heartbeat(ctx, lease) {
+			close(lostc)
+			cancel()
+		}
+	}()
+
+	// fn gets a copy, the heartbeat keeps extending the expiry of ours
+	held := *lease
+	err = fn(ctx, &held)
+	cancel()
+
+	// release with a context of its own, ours may be done by now
+	releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer releaseCancel()
+	if releaseErr := l.Release(releaseCtx, lease); releaseErr != nil {
+		l.logger.Warnw("releasing lock", "lock", name, "err", releaseErr)
+	}
+
+	select {
+	case <-lostc:
+		if err == nil {
+			err = ErrLost
+		}
+	default:
+	}
+	return err
+}
+
+// heartbeat renews lease every third of our ttl until ctx is done, it reports whether the lease was lost. a renewal
+// that fails for any other reason is retried until the lease would have expired
+func (l *Locker) heartbeat(ctx context.Context, lease *Lease) bool {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+		err := l.Renew(ctx, lease)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if errors.Is(err, ErrLost) || !l.now().Before(lease.Expires) {
+			l.lost.Add(ctx, 1, attribute.String("lock", lease.Name))
+			l.logger.Warnw("lost lock", "lock", lease.Name, "token", lease.Token, "err", err)
+			return true
+		}
+		l.logger.Warnw("renewing lock", "lock", lease.Name, "err", err)
+	}
+}
+
+// Lead is leader election, it keeps trying for lock name and runs fn whenever we hold it, until ctx is done. fn
+// should run until its context is done, if it returns early we give up the lock and campaign again
+func (l *Locker) Lead(ctx context.Context, name string, fn func(ctx context.Context, lease *Lease) error) error {
+	for {
+		err := l.Hold(ctx, name, fn)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, ErrHeld):
+		case err != nil:
+			l.logger.Warnw("leading", "lock", name, "err", err)
+		}
+
+		timer := time.NewTimer(l.retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package logx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blendle/zapdriver"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCloudTraceContext is returned for X-Cloud-Trace-Context headers that don't follow
+// TRACE_ID/SPAN_ID;o=OPTIONS, callers should log without trace correlation rather than fail the request
+var ErrInvalidCloudTraceContext = errors.New("invalid X-Cloud-Trace-Context")
+
+// CloudTraceContext is a parsed X-Cloud-Trace-Context header, in the form cloud logging expects in its special fields
+type CloudTraceContext struct {
+	// TraceID is 32 lowercase hex characters
+	TraceID string
+	// SpanID is 16 lowercase hex characters, the header carries it in decimal. empty when the header had no span
+	SpanID  string
+	Sampled bool
+}
+
+// ParseCloudTraceContext parses TRACE_ID/SPAN_ID;o=OPTIONS as described at
+// https://cloud.google.com/trace/docs/setup#force-trace, only TRACE_ID is required. headers come straight from the
+// client so nothing in them is trusted, a malformed header is an error and never a panic or a half parsed result
+func ParseCloudTraceContext(header string) (CloudTraceContext, error) {
+	var tc CloudTraceContext
+	rest := strings.TrimSpace(header)
+
+	traceID := rest
+	if i := strings.IndexAny(rest, "/;"); i >= 0 {
+		traceID, rest = rest[:i], rest[i:]
+	} else {
+		rest = ""
+	}
+	if len(traceID) != 32 || !isHex(traceID) || strings.Trim(traceID, "0") == "" {
+		return CloudTraceContext{}, fmt.Errorf("%w: trace id %q is not 32 hex characters", ErrInvalidCloudTraceContext, truncate(traceID))
+	}
+	tc.TraceID = strings.ToLower(traceID)
+
+	if strings.HasPrefix(rest, "/") {
+		spanID := rest[1:]
+		if i := strings.IndexByte(spanID, ';'); i >= 0 {
+			spanID, rest = spanID[:i], spanID[i:]
+		} else {
+			rest = ""
+		}
+		// ParseUint would also take a sign or underscores, the header is plain decimal digits
+		if spanID == "" || !isDecimal(spanID) {
+			return CloudTraceContext{}, fmt.Errorf("%w: span id %q is not decimal", ErrInvalidCloudTraceContext, truncate(spanID))
+		}
+		id, err := strconv.ParseUint(spanID, 10, 64)
+		if err != nil {
+			return CloudTraceContext{}, fmt.Errorf("%w: span id %q overflows 64 bits", ErrInvalidCloudTraceContext, truncate(spanID))
+		}
+		// a zero span means the caller didn't have one
+		if id != 0 {
+			tc.SpanID = fmt.Sprintf("%016x", id)
+		}
+	}
+
+	if rest != "" {
+		if !strings.HasPrefix(rest, ";o=") || !isDecimal(rest[3:]) || rest[3:] == "" {
+			return CloudTraceContext{}, fmt.Errorf("%w: options %q are not o=NUMBER", ErrInvalidCloudTraceContext, truncate(rest))
+		}
+		options, err := strconv.ParseUint(rest[3:], 10, 32)
+		if err != nil {
+			return CloudTraceContext{}, fmt.Errorf("%w: options %q overflow", ErrInvalidCloudTraceContext, truncate(rest))
+		}
+		// options is a bit mask, the lowest bit is the sampling decision
+		tc.Sampled = options&1 == 1
+	}
+	return tc, nil
+}
+
+// WrapCloudTraceContext correlates our logs with the request through the raw X-Cloud-Trace-Context header, for
+// handlers that aren't instrumented with otel. prefer WrapTraceContext when a span is in the context
+func (i *AppLogger) WrapCloudTraceContext(header string) *zap.SugaredLogger {
+	tc, err := ParseCloudTraceContext(header)
+	if err != nil {
+		return i.Sugar()
+	}
+	return i.With(zapdriver.TraceContext(tc.TraceID, tc.SpanID, tc.Sampled, i.projectID)...).Sugar()
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDecimal(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate keeps attacker controlled input in our errors short
+func truncate(s string) string {
+	if len(s) > 64 {
+		return s[:64] + "..."
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+package logx
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// FuzzParseCloudTraceContext feeds client controlled X-Cloud-Trace-Context headers to our parser, it must never panic,
+// only hand back well formed ids, keep its errors short and parse the header it would send on the same way
+func FuzzParseCloudTraceContext(f *testing.F) {
+	f.Add("105445aa7843bc8bf206b120001000ab/1;o=1")
+	f.Add("105445aa7843bc8bf206b120001000ab")
+	f.Add("105445aa7843bc8bf206b120001000ab/0")
+	f.Add("105445AA7843BC8BF206B120001000AB/18446744073709551615;o=3")
+	f.Add("105445aa7843bc8bf206b120001000ab/18446744073709551616;o=1")
+	f.Add("105445aa7843bc8bf206b120001000ab;o=4294967296")
+	f.Add("00000000000000000000000000000000/1;o=1")
+	f.Add("105445aa7843bc8bf206b120001000ab/+1;o=-1")
+	f.Add(" 105445aa7843bc8bf206b120001000ab/1;o=1 ")
+	f.Add("/;o=")
+	f.Fuzz(func(t *testing.T, header string) {
+		tc, err := ParseCloudTraceContext(header)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCloudTraceContext) {
+				t.Fatalf("ParseCloudTraceContext(%q) error %v doesn't wrap ErrInvalidCloudTraceContext", header, err)
+			}
+			if tc != (CloudTraceContext{}) {
+				t.Fatalf("ParseCloudTraceContext(%q) returned %+v along with error %v", header, tc, err)
+			}
+			// the header is echoed back truncated and quoted, a huge header must not turn into a huge log line
+			if len(err.Error()) > 512 {
+				t.Fatalf("ParseCloudTraceContext(%q) error is %d bytes long", header, len(err.Error()))
+			}
+			return
+		}
+
+		if len(tc.TraceID) != 32 || !isLowerHex(tc.TraceID) {
+			t.Fatalf("ParseCloudTraceContext(%q) trace id %q is not 32 lowercase hex characters", header, tc.TraceID)
+		}
+		if tc.SpanID != "" && (len(tc.SpanID) != 16 || !isLowerHex(tc.SpanID)) {
+			t.Fatalf("ParseCloudTraceContext(%q) span id %q is not 16 lowercase hex characters", header, tc.SpanID)
+		}
+
+		// what we accepted has to survive being sent on to the next service
+		again, err := ParseCloudTraceContext(format(tc))
+		if err != nil {
+			t.Fatalf("ParseCloudTraceContext(%q) = %+v, which formats to %q that fails with %v", header, tc, format(tc), err)
+		}
+		if again != tc {
+			t.Fatalf("ParseCloudTraceContext(%q) = %+v, formatting and parsing it again gives %+v", header, tc, again)
+		}
+	})
+}
+
+// format writes tc back as TRACE_ID/SPAN_ID;o=OPTIONS
+func format(tc CloudTraceContext) string {
+	header := tc.TraceID
+	if tc.SpanID != "" {
+		id, _ := strconv.ParseUint(tc.SpanID, 16, 64)
+		header += "/" + strconv.FormatUint(id, 10)
+	}
+	if tc.Sampled {
+		header += ";o=1"
+	}
+	return header
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package logx
+
+import (
+	"regexp"
+	"testing"
+)
+
+// reCloudTraceContext is the regex google-cloud-go parses the header with, and we used to, kept to compare against
+var reCloudTraceContext = regexp.MustCompile(`([a-f\d]+)?(?:/([a-f\d]+))?(?:;o=(\d))?`)
+
+var benchmarkHeaders = []struct {
+	name   string
+	header string
+}{
+	{name: "full", header: "105445aa7843bc8bf206b120001000ab/1;o=1"},
+	{name: "trace_only", header: "105445aa7843bc8bf206b120001000ab"},
+	{name: "malformed", header: "not-a-trace/xyz;o=maybe"},
+}
+
+func BenchmarkParseCloudTraceContext(b *testing.B) {
+	for _, bm := range benchmarkHeaders {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ParseCloudTraceContext(bm.header)
+			}
+		})
+	}
+}
+
+func BenchmarkCloudTraceContextRegex(b *testing.B) {
+	for _, bm := range benchmarkHeaders {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reCloudTraceContext.FindStringSubmatch(bm.header)
+			}
+		})
+	}
+}
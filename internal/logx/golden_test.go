@@ -0,0 +1,98 @@
+package logx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/logx/logtest"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"testing"
+)
+
+func tracedContext(sampled bool) context.Context {
+	traceID, _ := trace.TraceIDFromHex("105445aa7843bc8bf206b120001000ab")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	config := trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}
+	if sampled {
+		config.TraceFlags = trace.FlagsSampled
+	}
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(config))
+}
+
+// TestGolden guards the shape of the entries cloud logging parses, run with UPDATE_GOLDEN=1 after an intended change
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(logger *logx.AppLogger)
+	}{
+		{
+			name: "traced_info",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapTraceContext(tracedContext(true)).Infow("created beer", "beer_name", "hazy ipa", "count", 3)
+			},
+		},
+		{
+			name: "unsampled_debug",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapTraceContext(tracedContext(false)).Debugw("cache miss", "key", "beers")
+			},
+		},
+		{
+			name: "untraced_warn",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapTraceContext(context.Background()).Warnw("retrying", "attempt", 2)
+			},
+		},
+		{
+			name: "context_labels",
+			log: func(logger *logx.AppLogger) {
+				ctx := logx.ContextWithFields(tracedContext(true), zapdriver.Label("tenant", "acme"), zap.String("request_id", "abc"))
+				logger.WrapTraceContext(ctx).Infow("tenant request")
+			},
+		},
+		{
+			name: "error_with_stacktrace",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapTraceContext(tracedContext(true)).Errorw("upstream failed", "err", errors.New("connection reset"))
+			},
+		},
+		{
+			name: "http_request",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapTraceContext(tracedContext(true)).Infow("request served", zapdriver.HTTP(&zapdriver.HTTPPayload{
+					RequestMethod: "GET",
+					RequestURL:    "/api/beers",
+					Status:        200,
+					UserAgent:     "curl/7.64.1",
+					RemoteIP:      "203.0.113.7",
+					Latency:       "0.015s",
+				}))
+			},
+		},
+		{
+			name: "cloud_trace_context",
+			log: func(logger *logx.AppLogger) {
+				logger.WrapCloudTraceContext("105445aa7843bc8bf206b120001000ab/1;o=1").Info("hello")
+			},
+		},
+		{
+			name: "request_level",
+			log: func(logger *logx.AppLogger) {
+				logger.Level.SetLevel(zapcore.InfoLevel)
+				ctx := logx.ContextWithLevel(tracedContext(true), zapcore.DebugLevel)
+				logger.WrapTraceContext(ctx).Debug("debug for one request")
+				logger.WrapTraceContext(tracedContext(true)).Debug("filtered out")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, capture := logtest.New(t, "my-project")
+			tt.log(logger)
+			logtest.Golden(t, "testdata/"+tt.name+".golden.json", capture.Entries())
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package logx
+
+import (
+	"github.com/blendle/zapdriver"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"strings"
+)
+
+const (
+	labelsKey         = "logging.googleapis.com/labels"
+	sourceLocationKey = "logging.googleapis.com/sourceLocation"
+)
+
+// labelCore nests zapdriver.Label fields under logging.googleapis.com/labels and adds our source location, what
+// zapdriver.WrapCore does, without sharing labels between loggers. zapdriver keeps the labels of every With in a single
+// map shared by every logger of the same root, so a label added for one request showed up on the entries of every
+// request after it
+type labelCore struct {
+	zapcore.Core
+	// labels came from With, oldest first
+	labels []zapcore.Field
+}
+
+func wrapLabels() zap.Option {
+	return zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &labelCore{Core: core}
+	})
+}
+
+func isLabel(field zapcore.Field) bool {
+	return strings.HasPrefix(field.Key, "labels.") && field.Type == zapcore.StringType
+}
+
+// splitLabels separates label fields from the rest
+func splitLabels(fields []zapcore.Field) (labels, rest []zapcore.Field) {
+	for _, field := range fields {
+		if isLabel(field) {
+			labels = append(labels, field)
+			continue
+		}
+		rest = append(rest, field)
+	}
+	return labels, rest
+}
+
+func (c *labelCore) With(fields []zapcore.Field) zapcore.Core {
+	labels, rest := splitLabels(fields)
+	merged := make([]zapcore.Field, 0, len(c.labels)+len(labels))
+	merged = append(merged, c.labels...)
+	merged = append(merged, labels...)
+	return &labelCore{Core: c.Core.With(rest), labels: merged}
+}
+
+func (c *labelCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *labelCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	labels, rest := splitLabels(fields)
+	all := make(labelMap, 0, len(c.labels)+len(labels))
+	for _, field := range append(append([]zapcore.Field{}, c.labels...), labels...) {
+		all = all.set(strings.TrimPrefix(field.Key, "labels."), field.String)
+	}
+	rest = append(rest, zap.Object(labelsKey, all))
+
+	hasSource := false
+	for _, field := range rest {
+		if field.Key == sourceLocationKey {
+			hasSource = true
+			break
+		}
+	}
+	if !hasSource && entry.Caller.Defined {
+		rest = append(rest, zapdriver.SourceLocation(entry.Caller.PC, entry.Caller.File, entry.Caller.Line, true))
+	}
+	return c.Core.Write(entry, rest)
+}
+
+type label struct {
+	key, value string
+}
+
+// labelMap keeps labels in the order they were first added, a later value for the same key wins
+type labelMap []label
+
+func (m labelMap) set(key, value string) labelMap {
+	for i := range m {
+		if m[i].key == key {
+			m[i].value = value
+			return m
+		}
+	}
+	return append(m, label{key: key, value: value})
+}
+
+func (m labelMap) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, l := range m {
+		enc.AddString(l.key, l.value)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package logx
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/blendle/zapdriver"
+	"testing"
+)
+
+func TestLabelsStayWithTheirLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewWriterLogger("my-project", &buf)
+
+	// two requests deriving loggers from the same root, eg the tenant and cold start labels of our middlewares
+	acme := logger.With(zapdriver.Label("tenant", "acme"))
+	cold := logger.With(zapdriver.Label("cold_start", "true"))
+	acme.Info("acme")
+	cold.Info("cold")
+	logger.Info("root")
+	acme.With(zapdriver.Label("tenant", "globex")).Info("globex")
+	acme.Info("acme again")
+
+	want := []map[string]string{
+		{"tenant": "acme"},
+		{"cold_start": "true"},
+		{},
+		{"tenant": "globex"},
+		{"tenant": "acme"},
+	}
+	decoder := json.NewDecoder(&buf)
+	for i, labels := range want {
+		var entry struct {
+			Message string            `json:"message"`
+			Labels  map[string]string `json:"logging.googleapis.com/labels"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("entry %d: json.Decode(): %v", i, err)
+		}
+		for key, value := range labels {
+			if got := entry.Labels[key]; got != value {
+				t.Errorf("%q label %s = %q, want %q", entry.Message, key, got, value)
+			}
+		}
+		for _, key := range []string{"tenant", "cold_start"} {
+			if _, ok := labels[key]; !ok && entry.Labels[key] != "" {
+				t.Errorf("%q has label %s=%q of another logger", entry.Message, key, entry.Labels[key])
+			}
+		}
+	}
+}
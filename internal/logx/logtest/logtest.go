@@ -0,0 +1,162 @@
+// Package logtest captures our structured log output and compares it against golden files, cloud logging relies on
+// field names like logging.googleapis.com/trace so renaming one by accident silently breaks log correlation
+//
+//	func TestRequestLogging(t *testing.T) {
+//		logger, capture := logtest.New(t, "my-project")
+//		logger.WrapTraceContext(ctx).Infow("hello", "user", "abc")
+//		logtest.Golden(t, "testdata/hello.golden.json", capture.Entries())
+//	}
+//
+// run the tests with UPDATE_GOLDEN=1 to rewrite the golden files after an intended change
+package logtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Normalized replaces every value that changes between runs or builds
+const Normalized = "<normalized>"
+
+// volatile fields are normalized wherever they appear, nested fields are written as a path
+var volatile = []string{
+	"timestamp",
+	"stacktrace",
+	"caller",
+	"logging.googleapis.com/sourceLocation.file",
+	"logging.googleapis.com/sourceLocation.line",
+	// the function of a closure is numbered by its position in the file
+	"logging.googleapis.com/sourceLocation.function",
+	"logging.googleapis.com/labels.version",
+	"logging.googleapis.com/labels.revision",
+	"logging.googleapis.com/labels.cloud_run_revision",
+}
+
+// Capture collects the json lines written by a logger
+type Capture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// Entries decodes every captured line with its volatile fields normalized
+func (c *Capture) Entries() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(c.buf.Bytes()))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			entry = map[string]interface{}{"invalid_json": scanner.Text()}
+		}
+		Normalize(entry)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Reset drops everything captured so far
+func (c *Capture) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.Reset()
+}
+
+// New returns our production logger writing into a Capture
+func New(tb testing.TB, projectID string, opts ...zap.Option) (*logx.AppLogger, *Capture) {
+	tb.Helper()
+	capture := &Capture{}
+	logger := logx.NewWriterLogger(projectID, capture, opts...)
+	tb.Cleanup(func() { logger.Sync() })
+	return logger, capture
+}
+
+// WithClock timestamps every entry with now, for tests that read the raw output. Entries normalizes timestamps, golden
+// files never see them
+func WithClock(now func() time.Time) zap.Option {
+	return zap.WithClock(clock(now))
+}
+
+type clock func() time.Time
+
+func (c clock) Now() time.Time {
+	return c()
+}
+
+func (c clock) NewTicker(d time.Duration) *time.Ticker {
+	return time.NewTicker(d)
+}
+
+// Normalize replaces the volatile fields of entry, fields that are missing stay missing so a dropped field still
+// shows up as a diff
+func Normalize(entry map[string]interface{}) {
+	for _, path := range volatile {
+		normalizePath(entry, path)
+	}
+}
+
+func normalizePath(m map[string]interface{}, path string) {
+	if _, ok := m[path]; ok {
+		m[path] = Normalized
+		return
+	}
+	// keys like logging.googleapis.com/labels contain dots themselves, so try every split point
+	for i := strings.Index(path, "."); i >= 0; {
+		if nested, ok := m[path[:i]].(map[string]interface{}); ok {
+			normalizePath(nested, path[i+1:])
+		}
+		next := strings.Index(path[i+1:], ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+}
+
+// Golden compares got with the json in path, with UPDATE_GOLDEN set it writes got to path instead
+func Golden(tb testing.TB, path string, got interface{}) {
+	tb.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(got); err != nil {
+		tb.Fatalf("enc.Encode(): %v", err)
+	}
+	actual := buf.Bytes()
+
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			tb.Fatalf("os.MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(path, actual, 0o644); err != nil {
+			tb.Fatalf("ioutil.WriteFile(): %v", err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("ioutil.ReadFile(): %v, run with UPDATE_GOLDEN=1 to create it", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		tb.Errorf("log output does not match %s, run with UPDATE_GOLDEN=1 if the change is intended\ngot:\n%s\nwant:\n%s", path, actual, expected)
+	}
+}
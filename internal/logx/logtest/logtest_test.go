@@ -0,0 +1,115 @@
+package logtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	entry := map[string]interface{}{
+		"timestamp": "2021-08-01T12:00:00Z",
+		"message":   "hello",
+		"logging.googleapis.com/labels": map[string]interface{}{
+			"version": "v1.2.3",
+			"tenant":  "acme",
+		},
+		"logging.googleapis.com/sourceLocation": map[string]interface{}{
+			"file": "/src/main.go",
+			"line": "42",
+		},
+	}
+	Normalize(entry)
+	want := map[string]interface{}{
+		"timestamp": Normalized,
+		"message":   "hello",
+		"logging.googleapis.com/labels": map[string]interface{}{
+			"version": Normalized,
+			"tenant":  "acme",
+		},
+		// function was missing and stays missing
+		"logging.googleapis.com/sourceLocation": map[string]interface{}{
+			"file": Normalized,
+			"line": Normalized,
+		},
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("Normalize() = %v, want %v", entry, want)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	logger, capture := New(t, "my-project", WithClock(func() time.Time { return time.Unix(0, 0) }))
+	logger.Sugar().Infow("first", "n", 1)
+	logger.Sugar().Warn("second")
+
+	entries := capture.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("captured %d entries, want 2", len(entries))
+	}
+	if entries[0]["message"] != "first" || entries[0]["n"] != float64(1) || entries[1]["severity"] != "WARNING" {
+		t.Errorf("captured %v", entries)
+	}
+	if entries[0]["timestamp"] != Normalized {
+		t.Errorf("timestamp = %v, want it normalized", entries[0]["timestamp"])
+	}
+
+	capture.Reset()
+	if entries := capture.Entries(); len(entries) != 0 {
+		t.Errorf("captured %d entries after Reset(), want none", len(entries))
+	}
+}
+
+// recordingTB records the failures of Golden instead of failing our test
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+func TestGolden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry.golden.json")
+	entries := []map[string]interface{}{{"severity": "INFO", "logging.googleapis.com/trace": "projects/p/traces/abc"}}
+
+	// t.Setenv needs go1.17
+	previous, had := os.LookupEnv("UPDATE_GOLDEN")
+	os.Setenv("UPDATE_GOLDEN", "1")
+	Golden(t, path, entries)
+	os.Unsetenv("UPDATE_GOLDEN")
+	if had {
+		defer os.Setenv("UPDATE_GOLDEN", previous)
+	}
+
+	same := &recordingTB{TB: t}
+	Golden(same, path, entries)
+	if len(same.errors) != 0 {
+		t.Errorf("Golden() failed for the entries it wrote: %v", same.errors)
+	}
+
+	// a renamed special field is exactly what the golden files are there to catch
+	renamed := &recordingTB{TB: t}
+	Golden(renamed, path, []map[string]interface{}{{"severity": "INFO", "trace": "projects/p/traces/abc"}})
+	if len(renamed.errors) != 1 {
+		t.Errorf("Golden() reported %d failures for a renamed field, want 1", len(renamed.errors))
+	}
+
+	missing := &recordingTB{TB: t}
+	Golden(missing, filepath.Join(t.TempDir(), "missing.golden.json"), entries)
+	// our Fatalf doesn't stop Golden, only its first failure counts
+	if len(missing.errors) == 0 || !strings.Contains(missing.errors[0], "UPDATE_GOLDEN=1 to create it") {
+		t.Errorf("Golden() reported %v for a missing golden file, want it to say how to create it", missing.errors)
+	}
+}
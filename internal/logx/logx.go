@@ -3,42 +3,99 @@ package logx
 import (
 	"context"
 	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
 	"github.com/blendle/zapdriver"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
 )
 
 type AppLogger struct {
 	*zap.Logger
+	// Level can be adjusted at runtime, it also implements http.Handler for use on an admin endpoint
+	Level     zap.AtomicLevel
 	projectID string
 }
 
+// levelCore applies our level on top of a core that lets everything through, so a single request can log below it,
+// see ContextWithLevel
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zap.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(entry.Level) {
+		return ce
+	}
+	return c.Core.Check(entry, ce)
+}
+
+// withLevel filters by level, replacing the level of a core we already filter
+func withLevel(level zapcore.LevelEnabler) zap.Option {
+	return zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		if lc, ok := core.(*levelCore); ok {
+			core = lc.Core
+		}
+		return &levelCore{Core: core, level: level}
+	})
+}
+
 func newDevLogger(projectID string) (*AppLogger, error) {
 	config := zapdriver.NewDevelopmentConfig()
 	config.Encoding = "console"
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	zapLogger, err := config.Build()
+	level := config.Level
+	config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	zapLogger, err := config.Build(zap.Fields(buildinfo.LogFields()...), withLevel(level))
 	if err != nil {
 		return nil, fmt.Errorf("config.Build(): %v", err)
 	}
-	return &AppLogger{Logger: zapLogger, projectID: projectID}, nil
+	return &AppLogger{Logger: zapLogger, Level: level, projectID: projectID}, nil
 }
 
 func newProdLogger(projectID string) (*AppLogger, error) {
 	config := zapdriver.NewProductionConfig()
 	config.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	level := zap.NewAtomicLevelAt(zap.DebugLevel)
 
-	zapLogger, err := config.Build()
+	// wrapping the core nests our build labels under logging.googleapis.com/labels
+	zapLogger, err := config.Build(wrapLabels(), zap.Fields(buildinfo.LogFields()...), withLevel(level))
 	if err != nil {
 		return nil, fmt.Errorf("config.Build(): %v", err)
 	}
 	return &AppLogger{
 		Logger:    zapLogger,
+		Level:     level,
 		projectID: projectID,
 	}, nil
 }
 
+// NewWriterLogger is our production json logger writing to w instead of stderr, without sampling, eg to capture our
+// output in tests. opts are applied last, zap.WithClock fixes the timestamps of a golden test
+func NewWriterLogger(projectID string, w io.Writer, opts ...zap.Option) *AppLogger {
+	level := zap.NewAtomicLevelAt(zap.DebugLevel)
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zapdriver.NewProductionEncoderConfig()), zapcore.AddSync(w), zap.DebugLevel)
+	zapLogger := zap.New(core, append([]zap.Option{
+		wrapLabels(),
+		withLevel(level),
+		zap.AddCaller(),
+		zap.AddStacktrace(zap.ErrorLevel),
+		zap.Fields(buildinfo.LogFields()...),
+	}, opts...)...)
+	return &AppLogger{Logger: zapLogger, Level: level, projectID: projectID}
+}
+
 func NewLogger(projectID string, onCloud bool) (*AppLogger, error) {
 	if onCloud {
 		return newProdLogger(projectID)
@@ -46,9 +103,57 @@ func NewLogger(projectID string, onCloud bool) (*AppLogger, error) {
 	return newDevLogger(projectID)
 }
 
+var fieldsKey = ctxval.New("logx.fields", ctxval.WithFormat(func(v interface{}) string {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range v.([]zap.Field) {
+		field.AddTo(enc)
+	}
+	return fmt.Sprint(enc.Fields)
+}))
+
+// ContextWithFields attaches fields to ctx that WrapTraceContext adds to every entry, eg a zapdriver.Label for the tenant
+func ContextWithFields(ctx context.Context, fields ...zap.Field) context.Context {
+	existing := FieldsFromContext(ctx)
+	merged := make([]zap.Field, 0, len(existing)+len(fields))
+	merged = append(merged, existing...)
+	merged = append(merged, fields...)
+	return fieldsKey.With(ctx, merged)
+}
+
+func FieldsFromContext(ctx context.Context) []zap.Field {
+	fields, _ := fieldsKey.Value(ctx)
+	f, _ := fields.([]zap.Field)
+	return f
+}
+
+var levelKey = ctxval.New("logx.level")
+
+// ContextWithLevel has WrapTraceContext log at level for this request only, whatever our Level is, eg debug logs
+// for a request someone is tracing with tracex.Debug
+func ContextWithLevel(ctx context.Context, level zapcore.Level) context.Context {
+	return levelKey.With(ctx, level)
+}
+
+// LevelFromContext returns the level set with ContextWithLevel
+func LevelFromContext(ctx context.Context) (zapcore.Level, bool) {
+	level, ok := levelKey.Value(ctx)
+	if !ok {
+		return 0, false
+	}
+	return level.(zapcore.Level), true
+}
+
 func (i *AppLogger) WrapTraceContext(ctx context.Context) *zap.SugaredLogger {
-	sc := trace.SpanContextFromContext(ctx)
-	fields := zapdriver.TraceContext(sc.TraceID().String(), sc.SpanID().String(), sc.IsSampled(), i.projectID)
-	setFields := i.With(fields...)
-	return setFields.Sugar()
+	var fields []zap.Field
+	// without a span we leave the trace fields out, like every other backend does, an all zero trace id would file
+	// every untraced entry under one bogus trace
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = zapdriver.TraceContext(sc.TraceID().String(), sc.SpanID().String(), sc.IsSampled(), i.projectID)
+	}
+	fields = append(fields, FieldsFromContext(ctx)...)
+	logger := i.Logger
+	if level, ok := LevelFromContext(ctx); ok {
+		logger = logger.WithOptions(withLevel(level))
+	}
+	return logger.With(fields...).Sugar()
 }
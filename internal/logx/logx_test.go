@@ -0,0 +1,49 @@
+package logx
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"testing"
+)
+
+// tracedContext carries a sampled span context, what otelhttp leaves in the context of a traced request
+func tracedContext() context.Context {
+	traceID, _ := trace.TraceIDFromHex("105445aa7843bc8bf206b120001000ab")
+	spanID, _ := trace.SpanIDFromHex("0000000000000001")
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+}
+
+func BenchmarkWrapTraceContext(b *testing.B) {
+	logger := NewWriterLogger("my-project", ioutil.Discard)
+	contexts := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{name: "untraced", ctx: context.Background()},
+		{name: "traced", ctx: tracedContext()},
+		{name: "traced_with_fields", ctx: ContextWithFields(tracedContext(), zap.String("tenant", "acme"))},
+	}
+	for _, bm := range contexts {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.WrapTraceContext(bm.ctx)
+			}
+		})
+	}
+
+	// a request logging a line, wrapping included
+	b.Run("traced_info", func(b *testing.B) {
+		ctx := tracedContext()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.WrapTraceContext(ctx).Infow("hello", "user", "abc")
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package lro
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// operationDoc is how an operation is stored, a firestore ttl policy on expires deletes old operations
+type operationDoc struct {
+	Kind            string            `firestore:"kind"`
+	State           string            `firestore:"state"`
+	Done            bool              `firestore:"done"`
+	Progress        int               `firestore:"progress"`
+	Request         []byte            `firestore:"request,omitempty"`
+	Result          []byte            `firestore:"result,omitempty"`
+	ErrorCode       string            `firestore:"error_code,omitempty"`
+	ErrorMessage    string            `firestore:"error_message,omitempty"`
+	CancelRequested bool              `firestore:"cancel_requested"`
+	Attempts        int               `firestore:"attempts"`
+	Trace           map[string]string `firestore:"trace,omitempty"`
+	Created         time.Time         `firestore:"created"`
+	Updated         time.Time         `firestore:"updated"`
+	Expires         time.Time         `firestore:"expires"`
+}
+
+type firestoreStore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+	ttl        time.Duration
+}
+
+// Firestore stores a document per operation in collection, kept for ttl after it was created. set a ttl policy on
+// its expires field for firestore to delete them
+func Firestore(client *firestore.Client, collection string, ttl time.Duration) Store {
+	return &firestoreStore{client: client, collection: client.Collection(collection), ttl: ttl}
+}
+
+func (f *firestoreStore) Create(ctx context.Context, op *Operation) error {
+	if _, err := f.collection.Doc(op.ID).Create(ctx, f.toDoc(op)); err != nil {
+		return fmt.Errorf("Create(): %v", err)
+	}
+	return nil
+}
+
+func (f *firestoreStore) Get(ctx context.Context, id string) (*Operation, error) {
+	snapshot, err := f.collection.Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Get(): %v", err)
+	}
+	return fromSnapshot(snapshot)
+}
+
+func (f *firestoreStore) Update(ctx context.Context, id string, fn func(op *Operation) error) (*Operation, error) {
+	ref := f.collection.Doc(id)
+	var updated *Operation
+	err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("tx.Get(): %v", err)
+		}
+		op, err := fromSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		if err := fn(op); err != nil {
+			return err
+		}
+		updated = op
+		return tx.Set(ref, f.toDoc(op))
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("f.client.RunTransaction(): %v", err)
+	}
+	return updated, nil
+}
+
+func (f *firestoreStore) toDoc(op *Operation) *operationDoc {
+	doc := &operationDoc{
+		Kind:            op.Kind,
+		State:           string(op.State),
+		Done:            op.Done,
+		Progress:        op.Progress,
+		Request:         op.Request,
+		Result:          op.Result,
+		CancelRequested: op.CancelRequested,
+		Attempts:        op.Attempts,
+		Trace:           op.Trace,
+		Created:         op.Created,
+		Updated:         op.Updated,
+		Expires:         op.Created.Add(f.ttl),
+	}
+	if op.Error != nil {
+		doc.ErrorCode, doc.ErrorMessage = op.Error.Code, op.Error.Message
+	}
+	return doc
+}
+
+func fromSnapshot(snapshot *firestore.DocumentSnapshot) (*Operation, error) {
+	var doc operationDoc
+	if err := snapshot.DataTo(&doc); err != nil {
+		return nil, fmt.Errorf("snapshot.DataTo(): %v", err)
+	}
+	op := &Operation{
+		ID:              snapshot.Ref.ID,
+		Kind:            doc.Kind,
+		State:           State(doc.State),
+		Done:            doc.Done,
+		Progress:        doc.Progress,
+		Request:         doc.Request,
+		Result:          doc.Result,
+		CancelRequested: doc.CancelRequested,
+		Attempts:        doc.Attempts,
+		Trace:           doc.Trace,
+		Created:         doc.Created,
+		Updated:         doc.Updated,
+	}
+	if doc.ErrorCode != "" {
+		op.Error = &Status{Code: doc.ErrorCode, Message: doc.ErrorMessage}
+	}
+	return op, nil
+}
@@ -0,0 +1,590 @@
+package lro
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/lro"
+
+// ErrNotFound is returned by a Store without the operation asked for
+var ErrNotFound = errors.New("lro: operation not found")
+
+// State is where an operation is in its life, succeeded, failed and cancelled are final
+type State string
+
+const (
+	Pending   State = "pending"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+)
+
+// Status is why an operation failed, Code is the errs kind of its error and Message what a client may see of it
+type Status struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Operation is work that outlives the request that asked for it, clients poll it until it is done
+type Operation struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	State State  `json:"state"`
+	Done  bool   `json:"done"`
+	// Progress is how far the work got in percent, as far as it reports it
+	Progress int `json:"progress"`
+	// Result is what the work returned once it succeeded
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *Status         `json:"error,omitempty"`
+	// CancelRequested is set when a running operation was asked to stop, it is cancelled once its work notices
+	CancelRequested bool      `json:"cancel_requested,omitempty"`
+	Attempts        int       `json:"attempts"`
+	Created         time.Time `json:"created"`
+	Updated         time.Time `json:"updated"`
+
+	// Request is what the work is given, as the creating request passed it
+	Request json.RawMessage `json:"-"`
+	// Trace is the trace context of the creating request, the work continues its trace
+	Trace map[string]string `json:"-"`
+}
+
+// Store keeps our operations somewhere every instance sees them, Update changes one atomically so a cancel and the
+// work finishing don't overwrite each other
+type Store interface {
+	Create(ctx context.Context, op *Operation) error
+	Get(ctx context.Context, id string) (*Operation, error)
+	// Update applies fn to the current operation and stores it, unless fn fails
+	Update(ctx context.Context, id string, fn func(op *Operation) error) (*Operation, error)
+}
+
+// Queue hands an operation to a worker, typically through cloud tasks which retries until the worker succeeds
+type Queue interface {
+	Enqueue(ctx context.Context, id string) error
+}
+
+type memoryStore struct {
+	mu  sync.Mutex
+	ops map[string]*Operation
+}
+
+// NewMemory keeps operations on this instance, only good for local development with a single instance
+func NewMemory() Store {
+	return &memoryStore{ops: map[string]*Operation{}}
+}
+
+func (m *memoryStore) Create(ctx context.Context, op *Operation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *op
+	m.ops[op.ID] = &copied
+	return nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, id string) (*Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *op
+	return &copied, nil
+}
+
+func (m *memoryStore) Update(ctx context.Context, id string, fn func(op *Operation) error) (*Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *op
+	if err := fn(&copied); err != nil {
+		return nil, err
+	}
+	m.ops[id] = &copied
+	updated := copied
+	return &updated, nil
+}
+
+// Func does the work of an operation, what it returns becomes the result. errors of kind errs.Unavailable or
+// errs.DeadlineExceeded leave the operation pending for the queue to retry, any other error fails it for good
+type Func func(ctx context.Context, run *Run) (interface{}, error)
+
+// Run is the operation a Func works on
+type Run struct {
+	Operation *Operation
+	manager   *Manager
+}
+
+// Decode decodes the request the operation was started with into v
+func (r *Run) Decode(v interface{}) error {
+	if err := json.Unmarshal(r.Operation.Request, v); err != nil {
+		return errs.Wrapf(err, errs.InvalidArgument, "json.Unmarshal()")
+	}
+	return nil
+}
+
+// Progress records how far the work got, in percent, for clients polling the operation
+func (r *Run) Progress(ctx context.Context, percent int) error {
+	_, err := r.manager.store.Update(ctx, r.Operation.ID, func(op *Operation) error {
+		op.Progress = percent
+		op.Updated = r.manager.now().UTC()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("store.Update(): %v", err)
+	}
+	r.Operation.Progress = percent
+	return nil
+}
+
+// Manager starts operations, runs their work once the queue delivers them and serves them to clients polling them.
+// the request starting an operation answers as soon as it is stored and queued, the work then has the dispatch
+// deadline of its task rather than the timeout of that request, up to 30 minutes with cloud tasks
+type Manager struct {
+	store         Store
+	queue         Queue
+	logger        *zap.SugaredLogger
+	now           func() time.Time
+	newID         func() (string, error)
+	maxRetryAfter time.Duration
+	cancelPoll    time.Duration
+
+	mu    sync.Mutex
+	funcs map[string]Func
+
+	operations metric.Int64Counter
+}
+
+type Option func(m *Manager)
+
+// WithLogger logs operations failing and bookkeeping we couldn't do
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(m *Manager) {
+		m.logger = logger
+	}
+}
+
+// WithMaxRetryAfter caps the Retry-After we hint to clients polling an operation, defaults to 30 seconds. the hint
+// grows with the age of the operation, a young one is polled every second and an old one every d
+func WithMaxRetryAfter(d time.Duration) Option {
+	return func(m *Manager) {
+		m.maxRetryAfter = d
+	}
+}
+
+// WithCancelPoll checks a running operation for a cancel every d, defaults to 5 seconds
+func WithCancelPoll(d time.Duration) Option {
+	return func(m *Manager) {
+		m.cancelPoll = d
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through retry hints
+func WithClock(now func() time.Time) Option {
+	return func(m *Manager) {
+		m.now = now
+	}
+}
+
+// WithIDs replaces the random ids of our operations, for tests comparing whole operations. ids have to stay
+// unguessable in production, a client can only poll the operations it was told about
+func WithIDs(newID func() (string, error)) Option {
+	return func(m *Manager) {
+		m.newID = newID
+	}
+}
+
+func New(store Store, queue Queue, opts ...Option) *Manager {
+	m := &Manager{
+		store:         store,
+		queue:         queue,
+		logger:        zap.NewNop().Sugar(),
+		now:           time.Now,
+		newID:         randomID,
+		maxRetryAfter: 30 * time.Second,
+		cancelPoll:    5 * time.Second,
+		funcs:         map[string]Func{},
+		operations: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("lro.operations",
+			metric.WithDescription("operations by kind and the state they moved to")),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// randomID is our default operation id, random so a client can only poll the operations it was told about
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("io.ReadFull(): %v", err)
+	}
+	return "op-" + hex.EncodeToString(b), nil
+}
+
+// Register has fn do the work of operations of kind
+func (m *Manager) Register(kind string, fn Func) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.funcs[kind] = fn
+}
+
+// Start stores an operation of kind for request and queues it, the operation it returns is pending
+func (m *Manager) Start(ctx context.Context, kind string, request interface{}) (*Operation, error) {
+	m.mu.Lock()
+	_, ok := m.funcs[kind]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no work registered for %s operations", kind)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal(): %v", err)
+	}
+	id, err := m.newID()
+	if err != nil {
+		return nil, fmt.Errorf("m.newID(): %v", err)
+	}
+	now := m.now().UTC()
+	op := &Operation{
+		ID:      id,
+		Kind:    kind,
+		State:   Pending,
+		Created: now,
+		Updated: now,
+		Request: body,
+		Trace:   map[string]string{},
+	}
+	otel.GetTextMapPropagator().Inject(ctx, traceCarrier(op.Trace))
+	if err := m.store.Create(ctx, op); err != nil {
+		return nil, fmt.Errorf("m.store.Create(): %v", err)
+	}
+	if err := m.queue.Enqueue(ctx, op.ID); err != nil {
+		// nothing will ever run it, don't leave it pending for clients to poll forever
+		if _, failErr := m.finish(ctxutil.Detach(ctx), op.ID, Failed, nil, &Status{Code: errs.Unavailable.String(), Message: "the operation couldn't be queued"}); failErr != nil {
+			m.logger.Errorw("m.finish()", "operation", op.ID, "err", failErr)
+		}
+		return nil, fmt.Errorf("m.queue.Enqueue(): %v", err)
+	}
+	m.count(ctx, op.Kind, Pending)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("lro.operation", op.ID))
+	return op, nil
+}
+
+// Get returns operation id
+func (m *Manager) Get(ctx context.Context, id string) (*Operation, error) {
+	op, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// Cancel cancels a pending operation right away and asks a running one to stop, its work sees its context cancelled
+// within a cancel poll. a done operation is returned as it is
+func (m *Manager) Cancel(ctx context.Context, id string) (*Operation, error) {
+	cancelled := false
+	op, err := m.store.Update(ctx, id, func(op *Operation) error {
+		switch {
+		case op.Done:
+		case op.State == Pending:
+			op.State, op.Done, cancelled = Cancelled, true, true
+		default:
+			op.CancelRequested = true
+		}
+		op.Updated = m.now().UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cancelled {
+		m.count(ctx, op.Kind, Cancelled)
+	}
+	return op, nil
+}
+
+// RetryAfter is how long a client should wait before polling op again, a quarter of its age between a second and
+// our max retry after
+func (m *Manager) RetryAfter(op *Operation) time.Duration {
+	wait := m.now().Sub(op.Created) / 4
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > m.maxRetryAfter {
+		wait = m.maxRetryAfter
+	}
+	return wait
+}
+
+// RespondAccepted answers the request that started op with a 202, location is where it is polled
+func (m *Manager) RespondAccepted(writer http.ResponseWriter, op *Operation, location string) {
+	writer.Header().Set("Location", location)
+	m.respond(writer, op, http.StatusAccepted)
+}
+
+func (m *Manager) respond(writer http.ResponseWriter, op *Operation, status int) {
+	if !op.Done {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(m.RetryAfter(op).Seconds()))))
+	}
+	httpx.RespondJSON(writer, op, status)
+}
+
+// Handler serves GET .../{id} for polling an operation and POST .../{id}:cancel for cancelling it, mount it under
+// any prefix
+func (m *Manager) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		id := path.Base(request.URL.Path)
+		var op *Operation
+		var err error
+		switch {
+		case request.Method == http.MethodGet:
+			op, err = m.Get(ctx, id)
+		case request.Method == http.MethodPost && strings.HasSuffix(id, ":cancel"):
+			op, err = m.Cancel(ctx, strings.TrimSuffix(id, ":cancel"))
+		default:
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "method_not_allowed", Message: "method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, ErrNotFound) {
+			httpx.RespondError(writer, request, errs.New(errs.NotFound, "operation not found"))
+			return
+		}
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "operation %s", id))
+			return
+		}
+		m.respond(writer, op, http.StatusOK)
+	})
+}
+
+// task is the body of what a Queue delivers to Worker
+type task struct {
+	ID string `json:"id"`
+}
+
+// Worker runs the operations our queue delivers, it is the target of their tasks. it answers with a 503 for the queue
+// to retry and with a 200 once there is nothing left to do, whether the work succeeded, failed or was cancelled. a
+// delivery for an operation still running, eg after the instance running it died, runs it again
+func (m *Manager) Worker() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var t task
+		if err := json.NewDecoder(io.LimitReader(request.Body, 64<<10)).Decode(&t); err != nil || t.ID == "" {
+			// a task we can't decode never will be, the queue would retry it until it gives up
+			m.logger.Errorw("dropping undecodable task", "err", err)
+			httpx.RespondJSON(writer, map[string]string{"status": "dropped"}, http.StatusOK)
+			return
+		}
+		status, err := m.run(request.Context(), t.ID)
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "m.run(%s)", t.ID))
+			return
+		}
+		httpx.RespondJSON(writer, map[string]string{"status": status}, http.StatusOK)
+	})
+}
+
+// run runs the work of operation id and returns what became of it, an error is for the queue to retry
+func (m *Manager) run(ctx context.Context, id string) (string, error) {
+	var fn Func
+	op, err := m.store.Update(ctx, id, func(op *Operation) error {
+		if op.Done {
+			return nil
+		}
+		m.mu.Lock()
+		fn = m.funcs[op.Kind]
+		m.mu.Unlock()
+		if fn == nil {
+			return nil
+		}
+		op.State = Running
+		op.Attempts++
+		op.Updated = m.now().UTC()
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrNotFound):
+		m.logger.Warnw("dropping task of unknown operation", "operation", id)
+		return "dropped", nil
+	case err != nil:
+		return "", fmt.Errorf("m.store.Update(): %v", err)
+	case op.Done:
+		return string(op.State), nil
+	case fn == nil:
+		// an old revision may not know a kind a new one started, the queue retries it until one that does runs it
+		return "", fmt.Errorf("no work registered for %s operations", op.Kind)
+	}
+
+	// continue the trace of the request that started the operation, linked to the request of the queue delivering it
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("lro.operation", op.ID),
+			attribute.String("lro.kind", op.Kind),
+			attribute.Int("lro.attempt", op.Attempts),
+		),
+	}
+	if len(op.Trace) > 0 {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}))
+		ctx = otel.GetTextMapPropagator().Extract(ctx, traceCarrier(op.Trace))
+	}
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "lro."+op.Kind, opts...)
+	defer span.End()
+	m.count(ctx, op.Kind, Running)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cancelled := make(chan struct{})
+	go m.watchCancel(runCtx, op.ID, cancel, cancelled)
+	result, err := fn(runCtx, &Run{Operation: op, manager: m})
+	cancel()
+
+	// the request may be done by now, what became of the work still has to be stored
+	settleCtx, settleCancel := context.WithTimeout(ctxutil.Detach(ctx), 10*time.Second)
+	defer settleCancel()
+	if err != nil {
+		// work that finished anyway before noticing its cancel keeps its result
+		select {
+		case <-cancelled:
+			span.SetAttributes(attribute.Bool("lro.cancelled", true))
+			if _, err := m.finish(settleCtx, op.ID, Cancelled, nil, nil); err != nil {
+				return "", err
+			}
+			return string(Cancelled), nil
+		default:
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if kind := errs.KindOf(err); kind == errs.Unavailable || kind == errs.DeadlineExceeded {
+			m.logger.Warnw("operation failed, the queue will retry it", "operation", op.ID, "kind", op.Kind, "err", err)
+			m.release(settleCtx, op.ID)
+			return "", err
+		}
+		m.logger.Errorw("operation failed", "operation", op.ID, "kind", op.Kind, "err", err)
+		if _, err := m.finish(settleCtx, op.ID, Failed, nil, &Status{Code: errs.KindOf(err).String(), Message: errs.Message(err)}); err != nil {
+			return "", err
+		}
+		return string(Failed), nil
+	}
+	value, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal(): %v", err)
+	}
+	if _, err := m.finish(settleCtx, op.ID, Succeeded, value, nil); err != nil {
+		return "", err
+	}
+	return string(Succeeded), nil
+}
+
+// watchCancel cancels a running operation once it was asked to stop, closing cancelled when it does
+func (m *Manager) watchCancel(ctx context.Context, id string, cancel context.CancelFunc, cancelled chan struct{}) {
+	ticker := time.NewTicker(m.cancelPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			op, err := m.store.Get(ctx, id)
+			if err != nil {
+				continue
+			}
+			if op.CancelRequested {
+				close(cancelled)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// finish moves operation id to a final state, unless it already is in one
+func (m *Manager) finish(ctx context.Context, id string, state State, result json.RawMessage, status *Status) (*Operation, error) {
+	moved := false
+	op, err := m.store.Update(ctx, id, func(op *Operation) error {
+		if op.Done {
+			return nil
+		}
+		op.State, op.Done, op.Result, op.Error, moved = state, true, result, status, true
+		if state == Succeeded {
+			op.Progress = 100
+		}
+		op.Updated = m.now().UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("m.store.Update(): %v", err)
+	}
+	if moved {
+		m.count(ctx, op.Kind, state)
+	}
+	return op, nil
+}
+
+// release puts a running operation back to pending for the queue to retry, a cancel asked for meanwhile wins
+func (m *Manager) release(ctx context.Context, id string) {
+	_, err := m.store.Update(ctx, id, func(op *Operation) error {
+		if op.Done {
+			return nil
+		}
+		op.State = Pending
+		if op.CancelRequested {
+			op.State, op.Done = Cancelled, true
+		}
+		op.Updated = m.now().UTC()
+		return nil
+	})
+	if err != nil {
+		m.logger.Errorw("m.store.Update()", "operation", id, "err", err)
+	}
+}
+
+func (m *Manager) count(ctx context.Context, kind string, state State) {
+	m.operations.Add(ctx, 1, attribute.String("kind", kind), attribute.String("state", string(state)))
+}
+
+// traceCarrier reads and writes the trace context of an operation
+type traceCarrier map[string]string
+
+func (c traceCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c traceCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c traceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
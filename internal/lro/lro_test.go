@@ -0,0 +1,55 @@
+package lro
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// recordingQueue remembers what it was asked to enqueue
+type recordingQueue struct {
+	ids []string
+}
+
+func (q *recordingQueue) Enqueue(ctx context.Context, id string) error {
+	q.ids = append(q.ids, id)
+	return nil
+}
+
+func TestStartWithInjectedIDsAndClock(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	queue := &recordingQueue{}
+	m := New(NewMemory(), queue,
+		WithClock(func() time.Time { return now }),
+		WithIDs(func() (string, error) { return "op-fixed", nil }),
+	)
+	m.Register("export", func(ctx context.Context, run *Run) (interface{}, error) { return nil, nil })
+
+	op, err := m.Start(context.Background(), "export", map[string]string{"format": "csv"})
+	if err != nil {
+		t.Fatalf("m.Start(): %v", err)
+	}
+	got, err := json.Marshal(op)
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+	want := `{"id":"op-fixed","kind":"export","state":"pending","done":false,"progress":0,"attempts":0,"created":"2021-06-01T12:00:00Z","updated":"2021-06-01T12:00:00Z"}`
+	if string(got) != want {
+		t.Errorf("m.Start() = %s\nwant %s", got, want)
+	}
+	if len(queue.ids) != 1 || queue.ids[0] != "op-fixed" {
+		t.Errorf("queued %v, want [op-fixed]", queue.ids)
+	}
+}
+
+func TestRandomID(t *testing.T) {
+	a, err := randomID()
+	if err != nil {
+		t.Fatalf("randomID(): %v", err)
+	}
+	b, _ := randomID()
+	if a == b || len(a) != len("op-")+32 {
+		t.Errorf("randomID() = %q then %q, want two different op- ids of 32 hex characters", a, b)
+	}
+}
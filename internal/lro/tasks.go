@@ -0,0 +1,78 @@
+package lro
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/googleapi"
+	"net/http"
+)
+
+type tasksQueue struct {
+	tasks          *cloudtasks.ProjectsLocationsQueuesTasksService
+	queue          string
+	target         string
+	serviceAccount string
+	retry          retry.Policy
+}
+
+type TasksOption func(q *tasksQueue)
+
+// WithEnqueueRetry creates a task that failed to be created again by p, defaults to retry.Default. tasks are named
+// after their operation, creating one that was created after all is a 409 we take as queued, so retrying is safe
+func WithEnqueueRetry(p retry.Policy) TasksOption {
+	return func(q *tasksQueue) {
+		q.retry = p
+	}
+}
+
+// CloudTasks queues operations on queue, projects/<project>/locations/<region>/queues/<queue>. each task calls target,
+// the full url Manager.Worker is served on, with an identity token of serviceAccount minted for target
+func CloudTasks(ctx context.Context, queue, target, serviceAccount string, opts ...TasksOption) (Queue, error) {
+	svc, err := cloudtasks.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cloudtasks.NewService(): %v", err)
+	}
+	q := &tasksQueue{tasks: svc.Projects.Locations.Queues.Tasks, queue: queue, target: target, serviceAccount: serviceAccount, retry: retry.Default()}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q, nil
+}
+
+// Enqueue names the task after the operation, cloud tasks rejects a name it has seen with a 409 which we take as
+// queued
+func (q *tasksQueue) Enqueue(ctx context.Context, id string) error {
+	body, err := json.Marshal(&task{ID: id})
+	if err != nil {
+		return fmt.Errorf("json.Marshal(): %v", err)
+	}
+	t := &cloudtasks.Task{
+		Name: q.queue + "/tasks/" + id,
+		// the longest cloud tasks waits on an http target, work running longer is retried while it still runs
+		DispatchDeadline: "1800s",
+		HttpRequest: &cloudtasks.HttpRequest{
+			HttpMethod: http.MethodPost,
+			Url:        q.target,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       base64.StdEncoding.EncodeToString(body),
+			OidcToken:  &cloudtasks.OidcToken{ServiceAccountEmail: q.serviceAccount, Audience: q.target},
+		},
+	}
+	err = q.retry.Do(ctx, "tasks.enqueue", func(ctx context.Context) error {
+		_, err := q.tasks.Create(q.queue, &cloudtasks.CreateTaskRequest{Task: t}).Context(ctx).Do()
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("tasks.Create(): %v", err)
+	}
+	return nil
+}
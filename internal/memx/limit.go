@@ -0,0 +1,11 @@
+//go:build go1.19
+// +build go1.19
+
+package memx
+
+import "runtime/debug"
+
+func setMemoryLimit(bytes int64) bool {
+	debug.SetMemoryLimit(bytes)
+	return true
+}
@@ -0,0 +1,185 @@
+package memx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/limits"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/memx"
+
+const (
+	// minHeadroom is left outside our soft limit whatever the headroom fraction, goroutine stacks, cgo and the
+	// runtime itself live there
+	minHeadroom = 32 << 20
+)
+
+var (
+	// ballast is never touched so the os never backs it with memory, it only raises the heap size the gc paces against
+	ballast []byte
+
+	registerOnce sync.Once
+)
+
+// Tuning is what Tune found and changed
+type Tuning struct {
+	// ContainerLimit is our memory limit in bytes, 0 if we couldn't find one
+	ContainerLimit int64
+	// Source says where ContainerLimit came from, "option", "cgroup v2" or "cgroup v1"
+	Source string
+	// MemoryLimit is the soft limit handed to the gc, 0 if we didn't set one
+	MemoryLimit int64
+	// GOGC is the gc percent we set, 0 if we left it alone
+	GOGC int
+	// Ballast is the size of our ballast in bytes
+	Ballast int64
+}
+
+// Mode names the tuning for our metric labels, so gc behaviour can be compared before and after turning it on
+func (t *Tuning) Mode() string {
+	switch {
+	case t.MemoryLimit > 0:
+		return "memory_limit"
+	case t.Ballast > 0:
+		return "ballast"
+	case t.GOGC > 0:
+		return "gogc"
+	}
+	return "untuned"
+}
+
+type config struct {
+	limit    int64
+	headroom float64
+	gogc     int
+	ballast  float64
+}
+
+type Option func(c *config)
+
+// WithContainerLimit skips detecting our memory limit, eg when it is passed in through config
+func WithContainerLimit(bytes int64) Option {
+	return func(c *config) {
+		c.limit = bytes
+	}
+}
+
+// WithHeadroom keeps fraction of the container limit out of the gc soft limit, defaults to 10% and never less
+// than 32MiB
+func WithHeadroom(fraction float64) Option {
+	return func(c *config) {
+		c.headroom = fraction
+	}
+}
+
+// WithGOGC sets the gc percent unless the GOGC env variable is set. with a soft limit in place a higher value, eg 200,
+// trades memory we were never going to use for fewer collections
+func WithGOGC(percent int) Option {
+	return func(c *config) {
+		c.gogc = percent
+	}
+}
+
+// WithBallast allocates fraction of the container limit as ballast. only worth it without a soft limit, which needs
+// go1.19, the gc then runs as if the heap was that much bigger
+func WithBallast(fraction float64) Option {
+	return func(c *config) {
+		c.ballast = fraction
+	}
+}
+
+// Tune sizes the gc to our container. cloud run kills an instance that goes over its memory limit, while the default
+// gc pacing only looks at the live heap, so a 256MiB instance can either collect constantly or run out of memory. call
+// it once from main before doing any real work
+func Tune(logger *zap.SugaredLogger, opts ...Option) (*Tuning, error) {
+	c := &config{headroom: 0.1}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	t := &Tuning{ContainerLimit: c.limit, Source: "option"}
+	if t.ContainerLimit <= 0 {
+		t.ContainerLimit, t.Source = limits.CgroupMemory()
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	if t.ContainerLimit > 0 {
+		headroom := int64(float64(t.ContainerLimit) * c.headroom)
+		if headroom < minHeadroom {
+			headroom = minHeadroom
+		}
+		// an explicit GOMEMLIMIT has already been applied by the runtime
+		if soft := t.ContainerLimit - headroom; soft > 0 && os.Getenv("GOMEMLIMIT") == "" && setMemoryLimit(soft) {
+			t.MemoryLimit = soft
+		}
+		if c.ballast > 0 {
+			t.Ballast = int64(float64(t.ContainerLimit) * c.ballast)
+			ballast = make([]byte, t.Ballast)
+		}
+	}
+	if c.gogc > 0 && os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(c.gogc)
+		t.GOGC = c.gogc
+	}
+
+	var err error
+	registerOnce.Do(func() {
+		err = registerMetrics(attribute.String("mode", t.Mode()))
+	})
+
+	logger.Infow("memx tuned the gc",
+		"mode", t.Mode(),
+		"container_limit_bytes", t.ContainerLimit,
+		"limit_source", t.Source,
+		"memory_limit_bytes", t.MemoryLimit,
+		"gogc", t.GOGC,
+		"ballast_bytes", t.Ballast,
+		"gcs_before", before.NumGC,
+		"heap_alloc_before_bytes", before.HeapAlloc,
+	)
+	return t, err
+}
+
+// registerMetrics observes the gc from the runtime stats, labelled with our tuning mode
+func registerMetrics(labels ...attribute.KeyValue) error {
+	meter := global.Meter(instrumentationName)
+	var (
+		heap, goal, gcs, pauses metric.Int64ValueObserver
+		cpu                     metric.Float64ValueObserver
+	)
+	batch := meter.NewBatchObserver(func(ctx context.Context, result metric.BatchObserverResult) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		result.Observe(labels,
+			heap.Observation(int64(mem.HeapAlloc)),
+			goal.Observation(int64(mem.NextGC)),
+			gcs.Observation(int64(mem.NumGC)),
+			pauses.Observation(int64(mem.PauseTotalNs)),
+			cpu.Observation(mem.GCCPUFraction),
+		)
+	})
+	var err error
+	if heap, err = batch.NewInt64ValueObserver("memx.heap.alloc", metric.WithDescription("bytes of allocated heap objects"), metric.WithUnit("By")); err != nil {
+		return err
+	}
+	if goal, err = batch.NewInt64ValueObserver("memx.heap.goal", metric.WithDescription("heap size the next gc is paced to start at"), metric.WithUnit("By")); err != nil {
+		return err
+	}
+	if gcs, err = batch.NewInt64ValueObserver("memx.gc.count", metric.WithDescription("completed gc cycles since process start")); err != nil {
+		return err
+	}
+	if pauses, err = batch.NewInt64ValueObserver("memx.gc.pause_total", metric.WithDescription("stop the world pause time since process start"), metric.WithUnit("ns")); err != nil {
+		return err
+	}
+	cpu, err = batch.NewFloat64ValueObserver("memx.gc.cpu_fraction", metric.WithDescription("fraction of cpu time spent in the gc since process start"))
+	return err
+}
@@ -0,0 +1,128 @@
+package metadatax
+
+import (
+	"cloud.google.com/go/compute/metadata"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/metadatax"
+
+// client skips proxies, the metadata server is only reachable directly
+var client = &http.Client{Transport: &http.Transport{Proxy: nil, ResponseHeaderTimeout: 5 * time.Second}}
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]string{}
+)
+
+// OnGCE reports whether we run on gcp, cloud run included. it is cloud.google.com/go/compute/metadata.OnGCE, which
+// probes once and remembers the answer
+func OnGCE() bool {
+	return metadata.OnGCE()
+}
+
+// Get reads path from the metadata server, eg instance/zone. unlike cloud.google.com/go/compute/metadata it gives up
+// once ctx is done, a metadata server that hangs at startup can't keep us from failing fast, and the fetch is spanned.
+// transient failures are retried while ctx allows
+func Get(ctx context.Context, path string) (string, error) {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, "metadatax.Get", trace.WithAttributes(attribute.String("path", path)))
+	defer span.End()
+
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "169.254.169.254"
+	}
+	url := "http://" + host + "/computeMetadata/v1/" + strings.TrimPrefix(path, "/")
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		value, retry, err := get(ctx, url)
+		if err == nil {
+			return value, nil
+		}
+		if !retry || attempt == 5 {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return "", fmt.Errorf("metadata %s: %v", path, err)
+		}
+		select {
+		case <-ctx.Done():
+			span.RecordError(ctx.Err())
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return "", fmt.Errorf("metadata %s: %v", path, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// get fetches url once, retry says whether another attempt could go differently
+func get(ctx context.Context, url string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", ctx.Err() == nil, fmt.Errorf("client.Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", ctx.Err() == nil, fmt.Errorf("ioutil.ReadAll(): %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("%s", resp.Status)
+	}
+	return strings.TrimSpace(string(body)), false, nil
+}
+
+// cached is Get for paths whose value never changes during the life of an instance
+func cached(ctx context.Context, path string) (string, error) {
+	cacheMu.Lock()
+	value, ok := cache[path]
+	cacheMu.Unlock()
+	if ok {
+		return value, nil
+	}
+	value, err := Get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	cacheMu.Lock()
+	cache[path] = value
+	cacheMu.Unlock()
+	return value, nil
+}
+
+// ProjectID is the id of the project we run in
+func ProjectID(ctx context.Context) (string, error) {
+	return cached(ctx, "project/project-id")
+}
+
+// InstanceID is the id of the instance we run on, every cloud run instance has its own
+func InstanceID(ctx context.Context) (string, error) {
+	return cached(ctx, "instance/id")
+}
+
+// Region is the short name of the region we run in, eg us-central1. only cloud run serves it
+func Region(ctx context.Context) (string, error) {
+	region, err := cached(ctx, "instance/region")
+	if err != nil {
+		return "", err
+	}
+	// it comes back as projects/<number>/regions/<region>
+	return region[strings.LastIndex(region, "/")+1:], nil
+}
@@ -0,0 +1,355 @@
+package metering
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/revisionx"
+	"github.com/amammay/effectivecloudrun/internal/tenantx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/metering"
+
+var (
+	// ErrClosed is returned when recording to a meter that has been closed
+	ErrClosed = errors.New("metering: meter is closed")
+	// ErrBacklog is returned when too many events are waiting to be exported, the event is dropped
+	ErrBacklog = errors.New("metering: too many pending events")
+)
+
+// Event is a unit of usage by a caller, one row of a billing export. its json tags are the columns of the bigquery
+// table and the fields of the pub/sub message
+type Event struct {
+	// ID is random, it lets whoever bills drop an event exported twice by a retry
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Caller   string    `json:"caller"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Route    string    `json:"route"`
+	Method   string    `json:"method,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Units    int64     `json:"units"`
+	Revision string    `json:"revision,omitempty"`
+}
+
+// Sink exports a batch of events, its signature matches bqx.InsertSink so records are always *Event. a batch that
+// fails is exported again with the next one
+type Sink func(ctx context.Context, records []interface{}) error
+
+// usage is what a request carries for its handler to add units to
+type usage struct {
+	units int64
+}
+
+var usageKey = ctxval.New("metering.units", ctxval.WithFormat(func(v interface{}) string {
+	return strconv.FormatInt(atomic.LoadInt64(&v.(*usage).units), 10)
+}))
+
+// AddUnits adds n units to the usage of the request of ctx, for handlers whose requests aren't all worth the same, eg
+// a note per note imported. it does nothing outside of Meter.Middleware
+func AddUnits(ctx context.Context, n int64) {
+	if v, ok := usageKey.Value(ctx); ok {
+		atomic.AddInt64(&v.(*usage).units, n)
+	}
+}
+
+// Meter records usage events and exports them in batches in the background, so a request doesn't wait on the
+// export. events are exported once enough of them pile up, on a timer, and when the instance shuts down. an event is
+// lost when its instance dies before exporting it or more than WithMaxPending events are waiting
+type Meter struct {
+	sink          Sink
+	name          string
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+	flushTimeout  time.Duration
+	route         func(request *http.Request) string
+	logger        *zap.SugaredLogger
+	now           func() time.Time
+
+	mu      sync.Mutex
+	pending []interface{}
+	closed  bool
+	// flushing keeps a background flush and Close from exporting the same events side by side
+	flushing sync.Mutex
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	events metric.Int64Counter
+	units  metric.Int64Counter
+}
+
+type Option func(m *Meter)
+
+// WithName labels our metrics and logs, eg with the sink, defaults to default
+func WithName(name string) Option {
+	return func(m *Meter) {
+		m.name = name
+	}
+}
+
+// WithBatchSize exports once n events are pending, defaults to 500, the most bigquery recommends per insert
+func WithBatchSize(n int) Option {
+	return func(m *Meter) {
+		m.batchSize = n
+	}
+}
+
+// WithFlushInterval exports whatever is pending every d, defaults to 10 seconds
+func WithFlushInterval(d time.Duration) Option {
+	return func(m *Meter) {
+		m.flushInterval = d
+	}
+}
+
+// WithFlushTimeout bounds each export in the background, defaults to 30 seconds. a sink that hangs fails the export,
+// its events are kept for the next one
+func WithFlushTimeout(d time.Duration) Option {
+	return func(m *Meter) {
+		m.flushTimeout = d
+	}
+}
+
+// WithMaxPending bounds how many events can wait in memory, including ones whose export failed, defaults to 20
+// batches worth
+func WithMaxPending(n int) Option {
+	return func(m *Meter) {
+		m.maxPending = n
+	}
+}
+
+// WithRoute names the route of a request in its events, eg the path template of the router, defaults to its path
+func WithRoute(route func(request *http.Request) string) Option {
+	return func(m *Meter) {
+		m.route = route
+	}
+}
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(m *Meter) {
+		m.logger = logger
+	}
+}
+
+// New exports the events recorded to sink, see PubSub and BigQuery
+func New(sink Sink, opts ...Option) (*Meter, error) {
+	m := &Meter{
+		sink:          sink,
+		name:          "default",
+		batchSize:     500,
+		flushInterval: 10 * time.Second,
+		flushTimeout:  30 * time.Second,
+		route: func(request *http.Request) string {
+			return request.URL.Path
+		},
+		logger: zap.NewNop().Sugar(),
+		now:    time.Now,
+		full:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.batchSize <= 0 {
+		m.batchSize = 500
+	}
+	if m.maxPending <= 0 {
+		m.maxPending = 20 * m.batchSize
+	}
+
+	meter := global.Meter(instrumentationName)
+	var err error
+	if m.events, err = meter.NewInt64Counter("metering.events", metric.WithDescription("usage events by outcome, exported, failed or dropped")); err != nil {
+		return nil, fmt.Errorf("meter.NewInt64Counter(): %v", err)
+	}
+	if m.units, err = meter.NewInt64Counter("metering.units", metric.WithDescription("units of usage recorded by route")); err != nil {
+		return nil, fmt.Errorf("meter.NewInt64Counter(): %v", err)
+	}
+
+	go m.loop()
+	return m, nil
+}
+
+// Record queues event for export, filling in its id and time when they are empty
+func (m *Meter) Record(ctx context.Context, event Event) error {
+	if event.ID == "" {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return fmt.Errorf("io.ReadFull(): %v", err)
+		}
+		event.ID = hex.EncodeToString(b)
+	}
+	if event.Time.IsZero() {
+		event.Time = m.now().UTC()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if len(m.pending) >= m.maxPending {
+		m.events.Add(ctx, 1, attribute.String("meter", m.name), attribute.String("outcome", "dropped"))
+		return ErrBacklog
+	}
+	m.pending = append(m.pending, &event)
+	m.units.Add(ctx, event.Units, attribute.String("meter", m.name), attribute.String("route", event.Route))
+	if len(m.pending) >= m.batchSize {
+		select {
+		case m.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Middleware records an event for every request with a caller, worth a unit unless its handler adds units of its own
+// with AddUnits. requests caller returns nothing for aren't metered, eg ones that failed authentication. requests
+// answered with a 5xx aren't metered either, nobody pays for our outages
+func (m *Meter) Middleware(caller func(request *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			c := caller(request)
+			if c == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			u := &usage{}
+			ctx := usageKey.With(request.Context(), u)
+			wrapped, rec := httpx.Record(writer, 0)
+			request = request.WithContext(ctx)
+			next.ServeHTTP(wrapped, request)
+			if rec.Status >= http.StatusInternalServerError {
+				return
+			}
+
+			units := atomic.LoadInt64(&u.units)
+			if units == 0 {
+				units = 1
+			}
+			tenant, _ := tenantx.FromContext(ctx)
+			err := m.Record(ctx, Event{
+				Caller:   c,
+				Tenant:   tenant,
+				Route:    m.route(request),
+				Method:   request.Method,
+				Status:   rec.Status,
+				Units:    units,
+				Revision: revisionx.Revision(),
+			})
+			if err != nil {
+				m.logger.Warnw("metering a request", "meter", m.name, "caller", c, "err", err)
+			}
+		})
+	}
+}
+
+func (m *Meter) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.full:
+		case <-m.stop:
+			return
+		}
+		m.flushInBackground()
+	}
+}
+
+// flushInBackground runs a bounded export for loop
+func (m *Meter) flushInBackground() {
+	// background exports aren't tied to any request, Close picks up anything left when we are told to stop
+	ctx, cancel := context.WithTimeout(context.Background(), m.flushTimeout)
+	defer cancel()
+	if err := m.Flush(ctx); err != nil {
+		m.logger.Errorw("exporting usage events failed, keeping them for the next export", "meter", m.name, "err", err)
+	}
+}
+
+// Flush exports every pending event in batches of at most batchSize. a batch that fails goes back in front of the
+// pending events, as far as WithMaxPending leaves room for it, and Flush stops there
+func (m *Meter) Flush(ctx context.Context) error {
+	m.flushing.Lock()
+	defer m.flushing.Unlock()
+	for {
+		m.mu.Lock()
+		n := len(m.pending)
+		if n > m.batchSize {
+			n = m.batchSize
+		}
+		batch := m.pending[:n:n]
+		// what is left moves to a new array, re-slicing would keep the whole backlog we exported reachable
+		m.pending = append([]interface{}(nil), m.pending[n:]...)
+		m.mu.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+		if err := m.sink(ctx, batch); err != nil {
+			m.events.Add(ctx, int64(n), attribute.String("meter", m.name), attribute.String("outcome", "failed"))
+			m.requeue(ctx, batch)
+			return fmt.Errorf("metering %s: exporting %d events: %w", m.name, n, err)
+		}
+		m.events.Add(ctx, int64(n), attribute.String("meter", m.name), attribute.String("outcome", "exported"))
+	}
+}
+
+// requeue puts a batch that failed back in front of the pending events, dropping its newest events beyond maxPending
+func (m *Meter) requeue(ctx context.Context, batch []interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room := m.maxPending - len(m.pending)
+	if room < 0 {
+		room = 0
+	}
+	if len(batch) > room {
+		m.events.Add(ctx, int64(len(batch)-room), attribute.String("meter", m.name), attribute.String("outcome", "dropped"))
+		batch = batch[:room]
+	}
+	m.pending = append(batch, m.pending...)
+}
+
+// Close stops accepting events and exports everything still pending, the signature matches serverx.Server.OnShutdown
+// so SIGTERM exports our usage inside cloud run's shutdown window. Close gives up once ctx is done, even while a
+// background export is still running
+func (m *Meter) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	close(m.stop)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return fmt.Errorf("metering %s: close interrupted: %w", m.name, ctx.Err())
+	}
+	if err := m.Flush(ctx); err != nil {
+		return fmt.Errorf("m.Flush(): %v", err)
+	}
+	m.logger.Infow("usage events exported", "meter", m.name)
+	return nil
+}
@@ -0,0 +1,102 @@
+package metering
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBackgroundFlushBounded checks a sink that hangs until its ctx is done can't stall our background exports
+func TestBackgroundFlushBounded(t *testing.T) {
+	exported := make(chan int, 10)
+	hang := true
+	sink := func(ctx context.Context, records []interface{}) error {
+		if hang {
+			hang = false
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		exported <- len(records)
+		return nil
+	}
+	m, err := New(sink, WithFlushInterval(10*time.Millisecond), WithFlushTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	defer m.Close(context.Background())
+
+	if err := m.Record(context.Background(), Event{Caller: "test", Units: 1}); err != nil {
+		t.Fatalf("m.Record(): %v", err)
+	}
+	// the first export times out and the event is kept for the next one
+	select {
+	case n := <-exported:
+		if n != 1 {
+			t.Errorf("exported %d events, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the event was never exported after the sink hung once")
+	}
+}
+
+// TestCloseHonorsContext checks Close returns once its ctx is done while a background export hangs
+func TestCloseHonorsContext(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	sink := func(ctx context.Context, records []interface{}) error {
+		close(started)
+		<-release
+		return nil
+	}
+	m, err := New(sink, WithFlushInterval(time.Millisecond), WithFlushTimeout(time.Hour))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	if err := m.Record(context.Background(), Event{Caller: "test", Units: 1}); err != nil {
+		t.Fatalf("m.Record(): %v", err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("m.Close() = %v, want a deadline exceeded", err)
+	}
+}
+
+func TestFlushReleasesExported(t *testing.T) {
+	var batches [][]interface{}
+	sink := func(ctx context.Context, records []interface{}) error {
+		batches = append(batches, records)
+		return nil
+	}
+	m, err := New(sink, WithBatchSize(2), WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	defer m.Close(context.Background())
+	for i := 0; i < 5; i++ {
+		m.mu.Lock()
+		m.pending = append(m.pending, &Event{Caller: "test", Units: 1})
+		m.mu.Unlock()
+	}
+	if err := m.Flush(context.Background()); err != nil {
+		t.Fatalf("m.Flush(): %v", err)
+	}
+	var sizes []int
+	for _, batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Fatalf("exported batches of %v events, want [2 2 1]", sizes)
+	}
+	// a batch can't reach into the events after it, whoever keeps a batch must not keep the rest of the backlog
+	if cap(batches[0]) != 2 {
+		t.Errorf("the first batch has a capacity of %d, want 2", cap(batches[0]))
+	}
+	if m.pending != nil {
+		t.Errorf("%d events still pending after the flush", len(m.pending))
+	}
+}
@@ -0,0 +1,53 @@
+package metering
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/bqx"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// PubSub publishes every event as a json message on topic, with the caller, tenant and route as attributes for
+// subscriptions to filter on. a batch waits until pub/sub has all of it, an event whose batch failed is published
+// again with its id unchanged, so subscribers dedupe on it
+func PubSub(topic *pubsub.Topic) Sink {
+	return func(ctx context.Context, records []interface{}) error {
+		results := make([]*pubsub.PublishResult, 0, len(records))
+		for _, record := range records {
+			event := record.(*Event)
+			data, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("json.Marshal(): %v", err)
+			}
+			attributes := map[string]string{"event_id": event.ID, "caller": event.Caller, "route": event.Route}
+			if event.Tenant != "" {
+				attributes["tenant"] = event.Tenant
+			}
+			results = append(results, topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}))
+		}
+		var failed int
+		var firstErr error
+		for _, result := range results {
+			if _, err := result.Get(ctx); err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("topic.Publish(%s): %d of %d events failed, the first: %v", topic.ID(), failed, len(results), firstErr)
+		}
+		return nil
+	}
+}
+
+// BigQuery streams events into table, a table whose columns match the json tags of Event. the id of an event is its
+// insert id, bigquery drops an event exported again by a retry within about a minute
+func BigQuery(svc *bigquery.Service, table bqx.Table) Sink {
+	return bqx.InsertSink(svc, table, func(record interface{}) string {
+		return record.(*Event).ID
+	})
+}
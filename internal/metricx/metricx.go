@@ -0,0 +1,117 @@
+package metricx
+
+import (
+	"context"
+	"fmt"
+	mexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Pipeline exports every instrument our packages register on the global meter to cloud monitoring, until it starts
+// they record into a no-op provider. instruments are collected every interval, so whatever was recorded since the last
+// export is lost unless the pipeline is flushed before we exit, at scale in that is the busiest interval we had
+type Pipeline struct {
+	pusher       *controller.Controller
+	flushTimeout time.Duration
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+type config struct {
+	interval     time.Duration
+	flushTimeout time.Duration
+	resource     *resource.Resource
+}
+
+type Option func(c *config)
+
+// WithInterval exports every d, defaults to 60 seconds. cloud monitoring takes a point per time series every 5
+// seconds at most
+func WithInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.interval = d
+	}
+}
+
+// WithFlushTimeout bounds a flush, including the final one as we shut down, defaults to 3 seconds
+func WithFlushTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.flushTimeout = d
+	}
+}
+
+// WithResource attaches res to every exported point, the same resource our spans carry
+func WithResource(res *resource.Resource) Option {
+	return func(c *config) {
+		c.resource = res
+	}
+}
+
+// Start installs our pipeline as the global meter provider and starts exporting, failed exports are logged to logger
+func Start(logger *zap.SugaredLogger, projectID string, opts ...Option) (*Pipeline, error) {
+	c := &config{interval: 60 * time.Second, flushTimeout: 3 * time.Second}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// an export stuck on the api mustn't hold up a flush past its timeout
+	pusher, err := mexporter.InstallNewPipeline([]mexporter.Option{
+		mexporter.WithProjectID(projectID),
+		mexporter.WithInterval(c.interval),
+		mexporter.WithOnError(func(err error) {
+			logger.Warnw("metric export failed", "error", err)
+		}),
+	}, controller.WithPushTimeout(c.flushTimeout), controller.WithResource(c.resource))
+	if err != nil {
+		return nil, fmt.Errorf("mexporter.InstallNewPipeline(): %v", err)
+	}
+	return &Pipeline{pusher: pusher, flushTimeout: c.flushTimeout}, nil
+}
+
+// FlushTimeout is how long a flush may take, for serverx.WithFlush
+func (p *Pipeline) FlushTimeout() time.Duration {
+	return p.flushTimeout
+}
+
+// ForceFlush exports what was recorded since the last export now rather than at the next interval, eg before a job
+// exits. the interval starts over afterwards. series exported less than 5 seconds ago are rejected by cloud monitoring
+// and logged
+func (p *Pipeline) ForceFlush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.flushTimeout)
+	defer cancel()
+	// the controller only collects on its own ticker while it runs, stopping it collects and exports one last time
+	stopErr := p.pusher.Stop(ctx)
+	// the controller runs on until Shutdown, not for as long as ctx
+	if err := p.pusher.Start(context.Background()); err != nil {
+		return fmt.Errorf("pusher.Start(): %v", err)
+	}
+	if stopErr != nil {
+		return fmt.Errorf("pusher.Stop(): %v", stopErr)
+	}
+	return nil
+}
+
+// Shutdown exports one last time and stops, its signature matches serverx.WithFlush
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil
+	}
+	p.stopped = true
+	ctx, cancel := context.WithTimeout(ctx, p.flushTimeout)
+	defer cancel()
+	if err := p.pusher.Stop(ctx); err != nil {
+		return fmt.Errorf("pusher.Stop(): %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package migrate
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/jobx"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"time"
+)
+
+// maxBatchSize is the most writes firestore accepts in a single commit
+const maxBatchSize = 500
+
+// Migration backfills a change to our data model into the documents already stored, eg a field derived from others
+// or a field copied under its new name before code stops reading the old one
+type Migration struct {
+	// ID orders migrations and is what the ledger remembers them by, eg 0001_beers_name_lower. never rename one that ran
+	ID          string
+	Description string
+	// Query is the documents to look at, equality filters only, they are paged through by document id
+	Query func(client *firestore.Client) firestore.Query
+	// Update returns the updates doc needs, none when it needs nothing. a migration that fails part way is run again
+	// from the last batch it committed, so Update has to be idempotent, returning nothing for a document it updated
+	Update func(doc *firestore.DocumentSnapshot) ([]firestore.Update, error)
+}
+
+// Applied is what the ledger keeps about a migration that ran to the end
+type Applied struct {
+	At      time.Time `firestore:"at"`
+	Scanned int       `firestore:"scanned"`
+	Updated int       `firestore:"updated"`
+	TookMS  int64     `firestore:"took_ms"`
+}
+
+// progress is how far a migration that hasn't finished got, saved after every commit
+type progress struct {
+	AfterID string `firestore:"after_id"`
+	Scanned int    `firestore:"scanned"`
+	Updated int    `firestore:"updated"`
+}
+
+// ledger is the document remembering which migrations were applied
+type ledger struct {
+	Applied  map[string]Applied  `firestore:"applied"`
+	Progress map[string]progress `firestore:"progress"`
+}
+
+// Result is what Run did with one migration
+type Result struct {
+	ID      string
+	Scanned int
+	Updated int
+	Took    time.Duration
+	// Resumed is set when an earlier run had committed part of it
+	Resumed bool
+}
+
+// Runner applies the migrations a ledger document doesn't list yet, in order of their ID. run a single Runner at a
+// time, eg from a cloud run job holding a lockx lock, two would update the same documents
+type Runner struct {
+	client     *firestore.Client
+	ledger     *firestore.DocumentRef
+	migrations []Migration
+	batchSize  int
+	dryRun     bool
+	pacer      *jobx.Pacer
+	logger     *zap.SugaredLogger
+}
+
+type Option func(r *Runner)
+
+// WithBatchSize commits at most n updates at a time, defaults to 200, capped at the firestore limit of 500
+func WithBatchSize(n int) Option {
+	return func(r *Runner) {
+		r.batchSize = n
+	}
+}
+
+// WithDryRun has Run count what it would update without writing anything, the ledger included
+func WithDryRun(dryRun bool) Option {
+	return func(r *Runner) {
+		r.dryRun = dryRun
+	}
+}
+
+// WithPacer paces the documents we scan, see jobx.Pacer
+func WithPacer(p *jobx.Pacer) Option {
+	return func(r *Runner) {
+		r.pacer = p
+	}
+}
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(r *Runner) {
+		r.logger = logger
+	}
+}
+
+// New runs migrations against client, remembering them in the document at ledgerPath, eg migrations/ledger
+func New(client *firestore.Client, ledgerPath string, migrations []Migration, opts ...Option) (*Runner, error) {
+	r := &Runner{
+		client:    client,
+		ledger:    client.Doc(ledgerPath),
+		batchSize: 200,
+		logger:    zap.NewNop().Sugar(),
+	}
+	if r.ledger == nil {
+		return nil, fmt.Errorf("migrate: %q is not a document path", ledgerPath)
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.batchSize <= 0 || r.batchSize > maxBatchSize {
+		r.batchSize = maxBatchSize
+	}
+
+	r.migrations = append([]Migration(nil), migrations...)
+	sort.Slice(r.migrations, func(i, j int) bool { return r.migrations[i].ID < r.migrations[j].ID })
+	for i, m := range r.migrations {
+		if m.ID == "" || m.Query == nil || m.Update == nil {
+			return nil, fmt.Errorf("migrate: migration %q needs an ID, a Query and an Update", m.ID)
+		}
+		if i > 0 && r.migrations[i-1].ID == m.ID {
+			return nil, fmt.Errorf("migrate: migration %s is there twice", m.ID)
+		}
+	}
+	return r, nil
+}
+
+// Applied is what the ledger knows about every migration that ran to the end, by ID
+func (r *Runner) Applied(ctx context.Context) (map[string]Applied, error) {
+	l, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return l.Applied, nil
+}
+
+// Pending are the migrations that haven't run to the end, in the order Run applies them
+func (r *Runner) Pending(ctx context.Context) ([]Migration, error) {
+	l, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range r.migrations {
+		if _, ok := l.Applied[m.ID]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+func (r *Runner) load(ctx context.Context) (*ledger, error) {
+	l := &ledger{}
+	snapshot, err := r.ledger.Get(ctx)
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return nil, fmt.Errorf("ledger.Get(): %v", err)
+	default:
+		if err := snapshot.DataTo(l); err != nil {
+			return nil, fmt.Errorf("snapshot.DataTo(): %v", err)
+		}
+	}
+	if l.Applied == nil {
+		l.Applied = map[string]Applied{}
+	}
+	if l.Progress == nil {
+		l.Progress = map[string]progress{}
+	}
+	return l, nil
+}
+
+// Run applies every pending migration in order, stopping at the first that fails. it returns what it did so far
+// either way
+func (r *Runner) Run(ctx context.Context) ([]Result, error) {
+	l, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	for _, m := range r.migrations {
+		if _, ok := l.Applied[m.ID]; ok {
+			continue
+		}
+		p, resumed := l.Progress[m.ID]
+		started := time.Now()
+		r.logger.Infow("applying migration", "migration", m.ID, "description", m.Description, "resumed", resumed, "dry_run", r.dryRun)
+		p, err := r.backfill(ctx, m, p)
+		result := Result{ID: m.ID, Scanned: p.Scanned, Updated: p.Updated, Took: time.Since(started), Resumed: resumed}
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("migration %s: %v", m.ID, err)
+		}
+		if err := r.record(ctx, m.ID, Applied{At: time.Now(), Scanned: p.Scanned, Updated: p.Updated, TookMS: result.Took.Milliseconds()}); err != nil {
+			return results, err
+		}
+		r.logger.Infow("applied migration", "migration", m.ID, "scanned", p.Scanned, "updated", p.Updated, "took", result.Took.String())
+	}
+	return results, nil
+}
+
+// backfill pages through the documents of m after where p left off, committing the updates of each page and saving
+// how far it got
+func (r *Runner) backfill(ctx context.Context, m Migration, p progress) (progress, error) {
+	base := m.Query(r.client).OrderBy(firestore.DocumentID, firestore.Asc)
+	for {
+		if err := r.pacer.Wait(ctx, r.batchSize); err != nil {
+			return p, err
+		}
+		query := base
+		if p.AfterID != "" {
+			query = query.StartAfter(p.AfterID)
+		}
+		page, err := query.Limit(r.batchSize).Documents(ctx).GetAll()
+		if err != nil {
+			return p, fmt.Errorf("query.Documents(): %v", err)
+		}
+		if len(page) == 0 {
+			return p, nil
+		}
+
+		batch := r.client.Batch()
+		updates := 0
+		for _, doc := range page {
+			u, err := m.Update(doc)
+			if err != nil {
+				return p, fmt.Errorf("update(%s): %v", doc.Ref.Path, err)
+			}
+			if len(u) == 0 {
+				continue
+			}
+			// a document changed since we read it fails the commit rather than getting what we derived from its old
+			// version, the retry reads it again
+			batch.Update(doc.Ref, u, firestore.LastUpdateTime(doc.UpdateTime))
+			updates++
+		}
+		if updates > 0 && !r.dryRun {
+			if _, err := batch.Commit(ctx); err != nil {
+				return p, fmt.Errorf("batch.Commit(): %v", err)
+			}
+		}
+
+		p.AfterID = page[len(page)-1].Ref.ID
+		p.Scanned += len(page)
+		p.Updated += updates
+		if err := r.save(ctx, m.ID, p); err != nil {
+			return p, err
+		}
+		r.logger.Infow("migration progress", "migration", m.ID, "scanned", p.Scanned, "updated", p.Updated, "after_id", p.AfterID, "dry_run", r.dryRun)
+	}
+}
+
+// save records how far migration id got, only once what it records was committed
+func (r *Runner) save(ctx context.Context, id string, p progress) error {
+	if r.dryRun {
+		return nil
+	}
+	if _, err := r.ledger.Set(ctx, map[string]interface{}{"progress": map[string]interface{}{id: p}}, firestore.MergeAll); err != nil {
+		return fmt.Errorf("ledger.Set(progress): %v", err)
+	}
+	return nil
+}
+
+// record lists migration id as applied and drops its progress
+func (r *Runner) record(ctx context.Context, id string, applied Applied) error {
+	if r.dryRun {
+		return nil
+	}
+	_, err := r.ledger.Set(ctx, map[string]interface{}{
+		"applied":  map[string]interface{}{id: applied},
+		"progress": map[string]interface{}{id: firestore.Delete},
+	}, firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("ledger.Set(applied): %v", err)
+	}
+	return nil
+}
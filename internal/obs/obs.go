@@ -0,0 +1,205 @@
+package obs
+
+import (
+	"context"
+	"fmt"
+	cloudtrace "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	cloudprop "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/metadatax"
+	"github.com/amammay/effectivecloudrun/internal/metricx"
+	"github.com/amammay/effectivecloudrun/internal/profilex"
+	"github.com/amammay/effectivecloudrun/internal/serverx"
+	"go.opentelemetry.io/otel"
+	prop "go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Config is everything our telemetry needs to know, the zero value of a field picks its default
+type Config struct {
+	// ServiceName names us on every span, metric point and profile
+	ServiceName string
+	// ProjectID is where telemetry goes, read from the metadata server on gcp and mammay-labs elsewhere when empty
+	ProjectID string
+	// Sampler decides which traces are kept, defaults to every trace. requests tracex.Debug forces a trace for are
+	// kept whatever it decides
+	Sampler sdktrace.Sampler
+	// MetricsInterval is how often metrics are exported, defaults to 60 seconds
+	MetricsInterval time.Duration
+	// MetricsFlushTimeout bounds the last export of metrics as we shut down, defaults to 3 seconds
+	MetricsFlushTimeout time.Duration
+	// TracesFlushTimeout bounds sending the spans still batched as we shut down, defaults to 2 seconds
+	TracesFlushTimeout time.Duration
+	// Profile runs a cloud profiler agent, see profilex.Agent for what cloud run needs for it to be useful
+	Profile bool
+}
+
+// Telemetry is our logger along with the trace, metric and profile pipelines behind the otel globals. off of gcp
+// there is nothing to export metrics or profiles to, they stay off
+type Telemetry struct {
+	Logger    *logx.AppLogger
+	ProjectID string
+	OnGCE     bool
+	// Resource identifies us on spans and metric points alike
+	Resource *resource.Resource
+
+	tracer             *sdktrace.TracerProvider
+	tracesFlushTimeout time.Duration
+	metrics            *metricx.Pipeline
+	stopProfiler       context.CancelFunc
+	profilerDone       chan struct{}
+}
+
+type errorProcessing struct {
+	logger *zap.SugaredLogger
+}
+
+func (e *errorProcessing) Handle(err error) {
+	if err != nil {
+		e.logger.Errorw("global otel error detected", "error", err)
+	}
+}
+
+// Init sets up logs, traces, metrics and profiles in one go, replacing four setups in every main. whatever it started
+// is torn down again when it fails, and by Telemetry.Shutdown once we are done
+func Init(ctx context.Context, cfg Config) (*Telemetry, error) {
+	t := &Telemetry{ProjectID: cfg.ProjectID, OnGCE: metadatax.OnGCE(), tracesFlushTimeout: cfg.TracesFlushTimeout}
+	if t.ProjectID == "" {
+		t.ProjectID = "mammay-labs"
+		if t.OnGCE {
+			id, err := metadatax.ProjectID(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("metadatax.ProjectID(): %v", err)
+			}
+			t.ProjectID = id
+		}
+	}
+	if t.tracesFlushTimeout == 0 {
+		t.tracesFlushTimeout = 2 * time.Second
+	}
+
+	var err error
+	if t.Logger, err = logx.NewLogger(t.ProjectID, t.OnGCE); err != nil {
+		return nil, fmt.Errorf("logx.NewLogger(): %v", err)
+	}
+	logger := t.Logger.Sugar()
+	otel.SetErrorHandler(&errorProcessing{logger: logger})
+	t.Resource = resource.NewWithAttributes(semconv.SchemaURL,
+		append(buildinfo.Attributes(), semconv.ServiceNameKey.String(cfg.ServiceName))...,
+	)
+
+	if err := t.initTracing(ctx, cfg.Sampler); err != nil {
+		return nil, err
+	}
+	if t.OnGCE {
+		var opts []metricx.Option
+		if cfg.MetricsInterval != 0 {
+			opts = append(opts, metricx.WithInterval(cfg.MetricsInterval))
+		}
+		if cfg.MetricsFlushTimeout != 0 {
+			opts = append(opts, metricx.WithFlushTimeout(cfg.MetricsFlushTimeout))
+		}
+		if t.metrics, err = metricx.Start(logger, t.ProjectID, append(opts, metricx.WithResource(t.Resource))...); err != nil {
+			t.Shutdown(ctx)
+			return nil, fmt.Errorf("metricx.Start(): %v", err)
+		}
+	}
+	if t.OnGCE && cfg.Profile {
+		agent, err := profilex.New(ctx, t.ProjectID, cfg.ServiceName,
+			profilex.WithVersion(buildinfo.Get().Version),
+			profilex.WithLogger(logger),
+		)
+		if err != nil {
+			t.Shutdown(ctx)
+			return nil, fmt.Errorf("profilex.New(): %v", err)
+		}
+		// profiling runs until Shutdown, ctx only covers setting it up
+		profileCtx, cancel := context.WithCancel(context.Background())
+		t.stopProfiler, t.profilerDone = cancel, make(chan struct{})
+		go func() {
+			defer close(t.profilerDone)
+			agent.Run(profileCtx)
+		}()
+	}
+	return t, nil
+}
+
+// initTracing exports spans to cloud trace and installs our propagators
+func (t *Telemetry) initTracing(ctx context.Context, sampler sdktrace.Sampler) error {
+	otel.SetTextMapPropagator(Propagator())
+	if sampler == nil {
+		sampler = sdktrace.AlwaysSample()
+	}
+
+	exporter, err := cloudtrace.New(cloudtrace.WithProjectID(t.ProjectID), cloudtrace.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cloudtrace.New(): %v", err)
+	}
+	t.tracer = sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(t.Resource),
+	)
+	otel.SetTracerProvider(t.tracer)
+	return nil
+}
+
+// Propagator reads and writes trace context in the headers Init has otel use. the GFE sends X-Cloud-Trace-Context,
+// other services we call into may only understand traceparent
+func Propagator() prop.TextMapPropagator {
+	return prop.NewCompositeTextMapPropagator(
+		cloudprop.CloudTraceFormatPropagator{},
+		prop.TraceContext{},
+		prop.Baggage{},
+	)
+}
+
+// Metrics is our metric pipeline, nil off of gcp
+func (t *Telemetry) Metrics() *metricx.Pipeline {
+	return t.metrics
+}
+
+// ServerOptions has serverx.Server tear our telemetry down last, after every hook so it includes them
+func (t *Telemetry) ServerOptions() []serverx.Option {
+	timeout := t.tracesFlushTimeout + time.Second
+	if t.metrics != nil {
+		timeout += t.metrics.FlushTimeout()
+	}
+	return []serverx.Option{serverx.WithFlush("telemetry", timeout, t.Shutdown)}
+}
+
+// Shutdown stops profiling, exports the last interval of metrics, sends the spans still batched and syncs our logs, in
+// that order so each gets to report on the ones before it. each export gets its own timeout, ctx bounds them all
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	var firstErr error
+	if t.stopProfiler != nil {
+		t.stopProfiler()
+		// a cpu profile being taken stops right away, an upload in flight is cancelled
+		select {
+		case <-t.profilerDone:
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+	if t.metrics != nil {
+		if err := t.metrics.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("metrics.Shutdown(): %v", err)
+		}
+	}
+	if t.tracer != nil {
+		traceCtx, cancel := context.WithTimeout(ctx, t.tracesFlushTimeout)
+		err := t.tracer.Shutdown(traceCtx)
+		cancel()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tracer.Shutdown(): %v", err)
+		}
+	}
+	// syncing stdout fails on most platforms for no reason worth reporting
+	_ = t.Logger.Sync()
+	return firstErr
+}
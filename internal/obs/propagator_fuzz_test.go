@@ -0,0 +1,42 @@
+//go:build go1.18
+// +build go1.18
+
+package obs
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"testing"
+)
+
+// FuzzPropagator feeds the trace headers every request can carry through the propagators we install, a client picks
+// them so they must never panic, and whatever trace they accept has to survive going out to the next service
+func FuzzPropagator(f *testing.F) {
+	f.Add("105445aa7843bc8bf206b120001000ab/1;o=1", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "user=abc")
+	f.Add("105445aa7843bc8bf206b120001000ab", "", "")
+	f.Add("", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "")
+	f.Add("00000000000000000000000000000000/0;o=0", "ff-00000000000000000000000000000000-0000000000000000-ff", "=;,")
+	f.Add("105445aa7843bc8bf206b120001000ab/18446744073709551616;o=9", "00-xyz", "a=%zz")
+	f.Fuzz(func(t *testing.T, cloudTrace, traceparent, baggage string) {
+		incoming := http.Header{}
+		incoming.Set("X-Cloud-Trace-Context", cloudTrace)
+		incoming.Set("Traceparent", traceparent)
+		incoming.Set("Baggage", baggage)
+
+		p := Propagator()
+		ctx := p.Extract(context.Background(), propagation.HeaderCarrier(incoming))
+		sc := trace.SpanContextFromContext(ctx)
+		if !sc.IsValid() {
+			return
+		}
+
+		outgoing := http.Header{}
+		p.Inject(ctx, propagation.HeaderCarrier(outgoing))
+		next := trace.SpanContextFromContext(p.Extract(context.Background(), propagation.HeaderCarrier(outgoing)))
+		if next.TraceID() != sc.TraceID() || next.SpanID() != sc.SpanID() || next.IsSampled() != sc.IsSampled() {
+			t.Fatalf("trace changed on its way out: extracted %v, the next service extracts %v from %v", sc, next, outgoing)
+		}
+	})
+}
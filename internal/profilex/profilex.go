@@ -0,0 +1,137 @@
+package profilex
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"go.uber.org/zap"
+	"google.golang.org/api/cloudprofiler/v2"
+	"runtime/pprof"
+	"time"
+)
+
+// Agent sends profiles to cloud profiler whenever it asks us for one, the protocol the cloud.google.com/go/profiler
+// agent speaks, over the rest api we already depend on. cloud profiler spreads its requests over every instance of a
+// service, each gets asked for a 10 second profile every so often, which costs next to nothing.
+// cloud run only gives us cpu during requests unless the service runs with --no-cpu-throttling, without it profiles
+// taken between requests come back mostly empty
+type Agent struct {
+	profiles   *cloudprofiler.ProjectsProfilesService
+	parent     string
+	deployment *cloudprofiler.Deployment
+	types      []string
+	logger     *zap.SugaredLogger
+}
+
+type Option func(a *Agent)
+
+// WithVersion labels our profiles with version, so profiles of different deploys can be compared
+func WithVersion(version string) Option {
+	return func(a *Agent) {
+		if version != "" {
+			a.deployment.Labels = map[string]string{"version": version}
+		}
+	}
+}
+
+// WithProfileTypes is what cloud profiler may ask us for, defaults to CPU, HEAP and THREADS
+func WithProfileTypes(types ...string) Option {
+	return func(a *Agent) {
+		a.types = types
+	}
+}
+
+// WithLogger logs failed profiles to logger, they are dropped silently otherwise
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(a *Agent) {
+		a.logger = logger
+	}
+}
+
+// New returns an agent profiling us as service in projectID, profiles only start being taken once it runs
+func New(ctx context.Context, projectID, service string, opts ...Option) (*Agent, error) {
+	svc, err := cloudprofiler.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cloudprofiler.NewService(): %v", err)
+	}
+	a := &Agent{
+		profiles:   cloudprofiler.NewProjectsProfilesService(svc),
+		parent:     "projects/" + projectID,
+		deployment: &cloudprofiler.Deployment{ProjectId: projectID, Target: service},
+		types:      []string{"CPU", "HEAP", "THREADS"},
+		logger:     zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+// Run takes the profiles cloud profiler asks for until ctx is done, a profile being taken is cut short then
+func (a *Agent) Run(ctx context.Context) {
+	backoff := time.Minute
+	for ctx.Err() == nil {
+		if err := a.profileOnce(ctx); err != nil && ctx.Err() == nil {
+			a.logger.Warnw("profiling failed", "err", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > time.Hour {
+				backoff = time.Hour
+			}
+			continue
+		}
+		backoff = time.Minute
+	}
+}
+
+// profileOnce waits for cloud profiler to ask for a profile, takes it and uploads it
+func (a *Agent) profileOnce(ctx context.Context) error {
+	// blocks until cloud profiler wants a profile from us, which can take the better part of an hour
+	profile, err := a.profiles.Create(a.parent, &cloudprofiler.CreateProfileRequest{
+		Deployment:  a.deployment,
+		ProfileType: a.types,
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("profiles.Create(): %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := take(ctx, profile, &buf); err != nil {
+		return fmt.Errorf("take(%s): %v", profile.ProfileType, err)
+	}
+	profile.ProfileBytes = base64.StdEncoding.EncodeToString(buf.Bytes())
+	if _, err := a.profiles.Patch(profile.Name, profile).UpdateMask("profileBytes").Context(ctx).Do(); err != nil {
+		return fmt.Errorf("profiles.Patch(): %v", err)
+	}
+	return nil
+}
+
+// take writes the profile cloud profiler asked for to buf, gzipped pprof like it expects
+func take(ctx context.Context, profile *cloudprofiler.Profile, buf *bytes.Buffer) error {
+	switch profile.ProfileType {
+	case "CPU":
+		duration, err := time.ParseDuration(profile.Duration)
+		if err != nil {
+			return fmt.Errorf("time.ParseDuration(%q): %v", profile.Duration, err)
+		}
+		// fails when someone is taking a cpu profile through the admin pprof handlers at the same time
+		if err := pprof.StartCPUProfile(buf); err != nil {
+			return fmt.Errorf("pprof.StartCPUProfile(): %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+		pprof.StopCPUProfile()
+		return nil
+	case "HEAP":
+		return pprof.Lookup("heap").WriteTo(buf, 0)
+	case "THREADS":
+		return pprof.Lookup("goroutine").WriteTo(buf, 0)
+	}
+	return fmt.Errorf("unsupported profile type")
+}
@@ -0,0 +1,32 @@
+package pubsubx
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+)
+
+// Publish publishes message on topic and waits for pub/sub to have it, publishing it again by p while it fails. the
+// client library already retries within the topic's PublishSettings.Timeout, p covers what outlasts that. a failed
+// message pauses its ordering key, the key is resumed before the next attempt. it returns the id pub/sub gave the
+// message
+func Publish(ctx context.Context, topic *pubsub.Topic, message *pubsub.Message, p retry.Policy) (string, error) {
+	var id string
+	err := p.Do(ctx, "pubsub.publish", func(ctx context.Context) error {
+		// a message is sent by the attempt it was given to, every attempt gets its own
+		result := topic.Publish(ctx, &pubsub.Message{Data: message.Data, Attributes: message.Attributes, OrderingKey: message.OrderingKey})
+		var err error
+		if id, err = result.Get(ctx); err != nil {
+			if message.OrderingKey != "" {
+				topic.ResumePublish(message.OrderingKey)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("topic.Publish(%s): %v", topic.ID(), err)
+	}
+	return id, nil
+}
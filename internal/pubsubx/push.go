@@ -0,0 +1,198 @@
+package pubsubx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/pubsubx"
+
+// Message is a pub/sub message as it is delivered to a push endpoint, Data arrives base64 encoded and is decoded for us
+type Message struct {
+	ID          string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes"`
+	Data        []byte            `json:"data"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// PushRequest is the envelope pub/sub posts to a push subscription
+type PushRequest struct {
+	Message      Message `json:"message"`
+	Subscription string  `json:"subscription"`
+	// DeliveryAttempt is only set when the subscription has a dead letter policy
+	DeliveryAttempt int `json:"deliveryAttempt,omitempty"`
+}
+
+// DecodePush reads and validates a push envelope, anything malformed is an errs.InvalidArgument
+func DecodePush(r *http.Request, maxBytes int64) (*PushRequest, error) {
+	if r.Method != http.MethodPost {
+		return nil, errs.New(errs.InvalidArgument, "push requests are POST")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, errs.Wrapf(err, errs.InvalidArgument, "ioutil.ReadAll()")
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, errs.New(errs.InvalidArgument, "push request too large")
+	}
+	push := &PushRequest{}
+	if err := json.Unmarshal(body, push); err != nil {
+		return nil, errs.Wrapf(err, errs.InvalidArgument, "json.Unmarshal()")
+	}
+	if push.Message.ID == "" {
+		return nil, errs.New(errs.InvalidArgument, "push request has no message id")
+	}
+	return push, nil
+}
+
+// HandlerFunc processes one message, returning nil acknowledges it and any error has pub/sub redeliver it
+type HandlerFunc func(ctx context.Context, push *PushRequest) error
+
+type pushConfig struct {
+	maxBytes int64
+	dedupe   *dedupe.Deduper
+}
+
+type PushOption func(c *pushConfig)
+
+// WithMaxPushBytes caps the size of a push request, pub/sub messages are at most 10MB and base64 adds a third on top
+func WithMaxPushBytes(n int64) PushOption {
+	return func(c *pushConfig) {
+		c.maxBytes = n
+	}
+}
+
+// WithDedupe processes each message once, keyed by subscription and message id. pub/sub delivers at least once, a
+// redelivery of a message we already processed is acked without calling fn, and one still being processed is nacked
+// so pub/sub tries it again later. give d a ttl as long as the message retention of the subscription
+func WithDedupe(d *dedupe.Deduper) PushOption {
+	return func(c *pushConfig) {
+		c.dedupe = d
+	}
+}
+
+// Push serves a push subscription. every message gets a consumer span, linked to the publisher when it put trace
+// context in the message attributes, and its logs carry the message id. put authx.Verifier.Middleware in front with
+// the audience configured on the subscription, push endpoints are as public as the rest of our service
+func Push(logger *logx.AppLogger, fn HandlerFunc, opts ...PushOption) http.Handler {
+	c := &pushConfig{maxBytes: 14 << 20}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	meter := metric.Must(global.Meter(instrumentationName))
+	messages := meter.NewInt64Counter("pubsubx.push.messages", metric.WithDescription("push deliveries by subscription and outcome"))
+	age := meter.NewFloat64ValueRecorder("pubsubx.push.age",
+		metric.WithDescription("time from publish until we finished processing a message"),
+		metric.WithUnit("ms"),
+	)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		push, err := DecodePush(request, c.maxBytes)
+		if err != nil {
+			logger.WrapTraceContext(ctx).Warnw("invalid push request", "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+
+		attrs := []attribute.KeyValue{
+			attribute.String("messaging.system", "pubsub"),
+			attribute.String("messaging.destination", push.Subscription),
+			attribute.String("messaging.message_id", push.Message.ID),
+			attribute.Int("messaging.pubsub.delivery_attempt", push.DeliveryAttempt),
+		}
+		spanOpts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...)}
+		// a publisher can put its trace context in the attributes, we link rather than parent since one publish can
+		// fan out to many subscriptions and redeliveries
+		if publisher := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), attributeCarrier(push.Message.Attributes))); publisher.IsValid() {
+			spanOpts = append(spanOpts, trace.WithLinks(trace.Link{SpanContext: publisher}))
+		}
+		ctx, span := otel.Tracer(instrumentationName).Start(ctx, "pubsubx.Push "+push.Subscription, spanOpts...)
+		defer span.End()
+		ctx = logx.ContextWithFields(ctx, zapdriver.Label("message_id", push.Message.ID))
+
+		outcome := "acked"
+		if err := c.process(ctx, push, fn); errors.Is(err, dedupe.ErrDuplicate) {
+			outcome = "duplicate"
+			writer.WriteHeader(http.StatusNoContent)
+		} else if err != nil {
+			outcome = "nacked"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.WrapTraceContext(ctx).Errorw("push message failed, pub/sub will redeliver it",
+				"subscription", push.Subscription,
+				"delivery_attempt", push.DeliveryAttempt,
+				"err", err,
+			)
+			httpx.RespondError(writer, request, err)
+		} else {
+			writer.WriteHeader(http.StatusNoContent)
+		}
+
+		labels := []attribute.KeyValue{attribute.String("subscription", push.Subscription), attribute.String("outcome", outcome)}
+		messages.Add(ctx, 1, labels...)
+		if !push.Message.PublishTime.IsZero() {
+			age.Record(ctx, float64(time.Since(push.Message.PublishTime))/float64(time.Millisecond), labels...)
+		}
+	})
+}
+
+// process runs fn, at most once per message WithDedupe
+func (c *pushConfig) process(ctx context.Context, push *PushRequest, fn HandlerFunc) error {
+	if c.dedupe == nil {
+		return fn(ctx, push)
+	}
+	err := c.dedupe.Do(ctx, push.Subscription+"/"+push.Message.ID, func(ctx context.Context) error {
+		return fn(ctx, push)
+	})
+	if errors.Is(err, dedupe.ErrInProgress) {
+		return errs.Wrapf(err, errs.Unavailable, "c.dedupe.Do()")
+	}
+	return err
+}
+
+// attributeCarrier reads trace context out of message attributes
+type attributeCarrier map[string]string
+
+func (a attributeCarrier) Get(key string) string {
+	return a[key]
+}
+
+func (a attributeCarrier) Set(key, value string) {
+	a[key] = value
+}
+
+func (a attributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectAttributes adds the trace context of ctx to attributes, for publishers that want their subscribers linked
+func InjectAttributes(ctx context.Context, attributes map[string]string) map[string]string {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, attributeCarrier(attributes))
+	return attributes
+}
@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package pubsubx
+
+import (
+	"bytes"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"net/http/httptest"
+	"testing"
+)
+
+// FuzzDecodePush decodes whatever reaches our push endpoints, anyone can post to them until a verifier is in front
+func FuzzDecodePush(f *testing.F) {
+	f.Add([]byte(`{"message":{"messageId":"1","publishTime":"2021-08-01T00:00:00Z","attributes":{"a":"b"},"data":"aGVsbG8="},"subscription":"projects/p/subscriptions/s"}`))
+	f.Add([]byte(`{"message":{"messageId":"1","data":"not base64"}}`))
+	f.Add([]byte(`{"message":{"messageId":""}}`))
+	f.Add([]byte(`{"message":null,"deliveryAttempt":-1}`))
+	f.Add([]byte(`{"message":{"messageId":"1","publishTime":"yesterday"}}`))
+	f.Add([]byte(`[]`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		const maxBytes = 1 << 10
+		request := httptest.NewRequest("POST", "/pubsub/push", bytes.NewReader(body))
+		push, err := DecodePush(request, maxBytes)
+		if err != nil {
+			if !errs.Is(err, errs.InvalidArgument) {
+				t.Fatalf("DecodePush() = %v, malformed envelopes are errs.InvalidArgument", err)
+			}
+			return
+		}
+		if len(body) > maxBytes {
+			t.Fatalf("DecodePush() took %d bytes, more than %d", len(body), maxBytes)
+		}
+		if push.Message.ID == "" {
+			t.Fatalf("DecodePush() returned a message without an id from %q", body)
+		}
+	})
+}
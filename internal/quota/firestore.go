@@ -0,0 +1,56 @@
+package quota
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+type firestoreStore struct {
+	collection *firestore.CollectionRef
+	shards     int
+}
+
+// Firestore keeps the count of a key in a window as the shards subcollection of a document in collection, keys are
+// hashed into document ids since clients pick them. a firestore document takes about one write a second, so adds go
+// to one of shards documents at random and reads sum them all. set a ttl policy on the expires field of the shards
+// collection group to have past windows deleted
+func Firestore(client *firestore.Client, collection string, shards int) Store {
+	if shards < 1 {
+		shards = 1
+	}
+	return &firestoreStore{collection: client.Collection(collection), shards: shards}
+}
+
+func (f *firestoreStore) Add(ctx context.Context, key, window string, n int64, expires time.Time) (int64, error) {
+	sum := sha256.Sum256([]byte(key))
+	shards := f.collection.Doc(hex.EncodeToString(sum[:]) + "_" + window).Collection("shards")
+	if n != 0 {
+		shard := shards.Doc(strconv.Itoa(rand.Intn(f.shards)))
+		_, err := shard.Set(ctx, map[string]interface{}{
+			"key":     key,
+			"window":  window,
+			"count":   firestore.Increment(n),
+			"expires": expires,
+		}, firestore.MergeAll)
+		if err != nil {
+			return 0, fmt.Errorf("shard.Set(): %v", err)
+		}
+	}
+	docs, err := shards.Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("GetAll(): %v", err)
+	}
+	var total int64
+	for _, doc := range docs {
+		if count, ok := doc.Data()["count"].(int64); ok {
+			total += count
+		}
+	}
+	return total, nil
+}
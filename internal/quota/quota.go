@@ -0,0 +1,386 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/quota"
+
+// Period is the window a Limit counts over, windows start at midnight utc
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+)
+
+// window returns the id of the window of p holding t and when that window ends
+func (p Period) window(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	if p == Monthly {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// seconds is the length of p as the w= of a RateLimit-Policy, a month is taken as 30 days
+func (p Period) seconds() int64 {
+	if p == Monthly {
+		return 30 * 24 * 60 * 60
+	}
+	return 24 * 60 * 60
+}
+
+// Limit is how many requests a key gets per Period
+type Limit struct {
+	Period Period
+	Max    int64
+}
+
+// ParseLimits reads limits like daily=1000,monthly=20000, an empty spec has no limits
+func ParseLimits(spec string) ([]Limit, error) {
+	var limits []Limit
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("quota: %q is not period=max", field)
+		}
+		period := Period(strings.TrimSpace(parts[0]))
+		if period != Daily && period != Monthly {
+			return nil, fmt.Errorf("quota: unknown period %q, expected daily or monthly", period)
+		}
+		max, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || max < 1 {
+			return nil, fmt.Errorf("quota: %s has to be a positive number", period)
+		}
+		limits = append(limits, Limit{Period: period, Max: max})
+	}
+	return limits, nil
+}
+
+// Store keeps the counts every instance adds to
+type Store interface {
+	// Add adds n to the count of key in window and returns the count of every instance, an n of 0 only reads it.
+	// expires is when the window is over and its count can be deleted
+	Add(ctx context.Context, key, window string, n int64, expires time.Time) (int64, error)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	counts  map[string]int64
+	expires map[string]time.Time
+}
+
+// NewMemory counts on this instance, only good for a single instance or local development
+func NewMemory() Store {
+	return &memoryStore{counts: map[string]int64{}, expires: map[string]time.Time{}}
+}
+
+func (m *memoryStore) Add(ctx context.Context, key, window string, n int64, expires time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, e := range m.expires {
+		if now.After(e) {
+			delete(m.counts, k)
+			delete(m.expires, k)
+		}
+	}
+	k := key + "\x00" + window
+	m.counts[k] += n
+	m.expires[k] = expires
+	return m.counts[k], nil
+}
+
+// counter is what we know of the count of a key in a window. synced is the count of every instance as of syncedAt,
+// pending is what we admitted since and haven't added to the store yet
+type counter struct {
+	key      string
+	window   string
+	ends     time.Time
+	synced   int64
+	pending  int64
+	syncedAt time.Time
+	usedAt   time.Time
+}
+
+// Usage is where a key stands against the limit it has the least left of
+type Usage struct {
+	Limit     Limit
+	Used      int64
+	Remaining int64
+	Resets    time.Time
+	Allowed   bool
+	// Limits are every limit of the key, for the RateLimit-Policy header
+	Limits []Limit
+}
+
+// Quota enforces daily and monthly limits per key, eg per api client. requests are decided on the counts this
+// instance has, which are reconciled with the store in the background, so a key can go over its limit by what the
+// other instances admitted since they last synced. a key this instance hasn't seen, or hasn't synced in a while, is
+// synced before its request is decided
+type Quota struct {
+	store      Store
+	name       string
+	limits     func(key string) []Limit
+	staleAfter time.Duration
+	now        func() time.Time
+	logger     *zap.SugaredLogger
+
+	mu       sync.Mutex
+	counters map[string]*counter
+
+	checks metric.Int64Counter
+	syncs  metric.Int64Counter
+}
+
+type Option func(q *Quota)
+
+// WithKeyLimits gives keys limits of their own, eg by the plan of a customer. keys it returns nil for get the
+// limits given to New, an empty slice leaves a key unlimited
+func WithKeyLimits(limits func(key string) []Limit) Option {
+	return func(q *Quota) {
+		defaults := q.limits
+		q.limits = func(key string) []Limit {
+			if l := limits(key); l != nil {
+				return l
+			}
+			return defaults(key)
+		}
+	}
+}
+
+// WithStaleAfter syncs a key on its next request once it hasn't been synced for d, defaults to a minute. it bounds
+// how far behind we fall when Reconcile doesn't run, eg while our cpu is throttled between requests
+func WithStaleAfter(d time.Duration) Option {
+	return func(q *Quota) {
+		q.staleAfter = d
+	}
+}
+
+// WithLogger logs the syncs that failed, we keep deciding on the counts we have when the store is unavailable
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(q *Quota) {
+		q.logger = logger
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through windows
+func WithClock(now func() time.Time) Option {
+	return func(q *Quota) {
+		q.now = now
+	}
+}
+
+// New enforces limits on every key counted in store, name tells quotas sharing a store apart and labels our metrics
+func New(store Store, name string, limits []Limit, opts ...Option) *Quota {
+	meter := metric.Must(global.Meter(instrumentationName))
+	q := &Quota{
+		store:      store,
+		name:       name,
+		limits:     func(string) []Limit { return limits },
+		staleAfter: time.Minute,
+		now:        time.Now,
+		logger:     zap.NewNop().Sugar(),
+		counters:   map[string]*counter{},
+		checks: meter.NewInt64Counter("quota.checks",
+			metric.WithDescription("requests checked against a quota by quota and outcome, allowed or exceeded")),
+		syncs: meter.NewInt64Counter("quota.syncs",
+			metric.WithDescription("counts reconciled with the store by quota and outcome")),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Allow admits n requests of key when every limit of key has room for them, counting them when it does
+func (q *Quota) Allow(ctx context.Context, key string, n int64) Usage {
+	limits := q.limits(key)
+	if len(limits) == 0 {
+		return Usage{Allowed: true}
+	}
+	now := q.now()
+
+	q.mu.Lock()
+	counters := make([]*counter, len(limits))
+	var stale []*counter
+	for i, limit := range limits {
+		c := q.counter(key, limit.Period, now)
+		counters[i] = c
+		if now.Sub(c.syncedAt) > q.staleAfter {
+			stale = append(stale, c)
+		}
+	}
+	q.mu.Unlock()
+	for _, c := range stale {
+		if err := q.sync(ctx, c); err != nil {
+			q.logger.Warnw("syncing quota, deciding on what this instance counted", "quota", q.name, "key", key, "err", err)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := Usage{Allowed: true, Remaining: math.MaxInt64, Limits: limits}
+	for i, limit := range limits {
+		c := counters[i]
+		used := c.synced + c.pending
+		if used+n > limit.Max {
+			usage.Allowed = false
+		}
+		if remaining := limit.Max - used; remaining < usage.Remaining {
+			usage.Limit, usage.Used, usage.Remaining, usage.Resets = limit, used, remaining, c.ends
+		}
+	}
+	if usage.Allowed {
+		// limits of the same period share their counter, it only counts the requests once
+		counted := map[*counter]bool{}
+		for _, c := range counters {
+			if !counted[c] {
+				c.pending += n
+				counted[c] = true
+			}
+		}
+		usage.Used += n
+		usage.Remaining -= n
+	}
+	if usage.Remaining < 0 {
+		usage.Remaining = 0
+	}
+	outcome := "allowed"
+	if !usage.Allowed {
+		outcome = "exceeded"
+	}
+	q.checks.Add(ctx, 1, attribute.String("quota", q.name), attribute.String("outcome", outcome))
+	return usage
+}
+
+// counter returns the counter of key in the window of period holding now, q.mu is held
+func (q *Quota) counter(key string, period Period, now time.Time) *counter {
+	window, ends := period.window(now)
+	id := key + "\x00" + window
+	c, ok := q.counters[id]
+	if !ok {
+		c = &counter{key: key, window: window, ends: ends}
+		q.counters[id] = c
+	}
+	c.usedAt = now
+	return c
+}
+
+// sync adds what c has pending to the store and takes the count of every instance from it
+func (q *Quota) sync(ctx context.Context, c *counter) error {
+	q.mu.Lock()
+	n := c.pending
+	c.pending = 0
+	q.mu.Unlock()
+
+	total, err := q.store.Add(ctx, q.name+":"+c.key, c.window, n, c.ends)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		c.pending += n
+		q.syncs.Add(ctx, 1, attribute.String("quota", q.name), attribute.String("outcome", "failed"))
+		return fmt.Errorf("q.store.Add(): %v", err)
+	}
+	c.synced = total
+	c.syncedAt = q.now()
+	q.syncs.Add(ctx, 1, attribute.String("quota", q.name), attribute.String("outcome", "ok"))
+	return nil
+}
+
+// Reconcile adds what every key admitted since it last synced to the store and picks up what the other instances
+// added meanwhile. run it every few seconds with serverx.WithBackground, and once more as we shut down, counts it
+// couldn't add are kept for the next run. keys idle for longer than WithStaleAfter, and windows that ended, are
+// forgotten once they have nothing pending
+func (q *Quota) Reconcile(ctx context.Context) error {
+	now := q.now()
+	var due []*counter
+	q.mu.Lock()
+	for id, c := range q.counters {
+		switch {
+		case c.pending == 0 && (!now.Before(c.ends) || now.Sub(c.usedAt) > q.staleAfter):
+			delete(q.counters, id)
+		case c.pending > 0 || c.usedAt.After(c.syncedAt):
+			due = append(due, c)
+		}
+	}
+	q.mu.Unlock()
+
+	var failed int
+	var firstErr error
+	for _, c := range due {
+		if err := q.sync(ctx, c); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d counts of %s failed to sync, the first: %v", failed, len(due), q.name, firstErr)
+	}
+	return nil
+}
+
+// Middleware counts every request against the quota of its key, requests key returns nothing for pass through.
+// responses carry the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset of the limit the key has the least
+// left of, and a RateLimit-Policy listing all of them. a request over a limit gets a 429 with a Retry-After of when
+// its window resets
+func (q *Quota) Middleware(key func(request *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			k := key(request)
+			if k == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			usage := q.Allow(request.Context(), k, 1)
+			if len(usage.Limits) == 0 {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			reset := int64(math.Ceil(usage.Resets.Sub(q.now()).Seconds()))
+			if reset < 1 {
+				reset = 1
+			}
+			policies := make([]string, len(usage.Limits))
+			for i, limit := range usage.Limits {
+				policies[i] = fmt.Sprintf("%d;w=%d", limit.Max, limit.Period.seconds())
+			}
+			header := writer.Header()
+			header.Set("RateLimit-Limit", strconv.FormatInt(usage.Limit.Max, 10))
+			header.Set("RateLimit-Remaining", strconv.FormatInt(usage.Remaining, 10))
+			header.Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+			header.Set("RateLimit-Policy", strings.Join(policies, ", "))
+			if !usage.Allowed {
+				header.Set("Retry-After", strconv.FormatInt(reset, 10))
+				httpx.RespondJSON(writer, &httpx.ErrorResponse{
+					Code:    "quota_exceeded",
+					Message: fmt.Sprintf("%s quota of %d requests used up, retry after the Retry-After header", usage.Limit.Period, usage.Limit.Max),
+				}, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
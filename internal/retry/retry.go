@@ -0,0 +1,221 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/retry"
+
+var attempts = metric.Must(global.Meter(instrumentationName)).NewInt64Counter(
+	"retry.attempts",
+	metric.WithDescription("attempts made by Policy.Do by op and outcome, retried attempts failed and were tried again"),
+)
+
+// Jitter is how much of a backoff is randomized, so clients that failed together don't all retry together
+type Jitter string
+
+const (
+	// JitterFull waits anywhere between nothing and the backoff, the default
+	JitterFull Jitter = "full"
+	// JitterEqual waits at least half the backoff
+	JitterEqual Jitter = "equal"
+	// JitterNone waits the backoff exactly
+	JitterNone Jitter = "none"
+)
+
+// Policy describes how and when a failed call is attempted again. it is shared by clientx, firestorex, pubsubx and
+// lro so every client backs off the same way, and can be tuned per environment from config, see Parse
+type Policy struct {
+	// MaxAttempts includes the first attempt, a value of 3 means at most 2 retries. 1 or less never retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Multiplier grows the backoff after every attempt, defaults to 2
+	Multiplier float64
+	Jitter     Jitter
+	// Retryable says which errors are worth another attempt, defaults to Transient
+	Retryable func(err error) bool
+}
+
+// Default is a sensible policy for calls to google apis and other cloud run services from within a request
+func Default() Policy {
+	return Policy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		Jitter:         JitterFull,
+	}
+}
+
+// Backoff returns how long to wait before the given retry, attempt starts at 1
+func (p Policy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if !(multiplier >= 1) || math.IsInf(multiplier, 0) {
+		multiplier = 2
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	// without a max the float grows past what a duration holds, and converting that to int64 is undefined
+	limit := float64(math.MaxInt64 / 2)
+	if p.MaxBackoff > 0 && float64(p.MaxBackoff) < limit {
+		limit = float64(p.MaxBackoff)
+	}
+	if !(backoff < limit) {
+		backoff = limit
+	}
+	if backoff < 1 {
+		return 0
+	}
+	d := int64(backoff)
+	switch p.Jitter {
+	case JitterNone:
+		return time.Duration(d)
+	case JitterEqual:
+		half := d / 2
+		return time.Duration(half + rand.Int63n(half+1))
+	default:
+		return time.Duration(rand.Int63n(d) + 1)
+	}
+}
+
+// ShouldRetry reports if err is worth another attempt by our classifier
+func (p Policy) ShouldRetry(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return Transient(err)
+}
+
+// Do calls fn until it succeeds, fails with an error we don't retry, runs out of attempts or ctx is done, and returns
+// its last error. op labels the retry.attempts metric, eg tasks.enqueue
+func (p Policy) Do(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			attempts.Add(ctx, 1, attribute.String("op", op), attribute.String("outcome", "ok"))
+			return nil
+		}
+		if attempt >= p.MaxAttempts || ctx.Err() != nil || !p.ShouldRetry(err) {
+			attempts.Add(ctx, 1, attribute.String("op", op), attribute.String("outcome", "failed"))
+			return err
+		}
+		attempts.Add(ctx, 1, attribute.String("op", op), attribute.String("outcome", "retried"))
+
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Transient is our default classifier, it retries what fails now and may not in a moment: grpc unavailable, resource
+// exhausted, aborted and server side deadlines, google api 408, 429 and 5xx, network errors and errs.Unavailable. our
+// own context running out is never retried
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusRequestTimeout || apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var typed *errs.Error
+	return errors.As(err, &typed) && errs.KindOf(err) == errs.Unavailable
+}
+
+// Parse overrides the fields of base named in spec, a comma separated list like
+// attempts=5,initial=200ms,max=10s,multiplier=1.5,jitter=equal. an empty spec is base as it is
+func Parse(spec string, base Policy) (Policy, error) {
+	p := base
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return base, fmt.Errorf("retry: %q is not key=value", field)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "attempts":
+			p.MaxAttempts, err = strconv.Atoi(value)
+		case "initial":
+			p.InitialBackoff, err = time.ParseDuration(value)
+		case "max":
+			p.MaxBackoff, err = time.ParseDuration(value)
+		case "multiplier":
+			p.Multiplier, err = strconv.ParseFloat(value, 64)
+			if err == nil && (!(p.Multiplier >= 1) || math.IsInf(p.Multiplier, 0)) {
+				err = fmt.Errorf("has to be a finite number of at least 1")
+			}
+		case "jitter":
+			switch j := Jitter(value); j {
+			case JitterFull, JitterEqual, JitterNone:
+				p.Jitter = j
+			default:
+				err = fmt.Errorf("jitter is full, equal or none")
+			}
+		default:
+			return base, fmt.Errorf("retry: unknown key %q, expected attempts, initial, max, multiplier or jitter", key)
+		}
+		if err != nil {
+			return base, fmt.Errorf("retry: %s: %v", key, err)
+		}
+	}
+	if p.MaxAttempts < 1 || p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return base, fmt.Errorf("retry: attempts has to be at least 1 and backoffs can't be negative")
+	}
+	return p, nil
+}
+
+// FromConfig parses the policy at key of cfg on top of base, see Parse
+func FromConfig(cfg *configx.Config, key string, base Policy) (Policy, error) {
+	p, err := Parse(cfg.String(key), base)
+	if err != nil {
+		return base, fmt.Errorf("%s: %v", key, err)
+	}
+	return p, nil
+}
+
+// String is p in the form Parse reads, for logging the policy in effect
+func (p Policy) String() string {
+	jitter := p.Jitter
+	if jitter == "" {
+		jitter = JitterFull
+	}
+	return fmt.Sprintf("attempts=%d,initial=%s,max=%s,multiplier=%g,jitter=%s", p.MaxAttempts, p.InitialBackoff, p.MaxBackoff, p.Multiplier, jitter)
+}
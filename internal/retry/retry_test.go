@@ -0,0 +1,56 @@
+package retry
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseRejectsBadMultiplier(t *testing.T) {
+	for _, spec := range []string{"multiplier=NaN", "multiplier=+Inf", "multiplier=0.5", "multiplier=-2"} {
+		if _, err := Parse(spec, Default()); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+	p, err := Parse("multiplier=1.5", Default())
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+	if p.Multiplier != 1.5 {
+		t.Errorf("Parse() multiplier = %v, want 1.5", p.Multiplier)
+	}
+}
+
+func TestBackoffStaysInRange(t *testing.T) {
+	uncapped, err := Parse("attempts=100,max=0", Default())
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+	nan := Default()
+	nan.Multiplier = math.NaN()
+
+	tests := []struct {
+		name    string
+		p       Policy
+		attempt int
+	}{
+		{name: "nan multiplier", p: nan, attempt: 2},
+		{name: "no max", p: uncapped, attempt: 50},
+		{name: "no max equal jitter", p: Policy{InitialBackoff: time.Second, Jitter: JitterEqual}, attempt: 100},
+		{name: "no max no jitter", p: Policy{InitialBackoff: time.Second, Jitter: JitterNone}, attempt: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := tt.p.Backoff(tt.attempt); got < 0 {
+					t.Fatalf("Backoff(%d) = %v, want a positive duration", tt.attempt, got)
+				}
+			}
+		})
+	}
+
+	capped := Policy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Jitter: JitterNone}
+	if got := capped.Backoff(50); got != 5*time.Second {
+		t.Errorf("Backoff(50) = %v, want the max of 5s", got)
+	}
+}
@@ -0,0 +1,200 @@
+package revisionx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings are what cloud run has deployed for our revision, which can differ from what a deploy script or a console
+// edit was meant to set
+type Settings struct {
+	Project  string `json:"project"`
+	Region   string `json:"region"`
+	Service  string `json:"service"`
+	Revision string `json:"revision"`
+	Image    string `json:"image"`
+	// MinInstances and MaxInstances are 0 when they were left at the cloud run default
+	MinInstances   int    `json:"min_instances"`
+	MaxInstances   int    `json:"max_instances"`
+	Concurrency    int    `json:"concurrency"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	CPU            string `json:"cpu"`
+	Memory         string `json:"memory"`
+	// CPUThrottling is false when cpu is always allocated, not just during requests
+	CPUThrottling        bool      `json:"cpu_throttling"`
+	ExecutionEnvironment string    `json:"execution_environment,omitempty"`
+	ServiceAccount       string    `json:"service_account"`
+	FetchedAt            time.Time `json:"fetched_at"`
+}
+
+// Fields are the settings as log fields
+func (s *Settings) Fields() []interface{} {
+	return []interface{}{
+		"service", s.Service,
+		"revision", s.Revision,
+		"image", s.Image,
+		"min_instances", s.MinInstances,
+		"max_instances", s.MaxInstances,
+		"concurrency", s.Concurrency,
+		"timeout_seconds", s.TimeoutSeconds,
+		"cpu", s.CPU,
+		"memory", s.Memory,
+		"cpu_throttling", s.CPUThrottling,
+		"execution_environment", s.ExecutionEnvironment,
+		"service_account", s.ServiceAccount,
+	}
+}
+
+// revisionResource is the part of a knative serving revision of the cloud run admin api v1 we read
+type revisionResource struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		ContainerConcurrency int    `json:"containerConcurrency"`
+		TimeoutSeconds       int    `json:"timeoutSeconds"`
+		ServiceAccountName   string `json:"serviceAccountName"`
+		Containers           []struct {
+			Image     string `json:"image"`
+			Resources struct {
+				Limits map[string]string `json:"limits"`
+			} `json:"resources"`
+		} `json:"containers"`
+	} `json:"spec"`
+}
+
+// Inspector reads the settings of our revision from the cloud run admin api with our service identity, which needs
+// run.revisions.get, eg roles/run.viewer
+type Inspector struct {
+	client   *clientx.Client
+	project  string
+	region   string
+	service  string
+	revision string
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+
+	mu       sync.Mutex
+	settings *Settings
+	traffic  *Traffic
+}
+
+type InspectOption func(i *Inspector)
+
+// WithInspectClient replaces the client of the admin api, it has to authenticate its own requests
+func WithInspectClient(client *clientx.Client) InspectOption {
+	return func(i *Inspector) {
+		i.client = client
+	}
+}
+
+// WithInspectService reads the traffic split of another service than our K_SERVICE
+func WithInspectService(service string) InspectOption {
+	return func(i *Inspector) {
+		i.service = service
+	}
+}
+
+// WithInspectLogger logs the traffic splits Watch failed to read
+func WithInspectLogger(logger *zap.SugaredLogger) InspectOption {
+	return func(i *Inspector) {
+		i.logger = logger
+	}
+}
+
+// WithInspectRevision inspects another revision than our K_REVISION
+func WithInspectRevision(revision string) InspectOption {
+	return func(i *Inspector) {
+		i.revision = revision
+	}
+}
+
+// NewInspector inspects our revision in project and region, region being the short name, eg us-central1
+func NewInspector(ctx context.Context, project, region string, opts ...InspectOption) (*Inspector, error) {
+	i := &Inspector{project: project, region: region, revision: Revision(), logger: zap.NewNop().Sugar(), now: time.Now}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if i.revision == "" {
+		return nil, fmt.Errorf("revisionx: no revision to inspect, K_REVISION is only set on cloud run")
+	}
+	if i.client == nil {
+		i.client = clientx.New(
+			clientx.WithBaseURL("https://"+region+"-run.googleapis.com/"),
+			clientx.WithGoogleAuth(clientx.DeferredGoogleTokenSource()),
+			clientx.WithTimeout(10*time.Second),
+		)
+	}
+	return i, nil
+}
+
+// Inspect fetches our settings from the admin api and keeps them for ServeHTTP
+func (i *Inspector) Inspect(ctx context.Context) (*Settings, error) {
+	var resource revisionResource
+	path := fmt.Sprintf("apis/serving.knative.dev/v1/namespaces/%s/revisions/%s", i.project, i.revision)
+	if err := i.client.JSON(ctx, http.MethodGet, path, nil, &resource); err != nil {
+		return nil, fmt.Errorf("i.client.JSON(%s): %v", path, err)
+	}
+
+	annotations := resource.Metadata.Annotations
+	settings := &Settings{
+		Project:              i.project,
+		Region:               i.region,
+		Service:              resource.Metadata.Labels["serving.knative.dev/service"],
+		Revision:             resource.Metadata.Name,
+		Concurrency:          resource.Spec.ContainerConcurrency,
+		TimeoutSeconds:       resource.Spec.TimeoutSeconds,
+		ServiceAccount:       resource.Spec.ServiceAccountName,
+		ExecutionEnvironment: annotations["run.googleapis.com/execution-environment"],
+		// cpu is only allocated during requests unless the annotation says otherwise
+		CPUThrottling: annotations["run.googleapis.com/cpu-throttling"] != "false",
+		FetchedAt:     i.now(),
+	}
+	settings.MinInstances, _ = strconv.Atoi(annotations["autoscaling.knative.dev/minScale"])
+	settings.MaxInstances, _ = strconv.Atoi(annotations["autoscaling.knative.dev/maxScale"])
+	if len(resource.Spec.Containers) > 0 {
+		container := resource.Spec.Containers[0]
+		settings.Image = container.Image
+		settings.CPU = container.Resources.Limits["cpu"]
+		settings.Memory = container.Resources.Limits["memory"]
+	}
+
+	i.mu.Lock()
+	i.settings = settings
+	i.mu.Unlock()
+	return settings, nil
+}
+
+// ServeHTTP serves the settings and traffic split we fetched last, fetching them when we have none or ?refresh=true
+// asks for it
+func (i *Inspector) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	i.mu.Lock()
+	settings, traffic := i.settings, i.traffic
+	i.mu.Unlock()
+
+	refresh, _ := strconv.ParseBool(request.URL.Query().Get("refresh"))
+	var err error
+	if settings == nil || refresh {
+		if settings, err = i.Inspect(request.Context()); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "i.Inspect()"))
+			return
+		}
+	}
+	if traffic == nil || refresh {
+		if traffic, err = i.Traffic(request.Context()); err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "i.Traffic()"))
+			return
+		}
+	}
+	httpx.RespondJSON(writer, map[string]interface{}{"settings": settings, "traffic": traffic}, http.StatusOK)
+}
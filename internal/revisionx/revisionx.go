@@ -0,0 +1,138 @@
+package revisionx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/revisionx"
+
+// DefaultHeader carries the traffic tag when requests don't come in on a tagged run.app url, eg behind a load
+// balancer routing a custom domain to a tagged revision
+const DefaultHeader = "X-Traffic-Tag"
+
+// Untagged is the tag label of requests that were routed by the traffic split rather than a tag
+const Untagged = "untagged"
+
+// cloud run tags are lowercase letters, digits and dashes, anything else never came from cloud run
+var validTag = regexp.MustCompile(`^[a-z][a-z0-9-]{0,45}$`)
+
+var tagKey = ctxval.NewString("revisionx.traffic_tag")
+
+// Revision is our K_REVISION, empty outside of cloud run
+func Revision() string {
+	return buildinfo.Get().ServiceRevision
+}
+
+// TagFromContext returns the traffic tag stored by Enrich
+func TagFromContext(ctx context.Context) (string, bool) {
+	return tagKey.Value(ctx)
+}
+
+// Enrich is our one hook for rollout telemetry, it stores tag in ctx and adds it along with our revision and its Role
+// to the log labels and the current span. pass "" for untagged traffic
+func Enrich(ctx context.Context, tag string) context.Context {
+	if tag == "" {
+		tag = Untagged
+	}
+	ctx = tagKey.With(ctx, tag)
+	ctx = logx.ContextWithFields(ctx, zapdriver.Label("traffic_tag", tag), zapdriver.Label("traffic_role", Role()))
+	trace.SpanFromContext(ctx).SetAttributes(Labels(ctx)...)
+	return ctx
+}
+
+// Labels returns our revision, its Role and the traffic tag as metric dimensions, all bounded by the number of
+// revisions that are serving traffic. canary analysis compares the canary role against the stable one without
+// knowing revision names up front
+func Labels(ctx context.Context) []attribute.KeyValue {
+	tag, ok := TagFromContext(ctx)
+	if !ok {
+		tag = Untagged
+	}
+	return []attribute.KeyValue{
+		attribute.String("cloud_run.revision", Revision()),
+		attribute.String("cloud_run.traffic_role", Role()),
+		attribute.String("cloud_run.traffic_tag", tag),
+	}
+}
+
+// FromHost reads the tag of a tagged cloud run url, https://<tag>---<service>-<hash>-<region>.a.run.app
+func FromHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	i := strings.Index(host, "---")
+	if i <= 0 || !strings.HasSuffix(host, ".run.app") {
+		return ""
+	}
+	return host[:i]
+}
+
+// FromHeader reads the tag from header, defaults to DefaultHeader. the header comes from whoever calls us, so only the
+// tags in allowed are taken from it, anything else would let a client file its requests under our canary or mint a
+// metric label per request. without allowed tags the header is ignored
+func FromHeader(header string, allowed ...string) func(r *http.Request) string {
+	if header == "" {
+		header = DefaultHeader
+	}
+	tags := make(map[string]bool, len(allowed))
+	for _, tag := range allowed {
+		tags[strings.ToLower(strings.TrimSpace(tag))] = true
+	}
+	return func(r *http.Request) string {
+		if tag := strings.ToLower(r.Header.Get(header)); tags[tag] {
+			return tag
+		}
+		return ""
+	}
+}
+
+// Tag returns the traffic tag of r, a tagged url wins over the header, which is only trusted for the tags in allowed
+func Tag(r *http.Request, header string, allowed ...string) string {
+	for _, source := range []func(r *http.Request) string{FromHost, FromHeader(header, allowed...)} {
+		if tag := source(r); validTag.MatchString(tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// Middleware enriches every request with its traffic tag and records request counts and latency by revision and tag,
+// so a canary can be compared with the revision it replaces on one dashboard. tags come from a tagged url, or from
+// header for the tags in allowed, eg the tags a load balancer in front of us routes by
+func Middleware(header string, allowed ...string) func(next http.Handler) http.Handler {
+	meter := metric.Must(global.Meter(instrumentationName))
+	requests := meter.NewInt64Counter("revisionx.requests", metric.WithDescription("requests by revision, traffic tag and status class"))
+	latency := meter.NewFloat64ValueRecorder("revisionx.latency",
+		metric.WithDescription("request latency by revision and traffic tag"),
+		metric.WithUnit("ms"),
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			start := time.Now()
+			ctx := Enrich(request.Context(), Tag(request, header, allowed...))
+			wrapped, rec := httpx.Record(writer, 0)
+			next.ServeHTTP(wrapped, request.WithContext(ctx))
+
+			labels := Labels(ctx)
+			latency.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), labels...)
+			requests.Add(ctx, 1, append(labels, attribute.String("class", strconv.Itoa(rec.Status/100)+"xx"))...)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package revisionx
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		header  string
+		allowed []string
+		want    string
+	}{
+		{name: "tagged_url", host: "canary---opentelemetry-abc123-uc.a.run.app", want: "canary"},
+		{name: "tagged_url_wins", host: "canary---opentelemetry-abc123-uc.a.run.app", header: "beta", allowed: []string{"beta"}, want: "canary"},
+		{name: "untagged_url", host: "opentelemetry-abc123-uc.a.run.app", want: ""},
+		{name: "custom_domain", host: "canary---api.example.com", want: ""},
+		{name: "header_allowed", host: "api.example.com", header: "Canary", allowed: []string{"canary", "beta"}, want: "canary"},
+		// a client can send any header, it must not pick our canary or mint a label of its own
+		{name: "header_without_allowlist", host: "api.example.com", header: "canary", want: ""},
+		{name: "header_not_allowed", host: "api.example.com", header: "a-new-tag-every-request", allowed: []string{"canary"}, want: ""},
+		{name: "header_invalid", host: "api.example.com", header: "canary!", allowed: []string{"canary!"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+			if tt.header != "" {
+				r.Header.Set(DefaultHeader, tt.header)
+			}
+			if got := Tag(r, "", tt.allowed...); got != tt.want {
+				t.Errorf("Tag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
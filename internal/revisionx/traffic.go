@@ -0,0 +1,131 @@
+package revisionx
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// the roles our revision can have in the traffic split of its service
+const (
+	// RoleStable is the revision getting the largest share of traffic
+	RoleStable = "stable"
+	// RoleCanary gets some traffic but less than another revision
+	RoleCanary = "canary"
+	// RoleTagged only gets traffic through its tagged url
+	RoleTagged = "tagged"
+	// RoleInactive gets no traffic at all, eg a revision that is still draining after a rollout
+	RoleInactive = "inactive"
+	// RoleUnknown is our role until the traffic split was read, and for good outside of cloud run
+	RoleUnknown = "unknown"
+)
+
+// role is the role of our revision set by the last Inspector.Traffic
+var role atomic.Value
+
+// Role is the role of our revision in the traffic split, as of the last time an Inspector read it
+func Role() string {
+	if r, ok := role.Load().(string); ok {
+		return r
+	}
+	return RoleUnknown
+}
+
+// TrafficTarget is one entry of the traffic split of a service
+type TrafficTarget struct {
+	Revision string `json:"revision"`
+	Percent  int    `json:"percent"`
+	Tag      string `json:"tag,omitempty"`
+	Latest   bool   `json:"latest,omitempty"`
+}
+
+// Traffic is the traffic split of our service and where our revision stands in it
+type Traffic struct {
+	Targets []TrafficTarget `json:"targets"`
+	// Percent is the share of untagged traffic our revision gets
+	Percent   int       `json:"percent"`
+	Role      string    `json:"role"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// serviceResource is the part of a knative serving service of the cloud run admin api v1 we read
+type serviceResource struct {
+	Status struct {
+		Traffic []struct {
+			RevisionName   string `json:"revisionName"`
+			Percent        int    `json:"percent"`
+			Tag            string `json:"tag"`
+			LatestRevision bool   `json:"latestRevision"`
+		} `json:"traffic"`
+	} `json:"status"`
+}
+
+// Traffic reads the traffic split of our service, status rather than spec so it is the split that is actually
+// serving, and makes the role of our revision the one Labels and Enrich report. it needs run.services.get
+func (i *Inspector) Traffic(ctx context.Context) (*Traffic, error) {
+	service := i.service
+	if service == "" {
+		service = buildinfo.Get().Service
+	}
+	var resource serviceResource
+	path := fmt.Sprintf("apis/serving.knative.dev/v1/namespaces/%s/services/%s", i.project, service)
+	if err := i.client.JSON(ctx, http.MethodGet, path, nil, &resource); err != nil {
+		return nil, fmt.Errorf("i.client.JSON(%s): %v", path, err)
+	}
+
+	traffic := &Traffic{FetchedAt: i.now()}
+	// a revision can be listed more than once, eg by name and as the latest revision, so shares are summed
+	shares := map[string]int{}
+	tagged := false
+	for _, t := range resource.Status.Traffic {
+		traffic.Targets = append(traffic.Targets, TrafficTarget{Revision: t.RevisionName, Percent: t.Percent, Tag: t.Tag, Latest: t.LatestRevision})
+		shares[t.RevisionName] += t.Percent
+		if t.RevisionName == i.revision && t.Tag != "" {
+			tagged = true
+		}
+	}
+	traffic.Percent = shares[i.revision]
+	traffic.Role = roleOf(i.revision, shares, tagged)
+
+	role.Store(traffic.Role)
+	i.mu.Lock()
+	i.traffic = traffic
+	i.mu.Unlock()
+	return traffic, nil
+}
+
+func roleOf(revision string, shares map[string]int, tagged bool) string {
+	ours := shares[revision]
+	if ours == 0 {
+		if tagged {
+			return RoleTagged
+		}
+		return RoleInactive
+	}
+	for other, share := range shares {
+		if other != revision && share > ours {
+			return RoleCanary
+		}
+	}
+	return RoleStable
+}
+
+// Watch reads the traffic split every interval until ctx is done, a rollout moving traffic changes our role within
+// an interval. a failed read keeps the role we had
+func (i *Inspector) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := i.Traffic(ctx); err != nil && ctx.Err() == nil {
+			i.logger.Warnw("reading our traffic split", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/saga"
+
+var (
+	tracer = otel.Tracer(instrumentationName)
+	meter  = metric.Must(global.Meter(instrumentationName))
+
+	stepRuns      = meter.NewInt64Counter("saga.steps", metric.WithDescription("saga steps by outcome"))
+	compensations = meter.NewInt64Counter("saga.compensations", metric.WithDescription("compensations run after a later step failed, by outcome"))
+)
+
+// Action is one step of a saga, or the compensation undoing it
+type Action func(ctx context.Context) error
+
+type step struct {
+	name       string
+	action     Action
+	compensate Action
+}
+
+// Saga runs the steps of a handler that touches more than one system, eg a firestore write followed by a pub/sub
+// publish. there is no transaction spanning them, so when a step fails the steps that already succeeded are undone by
+// their compensations, most recent first. that is atomic-ish at best, a compensation can fail too and others can see
+// the effects of a step before it is undone, so compensations should be idempotent and safe to run late
+type Saga struct {
+	name    string
+	logger  *logx.AppLogger
+	timeout time.Duration
+	steps   []step
+}
+
+type Option func(s *Saga)
+
+// WithLogger logs compensations that failed, those leave something behind that needs cleaning up
+func WithLogger(logger *logx.AppLogger) Option {
+	return func(s *Saga) {
+		s.logger = logger
+	}
+}
+
+// WithCompensationTimeout bounds all compensations together, defaults to 30 seconds. they run detached from the
+// request so a client that leaves or a deadline that passed doesn't stop us from cleaning up
+func WithCompensationTimeout(d time.Duration) Option {
+	return func(s *Saga) {
+		s.timeout = d
+	}
+}
+
+func New(name string, opts ...Option) *Saga {
+	s := &Saga{name: name, timeout: 30 * time.Second}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Step adds a step, compensate undoes action once a later step failed and may be nil for steps with nothing to undo.
+// a step that fails is not compensated itself, action has to clean up after its own partial failure
+func (s *Saga) Step(name string, action, compensate Action) *Saga {
+	s.steps = append(s.steps, step{name: name, action: action, compensate: compensate})
+	return s
+}
+
+// Error is a failed saga, Err is the error of the step that failed and is what errors.Is and errs.KindOf see
+type Error struct {
+	Saga string
+	Step string
+	Err  error
+	// CompensationErrs are the compensations that failed too, by step, the saga was only partly undone
+	CompensationErrs map[string]error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("saga %s: step %s: %v", e.Saga, e.Step, e.Err)
+	if len(e.CompensationErrs) > 0 {
+		var failed []string
+		for name, err := range e.CompensationErrs {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+		msg += fmt.Sprintf(" (compensations failed: %s)", strings.Join(failed, ", "))
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Run runs our steps in order, each in a span of its own. when one fails the steps before it are compensated in reverse
+// order and Run returns an *Error
+func (s *Saga) Run(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "saga."+s.name)
+	defer span.End()
+
+	for i, st := range s.steps {
+		err := s.run(ctx, "step", st.name, st.action)
+		stepRuns.Add(ctx, 1, attribute.String("saga", s.name), attribute.String("step", st.name), attribute.Bool("ok", err == nil))
+		if err == nil {
+			continue
+		}
+		sagaErr := &Error{Saga: s.name, Step: st.name, Err: err, CompensationErrs: s.compensate(ctx, s.steps[:i])}
+		span.RecordError(sagaErr)
+		span.SetStatus(codes.Error, "step "+st.name+" failed")
+		return sagaErr
+	}
+	return nil
+}
+
+// compensate undoes done, most recent first, and returns the compensations that failed
+func (s *Saga) compensate(ctx context.Context, done []step) map[string]error {
+	ctx, cancel := context.WithTimeout(ctxutil.Detach(ctx), s.timeout)
+	defer cancel()
+
+	var failed map[string]error
+	for i := len(done) - 1; i >= 0; i-- {
+		st := done[i]
+		if st.compensate == nil {
+			continue
+		}
+		err := s.run(ctx, "compensate", st.name, st.compensate)
+		compensations.Add(ctx, 1, attribute.String("saga", s.name), attribute.String("step", st.name), attribute.Bool("ok", err == nil))
+		if err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = map[string]error{}
+		}
+		failed[st.name] = err
+		if s.logger != nil {
+			s.logger.WrapTraceContext(ctx).Errorw("compensation failed, the saga was only partly undone",
+				"saga", s.name,
+				"step", st.name,
+				"err", err,
+			)
+		}
+	}
+	return failed
+}
+
+func (s *Saga) run(ctx context.Context, kind, name string, fn Action) error {
+	ctx, span := tracer.Start(ctx, "saga."+s.name+"."+kind+"."+name, trace.WithAttributes(
+		attribute.String("saga.name", s.name),
+		attribute.String("saga.step", name),
+		attribute.String("saga.kind", kind),
+	))
+	defer span.End()
+	if err := fn(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
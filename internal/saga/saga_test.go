@@ -0,0 +1,63 @@
+package saga
+
+import (
+	"context"
+	"errors"
+	"github.com/amammay/effectivecloudrun/internal/tracex/tracetest"
+	"go.opentelemetry.io/otel/attribute"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	rec := tracetest.Install(t)
+
+	var undone []string
+	undo := func(name string) Action {
+		return func(ctx context.Context) error {
+			undone = append(undone, name)
+			return nil
+		}
+	}
+	noop := func(ctx context.Context) error { return nil }
+	err := New("order").
+		Step("reserve", noop, undo("reserve")).
+		Step("charge", noop, undo("charge")).
+		Step("ship", func(ctx context.Context) error { return errors.New("no courier") }, undo("ship")).
+		Run(context.Background())
+
+	var sagaErr *Error
+	if !errors.As(err, &sagaErr) || sagaErr.Step != "ship" {
+		t.Fatalf("Run() = %v, want the ship step to fail", err)
+	}
+	if len(undone) != 2 || undone[0] != "charge" || undone[1] != "reserve" {
+		t.Errorf("compensated %v, want charge then reserve", undone)
+	}
+
+	parent := rec.RequireSpan("saga.order")
+	rec.AssertError(parent, "step ship failed")
+	ship := rec.RequireSpan("saga.order.step.ship", attribute.String("saga.kind", "step"))
+	rec.AssertChildOf(ship, parent)
+	rec.AssertError(ship, "no courier")
+	for _, name := range []string{"reserve", "charge"} {
+		rec.AssertOK(rec.RequireSpan("saga.order.step." + name))
+		// compensations run detached from the request but stay in its trace
+		compensation := rec.RequireSpan("saga.order.compensate."+name, attribute.String("saga.step", name))
+		rec.AssertChildOf(compensation, parent)
+	}
+	rec.AssertNoSpan("saga.order.compensate.ship")
+}
+
+func TestRunCompensationFails(t *testing.T) {
+	rec := tracetest.Install(t)
+
+	err := New("order").
+		Step("reserve", func(ctx context.Context) error { return nil }, func(ctx context.Context) error { return errors.New("already shipped") }).
+		Step("charge", func(ctx context.Context) error { return errors.New("card declined") }, nil).
+		Run(context.Background())
+
+	var sagaErr *Error
+	if !errors.As(err, &sagaErr) || sagaErr.CompensationErrs["reserve"] == nil {
+		t.Fatalf("Run() = %v, want the reserve compensation to have failed", err)
+	}
+	rec.AssertError(rec.RequireSpan("saga.order.compensate.reserve"), "already shipped")
+}
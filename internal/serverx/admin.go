@@ -0,0 +1,164 @@
+package serverx
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/buildinfo"
+	"github.com/amammay/effectivecloudrun/internal/configx"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadinessCheck reports if a dependency is ready to serve traffic
+type ReadinessCheck func(ctx context.Context) error
+
+type admin struct {
+	mux    *http.ServeMux
+	server *http.Server
+
+	mu     sync.RWMutex
+	checks map[string]ReadinessCheck
+}
+
+// newAdmin serves our probes on the admin mux too, whichever way it is exposed, the admin /readyz shows why a check
+// failed
+func newAdmin(healthz, readyz http.HandlerFunc) *admin {
+	a := &admin{mux: http.NewServeMux(), checks: map[string]ReadinessCheck{}}
+	a.mux.HandleFunc("/healthz", healthz)
+	a.mux.HandleFunc("/readyz", readyz)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	a.mux.HandleFunc("/version", buildinfo.Handler())
+	return a
+}
+
+// WithAdminAddr serves the admin mux on its own listener, eg "localhost:8081". cloud run only routes traffic to the
+// container PORT so anything else is unreachable from the outside world
+func WithAdminAddr(addr string) Option {
+	return func(s *Server) {
+		s.admin.server = &http.Server{Addr: addr}
+	}
+}
+
+// WithAdminGuard mounts the admin mux on the public server under /admin/, every admin request has to make it past
+// guard first, typically an authx.Verifier middleware
+func WithAdminGuard(guard func(http.Handler) http.Handler) Option {
+	return func(s *Server) {
+		public := s.httpServer.Handler
+		adminHandler := guard(http.StripPrefix("/admin", s.admin.mux))
+		s.httpServer.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if strings.HasPrefix(request.URL.Path, "/admin/") {
+				adminHandler.ServeHTTP(writer, request)
+				return
+			}
+			public.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// WithReadinessCheck adds a named check to /readyz
+func WithReadinessCheck(name string, check ReadinessCheck) Option {
+	return func(s *Server) {
+		s.admin.mu.Lock()
+		defer s.admin.mu.Unlock()
+		s.admin.checks[name] = check
+	}
+}
+
+// WithConfig exposes a redacted dump of our config on /config, and reloads it on a POST to /reload, see
+// configx.Config.ReloadHandler
+func WithConfig(cfg *configx.Config) Option {
+	return func(s *Server) {
+		s.admin.mux.Handle("/reload", cfg.ReloadHandler())
+		s.admin.mux.HandleFunc("/config", func(writer http.ResponseWriter, request *http.Request) {
+			writeJSON(writer, map[string]interface{}{
+				"profile":    cfg.Profile(),
+				"values":     cfg.Redacted(),
+				"provenance": cfg.Provenance(),
+			}, http.StatusOK)
+		})
+	}
+}
+
+// WithLogLevel exposes a zap.AtomicLevel on /loglevel, GET to view and PUT {"level":"debug"} to change
+func WithLogLevel(level http.Handler) Option {
+	return func(s *Server) {
+		s.admin.mux.Handle("/loglevel", level)
+	}
+}
+
+// WithTraceSampling exposes a runtime adjustable sampler (see tracex.Sampler) on /tracing/sampling
+func WithTraceSampling(sampler http.Handler) Option {
+	return func(s *Server) {
+		s.admin.mux.Handle("/tracing/sampling", sampler)
+	}
+}
+
+// AdminHandle registers an additional handler on the admin mux
+func (s *Server) AdminHandle(pattern string, handler http.Handler) {
+	s.admin.mux.Handle(pattern, handler)
+}
+
+func (s *Server) handleHealthz(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+// handleReadyz fails once we start draining or when any registered check fails. the public probe only names the checks
+// that failed, an error can carry hostnames and other internals, the reason is logged and shown on the admin /readyz
+func (s *Server) handleReadyz(writer http.ResponseWriter, request *http.Request) {
+	s.readyz(writer, request, false)
+}
+
+func (s *Server) handleAdminReadyz(writer http.ResponseWriter, request *http.Request) {
+	s.readyz(writer, request, true)
+}
+
+func (s *Server) readyz(writer http.ResponseWriter, request *http.Request, detailed bool) {
+	if s.Draining() {
+		writeJSON(writer, map[string]string{"status": "draining"}, http.StatusServiceUnavailable)
+		return
+	}
+	if !s.warmedUp() {
+		writeJSON(writer, map[string]string{"status": "warming up"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), 2*time.Second)
+	defer cancel()
+
+	s.admin.mu.RLock()
+	defer s.admin.mu.RUnlock()
+	status := http.StatusOK
+	results := make(map[string]string, len(s.admin.checks))
+	for name, check := range s.admin.checks {
+		if err := check(ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			if detailed {
+				results[name] = err.Error()
+				continue
+			}
+			results[name] = "failed"
+			s.logger.Warnw("readiness check failed", "check", name, "err", err)
+			continue
+		}
+		results[name] = "ok"
+	}
+	body := map[string]interface{}{"checks": results}
+	// maintenance mode doesn't fail readiness, as a startup probe that would keep new instances from ever starting
+	if m := s.Maintenance(); m.Enabled {
+		body["maintenance"] = m
+	}
+	writeJSON(writer, body, status)
+}
+
+func writeJSON(writer http.ResponseWriter, data interface{}, statusCode int) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	json.NewEncoder(writer).Encode(data)
+}
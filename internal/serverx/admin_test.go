@@ -0,0 +1,50 @@
+package serverx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzHidesCheckErrors(t *testing.T) {
+	failing := WithReadinessCheck("firestore", func(ctx context.Context) error {
+		return errors.New("dial tcp 10.0.0.7:443: connection refused")
+	})
+	allow := func(next http.Handler) http.Handler { return next }
+	// both ways of exposing the admin mux at once used to register our probes twice
+	s := New("", http.NotFoundHandler(), zap.NewNop().Sugar(), WithAdminAddr("localhost:0"), WithAdminGuard(allow), failing)
+	s.warmup.done = 1
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		want    string
+	}{
+		{name: "public", handler: s.httpServer.Handler, path: "/readyz", want: "failed"},
+		{name: "admin", handler: s.admin.mux, path: "/readyz", want: "dial tcp 10.0.0.7:443: connection refused"},
+		{name: "guarded admin", handler: s.httpServer.Handler, path: "/admin/readyz", want: "dial tcp 10.0.0.7:443: connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, http.StatusServiceUnavailable)
+			}
+			var body struct {
+				Checks map[string]string `json:"checks"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("json.Decode(): %v", err)
+			}
+			if got := body.Checks["firestore"]; got != tt.want {
+				t.Errorf("GET %s firestore = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
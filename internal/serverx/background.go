@@ -0,0 +1,166 @@
+package serverx
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"sync/atomic"
+	"time"
+)
+
+// throttleTick is how often we look for our cpu having been taken away, a tick that comes in more than throttleSlack
+// late slept through time we had no cpu for
+const (
+	throttleTick  = 100 * time.Millisecond
+	throttleSlack = time.Second
+)
+
+// throttleMemory is how long a single throttled stretch keeps us counted as throttled, cloud run only throttles
+// between requests so a busy instance can go a long while without seeing it again
+const throttleMemory = 10 * time.Minute
+
+var backgroundRuns = metric.Must(global.Meter(instrumentationName)).NewInt64Counter(
+	"serverx.background.runs",
+	metric.WithDescription("background task runs by task and outcome, throttled runs were skipped"),
+)
+
+type backgroundTask struct {
+	name     string
+	interval time.Duration
+	fn       func(ctx context.Context) error
+}
+
+// WithBackground runs fn every interval from the moment we listen until we start shutting down, eg to keep a hot
+// cache warm. cloud run only gives an instance cpu outside of requests with --no-cpu-throttling, without it a
+// background loop stalls between requests and then competes with them for the cpu they were given. so runs are
+// skipped while CPUThrottled, work that has to happen anyway should fall back to happening on request
+func WithBackground(name string, interval time.Duration, fn func(ctx context.Context) error) Option {
+	return func(s *Server) {
+		s.background = append(s.background, backgroundTask{name: name, interval: interval, fn: fn})
+	}
+}
+
+// WithDaemon runs fn once from the moment we listen until we start shutting down, for work that holds on to a
+// connection rather than running on an interval, eg a firestore snapshot listener. fn returns once its ctx is done,
+// an error it returns before that is logged and fn isn't started again, retry within fn. like background tasks it
+// only makes progress between requests with --no-cpu-throttling, CPUThrottled tells when it may have fallen behind
+func WithDaemon(name string, fn func(ctx context.Context) error) Option {
+	return func(s *Server) {
+		s.daemons = append(s.daemons, backgroundTask{name: name, fn: fn})
+	}
+}
+
+// CPUThrottled reports if our cpu was taken away between requests within the last 10 minutes. it is only measured
+// while a background task or daemon is registered, and is false until then
+func (s *Server) CPUThrottled() bool {
+	at := atomic.LoadInt64(&s.throttledAt)
+	return at != 0 && time.Since(time.Unix(0, at)) < throttleMemory
+}
+
+// runBackground starts our background tasks, daemons and the throttle detector gating them, they stop once ctx is done
+func (s *Server) runBackground(ctx context.Context) {
+	if len(s.background) == 0 && len(s.daemons) == 0 {
+		return
+	}
+	s.backgroundWG.Add(1)
+	go func() {
+		defer s.backgroundWG.Done()
+		s.detectThrottling(ctx)
+	}()
+	for _, task := range s.background {
+		task := task
+		s.backgroundWG.Add(1)
+		go func() {
+			defer s.backgroundWG.Done()
+			s.runTask(ctx, task)
+		}()
+	}
+	for _, daemon := range s.daemons {
+		daemon := daemon
+		s.backgroundWG.Add(1)
+		go func() {
+			defer s.backgroundWG.Done()
+			if err := daemon.fn(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Errorw("daemon stopped", "daemon", daemon.name, "err", err)
+			}
+		}()
+	}
+}
+
+// waitBackground waits for our background tasks to return after their context was cancelled, at most until ctx is done,
+// and reports if they all did
+func (s *Server) waitBackground(ctx context.Context) bool {
+	if len(s.background) == 0 && len(s.daemons) == 0 {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		s.backgroundWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		s.logger.Warn("background tasks still running after shutdown timeout")
+		return false
+	}
+}
+
+// detectThrottling ticks quickly and takes a tick arriving well past its time as our cpu having been throttled. that
+// only shows once we have cpu again, ie at the start of the next request
+func (s *Server) detectThrottling(ctx context.Context) {
+	ticker := time.NewTicker(throttleTick)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// the time a tick carries is when it was due, not when we got to it
+			now := time.Now()
+			s.noteLateness(now.Sub(last) - throttleTick)
+			last = now
+		}
+	}
+}
+
+// noteLateness records a tick that came in late by late
+func (s *Server) noteLateness(late time.Duration) {
+	if late < throttleSlack {
+		return
+	}
+	if !s.CPUThrottled() {
+		s.logger.Infow("cpu throttled between requests, pausing background tasks", "stalled_ms", late.Milliseconds())
+	}
+	atomic.StoreInt64(&s.throttledAt, time.Now().UnixNano())
+}
+
+func (s *Server) runTask(ctx context.Context, task backgroundTask) {
+	ticker := time.NewTicker(task.interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// our own tick may be the first to notice, the detector wakes up along with us
+			s.noteLateness(time.Since(last) - task.interval)
+		}
+		outcome := "ok"
+		if s.CPUThrottled() {
+			outcome = "throttled"
+		} else if err := task.fn(ctx); err != nil {
+			outcome = "error"
+			if ctx.Err() == nil {
+				s.logger.Warnw("background task failed", "task", task.name, "err", err)
+			}
+		}
+		backgroundRuns.Add(ctx, 1, attribute.String("task", task.name), attribute.String("outcome", outcome))
+		// a run longer than interval has the next tick waiting, which isn't late
+		last = time.Now()
+	}
+}
@@ -0,0 +1,83 @@
+package serverx
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var firstRequestLatency = metric.Must(global.Meter(instrumentationName)).NewFloat64ValueRecorder(
+	"serverx.cold_start.request_latency",
+	metric.WithDescription("latency of the first request an instance served, by how long the instance had been up"),
+	metric.WithUnit("ms"),
+)
+
+var coldStartKey = ctxval.New("serverx.cold_start")
+
+// ColdStart describes the first request an instance served, whoever sent it may well have waited for our container
+// to start. with min instances or a startup probe the instance is usually up long before that
+type ColdStart struct {
+	// SinceStart is how long the process had been running when the request came in
+	SinceStart time.Duration
+}
+
+// ColdStartFromContext reports if the request behind ctx is the first one this instance served
+func ColdStartFromContext(ctx context.Context) (ColdStart, bool) {
+	c, ok := coldStartKey.Value(ctx)
+	if !ok {
+		return ColdStart{}, false
+	}
+	return c.(ColdStart), true
+}
+
+// ColdStartMiddleware marks the span of every request with whether it was our first, it has to run after the
+// middleware that starts the span. the logs of the first request already carry a cold_start label
+func ColdStartMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		span := trace.SpanFromContext(request.Context())
+		if c, ok := ColdStartFromContext(request.Context()); ok {
+			span.SetAttributes(
+				attribute.Bool("cloud_run.cold_start", true),
+				attribute.Int64("process.uptime_ms", c.SinceStart.Milliseconds()),
+			)
+		} else {
+			span.SetAttributes(attribute.Bool("cloud_run.cold_start", false))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// serveFirst wraps the first real request we get, our own warmup requests and probes don't count
+func (s *Server) serveFirst(next http.Handler, writer http.ResponseWriter, request *http.Request) bool {
+	if request.Header.Get(WarmupHeader) != "" || !atomic.CompareAndSwapInt32(&s.servedFirst, 0, 1) {
+		return false
+	}
+
+	start := time.Now()
+	c := ColdStart{SinceStart: start.Sub(processStart)}
+	ctx := coldStartKey.With(request.Context(), c)
+	ctx = logx.ContextWithFields(ctx, zapdriver.Label("cold_start", "true"))
+	next.ServeHTTP(writer, request.WithContext(ctx))
+
+	latency := time.Since(start)
+	uptime := "over_1m"
+	if c.SinceStart < time.Minute {
+		uptime = "under_1m"
+	}
+	firstRequestLatency.Record(ctx, float64(latency)/float64(time.Millisecond), attribute.String("uptime", uptime))
+	recordPhase(ctx, "first_request")
+	s.logger.Infow("first request served",
+		"path", request.URL.Path,
+		"since_start_ms", c.SinceStart.Milliseconds(),
+		"latency_ms", latency.Milliseconds(),
+	)
+	return true
+}
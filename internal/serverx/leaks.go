@@ -0,0 +1,278 @@
+package serverx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LeakSample is one reading of our goroutines and open file descriptors, OpenFDs is -1 where we can't count them
+type LeakSample struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	OpenFDs    int       `json:"open_fds"`
+}
+
+// GoroutineStack is a stack shared by Count goroutines
+type GoroutineStack struct {
+	Count int      `json:"count"`
+	Stack []string `json:"stack"`
+}
+
+// LeakReport is what the detector knows right now, served on /debug/leaks
+type LeakReport struct {
+	Current         LeakSample       `json:"current"`
+	GoroutineGrowth int              `json:"goroutine_growth"`
+	FDGrowth        int              `json:"fd_growth"`
+	Exceeded        []string         `json:"exceeded,omitempty"`
+	Samples         []LeakSample     `json:"samples"`
+	TopStacks       []GoroutineStack `json:"top_stacks"`
+}
+
+// LeakDetector samples our goroutine and file descriptor counts and warns when either is too high or keeps growing.
+// a response body nobody closed keeps its connection, a file descriptor, and the two goroutines of its transport
+// alive, which shows up here as a steady climb with net/http.(*persistConn).readLoop at the top of the stacks
+type LeakDetector struct {
+	logger   *zap.SugaredLogger
+	interval time.Duration
+	window   int
+	now      func() time.Time
+
+	maxGoroutines      int
+	maxGoroutineGrowth int
+	maxFDs             int
+	maxFDGrowth        int
+	topStacks          int
+
+	mu       sync.Mutex
+	samples  []LeakSample
+	lastWarn time.Time
+}
+
+type LeakOption func(d *LeakDetector)
+
+// WithLeakInterval samples every d, defaults to a minute
+func WithLeakInterval(d time.Duration) LeakOption {
+	return func(l *LeakDetector) {
+		l.interval = d
+	}
+}
+
+// WithLeakWindow keeps the last n samples to measure growth over, defaults to 30
+func WithLeakWindow(n int) LeakOption {
+	return func(l *LeakDetector) {
+		l.window = n
+	}
+}
+
+// WithGoroutineThresholds warns above max goroutines or when they grew by more than growth over our window
+func WithGoroutineThresholds(max, growth int) LeakOption {
+	return func(l *LeakDetector) {
+		l.maxGoroutines = max
+		l.maxGoroutineGrowth = growth
+	}
+}
+
+// WithFDThresholds warns above max open file descriptors or when they grew by more than growth over our window
+func WithFDThresholds(max, growth int) LeakOption {
+	return func(l *LeakDetector) {
+		l.maxFDs = max
+		l.maxFDGrowth = growth
+	}
+}
+
+// WithLeakClock replaces time.Now, for the time of each sample
+func WithLeakClock(now func() time.Time) LeakOption {
+	return func(l *LeakDetector) {
+		l.now = now
+	}
+}
+
+func NewLeakDetector(logger *zap.SugaredLogger, opts ...LeakOption) *LeakDetector {
+	d := &LeakDetector{
+		logger:             logger,
+		interval:           time.Minute,
+		window:             30,
+		now:                time.Now,
+		maxGoroutines:      10000,
+		maxGoroutineGrowth: 500,
+		// cloud run allows each container a few thousand file descriptors
+		maxFDs:      2000,
+		maxFDGrowth: 200,
+		topStacks:   5,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	meter := metric.Must(global.Meter(instrumentationName))
+	meter.NewInt64ValueObserver("serverx.goroutines", func(ctx context.Context, result metric.Int64ObserverResult) {
+		result.Observe(int64(runtime.NumGoroutine()))
+	}, metric.WithDescription("goroutines currently running"))
+	meter.NewInt64ValueObserver("serverx.open_fds", func(ctx context.Context, result metric.Int64ObserverResult) {
+		if fds := openFDs(); fds >= 0 {
+			result.Observe(int64(fds))
+		}
+	}, metric.WithDescription("file descriptors our process has open"))
+	return d
+}
+
+// WithLeakDetector samples with d for as long as the server runs and serves its report on /debug/leaks of the admin mux
+func WithLeakDetector(d *LeakDetector) Option {
+	return func(s *Server) {
+		s.leaks = d
+		s.admin.mux.Handle("/debug/leaks", d)
+	}
+}
+
+// Run samples every interval until ctx is done
+func (d *LeakDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	d.Sample()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Sample()
+		}
+	}
+}
+
+// Sample takes a reading and warns, with our top goroutine stacks, when it exceeds any threshold. warnings are
+// spaced at least a window apart
+func (d *LeakDetector) Sample() LeakReport {
+	sample := LeakSample{Time: d.now(), Goroutines: runtime.NumGoroutine(), OpenFDs: openFDs()}
+
+	d.mu.Lock()
+	d.samples = append(d.samples, sample)
+	if len(d.samples) > d.window {
+		d.samples = d.samples[len(d.samples)-d.window:]
+	}
+	report := d.report(sample)
+	warn := len(report.Exceeded) > 0 && sample.Time.Sub(d.lastWarn) >= time.Duration(d.window)*d.interval
+	if warn {
+		d.lastWarn = sample.Time
+	}
+	d.mu.Unlock()
+
+	if warn {
+		report.TopStacks = topGoroutineStacks(d.topStacks)
+		d.logger.Warnw("possible goroutine or file descriptor leak",
+			"exceeded", report.Exceeded,
+			"goroutines", sample.Goroutines,
+			"goroutine_growth", report.GoroutineGrowth,
+			"open_fds", sample.OpenFDs,
+			"fd_growth", report.FDGrowth,
+			"top_stacks", report.TopStacks,
+		)
+	}
+	return report
+}
+
+// report compares sample against the lowest reading in our window, d.mu must be held
+func (d *LeakDetector) report(sample LeakSample) LeakReport {
+	report := LeakReport{Current: sample, Samples: append([]LeakSample(nil), d.samples...)}
+	minGoroutines, minFDs := sample.Goroutines, sample.OpenFDs
+	for _, s := range d.samples {
+		if s.Goroutines < minGoroutines {
+			minGoroutines = s.Goroutines
+		}
+		if s.OpenFDs >= 0 && s.OpenFDs < minFDs {
+			minFDs = s.OpenFDs
+		}
+	}
+	report.GoroutineGrowth = sample.Goroutines - minGoroutines
+	if sample.OpenFDs >= 0 {
+		report.FDGrowth = sample.OpenFDs - minFDs
+	}
+
+	if d.maxGoroutines > 0 && sample.Goroutines > d.maxGoroutines {
+		report.Exceeded = append(report.Exceeded, "goroutines")
+	}
+	if d.maxGoroutineGrowth > 0 && report.GoroutineGrowth > d.maxGoroutineGrowth {
+		report.Exceeded = append(report.Exceeded, "goroutine_growth")
+	}
+	if d.maxFDs > 0 && sample.OpenFDs > d.maxFDs {
+		report.Exceeded = append(report.Exceeded, "open_fds")
+	}
+	if d.maxFDGrowth > 0 && report.FDGrowth > d.maxFDGrowth {
+		report.Exceeded = append(report.Exceeded, "fd_growth")
+	}
+	return report
+}
+
+// ServeHTTP reports the current reading without storing it as a sample, along with our top goroutine stacks
+func (d *LeakDetector) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	sample := LeakSample{Time: d.now(), Goroutines: runtime.NumGoroutine(), OpenFDs: openFDs()}
+	d.mu.Lock()
+	report := d.report(sample)
+	d.mu.Unlock()
+	report.TopStacks = topGoroutineStacks(d.topStacks)
+	writeJSON(writer, report, http.StatusOK)
+}
+
+// openFDs counts /proc/self/fd, -1 off of linux
+func openFDs() int {
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// topGoroutineStacks returns the n stacks shared by the most goroutines, from the aggregated goroutine profile
+func topGoroutineStacks(n int) []GoroutineStack {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+
+	var stacks []GoroutineStack
+	var current *GoroutineStack
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, " @ "):
+			// "<count> @ <pc> <pc> ..." starts a stack
+			count, err := strconv.Atoi(strings.Fields(line)[0])
+			if err != nil {
+				current = nil
+				continue
+			}
+			stacks = append(stacks, GoroutineStack{Count: count})
+			current = &stacks[len(stacks)-1]
+		case strings.HasPrefix(line, "#") && current != nil:
+			// "#\t<pc>\t<function>+<offset>\t<file>:<line>"
+			fields := strings.Fields(line)
+			if len(fields) >= 4 {
+				function := fields[2]
+				if i := strings.LastIndex(function, "+0x"); i > 0 {
+					function = function[:i]
+				}
+				current.Stack = append(current.Stack, function+" "+fields[3])
+			}
+		}
+	}
+
+	sort.SliceStable(stacks, func(i, j int) bool { return stacks[i].Count > stacks[j].Count })
+	if len(stacks) > n {
+		stacks = stacks[:n]
+	}
+	return stacks
+}
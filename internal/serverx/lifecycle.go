@@ -0,0 +1,139 @@
+package serverx
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	instanceStarts = metric.Must(global.Meter(instrumentationName)).NewInt64Counter(
+		"serverx.instance.starts",
+		metric.WithDescription("instances that started serving"),
+	)
+	instanceLifetime = metric.Must(global.Meter(instrumentationName)).NewFloat64ValueRecorder(
+		"serverx.instance.lifetime",
+		metric.WithDescription("how long an instance ran before it was shut down"),
+		metric.WithUnit("s"),
+	)
+	instanceRequests = metric.Must(global.Meter(instrumentationName)).NewInt64ValueRecorder(
+		"serverx.instance.requests",
+		metric.WithDescription("requests an instance served before it was shut down"),
+	)
+)
+
+// WithInstanceID is put on our lifecycle events, pass metadata.InstanceID() on cloud run. defaults to the hostname
+func WithInstanceID(id string) Option {
+	return func(s *Server) {
+		s.instanceID = id
+	}
+}
+
+func (s *Server) instance() string {
+	if s.instanceID != "" {
+		return s.instanceID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// logStarted is our "instance_start" event, together with "instance_stop" it lets a logs based query follow every
+// instance from start until scale in
+func (s *Server) logStarted(ctx context.Context) {
+	instanceStarts.Add(ctx, 1)
+	s.logger.Infow("instance started",
+		"event", "instance_start",
+		"instance_id", s.instance(),
+		"pid", os.Getpid(),
+		"gomaxprocs", runtime.GOMAXPROCS(0),
+		"since_process_start_ms", time.Since(processStart).Milliseconds(),
+	)
+}
+
+// logStopping is our "instance_stop" event, written once we are told to shut down and before we drain so it makes it
+// out even when draining runs out of time
+func (s *Server) logStopping(ctx context.Context, reason string) {
+	lifetime := time.Since(processStart)
+	served := atomic.LoadInt64(&s.served)
+	instanceLifetime.Record(ctx, lifetime.Seconds())
+	instanceRequests.Record(ctx, served)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s.logger.Infow("instance stopping",
+		"event", "instance_stop",
+		"instance_id", s.instance(),
+		"reason", reason,
+		"lifetime_s", int64(lifetime.Seconds()),
+		"requests_served", served,
+		"peak_rss_bytes", peakRSS(),
+		"go_sys_bytes", mem.Sys,
+	)
+}
+
+// shutdownReport is our "shutdown_report" event, a single entry written once everything has run that says how an
+// instance went away, so scale in can be audited instance by instance rather than pieced together from the entries
+// of each step
+type shutdownReport struct {
+	signal  string
+	started time.Time
+	// inFlight is how many requests were in flight when we were told to stop, aborted how many still were once our
+	// drain timeout was up
+	inFlight       int64
+	aborted        int64
+	drain          time.Duration
+	backgroundDone bool
+	hooks          []stepResult
+	flushes        []stepResult
+}
+
+// stepResult is how a shutdown hook or flush went
+type stepResult struct {
+	Name   string `json:"name"`
+	TookMS int64  `json:"took_ms"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newStepResult(name string, started time.Time, err error) stepResult {
+	r := stepResult{Name: name, TookMS: time.Since(started).Milliseconds()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// log writes the report, as a warning when any request was aborted or any step didn't finish. it goes out after our
+// telemetry was flushed, it only needs stdout
+func (r *shutdownReport) log(logger *zap.SugaredLogger, instanceID string) {
+	clean := r.aborted == 0 && r.backgroundDone
+	for _, step := range append(append([]stepResult{}, r.hooks...), r.flushes...) {
+		clean = clean && step.Error == ""
+	}
+	drained := r.inFlight - r.aborted
+	if drained < 0 {
+		drained = 0
+	}
+	write := logger.Infow
+	if !clean {
+		write = logger.Warnw
+	}
+	write("shutdown report",
+		"event", "shutdown_report",
+		"instance_id", instanceID,
+		"signal", r.signal,
+		"clean", clean,
+		"drain_ms", r.drain.Milliseconds(),
+		"requests_in_flight", r.inFlight,
+		"requests_drained", drained,
+		"requests_aborted", r.aborted,
+		"background_finished", r.backgroundDone,
+		"hooks", r.hooks,
+		"flushes", r.flushes,
+		"total_ms", time.Since(r.started).Milliseconds(),
+	)
+}
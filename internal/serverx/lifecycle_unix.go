@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package serverx
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// peakRSS is the most memory our process has had resident, what cloud run holds against our memory limit
+func peakRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	// linux reports kilobytes, darwin bytes
+	if runtime.GOOS == "darwin" {
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) * 1024
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package serverx
+
+// peakRSS isn't implemented on windows, cloud run only runs linux containers
+func peakRSS() int64 {
+	return 0
+}
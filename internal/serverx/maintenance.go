@@ -0,0 +1,110 @@
+package serverx
+
+import (
+	"encoding/json"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var maintenanceRejects = metric.Must(global.Meter(instrumentationName)).NewInt64Counter(
+	"serverx.maintenance.rejects",
+	metric.WithDescription("requests turned away while we were in maintenance mode"),
+)
+
+// Maintenance is the maintenance mode of our server, served and changed on the admin /maintenance endpoint
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// RetryAfter is what we tell clients about when to come back, in seconds
+	RetryAfter int `json:"retry_after_seconds,omitempty"`
+	// Since is when maintenance mode was turned on, nil while it is off
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// WithMaintenanceAllow keeps paths reachable in maintenance mode, eg /version, our probes and the admin endpoints
+// always are
+func WithMaintenanceAllow(paths ...string) Option {
+	return func(s *Server) {
+		if s.maintenanceAllow == nil {
+			s.maintenanceAllow = map[string]bool{}
+		}
+		for _, path := range paths {
+			s.maintenanceAllow[path] = true
+		}
+	}
+}
+
+// SetMaintenance turns maintenance mode on or off. while it is on every public request gets a 503 with a Retry-After
+// of retryAfter, 0 defaults to a minute
+func (s *Server) SetMaintenance(enabled bool, reason string, retryAfter time.Duration) {
+	m := &Maintenance{}
+	if enabled {
+		if retryAfter <= 0 {
+			retryAfter = time.Minute
+		}
+		since := time.Now()
+		m = &Maintenance{Enabled: true, Reason: reason, RetryAfter: int(math.Ceil(retryAfter.Seconds())), Since: &since}
+		// turning it on again keeps when it started
+		if current := s.Maintenance(); current.Enabled {
+			m.Since = current.Since
+		}
+	}
+	previous := s.Maintenance()
+	s.maintenance.Store(m)
+	if previous.Enabled == m.Enabled {
+		return
+	}
+	if m.Enabled {
+		s.logger.Warnw("maintenance mode on", "event", "maintenance_start", "reason", reason, "retry_after_s", m.RetryAfter)
+		return
+	}
+	s.logger.Infow("maintenance mode off", "event", "maintenance_end", "lasted_s", int64(time.Since(*previous.Since).Seconds()))
+}
+
+// Maintenance returns our current maintenance mode
+func (s *Server) Maintenance() Maintenance {
+	if m, ok := s.maintenance.Load().(*Maintenance); ok {
+		return *m
+	}
+	return Maintenance{}
+}
+
+// rejectMaintenance answers request with a 503 when we are in maintenance mode and it isn't allowed through
+func (s *Server) rejectMaintenance(writer http.ResponseWriter, request *http.Request) bool {
+	m := s.Maintenance()
+	if !m.Enabled || s.maintenanceAllow[request.URL.Path] {
+		return false
+	}
+	maintenanceRejects.Add(request.Context(), 1)
+	writer.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+	message := "down for maintenance, retry after the Retry-After header"
+	if m.Reason != "" {
+		message = "down for maintenance: " + m.Reason
+	}
+	httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "maintenance", Message: message}, http.StatusServiceUnavailable)
+	return true
+}
+
+// handleMaintenance serves our maintenance mode on GET and changes it on PUT, eg
+// {"enabled":true,"reason":"migrating notes","retry_after_seconds":300}
+func (s *Server) handleMaintenance(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var m Maintenance
+		if err := json.NewDecoder(request.Body).Decode(&m); err != nil {
+			writeJSON(writer, map[string]string{"error": "body has to be a json object with enabled, reason and retry_after_seconds"}, http.StatusBadRequest)
+			return
+		}
+		s.SetMaintenance(m.Enabled, m.Reason, time.Duration(m.RetryAfter)*time.Second)
+	default:
+		writeJSON(writer, map[string]string{"error": "GET or PUT"}, http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(writer, s.Maintenance(), http.StatusOK)
+}
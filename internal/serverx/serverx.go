@@ -0,0 +1,282 @@
+package serverx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server wraps the graceful shutdown dance shown in cmd/graceful so every example handles SIGTERM the same way
+type Server struct {
+	// served counts requests that made it past our probes, first in the struct to keep it 64 bit aligned for atomics
+	served int64
+	// inFlight counts the requests served is counting that haven't returned yet
+	inFlight int64
+	// throttledAt is when we last noticed our cpu was throttled in unix nanos, 0 when we never did
+	throttledAt int64
+
+	httpServer      *http.Server
+	logger          *zap.SugaredLogger
+	shutdownTimeout time.Duration
+	shutdownHooks   []shutdownHook
+	flushes         []flush
+	instanceID      string
+
+	admin  *admin
+	warmup warmup
+	leaks  *LeakDetector
+
+	background   []backgroundTask
+	daemons      []backgroundTask
+	backgroundWG sync.WaitGroup
+
+	// maintenance holds a *Maintenance, see SetMaintenance
+	maintenance      atomic.Value
+	maintenanceAllow map[string]bool
+
+	// draining flips to 1 once we receive a shutdown signal so /readyz starts failing
+	draining int32
+	// servedFirst flips to 1 once the first request that isn't a probe or warmup comes in
+	servedFirst int32
+}
+
+type Option func(s *Server)
+
+// WithShutdownTimeout controls how long in flight requests have to complete, cloud run gives us 10 seconds after SIGTERM
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// New creates our server listening on addr, if addr is empty we fall back to the PORT env variable cloud run sets
+func New(addr string, handler http.Handler, logger *zap.SugaredLogger, opts ...Option) *Server {
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		addr = ":" + port
+	}
+	s := &Server{
+		logger:          logger,
+		shutdownTimeout: 9 * time.Second,
+	}
+	s.admin = newAdmin(s.handleHealthz, s.handleAdminReadyz)
+	s.admin.mux.HandleFunc("/maintenance", s.handleMaintenance)
+	s.httpServer = &http.Server{Addr: addr, Handler: s.publicHandler(handler)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type flush struct {
+	name    string
+	timeout time.Duration
+	fn      func(ctx context.Context) error
+}
+
+// WithFlush runs fn last as we shut down, with timeout of its own for telemetry that has to leave the instance before
+// it is gone, eg the last interval of metrics. its timeout is taken out of the shutdown timeout before requests
+// drain, a slow drain or hook can't leave it without time. flushes run in the order they were added
+func WithFlush(name string, timeout time.Duration, fn func(ctx context.Context) error) Option {
+	return func(s *Server) {
+		s.flushes = append(s.flushes, flush{name: name, timeout: timeout, fn: fn})
+	}
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// OnShutdown registers a hook that runs after the http server has drained, hooks run in the order they were added.
+// the shutdown report names it by its position, see OnShutdownNamed
+func (s *Server) OnShutdown(fn func(ctx context.Context) error) {
+	s.OnShutdownNamed(fmt.Sprintf("hook_%d", len(s.shutdownHooks)+1), fn)
+}
+
+// OnShutdownNamed is OnShutdown with the name its outcome is reported under in the shutdown report
+func (s *Server) OnShutdownNamed(name string, fn func(ctx context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// publicHandler serves our probes ahead of the application router, cloud run startup and liveness probes can only
+// target the container port
+func (s *Server) publicHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/healthz":
+			s.handleHealthz(writer, request)
+		case "/readyz":
+			s.handleReadyz(writer, request)
+		default:
+			if s.rejectMaintenance(writer, request) {
+				return
+			}
+			atomic.AddInt64(&s.served, 1)
+			atomic.AddInt64(&s.inFlight, 1)
+			defer atomic.AddInt64(&s.inFlight, -1)
+			if !s.serveFirst(next, writer, request) {
+				next.ServeHTTP(writer, request)
+			}
+		}
+	})
+}
+
+// ListenAndServe blocks until we receive SIGINT/SIGTERM and the server has been shutdown
+func (s *Server) ListenAndServe() error {
+	// create our base context to work with, cancelled once we start shutting down
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	s.httpServer.BaseContext = func(listener net.Listener) context.Context { return ctx }
+	s.httpServer.RegisterOnShutdown(cancelFunc)
+
+	// setup our shutdown signal
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(
+		shutdown,
+		os.Interrupt,    // Capture ctrl + c events (SIGINT)
+		syscall.SIGTERM, // Capture actual sig term event (kill command).
+	)
+	defer signal.Stop(shutdown)
+
+	g, gctx := errgroup.WithContext(ctx)
+	if s.admin.server != nil {
+		adminServer := s.admin.server
+		adminServer.Handler = s.admin.mux
+		g.Go(func() error {
+			s.logger.Infof("starting admin server on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return fmt.Errorf("adminServer.ListenAndServe(): %v", err)
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		var reason string
+		select {
+		case o := <-shutdown:
+			s.logger.Infof("sig: %s - starting shutting down sequence...", o)
+			reason = o.String()
+		case <-gctx.Done():
+			s.logger.Info("server context cancelled - starting shutting down sequence...")
+			reason = "context cancelled"
+		}
+		s.logStopping(ctx, reason)
+		atomic.StoreInt32(&s.draining, 1)
+		report := &shutdownReport{signal: reason, started: time.Now(), inFlight: atomic.LoadInt64(&s.inFlight), hooks: []stepResult{}}
+		defer report.log(s.logger, s.instance())
+
+		// we need to use a fresh context.Background() because the parent ctx will be cancelled during Shutdown
+		graceFull, cancel := context.WithTimeout(context.Background(), s.drainTimeout())
+		defer cancel()
+		// requests still running past our timeout don't get to keep our hooks and flushes from running
+		var hookErr error
+		if err := s.httpServer.Shutdown(graceFull); err != nil {
+			s.logger.Errorw("requests still in flight after shutdown timeout", "err", err)
+			hookErr = fmt.Errorf("httpServer.Shutdown(): %w", err)
+			report.aborted = atomic.LoadInt64(&s.inFlight)
+		} else {
+			s.logger.Info("server has shutdown gracefully")
+		}
+		report.drain = time.Since(report.started)
+		// ctx was cancelled by Shutdown, hooks may close what our background tasks use once they returned
+		report.backgroundDone = s.waitBackground(graceFull)
+
+		for _, hook := range s.shutdownHooks {
+			started := time.Now()
+			err := hook.fn(graceFull)
+			report.hooks = append(report.hooks, newStepResult(hook.name, started, err))
+			if err != nil {
+				s.logger.Errorw("shutdown hook failed", "hook", hook.name, "err", err)
+				hookErr = err
+			}
+		}
+		if s.admin.server != nil {
+			if err := s.admin.server.Shutdown(graceFull); err != nil {
+				hookErr = fmt.Errorf("adminServer.Shutdown(): %w", err)
+			}
+		}
+		var flushErr error
+		if report.flushes, flushErr = s.runFlushes(); flushErr != nil {
+			hookErr = flushErr
+		}
+		return hookErr
+	})
+
+	// binding the listener ourselves lets us start warming up the moment we can accept connections
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		cancelFunc()
+		g.Wait()
+		return fmt.Errorf("net.Listen(): %v", err)
+	}
+	s.logStarted(ctx)
+	if s.leaks != nil {
+		go s.leaks.Run(ctx)
+	}
+	go s.runWarmup(ctx, listener.Addr())
+	s.runBackground(ctx)
+
+	s.logger.Infof("starting server on %s", s.httpServer.Addr)
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		cancelFunc()
+		g.Wait()
+		return fmt.Errorf("httpServer.Serve(): %v", err)
+	}
+	return g.Wait()
+}
+
+// drainTimeout is what is left of our shutdown timeout for requests and hooks once our flushes have theirs, at least
+// a second
+func (s *Server) drainTimeout() time.Duration {
+	d := s.shutdownTimeout
+	for _, f := range s.flushes {
+		d -= f.timeout
+	}
+	if d < time.Second {
+		s.logger.Warnw("flush timeouts leave less than a second of the shutdown timeout to drain", "shutdown_timeout", s.shutdownTimeout.String())
+		d = time.Second
+	}
+	return d
+}
+
+// runFlushes runs our flushes one after the other, each within its own timeout, and returns how each went along with
+// the last error
+func (s *Server) runFlushes() ([]stepResult, error) {
+	var flushErr error
+	results := make([]stepResult, 0, len(s.flushes))
+	for _, f := range s.flushes {
+		// each flush gets its time however long the ones before it took
+		ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+		started := time.Now()
+		err := f.fn(ctx)
+		cancel()
+		results = append(results, newStepResult(f.name, started, err))
+		if err != nil {
+			s.logger.Errorw("flush failed", "flush", f.name, "took", time.Since(started).String(), "err", err)
+			flushErr = fmt.Errorf("flush %s: %w", f.name, err)
+			continue
+		}
+		s.logger.Infow("flushed", "flush", f.name, "took", time.Since(started).String())
+	}
+	return results, flushErr
+}
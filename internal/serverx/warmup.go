@@ -0,0 +1,149 @@
+package serverx
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/serverx"
+
+// WarmupHeader is set on every synthetic warmup request so handlers and access logs can tell them apart
+const WarmupHeader = "X-Serverx-Warmup"
+
+// processStart is as close to process start as we can get without asking the os
+var processStart = time.Now()
+
+var coldStart = metric.Must(global.Meter(instrumentationName)).NewFloat64ValueRecorder(
+	"serverx.cold_start",
+	metric.WithDescription("time from process start until each cold start phase completed"),
+	metric.WithUnit("ms"),
+)
+
+// WarmupFunc primes a dependency, eg minting a token or opening a firestore channel
+type WarmupFunc func(ctx context.Context) error
+
+type warmup struct {
+	funcs   []namedWarmup
+	paths   []string
+	timeout time.Duration
+	done    int32
+}
+
+type namedWarmup struct {
+	name string
+	fn   WarmupFunc
+}
+
+// WithWarmup runs fn right after our listener is bound, /readyz reports not ready until every warmup has finished so
+// a startup probe pointed at /readyz holds real traffic back until then
+func WithWarmup(name string, fn WarmupFunc) Option {
+	return func(s *Server) {
+		s.warmup.funcs = append(s.warmup.funcs, namedWarmup{name: name, fn: fn})
+	}
+}
+
+// WithWarmupRequests fires a GET at each path through our own listener, exercising the full middleware stack along
+// with whatever connection pools and caches the handlers touch
+func WithWarmupRequests(paths ...string) Option {
+	return func(s *Server) {
+		s.warmup.paths = append(s.warmup.paths, paths...)
+	}
+}
+
+// WithWarmupTimeout bounds the whole warmup phase, defaults to 10 seconds
+func WithWarmupTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.warmup.timeout = d
+	}
+}
+
+func (s *Server) warmedUp() bool {
+	return atomic.LoadInt32(&s.warmup.done) == 1
+}
+
+func recordPhase(ctx context.Context, phase string) time.Duration {
+	elapsed := time.Since(processStart)
+	coldStart.Record(ctx, float64(elapsed)/float64(time.Millisecond), attribute.String("phase", phase))
+	return elapsed
+}
+
+// runWarmup is called once our listener is bound, failures are logged but never stop the server from serving
+func (s *Server) runWarmup(ctx context.Context, addr net.Addr) {
+	defer atomic.StoreInt32(&s.warmup.done, 1)
+
+	bound := recordPhase(ctx, "listening")
+	if len(s.warmup.funcs) == 0 && len(s.warmup.paths) == 0 {
+		s.logger.Infow("cold start", "listening_ms", bound.Milliseconds())
+		return
+	}
+
+	timeout := s.warmup.timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make(map[string]string, len(s.warmup.funcs)+len(s.warmup.paths))
+	for _, w := range s.warmup.funcs {
+		start := time.Now()
+		if err := w.fn(ctx); err != nil {
+			results[w.name] = fmt.Sprintf("error after %s: %v", time.Since(start), err)
+			continue
+		}
+		results[w.name] = time.Since(start).String()
+	}
+
+	base := loopbackURL(addr)
+	client := &http.Client{Timeout: timeout}
+	for _, path := range s.warmup.paths {
+		start := time.Now()
+		if err := warmupRequest(ctx, client, base+path); err != nil {
+			results[path] = fmt.Sprintf("error after %s: %v", time.Since(start), err)
+			continue
+		}
+		results[path] = time.Since(start).String()
+	}
+
+	warm := recordPhase(ctx, "warm")
+	s.logger.Infow("cold start",
+		"listening_ms", bound.Milliseconds(),
+		"warm_ms", warm.Milliseconds(),
+		"warmups", results,
+	)
+}
+
+func warmupRequest(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	req.Header.Set(WarmupHeader, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("client.Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func loopbackURL(addr net.Addr) string {
+	port := "8080"
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		port = fmt.Sprint(tcp.Port)
+	}
+	return "http://127.0.0.1:" + port
+}
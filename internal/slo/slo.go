@@ -0,0 +1,161 @@
+package slo
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/slo"
+
+// Windows are the burn rate windows we precompute, pairs of them (5m/1h and 30m/6h) make up the multiwindow alerts
+// recommended by the google sre workbook
+var Windows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+const bucketWidth = time.Minute
+
+// Objective is what a route promises, a request is good when it did not fail with a 5xx and, if Latency is set,
+// finished within Latency. Target is the fraction of good requests we aim for, eg 0.995
+type Objective struct {
+	Name    string
+	Latency time.Duration
+	Target  float64
+}
+
+// Tracker counts good and bad events per objective and keeps enough per minute history to report burn rates
+type Tracker struct {
+	mu      sync.Mutex
+	windows map[string]*window
+	now     func() time.Time
+
+	events metric.Int64Counter
+}
+
+func NewTracker() *Tracker {
+	t := &Tracker{windows: map[string]*window{}, now: time.Now}
+	meter := metric.Must(global.Meter(instrumentationName))
+	t.events = meter.NewInt64Counter("slo.events", metric.WithDescription("slo events by objective, good or bad"))
+	// burn rate is the rate we are spending error budget at, 1 means we use exactly the budget over the slo period
+	meter.NewFloat64ValueObserver("slo.burn_rate", func(ctx context.Context, result metric.Float64ObserverResult) {
+		for _, rate := range t.BurnRates() {
+			result.Observe(rate.Rate, attribute.String("slo", rate.Objective), attribute.String("window", rate.Window.String()))
+		}
+	}, metric.WithDescription("per instance error budget burn rate by objective and window"))
+	return t
+}
+
+// Track wraps next so every request counts against each of objectives
+func (t *Tracker) Track(next http.Handler, objectives ...Objective) http.Handler {
+	t.mu.Lock()
+	for _, o := range objectives {
+		if _, ok := t.windows[o.Name]; !ok {
+			t.windows[o.Name] = newWindow(o)
+		}
+	}
+	t.mu.Unlock()
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := t.now()
+		wrapped, rec := httpx.Record(writer, 0)
+		next.ServeHTTP(wrapped, request)
+		elapsed := t.now().Sub(start)
+
+		for _, o := range objectives {
+			good := rec.Status < http.StatusInternalServerError && (o.Latency <= 0 || elapsed <= o.Latency)
+			t.Observe(request.Context(), o.Name, good)
+		}
+	})
+}
+
+// Observe records a single event, useful for work that doesn't go through Track such as background jobs
+func (t *Tracker) Observe(ctx context.Context, objective string, good bool) {
+	t.mu.Lock()
+	w, ok := t.windows[objective]
+	if ok {
+		w.add(t.now(), good)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	t.events.Add(ctx, 1, attribute.String("slo", objective), attribute.Bool("good", good))
+}
+
+// BurnRate is the burn rate of one objective over one window
+type BurnRate struct {
+	Objective string        `json:"objective"`
+	Window    time.Duration `json:"window"`
+	Good      int64         `json:"good"`
+	Bad       int64         `json:"bad"`
+	Rate      float64       `json:"rate"`
+}
+
+// BurnRates computes every objective over every window in Windows
+func (t *Tracker) BurnRates() []BurnRate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	rates := make([]BurnRate, 0, len(t.windows)*len(Windows))
+	for name, w := range t.windows {
+		for _, d := range Windows {
+			good, bad := w.sum(now, d)
+			rate := BurnRate{Objective: name, Window: d, Good: good, Bad: bad}
+			if total := good + bad; total > 0 && w.objective.Target < 1 {
+				rate.Rate = (float64(bad) / float64(total)) / (1 - w.objective.Target)
+			}
+			rates = append(rates, rate)
+		}
+	}
+	return rates
+}
+
+// ServeHTTP reports our current burn rates, handy to mount on the admin server
+func (t *Tracker) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	httpx.RespondJSON(writer, t.BurnRates(), http.StatusOK)
+}
+
+type bucket struct {
+	minute    int64
+	good, bad int64
+}
+
+// window is a ring of per minute buckets long enough to cover our largest window
+type window struct {
+	objective Objective
+	buckets   []bucket
+}
+
+func newWindow(o Objective) *window {
+	longest := Windows[len(Windows)-1]
+	return &window{objective: o, buckets: make([]bucket, int(longest/bucketWidth))}
+}
+
+func (w *window) add(now time.Time, good bool) {
+	minute := now.Unix() / int64(bucketWidth/time.Second)
+	b := &w.buckets[minute%int64(len(w.buckets))]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+	if good {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+func (w *window) sum(now time.Time, d time.Duration) (good, bad int64) {
+	current := now.Unix() / int64(bucketWidth/time.Second)
+	oldest := current - int64(d/bucketWidth) + 1
+	for _, b := range w.buckets {
+		if b.minute >= oldest && b.minute <= current {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return good, bad
+}
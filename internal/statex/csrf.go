@@ -0,0 +1,170 @@
+package statex
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"net/http"
+	"strings"
+)
+
+const (
+	// CSRFHeader carries the token of a state changing request made from javascript
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField carries the token of a form post
+	CSRFField = "csrf_token"
+)
+
+// csrfKey shows that a request has a token in a ctxval.Dump, never the token
+var csrfKey = ctxval.NewString("statex.csrf_token", ctxval.Redacted())
+
+// CSRFToken returns the token CSRF.Middleware handed our request, for the hidden CSRFField of the forms we render
+func CSRFToken(ctx context.Context) string {
+	token, _ := csrfKey.Value(ctx)
+	return token
+}
+
+// CSRF keeps other sites from making a browser change state with its session cookie. a token is a random nonce
+// signed along with the session id, so it is only good for the session it was handed to and any instance holding
+// the secret can check it without storing anything. the token is handed out in a cookie javascript can read, and has
+// to come back in CSRFHeader or the CSRFField of a form, which a cross site request can't do since it can't read
+// our cookies
+type CSRF struct {
+	secret []byte
+	cookie string
+	exempt func(request *http.Request) bool
+
+	checks metric.Int64Counter
+}
+
+type CSRFOption func(c *CSRF)
+
+// WithCSRFCookie names the cookie tokens are handed out in, defaults to "csrf_token"
+func WithCSRFCookie(name string) CSRFOption {
+	return func(c *CSRF) {
+		c.cookie = name
+	}
+}
+
+// WithCSRFExempt leaves the state changing requests exempt returns true for unchecked, eg webhooks that carry a
+// signature of their own. requests with an Authorization header are always exempt, browsers never add one on their
+// own and a page of another site can't add one without our cors allowing it
+func WithCSRFExempt(exempt func(request *http.Request) bool) CSRFOption {
+	return func(c *CSRF) {
+		c.exempt = exempt
+	}
+}
+
+// NewCSRF signs tokens with secret, every instance has to share it, eg from secret manager
+func NewCSRF(secret []byte, opts ...CSRFOption) *CSRF {
+	c := &CSRF{
+		secret: secret,
+		cookie: "csrf_token",
+		exempt: func(*http.Request) bool { return false },
+		checks: metric.Must(global.Meter(instrumentationName)).NewInt64Counter("statex.csrf.checks",
+			metric.WithDescription("state changing requests checked for a csrf token by outcome, ok, exempt, missing or invalid")),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// sign is the mac of nonce for the session id
+func (c *CSRF) sign(sessionID, nonce string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(sessionID + "." + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newToken returns a fresh token for the session id, "<hex nonce>.<hex hmac-sha256>"
+func (c *CSRF) newToken(sessionID string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read(): %v", err)
+	}
+	nonce := hex.EncodeToString(b)
+	return nonce + "." + c.sign(sessionID, nonce), nil
+}
+
+// valid reports if token was handed to the session id
+func (c *CSRF) valid(sessionID, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(c.sign(sessionID, parts[0])))
+}
+
+// Middleware hands every request a token of its session and checks the token of state changing ones, anything but
+// GET, HEAD, OPTIONS and TRACE, rejecting those without a valid one with a 403. it runs inside Store.Middleware,
+// whose session the tokens are bound to, a client that loses its session cookie loses its token with it
+func (c *CSRF) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		session := FromContext(ctx)
+		if session == nil {
+			httpx.RespondError(writer, request, errs.New(errs.Internal, "statex: CSRF.Middleware runs outside of Store.Middleware"))
+			return
+		}
+
+		token := ""
+		if cookie, err := request.Cookie(c.cookie); err == nil && c.valid(session.ID, cookie.Value) {
+			token = cookie.Value
+		} else {
+			if token, err = c.newToken(session.ID); err != nil {
+				httpx.RespondError(writer, request, errs.Wrapf(err, errs.Internal, "c.newToken()"))
+				return
+			}
+			// not HttpOnly, our own javascript reads it to send it back in CSRFHeader
+			http.SetCookie(writer, &http.Cookie{
+				Name:     c.cookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		request = request.WithContext(csrfKey.With(ctx, token))
+
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if request.Header.Get("Authorization") != "" || c.exempt(request) {
+			c.checks.Add(ctx, 1, attribute.String("outcome", "exempt"))
+			next.ServeHTTP(writer, request)
+			return
+		}
+		sent := request.Header.Get(CSRFHeader)
+		if sent == "" {
+			sent = request.PostFormValue(CSRFField)
+		}
+		outcome := "ok"
+		switch {
+		case sent == "":
+			outcome = "missing"
+		case !c.valid(session.ID, sent):
+			outcome = "invalid"
+		}
+		c.checks.Add(ctx, 1, attribute.String("outcome", outcome))
+		if outcome != "ok" {
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{
+				Code:    "csrf_" + outcome,
+				Message: "a state changing request needs the token of its session in the " + CSRFHeader + " header or the " + CSRFField + " field",
+			}, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,42 @@
+package statex
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type firestoreBackend struct {
+	collection *firestore.CollectionRef
+	newValue   func() interface{}
+}
+
+// Firestore stores a document per session in collection, newValue is what documents are decoded into and has to be
+// the same as the one passed to New
+func Firestore(client *firestore.Client, collection string, newValue func() interface{}) Backend {
+	return &firestoreBackend{collection: client.Collection(collection), newValue: newValue}
+}
+
+func (b *firestoreBackend) Load(ctx context.Context, id string) (interface{}, error) {
+	snapshot, err := b.collection.Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Get(): %v", err)
+	}
+	value := b.newValue()
+	if err := snapshot.DataTo(value); err != nil {
+		return nil, fmt.Errorf("snapshot.DataTo(): %v", err)
+	}
+	return value, nil
+}
+
+func (b *firestoreBackend) Save(ctx context.Context, id string, value interface{}) error {
+	if _, err := b.collection.Doc(id).Set(ctx, value); err != nil {
+		return fmt.Errorf("Set(): %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package statex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/statex"
+
+// AffinityCookie is the cookie cloud run sets once session affinity is turned on with --session-affinity, it sends
+// the client back to the instance that served it for as long as that instance is around. it is set by the platform
+// and missing on the first request, so our sessions are keyed by a cookie of our own that lives alongside it
+const AffinityCookie = "GAESA"
+
+// ErrNotFound is returned by a Backend that has nothing stored for a session, the session starts out empty
+var ErrNotFound = errors.New("statex: session not found")
+
+// Backend is where sessions live once they leave our memory, Load rebuilds a session another instance served
+type Backend interface {
+	Load(ctx context.Context, id string) (interface{}, error)
+	Save(ctx context.Context, id string, value interface{}) error
+}
+
+// Session is the state of one client on this instance, only touch its value through View and Update
+type Session struct {
+	ID string
+
+	mu       sync.Mutex
+	value    interface{}
+	dirty    bool
+	lastUsed time.Time
+	// ready is closed once value was loaded, err is why it couldn't be
+	ready chan struct{}
+	err   error
+}
+
+// View calls fn with the session value, fn must not hold on to it
+func (s *Session) View(fn func(value interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.value)
+}
+
+// Update calls fn with the session value and marks the session for saving unless fn fails
+func (s *Session) Update(fn func(value interface{}) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := fn(s.value); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+// Store keeps sessions in memory on the instance session affinity pins them to. affinity is best effort, a client
+// moves to another instance when we scale in, get replaced or are busy, and that instance rebuilds the session from
+// the backend. changes are written behind every interval and when we drain, so a client that moves sees what we saved
+// last and a crash loses at most one interval of changes
+type Store struct {
+	backend  Backend
+	newValue func() interface{}
+	logger   *zap.SugaredLogger
+	now      func() time.Time
+
+	cookie      string
+	idleTTL     time.Duration
+	maxSessions int
+	interval    time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+
+	lookups metric.Int64Counter
+	saves   metric.Int64Counter
+}
+
+type Option func(s *Store)
+
+// WithCookie names the cookie our session id lives in, defaults to "session"
+func WithCookie(name string) Option {
+	return func(s *Store) {
+		s.cookie = name
+	}
+}
+
+// WithIdleTTL drops sessions from memory once they weren't used for d, defaults to 30 minutes. match it to the
+// cookie ttl of cloud run's affinity, past it the client is likely to land elsewhere anyway
+func WithIdleTTL(d time.Duration) Option {
+	return func(s *Store) {
+		s.idleTTL = d
+	}
+}
+
+// WithMaxSessions keeps at most n sessions in memory, the least recently used go first. defaults to 10000
+func WithMaxSessions(n int) Option {
+	return func(s *Store) {
+		s.maxSessions = n
+	}
+}
+
+// WithWriteBehind saves changed sessions and evicts idle ones every d, defaults to 30 seconds
+func WithWriteBehind(d time.Duration) Option {
+	return func(s *Store) {
+		s.interval = d
+	}
+}
+
+// WithLogger logs sessions we failed to save
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// WithClock replaces time.Now, for tests stepping through idle ttls
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// New keeps sessions whose values come from newValue, a pointer to an empty value a Backend can decode into
+func New(backend Backend, newValue func() interface{}, opts ...Option) *Store {
+	meter := metric.Must(global.Meter(instrumentationName))
+	s := &Store{
+		backend:     backend,
+		newValue:    newValue,
+		logger:      zap.NewNop().Sugar(),
+		now:         time.Now,
+		cookie:      "session",
+		idleTTL:     30 * time.Minute,
+		maxSessions: 10000,
+		interval:    30 * time.Second,
+		sessions:    map[string]*Session{},
+		lookups:     meter.NewInt64Counter("statex.lookups", metric.WithDescription("session lookups by whether memory had them, a high rebuilt rate means affinity isn't holding")),
+		saves:       meter.NewInt64Counter("statex.saves", metric.WithDescription("sessions written to the backend by reason and outcome")),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	meter.NewInt64ValueObserver("statex.sessions", func(ctx context.Context, result metric.Int64ObserverResult) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		result.Observe(int64(len(s.sessions)))
+	}, metric.WithDescription("sessions held in memory"))
+	return s
+}
+
+// Get returns session id from memory, rebuilding it from the backend on a miss. concurrent misses for the same
+// session share a single load
+func (s *Store) Get(ctx context.Context, id string) (*Session, error) {
+	return s.get(ctx, id, true)
+}
+
+// get is Get, without create an id neither we nor the backend know is an ErrNotFound instead of a new session
+func (s *Store) get(ctx context.Context, id string, create bool) (*Session, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &Session{ID: id, ready: make(chan struct{})}
+		s.sessions[id] = session
+	}
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case <-session.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if session.err != nil {
+			return nil, session.err
+		}
+		// touching it under our lock keeps evict from dropping it in between, if it already did we load it again
+		s.mu.Lock()
+		current := s.sessions[id] == session
+		if current {
+			session.mu.Lock()
+			session.lastUsed = s.now()
+			session.mu.Unlock()
+		}
+		s.mu.Unlock()
+		if !current {
+			return s.get(ctx, id, create)
+		}
+		s.lookups.Add(ctx, 1, attribute.String("outcome", "hit"))
+		return session, nil
+	}
+
+	outcome := "rebuilt"
+	value, err := s.backend.Load(ctx, id)
+	switch {
+	case errors.Is(err, ErrNotFound) && !create:
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+		session.err = fmt.Errorf("%w: %s", ErrNotFound, id)
+		close(session.ready)
+		s.lookups.Add(ctx, 1, attribute.String("outcome", "unknown"))
+		return nil, session.err
+	case errors.Is(err, ErrNotFound):
+		outcome, value, err = "new", s.newValue(), nil
+	}
+	if err != nil {
+		// the next request for this session tries again
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+		session.err = fmt.Errorf("backend.Load(%s): %v", id, err)
+		close(session.ready)
+		return nil, session.err
+	}
+	session.value = value
+	session.lastUsed = s.now()
+	close(session.ready)
+	s.lookups.Add(ctx, 1, attribute.String("outcome", outcome))
+	return session, nil
+}
+
+// Flush saves every changed session, register it with serverx.Server.OnShutdown so sessions survive us draining
+func (s *Store) Flush(ctx context.Context) error {
+	return s.save(ctx, "flush", s.loaded())
+}
+
+// Run saves changed sessions and evicts idle ones every interval until ctx is done
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.save(ctx, "write_behind", s.loaded()); err != nil {
+				s.logger.Warnw("saving sessions", "err", err)
+			}
+			s.evict(ctx)
+		}
+	}
+}
+
+// loaded returns the sessions that finished loading
+func (s *Store) loaded() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		select {
+		case <-session.ready:
+			sessions = append(sessions, session)
+		default:
+		}
+	}
+	return sessions
+}
+
+// save writes the changed ones among sessions and returns the first error, the ones that failed stay dirty. the
+// session is locked while it is written, a request for it waits rather than changing what is being encoded
+func (s *Store) save(ctx context.Context, reason string, sessions []*Session) error {
+	var firstErr error
+	for _, session := range sessions {
+		session.mu.Lock()
+		if !session.dirty {
+			session.mu.Unlock()
+			continue
+		}
+		err := s.backend.Save(ctx, session.ID, session.value)
+		if err == nil {
+			session.dirty = false
+		}
+		session.mu.Unlock()
+
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+			if firstErr == nil {
+				firstErr = fmt.Errorf("backend.Save(%s): %v", session.ID, err)
+			}
+		}
+		s.saves.Add(ctx, 1, attribute.String("reason", reason), attribute.String("outcome", outcome))
+	}
+	return firstErr
+}
+
+// evict drops sessions idle for longer than our ttl, and the least recently used ones past maxSessions. a session is
+// only dropped once it was saved
+func (s *Store) evict(ctx context.Context) {
+	sessions := s.loaded()
+	lastUsed := make(map[*Session]time.Time, len(sessions))
+	for _, session := range sessions {
+		session.mu.Lock()
+		lastUsed[session] = session.lastUsed
+		session.mu.Unlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool { return lastUsed[sessions[i]].After(lastUsed[sessions[j]]) })
+
+	cutoff := s.now().Add(-s.idleTTL)
+	var evicted []*Session
+	for i, session := range sessions {
+		if i >= s.maxSessions || lastUsed[session].Before(cutoff) {
+			evicted = append(evicted, session)
+		}
+	}
+	if err := s.save(ctx, "evict", evicted); err != nil {
+		s.logger.Warnw("saving evicted sessions", "err", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range evicted {
+		session.mu.Lock()
+		// it may have been used or changed while we were saving
+		if !session.dirty && session.lastUsed.Equal(lastUsed[session]) {
+			delete(s.sessions, session.ID)
+		}
+		session.mu.Unlock()
+	}
+}
+
+// sessionKey shows the id of a session in a ctxval.Dump, never its value
+var sessionKey = ctxval.New("statex.session", ctxval.WithFormat(func(v interface{}) string {
+	return "id=" + v.(*Session).ID
+}))
+
+// FromContext returns the session Middleware loaded for our request, nil outside of it
+func FromContext(ctx context.Context) *Session {
+	session, _ := sessionKey.Value(ctx)
+	s, _ := session.(*Session)
+	return s
+}
+
+// Middleware loads the session of every request, handing out a new session id to clients without one. a client
+// presenting an id we never handed out, or one whose session is gone, gets a new id too, so nobody can plant an id of
+// their choosing on a victim and share the session it ends up with
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		var session *Session
+		var err error
+		if cookie, cookieErr := request.Cookie(s.cookie); cookieErr == nil && cookie.Value != "" {
+			session, err = s.get(ctx, cookie.Value, false)
+		} else {
+			err = ErrNotFound
+		}
+		if errors.Is(err, ErrNotFound) {
+			session, err = s.issue(ctx, writer)
+		}
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "s.get()"))
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(sessionKey.With(ctx, session)))
+	})
+}
+
+// issue starts a session under an id of our own making and hands it to the client
+func (s *Store) issue(ctx context.Context, writer http.ResponseWriter) (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errs.Wrapf(err, errs.Internal, "rand.Read()")
+	}
+	id := hex.EncodeToString(b)
+	session, err := s.get(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(writer, &http.Cookie{
+		Name:     s.cookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session, nil
+}
@@ -0,0 +1,80 @@
+package statex
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// memoryBackend keeps saved sessions in a map, like firestore would across instances
+type memoryBackend struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func (b *memoryBackend) Load(ctx context.Context, id string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value, ok := b.values[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (b *memoryBackend) Save(ctx context.Context, id string, value interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values[id] = value
+	return nil
+}
+
+func TestMiddlewareIssuesSessionIDs(t *testing.T) {
+	backend := &memoryBackend{values: map[string]interface{}{"saved-elsewhere": &[]string{"hello"}}}
+	store := New(backend, func() interface{} { return &[]string{} })
+	var seen string
+	handler := store.Middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		seen = FromContext(request.Context()).ID
+	}))
+	serve := func(cookie string) (string, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		var issued string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "session" {
+				issued = c.Value
+			}
+		}
+		return seen, issued
+	}
+
+	first, issued := serve("")
+	if issued == "" || first != issued {
+		t.Fatalf("a client without a session got session %q and cookie %q, want a new id for both", first, issued)
+	}
+	if again, reissued := serve(first); again != first || reissued != "" {
+		t.Errorf("a client with our id got session %q and cookie %q, want %q and no new cookie", again, reissued, first)
+	}
+	if rebuilt, reissued := serve("saved-elsewhere"); rebuilt != "saved-elsewhere" || reissued != "" {
+		t.Errorf("a client with a saved session got session %q and cookie %q, want saved-elsewhere and no new cookie", rebuilt, reissued)
+	}
+
+	// an id picked by someone else, eg planted on a victim, is replaced rather than adopted
+	planted, issued := serve("attacker-chosen")
+	if planted == "attacker-chosen" || issued == "" || planted != issued {
+		t.Errorf("a client with an unknown id got session %q and cookie %q, want a new id for both", planted, issued)
+	}
+	if again, _ := serve("attacker-chosen"); again == "attacker-chosen" {
+		t.Errorf("an unknown id was adopted once it had been seen")
+	}
+}
@@ -0,0 +1,166 @@
+package tenantx
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/authx"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DefaultHeader is checked by FromHeader when no header name is given
+const DefaultHeader = "X-Tenant-ID"
+
+// ErrNoTenant is returned when no source produced a tenant id
+var ErrNoTenant = errors.New("tenantx: no tenant on request")
+
+// validID keeps tenant ids safe to use as a firestore document id, a log label and a metric dimension
+var validID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+var tenantKey = ctxval.NewString("tenantx.tenant")
+
+// FromContext returns the tenant id stored by Middleware
+func FromContext(ctx context.Context) (string, bool) {
+	return tenantKey.Value(ctx)
+}
+
+// WithTenant stores id in ctx and adds it to our log labels and the current span
+func WithTenant(ctx context.Context, id string) context.Context {
+	ctx = tenantKey.With(ctx, id)
+	ctx = logx.ContextWithFields(ctx, zapdriver.Label("tenant", id))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("tenant.id", id))
+	return ctx
+}
+
+// Labels returns the tenant as a metric dimension, empty when there is no tenant. only use it with a bounded number
+// of tenants, every tenant is its own time series
+func Labels(ctx context.Context) []attribute.KeyValue {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return []attribute.KeyValue{attribute.String("tenant", id)}
+}
+
+// Collection scopes a collection to the tenant in ctx as tenants/{id}/{name}, keeping every tenant's data under its
+// own document so security rules and exports can be done per tenant
+func Collection(ctx context.Context, client *firestore.Client, name string) (*firestore.CollectionRef, error) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	return client.Collection("tenants").Doc(id).Collection(name), nil
+}
+
+// Source extracts a tenant id from a request, returning "" when it has nothing to say
+type Source func(r *http.Request) string
+
+// FromHost uses the first label of the host when it ends in domain, eg acme.example.com with domain example.com
+func FromHost(domain string) Source {
+	suffix := "." + strings.TrimPrefix(strings.ToLower(domain), ".")
+	return func(r *http.Request) string {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		sub := strings.TrimSuffix(host, suffix)
+		if strings.Contains(sub, ".") {
+			return ""
+		}
+		return sub
+	}
+}
+
+// FromHeader reads the tenant from header, defaults to DefaultHeader. only trust it behind something that sets or
+// strips the header, such as an api gateway
+func FromHeader(header string) Source {
+	if header == "" {
+		header = DefaultHeader
+	}
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// FromVerifiedHeader is FromHeader for requests authx.Verifier.Middleware verified the caller of, eg our api gateway's
+// service account picking the tenant it authenticated. the header of a request without verified claims is ignored,
+// anyone can send one
+func FromVerifiedHeader(header string) Source {
+	fromHeader := FromHeader(header)
+	return func(r *http.Request) string {
+		if _, ok := authx.ClaimsFromContext(r.Context()); !ok {
+			return ""
+		}
+		return fromHeader(r)
+	}
+}
+
+// NewHeaderVerifier verifies the callers FromVerifiedHeader takes a tenant from. any google identity can mint a token
+// for audience, so a verifier that doesn't name its callers would let anyone pick a tenant and is never built
+func NewHeaderVerifier(ctx context.Context, audience string, callers ...string) (*authx.Verifier, error) {
+	var emails []string
+	for _, caller := range callers {
+		if caller = strings.TrimSpace(caller); caller != "" {
+			emails = append(emails, caller)
+		}
+	}
+	if len(emails) == 0 {
+		return nil, fmt.Errorf("NewHeaderVerifier(): the callers allowed to pick a tenant are required")
+	}
+	return authx.NewVerifier(ctx, audience, authx.WithAllowedEmails(emails...))
+}
+
+// FromClaim reads a string claim of the identity token verified by authx.Verifier.Middleware
+func FromClaim(claim string) Source {
+	return func(r *http.Request) string {
+		claims, ok := authx.ClaimsFromContext(r.Context())
+		if !ok {
+			return ""
+		}
+		id, _ := claims.Raw[claim].(string)
+		return id
+	}
+}
+
+// Resolve asks each source in order and returns the first valid tenant id
+func Resolve(r *http.Request, sources ...Source) (string, error) {
+	for _, source := range sources {
+		id := strings.ToLower(strings.TrimSpace(source(r)))
+		if id == "" {
+			continue
+		}
+		if !validID.MatchString(id) {
+			return "", errs.New(errs.InvalidArgument, "invalid tenant id")
+		}
+		return id, nil
+	}
+	return "", errs.New(errs.InvalidArgument, "missing tenant id")
+}
+
+// Middleware rejects requests without a tenant, every request that makes it through has its tenant in the context
+func Middleware(sources ...Source) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			id, err := Resolve(request, sources...)
+			if err != nil {
+				httpx.RespondError(writer, request, err)
+				return
+			}
+			next.ServeHTTP(writer, request.WithContext(WithTenant(request.Context(), id)))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package testinfra
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ProjectID is the project every emulator client uses, emulators accept any project id
+const ProjectID = "testinfra"
+
+// how long we give an emulator to start, the first start downloads nothing but still has to boot a jvm
+const startTimeout = time.Minute
+
+// emulator is one gcloud emulator, either started by us or found through its *_EMULATOR_HOST env variable
+type emulator struct {
+	name    string
+	hostEnv string
+
+	once sync.Once
+	host string
+	err  error
+	cmd  *exec.Cmd
+	logs bytes.Buffer
+}
+
+var (
+	firestoreEmulator = &emulator{name: "firestore", hostEnv: "FIRESTORE_EMULATOR_HOST"}
+	pubsubEmulator    = &emulator{name: "pubsub", hostEnv: "PUBSUB_EMULATOR_HOST"}
+)
+
+// start connects to an already running emulator when its env variable is set, otherwise starts one with gcloud. an
+// emulator is started at most once per test binary and shared by every test, Stop shuts it down
+func (e *emulator) start() (string, error) {
+	e.once.Do(func() {
+		if host := os.Getenv(e.hostEnv); host != "" {
+			e.host = host
+			e.err = waitReady(host)
+			return
+		}
+		if _, err := exec.LookPath("gcloud"); err != nil {
+			e.err = fmt.Errorf("testinfra: %s is not set and gcloud is not installed", e.hostEnv)
+			return
+		}
+		host, err := freeHostPort()
+		if err != nil {
+			e.err = err
+			return
+		}
+
+		// ctxlint:ignore the emulator outlives the test that starts it, Stop ends it
+		e.cmd = exec.Command("gcloud", "beta", "emulators", e.name, "start", "--host-port="+host, "--project="+ProjectID, "--quiet")
+		e.cmd.Stdout = &e.logs
+		e.cmd.Stderr = &e.logs
+		setProcessGroup(e.cmd)
+		if err := e.cmd.Start(); err != nil {
+			e.err = fmt.Errorf("e.cmd.Start(): %v", err)
+			return
+		}
+		if err := waitReady(host); err != nil {
+			e.stop()
+			e.err = fmt.Errorf("%v, emulator output:\n%s", err, e.logs.String())
+			return
+		}
+		e.host = host
+		// the client libraries find the emulator through this, including clients created by the code under test
+		os.Setenv(e.hostEnv, host)
+	})
+	return e.host, e.err
+}
+
+func (e *emulator) stop() {
+	if e.cmd == nil || e.cmd.Process == nil {
+		return
+	}
+	// gcloud starts the emulator as a child java process, so we signal the whole process group
+	killProcessGroup(e.cmd)
+	e.cmd.Wait()
+	e.cmd = nil
+}
+
+// Stop shuts down every emulator we started, call it from TestMain after m.Run. emulators we merely connected to are
+// left running
+//
+//	func TestMain(m *testing.M) {
+//		code := m.Run()
+//		testinfra.Stop()
+//		os.Exit(code)
+//	}
+func Stop() {
+	firestoreEmulator.stop()
+	pubsubEmulator.stop()
+}
+
+// waitReady polls the emulator until it answers, both emulators respond with "Ok" on /
+func waitReady(host string) error {
+	// bounded by startTimeout alone, starting is shared by every test waiting on it
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/", nil)
+		if err != nil {
+			return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("testinfra: emulator on %s did not become ready within %s", host, startTimeout)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func freeHostPort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("net.Listen(): %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -0,0 +1,86 @@
+package testinfra
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Firestore returns a client for the firestore emulator, starting the emulator if needed. the test is skipped when no
+// emulator is available. every document is deleted when the test finishes, so tests using Firestore must not run in
+// parallel with each other
+func Firestore(tb testing.TB) *firestore.Client {
+	tb.Helper()
+	host, err := firestoreEmulator.start()
+	if err != nil {
+		tb.Skipf("firestore emulator unavailable: %v", err)
+	}
+
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, ProjectID)
+	if err != nil {
+		tb.Fatalf("firestore.NewClient(): %v", err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		if err := ResetFirestore(ctx, host); err != nil {
+			tb.Errorf("ResetFirestore(): %v", err)
+		}
+	})
+	return client
+}
+
+// ResetFirestore deletes every document in the emulator
+func ResetFirestore(ctx context.Context, host string) error {
+	url := fmt.Sprintf("http://%s/emulator/v1/projects/%s/databases/(default)/documents", host, ProjectID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.DefaultClient.Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("testinfra: resetting firestore emulator: %s", resp.Status)
+	}
+	return nil
+}
+
+// Seed writes fixtures keyed by document path, eg "beer/ipa", in a single batch
+func Seed(tb testing.TB, client *firestore.Client, fixtures map[string]interface{}) {
+	tb.Helper()
+	if len(fixtures) == 0 {
+		return
+	}
+	batch := client.Batch()
+	for path, data := range fixtures {
+		if strings.Count(strings.Trim(path, "/"), "/")%2 != 1 {
+			tb.Fatalf("testinfra: %q is not a document path", path)
+		}
+		batch.Set(client.Doc(strings.Trim(path, "/")), data)
+	}
+	if _, err := batch.Commit(context.Background()); err != nil {
+		tb.Fatalf("batch.Commit(): %v", err)
+	}
+}
+
+// SeedFile seeds the fixtures in a json file shaped like {"beer/ipa": {"name": "..."}}, usually kept in testdata
+func SeedFile(tb testing.TB, client *firestore.Client, path string) {
+	tb.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("ioutil.ReadFile(): %v", err)
+	}
+	fixtures := map[string]interface{}{}
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		tb.Fatalf("json.Unmarshal(%s): %v", path, err)
+	}
+	Seed(tb, client, fixtures)
+}
@@ -0,0 +1,11 @@
+package testinfra
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
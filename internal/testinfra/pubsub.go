@@ -0,0 +1,69 @@
+package testinfra
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the pubsub emulator has no reset endpoint, every test gets uniquely named topics instead
+var topicSeq int64
+
+// PubSub returns a client for the pubsub emulator, starting the emulator if needed. the test is skipped when no
+// emulator is available
+func PubSub(tb testing.TB) *pubsub.Client {
+	tb.Helper()
+	if _, err := pubsubEmulator.start(); err != nil {
+		tb.Skipf("pubsub emulator unavailable: %v", err)
+	}
+	client, err := pubsub.NewClient(context.Background(), ProjectID)
+	if err != nil {
+		tb.Fatalf("pubsub.NewClient(): %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Topic creates a topic named after name and the test, with a subscription of the same name, both are deleted when
+// the test finishes
+func Topic(tb testing.TB, client *pubsub.Client, name string) (*pubsub.Topic, *pubsub.Subscription) {
+	tb.Helper()
+	ctx := context.Background()
+	id := uniqueID(tb, name)
+
+	topic, err := client.CreateTopic(ctx, id)
+	if err != nil {
+		tb.Fatalf("client.CreateTopic(%s): %v", id, err)
+	}
+	sub, err := client.CreateSubscription(ctx, id, pubsub.SubscriptionConfig{Topic: topic, AckDeadline: 10 * time.Second})
+	if err != nil {
+		tb.Fatalf("client.CreateSubscription(%s): %v", id, err)
+	}
+	tb.Cleanup(func() {
+		sub.Delete(ctx)
+		topic.Stop()
+		topic.Delete(ctx)
+	})
+	return topic, sub
+}
+
+// uniqueID builds a valid topic id, letters first and at most 255 characters
+func uniqueID(tb testing.TB, name string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, tb.Name())
+	id := fmt.Sprintf("t-%s-%s-%d", name, clean, atomic.AddInt64(&topicSeq, 1))
+	if len(id) > 255 {
+		id = id[len(id)-255:]
+		id = "t" + id[1:]
+	}
+	return id
+}
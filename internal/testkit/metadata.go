@@ -0,0 +1,90 @@
+package testkit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Metadata describes the instance our fake metadata server pretends to be
+type Metadata struct {
+	ProjectID      string
+	NumericProject string
+	Region         string
+	InstanceID     string
+	ServiceAccount string
+	// IDToken is handed out for every audience, AccessToken for every scope
+	IDToken     string
+	AccessToken string
+}
+
+// DefaultMetadata is a plausible cloud run instance in us-central1
+func DefaultMetadata() Metadata {
+	return Metadata{
+		ProjectID:      "testkit-project",
+		NumericProject: "123456789012",
+		Region:         "us-central1",
+		InstanceID:     "00bf4bf02d",
+		ServiceAccount: "testkit@testkit-project.iam.gserviceaccount.com",
+		IDToken:        "testkit-id-token",
+		AccessToken:    "testkit-access-token",
+	}
+}
+
+// FakeMetadata starts a metadata server answering like the one on cloud run and points GCE_METADATA_HOST at it, which
+// also makes metadata.OnGCE report true. the metadata package caches some values for the life of the process, so use
+// the same Metadata in every test of a package
+func FakeMetadata(tb testing.TB, md Metadata) *httptest.Server {
+	tb.Helper()
+	values := map[string]string{
+		"project/project-id":                                        md.ProjectID,
+		"project/numeric-project-id":                                md.NumericProject,
+		"instance/region":                                           fmt.Sprintf("projects/%s/regions/%s", md.NumericProject, md.Region),
+		"instance/zone":                                             fmt.Sprintf("projects/%s/zones/%s-1", md.NumericProject, md.Region),
+		"instance/id":                                               md.InstanceID,
+		"instance/service-accounts/default/email":                   md.ServiceAccount,
+		"instance/service-accounts/default/identity":                md.IDToken,
+		"instance/service-accounts/default/aliases":                 "default",
+		"instance/service-accounts/default/scopes":                  "https://www.googleapis.com/auth/cloud-platform",
+		"instance/service-accounts/default/token":                   fmt.Sprintf(`{"access_token":%q,"expires_in":3599,"token_type":"Bearer"}`, md.AccessToken),
+		"instance/service-accounts/" + md.ServiceAccount + "/token": fmt.Sprintf(`{"access_token":%q,"expires_in":3599,"token_type":"Bearer"}`, md.AccessToken),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(writer, "missing Metadata-Flavor header", http.StatusForbidden)
+			return
+		}
+		key := strings.Trim(strings.TrimPrefix(request.URL.Path, "/computeMetadata/v1/"), "/")
+		value, ok := values[key]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Header().Set("Metadata-Flavor", "Google")
+		if strings.HasSuffix(key, "/token") {
+			writer.Header().Set("Content-Type", "application/json")
+		}
+		fmt.Fprint(writer, value)
+	}))
+	tb.Cleanup(srv.Close)
+
+	setenv(tb, "GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	return srv
+}
+
+// setenv sets key for the rest of the test, testing.T.Setenv only arrived in go 1.17
+func setenv(tb testing.TB, key, value string) {
+	previous, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	tb.Cleanup(func() {
+		if had {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
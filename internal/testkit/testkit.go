@@ -0,0 +1,182 @@
+// Package testkit runs our example servers in process and checks a request end to end, the http response as well as
+// the logs and spans it produced, correlated through the trace header cloud run would have sent
+//
+//	func TestHTTP(t *testing.T) {
+//		kit := testkit.New(t, "testkit-project")
+//		kit.Serve(newServer(kit.Logger, cfg, fs, bin, writes))
+//
+//		trace := testkit.NewTrace(true)
+//		resp, _ := kit.Get("/api/http", trace.CloudTraceContext())
+//		kit.AssertStatus(resp, http.StatusOK)
+//		kit.AssertLogsCorrelated(trace)
+//		kit.AssertSpansIn(trace)
+//	}
+package testkit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	cloudprop "github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/logx/logtest"
+	"github.com/amammay/effectivecloudrun/internal/tracex/tracetest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Kit is one test's view of a server, its logger and its recorded spans
+type Kit struct {
+	tb        testing.TB
+	projectID string
+
+	// Logger captures everything the server logs, hand it to the server under test
+	Logger *logx.AppLogger
+	Logs   *logtest.Capture
+	Spans  *tracetest.Recorder
+	Server *httptest.Server
+}
+
+// New installs a span recorder, the same propagators our examples use and a capturing logger
+func New(tb testing.TB, projectID string) *Kit {
+	tb.Helper()
+	spans := tracetest.Install(tb)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		cloudprop.CloudTraceFormatPropagator{},
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	logger, logs := logtest.New(tb, projectID)
+	return &Kit{tb: tb, projectID: projectID, Logger: logger, Logs: logs, Spans: spans}
+}
+
+// Serve starts handler on a local httptest server, it is closed when the test finishes
+func (k *Kit) Serve(handler http.Handler) *Kit {
+	k.Server = httptest.NewServer(handler)
+	k.tb.Cleanup(k.Server.Close)
+	return k
+}
+
+// Header is applied to a request before it is sent
+type Header func(r *http.Request)
+
+// WithHeader sets any header, eg an Authorization header
+func WithHeader(key, value string) Header {
+	return func(r *http.Request) {
+		r.Header.Set(key, value)
+	}
+}
+
+// Do sends req to our server and reads the whole body, the returned response body can be read again
+func (k *Kit) Do(req *http.Request, headers ...Header) (*http.Response, []byte) {
+	k.tb.Helper()
+	for _, h := range headers {
+		h(req)
+	}
+	resp, err := k.Server.Client().Do(req)
+	if err != nil {
+		k.tb.Fatalf("k.Server.Client().Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		k.tb.Fatalf("ioutil.ReadAll(): %v", err)
+	}
+	return resp, body
+}
+
+// Get sends a GET for path
+func (k *Kit) Get(path string, headers ...Header) (*http.Response, []byte) {
+	k.tb.Helper()
+	req, err := http.NewRequest(http.MethodGet, k.Server.URL+path, nil)
+	if err != nil {
+		k.tb.Fatalf("http.NewRequest(): %v", err)
+	}
+	return k.Do(req, headers...)
+}
+
+// AssertStatus fails the test when resp doesn't have status code
+func (k *Kit) AssertStatus(resp *http.Response, code int) {
+	k.tb.Helper()
+	if resp.StatusCode != code {
+		k.tb.Errorf("%s %s responded %d, expected %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, code)
+	}
+}
+
+// AssertLogsCorrelated fails the test unless something was logged and every entry carries the trace of t, which is
+// what makes cloud logging nest the entries under the request
+func (k *Kit) AssertLogsCorrelated(t Trace) {
+	k.tb.Helper()
+	entries := k.Logs.Entries()
+	if len(entries) == 0 {
+		k.tb.Errorf("nothing was logged")
+	}
+	want := fmt.Sprintf("projects/%s/traces/%s", k.projectID, t.TraceID)
+	for _, entry := range entries {
+		if got := entry["logging.googleapis.com/trace"]; got != want {
+			k.tb.Errorf("log entry %q has trace %v, expected %s", entry["message"], got, want)
+		}
+	}
+}
+
+// AssertSpansIn fails the test unless spans were recorded and all of them belong to the trace of t
+func (k *Kit) AssertSpansIn(t Trace) {
+	k.tb.Helper()
+	spans := k.Spans.Spans()
+	if len(spans) == 0 {
+		k.tb.Errorf("no spans were recorded")
+	}
+	for _, span := range spans {
+		if got := span.SpanContext().TraceID().String(); got != t.TraceID {
+			k.tb.Errorf("span %q is in trace %s, expected %s", span.Name(), got, t.TraceID)
+		}
+	}
+}
+
+// Trace is a synthetic incoming trace, as the cloud run frontend would have started it
+type Trace struct {
+	// TraceID is 32 lowercase hex characters
+	TraceID string
+	// SpanID is the 64 bit id of the caller's span
+	SpanID  uint64
+	Sampled bool
+}
+
+// NewTrace returns a random trace
+func NewTrace(sampled bool) Trace {
+	var b [16]byte
+	rand.Read(b[:])
+	var s [8]byte
+	rand.Read(s[:])
+	spanID := uint64(0)
+	for _, c := range s {
+		spanID = spanID<<8 | uint64(c)
+	}
+	if spanID == 0 {
+		spanID = 1
+	}
+	return Trace{TraceID: hex.EncodeToString(b[:]), SpanID: spanID, Sampled: sampled}
+}
+
+// CloudTraceContext sends the trace as X-Cloud-Trace-Context, TRACE_ID/SPAN_ID;o=OPTIONS with a decimal span id
+func (t Trace) CloudTraceContext() Header {
+	o := "0"
+	if t.Sampled {
+		o = "1"
+	}
+	return WithHeader("X-Cloud-Trace-Context", t.TraceID+"/"+strconv.FormatUint(t.SpanID, 10)+";o="+o)
+}
+
+// Traceparent sends the trace as a w3c traceparent header, 00-TRACE_ID-SPAN_ID-FLAGS with a hex span id
+func (t Trace) Traceparent() Header {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return WithHeader("traceparent", fmt.Sprintf("00-%s-%016x-%s", t.TraceID, t.SpanID, flags))
+}
@@ -0,0 +1,141 @@
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/amammay/effectivecloudrun/internal/metadatax"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net/http"
+	"testing"
+)
+
+// newHandler is the smallest server shaped like our examples, otelhttp continues the incoming trace and the handler
+// logs through the trace of its request
+func newHandler(logger *logx.AppLogger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(writer http.ResponseWriter, request *http.Request) {
+		logger.WrapTraceContext(request.Context()).Infow("saying hello", "path", request.URL.Path)
+		fmt.Fprint(writer, "hello")
+	})
+	return otelhttp.NewHandler(mux, "testkit")
+}
+
+func TestKit(t *testing.T) {
+	tests := []struct {
+		name   string
+		header func(Trace) Header
+	}{
+		{name: "cloud_trace_context", header: Trace.CloudTraceContext},
+		{name: "traceparent", header: Trace.Traceparent},
+	}
+	for _, tt := range tests {
+		for _, sampled := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s_sampled_%t", tt.name, sampled), func(t *testing.T) {
+				kit := New(t, "testkit-project")
+				kit.Serve(newHandler(kit.Logger))
+
+				trace := NewTrace(sampled)
+				resp, body := kit.Get("/hello", tt.header(trace))
+				kit.AssertStatus(resp, http.StatusOK)
+				if string(body) != "hello" {
+					t.Errorf("body = %q, want hello", body)
+				}
+				kit.AssertLogsCorrelated(trace)
+				kit.AssertSpansIn(trace)
+			})
+		}
+	}
+}
+
+// recordingTB records the failures of our assertions instead of failing the test
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestKitAssertionsFail(t *testing.T) {
+	kit := New(t, "testkit-project")
+	kit.Serve(newHandler(kit.Logger))
+
+	resp, _ := kit.Get("/hello", NewTrace(true).CloudTraceContext())
+
+	// the request ran in its own trace, so every assertion about another trace has to fail
+	rec := &recordingTB{TB: t}
+	kit.tb = rec
+	other := NewTrace(true)
+	kit.AssertStatus(resp, http.StatusNotFound)
+	kit.AssertLogsCorrelated(other)
+	kit.AssertSpansIn(other)
+	kit.tb = t
+
+	if len(rec.errors) != 3 {
+		t.Errorf("assertions reported %d failures, want 3: %v", len(rec.errors), rec.errors)
+	}
+}
+
+func TestTraceHeaders(t *testing.T) {
+	trace := Trace{TraceID: "105445aa7843bc8bf206b12000100000", SpanID: 0x1a2b3c, Sampled: true}
+	tests := []struct {
+		name   string
+		header Header
+		key    string
+		want   string
+	}{
+		{name: "cloud_trace_context", header: trace.CloudTraceContext(), key: "X-Cloud-Trace-Context", want: "105445aa7843bc8bf206b12000100000/1715004;o=1"},
+		{name: "traceparent", header: trace.Traceparent(), key: "traceparent", want: "00-105445aa7843bc8bf206b12000100000-00000000001a2b3c-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+			tt.header(req)
+			if got := req.Header.Get(tt.key); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	if NewTrace(false).TraceID == NewTrace(false).TraceID {
+		t.Errorf("NewTrace() returned the same trace id twice")
+	}
+}
+
+func TestFakeMetadata(t *testing.T) {
+	md := DefaultMetadata()
+	FakeMetadata(t, md)
+	ctx := context.Background()
+
+	projectID, err := metadatax.ProjectID(ctx)
+	if err != nil {
+		t.Fatalf("metadatax.ProjectID(): %v", err)
+	}
+	if projectID != md.ProjectID {
+		t.Errorf("metadatax.ProjectID() = %q, want %q", projectID, md.ProjectID)
+	}
+
+	region, err := metadatax.Region(ctx)
+	if err != nil {
+		t.Fatalf("metadatax.Region(): %v", err)
+	}
+	if region != md.Region {
+		t.Errorf("metadatax.Region() = %q, want %q", region, md.Region)
+	}
+
+	token, err := metadatax.Get(ctx, "instance/service-accounts/default/identity?audience=https://example.com")
+	if err != nil {
+		t.Fatalf("metadatax.Get(): %v", err)
+	}
+	if token != md.IDToken {
+		t.Errorf("identity token = %q, want %q", token, md.IDToken)
+	}
+
+	if _, err := metadatax.Get(ctx, "instance/attributes/missing"); err == nil {
+		t.Errorf("metadatax.Get() of an unknown key succeeded")
+	}
+}
@@ -0,0 +1,94 @@
+package tracex
+
+import (
+	"context"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/logx"
+	"github.com/blendle/zapdriver"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// DebugTraceHeader forces a trace and debug logs for a single request, its value is made by httpx.SignDebugHeader for
+// the method and path of that request
+const DebugTraceHeader = "X-Debug-Trace"
+
+var forcedKey = ctxval.NewBool("tracex.forced_sampling")
+
+// ContextWithForcedSampling has a ForceSampler record and sample every span started under ctx
+func ContextWithForcedSampling(ctx context.Context) context.Context {
+	return forcedKey.With(ctx, true)
+}
+
+// Forced reports if ctx is under ContextWithForcedSampling, eg a request Debug.Middleware let through
+func Forced(ctx context.Context) bool {
+	return forcedKey.Value(ctx)
+}
+
+type forceSampler struct {
+	delegate sdktrace.Sampler
+}
+
+// ForceSampler samples spans started under ContextWithForcedSampling, even when their parent wasn't sampled, and
+// leaves everything else to delegate
+func ForceSampler(delegate sdktrace.Sampler) sdktrace.Sampler {
+	return &forceSampler{delegate: delegate}
+}
+
+func (s *forceSampler) ShouldSample(parameters sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if Forced(parameters.ParentContext) {
+		return sdktrace.SamplingResult{
+			Decision:   sdktrace.RecordAndSample,
+			Tracestate: trace.SpanContextFromContext(parameters.ParentContext).TraceState(),
+		}
+	}
+	return s.delegate.ShouldSample(parameters)
+}
+
+func (s *forceSampler) Description() string {
+	return "ForceSampler{" + s.delegate.Description() + "}"
+}
+
+// Debug lets whoever holds our secret trace a single request in full, sampled whatever our ratio and logging at
+// debug whatever our level, without turning either up for everyone else
+type Debug struct {
+	secret []byte
+	now    func() time.Time
+}
+
+type DebugOption func(d *Debug)
+
+// WithDebugClock replaces time.Now, for checking the age of the signed header
+func WithDebugClock(now func() time.Time) DebugOption {
+	return func(d *Debug) {
+		d.now = now
+	}
+}
+
+// NewDebug accepts headers signed with secret, an empty secret turns forced tracing off
+func NewDebug(secret []byte, opts ...DebugOption) *Debug {
+	d := &Debug{secret: secret, now: time.Now}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Middleware has to run before the middleware that starts our span, a sampling decision can't be changed afterwards.
+// the trace of a forced request gets the debug_trace label on its logs so they are easy to pull up together
+func (d *Debug) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !httpx.VerifyDebugHeader(d.secret, request.Header.Get(DebugTraceHeader), request.Method, request.URL.Path, d.now()) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ctx := ContextWithForcedSampling(request.Context())
+		ctx = logx.ContextWithLevel(ctx, zap.DebugLevel)
+		ctx = logx.ContextWithFields(ctx, zapdriver.Label("debug_trace", "true"))
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
@@ -0,0 +1,76 @@
+package tracex
+
+import (
+	"encoding/json"
+	"fmt"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Sampler is a parent based trace id ratio sampler whose ratio can be adjusted at runtime, this lets us turn up
+// sampling on a live revision while debugging without a redeploy
+type Sampler struct {
+	delegate atomic.Value
+	ratio    atomic.Value
+}
+
+func NewSampler(ratio float64) (*Sampler, error) {
+	s := &Sampler{}
+	if err := s.SetRatio(ratio); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetRatio swaps the underlying sampler, ratio is clamped between 0 and 1. NaN compares false to both bounds and would
+// slip through the clamp, it is rejected and the current ratio stays
+func (s *Sampler) SetRatio(ratio float64) error {
+	if math.IsNaN(ratio) {
+		return fmt.Errorf("tracex: sample ratio is NaN")
+	}
+	if ratio < 0 {
+		ratio = 0
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	s.delegate.Store(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)))
+	s.ratio.Store(ratio)
+	return nil
+}
+
+func (s *Sampler) Ratio() float64 {
+	return s.ratio.Load().(float64)
+}
+
+func (s *Sampler) ShouldSample(parameters sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	return s.delegate.Load().(sdktrace.Sampler).ShouldSample(parameters)
+}
+
+func (s *Sampler) Description() string {
+	return fmt.Sprintf("DynamicSampler{%s}", s.delegate.Load().(sdktrace.Sampler).Description())
+}
+
+// ServeHTTP reports the current ratio on GET and updates it on PUT with ?ratio=0.5
+func (s *Sampler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		ratio, err := strconv.ParseFloat(request.URL.Query().Get("ratio"), 64)
+		if err == nil {
+			err = s.SetRatio(ratio)
+		}
+		if err != nil {
+			http.Error(writer, "ratio query param must be a float between 0 and 1", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{"ratio": s.Ratio(), "description": s.Description()})
+}
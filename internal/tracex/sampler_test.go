@@ -0,0 +1,46 @@
+package tracex
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSamplerRatio(t *testing.T) {
+	if _, err := NewSampler(math.NaN()); err == nil {
+		t.Errorf("NewSampler(NaN) succeeded, want an error")
+	}
+
+	s, err := NewSampler(0.5)
+	if err != nil {
+		t.Fatalf("NewSampler(): %v", err)
+	}
+	tests := []struct {
+		ratio   float64
+		want    float64
+		wantErr bool
+	}{
+		{ratio: 0.25, want: 0.25},
+		{ratio: -1, want: 0},
+		{ratio: 2, want: 1},
+		{ratio: math.Inf(1), want: 1},
+		// NaN keeps whatever ratio we had
+		{ratio: math.NaN(), want: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := s.SetRatio(tt.ratio)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetRatio(%v) = %v, want an error %t", tt.ratio, err, tt.wantErr)
+		}
+		if got := s.Ratio(); got != tt.want {
+			t.Errorf("SetRatio(%v) left the ratio at %v, want %v", tt.ratio, got, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/tracing?ratio=NaN", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT ?ratio=NaN = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
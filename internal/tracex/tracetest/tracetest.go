@@ -0,0 +1,191 @@
+// Package tracetest records spans in memory so tests can check our instrumentation, not just our behavior
+//
+//	func TestHandler(t *testing.T) {
+//		rec := tracetest.Install(t)
+//		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/report", nil))
+//
+//		parent := rec.RequireSpan("server.handleReport()")
+//		rec.AssertChildOf(rec.RequireSpan("report.beers"), parent)
+//		rec.AssertEvent(parent, "stream.send", attribute.String("stream.event", "done"))
+//	}
+package tracetest
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	sdktracetest "go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Recorder holds every span that ended while it was installed
+type Recorder struct {
+	tb       testing.TB
+	exporter *sdktracetest.InMemoryExporter
+	provider *sdktrace.TracerProvider
+}
+
+var (
+	providerOnce sync.Once
+	provider     *sdktrace.TracerProvider
+)
+
+// Install records the spans of the test in memory, along with the w3c trace context propagator which is restored when
+// the test finishes. tests using Install must not run in parallel.
+//
+// every test binary shares one recording provider that samples everything, set as our global provider on first use and
+// left in place. tracers our packages keep in package variables only ever delegate to the first global provider, a
+// provider per test would leave every test but the first recording nothing
+func Install(tb testing.TB) *Recorder {
+	tb.Helper()
+	providerOnce.Do(func() {
+		provider = sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample()))
+		otel.SetTracerProvider(provider)
+	})
+	exporter := sdktracetest.NewInMemoryExporter()
+	// a simple processor exports each span as it ends, so spans are visible as soon as the code under test returns
+	processor := sdktrace.NewSimpleSpanProcessor(exporter)
+	provider.RegisterSpanProcessor(processor)
+
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tb.Cleanup(func() {
+		provider.UnregisterSpanProcessor(processor)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return &Recorder{tb: tb, exporter: exporter, provider: provider}
+}
+
+// Provider is the recording provider, for code that takes a provider instead of using the global one
+func (r *Recorder) Provider() *sdktrace.TracerProvider {
+	return r.provider
+}
+
+// Spans returns every ended span in the order they ended
+func (r *Recorder) Spans() []sdktrace.ReadOnlySpan {
+	return r.exporter.GetSpans().Snapshots()
+}
+
+// Reset forgets every recorded span
+func (r *Recorder) Reset() {
+	r.exporter.Reset()
+}
+
+// Find returns the spans named name that carry every one of attrs
+func (r *Recorder) Find(name string, attrs ...attribute.KeyValue) []sdktrace.ReadOnlySpan {
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range r.Spans() {
+		if span.Name() == name && hasAttributes(span, attrs) {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+// RequireSpan fails the test unless a span named name carries every one of attrs, and returns the first match
+func (r *Recorder) RequireSpan(name string, attrs ...attribute.KeyValue) sdktrace.ReadOnlySpan {
+	r.tb.Helper()
+	found := r.Find(name, attrs...)
+	if len(found) == 0 {
+		r.tb.Fatalf("no span %q with attributes %v, recorded:\n%s", name, attrs, r.dump())
+	}
+	return found[0]
+}
+
+// AssertNoSpan fails the test when a span named name was recorded
+func (r *Recorder) AssertNoSpan(name string) {
+	r.tb.Helper()
+	if found := r.Find(name); len(found) > 0 {
+		r.tb.Errorf("expected no span %q, found %d", name, len(found))
+	}
+}
+
+// AssertChildOf fails the test unless child is a direct child of parent
+func (r *Recorder) AssertChildOf(child, parent sdktrace.ReadOnlySpan) {
+	r.tb.Helper()
+	if child.Parent().SpanID() != parent.SpanContext().SpanID() || child.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+		r.tb.Errorf("span %q is not a child of %q", child.Name(), parent.Name())
+	}
+}
+
+// AssertSameTrace fails the test unless every span belongs to the same trace
+func (r *Recorder) AssertSameTrace(spans ...sdktrace.ReadOnlySpan) {
+	r.tb.Helper()
+	if len(spans) < 2 {
+		return
+	}
+	for _, span := range spans[1:] {
+		if span.SpanContext().TraceID() != spans[0].SpanContext().TraceID() {
+			r.tb.Errorf("span %q is not in the same trace as %q", span.Name(), spans[0].Name())
+		}
+	}
+}
+
+// AssertError fails the test unless span has an error status, and a description containing contains when non empty
+func (r *Recorder) AssertError(span sdktrace.ReadOnlySpan, contains string) {
+	r.tb.Helper()
+	status := span.Status()
+	if status.Code != codes.Error {
+		r.tb.Errorf("span %q has status %s, expected an error", span.Name(), status.Code)
+		return
+	}
+	if contains != "" && !strings.Contains(status.Description, contains) {
+		r.tb.Errorf("span %q error %q does not contain %q", span.Name(), status.Description, contains)
+	}
+}
+
+// AssertOK fails the test when span has an error status
+func (r *Recorder) AssertOK(span sdktrace.ReadOnlySpan) {
+	r.tb.Helper()
+	if status := span.Status(); status.Code == codes.Error {
+		r.tb.Errorf("span %q has an error status: %s", span.Name(), status.Description)
+	}
+}
+
+// AssertEvent fails the test unless span recorded an event named name carrying every one of attrs
+func (r *Recorder) AssertEvent(span sdktrace.ReadOnlySpan, name string, attrs ...attribute.KeyValue) {
+	r.tb.Helper()
+	for _, event := range span.Events() {
+		if event.Name == name && containsAll(event.Attributes, attrs) {
+			return
+		}
+	}
+	r.tb.Errorf("span %q has no event %q with attributes %v", span.Name(), name, attrs)
+}
+
+func hasAttributes(span sdktrace.ReadOnlySpan, attrs []attribute.KeyValue) bool {
+	return containsAll(span.Attributes(), attrs)
+}
+
+func containsAll(have, want []attribute.KeyValue) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h.Key == w.Key && h.Value == w.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// dump lists the recorded spans for failure messages
+func (r *Recorder) dump() string {
+	var b strings.Builder
+	for _, span := range r.Spans() {
+		fmt.Fprintf(&b, "  %s %v\n", span.Name(), span.Attributes())
+	}
+	if b.Len() == 0 {
+		return "  (none)"
+	}
+	return b.String()
+}
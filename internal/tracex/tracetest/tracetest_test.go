@@ -0,0 +1,120 @@
+package tracetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+// tracer is kept in a package variable like the tracers of our packages are
+var tracer = otel.Tracer("github.com/amammay/effectivecloudrun/internal/tracex/tracetest")
+
+// work starts a parent with a failing child and a healthy child, the shape of most handlers
+func work(ctx context.Context) {
+	ctx, parent := tracer.Start(ctx, "parent", trace.WithAttributes(attribute.String("route", "/api/report")))
+	defer parent.End()
+	parent.AddEvent("stream.send", trace.WithAttributes(attribute.String("stream.event", "done")))
+
+	_, failing := tracer.Start(ctx, "child", trace.WithAttributes(attribute.Int("attempt", 1)))
+	failing.RecordError(errors.New("upstream unavailable"))
+	failing.SetStatus(codes.Error, "upstream unavailable")
+	failing.End()
+
+	_, healthy := tracer.Start(ctx, "child", trace.WithAttributes(attribute.Int("attempt", 2)))
+	healthy.End()
+}
+
+func TestRecorder(t *testing.T) {
+	rec := Install(t)
+	work(context.Background())
+
+	if got := len(rec.Spans()); got != 3 {
+		t.Fatalf("recorded %d spans, want 3", got)
+	}
+	if got := len(rec.Find("child")); got != 2 {
+		t.Errorf("Find(child) = %d spans, want 2", got)
+	}
+
+	parent := rec.RequireSpan("parent", attribute.String("route", "/api/report"))
+	failing := rec.RequireSpan("child", attribute.Int("attempt", 1))
+	healthy := rec.RequireSpan("child", attribute.Int("attempt", 2))
+	rec.AssertChildOf(failing, parent)
+	rec.AssertChildOf(healthy, parent)
+	rec.AssertSameTrace(parent, failing, healthy)
+	rec.AssertError(failing, "unavailable")
+	rec.AssertOK(healthy)
+	rec.AssertOK(parent)
+	rec.AssertEvent(parent, "stream.send", attribute.String("stream.event", "done"))
+	rec.AssertNoSpan("grandchild")
+
+	rec.Reset()
+	if got := len(rec.Spans()); got != 0 {
+		t.Errorf("recorded %d spans after Reset(), want 0", got)
+	}
+}
+
+// TestRecorderPerTest checks that a second Install still records our package level tracer
+func TestRecorderPerTest(t *testing.T) {
+	rec := Install(t)
+	work(context.Background())
+	if got := len(rec.Spans()); got != 3 {
+		t.Fatalf("recorded %d spans, want 3", got)
+	}
+}
+
+func TestInstallRestoresPropagator(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	t.Run("installed", func(t *testing.T) {
+		Install(t)
+		if fields := otel.GetTextMapPropagator().Fields(); len(fields) != 2 || fields[0] != "traceparent" {
+			t.Errorf("propagator fields = %v, want traceparent and tracestate", fields)
+		}
+	})
+	if otel.GetTextMapPropagator() != previous {
+		t.Errorf("Install() didn't restore the propagator")
+	}
+}
+
+// recordingTB records the failures of our assertions instead of failing the test
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorderAssertionsFail(t *testing.T) {
+	rec := Install(t)
+	work(context.Background())
+	_, other := tracer.Start(context.Background(), "other")
+	other.End()
+
+	parent := rec.RequireSpan("parent")
+	failing := rec.RequireSpan("child", attribute.Int("attempt", 1))
+	healthy := rec.RequireSpan("child", attribute.Int("attempt", 2))
+	unrelated := rec.RequireSpan("other")
+
+	failures := &recordingTB{TB: t}
+	rec.tb = failures
+	rec.AssertChildOf(parent, healthy)
+	rec.AssertSameTrace(parent, unrelated)
+	rec.AssertError(healthy, "")
+	rec.AssertError(failing, "timeout")
+	rec.AssertOK(failing)
+	rec.AssertEvent(parent, "stream.send", attribute.String("stream.event", "error"))
+	rec.AssertNoSpan("parent")
+	rec.tb = t
+
+	if len(failures.errors) != 7 {
+		t.Errorf("assertions reported %d failures, want 7: %v", len(failures.errors), failures.errors)
+	}
+}
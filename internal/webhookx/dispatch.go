@@ -0,0 +1,274 @@
+package webhookx
+
+import (
+	"bytes"
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/clientx"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"github.com/amammay/effectivecloudrun/internal/retry"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeliveryStatus is where a delivery is in its lifecycle
+type DeliveryStatus string
+
+const (
+	StatusPending   DeliveryStatus = "pending"
+	StatusRetrying  DeliveryStatus = "retrying"
+	StatusDelivered DeliveryStatus = "delivered"
+	// StatusDead deliveries ran out of attempts, they stay in firestore as our dead letter queue
+	StatusDead DeliveryStatus = "dead"
+)
+
+// Delivery is a single webhook we owe a subscriber, stored in firestore so its status survives any instance
+type Delivery struct {
+	ID             string         `json:"id" firestore:"-"`
+	URL            string         `json:"url" firestore:"url"`
+	Event          string         `json:"event" firestore:"event"`
+	Payload        []byte         `json:"-" firestore:"payload"`
+	Status         DeliveryStatus `json:"status" firestore:"status"`
+	Attempts       int            `json:"attempts" firestore:"attempts"`
+	LastStatusCode int            `json:"last_status_code,omitempty" firestore:"last_status_code"`
+	LastError      string         `json:"last_error,omitempty" firestore:"last_error"`
+	NextAttempt    time.Time      `json:"next_attempt,omitempty" firestore:"next_attempt"`
+	Created        time.Time      `json:"created" firestore:"created"`
+	Updated        time.Time      `json:"updated" firestore:"updated"`
+}
+
+// Dispatcher delivers signed webhooks through a task queue, every attempt is its own task so a delivery can back off
+// for hours without holding on to an instance
+type Dispatcher struct {
+	collection string
+	deliveries *firestore.CollectionRef
+	queue      TaskQueue
+	secret     []byte
+	client     *clientx.Client
+	retry      retry.Policy
+	logger     *zap.SugaredLogger
+	now        func() time.Time
+}
+
+type DispatchOption func(d *Dispatcher)
+
+// WithDeliveryRetry controls backoff between attempts, MaxAttempts is when a delivery is dead lettered. defaults to 8
+// attempts starting at 30 seconds and backing off up to an hour
+func WithDeliveryRetry(policy retry.Policy) DispatchOption {
+	return func(d *Dispatcher) {
+		d.retry = policy
+	}
+}
+
+// WithDeliveryClient sets the client used to call subscribers, it shouldn't retry on its own
+func WithDeliveryClient(client *clientx.Client) DispatchOption {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithDeliveryCollection stores deliveries in collection, defaults to webhook_deliveries
+func WithDeliveryCollection(collection string) DispatchOption {
+	return func(d *Dispatcher) {
+		d.collection = collection
+	}
+}
+
+func WithDispatchLogger(logger *zap.SugaredLogger) DispatchOption {
+	return func(d *Dispatcher) {
+		d.logger = logger
+	}
+}
+
+func NewDispatcher(fs *firestore.Client, queue TaskQueue, secret []byte, opts ...DispatchOption) *Dispatcher {
+	d := &Dispatcher{
+		collection: "webhook_deliveries",
+		queue:      queue,
+		secret:     secret,
+		client:     clientx.New(clientx.WithTimeout(30 * time.Second)),
+		retry: retry.Policy{
+			MaxAttempts:    8,
+			InitialBackoff: 30 * time.Second,
+			MaxBackoff:     time.Hour,
+			Multiplier:     2,
+		},
+		logger: zap.NewNop().Sugar(),
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.deliveries = fs.Collection(d.collection)
+	return d
+}
+
+type deliverTask struct {
+	DeliveryID string `json:"delivery_id"`
+}
+
+// Enqueue records a delivery of payload to url and schedules its first attempt
+func (d *Dispatcher) Enqueue(ctx context.Context, url, event string, payload interface{}) (*Delivery, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errs.Wrapf(err, errs.InvalidArgument, "json.Marshal()")
+	}
+	now := d.now()
+	doc := d.deliveries.NewDoc()
+	delivery := &Delivery{
+		ID:      doc.ID,
+		URL:     url,
+		Event:   event,
+		Payload: body,
+		Status:  StatusPending,
+		Created: now,
+		Updated: now,
+	}
+	if _, err := doc.Create(ctx, delivery); err != nil {
+		return nil, errs.Wrapf(err, errs.Unknown, "doc.Create()")
+	}
+	if err := d.schedule(ctx, delivery.ID, 1, now); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (d *Dispatcher) schedule(ctx context.Context, id string, attempt int, at time.Time) error {
+	body, err := json.Marshal(deliverTask{DeliveryID: id})
+	if err != nil {
+		return errs.Wrapf(err, errs.Internal, "json.Marshal()")
+	}
+	if err := d.queue.Schedule(ctx, id+"-"+strconv.Itoa(attempt), at, body); err != nil {
+		return errs.Wrapf(err, errs.Unavailable, "queue.Schedule()")
+	}
+	return nil
+}
+
+// Get returns a delivery and its current status
+func (d *Dispatcher) Get(ctx context.Context, id string) (*Delivery, error) {
+	snapshot, err := d.deliveries.Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, errs.New(errs.NotFound, "delivery not found")
+	}
+	if err != nil {
+		return nil, errs.Wrapf(err, errs.Unknown, "doc.Get()")
+	}
+	delivery := &Delivery{}
+	if err := snapshot.DataTo(delivery); err != nil {
+		return nil, errs.Wrapf(err, errs.Internal, "snapshot.DataTo()")
+	}
+	delivery.ID = snapshot.Ref.ID
+	return delivery, nil
+}
+
+// Deliver makes one attempt at a delivery, on failure it either schedules the next attempt or dead letters it
+func (d *Dispatcher) Deliver(ctx context.Context, id string) error {
+	delivery, err := d.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if delivery.Status == StatusDelivered || delivery.Status == StatusDead {
+		// a duplicate task, cloud tasks delivers at least once
+		return nil
+	}
+
+	delivery.Attempts++
+	code, attemptErr := d.post(ctx, delivery)
+	now := d.now()
+	delivery.LastStatusCode = code
+	delivery.Updated = now
+	delivery.NextAttempt = time.Time{}
+	logger := d.logger.With("delivery_id", id, "url", delivery.URL, "attempt", delivery.Attempts)
+
+	switch {
+	case attemptErr == nil:
+		delivery.Status = StatusDelivered
+		delivery.LastError = ""
+		logger.Infow("webhook delivered", "status", code)
+	case delivery.Attempts >= d.retry.MaxAttempts:
+		delivery.Status = StatusDead
+		delivery.LastError = attemptErr.Error()
+		logger.Errorw("webhook dead lettered", "err", attemptErr)
+	default:
+		delivery.Status = StatusRetrying
+		delivery.LastError = attemptErr.Error()
+		delivery.NextAttempt = now.Add(d.retry.Backoff(delivery.Attempts))
+		logger.Warnw("webhook delivery failed, retrying", "err", attemptErr, "next_attempt", delivery.NextAttempt)
+	}
+
+	// schedule before saving, if saving fails the next attempt still happens and cleans up after us
+	if delivery.Status == StatusRetrying {
+		if err := d.schedule(ctx, id, delivery.Attempts+1, delivery.NextAttempt); err != nil {
+			return err
+		}
+	}
+	if _, err := d.deliveries.Doc(id).Set(ctx, delivery); err != nil {
+		return errs.Wrapf(err, errs.Unknown, "doc.Set()")
+	}
+	return nil
+}
+
+func (d *Dispatcher) post(ctx context.Context, delivery *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("http.NewRequestWithContext(): %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", delivery.ID)
+	req.Header.Set("Webhook-Event", delivery.Event)
+	req.Header.Set(SignatureHeader, Sign(d.secret, delivery.Payload, d.now()))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("client.Do(): %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// DeliverHandler is the target of our task queue. failing to reach the subscriber is not an error here, we only ask
+// cloud tasks to retry when we couldn't record the outcome
+func (d *Dispatcher) DeliverHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var task deliverTask
+		if err := json.NewDecoder(request.Body).Decode(&task); err != nil || task.DeliveryID == "" {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "delivery_id is required"))
+			return
+		}
+		if err := d.Deliver(request.Context(), task.DeliveryID); err != nil {
+			d.logger.Errorw("d.Deliver()", "delivery_id", task.DeliveryID, "err", err)
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// StatusHandler serves GET ?id=<delivery id>
+func (d *Dispatcher) StatusHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.URL.Query().Get("id")
+		if id == "" {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "id is required"))
+			return
+		}
+		delivery, err := d.Get(request.Context(), id)
+		if err != nil {
+			httpx.RespondError(writer, request, err)
+			return
+		}
+		httpx.RespondJSON(writer, delivery, http.StatusOK)
+	}
+}
@@ -0,0 +1,67 @@
+package webhookx
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/api/cloudtasks/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"net/http"
+	"time"
+)
+
+// TaskQueue schedules a call back into our deliver handler, name is deterministic per attempt so scheduling the same
+// attempt twice is a no-op
+type TaskQueue interface {
+	Schedule(ctx context.Context, name string, at time.Time, body []byte) error
+}
+
+// CloudTasksQueue schedules http tasks on a cloud tasks queue, authenticated with an identity token for our own
+// cloud run service
+type CloudTasksQueue struct {
+	tasks          *cloudtasks.ProjectsLocationsQueuesTasksService
+	queue          string
+	target         string
+	serviceAccount string
+}
+
+// NewCloudTasksQueue targets queue (projects/p/locations/l/queues/q), posting to target, the full url of our deliver
+// handler. serviceAccount needs run.invoker on our service
+func NewCloudTasksQueue(ctx context.Context, queue, target, serviceAccount string, opts ...option.ClientOption) (*CloudTasksQueue, error) {
+	svc, err := cloudtasks.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cloudtasks.NewService(): %v", err)
+	}
+	return &CloudTasksQueue{
+		tasks:          svc.Projects.Locations.Queues.Tasks,
+		queue:          queue,
+		target:         target,
+		serviceAccount: serviceAccount,
+	}, nil
+}
+
+func (q *CloudTasksQueue) Schedule(ctx context.Context, name string, at time.Time, body []byte) error {
+	task := &cloudtasks.Task{
+		Name:         q.queue + "/tasks/" + name,
+		ScheduleTime: at.UTC().Format(time.RFC3339Nano),
+		HttpRequest: &cloudtasks.HttpRequest{
+			HttpMethod: http.MethodPost,
+			Url:        q.target,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       base64.StdEncoding.EncodeToString(body),
+			OidcToken:  &cloudtasks.OidcToken{ServiceAccountEmail: q.serviceAccount},
+		},
+	}
+	_, err := q.tasks.Create(q.queue, &cloudtasks.CreateTaskRequest{Task: task}).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		// this attempt was already scheduled, tasks are deduplicated by name
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tasks.Create(): %v", err)
+	}
+	return nil
+}
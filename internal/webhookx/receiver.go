@@ -0,0 +1,161 @@
+package webhookx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxval"
+	"github.com/amammay/effectivecloudrun/internal/dedupe"
+	"github.com/amammay/effectivecloudrun/internal/errs"
+	"github.com/amammay/effectivecloudrun/internal/httpx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// rawBodyKey shows the size of a body in a ctxval.Dump, never what it says
+var rawBodyKey = ctxval.New("webhookx.raw_body", ctxval.WithFormat(func(v interface{}) string {
+	return fmt.Sprintf("%d bytes", len(v.([]byte)))
+}))
+
+// RawBody returns the exact bytes that were verified, decode from this rather than re-reading the request so nothing
+// in between can change what was signed
+func RawBody(ctx context.Context) []byte {
+	b, _ := rawBodyKey.Value(ctx)
+	body, _ := b.([]byte)
+	return body
+}
+
+// Receiver verifies webhook signatures before handing the request to the next handler
+type Receiver struct {
+	verifier    Verifier
+	store       dedupe.Store
+	replayTTL   time.Duration
+	seen        *dedupe.Deduper
+	maxBody     int64
+	deliveryIDs []string
+	now         func() time.Time
+}
+
+type ReceiverOption func(r *Receiver)
+
+// WithReplayStore remembers the deliveries we have seen in store for ttl, defaults to an in memory store for an hour.
+// use a shared store such as dedupe.Firestore when running more than one instance
+func WithReplayStore(store dedupe.Store, ttl time.Duration) ReceiverOption {
+	return func(r *Receiver) {
+		r.store = store
+		r.replayTTL = ttl
+	}
+}
+
+// WithMaxBodyBytes bounds the payload we are willing to buffer, defaults to 1MiB
+func WithMaxBodyBytes(n int64) ReceiverOption {
+	return func(r *Receiver) {
+		r.maxBody = n
+	}
+}
+
+// WithDeliveryIDHeaders names headers carrying a unique delivery id, used as the replay key instead of the signature
+func WithDeliveryIDHeaders(headers ...string) ReceiverOption {
+	return func(r *Receiver) {
+		r.deliveryIDs = append(r.deliveryIDs, headers...)
+	}
+}
+
+func NewReceiver(verifier Verifier, opts ...ReceiverOption) *Receiver {
+	r := &Receiver{
+		verifier:    verifier,
+		store:       dedupe.NewMemory(),
+		replayTTL:   time.Hour,
+		maxBody:     1 << 20,
+		deliveryIDs: []string{"X-GitHub-Delivery", "Webhook-Id"},
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.seen = dedupe.New(r.store, "webhook", dedupe.WithTTL(r.replayTTL), dedupe.WithClock(r.now))
+	return r
+}
+
+// Middleware buffers and verifies the body, put it ahead of anything else that reads the body. duplicates are
+// acknowledged with a 200 without calling next, since senders retry anything else. a delivery next answers with a 5xx
+// isn't remembered, its retry runs next again
+func (rc *Receiver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, rc.maxBody+1))
+		request.Body.Close()
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.InvalidArgument, "ioutil.ReadAll()"))
+			return
+		}
+		if int64(len(body)) > rc.maxBody {
+			httpx.RespondError(writer, request, errs.New(errs.InvalidArgument, "payload too large"))
+			return
+		}
+
+		signature, err := rc.verifier.Verify(request, body, rc.now())
+		if err != nil {
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unauthenticated, "verifier.Verify()"))
+			return
+		}
+
+		ctx := request.Context()
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request = request.WithContext(rawBodyKey.With(ctx, body))
+		ran := false
+		err = rc.process(ctx, rc.replayKeys(request, signature), func(ctx context.Context) error {
+			ran = true
+			wrapped, rec := httpx.Record(writer, 0)
+			next.ServeHTTP(wrapped, request)
+			if rec.Status >= http.StatusInternalServerError {
+				return fmt.Errorf("status %d", rec.Status)
+			}
+			return nil
+		})
+		switch {
+		case ran:
+			// the handler responded, failing to settle its keys only means a retry may run it again
+		case errors.Is(err, dedupe.ErrDuplicate):
+			httpx.RespondJSON(writer, map[string]string{"status": "duplicate"}, http.StatusOK)
+		case errors.Is(err, dedupe.ErrInProgress):
+			httpx.RespondJSON(writer, &httpx.ErrorResponse{Code: "in_progress", Message: "already being processed, retry later"}, http.StatusConflict)
+		case err != nil:
+			httpx.RespondError(writer, request, errs.Wrapf(err, errs.Unavailable, "rc.process()"))
+		}
+	})
+}
+
+// process runs fn once every replay key is claimed. the keys are only kept once fn succeeded, a delivery our handler
+// failed is released so the retry of its sender runs it again
+func (rc *Receiver) process(ctx context.Context, keys []string, fn func(ctx context.Context) error) error {
+	if len(keys) == 0 {
+		return fn(ctx)
+	}
+	return rc.seen.Do(ctx, keys[0], func(ctx context.Context) error {
+		return rc.process(ctx, keys[1:], fn)
+	})
+}
+
+// replayKeys are the signature, and the delivery id when the sender sends one. a delivery id catches the senders own
+// retries, which are signed again, but the id header itself is rarely signed so a replayed request could simply
+// change it. the signature catches those
+func (rc *Receiver) replayKeys(r *http.Request, signature string) []string {
+	sum := sha256.Sum256([]byte(signature))
+	keys := []string{"sig:" + hex.EncodeToString(sum[:])}
+	for _, header := range rc.deliveryIDs {
+		if id := r.Header.Get(header); id != "" {
+			return append(keys, "id:"+id)
+		}
+	}
+	return keys
+}
+
+// IsVerificationError reports whether err came from a failed signature check
+func IsVerificationError(err error) bool {
+	return errors.Is(err, ErrMissingSignature) || errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrExpired)
+}
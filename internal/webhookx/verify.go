@@ -0,0 +1,159 @@
+package webhookx
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingSignature is returned when the signature header is absent
+	ErrMissingSignature = errors.New("webhookx: missing signature")
+	// ErrInvalidSignature is returned when no signature matches the payload
+	ErrInvalidSignature = errors.New("webhookx: invalid signature")
+	// ErrExpired is returned when the signed timestamp is outside of our tolerance
+	ErrExpired = errors.New("webhookx: timestamp outside of tolerance")
+)
+
+// SignatureHeader is the header our own Dispatcher signs deliveries with, in the same format Stripe uses
+const SignatureHeader = "Webhook-Signature"
+
+// Verifier checks the signature of a webhook, body is the raw payload exactly as it was received. it returns the
+// signature it verified which the Receiver uses as a replay key. the signature is returned in a canonical form, not as
+// the raw header, otherwise a replayed request could dodge the replay check by reordering or re-casing the header
+type Verifier interface {
+	Verify(r *http.Request, body []byte, now time.Time) (string, error)
+}
+
+// VerifierFunc adapts a function into a Verifier
+type VerifierFunc func(r *http.Request, body []byte, now time.Time) (string, error)
+
+func (f VerifierFunc) Verify(r *http.Request, body []byte, now time.Time) (string, error) {
+	return f(r, body, now)
+}
+
+func sign(secret []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// GitHub verifies X-Hub-Signature-256: sha256=<hex hmac of body>. github doesn't sign a timestamp so replay protection
+// relies on the X-GitHub-Delivery id
+func GitHub(secret []byte) Verifier {
+	return VerifierFunc(func(r *http.Request, body []byte, now time.Time) (string, error) {
+		header := r.Header.Get("X-Hub-Signature-256")
+		if header == "" {
+			return "", ErrMissingSignature
+		}
+		got, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+		if err != nil || !hmac.Equal(got, sign(secret, body)) {
+			return "", ErrInvalidSignature
+		}
+		return "sha256=" + hex.EncodeToString(got), nil
+	})
+}
+
+// TimestampedHMAC verifies "t=<unix>,v1=<hex hmac of t.body>" headers, several v1 entries are allowed so senders can
+// rotate secrets. any of secrets may match
+func TimestampedHMAC(header string, tolerance time.Duration, secrets ...[]byte) Verifier {
+	return VerifierFunc(func(r *http.Request, body []byte, now time.Time) (string, error) {
+		value := r.Header.Get(header)
+		if value == "" {
+			return "", ErrMissingSignature
+		}
+		ts, signatures := parseTimestamped(value)
+		if ts == "" || len(signatures) == 0 {
+			return "", ErrInvalidSignature
+		}
+		if err := checkTimestamp(ts, tolerance, now); err != nil {
+			return "", err
+		}
+		for _, secret := range secrets {
+			expected := sign(secret, []byte(ts), []byte("."), body)
+			for _, sig := range signatures {
+				if got, err := hex.DecodeString(sig); err == nil && hmac.Equal(got, expected) {
+					return "t=" + ts + ",v1=" + hex.EncodeToString(got), nil
+				}
+			}
+		}
+		return "", ErrInvalidSignature
+	})
+}
+
+// Stripe verifies the Stripe-Signature header with stripe's default tolerance of 5 minutes
+func Stripe(secret []byte) Verifier {
+	return TimestampedHMAC("Stripe-Signature", 5*time.Minute, secret)
+}
+
+// Ed25519 verifies an asymmetric signature of timestamp+body, in the headers Discord uses:
+// X-Signature-Ed25519 (hex) and X-Signature-Timestamp
+func Ed25519(publicKey ed25519.PublicKey, tolerance time.Duration) Verifier {
+	return VerifierFunc(func(r *http.Request, body []byte, now time.Time) (string, error) {
+		sigHeader, ts := r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp")
+		if sigHeader == "" || ts == "" {
+			return "", ErrMissingSignature
+		}
+		if err := checkTimestamp(ts, tolerance, now); err != nil {
+			return "", err
+		}
+		sig, err := hex.DecodeString(sigHeader)
+		if err != nil {
+			return "", ErrInvalidSignature
+		}
+		msg := make([]byte, 0, len(ts)+len(body))
+		msg = append(append(msg, ts...), body...)
+		if !ed25519.Verify(publicKey, msg, sig) {
+			return "", ErrInvalidSignature
+		}
+		return hex.EncodeToString(sig), nil
+	})
+}
+
+func parseTimestamped(value string) (string, []string) {
+	var ts string
+	var signatures []string
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	return ts, signatures
+}
+
+func checkTimestamp(ts string, tolerance time.Duration, now time.Time) error {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if tolerance <= 0 {
+		return nil
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: signed %s ago", ErrExpired, age.Truncate(time.Second))
+	}
+	return nil
+}
+
+// Sign produces a SignatureHeader value for body, used by Dispatcher and handy for testing a receiver by hand
+func Sign(secret, body []byte, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(sign(secret, []byte(ts), []byte("."), body))
+}
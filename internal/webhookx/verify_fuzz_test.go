@@ -0,0 +1,113 @@
+//go:build go1.18
+// +build go1.18
+
+package webhookx
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	fuzzSecret = []byte("fuzz-secret")
+	fuzzNow    = time.Unix(1627776000, 0)
+)
+
+// FuzzTimestampedHMAC throws headers at the verifier every receiver of ours uses for signed timestamps. nothing a
+// sender picks may panic it, a signature it accepts has to be one we made for the body, and the replay key it returns
+// has to be canonical, verifying the key itself yields the same key
+func FuzzTimestampedHMAC(f *testing.F) {
+	body := []byte(`{"type":"ping"}`)
+	f.Add(Sign(fuzzSecret, body, fuzzNow), body)
+	f.Add("t=1627776000,v1=00,v1="+Sign(fuzzSecret, body, fuzzNow)[len("t=1627776000,v1="):], body)
+	f.Add(" v1=abc , t=1627776000 ,x", body)
+	f.Add("t=-1,v1=", []byte{})
+	f.Add("t=99999999999999999999,v1=zz", body)
+	f.Add("t=1627776000,t=1,v1=AB", body)
+	verifier := TimestampedHMAC(SignatureHeader, 5*time.Minute, fuzzSecret)
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		request := httptest.NewRequest("POST", "/webhooks/internal", nil)
+		request.Header.Set(SignatureHeader, header)
+		key, err := verifier.Verify(request, body, fuzzNow)
+		if err != nil {
+			if !IsVerificationError(err) {
+				t.Fatalf("Verify() = %v, not a verification error", err)
+			}
+			return
+		}
+
+		ts, signatures := parseTimestamped(key)
+		if len(signatures) != 1 {
+			t.Fatalf("Verify() returned %q, a canonical key has a single signature", key)
+		}
+		if want := hex.EncodeToString(sign(fuzzSecret, []byte(ts), []byte("."), body)); signatures[0] != want {
+			t.Fatalf("Verify() accepted %q for a body signed %s", header, want)
+		}
+		request.Header.Set(SignatureHeader, key)
+		again, err := verifier.Verify(request, body, fuzzNow)
+		if err != nil || again != key {
+			t.Fatalf("Verify(%q) = %q, %v, want the key back unchanged", key, again, err)
+		}
+	})
+}
+
+// FuzzGitHub is FuzzTimestampedHMAC for the X-Hub-Signature-256 header
+func FuzzGitHub(f *testing.F) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	f.Add("sha256="+hex.EncodeToString(sign(fuzzSecret, body)), body)
+	f.Add("sha256="+hex.EncodeToString(sign(fuzzSecret, body))[:10], body)
+	f.Add("SHA256=AB", body)
+	f.Add("sha256=", []byte{})
+	verifier := GitHub(fuzzSecret)
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		request := httptest.NewRequest("POST", "/webhooks/github", nil)
+		request.Header.Set("X-Hub-Signature-256", header)
+		key, err := verifier.Verify(request, body, fuzzNow)
+		if err != nil {
+			if !IsVerificationError(err) {
+				t.Fatalf("Verify() = %v, not a verification error", err)
+			}
+			return
+		}
+		if want := "sha256=" + hex.EncodeToString(sign(fuzzSecret, body)); key != want {
+			t.Fatalf("Verify() accepted %q as %q, the body is signed %s", header, key, want)
+		}
+	})
+}
+
+// FuzzEd25519 checks the verifier never accepts a signature our key didn't make and always returns it in lowercase
+func FuzzEd25519(f *testing.F) {
+	seed := make([]byte, ed25519.SeedSize)
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	body := []byte(`{"type":1}`)
+	ts := "1627776000"
+	signature := hex.EncodeToString(ed25519.Sign(privateKey, append([]byte(ts), body...)))
+	f.Add(signature, ts, body)
+	f.Add(signature, "1627776001", body)
+	f.Add("zz", ts, body)
+	f.Add("", "", []byte{})
+	verifier := Ed25519(publicKey, 5*time.Minute)
+	f.Fuzz(func(t *testing.T, signature, ts string, body []byte) {
+		request := httptest.NewRequest("POST", "/webhooks/discord", nil)
+		request.Header.Set("X-Signature-Ed25519", signature)
+		request.Header.Set("X-Signature-Timestamp", ts)
+		key, err := verifier.Verify(request, body, fuzzNow)
+		if err != nil {
+			if !IsVerificationError(err) {
+				t.Fatalf("Verify() = %v, not a verification error", err)
+			}
+			return
+		}
+		sig, err := hex.DecodeString(key)
+		if err != nil || hex.EncodeToString(sig) != key {
+			t.Fatalf("Verify() returned %q, not lowercase hex", key)
+		}
+		if !ed25519.Verify(publicKey, append([]byte(ts), body...), sig) {
+			t.Fatalf("Verify() accepted %q for %q", signature, body)
+		}
+	})
+}
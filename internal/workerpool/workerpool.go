@@ -0,0 +1,323 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amammay/effectivecloudrun/internal/ctxutil"
+	"github.com/amammay/effectivecloudrun/internal/limits"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const instrumentationName = "github.com/amammay/effectivecloudrun/internal/workerpool"
+
+// ErrClosed is returned when submitting to a pool that is shutting down
+var ErrClosed = errors.New("workerpool: pool is closed")
+
+// Job is a unit of work, ctx carries the values of the context it was submitted with and is cancelled by its timeout
+// or when the pool is forced to stop
+type Job func(ctx context.Context) error
+
+type job struct {
+	ctx      context.Context
+	fn       Job
+	enqueued time.Time
+}
+
+// Pool runs jobs on a fixed number of goroutines sized to the cpu our container is actually allowed to use
+type Pool struct {
+	name       string
+	size       int
+	jobs       chan job
+	jobTimeout time.Duration
+	logger     *zap.SugaredLogger
+
+	// base is cancelled when Shutdown runs out of time, stopping every running job
+	base       context.Context
+	baseCancel context.CancelFunc
+
+	// mu is only held to check closed and count a sender in, never across a send, so Shutdown can't wait on it
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	senders sync.WaitGroup
+	drain   sync.Once
+	wg      sync.WaitGroup
+
+	queued int64
+	active int64
+
+	completed metric.Int64Counter
+	wait      metric.Float64ValueRecorder
+	duration  metric.Float64ValueRecorder
+}
+
+type config struct {
+	name          string
+	size          int
+	workersPerCPU int
+	concurrency   int
+	queueSize     int
+	jobTimeout    time.Duration
+	logger        *zap.SugaredLogger
+}
+
+type Option func(c *config)
+
+// WithName labels our metrics and logs
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithSize fixes the number of workers, overriding any cpu based sizing
+func WithSize(n int) Option {
+	return func(c *config) {
+		c.size = n
+	}
+}
+
+// WithWorkersPerCPU sizes the pool as a multiple of our cpu limit, defaults to 2. io bound work wants more
+func WithWorkersPerCPU(n int) Option {
+	return func(c *config) {
+		c.workersPerCPU = n
+	}
+}
+
+// WithConcurrency caps the pool at the cloud run concurrency setting, there is little point in running more jobs at
+// once than requests we accept
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		c.concurrency = n
+	}
+}
+
+// WithQueueSize bounds the number of jobs waiting for a worker, defaults to the pool size
+func WithQueueSize(n int) Option {
+	return func(c *config) {
+		c.queueSize = n
+	}
+}
+
+// WithJobTimeout bounds every job
+func WithJobTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.jobTimeout = d
+	}
+}
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+func New(opts ...Option) (*Pool, error) {
+	c := &config{name: "default", workersPerCPU: 2, logger: zap.NewNop().Sugar()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	size := c.size
+	if size <= 0 {
+		size = limits.CPUs() * c.workersPerCPU
+	}
+	if c.concurrency > 0 && size > c.concurrency {
+		size = c.concurrency
+	}
+	if size < 1 {
+		size = 1
+	}
+	queueSize := c.queueSize
+	if queueSize <= 0 {
+		queueSize = size
+	}
+
+	// cancelled by Close, tasks carry their submitter's values but never its cancellation
+	base, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		name:       c.name,
+		size:       size,
+		jobs:       make(chan job, queueSize),
+		jobTimeout: c.jobTimeout,
+		logger:     c.logger,
+		base:       base,
+		baseCancel: cancel,
+		closing:    make(chan struct{}),
+	}
+	if err := p.registerMetrics(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("p.registerMetrics(): %v", err)
+	}
+
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go p.worker()
+	}
+	p.logger.Infow("worker pool started", "pool", p.name, "workers", size, "queue", queueSize, "cpu_limit", limits.CPU())
+	return p, nil
+}
+
+func (p *Pool) registerMetrics() error {
+	meter := global.Meter(instrumentationName)
+	labels := []attribute.KeyValue{attribute.String("pool", p.name)}
+	var err error
+	if p.completed, err = meter.NewInt64Counter("workerpool.jobs", metric.WithDescription("completed jobs by outcome")); err != nil {
+		return err
+	}
+	if p.wait, err = meter.NewFloat64ValueRecorder("workerpool.queue_wait", metric.WithDescription("time jobs spent queued"), metric.WithUnit("ms")); err != nil {
+		return err
+	}
+	if p.duration, err = meter.NewFloat64ValueRecorder("workerpool.job_duration", metric.WithDescription("job run time"), metric.WithUnit("ms")); err != nil {
+		return err
+	}
+	_, err = meter.NewInt64ValueObserver("workerpool.queue_depth", func(ctx context.Context, result metric.Int64ObserverResult) {
+		result.Observe(atomic.LoadInt64(&p.queued), labels...)
+	}, metric.WithDescription("jobs waiting for a worker"))
+	if err != nil {
+		return err
+	}
+	_, err = meter.NewInt64ValueObserver("workerpool.active", func(ctx context.Context, result metric.Int64ObserverResult) {
+		result.Observe(atomic.LoadInt64(&p.active), labels...)
+	}, metric.WithDescription("jobs currently running"))
+	return err
+}
+
+// Size is the number of workers
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// QueueDepth is the number of jobs waiting for a worker
+func (p *Pool) QueueDepth() int {
+	return int(atomic.LoadInt64(&p.queued))
+}
+
+// Submit blocks until the job is queued or ctx is done. the job keeps the values of ctx, but not its cancellation, so
+// a request can hand off work that outlives it
+func (p *Pool) Submit(ctx context.Context, fn Job) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrClosed
+	}
+	// Shutdown only closes our jobs once every sender it let in has left
+	p.senders.Add(1)
+	p.mu.RUnlock()
+	defer p.senders.Done()
+
+	j := job{ctx: ctxutil.Detach(ctx), fn: fn, enqueued: time.Now()}
+	select {
+	case p.jobs <- j:
+		atomic.AddInt64(&p.queued, 1)
+		return nil
+	case <-p.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TrySubmit queues the job only if there is room, useful for shedding work under load
+func (p *Pool) TrySubmit(ctx context.Context, fn Job) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.jobs <- job{ctx: ctxutil.Detach(ctx), fn: fn, enqueued: time.Now()}:
+		atomic.AddInt64(&p.queued, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for j := range p.jobs {
+		atomic.AddInt64(&p.queued, -1)
+		p.run(j)
+	}
+}
+
+func (p *Pool) run(j job) {
+	atomic.AddInt64(&p.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+	// stop the job if the pool is forced to stop
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-p.base.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	if p.jobTimeout > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeout(ctx, p.jobTimeout)
+		defer timeoutCancel()
+	}
+
+	start := time.Now()
+	p.wait.Record(ctx, float64(start.Sub(j.enqueued))/float64(time.Millisecond), attribute.String("pool", p.name))
+
+	outcome := "ok"
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				outcome = "panic"
+				p.logger.Errorw("worker pool job panicked", "pool", p.name, "panic", r)
+			}
+		}()
+		if err := j.fn(ctx); err != nil {
+			outcome = "error"
+			p.logger.Warnw("worker pool job failed", "pool", p.name, "err", err)
+		}
+	}()
+
+	labels := []attribute.KeyValue{attribute.String("pool", p.name), attribute.String("outcome", outcome)}
+	p.duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), labels...)
+	p.completed.Add(ctx, 1, labels...)
+}
+
+// Shutdown stops accepting jobs and waits for queued and running jobs to finish. if ctx is done first every running
+// job is cancelled, the signature matches serverx.Server.OnShutdown
+func (p *Pool) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.drain.Do(func() {
+			p.mu.Lock()
+			p.closed = true
+			close(p.closing)
+			p.mu.Unlock()
+			// senders blocked on a full queue give up on closing, after that nobody sends on jobs anymore
+			p.senders.Wait()
+			close(p.jobs)
+		})
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.baseCancel()
+		p.logger.Infow("worker pool drained", "pool", p.name)
+		return nil
+	case <-ctx.Done():
+		p.baseCancel()
+		<-done
+		return fmt.Errorf("workerpool %s: drain did not finish: %w", p.name, ctx.Err())
+	}
+}
@@ -0,0 +1,66 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownWithSubmitBlocked(t *testing.T) {
+	p, err := New(WithName("blocked"), WithSize(1), WithQueueSize(1))
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	// keep the only worker busy and fill the queue, the next Submit waits for room
+	release := make(chan struct{})
+	started := make(chan struct{})
+	if err := p.Submit(context.Background(), func(ctx context.Context) error {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Submit(): %v", err)
+	}
+	<-started
+	if err := p.Submit(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("Submit(): %v", err)
+	}
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- p.Submit(context.Background(), func(ctx context.Context) error { return nil })
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- p.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-submitted:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Submit() during Shutdown = %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Submit() still blocked after Shutdown")
+	}
+	select {
+	case err := <-shutdown:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown() did not return once its context was done")
+	}
+	close(release)
+
+	if err := p.Submit(context.Background(), func(ctx context.Context) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("Submit() after Shutdown = %v, want %v", err, ErrClosed)
+	}
+}